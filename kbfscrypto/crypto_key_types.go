@@ -403,6 +403,7 @@ func MakeTLFCryptKeyServerHalfID(
 	if err != nil {
 		return TLFCryptKeyServerHalfID{}, err
 	}
+	defer zeroBytes(key)
 	data := append(user.ToBytes(), devicePubKey.KID().ToBytes()...)
 	hmac, err := kbfshash.DefaultHMAC(key, data)
 	if err != nil {
@@ -422,6 +423,7 @@ func VerifyTLFCryptKeyServerHalfID(
 	if err != nil {
 		return err
 	}
+	defer zeroBytes(key)
 	data := append(user.ToBytes(), devicePubKey.KID().ToBytes()...)
 	return serverHalfID.ID.Verify(key, data)
 }
@@ -489,8 +491,10 @@ func DecryptTLFCryptKeyClientHalf(
 
 	publicKeyData := publicKey.Data()
 	privateKeyData := privateKey.Data()
+	defer zeroBytes(privateKeyData[:])
 	decryptedData, ok := box.Open(nil, encryptedClientHalf.EncryptedData,
 		&nonce, &publicKeyData, &privateKeyData)
+	defer zeroBytes(decryptedData)
 	if !ok {
 		return TLFCryptKeyClientHalf{},
 			errors.WithStack(libkb.DecryptionError{})
@@ -618,6 +622,23 @@ func MakeBlockCryptKey(data [32]byte) BlockCryptKey {
 	return BlockCryptKey{privateByte32Container{data}}
 }
 
+// LocalStorageKey is used to encrypt/decrypt data that KBFS keeps on
+// the local disk, like journals, so that it can't be read off a
+// stolen disk.  It's derived from the current device's key, and so
+// is never sent anywhere.
+type LocalStorageKey struct {
+	// Should only be used by implementations of Crypto.
+	privateByte32Container
+}
+
+// MakeLocalStorageKey returns a LocalStorageKey containing the given
+// data.
+//
+// Copies of LocalStorageKey objects are deep copies.
+func MakeLocalStorageKey(data [32]byte) LocalStorageKey {
+	return LocalStorageKey{privateByte32Container{data}}
+}
+
 func xorKeys(x, y [32]byte) [32]byte {
 	var res [32]byte
 	for i := 0; i < 32; i++ {
@@ -5,6 +5,7 @@
 package kbfscrypto
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"reflect"
@@ -26,6 +27,41 @@ const (
 	EncryptionSecretbox EncryptionVer = 1
 )
 
+// DefaultEncryptionVer is the encryption version used for the data of
+// new key generations.
+const DefaultEncryptionVer = EncryptionSecretbox
+
+// IsSupported returns whether this client knows how to encrypt and
+// decrypt data with the given encryption version.
+func (v EncryptionVer) IsSupported() bool {
+	switch v {
+	case EncryptionSecretbox:
+		return true
+	default:
+		return false
+	}
+}
+
+// NegotiateEncryptionVer returns the encryption version to use for
+// the data of a new key generation, given the version used by the
+// previous key generation (or zero if there isn't one). The version
+// is never lowered, so that a rekey can't be used to downgrade a
+// TLF's cipher, and it must be supported by this client; otherwise
+// an UnknownEncryptionVer error is returned, and the rekey must be
+// left to a newer client.
+func NegotiateEncryptionVer(prev EncryptionVer) (EncryptionVer, error) {
+	if prev == 0 {
+		return DefaultEncryptionVer, nil
+	}
+	if !prev.IsSupported() {
+		return 0, errors.WithStack(UnknownEncryptionVer{prev})
+	}
+	if prev > DefaultEncryptionVer {
+		return prev, nil
+	}
+	return DefaultEncryptionVer, nil
+}
+
 func (v EncryptionVer) String() string {
 	switch v {
 	case EncryptionSecretbox:
@@ -130,7 +166,9 @@ func EncryptTLFCryptKeyClientHalf(
 	}
 
 	clientHalfData := clientHalf.Data()
+	defer zeroBytes(clientHalfData[:])
 	privateKeyData := privateKey.Data()
+	defer zeroBytes(privateKeyData[:])
 	encryptedBytes := box.Seal(nil, clientHalfData[:], &nonce, (*[32]byte)(&dhKeyPair.Public), &privateKeyData)
 
 	return EncryptedTLFCryptKeyClientHalf{
@@ -172,23 +210,81 @@ type EncryptedBlock struct {
 	encryptedData
 }
 
-// EncryptPaddedEncodedBlock encrypts a padded, encoded block.
-func EncryptPaddedEncodedBlock(paddedEncodedBlock []byte, key BlockCryptKey) (
-	encryptedBlock EncryptedBlock, err error) {
-	encryptedData, err := encryptData(paddedEncodedBlock, key.Data())
-	if err != nil {
-		return EncryptedBlock{}, err
+// EncryptPaddedEncodedBlock encrypts a padded, encoded block with
+// the cipher given by `encVer`, which should be the one negotiated
+// for the key generation of the key.
+func EncryptPaddedEncodedBlock(paddedEncodedBlock []byte, key BlockCryptKey,
+	encVer EncryptionVer) (encryptedBlock EncryptedBlock, err error) {
+	switch encVer {
+	case EncryptionSecretbox:
+		encryptedData, err := encryptData(paddedEncodedBlock, key.Data())
+		if err != nil {
+			return EncryptedBlock{}, err
+		}
+		return EncryptedBlock{encryptedData}, nil
+	default:
+		return EncryptedBlock{}, errors.WithStack(
+			UnknownEncryptionVer{encVer})
 	}
-
-	return EncryptedBlock{encryptedData}, nil
 }
 
 // DecryptBlock decrypts a block, but does not unpad or decode it.
+// The cipher is taken from the encrypted block itself, so that
+// blocks from older key generations can always be read.
 func DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey) (
 	[]byte, error) {
 	return decryptData(encryptedBlock.encryptedData, key.Data())
 }
 
+// sealedLocalDataMagic starts every buffer returned by
+// SealLocalData.  Its first byte is never used by msgpack, JSON, or
+// UTF-8, so it can't be confused with the start of any data KBFS
+// wrote to disk before local data was sealed.
+var sealedLocalDataMagic = []byte{0xc1, 'K', 'L', 'S'}
+
+// IsSealedLocalData returns whether the given buffer was returned by
+// SealLocalData.
+func IsSealedLocalData(buf []byte) bool {
+	return bytes.HasPrefix(buf, sealedLocalDataMagic)
+}
+
+// SealLocalData encrypts data to be stored on the local disk.  The
+// result is self-describing (see IsSealedLocalData), so it can be
+// stored as a raw file.
+func SealLocalData(data []byte, key LocalStorageKey) ([]byte, error) {
+	encryptedData, err := encryptData(data, key.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(sealedLocalDataMagic)+1+
+		len(encryptedData.Nonce)+len(encryptedData.EncryptedData))
+	buf = append(buf, sealedLocalDataMagic...)
+	buf = append(buf, byte(encryptedData.Version))
+	buf = append(buf, encryptedData.Nonce...)
+	buf = append(buf, encryptedData.EncryptedData...)
+	return buf, nil
+}
+
+// OpenLocalData decrypts a buffer returned by SealLocalData.
+func OpenLocalData(buf []byte, key LocalStorageKey) ([]byte, error) {
+	if !IsSealedLocalData(buf) {
+		return nil, errors.New("Local data is not sealed")
+	}
+	buf = buf[len(sealedLocalDataMagic):]
+
+	const nonceLen = 24
+	if len(buf) < 1+nonceLen {
+		return nil, errors.WithStack(InvalidNonceError{buf})
+	}
+
+	return decryptData(encryptedData{
+		Version:       EncryptionVer(buf[0]),
+		Nonce:         buf[1 : 1+nonceLen],
+		EncryptedData: buf[1+nonceLen:],
+	}, key.Data())
+}
+
 // EncryptedTLFCryptKeys is an encrypted TLFCryptKey array.
 type EncryptedTLFCryptKeys struct {
 	encryptedData
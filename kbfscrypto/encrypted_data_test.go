@@ -109,3 +109,70 @@ func TestCryptoCommonEncryptTLFCryptKeyClientHalf(t *testing.T) {
 	clientHalf2 := MakeTLFCryptKeyClientHalf(clientHalf2Data)
 	require.Equal(t, clientHalf, clientHalf2)
 }
+
+func TestNegotiateEncryptionVer(t *testing.T) {
+	// The first key generation gets the default.
+	v, err := NegotiateEncryptionVer(0)
+	require.NoError(t, err)
+	require.Equal(t, DefaultEncryptionVer, v)
+
+	v, err = NegotiateEncryptionVer(EncryptionSecretbox)
+	require.NoError(t, err)
+	require.Equal(t, DefaultEncryptionVer, v)
+
+	// A rekey can't be done by a client that doesn't understand
+	// the previous key generation's cipher.
+	unknownVer := EncryptionVer(99)
+	_, err = NegotiateEncryptionVer(unknownVer)
+	require.Equal(t, UnknownEncryptionVer{unknownVer}, errors.Cause(err))
+}
+
+func TestEncryptPaddedEncodedBlockEncryptionVer(t *testing.T) {
+	data := []byte{0x20, 0x30}
+	key := MakeBlockCryptKey([32]byte{0x40, 0x45})
+	encryptedBlock, err := EncryptPaddedEncodedBlock(
+		data, key, EncryptionSecretbox)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionSecretbox, encryptedBlock.Version)
+
+	decryptedData, err := DecryptBlock(encryptedBlock, key)
+	require.NoError(t, err)
+	require.Equal(t, data, decryptedData)
+
+	// Blocks can't be encrypted with a cipher this client doesn't
+	// support.
+	unknownVer := EncryptionVer(99)
+	_, err = EncryptPaddedEncodedBlock(data, key, unknownVer)
+	require.Equal(t, UnknownEncryptionVer{unknownVer}, errors.Cause(err))
+}
+
+func TestSealOpenLocalData(t *testing.T) {
+	data := []byte{0x20, 0x30}
+	key := MakeLocalStorageKey([32]byte{0x40, 0x45})
+	sealed, err := SealLocalData(data, key)
+	require.NoError(t, err)
+	require.True(t, IsSealedLocalData(sealed))
+	require.False(t, IsSealedLocalData(data))
+
+	opened, err := OpenLocalData(sealed, key)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+
+	// Wrong key.
+	_, err = OpenLocalData(
+		sealed, MakeLocalStorageKey([32]byte{0x40, 0x46}))
+	assert.Equal(t, libkb.DecryptionError{}, errors.Cause(err))
+
+	// Truncated.
+	_, err = OpenLocalData(sealed[:10], key)
+	assert.IsType(t, InvalidNonceError{}, errors.Cause(err))
+
+	// Corrupt.
+	sealed[len(sealed)-1] ^= 0x1
+	_, err = OpenLocalData(sealed, key)
+	assert.Equal(t, libkb.DecryptionError{}, errors.Cause(err))
+
+	// Not sealed at all.
+	_, err = OpenLocalData(data, key)
+	assert.Error(t, err)
+}
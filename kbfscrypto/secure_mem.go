@@ -0,0 +1,71 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"crypto/subtle"
+	"runtime"
+)
+
+// Zeroizer is implemented by key types that hold secret material,
+// or material that can be combined with other halves into a secret,
+// and that can overwrite it once it is no longer needed.  Every
+// new such type must implement it; crypto_key_types_test.go
+// enforces this.
+//
+// Since these types are usually passed by value, Zero only clears
+// the copy it is called on; callers should zero each copy they
+// make once they are done with it.
+type Zeroizer interface {
+	Zero()
+}
+
+// zeroBytes overwrites the given buffer with zeroes.
+func zeroBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	// Keep the compiler from treating the writes above as dead
+	// stores.
+	runtime.KeepAlive(buf)
+}
+
+// Zero overwrites the private data with zeroes.
+func (c *privateByte32Container) Zero() {
+	zeroBytes(c.data[:])
+}
+
+// Zero overwrites the server half with zeroes.
+func (k *TLFCryptKeyServerHalf) Zero() {
+	zeroBytes(k.data[:])
+}
+
+// Zero overwrites the client half with zeroes.
+func (k *TLFCryptKeyClientHalf) Zero() {
+	zeroBytes(k.data[:])
+}
+
+// Zero overwrites the server half with zeroes.
+func (k *BlockCryptKeyServerHalf) Zero() {
+	zeroBytes(k.data[:])
+}
+
+var _ Zeroizer = (*TLFCryptKey)(nil)
+var _ Zeroizer = (*TLFCryptKeyServerHalf)(nil)
+var _ Zeroizer = (*TLFCryptKeyClientHalf)(nil)
+var _ Zeroizer = (*BlockCryptKey)(nil)
+var _ Zeroizer = (*BlockCryptKeyServerHalf)(nil)
+
+// Equal returns whether the two IDs are the same, in time that
+// doesn't depend on where they differ.
+func (id TLFCryptKeyServerHalfID) Equal(other TLFCryptKeyServerHalfID) bool {
+	return id.ID.Equal(other.ID)
+}
+
+// Equal returns whether the two server halves are the same, in time
+// that doesn't depend on their contents.
+func (k BlockCryptKeyServerHalf) Equal(other BlockCryptKeyServerHalf) bool {
+	return subtle.ConstantTimeCompare(k.data[:], other.data[:]) == 1
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfscrypto
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKeyTypesImplementZeroizer checks, by parsing this package's
+// source, that every key type holding secret data, and every key
+// half, can be zeroed.  New key types that embed
+// privateByte32Container get this for free; new key halves need
+// their own Zero method in secure_mem.go.
+func TestKeyTypesImplementZeroizer(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	require.NoError(t, err)
+	pkg, ok := pkgs["kbfscrypto"]
+	require.True(t, ok)
+
+	zeroMethods := make(map[string]bool)
+	embeds := make(map[string]string)
+	for _, f := range pkg.Files {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil || d.Name.Name != "Zero" {
+					continue
+				}
+				recv := d.Recv.List[0].Type
+				if star, ok := recv.(*ast.StarExpr); ok {
+					recv = star.X
+				}
+				zeroMethods[recv.(*ast.Ident).Name] = true
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					ts, ok := spec.(*ast.TypeSpec)
+					if !ok {
+						continue
+					}
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					for _, field := range st.Fields.List {
+						ident, ok := field.Type.(*ast.Ident)
+						if len(field.Names) == 0 && ok {
+							embeds[ts.Name.Name] = ident.Name
+						}
+					}
+				}
+			}
+		}
+	}
+
+	require.True(t, zeroMethods["privateByte32Container"])
+	for name, embedded := range embeds {
+		switch {
+		case embedded == "privateByte32Container":
+		case strings.HasSuffix(name, "Half") &&
+			embedded == "publicByte32Container":
+			require.True(t, zeroMethods[name],
+				"%s must implement Zeroizer", name)
+		}
+	}
+}
+
+func TestZeroKeys(t *testing.T) {
+	data := [32]byte{1, 2, 3}
+
+	tlfCryptKey := MakeTLFCryptKey(data)
+	tlfCryptKey.Zero()
+	require.Equal(t, TLFCryptKey{}, tlfCryptKey)
+
+	serverHalf := MakeTLFCryptKeyServerHalf(data)
+	serverHalf.Zero()
+	require.Equal(t, TLFCryptKeyServerHalf{}, serverHalf)
+
+	clientHalf := MakeTLFCryptKeyClientHalf(data)
+	clientHalf.Zero()
+	require.Equal(t, TLFCryptKeyClientHalf{}, clientHalf)
+
+	blockServerHalf := MakeBlockCryptKeyServerHalf(data)
+	blockServerHalf.Zero()
+	require.Equal(t, BlockCryptKeyServerHalf{}, blockServerHalf)
+}
+
+func TestTLFCryptKeyServerHalfIDEqual(t *testing.T) {
+	uid := keybase1.MakeTestUID(1)
+	key := MakeFakeCryptPublicKeyOrBust("key")
+	serverHalf := MakeTLFCryptKeyServerHalf([32]byte{1})
+
+	id1, err := MakeTLFCryptKeyServerHalfID(uid, key, serverHalf)
+	require.NoError(t, err)
+	id2, err := MakeTLFCryptKeyServerHalfID(uid, key, serverHalf)
+	require.NoError(t, err)
+	require.True(t, id1.Equal(id2))
+
+	// Making the ID mustn't have zeroed the caller's copy.
+	require.NotEqual(t, TLFCryptKeyServerHalf{}, serverHalf)
+
+	id3, err := MakeTLFCryptKeyServerHalfID(
+		keybase1.MakeTestUID(2), key, serverHalf)
+	require.NoError(t, err)
+	require.False(t, id1.Equal(id3))
+}
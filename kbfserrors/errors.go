@@ -0,0 +1,180 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package kbfserrors gives KBFS errors stable codes, user-facing
+// messages, and remediation hints, so that every frontend can
+// present the same diagnostics for the same failure.
+package kbfserrors
+
+import (
+	"bytes"
+	"reflect"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Code is a stable, machine-readable identifier for a kind of KBFS
+// error.  Codes never change meaning once assigned, so frontends
+// can key translations and documentation off of them.
+type Code string
+
+// The known error codes.
+const (
+	CodeUnknown         Code = "UNKNOWN"
+	CodeNotFound        Code = "NOT_FOUND"
+	CodeExists          Code = "EXISTS"
+	CodeNotDir          Code = "NOT_DIR"
+	CodeNotFile         Code = "NOT_FILE"
+	CodeDirNotEmpty     Code = "DIR_NOT_EMPTY"
+	CodeInvalidName     Code = "INVALID_NAME"
+	CodeNameTooLong     Code = "NAME_TOO_LONG"
+	CodeFileTooBig      Code = "FILE_TOO_BIG"
+	CodeDirTooBig       Code = "DIR_TOO_BIG"
+	CodeCrossDirRename  Code = "CROSS_DIR_RENAME"
+	CodeUnlinkedDir     Code = "UNLINKED_DIR"
+	CodeNoSuchUser      Code = "NO_SUCH_USER"
+	CodeNoSuchTeam      Code = "NO_SUCH_TEAM"
+	CodeBadTlfName      Code = "BAD_TLF_NAME"
+	CodeTlfNotCanonical Code = "TLF_NOT_CANONICAL"
+	CodeReadAccess      Code = "READ_ACCESS"
+	CodeWriteAccess     Code = "WRITE_ACCESS"
+	CodeReadOnly        Code = "READ_ONLY"
+	CodeLoggedOut       Code = "LOGGED_OUT"
+	CodeNeedsRekey      Code = "NEEDS_REKEY"
+	CodeFinalized       Code = "FINALIZED"
+	CodeOverQuota       Code = "OVER_QUOTA"
+	CodeDiskLimit       Code = "DISK_LIMIT"
+	CodeThrottled       Code = "THROTTLED"
+	CodeOffline         Code = "OFFLINE"
+	CodeTimeout         Code = "TIMEOUT"
+	CodeOutdated        Code = "OUTDATED"
+	CodeBusy            Code = "BUSY"
+	CodeShutdown        Code = "SHUTDOWN"
+	CodeInternal        Code = "INTERNAL"
+)
+
+// Info describes how to present one kind of error.
+type Info struct {
+	Code Code
+	// Message is a text/template string, executed with a
+	// TemplateData whose Err field holds the original error.
+	Message string
+	// Hint tells the user what they can do about the error; it
+	// may be empty if there's nothing to do.  Like Message, it's a
+	// template.
+	Hint string
+}
+
+// TemplateData is what the Info templates are executed with.
+type TemplateData struct {
+	// Err is the original (unwrapped) error, so templates can use
+	// its exported fields.
+	Err error
+	// Detail is the original error's own message.
+	Detail string
+}
+
+var registry = make(map[reflect.Type]Info)
+
+// Register sets the Info for all errors with the same type as
+// `example`.  It's meant to be called from init functions, before
+// any errors are described, and panics on duplicate registration.
+func Register(example error, info Info) {
+	t := reflect.TypeOf(example)
+	if _, ok := registry[t]; ok {
+		panic("kbfserrors: duplicate registration for " + t.String())
+	}
+	registry[t] = info
+}
+
+// Lookup returns the Info registered for the type of the cause of
+// `err`, if any.
+func Lookup(err error) (Info, bool) {
+	info, ok := registry[reflect.TypeOf(errors.Cause(err))]
+	return info, ok
+}
+
+// Error is a KBFS error annotated for presentation to a user.
+type Error struct {
+	Code    Code
+	Message string
+	Hint    string
+	err     error
+}
+
+// Error implements the error interface for Error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the original error.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Cause implements the github.com/pkg/errors causer interface for
+// Error.
+func (e *Error) Cause() error {
+	return e.err
+}
+
+// Is returns true if `target` is an *Error with the same code, so
+// that `errors.Is(err, &Error{Code: CodeNotFound})` works.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// render executes the given template for `cause`, falling back to
+// `fallback` if the template is broken.
+func render(text string, cause error, fallback string) string {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return fallback
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, TemplateData{Err: cause, Detail: cause.Error()})
+	if err != nil {
+		return fallback
+	}
+	return buf.String()
+}
+
+// Describe returns `err` annotated with its code, message, and hint.
+// Unregistered errors get CodeInternal and their own message.  It
+// returns nil for a nil error, and `err` itself if it's already an
+// *Error.
+func Describe(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	cause := errors.Cause(err)
+	info, ok := Lookup(cause)
+	if !ok {
+		return &Error{
+			Code:    CodeInternal,
+			Message: cause.Error(),
+			Hint:    internalHint,
+			err:     err,
+		}
+	}
+	return &Error{
+		Code:    info.Code,
+		Message: render(info.Message, cause, cause.Error()),
+		Hint:    render(info.Hint, cause, ""),
+		err:     err,
+	}
+}
+
+// CodeOf returns the code for `err`, or CodeUnknown for nil.
+func CodeOf(err error) Code {
+	if err == nil {
+		return CodeUnknown
+	}
+	return Describe(err).Code
+}
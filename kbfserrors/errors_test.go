@@ -0,0 +1,70 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfserrors
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"text/template"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribe(t *testing.T) {
+	require.Nil(t, Describe(nil))
+
+	orig := libkbfs.NoSuchNameError{Name: "foo"}
+	err := errors.Wrap(orig, "lookup")
+	e := Describe(err)
+	require.Equal(t, CodeNotFound, e.Code)
+	require.Equal(t, "foo doesn't exist.", e.Error())
+	require.NotEmpty(t, e.Hint)
+	require.Equal(t, err, e.Unwrap())
+	require.Equal(t, orig, errors.Cause(e))
+	require.True(t, e.Is(&Error{Code: CodeNotFound}))
+	require.False(t, e.Is(&Error{Code: CodeExists}))
+	require.True(t, e == Describe(e))
+
+	e = Describe(libkbfs.TlfNameNotCanonical{Name: "b,a", NameToTry: "a,b"})
+	require.Equal(t, CodeTlfNotCanonical, e.Code)
+	require.Equal(t, "Use a,b instead.", e.Hint)
+
+	e = Describe(kbfsblock.ServerErrorOverQuota{Usage: 10, Limit: 5})
+	require.Equal(t, CodeOverQuota, e.Code)
+	require.Equal(t,
+		"You are using 10 bytes, over your quota of 5 bytes.", e.Message)
+
+	e = Describe(&libkbfs.ErrDiskLimitTimeout{})
+	require.Equal(t, CodeDiskLimit, e.Code)
+
+	e = Describe(errors.New("mystery"))
+	require.Equal(t, CodeInternal, e.Code)
+	require.Equal(t, "mystery", e.Message)
+	require.Equal(t, CodeUnknown, CodeOf(nil))
+}
+
+func TestRegisteredTemplatesRender(t *testing.T) {
+	for typ, info := range registry {
+		var example error
+		if typ.Kind() == reflect.Ptr {
+			example = reflect.New(typ.Elem()).Interface().(error)
+		} else {
+			example = reflect.Zero(typ).Interface().(error)
+		}
+		for _, text := range []string{info.Message, info.Hint} {
+			tmpl, err := template.New("").Parse(text)
+			require.NoError(t, err, "%s", typ)
+			var buf bytes.Buffer
+			err = tmpl.Execute(
+				&buf, TemplateData{Err: example, Detail: "detail"})
+			require.NoError(t, err, "%s", typ)
+			require.NotContains(t, buf.String(), "<no value>", "%s", typ)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfserrors
+
+import (
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const internalHint = "This is probably a bug in KBFS.  Please report " +
+	"it with `keybase log send`."
+
+const retryHint = "Try again in a few minutes."
+
+func init() {
+	// Names and paths.
+	Register(libkbfs.NoSuchNameError{}, Info{
+		Code:    CodeNotFound,
+		Message: "{{.Err.Name}} doesn't exist.",
+		Hint:    "Check the spelling of the name, or list the directory.",
+	})
+	Register(libkbfs.NameExistsError{}, Info{
+		Code:    CodeExists,
+		Message: "{{.Err.Name}} already exists.",
+		Hint:    "Pick a different name, or remove the existing entry first.",
+	})
+	Register(libkbfs.NotDirError{}, Info{
+		Code:    CodeNotDir,
+		Message: "{{.Detail}}.",
+		Hint:    "Use a path that names a directory.",
+	})
+	Register(libkbfs.NotFileError{}, Info{
+		Code:    CodeNotFile,
+		Message: "{{.Detail}}.",
+		Hint:    "Use a path that names a file.",
+	})
+	Register(libkbfs.DirNotEmptyError{}, Info{
+		Code:    CodeDirNotEmpty,
+		Message: "Directory {{.Err.Name}} is not empty.",
+		Hint:    "Remove everything inside it first.",
+	})
+	Register(libkbfs.DisallowedPrefixError{}, Info{
+		Code:    CodeInvalidName,
+		Message: "{{.Detail}}.",
+		Hint:    "Pick a name that doesn't use a reserved prefix.",
+	})
+	Register(libkbfs.NameTooLongError{}, Info{
+		Code:    CodeNameTooLong,
+		Message: "{{.Detail}}.",
+		Hint:    "Pick a shorter name.",
+	})
+	Register(libkbfs.FileTooBigError{}, Info{
+		Code:    CodeFileTooBig,
+		Message: "{{.Detail}}.",
+		Hint:    "Split the data into smaller files.",
+	})
+	Register(libkbfs.DirTooBigError{}, Info{
+		Code:    CodeDirTooBig,
+		Message: "{{.Detail}}.",
+		Hint:    "Move some entries into subdirectories.",
+	})
+	Register(libkbfs.RenameAcrossDirsError{}, Info{
+		Code:    CodeCrossDirRename,
+		Message: "Renaming across folders isn't supported.",
+		Hint:    "Copy the file to the other folder and delete the original.",
+	})
+	Register(libkbfs.UnsupportedOpInUnlinkedDirError{}, Info{
+		Code:    CodeUnlinkedDir,
+		Message: "The directory {{.Err.Dirpath}} has been deleted.",
+		Hint:    "Change to a directory that still exists.",
+	})
+
+	// Users, teams, and folders.
+	Register(libkbfs.NoSuchUserError{}, Info{
+		Code:    CodeNoSuchUser,
+		Message: "{{.Err.Input}} is not a Keybase user.",
+		Hint:    "Check the spelling of the username.",
+	})
+	Register(libkbfs.NoSuchTeamError{}, Info{
+		Code:    CodeNoSuchTeam,
+		Message: "{{.Err.Input}} is not a Keybase team.",
+		Hint:    "Check the spelling of the team name.",
+	})
+	Register(libkbfs.BadTLFNameError{}, Info{
+		Code:    CodeBadTlfName,
+		Message: "{{.Err.Name}} is not a valid folder name.",
+		Hint: "Folder names are comma-separated lists of users, " +
+			"optionally followed by #readers.",
+	})
+	Register(libkbfs.TlfNameNotCanonical{}, Info{
+		Code:    CodeTlfNotCanonical,
+		Message: "{{.Err.Name}} is not the canonical name of the folder.",
+		Hint:    "Use {{.Err.NameToTry}} instead.",
+	})
+	Register(libkbfs.NoSuchFolderListError{}, Info{
+		Code:    CodeNotFound,
+		Message: "{{.Err.Name}} is not a folder list.",
+		Hint: "Use {{.Err.PrivName}} or {{.Err.PubName}} at the top " +
+			"level.",
+	})
+
+	// Access.
+	Register(libkbfs.ReadAccessError{}, Info{
+		Code:    CodeReadAccess,
+		Message: "{{.Detail}}.",
+		Hint:    "Ask a writer of the folder to add you.",
+	})
+	Register(libkbfs.WriteAccessError{}, Info{
+		Code:    CodeWriteAccess,
+		Message: "{{.Detail}}.",
+		Hint:    "Ask a writer of the folder to add you as a writer.",
+	})
+	Register(libkbfs.WriteUnsupportedError{}, Info{
+		Code:    CodeReadOnly,
+		Message: "{{.Err.Filename}} can't be written to.",
+	})
+	Register(libkbfs.WriteToReadonlyNodeError{}, Info{
+		Code:    CodeReadOnly,
+		Message: "{{.Err.Filename}} is read-only.",
+	})
+	Register(libkbfs.NoCurrentSessionError{}, Info{
+		Code:    CodeLoggedOut,
+		Message: "You are not logged in to Keybase.",
+		Hint:    "Run `keybase login` and try again.",
+	})
+	Register(libkbfs.NeedSelfRekeyError{}, Info{
+		Code:    CodeNeedsRekey,
+		Message: "This device can't read {{.Err.Tlf}} yet.",
+		Hint: "Open Keybase on one of your other devices to give " +
+			"this device access.",
+	})
+	Register(libkbfs.NeedOtherRekeyError{}, Info{
+		Code:    CodeNeedsRekey,
+		Message: "This device can't read {{.Err.Tlf}} yet.",
+		Hint: "Another member of the folder needs to come online " +
+			"to give this device access.",
+	})
+	Register(libkbfs.RekeyPermissionError{}, Info{
+		Code:    CodeWriteAccess,
+		Message: "{{.Detail}}.",
+	})
+	Register(kbfsmd.MetadataIsFinalError{}, Info{
+		Code:    CodeFinalized,
+		Message: "This folder has been finalized and can't be changed.",
+		Hint:    "Its owner reset their account; use the new folder instead.",
+	})
+	Register(libkbfs.TlfHandleFinalizedError{}, Info{
+		Code:    CodeFinalized,
+		Message: "This folder has been finalized and can't be changed.",
+		Hint:    "Its owner reset their account; use the new folder instead.",
+	})
+	Register(kbfsblock.ServerErrorUnauthorized{}, Info{
+		Code:    CodeLoggedOut,
+		Message: "The block server didn't accept your credentials.",
+		Hint:    "Log out and log back in to Keybase.",
+	})
+	Register(kbfsblock.ServerErrorNoPermission{}, Info{
+		Code:    CodeReadAccess,
+		Message: "You don't have permission to access that data.",
+	})
+	Register(kbfsmd.ServerErrorUnauthorized{}, Info{
+		Code:    CodeLoggedOut,
+		Message: "The metadata server didn't accept your credentials.",
+		Hint:    "Log out and log back in to Keybase.",
+	})
+	Register(kbfsmd.ServerErrorWriteAccess{}, Info{
+		Code:    CodeWriteAccess,
+		Message: "You don't have write access to this folder.",
+		Hint:    "Ask a writer of the folder to add you as a writer.",
+	})
+
+	// Space and load.
+	Register(kbfsblock.ServerErrorOverQuota{}, Info{
+		Code: CodeOverQuota,
+		Message: "You are using {{.Err.Usage}} bytes, over your quota " +
+			"of {{.Err.Limit}} bytes.",
+		Hint: "Delete some files, including from your other folders.",
+	})
+	Register(&libkbfs.ErrDiskLimitTimeout{}, Info{
+		Code:    CodeDiskLimit,
+		Message: "There isn't enough local disk space to hold your changes.",
+		Hint: "Free up some disk space, or wait for pending changes " +
+			"to finish uploading.",
+	})
+	Register(kbfsblock.ServerErrorThrottle{}, Info{
+		Code:    CodeThrottled,
+		Message: "The Keybase servers are busy.",
+		Hint:    retryHint,
+	})
+	Register(kbfsmd.ServerErrorThrottle{}, Info{
+		Code:    CodeThrottled,
+		Message: "The Keybase servers are busy.",
+		Hint:    retryHint,
+	})
+
+	// Connectivity and versions.
+	Register(libkbfs.MDServerDisconnected{}, Info{
+		Code:    CodeOffline,
+		Message: "You are not connected to the Keybase servers.",
+		Hint:    "Check your network connection.",
+	})
+	Register(libkbfs.TimeoutError{}, Info{
+		Code:    CodeTimeout,
+		Message: "The operation timed out.",
+		Hint:    "Check your network connection, and try again.",
+	})
+	Register(libkbfs.OutdatedVersionError{}, Info{
+		Code:    CodeOutdated,
+		Message: "This version of Keybase is too old to do that.",
+		Hint:    "Update Keybase.",
+	})
+	Register(libkbfs.NewDataVersionError{}, Info{
+		Code:    CodeOutdated,
+		Message: "{{.Detail}}.",
+		Hint:    "Update Keybase.",
+	})
+
+	// Local state.
+	Register(libkbfs.MDWriteNeededInRequest{}, Info{
+		Code:    CodeBusy,
+		Message: "That operation can't modify the folder.",
+		Hint:    internalHint,
+	})
+	Register(libkbfs.NotPermittedWhileDirtyError{}, Info{
+		Code:    CodeBusy,
+		Message: "That isn't allowed while there are unsaved changes.",
+		Hint:    "Wait for your changes to sync, and try again.",
+	})
+	Register(libkbfs.NoUpdatesWhileDirtyError{}, Info{
+		Code:    CodeBusy,
+		Message: "That isn't allowed while there are unsaved changes.",
+		Hint:    "Wait for your changes to sync, and try again.",
+	})
+	Register(libkbfs.ShutdownHappenedError{}, Info{
+		Code:    CodeShutdown,
+		Message: "KBFS is shutting down.",
+		Hint:    "Restart Keybase.",
+	})
+}
@@ -7,6 +7,7 @@ package kbfshash
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding"
 	"encoding/hex"
 	"fmt"
@@ -337,6 +338,14 @@ func (hmac *HMAC) UnmarshalText(data []byte) error {
 	return hmac.h.UnmarshalText(data)
 }
 
+// Equal returns whether the two HMACs are the same, in time that
+// doesn't depend on where they differ, so that comparing against a
+// secret HMAC doesn't leak it.
+func (hmac HMAC) Equal(other HMAC) bool {
+	return subtle.ConstantTimeCompare(
+		[]byte(hmac.h.h), []byte(other.h.h)) == 1
+}
+
 // Verify makes sure that the HMAC matches the given data.
 func (hmac HMAC) Verify(key, buf []byte) error {
 	if !hmac.IsValid() {
@@ -353,7 +362,7 @@ func (hmac HMAC) Verify(key, buf []byte) error {
 	if err != nil {
 		return err
 	}
-	if hmac != expectedHMAC {
+	if !hmac.Equal(expectedHMAC) {
 		return errors.WithStack(
 			HashMismatchError{expectedHMAC.h, hmac.h})
 	}
@@ -226,3 +226,21 @@ func TestVerify(t *testing.T) {
 	err = corruptHMAC.Verify(key, data)
 	require.IsType(t, HashMismatchError{}, errors.Cause(err))
 }
+
+func TestHMACEqual(t *testing.T) {
+	key := []byte{1, 2}
+	data := []byte{1, 2, 3, 4, 5}
+
+	hmac1, err := DefaultHMAC(key, data)
+	require.NoError(t, err)
+	hmac2, err := DefaultHMAC(key, data)
+	require.NoError(t, err)
+	require.True(t, hmac1.Equal(hmac2))
+	require.True(t, (HMAC{}).Equal(HMAC{}))
+	require.False(t, hmac1.Equal(HMAC{}))
+
+	hashData := hmac1.hashData()
+	hashData[0] ^= 1
+	corruptHMAC := hmacFromRawNoCheck(hmac1.hashType(), hashData)
+	require.False(t, hmac1.Equal(corruptHMAC))
+}
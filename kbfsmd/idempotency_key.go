@@ -0,0 +1,74 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfsmd
+
+import (
+	"encoding"
+	"encoding/hex"
+	"errors"
+
+	"github.com/keybase/kbfs/kbfscrypto"
+)
+
+// IdempotencyKeyByteLen is the number of bytes in an MD put
+// idempotency key.
+const IdempotencyKeyByteLen = 16
+
+// IdempotencyKey is a random value that a client attaches to each
+// attempt to put an MD revision.  If a put fails in a way that
+// leaves it unclear whether the server applied it (e.g., a timeout
+// followed by a retry), finding the same key on the server's copy of
+// the revision means the put did land, and so the resulting revision
+// conflict can be treated as a success.
+type IdempotencyKey struct {
+	key [IdempotencyKeyByteLen]byte
+}
+
+var _ encoding.BinaryMarshaler = IdempotencyKey{}
+var _ encoding.BinaryUnmarshaler = (*IdempotencyKey)(nil)
+
+// NullIdempotencyKey is an empty IdempotencyKey, used by MDs that
+// don't have one.
+var NullIdempotencyKey = IdempotencyKey{}
+
+// String implements the Stringer interface for IdempotencyKey.
+func (k IdempotencyKey) String() string {
+	return hex.EncodeToString(k.key[:])
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface
+// for IdempotencyKey.
+func (k IdempotencyKey) MarshalBinary() (data []byte, err error) {
+	return k.key[:], nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler
+// interface for IdempotencyKey.
+func (k *IdempotencyKey) UnmarshalBinary(data []byte) error {
+	if len(data) != IdempotencyKeyByteLen {
+		return errors.New("invalid IdempotencyKey")
+	}
+	copy(k.key[:], data)
+	return nil
+}
+
+// MakeRandomIdempotencyKey generates an idempotency key using a
+// CSPRNG.  It will not return NullIdempotencyKey.
+func MakeRandomIdempotencyKey() (IdempotencyKey, error) {
+	var k IdempotencyKey
+	for k == NullIdempotencyKey {
+		err := kbfscrypto.RandRead(k.key[:])
+		if err != nil {
+			return NullIdempotencyKey, err
+		}
+	}
+	return k, nil
+}
+
+// FakeIdempotencyKey creates a fake idempotency key from the given
+// byte.
+func FakeIdempotencyKey(b byte) IdempotencyKey {
+	return IdempotencyKey{[IdempotencyKeyByteLen]byte{b}}
+}
@@ -18,10 +18,25 @@ type TLFCryptKeyInfo struct {
 	ClientHalf   kbfscrypto.EncryptedTLFCryptKeyClientHalf
 	ServerHalfID kbfscrypto.TLFCryptKeyServerHalfID
 	EPubKeyIndex int `codec:"i,omitempty"`
+	// EncryptionVer is the cipher used for data encrypted with
+	// this key generation's TLF crypt key.  All devices in a key
+	// generation have the same value.  It's zero for
+	// EncryptionSecretbox, so that key bundles written before
+	// this field existed are unchanged.
+	EncryptionVer kbfscrypto.EncryptionVer `codec:"v,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
 
+// DataEncryptionVer returns the cipher used for data encrypted with
+// the TLF crypt key described by this info.
+func (info TLFCryptKeyInfo) DataEncryptionVer() kbfscrypto.EncryptionVer {
+	if info.EncryptionVer == 0 {
+		return kbfscrypto.EncryptionSecretbox
+	}
+	return info.EncryptionVer
+}
+
 // DevicePublicKeys is a set of a user's devices (identified by the
 // corresponding device CryptPublicKey).
 type DevicePublicKeys map[kbfscrypto.CryptPublicKey]bool
@@ -104,11 +119,13 @@ func (serverHalves UserDeviceKeyServerHalves) MergeUsers(
 
 // splitTLFCryptKey splits the given TLFCryptKey into two parts -- the
 // client-side part (which is encrypted with the given keys), and the
-// server-side part, which will be uploaded to the server.
+// server-side part, which will be uploaded to the server. encVer is
+// recorded as the cipher of the key generation.
 func splitTLFCryptKey(uid keybase1.UID,
 	tlfCryptKey kbfscrypto.TLFCryptKey,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey, ePubIndex int,
-	pubKey kbfscrypto.CryptPublicKey) (
+	pubKey kbfscrypto.CryptPublicKey,
+	encVer kbfscrypto.EncryptionVer) (
 	TLFCryptKeyInfo, kbfscrypto.TLFCryptKeyServerHalf, error) {
 	//    * create a new random server half
 	//    * mask it with the key to get the client half
@@ -120,6 +137,7 @@ func splitTLFCryptKey(uid keybase1.UID,
 	}
 
 	clientHalf := kbfscrypto.MaskTLFCryptKey(serverHalf, tlfCryptKey)
+	defer clientHalf.Zero()
 
 	var encryptedClientHalf kbfscrypto.EncryptedTLFCryptKeyClientHalf
 	encryptedClientHalf, err =
@@ -140,6 +158,9 @@ func splitTLFCryptKey(uid keybase1.UID,
 		ServerHalfID: serverHalfID,
 		EPubKeyIndex: ePubIndex,
 	}
+	if encVer != kbfscrypto.EncryptionSecretbox {
+		clientInfo.EncryptionVer = encVer
+	}
 	return clientInfo, serverHalf, nil
 }
 
@@ -40,7 +40,7 @@ func makeFakeTLFCryptKeyInfoFuture(t *testing.T) tlfCryptKeyInfoFuture {
 			kbfscrypto.EncryptionSecretbox,
 			[]byte("fake encrypted data"),
 			[]byte("fake nonce")),
-		id, 5,
+		id, 5, kbfscrypto.EncryptionVer(2),
 		codec.UnknownFieldSetHandler{},
 	}
 	return tlfCryptKeyInfoFuture{
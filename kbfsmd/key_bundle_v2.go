@@ -79,7 +79,7 @@ type DeviceKeyInfoMapV2 map[keybase1.KID]TLFCryptKeyInfo
 func (dkimV2 DeviceKeyInfoMapV2) fillInDeviceInfos(
 	uid keybase1.UID, tlfCryptKey kbfscrypto.TLFCryptKey,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey, ePubIndex int,
-	updatedDeviceKeys DevicePublicKeys) (
+	updatedDeviceKeys DevicePublicKeys, encVer kbfscrypto.EncryptionVer) (
 	serverHalves DeviceKeyServerHalves, err error) {
 	serverHalves = make(DeviceKeyServerHalves, len(updatedDeviceKeys))
 	// TODO: parallelize
@@ -90,7 +90,7 @@ func (dkimV2 DeviceKeyInfoMapV2) fillInDeviceInfos(
 		}
 
 		clientInfo, serverHalf, err := splitTLFCryptKey(
-			uid, tlfCryptKey, ePrivKey, ePubIndex, k)
+			uid, tlfCryptKey, ePrivKey, ePubIndex, k, encVer)
 		if err != nil {
 			return nil, err
 		}
@@ -169,11 +169,24 @@ func (udkimV2 UserDeviceKeyInfoMapV2) RemoveDevicesNotIn(
 	return removalInfo
 }
 
-// FillInUserInfos fills in this map from the given info.
+// dataEncryptionVer returns the cipher of the key generation this
+// map belongs to, or zero if the map is empty.
+func (udkimV2 UserDeviceKeyInfoMapV2) dataEncryptionVer() kbfscrypto.EncryptionVer {
+	for _, dkim := range udkimV2 {
+		for _, info := range dkim {
+			return info.DataEncryptionVer()
+		}
+	}
+	return 0
+}
+
+// FillInUserInfos fills in this map from the given info.  New
+// entries record encVer as the cipher of their key generation.
 func (udkimV2 UserDeviceKeyInfoMapV2) FillInUserInfos(
 	newIndex int, updatedUserKeys UserDevicePublicKeys,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey,
-	tlfCryptKey kbfscrypto.TLFCryptKey) (
+	tlfCryptKey kbfscrypto.TLFCryptKey,
+	encVer kbfscrypto.EncryptionVer) (
 	serverHalves UserDeviceKeyServerHalves, err error) {
 	serverHalves = make(UserDeviceKeyServerHalves, len(updatedUserKeys))
 	for u, updatedDeviceKeys := range updatedUserKeys {
@@ -183,7 +196,7 @@ func (udkimV2 UserDeviceKeyInfoMapV2) FillInUserInfos(
 
 		deviceServerHalves, err := udkimV2[u].fillInDeviceInfos(
 			u, tlfCryptKey, ePrivKey, newIndex,
-			updatedDeviceKeys)
+			updatedDeviceKeys, encVer)
 		if err != nil {
 			return nil, err
 		}
@@ -12,6 +12,7 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/cache"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfshash"
@@ -60,7 +61,7 @@ var _ cache.Measurable = DeviceKeyInfoMapV3{}
 func (dkimV3 DeviceKeyInfoMapV3) fillInDeviceInfos(
 	uid keybase1.UID, tlfCryptKey kbfscrypto.TLFCryptKey,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey, ePubIndex int,
-	updatedDeviceKeys DevicePublicKeys) (
+	updatedDeviceKeys DevicePublicKeys, encVer kbfscrypto.EncryptionVer) (
 	serverHalves DeviceKeyServerHalves, err error) {
 	serverHalves = make(DeviceKeyServerHalves, len(updatedDeviceKeys))
 	// TODO: parallelize
@@ -71,7 +72,7 @@ func (dkimV3 DeviceKeyInfoMapV3) fillInDeviceInfos(
 		}
 
 		clientInfo, serverHalf, err := splitTLFCryptKey(
-			uid, tlfCryptKey, ePrivKey, ePubIndex, k)
+			uid, tlfCryptKey, ePrivKey, ePubIndex, k, encVer)
 		if err != nil {
 			return nil, err
 		}
@@ -197,11 +198,24 @@ func (udkimV3 UserDeviceKeyInfoMapV3) RemoveDevicesNotIn(
 	return removalInfo
 }
 
-// FillInUserInfos fills in this map from the given info.
+// dataEncryptionVer returns the cipher of the key generation this
+// map belongs to, or zero if the map is empty.
+func (udkimV3 UserDeviceKeyInfoMapV3) dataEncryptionVer() kbfscrypto.EncryptionVer {
+	for _, dkim := range udkimV3 {
+		for _, info := range dkim {
+			return info.DataEncryptionVer()
+		}
+	}
+	return 0
+}
+
+// FillInUserInfos fills in this map from the given info.  New
+// entries record encVer as the cipher of their key generation.
 func (udkimV3 UserDeviceKeyInfoMapV3) FillInUserInfos(
 	newIndex int, updatedUserKeys UserDevicePublicKeys,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey,
-	tlfCryptKey kbfscrypto.TLFCryptKey) (
+	tlfCryptKey kbfscrypto.TLFCryptKey,
+	encVer kbfscrypto.EncryptionVer) (
 	serverHalves UserDeviceKeyServerHalves, err error) {
 	serverHalves = make(UserDeviceKeyServerHalves, len(updatedUserKeys))
 	for u, updatedDeviceKeys := range updatedUserKeys {
@@ -211,7 +225,7 @@ func (udkimV3 UserDeviceKeyInfoMapV3) FillInUserInfos(
 
 		deviceServerHalves, err := udkimV3[u].fillInDeviceInfos(
 			u, tlfCryptKey, ePrivKey, newIndex,
-			updatedDeviceKeys)
+			updatedDeviceKeys, encVer)
 		if err != nil {
 			return nil, err
 		}
@@ -252,9 +266,20 @@ type TLFWriterKeyBundleV3 struct {
 // DeserializeTLFWriterKeyBundleV3 deserializes a TLFWriterKeyBundleV3
 // from the given path and returns it.
 func DeserializeTLFWriterKeyBundleV3(codec kbfscodec.Codec, path string) (
+	TLFWriterKeyBundleV3, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TLFWriterKeyBundleV3{}, err
+	}
+	return DecodeTLFWriterKeyBundleV3(codec, buf)
+}
+
+// DecodeTLFWriterKeyBundleV3 decodes a TLFWriterKeyBundleV3 from the
+// given buffer and returns it.
+func DecodeTLFWriterKeyBundleV3(codec kbfscodec.Codec, buf []byte) (
 	TLFWriterKeyBundleV3, error) {
 	var wkb TLFWriterKeyBundleV3
-	err := kbfscodec.DeserializeFromFile(codec, path, &wkb)
+	err := codec.Decode(buf, &wkb)
 	if err != nil {
 		return TLFWriterKeyBundleV3{}, err
 	}
@@ -413,9 +438,20 @@ type TLFReaderKeyBundleV3 struct {
 // DeserializeTLFReaderKeyBundleV3 deserializes a TLFReaderKeyBundleV3
 // from the given path and returns it.
 func DeserializeTLFReaderKeyBundleV3(codec kbfscodec.Codec, path string) (
+	TLFReaderKeyBundleV3, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TLFReaderKeyBundleV3{}, err
+	}
+	return DecodeTLFReaderKeyBundleV3(codec, buf)
+}
+
+// DecodeTLFReaderKeyBundleV3 decodes a TLFReaderKeyBundleV3 from the
+// given buffer and returns it.
+func DecodeTLFReaderKeyBundleV3(codec kbfscodec.Codec, buf []byte) (
 	TLFReaderKeyBundleV3, error) {
 	var rkb TLFReaderKeyBundleV3
-	err := kbfscodec.DeserializeFromFile(codec, path, &rkb)
+	err := codec.Decode(buf, &rkb)
 	if err != nil {
 		return TLFReaderKeyBundleV3{}, err
 	}
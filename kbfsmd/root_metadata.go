@@ -94,6 +94,12 @@ type RootMetadata interface {
 		kbfscrypto.TLFEphemeralPublicKey,
 		kbfscrypto.EncryptedTLFCryptKeyClientHalf,
 		kbfscrypto.TLFCryptKeyServerHalfID, bool, error)
+	// GetLatestDataEncryptionVer returns the cipher to use for data
+	// encrypted with the latest key generation's TLF crypt key.
+	// It's EncryptionSecretbox for TLFs that aren't keyed with key
+	// bundles, or that don't have any keys yet.
+	GetLatestDataEncryptionVer(extra ExtraMetadata) (
+		kbfscrypto.EncryptionVer, error)
 	// IsValidAndSigned verifies the RootMetadata, checks the
 	// writer signature, and returns an error if a problem was
 	// found. This should be the first thing checked on a BRMD
@@ -118,15 +124,22 @@ type RootMetadata interface {
 	UnrefBytes() uint64
 	// MDRefBytes returns the number of newly referenced bytes of MD blocks introduced by this revision of metadata.
 	MDRefBytes() uint64
+	// DedupRefBytes returns the number of bytes in RefBytes that are new references to already-existing blocks.
+	DedupRefBytes() uint64
 	// DiskUsage returns the estimated disk usage for the folder as of this revision of metadata.
 	DiskUsage() uint64
 	// MDDiskUsage returns the estimated MD disk usage for the folder as of this revision of metadata.
 	MDDiskUsage() uint64
+	// DedupDiskUsage returns the estimated number of bytes in DiskUsage that are references to already-existing blocks.
+	DedupDiskUsage() uint64
 	// RevisionNumber returns the revision number associated with this metadata structure.
 	RevisionNumber() Revision
 	// MerkleRoot returns the root of the global Keybase Merkle tree
 	// at the time the MD was written.
 	MerkleRoot() keybase1.MerkleRootV2
+	// IdempotencyKey returns the key attached to the put of this
+	// revision, or NullIdempotencyKey if there isn't one.
+	IdempotencyKey() IdempotencyKey
 	// BID returns the per-device branch ID associated with this metadata revision.
 	BID() BranchID
 	// GetPrevRoot returns the hash of the previous metadata revision.
@@ -176,6 +189,10 @@ type MutableRootMetadata interface {
 	SetDiskUsage(diskUsage uint64)
 	// SetMDDiskUsage sets the estimated MD disk usage for the folder as of this revision of metadata.
 	SetMDDiskUsage(mdDiskUsage uint64)
+	// SetDedupRefBytes sets the number of bytes in RefBytes that are new references to already-existing blocks.
+	SetDedupRefBytes(dedupRefBytes uint64)
+	// SetDedupDiskUsage sets the estimated number of bytes in DiskUsage that are references to already-existing blocks.
+	SetDedupDiskUsage(dedupDiskUsage uint64)
 	// AddRefBytes increments the number of newly referenced bytes of data blocks introduced by this revision of metadata.
 	AddRefBytes(refBytes uint64)
 	// AddUnrefBytes increments the number of newly unreferenced bytes introduced by this revision of metadata.
@@ -186,6 +203,10 @@ type MutableRootMetadata interface {
 	AddDiskUsage(diskUsage uint64)
 	// AddMDDiskUsage increments the estimated MD disk usage for the folder as of this revision of metadata.
 	AddMDDiskUsage(mdDiskUsage uint64)
+	// AddDedupRefBytes increments the number of bytes in RefBytes that are new references to already-existing blocks.
+	AddDedupRefBytes(dedupRefBytes uint64)
+	// AddDedupDiskUsage increments the estimated number of bytes in DiskUsage that are references to already-existing blocks.
+	AddDedupDiskUsage(dedupDiskUsage uint64)
 	// ClearRekeyBit unsets any set rekey bit.
 	ClearRekeyBit()
 	// ClearWriterMetadataCopiedBit unsets any set writer metadata copied bit.
@@ -219,6 +240,10 @@ type MutableRootMetadata interface {
 	// SetMerkleRoot sets the root of the global Keybase Merkle tree
 	// at the time the MD was written.
 	SetMerkleRoot(root keybase1.MerkleRootV2)
+	// SetIdempotencyKey sets the key attached to the put of this
+	// revision.  It may be ignored by MD versions that don't support
+	// idempotency keys.
+	SetIdempotencyKey(key IdempotencyKey)
 	// SetUnresolvedReaders sets the list of unresolved readers associated with this folder.
 	SetUnresolvedReaders(readers []keybase1.SocialAssertion)
 	// SetUnresolvedWriters sets the list of unresolved writers associated with this folder.
@@ -55,6 +55,12 @@ type WriterMetadataV2 struct {
 	// The total number of bytes in new MD blocks (for testing only --
 	// real v2 MDs in the wild won't ever have this set).
 	MDRefBytes uint64 `codec:",omitempty"`
+	// The number of bytes in RefBytes that are new references to
+	// blocks that already exist, and so take no new space
+	DedupRefBytes uint64 `codec:",omitempty"`
+	// Estimated number of bytes in DiskUsage that are new
+	// references to existing blocks
+	DedupDiskUsage uint64 `codec:",omitempty"`
 
 	Extra WriterMetadataExtraV2 `codec:"x,omitempty,omitemptycheckstruct"`
 }
@@ -77,6 +83,8 @@ func (wmdV2 *WriterMetadataV2) ToWriterMetadataV3() WriterMetadataV3 {
 	wmdV3.RefBytes = wmdV2.RefBytes
 	wmdV3.UnrefBytes = wmdV2.UnrefBytes
 	wmdV3.MDRefBytes = wmdV2.MDRefBytes
+	wmdV3.DedupRefBytes = wmdV2.DedupRefBytes
+	wmdV3.DedupDiskUsage = wmdV2.DedupDiskUsage
 
 	if wmdV2.ID.Type() == tlf.Public {
 		wmdV3.LatestKeyGen = PublicKeyGen
@@ -731,6 +739,20 @@ func (md *RootMetadataV2) GetUserDevicePublicKeys(_ ExtraMetadata) (
 	return wUDKIM.WKeys.ToPublicKeys(), rUDKIM.RKeys.ToPublicKeys(), nil
 }
 
+// GetLatestDataEncryptionVer implements the RootMetadata interface
+// for RootMetadataV2.
+func (md *RootMetadataV2) GetLatestDataEncryptionVer(_ ExtraMetadata) (
+	kbfscrypto.EncryptionVer, error) {
+	if md.TypeForKeying() != tlf.PrivateKeying || len(md.WKeys) == 0 {
+		return kbfscrypto.EncryptionSecretbox, nil
+	}
+	encVer := md.WKeys[len(md.WKeys)-1].WKeys.dataEncryptionVer()
+	if encVer == 0 {
+		return kbfscrypto.EncryptionSecretbox, nil
+	}
+	return encVer, nil
+}
+
 // GetTLFCryptKeyParams implements the RootMetadata interface for RootMetadataV2.
 func (md *RootMetadataV2) GetTLFCryptKeyParams(
 	keyGen KeyGen, user keybase1.UID, key kbfscrypto.CryptPublicKey,
@@ -964,6 +986,36 @@ func (md *RootMetadataV2) AddMDDiskUsage(mdDiskUsage uint64) {
 	md.WriterMetadataV2.MDDiskUsage += mdDiskUsage
 }
 
+// DedupRefBytes implements the RootMetadata interface for RootMetadataV2.
+func (md *RootMetadataV2) DedupRefBytes() uint64 {
+	return md.WriterMetadataV2.DedupRefBytes
+}
+
+// DedupDiskUsage implements the RootMetadata interface for RootMetadataV2.
+func (md *RootMetadataV2) DedupDiskUsage() uint64 {
+	return md.WriterMetadataV2.DedupDiskUsage
+}
+
+// SetDedupRefBytes implements the MutableRootMetadata interface for RootMetadataV2.
+func (md *RootMetadataV2) SetDedupRefBytes(dedupRefBytes uint64) {
+	md.WriterMetadataV2.DedupRefBytes = dedupRefBytes
+}
+
+// SetDedupDiskUsage implements the MutableRootMetadata interface for RootMetadataV2.
+func (md *RootMetadataV2) SetDedupDiskUsage(dedupDiskUsage uint64) {
+	md.WriterMetadataV2.DedupDiskUsage = dedupDiskUsage
+}
+
+// AddDedupRefBytes implements the MutableRootMetadata interface for RootMetadataV2.
+func (md *RootMetadataV2) AddDedupRefBytes(dedupRefBytes uint64) {
+	md.WriterMetadataV2.DedupRefBytes += dedupRefBytes
+}
+
+// AddDedupDiskUsage implements the MutableRootMetadata interface for RootMetadataV2.
+func (md *RootMetadataV2) AddDedupDiskUsage(dedupDiskUsage uint64) {
+	md.WriterMetadataV2.DedupDiskUsage += dedupDiskUsage
+}
+
 // RevisionNumber implements the RootMetadata interface for RootMetadataV2.
 func (md *RootMetadataV2) RevisionNumber() Revision {
 	return md.Revision
@@ -976,6 +1028,13 @@ func (md *RootMetadataV2) MerkleRoot() keybase1.MerkleRootV2 {
 	return keybase1.MerkleRootV2{}
 }
 
+// IdempotencyKey implements the RootMetadata interface for
+// RootMetadataV2.
+func (md *RootMetadataV2) IdempotencyKey() IdempotencyKey {
+	// No v2 MDs will have had this field set.
+	return NullIdempotencyKey
+}
+
 // BID implements the RootMetadata interface for RootMetadataV2.
 func (md *RootMetadataV2) BID() BranchID {
 	return md.WriterMetadataV2.BID
@@ -1085,6 +1144,12 @@ func (md *RootMetadataV2) SetMerkleRoot(root keybase1.MerkleRootV2) {
 	// V2 doesn't support merkle seqnos, just ignore.
 }
 
+// SetIdempotencyKey implements the MutableRootMetadata interface for
+// RootMetadataV2.
+func (md *RootMetadataV2) SetIdempotencyKey(key IdempotencyKey) {
+	// V2 doesn't support idempotency keys, just ignore.
+}
+
 // SetUnresolvedReaders implements the MutableRootMetadata interface for RootMetadataV2.
 func (md *RootMetadataV2) SetUnresolvedReaders(readers []keybase1.SocialAssertion) {
 	md.UnresolvedReaders = readers
@@ -1167,7 +1232,7 @@ func (md *RootMetadataV2) updateKeyGenerationForReaderRekey(
 			len(updatedReaderKeys))
 	}
 
-	_, rkb, err := md.getTLFKeyBundles(keyGen)
+	wkb, rkb, err := md.getTLFKeyBundles(keyGen)
 	if err != nil {
 		return nil, err
 	}
@@ -1178,7 +1243,8 @@ func (md *RootMetadataV2) updateKeyGenerationForReaderRekey(
 	newIndex := -len(rkb.TLFReaderEphemeralPublicKeys) - 1
 
 	rServerHalves, err := rkb.RKeys.FillInUserInfos(
-		newIndex, updatedReaderKeys, ePrivKey, tlfCryptKey)
+		newIndex, updatedReaderKeys, ePrivKey, tlfCryptKey,
+		wkb.WKeys.dataEncryptionVer())
 	if err != nil {
 		return nil, err
 	}
@@ -1193,12 +1259,16 @@ func (md *RootMetadataV2) updateKeyGenerationForReaderRekey(
 	return rServerHalves, nil
 }
 
+// updateKeyGeneration fills in the given key generation for any new
+// devices. encVer is the cipher of the key generation, which is only
+// used if it doesn't have any devices yet.
 func (md *RootMetadataV2) updateKeyGeneration(
 	keyGen KeyGen,
 	updatedWriterKeys, updatedReaderKeys UserDevicePublicKeys,
 	ePubKey kbfscrypto.TLFEphemeralPublicKey,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey,
-	tlfCryptKey kbfscrypto.TLFCryptKey) (UserDeviceKeyServerHalves, error) {
+	tlfCryptKey kbfscrypto.TLFCryptKey,
+	encVer kbfscrypto.EncryptionVer) (UserDeviceKeyServerHalves, error) {
 	if len(updatedWriterKeys) == 0 {
 		return nil, errors.New(
 			"updatedWriterKeys unexpectedly non-empty")
@@ -1211,14 +1281,18 @@ func (md *RootMetadataV2) updateKeyGeneration(
 
 	newIndex := len(wkb.TLFEphemeralPublicKeys)
 
+	if existingVer := wkb.WKeys.dataEncryptionVer(); existingVer != 0 {
+		encVer = existingVer
+	}
+
 	wServerHalves, err := wkb.WKeys.FillInUserInfos(
-		newIndex, updatedWriterKeys, ePrivKey, tlfCryptKey)
+		newIndex, updatedWriterKeys, ePrivKey, tlfCryptKey, encVer)
 	if err != nil {
 		return nil, err
 	}
 
 	rServerHalves, err := rkb.RKeys.FillInUserInfos(
-		newIndex, updatedReaderKeys, ePrivKey, tlfCryptKey)
+		newIndex, updatedReaderKeys, ePrivKey, tlfCryptKey, encVer)
 	if err != nil {
 		return nil, err
 	}
@@ -1269,7 +1343,9 @@ func (md *RootMetadataV2) AddKeyGeneration(
 			len(md.WKeys), len(md.RKeys))
 	}
 
+	var prevEncVer kbfscrypto.EncryptionVer
 	if len(md.WKeys) > 0 {
+		prevEncVer = md.WKeys[len(md.WKeys)-1].WKeys.dataEncryptionVer()
 		existingWriterKeys :=
 			md.WKeys[len(md.WKeys)-1].WKeys.ToPublicKeys()
 		if !existingWriterKeys.Equals(updatedWriterKeys) {
@@ -1287,6 +1363,11 @@ func (md *RootMetadataV2) AddKeyGeneration(
 		}
 	}
 
+	encVer, err := kbfscrypto.NegotiateEncryptionVer(prevEncVer)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	newWriterKeys := TLFWriterKeyBundleV2{
 		WKeys:        make(UserDeviceKeyInfoMapV2),
 		TLFPublicKey: pubKey,
@@ -1300,7 +1381,7 @@ func (md *RootMetadataV2) AddKeyGeneration(
 
 	serverHalves, err = md.updateKeyGeneration(
 		md.LatestKeyGeneration(), updatedWriterKeys,
-		updatedReaderKeys, ePubKey, ePrivKey, nextCryptKey)
+		updatedReaderKeys, ePubKey, ePrivKey, nextCryptKey, encVer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1362,7 +1443,7 @@ func (md *RootMetadataV2) UpdateKeyBundles(codec kbfscodec.Codec,
 		serverHalvesGen, err := md.updateKeyGeneration(
 			keyGen, updatedWriterKeys, updatedReaderKeys,
 			ePubKey, ePrivKey,
-			tlfCryptKeys[keyGen-FirstValidKeyGen])
+			tlfCryptKeys[keyGen-FirstValidKeyGen], 0)
 		if err != nil {
 			return nil, err
 		}
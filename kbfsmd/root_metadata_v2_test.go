@@ -208,6 +208,8 @@ func makeFakeWriterMetadataV2Future(t *testing.T) writerMetadataV2Future {
 		99,
 		101,
 		0,
+		0,
+		0,
 		WriterMetadataExtraV2{},
 	}
 	wkb := makeFakeTLFWriterKeyBundleV2Future(t)
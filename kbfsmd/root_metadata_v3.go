@@ -55,6 +55,12 @@ type WriterMetadataV3 struct {
 	UnrefBytes uint64
 	// The total number of bytes in new MD blocks
 	MDRefBytes uint64 `codec:",omitempty"`
+	// The number of bytes in RefBytes that are new references to
+	// blocks that already exist, and so take no new space
+	DedupRefBytes uint64 `codec:",omitempty"`
+	// Estimated number of bytes in DiskUsage that are new
+	// references to existing blocks
+	DedupDiskUsage uint64 `codec:",omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -99,6 +105,14 @@ type RootMetadataV3 struct {
 	// behavior, so that old MDs are still verifiable.
 	KBMerkleRoot *keybase1.MerkleRootV2 `codec:"mr,omitempty"`
 
+	// IdempotencyKey is chosen at random by the client for each
+	// attempt to put this revision, so that it can recognize its own
+	// put if it has to retry after an ambiguous failure.  Like
+	// KBMerkleRoot, older clients might copy it into their updates
+	// as an unknown field, so it must only be compared against keys
+	// for the same revision.
+	PutIdempotencyKey *IdempotencyKey `codec:"ik,omitempty"`
+
 	codec.UnknownFieldSetHandler
 }
 
@@ -806,6 +820,25 @@ func (md *RootMetadataV3) GetUserDevicePublicKeys(extra ExtraMetadata) (
 	return wkb.Keys.ToPublicKeys(), rkb.Keys.ToPublicKeys(), nil
 }
 
+// GetLatestDataEncryptionVer implements the RootMetadata interface
+// for RootMetadataV3.
+func (md *RootMetadataV3) GetLatestDataEncryptionVer(extra ExtraMetadata) (
+	kbfscrypto.EncryptionVer, error) {
+	if md.TypeForKeying() != tlf.PrivateKeying ||
+		md.LatestKeyGeneration() < FirstValidKeyGen {
+		return kbfscrypto.EncryptionSecretbox, nil
+	}
+	wkb, _, err := md.getTLFKeyBundles(extra)
+	if err != nil {
+		return 0, err
+	}
+	encVer := wkb.Keys.dataEncryptionVer()
+	if encVer == 0 {
+		return kbfscrypto.EncryptionSecretbox, nil
+	}
+	return encVer, nil
+}
+
 // GetTLFCryptKeyParams implements the RootMetadata interface for RootMetadataV3.
 func (md *RootMetadataV3) GetTLFCryptKeyParams(
 	keyGen KeyGen, user keybase1.UID,
@@ -1114,6 +1147,36 @@ func (md *RootMetadataV3) AddMDDiskUsage(mdDiskUsage uint64) {
 	md.WriterMetadata.MDDiskUsage += mdDiskUsage
 }
 
+// DedupRefBytes implements the RootMetadata interface for RootMetadataV3.
+func (md *RootMetadataV3) DedupRefBytes() uint64 {
+	return md.WriterMetadata.DedupRefBytes
+}
+
+// DedupDiskUsage implements the RootMetadata interface for RootMetadataV3.
+func (md *RootMetadataV3) DedupDiskUsage() uint64 {
+	return md.WriterMetadata.DedupDiskUsage
+}
+
+// SetDedupRefBytes implements the MutableRootMetadata interface for RootMetadataV3.
+func (md *RootMetadataV3) SetDedupRefBytes(dedupRefBytes uint64) {
+	md.WriterMetadata.DedupRefBytes = dedupRefBytes
+}
+
+// SetDedupDiskUsage implements the MutableRootMetadata interface for RootMetadataV3.
+func (md *RootMetadataV3) SetDedupDiskUsage(dedupDiskUsage uint64) {
+	md.WriterMetadata.DedupDiskUsage = dedupDiskUsage
+}
+
+// AddDedupRefBytes implements the MutableRootMetadata interface for RootMetadataV3.
+func (md *RootMetadataV3) AddDedupRefBytes(dedupRefBytes uint64) {
+	md.WriterMetadata.DedupRefBytes += dedupRefBytes
+}
+
+// AddDedupDiskUsage implements the MutableRootMetadata interface for RootMetadataV3.
+func (md *RootMetadataV3) AddDedupDiskUsage(dedupDiskUsage uint64) {
+	md.WriterMetadata.DedupDiskUsage += dedupDiskUsage
+}
+
 // RevisionNumber implements the RootMetadata interface for RootMetadataV3.
 func (md *RootMetadataV3) RevisionNumber() Revision {
 	return md.Revision
@@ -1125,6 +1188,15 @@ func (md *RootMetadataV3) MerkleRoot() keybase1.MerkleRootV2 {
 	return *md.KBMerkleRoot
 }
 
+// IdempotencyKey implements the RootMetadata interface for
+// RootMetadataV3.
+func (md *RootMetadataV3) IdempotencyKey() IdempotencyKey {
+	if md.PutIdempotencyKey == nil {
+		return NullIdempotencyKey
+	}
+	return *md.PutIdempotencyKey
+}
+
 // BID implements the RootMetadata interface for RootMetadataV3.
 func (md *RootMetadataV3) BID() BranchID {
 	return md.WriterMetadata.BID
@@ -1228,12 +1300,26 @@ func (md *RootMetadataV3) SetMerkleRoot(root keybase1.MerkleRootV2) {
 	md.KBMerkleRoot = &root
 }
 
+// SetIdempotencyKey implements the MutableRootMetadata interface for
+// RootMetadataV3.
+func (md *RootMetadataV3) SetIdempotencyKey(key IdempotencyKey) {
+	if key == NullIdempotencyKey {
+		md.PutIdempotencyKey = nil
+		return
+	}
+	md.PutIdempotencyKey = &key
+}
+
+// updateKeyBundles fills in the latest key generation for any new
+// devices. encVer is the cipher of the key generation, which is only
+// used if it doesn't have any devices yet.
 func (md *RootMetadataV3) updateKeyBundles(codec kbfscodec.Codec,
 	extra ExtraMetadata,
 	updatedWriterKeys, updatedReaderKeys UserDevicePublicKeys,
 	ePubKey kbfscrypto.TLFEphemeralPublicKey,
 	ePrivKey kbfscrypto.TLFEphemeralPrivateKey,
-	tlfCryptKey kbfscrypto.TLFCryptKey) (UserDeviceKeyServerHalves, error) {
+	tlfCryptKey kbfscrypto.TLFCryptKey,
+	encVer kbfscrypto.EncryptionVer) (UserDeviceKeyServerHalves, error) {
 	if md.TypeForKeying() != tlf.PrivateKeying {
 		return nil, InvalidNonPrivateTLFOperation{
 			md.TlfID(), "updateKeyBundles", md.Version()}
@@ -1244,6 +1330,10 @@ func (md *RootMetadataV3) updateKeyBundles(codec kbfscodec.Codec,
 		return nil, err
 	}
 
+	if existingVer := wkb.Keys.dataEncryptionVer(); existingVer != 0 {
+		encVer = existingVer
+	}
+
 	// No need to explicitly handle the reader rekey case.
 
 	var newWriterIndex int
@@ -1252,7 +1342,7 @@ func (md *RootMetadataV3) updateKeyBundles(codec kbfscodec.Codec,
 	}
 	wServerHalves, err := wkb.Keys.FillInUserInfos(
 		newWriterIndex, updatedWriterKeys,
-		ePrivKey, tlfCryptKey)
+		ePrivKey, tlfCryptKey, encVer)
 	if err != nil {
 		return nil, err
 	}
@@ -1269,7 +1359,7 @@ func (md *RootMetadataV3) updateKeyBundles(codec kbfscodec.Codec,
 	}
 	rServerHalves, err := rkb.Keys.FillInUserInfos(
 		newReaderIndex, updatedReaderKeys,
-		ePrivKey, tlfCryptKey)
+		ePrivKey, tlfCryptKey, encVer)
 	if err != nil {
 		return nil, err
 	}
@@ -1310,6 +1400,7 @@ func (md *RootMetadataV3) AddKeyGeneration(
 
 	latestKeyGen := md.LatestKeyGeneration()
 	var encryptedHistoricKeys kbfscrypto.EncryptedTLFCryptKeys
+	var prevEncVer kbfscrypto.EncryptionVer
 	if currCryptKey == (kbfscrypto.TLFCryptKey{}) {
 		if latestKeyGen >= FirstValidKeyGen {
 			return nil, nil, errors.Errorf(
@@ -1322,6 +1413,7 @@ func (md *RootMetadataV3) AddKeyGeneration(
 			return nil, nil, errors.New("Invalid curr extra metadata")
 		}
 
+		prevEncVer = currExtraV3.wkb.Keys.dataEncryptionVer()
 		existingWriterKeys := currExtraV3.wkb.Keys.ToPublicKeys()
 		if !existingWriterKeys.Equals(updatedWriterKeys) {
 			return nil, nil, fmt.Errorf(
@@ -1368,6 +1460,11 @@ func (md *RootMetadataV3) AddKeyGeneration(
 		}
 	}
 
+	encVer, err := kbfscrypto.NegotiateEncryptionVer(prevEncVer)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	newWriterKeys := TLFWriterKeyBundleV3{
 		Keys:                          make(UserDeviceKeyInfoMapV3),
 		TLFPublicKey:                  pubKey,
@@ -1381,7 +1478,7 @@ func (md *RootMetadataV3) AddKeyGeneration(
 
 	serverHalves, err = md.updateKeyBundles(codec, nextExtra,
 		updatedWriterKeys, updatedReaderKeys,
-		ePubKey, ePrivKey, nextCryptKey)
+		ePubKey, ePrivKey, nextCryptKey, encVer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1483,7 +1580,7 @@ func (md *RootMetadataV3) UpdateKeyBundles(codec kbfscodec.Codec,
 
 	serverHalves, err := md.updateKeyBundles(codec, extra,
 		updatedWriterKeys, updatedReaderKeys,
-		ePubKey, ePrivKey, tlfCryptKeys[0])
+		ePubKey, ePrivKey, tlfCryptKeys[0], 0)
 	if err != nil {
 		return nil, err
 	}
@@ -11,6 +11,7 @@ import (
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -796,3 +797,97 @@ func TestRootMetadataV3AddKeyGenerationKeylessUsers(t *testing.T) {
 
 	checkKeyBundlesV3(t, expectedRekeyInfos, tlfCryptKey, pubKey, wkb, rkb)
 }
+
+func TestRootMetadataV3KeyGenerationEncryptionVer(t *testing.T) {
+	uid := keybase1.MakeTestUID(1)
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	bh, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	rmd, err := MakeInitialRootMetadataV3(tlfID, bh)
+	require.NoError(t, err)
+
+	codec := kbfscodec.NewMsgpack()
+
+	ePubKey, ePrivKey, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+	pubKey := kbfscrypto.MakeTLFPublicKey([32]byte{1})
+	tlfCryptKey1 := kbfscrypto.MakeTLFCryptKey([32]byte{1})
+	tlfCryptKey2 := kbfscrypto.MakeTLFCryptKey([32]byte{2})
+
+	t.Log("The first key generation uses the default cipher, " +
+		"which is stored as zero")
+	extra, _, err := rmd.AddKeyGeneration(codec, nil,
+		UserDevicePublicKeys{uid: {key1: true}}, UserDevicePublicKeys{},
+		ePubKey, ePrivKey, pubKey, kbfscrypto.TLFCryptKey{}, tlfCryptKey1)
+	require.NoError(t, err)
+	wkb, _, err := rmd.getTLFKeyBundles(extra)
+	require.NoError(t, err)
+	info := wkb.Keys[uid][key1]
+	require.Equal(t, kbfscrypto.EncryptionVer(0), info.EncryptionVer)
+	require.Equal(t, kbfscrypto.EncryptionSecretbox, info.DataEncryptionVer())
+	encVer, err := rmd.GetLatestDataEncryptionVer(extra)
+	require.NoError(t, err)
+	require.Equal(t, kbfscrypto.EncryptionSecretbox, encVer)
+
+	t.Log("New devices get the existing key generation's cipher")
+	unknownVer := kbfscrypto.EncryptionVer(99)
+	info.EncryptionVer = unknownVer
+	wkb.Keys[uid][key1] = info
+	_, err = rmd.UpdateKeyBundles(codec, extra,
+		UserDevicePublicKeys{uid: {key1: true, key2: true}},
+		UserDevicePublicKeys{}, ePubKey, ePrivKey,
+		[]kbfscrypto.TLFCryptKey{tlfCryptKey1})
+	require.NoError(t, err)
+	require.Equal(t, unknownVer, wkb.Keys[uid][key2].DataEncryptionVer())
+	encVer, err = rmd.GetLatestDataEncryptionVer(extra)
+	require.NoError(t, err)
+	require.Equal(t, unknownVer, encVer)
+
+	t.Log("A new key generation can't be negotiated from an " +
+		"unsupported cipher")
+	_, _, err = rmd.AddKeyGeneration(codec, extra,
+		UserDevicePublicKeys{uid: {key1: true, key2: true}},
+		UserDevicePublicKeys{}, ePubKey, ePrivKey, pubKey,
+		tlfCryptKey1, tlfCryptKey2)
+	require.Equal(t,
+		kbfscrypto.UnknownEncryptionVer{Ver: unknownVer},
+		errors.Cause(err))
+}
+
+func TestRootMetadataV3IdempotencyKey(t *testing.T) {
+	tlfID := tlf.FakeID(1, tlf.Public)
+	uid := keybase1.MakeTestUID(1)
+	bh, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()},
+		[]keybase1.UserOrTeamID{keybase1.PublicUID.AsUserOrTeam()},
+		nil, nil, nil)
+	require.NoError(t, err)
+	rmd, err := MakeInitialRootMetadataV3(tlfID, bh)
+	require.NoError(t, err)
+	require.Equal(t, NullIdempotencyKey, rmd.IdempotencyKey())
+
+	codec := kbfscodec.NewMsgpack()
+	encodedNoKey, err := codec.Encode(rmd)
+	require.NoError(t, err)
+
+	key, err := MakeRandomIdempotencyKey()
+	require.NoError(t, err)
+	rmd.SetIdempotencyKey(key)
+	encoded, err := codec.Encode(rmd)
+	require.NoError(t, err)
+	var decoded RootMetadataV3
+	err = codec.Decode(encoded, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, key, decoded.IdempotencyKey())
+
+	// Clearing the key omits it from the encoding again.
+	rmd.SetIdempotencyKey(NullIdempotencyKey)
+	encoded, err = codec.Encode(rmd)
+	require.NoError(t, err)
+	require.Equal(t, encodedNoKey, encoded)
+}
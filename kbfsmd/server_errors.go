@@ -64,6 +64,11 @@ const (
 	// should ask service to create an implicit team for the give handle, and
 	// use the i-team backed TLF.
 	StatusCodeServerErrorClassicTLFDoesNotExist = 2814
+	// StatusCodeServerErrorTlfQuarantined is the error code returned
+	// for a TLF that has been quarantined by the server admins (e.g.,
+	// for abuse or a legal hold).  Writes are always rejected, and
+	// reads are too unless the error says otherwise.
+	StatusCodeServerErrorTlfQuarantined = 2815
 )
 
 // ServerError is a generic server-side error.
@@ -387,6 +392,32 @@ func (e ServerErrorClassicTLFDoesNotExist) ToStatus() (s keybase1.Status) {
 	return
 }
 
+// ServerErrorTlfQuarantined is the error type for
+// StatusCodeServerErrorTlfQuarantined.
+type ServerErrorTlfQuarantined struct {
+	Reason string
+	// ReadsAllowed is true if the server still serves reads of the
+	// TLF.
+	ReadsAllowed bool
+}
+
+// Error implements the Error interface.
+func (e ServerErrorTlfQuarantined) Error() string {
+	return fmt.Sprintf("ServerErrorTlfQuarantined{Reason: %q, "+
+		"ReadsAllowed: %t}", e.Reason, e.ReadsAllowed)
+}
+
+// ToStatus implements the ExportableError interface.
+func (e ServerErrorTlfQuarantined) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeServerErrorTlfQuarantined
+	s.Name = "TLF_QUARANTINED"
+	s.Desc = e.Reason
+	s.Fields = []keybase1.StringKVPair{
+		{Key: "ReadsAllowed", Value: strconv.FormatBool(e.ReadsAllowed)},
+	}
+	return
+}
+
 // ServerErrorUnwrapper is an implementation of rpc.ErrorUnwrapper
 // for errors coming from the MDServer.
 type ServerErrorUnwrapper struct{}
@@ -487,6 +518,16 @@ func (eu ServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, dis
 	case StatusCodeServerErrorClassicTLFDoesNotExist:
 		appError = ServerErrorClassicTLFDoesNotExist{}
 		break
+	case StatusCodeServerErrorTlfQuarantined:
+		err := ServerErrorTlfQuarantined{Reason: s.Desc}
+		for _, f := range s.Fields {
+			if f.Key == "ReadsAllowed" {
+				err.ReadsAllowed, _ = strconv.ParseBool(f.Value)
+				break
+			}
+		}
+		appError = err
+		break
 	default:
 		ase := libkb.AppStatusError{
 			Code:   s.Code,
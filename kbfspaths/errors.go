@@ -0,0 +1,45 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfspaths
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// NotDirError is returned when a path that needs to be a directory
+// isn't one.
+type NotDirError struct {
+	pathStr string
+}
+
+// Error implements the error interface for NotDirError.
+func (e NotDirError) Error() string {
+	return fmt.Sprintf("%s is not a directory", e.pathStr)
+}
+
+// NotFileError is returned when a path that needs to be a regular
+// file isn't one.
+type NotFileError struct {
+	pathStr   string
+	entryType libkbfs.EntryType
+}
+
+// Error implements the error interface for NotFileError.
+func (e NotFileError) Error() string {
+	return fmt.Sprintf("%s is not a file, but a %s", e.pathStr, e.entryType)
+}
+
+// TooManySymlinksError is returned when resolving a path follows
+// more symlinks than allowed, usually because of a loop.
+type TooManySymlinksError struct {
+	pathStr string
+}
+
+// Error implements the error interface for TooManySymlinksError.
+func (e TooManySymlinksError) Error() string {
+	return fmt.Sprintf("too many levels of symbolic links in %s", e.pathStr)
+}
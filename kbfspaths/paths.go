@@ -0,0 +1,256 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package kbfspaths provides simple string-path access to KBFS, for
+// callers that would rather not deal with TLF handles and Nodes
+// directly.  Paths look like "/keybase/private/alice,bob/notes.txt".
+package kbfspaths
+
+import (
+	"path"
+	"strings"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	topName     = "keybase"
+	publicName  = "public"
+	privateName = "private"
+)
+
+// maxSymlinkHops is the number of symlinks that will be followed
+// while resolving a single path, matching Linux's ELOOP limit.
+const maxSymlinkHops = 40
+
+// FS resolves string paths to KBFS nodes, using the TLFs, favorites
+// and KBFSOps of a given config.
+type FS struct {
+	config libkbfs.Config
+}
+
+// New returns a new FS that resolves paths against the given config.
+func New(config libkbfs.Config) *FS {
+	return &FS{config: config}
+}
+
+// resolve walks `pathStr` component by component, following any
+// symlinks it meets along the way.  If `followLast` is false, a
+// symlink in the final component is returned as-is, like lstat(2).
+// The returned Node is nil for anything above a TLF root, and for
+// unfollowed symlinks.
+func (fs *FS) resolve(
+	ctx context.Context, pathStr string, followLast bool) (
+	p fsrpc.Path, n libkbfs.Node, ei libkbfs.EntryInfo, err error) {
+	p, err = fsrpc.NewPath(pathStr)
+	if err != nil {
+		return fsrpc.Path{}, nil, libkbfs.EntryInfo{}, err
+	}
+
+	kbfsOps := fs.config.KBFSOps()
+	for hops := 0; ; {
+		if p.PathType != fsrpc.TLFPathType {
+			return p, nil, libkbfs.EntryInfo{Type: libkbfs.Dir}, nil
+		}
+
+		h, err := fsrpc.ParseTlfHandle(
+			ctx, fs.config.KBPKI(), fs.config.MDOps(), p.TLFName, p.TLFType)
+		if err != nil {
+			return fsrpc.Path{}, nil, libkbfs.EntryInfo{}, err
+		}
+		n, ei, err = kbfsOps.GetOrCreateRootNode(ctx, h, libkbfs.MasterBranch)
+		if err != nil {
+			return fsrpc.Path{}, nil, libkbfs.EntryInfo{}, err
+		}
+
+		var next string
+		for i, name := range p.TLFComponents {
+			if ei.Type != libkbfs.Dir {
+				return fsrpc.Path{}, nil, libkbfs.EntryInfo{},
+					NotDirError{pathStr}
+			}
+			n, ei, err = kbfsOps.Lookup(ctx, n, name)
+			if err != nil {
+				return fsrpc.Path{}, nil, libkbfs.EntryInfo{}, err
+			}
+			isLast := i == len(p.TLFComponents)-1
+			if ei.Type != libkbfs.Sym || (isLast && !followLast) {
+				continue
+			}
+
+			// Splice the link target into the path and start over
+			// from the top.
+			hops++
+			if hops > maxSymlinkHops {
+				return fsrpc.Path{}, nil, libkbfs.EntryInfo{},
+					TooManySymlinksError{pathStr}
+			}
+			rest := path.Join(p.TLFComponents[i+1:]...)
+			if path.IsAbs(ei.SymPath) {
+				next = path.Join(ei.SymPath, rest)
+			} else {
+				parent := fsrpc.Path{
+					PathType:      fsrpc.TLFPathType,
+					TLFType:       p.TLFType,
+					TLFName:       p.TLFName,
+					TLFComponents: p.TLFComponents[:i],
+				}
+				next = path.Join(parent.String(), ei.SymPath, rest)
+			}
+			break
+		}
+		if next == "" {
+			return p, n, ei, nil
+		}
+		p, err = fsrpc.NewPath(next)
+		if err != nil {
+			return fsrpc.Path{}, nil, libkbfs.EntryInfo{}, err
+		}
+	}
+}
+
+// Lookup returns the Node and entry info for the given path,
+// following symlinks.  The returned Node is nil for paths above a
+// TLF root, such as "/keybase/private".
+func (fs *FS) Lookup(ctx context.Context, pathStr string) (
+	libkbfs.Node, libkbfs.EntryInfo, error) {
+	_, n, ei, err := fs.resolve(ctx, pathStr, true)
+	return n, ei, err
+}
+
+// Stat returns the entry info for the given path, following
+// symlinks.
+func (fs *FS) Stat(ctx context.Context, pathStr string) (
+	libkbfs.EntryInfo, error) {
+	_, _, ei, err := fs.resolve(ctx, pathStr, true)
+	return ei, err
+}
+
+// Lstat is like Stat, but if the final component of the path is a
+// symlink, it returns the entry info for the link itself.
+func (fs *FS) Lstat(ctx context.Context, pathStr string) (
+	libkbfs.EntryInfo, error) {
+	_, _, ei, err := fs.resolve(ctx, pathStr, false)
+	return ei, err
+}
+
+// List returns the entries in the given directory.  For
+// "/keybase/public" and "/keybase/private", that's the user's
+// favorite TLFs of that type.
+func (fs *FS) List(ctx context.Context, pathStr string) (
+	map[string]libkbfs.EntryInfo, error) {
+	p, n, ei, err := fs.resolve(ctx, pathStr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	dirInfo := libkbfs.EntryInfo{Type: libkbfs.Dir}
+	switch p.PathType {
+	case fsrpc.RootPathType:
+		return map[string]libkbfs.EntryInfo{topName: dirInfo}, nil
+	case fsrpc.KeybasePathType:
+		return map[string]libkbfs.EntryInfo{
+			publicName:  dirInfo,
+			privateName: dirInfo,
+		}, nil
+	case fsrpc.KeybaseChildPathType:
+		favs, err := fs.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		children := make(map[string]libkbfs.EntryInfo)
+		for _, fav := range favs {
+			if fav.Type == p.TLFType {
+				children[fav.Name] = dirInfo
+			}
+		}
+		return children, nil
+	}
+
+	if ei.Type != libkbfs.Dir {
+		return nil, NotDirError{pathStr}
+	}
+	return fs.config.KBFSOps().GetDirChildren(ctx, n)
+}
+
+// ReadFile returns the full contents of the file at the given path.
+func (fs *FS) ReadFile(ctx context.Context, pathStr string) ([]byte, error) {
+	n, ei, err := fs.Lookup(ctx, pathStr)
+	if err != nil {
+		return nil, err
+	}
+	if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+		return nil, NotFileError{pathStr, ei.Type}
+	}
+
+	buf := make([]byte, ei.Size)
+	var off int64
+	for off < int64(len(buf)) {
+		nRead, err := fs.config.KBFSOps().Read(ctx, n, buf[off:], off)
+		if err != nil {
+			return nil, err
+		}
+		if nRead == 0 {
+			break
+		}
+		off += nRead
+	}
+	return buf[:off], nil
+}
+
+// WriteFile writes `data` to the file at the given path, creating it
+// if it doesn't exist and truncating it if it does, and then syncs
+// the change to the server.  The parent directory must already
+// exist.
+func (fs *FS) WriteFile(
+	ctx context.Context, pathStr string, data []byte) error {
+	dirStr, name := path.Split(path.Clean(pathStr))
+	dirStr = strings.TrimSuffix(dirStr, "/")
+	dir, dirInfo, err := fs.Lookup(ctx, dirStr)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return errors.Errorf("Cannot write a file directly in %s", dirStr)
+	}
+	if dirInfo.Type != libkbfs.Dir {
+		return NotDirError{dirStr}
+	}
+
+	kbfsOps := fs.config.KBFSOps()
+	n, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	switch errors.Cause(err).(type) {
+	case nil:
+		if ei.Type == libkbfs.Sym {
+			// Write through the link to wherever it points.
+			n, ei, err = fs.Lookup(ctx, pathStr)
+			if err != nil {
+				return err
+			}
+		}
+		if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+			return NotFileError{pathStr, ei.Type}
+		}
+		err = kbfsOps.Truncate(ctx, n, 0)
+		if err != nil {
+			return err
+		}
+	case libkbfs.NoSuchNameError:
+		n, _, err = kbfsOps.CreateFile(ctx, dir, name, false, libkbfs.NoExcl)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	err = kbfsOps.Write(ctx, n, data, 0)
+	if err != nil {
+		return err
+	}
+	return kbfsOps.SyncAll(ctx, n.GetFolderBranch())
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package kbfspaths
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathsReadWriteStat(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	fs := New(config)
+
+	const file = "/keybase/private/bob,alice/notes.txt"
+	data := []byte("hello")
+	err := fs.WriteFile(ctx, file, data)
+	require.NoError(t, err)
+
+	// Non-canonical TLF names resolve to the same folder.
+	got, err := fs.ReadFile(ctx, "/keybase/private/alice,bob/notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// Overwriting truncates the old contents.
+	err = fs.WriteFile(ctx, file, []byte("hi"))
+	require.NoError(t, err)
+	got, err = fs.ReadFile(ctx, file)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), got)
+
+	ei, err := fs.Stat(ctx, file)
+	require.NoError(t, err)
+	require.Equal(t, libkbfs.File, ei.Type)
+	require.Equal(t, uint64(2), ei.Size)
+
+	children, err := fs.List(ctx, "/keybase/private/alice,bob")
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, libkbfs.File, children["notes.txt"].Type)
+
+	children, err = fs.List(ctx, "/keybase/private")
+	require.NoError(t, err)
+	require.Contains(t, children, "alice,bob")
+
+	_, err = fs.List(ctx, file)
+	require.IsType(t, NotDirError{}, errors.Cause(err))
+	_, err = fs.ReadFile(ctx, "/keybase/private/alice,bob")
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+	_, err = fs.ReadFile(ctx, "/keybase/private/alice,bob/missing")
+	require.IsType(t, libkbfs.NoSuchNameError{}, errors.Cause(err))
+}
+
+func TestPathsSymlinks(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	config := libkbfs.MakeTestConfigOrBust(t, "alice")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	fs := New(config)
+
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "alice", tlf.Private)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "rel", "d")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "up", "../rel/f")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(
+		ctx, rootNode, "abs", "/keybase/private/alice/d")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "loop", "loop")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	data := []byte("data")
+	err = fs.WriteFile(ctx, "/keybase/private/alice/rel/f", data)
+	require.NoError(t, err)
+
+	for _, p := range []string{
+		"/keybase/private/alice/d/f",
+		"/keybase/private/alice/abs/f",
+		"/keybase/private/alice/d/up",
+	} {
+		got, err := fs.ReadFile(ctx, p)
+		require.NoError(t, err, p)
+		require.Equal(t, data, got, p)
+	}
+
+	ei, err := fs.Lstat(ctx, "/keybase/private/alice/rel")
+	require.NoError(t, err)
+	require.Equal(t, libkbfs.Sym, ei.Type)
+	require.Equal(t, "d", ei.SymPath)
+	ei, err = fs.Stat(ctx, "/keybase/private/alice/rel")
+	require.NoError(t, err)
+	require.Equal(t, libkbfs.Dir, ei.Type)
+
+	_, err = fs.Stat(ctx, "/keybase/private/alice/loop")
+	require.IsType(t, TooManySymlinksError{}, errors.Cause(err))
+}
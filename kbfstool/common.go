@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/keybase/kbfs/kbfserrors"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
 )
@@ -28,5 +29,13 @@ func byteCountStr(n int) string {
 }
 
 func printError(prefix string, err error) {
-	fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, err)
+	if _, ok := kbfserrors.Lookup(err); !ok {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, err)
+		return
+	}
+	e := kbfserrors.Describe(err)
+	fmt.Fprintf(os.Stderr, "%s: %s [%s]\n", prefix, e.Message, e.Code)
+	if e.Hint != "" {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, e.Hint)
+	}
 }
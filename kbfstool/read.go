@@ -10,7 +10,7 @@ import (
 	"io"
 	"os"
 
-	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfspaths"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -59,24 +59,19 @@ func readHelper(ctx context.Context, config libkbfs.Config, args []string) error
 	}
 
 	filePathStr := flags.Arg(0)
-	p, err := fsrpc.NewPath(filePathStr)
-	if err != nil {
-		return err
-	}
-
-	if p.PathType != fsrpc.TLFPathType {
-		return fmt.Errorf("Cannot read %s", p)
-	}
-
 	if *verbose {
-		fmt.Fprintf(os.Stderr, "Looking up %s\n", p)
+		fmt.Fprintf(os.Stderr, "Looking up %s\n", filePathStr)
 	}
 
-	fileNode, err := p.GetFileNode(ctx, config)
+	fileNode, ei, err := kbfspaths.New(config).Lookup(ctx, filePathStr)
 	if err != nil {
 		return err
 	}
 
+	if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+		return fmt.Errorf("Cannot read %s, which is a %s", filePathStr, ei.Type)
+	}
+
 	nr := nodeReader{
 		ctx:     ctx,
 		kbfsOps: config.KBFSOps(),
@@ -9,33 +9,17 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfspaths"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
 
 func statNode(ctx context.Context, config libkbfs.Config, nodePathStr string) error {
-	p, err := fsrpc.NewPath(nodePathStr)
+	ei, err := kbfspaths.New(config).Lstat(ctx, nodePathStr)
 	if err != nil {
 		return err
 	}
 
-	n, ei, err := p.GetNode(ctx, config)
-	if err != nil {
-		return err
-	}
-
-	// If n is non-nil, ignore the EntryInfo returned by
-	// p.getNode() so we can exercise the Stat() codepath. We
-	// can't compare the two, since they might legitimately differ
-	// due to races.
-	if n != nil {
-		ei, err = config.KBFSOps().Stat(ctx, n)
-		if err != nil {
-			return err
-		}
-	}
-
 	var symPathStr string
 	if ei.Type == libkbfs.Sym {
 		symPathStr = fmt.Sprintf("SymPath: %s, ", ei.SymPath)
@@ -24,6 +24,7 @@ func main() {
 	app.Commands = []cli.Command{
 		userCmd,
 		aclCmd,
+		shareCmd,
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,164 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/cli"
+	"github.com/keybase/kbfs/libpages"
+)
+
+const defaultShareExpiry = 7 * 24 * time.Hour
+
+// tarPath packs the file or directory at `p` into a tar archive,
+// with names relative to the directory containing it.
+func tarPath(p string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	base := filepath.Dir(filepath.Clean(p))
+	err := filepath.Walk(p, func(
+		file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			// Skip symlinks and anything else unusual.
+			return nil
+		}
+		name, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if buf.Len()+int(fi.Size()) > libpages.MaxShareSize {
+			return fmt.Errorf("%s is too large to share", p)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var shareCreateCmd = cli.Command{
+	Name:         "create",
+	Usage:        "share a file or directory through an encrypted link",
+	ArgumentHelp: "create <path>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "domain",
+			Usage: "the domain the site is served on",
+		},
+		cli.DurationFlag{
+			Name:  "expire",
+			Value: defaultShareExpiry,
+			Usage: "how long the link works for",
+		},
+	},
+	Action: func(c *cli.Context) {
+		if len(c.Args()) != 1 {
+			fmt.Fprintln(os.Stderr, "need exactly 1 arg")
+			os.Exit(1)
+		}
+		domain := c.String("domain")
+		if domain == "" {
+			fmt.Fprintln(os.Stderr, "--domain is required")
+			os.Exit(1)
+		}
+		archive, err := tarPath(c.Args()[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "archiving error: %v\n", err)
+			os.Exit(1)
+		}
+		key, err := libpages.NewShareKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "making key error: %v\n", err)
+			os.Exit(1)
+		}
+		sealed, err := libpages.SealShare(
+			key, time.Now().Add(c.Duration("expire")), archive)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "encrypting error: %v\n", err)
+			os.Exit(1)
+		}
+		id, err := libpages.NewShareID()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "making share ID error: %v\n", err)
+			os.Exit(1)
+		}
+		shareDir := filepath.Join(c.GlobalString("dir"), libpages.ShareDir)
+		if err = os.MkdirAll(shareDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "creating %s error: %v\n", shareDir, err)
+			os.Exit(1)
+		}
+		err = ioutil.WriteFile(filepath.Join(shareDir, id), sealed, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "writing share error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(libpages.ShareURL(domain, id, key))
+	},
+}
+
+var shareRevokeCmd = cli.Command{
+	Name:         "revoke",
+	Usage:        "revoke share link(s) by removing their shares",
+	ArgumentHelp: "revoke <share ID> [share ID ...]",
+	Action: func(c *cli.Context) {
+		if len(c.Args()) < 1 {
+			fmt.Fprintln(os.Stderr, "need at least 1 arg")
+			os.Exit(1)
+		}
+		shareDir := filepath.Join(c.GlobalString("dir"), libpages.ShareDir)
+		for _, id := range c.Args() {
+			if filepath.Base(id) != id {
+				fmt.Fprintf(os.Stderr, "invalid share ID %q\n", id)
+				os.Exit(1)
+			}
+			if err := os.Remove(filepath.Join(shareDir, id)); err != nil {
+				fmt.Fprintf(os.Stderr, "removing share error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+var shareCmd = cli.Command{
+	Name:         "share",
+	Usage:        "make or revoke end-to-end encrypted share links",
+	ArgumentHelp: "share <create|revoke> <args>",
+	Subcommands: []cli.Command{
+		shareCreateCmd,
+		shareRevokeCmd,
+	},
+}
@@ -7,8 +7,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 
+	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/env"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/libpages"
@@ -20,12 +25,97 @@ var (
 	fProd           bool
 	fDiskCertCache  bool
 	fNoRedirectHTTP bool
+	fDebugHTTPAddr  string
+	fPrewarmFile    string
+	fAnonymous      bool
+	fOrigins        = originFlags{}
 )
 
+// originServers holds the servers of a KBFS deployment other than the
+// default one.
+type originServers struct {
+	mdserver string
+	bserver  string
+}
+
+// originFlags collects -origin flags, keyed by origin name.
+type originFlags map[string]originServers
+
+// String implements the flag.Value interface for originFlags.
+func (o originFlags) String() string {
+	origins := make([]string, 0, len(o))
+	for name, servers := range o {
+		origins = append(origins, fmt.Sprintf(
+			"%s=%s,%s", name, servers.mdserver, servers.bserver))
+	}
+	return strings.Join(origins, " ")
+}
+
+// Set implements the flag.Value interface for originFlags.
+func (o originFlags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("origin %q isn't name=mdserver,bserver", s)
+	}
+	servers := strings.Split(parts[1], ",")
+	if len(servers) != 2 || servers[0] == "" || servers[1] == "" {
+		return fmt.Errorf("origin %q isn't name=mdserver,bserver", s)
+	}
+	o[parts[0]] = originServers{mdserver: servers[0], bserver: servers[1]}
+	return nil
+}
+
 func init() {
 	flag.BoolVar(&fProd, "prod", false, "disable development mode")
 	flag.BoolVar(&fDiskCertCache, "use-disk-cert-cache", false, "cache cert on disk")
 	flag.BoolVar(&fNoRedirectHTTP, "no-redirect-http", false, "do not redirect to HTTPS")
+	flag.StringVar(&fDebugHTTPAddr, "debug-http-addr", "", "local address "+
+		"(e.g. localhost:8080) to serve /debug/logging on, for turning "+
+		"KBFS debug logging on and off at runtime, and /debug/roots, for "+
+		"inspecting and purging the DNS root cache")
+	flag.Var(fOrigins, "origin", "name=mdserver,bserver of a KBFS "+
+		"deployment, other than the default one, that sites can name in "+
+		"a kbp_origin= TXT record; can be repeated")
+	flag.StringVar(&fPrewarmFile, "prewarm-domains-file", "", "file "+
+		"listing domains, one per line, whose certificates are loaded or "+
+		"issued at startup instead of on their first visit")
+	flag.BoolVar(&fAnonymous, "anonymous", false, "read sites without "+
+		"a logged-in keybase user; only sites in public folders can "+
+		"then be served")
+}
+
+// readPrewarmDomains reads the domains in the file at `path`, one per
+// line.  Blank lines and lines starting with # are skipped.
+func readPrewarmDomains(path string) (domains []string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, nil
+}
+
+// makeKBFSConfigMaker returns a libpages.KBFSConfigMaker that makes
+// configs for the origins given with -origin, based on `params`.  The
+// configs all talk to the same local keybase service.
+func makeKBFSConfigMaker(kbCtx libkbfs.Context, params libkbfs.InitParams,
+	onInterruptFn func(), log logger.Logger) libpages.KBFSConfigMaker {
+	return func(ctx context.Context, origin string) (libkbfs.Config, error) {
+		servers, ok := fOrigins[origin]
+		if !ok {
+			return nil, libpages.ErrUnknownOrigin{Origin: origin}
+		}
+		params.MDServerAddr = servers.mdserver
+		params.BServerAddr = servers.bserver
+		return libkbfs.InitWithLogPrefix(ctx, kbCtx, params, nil,
+			onInterruptFn, log, "kbfs_"+origin)
+	}
 }
 
 func newLogger(isCLI bool) (*zap.Logger, error) {
@@ -68,7 +158,9 @@ func main() {
 	kbCtx := env.NewContext()
 	params := libkbfs.DefaultInitParams(kbCtx)
 	params.EnableJournal = false
+	params.Mode = libkbfs.InitReadOnlyString
 	params.Debug = true
+	params.Anonymous = fAnonymous
 	kbfsLog, err := libkbfs.InitLog(params, kbCtx)
 	if err != nil {
 		logger.Panic("libkbfs.InitLog", zap.Error(err))
@@ -79,11 +171,38 @@ func main() {
 		logger.Panic("libkbfs.Init", zap.Error(err))
 	}
 
+	rootCache, err := libpages.NewRootCache(logger, kbConfig.MetricsRegistry())
+	if err != nil {
+		logger.Panic("libpages.NewRootCache", zap.Error(err))
+	}
+
+	go libkbfs.HandleDebugLoggingSignal(ctx, kbfsLog)
+	if fDebugHTTPAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/logging", libkbfs.DebugLoggingHandler())
+		mux.Handle("/debug/roots", rootCache.Handler())
+		go func() {
+			err := http.ListenAndServe(fDebugHTTPAddr, mux)
+			logger.Warn("debug HTTP server", zap.Error(err))
+		}()
+	}
+
 	serverConfig := libpages.ServerConfig{
 		UseStaging:       !fProd,
 		Logger:           logger,
 		UseDiskCertCache: fDiskCertCache,
 		AutoDirectHTTP:   !fNoRedirectHTTP,
+		RootCache:        rootCache,
+	}
+	if fPrewarmFile != "" {
+		serverConfig.PrewarmDomains, err = readPrewarmDomains(fPrewarmFile)
+		if err != nil {
+			logger.Panic("readPrewarmDomains", zap.Error(err))
+		}
+	}
+	if len(fOrigins) > 0 {
+		serverConfig.KBFSConfigForOrigin = makeKBFSConfigMaker(
+			kbCtx, params, cancel, kbfsLog)
 	}
 
 	libpages.ListenAndServe(ctx, serverConfig, kbConfig)
@@ -90,6 +90,9 @@ func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Try not to lose dirty data when Windows shuts us down.
+	go libkbfs.HandleTerminateSignal(ctx, config, log)
+
 	if options.MountPoint == "" {
 		// The mounter will detect this case and pick up the path from DokanConfig
 		options.MountPoint, err = config.KeybaseService().EstablishMountDir(ctx)
@@ -126,5 +129,6 @@ func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
 	}
 
 	mi.Wait()
+	libkbfs.FlushOnExit(ctx, config, log)
 	return nil
 }
@@ -0,0 +1,214 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// ErrBadControlToken is returned when the data written to a control
+// file doesn't match that file's current confirmation token.
+var ErrBadControlToken = errors.New(
+	"Wrong confirmation token for control file")
+
+// controlFileAction is the operation triggered by a write to a
+// control file.
+type controlFileAction func(ctx context.Context, fs *FS) error
+
+func syncFromServerAction(ctx context.Context, fs *FS) error {
+	// Use a context with a nil CtxAppIDKey value so that
+	// notifications generated from this sync won't be discarded.
+	syncCtx := context.WithValue(ctx, CtxAppIDKey, nil)
+	return fs.config.KBFSOps().SyncFromServerForTesting(
+		syncCtx, fs.root.GetFolderBranch(), nil)
+}
+
+func unstageAction(ctx context.Context, fs *FS) error {
+	return fs.config.KBFSOps().UnstageForTesting(
+		ctx, fs.root.GetFolderBranch())
+}
+
+// tlfControlFiles are the control files an FS can serve at the root
+// of its TLF, if special files are enabled with `EnableSpecialFiles`.
+//
+// So that they can't be triggered by accident, for example by a
+// backup tool copying the TLF, a write to one of these files only
+// triggers its action if the data written is the file's current
+// confirmation token.  The token is what a read of the control file
+// returns, and it changes every time an action is triggered.
+var tlfControlFiles = map[string]controlFileAction{
+	SyncFromServerFileName: syncFromServerAction,
+	UnstageFileName:        unstageAction,
+}
+
+// lookupControlFile returns the action of the control file named by
+// `filename`, if there is one.
+func (fs *FS) lookupControlFile(filename string) (
+	action controlFileAction, name string, ok bool) {
+	name, ok = fs.specialFileName(filename)
+	if !ok {
+		return nil, "", false
+	}
+	action, ok = tlfControlFiles[name]
+	return action, name, ok
+}
+
+func makeControlToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getControlToken returns the current confirmation token for this
+// FS's control files.
+func (fs *FS) getControlToken() (string, error) {
+	fs.controlTokenLock.Lock()
+	defer fs.controlTokenLock.Unlock()
+	if fs.controlToken == "" {
+		token, err := makeControlToken()
+		if err != nil {
+			return "", err
+		}
+		fs.controlToken = token
+	}
+	return fs.controlToken, nil
+}
+
+// useControlToken checks that `data` holds the current confirmation
+// token and, if so, replaces it with a new one, so that the same
+// write can't trigger another action.
+func (fs *FS) useControlToken(data []byte) error {
+	token, err := makeControlToken()
+	if err != nil {
+		return err
+	}
+
+	fs.controlTokenLock.Lock()
+	defer fs.controlTokenLock.Unlock()
+	if fs.controlToken == "" ||
+		string(bytes.TrimSpace(data)) != fs.controlToken {
+		return ErrBadControlToken
+	}
+	fs.controlToken = token
+	return nil
+}
+
+func (fs *FS) statControlFile(name string) (*specialFileInfo, error) {
+	token, err := fs.getControlToken()
+	if err != nil {
+		return nil, err
+	}
+	return &specialFileInfo{
+		name:  name,
+		size:  int64(len(token) + 1),
+		mode:  0600,
+		mtime: fs.config.Clock().Now(),
+	}, nil
+}
+
+func (fs *FS) openControlFile(
+	action controlFileAction, name string, flag int) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		token, err := fs.getControlToken()
+		if err != nil {
+			return nil, err
+		}
+		return &specialFile{
+			name:   name,
+			Reader: bytes.NewReader([]byte(token + "\n")),
+		}, nil
+	}
+	if flag&os.O_RDWR != 0 {
+		return nil, errors.Errorf("%s can't be opened for both reading "+
+			"and writing", name)
+	}
+	return &controlFile{
+		fs:     fs,
+		name:   name,
+		action: action,
+	}, nil
+}
+
+// controlFile is a write-only handle to a control file.  Writing the
+// current confirmation token to it triggers its action.
+type controlFile struct {
+	fs     *FS
+	name   string
+	action controlFileAction
+}
+
+var _ billy.File = (*controlFile)(nil)
+
+// Name implements the billy.File interface for controlFile.
+func (cf *controlFile) Name() string {
+	return cf.name
+}
+
+// Write implements the billy.File interface for controlFile.
+func (cf *controlFile) Write(p []byte) (n int, err error) {
+	cf.fs.log.CDebugf(cf.fs.ctx, "Control file %s written", cf.name)
+	defer func() {
+		cf.fs.deferLog.CDebugf(cf.fs.ctx, "Control file %s done: %+v",
+			cf.name, err)
+	}()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	err = cf.fs.useControlToken(p)
+	if err != nil {
+		return 0, err
+	}
+	err = cf.action(cf.fs.ctx, cf.fs)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read implements the billy.File interface for controlFile.
+func (cf *controlFile) Read(_ []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// ReadAt implements the billy.File interface for controlFile.
+func (cf *controlFile) ReadAt(_ []byte, _ int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Seek implements the billy.File interface for controlFile.
+func (cf *controlFile) Seek(_ int64, _ int) (int64, error) {
+	return 0, nil
+}
+
+// Close implements the billy.File interface for controlFile.
+func (cf *controlFile) Close() error {
+	return nil
+}
+
+// Lock implements the billy.File interface for controlFile.
+func (cf *controlFile) Lock() error {
+	return errors.Errorf("%s can't be locked", cf.name)
+}
+
+// Unlock implements the billy.File interface for controlFile.
+func (cf *controlFile) Unlock() error {
+	return errors.Errorf("%s can't be locked", cf.name)
+}
+
+// Truncate implements the billy.File interface for controlFile.
+func (cf *controlFile) Truncate(_ int64) error {
+	// Control files are always empty as far as writers are concerned.
+	return nil
+}
@@ -63,6 +63,13 @@ type fsInner struct {
 
 	eventsLock sync.RWMutex
 	events     map[chan<- FSEvent]bool
+
+	// specialFiles is set when the FS should serve the KBFS special
+	// files at the root of its TLF.
+	specialFiles bool
+
+	controlTokenLock sync.Mutex
+	controlToken     string
 }
 
 // FS is a wrapper around a KBFS subdirectory that implements the
@@ -398,6 +405,13 @@ func (fs *FS) OpenFile(filename string, flag int, perm os.FileMode) (
 		err = translateErr(err)
 	}()
 
+	if contents, name, ok := fs.lookupSpecialFile(filename); ok {
+		return fs.openSpecialFile(contents, name, flag)
+	}
+	if action, name, ok := fs.lookupControlFile(filename); ok {
+		return fs.openControlFile(action, name, flag)
+	}
+
 	err = fs.mkdirAll(path.Dir(filename), 0755)
 	if err != nil && !os.IsExist(err) {
 		return nil, err
@@ -455,6 +469,17 @@ func (fs *FS) Stat(filename string) (fi os.FileInfo, err error) {
 		err = translateErr(err)
 	}()
 
+	if contents, name, ok := fs.lookupSpecialFile(filename); ok {
+		sfi, _, err := fs.readSpecialFile(contents, name)
+		if err != nil {
+			return nil, err
+		}
+		return sfi, nil
+	}
+	if _, name, ok := fs.lookupControlFile(filename); ok {
+		return fs.statControlFile(name)
+	}
+
 	n, ei, err := fs.lookupOrCreateEntry(filename, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
@@ -589,6 +614,17 @@ func (fs *FS) Lstat(filename string) (fi os.FileInfo, err error) {
 		err = translateErr(err)
 	}()
 
+	if contents, name, ok := fs.lookupSpecialFile(filename); ok {
+		sfi, _, err := fs.readSpecialFile(contents, name)
+		if err != nil {
+			return nil, err
+		}
+		return sfi, nil
+	}
+	if _, name, ok := fs.lookupControlFile(filename); ok {
+		return fs.statControlFile(name)
+	}
+
 	n, _, base, err := fs.lookupParent(filename)
 	if err != nil {
 		return nil, err
@@ -740,6 +776,11 @@ func (fs *FS) SyncAll() error {
 	return fs.config.KBFSOps().SyncAll(fs.ctx, fs.root.GetFolderBranch())
 }
 
+// FolderBranch returns the folder-branch of the TLF this FS is in.
+func (fs *FS) FolderBranch() libkbfs.FolderBranch {
+	return fs.root.GetFolderBranch()
+}
+
 // Config returns the underlying Config object of this FS.
 func (fs *FS) Config() libkbfs.Config {
 	return fs.config
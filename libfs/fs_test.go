@@ -7,6 +7,7 @@ package libfs
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"os"
 	"path"
 	"testing"
@@ -17,6 +18,7 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	billy "gopkg.in/src-d/go-billy.v4"
@@ -658,3 +660,109 @@ func TestFileLockingExpiration(t *testing.T) {
 	// the journal is in a weird state.
 	fs.config.MDServer().Shutdown()
 }
+
+func TestSpecialFiles(t *testing.T) {
+	ctx, h, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	rootNode, _, err := fs.config.KBFSOps().GetRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	require.NoError(t, err)
+	_, _, err = fs.config.KBFSOps().CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	t.Log("Special files are hidden unless enabled")
+	_, err = fs.Stat(StatusFileName)
+	require.True(t, os.IsNotExist(err))
+
+	fs.EnableSpecialFiles()
+	fi, err := fs.Stat(StatusFileName)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileName, fi.Name())
+	require.Equal(t, os.FileMode(0444), fi.Mode())
+	require.True(t, fi.Size() > 0)
+
+	f, err := fs.Open("/" + StatusFileName)
+	require.NoError(t, err)
+	var status libkbfs.FolderBranchStatus
+	err = json.NewDecoder(f).Decode(&status)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, fs.FolderBranch().Tlf.String(), status.FolderID)
+	require.Equal(t, "user1", status.HeadWriter.String())
+
+	f, err = fs.Open(UpdateHistoryFileName)
+	require.NoError(t, err)
+	var history libkbfs.TLFUpdateHistory
+	err = json.NewDecoder(f).Decode(&history)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Len(t, history.Updates, 2)
+
+	t.Log("Special files are read-only")
+	_, err = fs.OpenFile(StatusFileName, os.O_RDWR, 0600)
+	require.True(t, os.IsPermission(err))
+	_, err = fs.Create(StatusFileName)
+	require.True(t, os.IsPermission(err))
+
+	t.Log("They don't show up in directory listings")
+	fis, err := fs.ReadDir("")
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	require.Equal(t, "a", fis[0].Name())
+
+	t.Log("And they only exist at the TLF root")
+	subFS, err := fs.Chroot("a")
+	require.NoError(t, err)
+	_, err = subFS.Stat(StatusFileName)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestControlFiles(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+	fs.EnableSpecialFiles()
+
+	readToken := func() []byte {
+		f, err := fs.Open(SyncFromServerFileName)
+		require.NoError(t, err)
+		defer f.Close()
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(f)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	token := readToken()
+	require.NotEmpty(t, bytes.TrimSpace(token))
+	fi, err := fs.Stat(SyncFromServerFileName)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(token)), fi.Size())
+	require.Equal(t, os.FileMode(0600), fi.Mode())
+
+	t.Log("Writes without the token don't trigger anything")
+	f, err := fs.OpenFile(
+		SyncFromServerFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("1"))
+	require.Equal(t, ErrBadControlToken, errors.Cause(err))
+	require.Equal(t, token, readToken())
+
+	t.Log("Writing the token syncs, and changes the token")
+	n, err := f.Write(token)
+	require.NoError(t, err)
+	require.Equal(t, len(token), n)
+	require.NoError(t, f.Close())
+	newToken := readToken()
+	require.NotEqual(t, token, newToken)
+
+	t.Log("The old token can't be reused, even for another control file")
+	f, err = fs.OpenFile(UnstageFileName, os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(token)
+	require.Equal(t, ErrBadControlToken, errors.Cause(err))
+	_, err = f.Write(newToken)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+//go:build go1.17
+// +build go1.17
+
+package libfs
+
+import (
+	"context"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+)
+
+// ioFS is a read-only wrapper around an *FS that satisfies the io/fs
+// interfaces, so that libraries written against io/fs can read KBFS
+// content directly.  Unlike billy's Open, it never creates any
+// directories.
+type ioFS struct {
+	fs *FS
+}
+
+var _ iofs.StatFS = ioFS{}
+var _ iofs.ReadDirFS = ioFS{}
+
+func (ifs ioFS) lookup(op, name string) (
+	libkbfs.Node, libkbfs.EntryInfo, error) {
+	if !iofs.ValidPath(name) {
+		return nil, libkbfs.EntryInfo{},
+			&iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	n, ei, err := ifs.fs.lookupOrCreateEntry(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, libkbfs.EntryInfo{},
+			&iofs.PathError{Op: op, Path: name, Err: translateErr(err)}
+	}
+	return n, ei, nil
+}
+
+func (ifs ioFS) fileInfo(name string, ei libkbfs.EntryInfo) *FileInfo {
+	return &FileInfo{
+		fs:   ifs.fs,
+		ei:   ei,
+		name: path.Base(name),
+	}
+}
+
+// Open implements the io/fs.FS interface for ioFS.
+func (ifs ioFS) Open(name string) (f iofs.File, err error) {
+	ifs.fs.log.CDebugf(ifs.fs.ctx, "io/fs Open %s", name)
+	defer func() {
+		ifs.fs.deferLog.CDebugf(ifs.fs.ctx, "io/fs Open done: %+v", err)
+	}()
+
+	n, ei, err := ifs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if ei.Type == libkbfs.Dir {
+		return &ioDir{ifs: ifs, name: name, node: n, ei: ei}, nil
+	}
+	return &ioFile{
+		File: &File{
+			fs:       ifs.fs,
+			filename: name,
+			node:     n,
+			readOnly: true,
+		},
+		ifs: ifs,
+	}, nil
+}
+
+// Stat implements the io/fs.StatFS interface for ioFS.
+func (ifs ioFS) Stat(name string) (iofs.FileInfo, error) {
+	_, ei, err := ifs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return ifs.fileInfo(name, ei), nil
+}
+
+func (ifs ioFS) readDir(name string, n libkbfs.Node) (
+	[]iofs.DirEntry, error) {
+	children, err := ifs.fs.config.KBFSOps().GetDirChildren(ifs.fs.ctx, n)
+	if err != nil {
+		return nil, &iofs.PathError{
+			Op: "readdir", Path: name, Err: translateErr(err)}
+	}
+	entries := make([]iofs.DirEntry, 0, len(children))
+	for childName, ei := range children {
+		entries = append(entries, iofs.FileInfoToDirEntry(
+			ifs.fileInfo(childName, ei)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// ReadDir implements the io/fs.ReadDirFS interface for ioFS.
+func (ifs ioFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	n, ei, err := ifs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if ei.Type != libkbfs.Dir {
+		return nil, &iofs.PathError{
+			Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return ifs.readDir(name, n)
+}
+
+// ioFile is a read-only File that also implements io/fs.File.
+type ioFile struct {
+	*File
+	ifs ioFS
+}
+
+var _ iofs.File = (*ioFile)(nil)
+
+// Stat implements the io/fs.File interface for ioFile.
+func (f *ioFile) Stat() (iofs.FileInfo, error) {
+	ei, err := f.fs.config.KBFSOps().Stat(f.fs.ctx, f.node)
+	if err != nil {
+		return nil, &iofs.PathError{
+			Op: "stat", Path: f.filename, Err: translateErr(err)}
+	}
+	return f.ifs.fileInfo(f.filename, ei), nil
+}
+
+// Read implements the io/fs.File interface for ioFile.
+func (f *ioFile) Read(p []byte) (int, error) {
+	// io.Reader allows an empty read to return EOF at the end of the
+	// file, but io/fs wants it to succeed.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return f.File.Read(p)
+}
+
+// ReadAt implements the io.ReaderAt interface for ioFile.  Unlike
+// File.ReadAt, a short read at the end of the file returns the bytes
+// it got along with io.EOF, as io/fs callers expect.
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	readBytes, err := f.fs.config.KBFSOps().Read(f.fs.ctx, f.node, p, off)
+	if err != nil {
+		return 0, err
+	}
+	if int(readBytes) < len(p) {
+		return int(readBytes), io.EOF
+	}
+	return int(readBytes), nil
+}
+
+// ioDir is a directory opened through ioFS.
+type ioDir struct {
+	ifs     ioFS
+	name    string
+	node    libkbfs.Node
+	ei      libkbfs.EntryInfo
+	entries []iofs.DirEntry
+	read    bool
+}
+
+var _ iofs.ReadDirFile = (*ioDir)(nil)
+
+// Stat implements the io/fs.File interface for ioDir.
+func (d *ioDir) Stat() (iofs.FileInfo, error) {
+	return d.ifs.fileInfo(d.name, d.ei), nil
+}
+
+// Read implements the io/fs.File interface for ioDir.
+func (d *ioDir) Read(_ []byte) (int, error) {
+	return 0, &iofs.PathError{
+		Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// Close implements the io/fs.File interface for ioDir.
+func (d *ioDir) Close() error {
+	d.node = nil
+	d.entries = nil
+	return nil
+}
+
+// ReadDir implements the io/fs.ReadDirFile interface for ioDir.
+func (d *ioDir) ReadDir(count int) ([]iofs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.ifs.readDir(d.name, d.node)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// ToIOFS calls fs.WithContext with ctx to create a *FS with the new
+// ctx, and returns a read-only wrapper around it that satisfies the
+// io/fs.FS interface (along with StatFS and ReadDirFS).
+func (fs *FS) ToIOFS(ctx context.Context) iofs.FS {
+	return ioFS{fs: fs.WithContext(ctx)}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+//go:build go1.17
+// +build go1.17
+
+package libfs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOFS(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	for _, name := range []string{"a", "b/c", "b/d/e"} {
+		f, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(name))
+		require.NoError(t, err)
+		err = f.Close()
+		require.NoError(t, err)
+	}
+	err := fs.SyncAll()
+	require.NoError(t, err)
+
+	ifs := fs.ToIOFS(ctx)
+	err = fstest.TestFS(ifs, "a", "b/c", "b/d/e")
+	require.NoError(t, err)
+
+	data, err := iofs.ReadFile(ifs, "b/d/e")
+	require.NoError(t, err)
+	require.Equal(t, "b/d/e", string(data))
+
+	// Missing paths are reported as such, and opening one must not
+	// create any parent directories.
+	_, err = ifs.Open("x/y")
+	require.True(t, errors.Is(err, iofs.ErrNotExist), "%+v", err)
+	_, err = iofs.Stat(ifs, "x")
+	require.True(t, errors.Is(err, iofs.ErrNotExist), "%+v", err)
+
+	_, err = ifs.Open("/a")
+	require.True(t, errors.Is(err, iofs.ErrInvalid), "%+v", err)
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// specialFileContents generates the contents of a read-only special
+// file for a TLF.
+type specialFileContents func(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) ([]byte, time.Time, error)
+
+// tlfSpecialFiles are the special files an FS can serve at the root
+// of its TLF, if they are enabled with `EnableSpecialFiles`.
+var tlfSpecialFiles = map[string]specialFileContents{
+	StatusFileName:        GetEncodedFolderStatus,
+	UpdateHistoryFileName: GetEncodedUpdateHistory,
+	EditHistoryName:       GetEncodedTlfEditHistory,
+}
+
+// EnableSpecialFiles makes this FS serve the read-only KBFS special
+// files (like `.kbfs_status`) at the root of its TLF, generated on
+// the fly whenever they're opened.  They are not listed by
+// `ReadDir`.  This has no effect on an FS that is rooted in a
+// subdirectory of the TLF.  It must be called before the FS is used.
+func (fs *FS) EnableSpecialFiles() {
+	fs.specialFiles = true
+}
+
+// specialFileName returns the cleaned-up name of `filename`, if it
+// might be a special file of this FS.
+func (fs *FS) specialFileName(filename string) (name string, ok bool) {
+	if !fs.specialFiles || fs.subdir != "" {
+		return "", false
+	}
+	return path.Clean(strings.TrimPrefix(filename, "/")), true
+}
+
+// lookupSpecialFile returns the generator of the special file named
+// by `filename`, if there is one.
+func (fs *FS) lookupSpecialFile(filename string) (
+	contents specialFileContents, name string, ok bool) {
+	name, ok = fs.specialFileName(filename)
+	if !ok {
+		return nil, "", false
+	}
+	contents, ok = tlfSpecialFiles[name]
+	return contents, name, ok
+}
+
+func (fs *FS) readSpecialFile(
+	contents specialFileContents, name string) (*specialFileInfo, []byte,
+	error) {
+	data, t, err := contents(fs.ctx, fs.config, fs.root.GetFolderBranch())
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.IsZero() {
+		t = fs.config.Clock().Now()
+	}
+	return &specialFileInfo{
+		name:  name,
+		size:  int64(len(data)),
+		mode:  0444,
+		mtime: t,
+	}, data, nil
+}
+
+func (fs *FS) openSpecialFile(
+	contents specialFileContents, name string, flag int) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	_, data, err := fs.readSpecialFile(contents, name)
+	if err != nil {
+		return nil, err
+	}
+	return &specialFile{
+		name:   name,
+		Reader: bytes.NewReader(data),
+	}, nil
+}
+
+// specialFile is a read-only, in-memory snapshot of a special file's
+// contents, taken when it was opened.
+type specialFile struct {
+	name string
+	*bytes.Reader
+}
+
+var _ billy.File = (*specialFile)(nil)
+
+// Name implements the billy.File interface for specialFile.
+func (sf *specialFile) Name() string {
+	return sf.name
+}
+
+// Write implements the billy.File interface for specialFile.
+func (sf *specialFile) Write(_ []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Close implements the billy.File interface for specialFile.
+func (sf *specialFile) Close() error {
+	return nil
+}
+
+// Lock implements the billy.File interface for specialFile.
+func (sf *specialFile) Lock() error {
+	return errors.Errorf("%s can't be locked", sf.name)
+}
+
+// Unlock implements the billy.File interface for specialFile.
+func (sf *specialFile) Unlock() error {
+	return errors.Errorf("%s can't be locked", sf.name)
+}
+
+// Truncate implements the billy.File interface for specialFile.
+func (sf *specialFile) Truncate(_ int64) error {
+	return os.ErrPermission
+}
+
+// specialFileInfo implements the os.FileInfo interface for a special
+// file.
+type specialFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+var _ os.FileInfo = (*specialFileInfo)(nil)
+
+// Name implements the os.FileInfo interface for specialFileInfo.
+func (sfi *specialFileInfo) Name() string {
+	return sfi.name
+}
+
+// Size implements the os.FileInfo interface for specialFileInfo.
+func (sfi *specialFileInfo) Size() int64 {
+	return sfi.size
+}
+
+// Mode implements the os.FileInfo interface for specialFileInfo.
+func (sfi *specialFileInfo) Mode() os.FileMode {
+	return sfi.mode
+}
+
+// ModTime implements the os.FileInfo interface for specialFileInfo.
+func (sfi *specialFileInfo) ModTime() time.Time {
+	return sfi.mtime
+}
+
+// IsDir implements the os.FileInfo interface for specialFileInfo.
+func (sfi *specialFileInfo) IsDir() bool {
+	return false
+}
+
+// Sys implements the os.FileInfo interface for specialFileInfo.
+func (sfi *specialFileInfo) Sys() interface{} {
+	return nil
+}
@@ -4,6 +4,11 @@
 
 package libfuse
 
+import (
+	"bazil.org/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
 const (
 	// PublicName is the name of the parent of all public top-level folders.
 	PublicName = "public"
@@ -25,3 +30,27 @@ const (
 	// CtxIDKey is the type of the tag for unique operation IDs.
 	CtxIDKey CtxTagKey = iota
 )
+
+// setattrTimes returns the times that `req` sets, and the bits of
+// `req.Valid` that they account for.
+func setattrTimes(req *fuse.SetattrRequest) (
+	times libkbfs.EntryTimes, handled fuse.SetattrValid) {
+	valid := req.Valid
+	if valid.Mtime() {
+		times.Mtime = &req.Mtime
+		handled |= fuse.SetattrMtime | fuse.SetattrMtimeNow
+	}
+	if valid.Atime() {
+		times.Atime = &req.Atime
+		handled |= fuse.SetattrAtime | fuse.SetattrAtimeNow
+	}
+	if valid.Crtime() {
+		times.Btime = &req.Crtime
+		handled |= fuse.SetattrCrtime
+	}
+	if valid.Chgtime() {
+		times.Ctime = &req.Chgtime
+		handled |= fuse.SetattrChgtime
+	}
+	return times, handled
+}
@@ -368,6 +368,8 @@ func (f *Folder) fillAttrWithUIDAndWritePerm(
 	a.Blocks = getNumBlocksFromSize(ei.Size)
 	a.Mtime = time.Unix(0, ei.Mtime)
 	a.Ctime = time.Unix(0, ei.Ctime)
+	a.Atime = ei.AccessTime()
+	a.Crtime = ei.BirthTime()
 
 	a.Uid = uint32(os.Getuid())
 
@@ -832,18 +834,14 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 		valid &^= fuse.SetattrMode
 	}
 
-	if valid.Mtime() {
-		err := d.folder.fs.config.KBFSOps().SetMtime(
-			ctx, d.node, &req.Mtime)
+	if times, handled := setattrTimes(req); handled != 0 {
+		err := d.folder.fs.config.KBFSOps().SetTimes(ctx, d.node, times)
 		if err != nil {
 			return err
 		}
-		valid &^= fuse.SetattrMtime | fuse.SetattrMtimeNow
+		valid &^= handled
 	}
 
-	// KBFS has no concept of persistent atime; explicitly don't handle it
-	valid &^= fuse.SetattrAtime | fuse.SetattrAtimeNow
-
 	// things we don't need to explicitly handle
 	valid &^= fuse.SetattrLockOwner | fuse.SetattrHandle
 
@@ -48,6 +48,12 @@ func filterError(err error) error {
 		return errorWithErrno{err, syscall.EACCES}
 	case libkbfs.WriteAccessError:
 		return errorWithErrno{err, syscall.EACCES}
+	case libkbfs.WriteRejectedError:
+		return errorWithErrno{err, syscall.EPERM}
+	case libkbfs.ContentPolicyError:
+		return errorWithErrno{err, syscall.EPERM}
+	case libkbfs.ContentPolicyAdminError:
+		return errorWithErrno{err, syscall.EACCES}
 	case libkbfs.WriteUnsupportedError:
 		return errorWithErrno{err, syscall.ENOENT}
 	case libkbfs.WriteToReadonlyNodeError:
@@ -7,7 +7,10 @@ package libfuse
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -278,13 +281,12 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 		valid &^= fuse.SetattrMode
 	}
 
-	if valid.Mtime() {
-		err := f.folder.fs.config.KBFSOps().SetMtime(
-			ctx, f.node, &req.Mtime)
+	if times, handled := setattrTimes(req); handled != 0 {
+		err := f.folder.fs.config.KBFSOps().SetTimes(ctx, f.node, times)
 		if err != nil {
 			return err
 		}
-		valid &^= fuse.SetattrMtime | fuse.SetattrMtimeNow
+		valid &^= handled
 	}
 
 	if valid.Uid() || valid.Gid() {
@@ -298,9 +300,6 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 		valid &^= fuse.SetattrUid | fuse.SetattrGid
 	}
 
-	// KBFS has no concept of persistent atime; explicitly don't handle it
-	valid &^= fuse.SetattrAtime | fuse.SetattrAtimeNow
-
 	// things we don't need to explicitly handle
 	valid &^= fuse.SetattrLockOwner | fuse.SetattrHandle
 
@@ -323,3 +322,65 @@ func (f *File) Forget() {
 	f.eiCache.destroy()
 	f.folder.forgetNode(f.node)
 }
+
+// writeTagXattrPrefix prefixes the names of the extended attributes
+// that show the tags a libkbfs.WriteInterceptor has set on a file.
+const writeTagXattrPrefix = "user.kbfs."
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	if !strings.HasPrefix(req.Name, writeTagXattrPrefix) {
+		return fuse.ErrNoXattr
+	}
+	ctx = f.folder.fs.config.MaybeStartTrace(
+		ctx, "File.Getxattr", f.node.GetBasename())
+	defer func() { f.folder.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { err = f.folder.processError(ctx, libkbfs.ReadMode, err) }()
+
+	nmd, err := f.folder.fs.config.KBFSOps().GetNodeMetadata(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	value, ok := nmd.WriteTags[strings.TrimPrefix(req.Name, writeTagXattrPrefix)]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	if req.Size != 0 && int(req.Size) < len(value) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = []byte(value)
+	return nil
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	ctx = f.folder.fs.config.MaybeStartTrace(
+		ctx, "File.Listxattr", f.node.GetBasename())
+	defer func() { f.folder.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { err = f.folder.processError(ctx, libkbfs.ReadMode, err) }()
+
+	nmd, err := f.folder.fs.config.KBFSOps().GetNodeMetadata(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(nmd.WriteTags))
+	for tag := range nmd.WriteTags {
+		names = append(names, writeTagXattrPrefix+tag)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	if req.Size != 0 && int(req.Size) < len(resp.Xattr) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
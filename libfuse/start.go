@@ -121,6 +121,13 @@ func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
 	}
 	defer libkbfs.Shutdown()
 
+	// Let debug logging be toggled without restarting.
+	signalCtx, cancelSignal := context.WithCancel(ctx)
+	defer cancelSignal()
+	go libkbfs.HandleDebugLoggingSignal(signalCtx, log)
+	// Try not to lose dirty data when the OS shuts us down.
+	go libkbfs.HandleTerminateSignal(signalCtx, config, log)
+
 	// Report "startup successful" to the supervisor (currently just systemd on
 	// Linux). This isn't necessary for correctness, but it allows commands
 	// like "systemctl start kbfs.service" to report startup errors to the
@@ -142,5 +149,6 @@ func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
 		}
 	}
 	mi.Wait()
+	libkbfs.FlushOnExit(ctx, config, log)
 	return nil
 }
@@ -19,6 +19,7 @@ import (
 type blockContainer struct {
 	block          Block
 	prefetchStatus PrefetchStatus
+	tlf            tlf.ID
 }
 
 type idCacheKey struct {
@@ -169,9 +170,12 @@ func (b *BlockCacheStandard) CheckForKnownPtr(tlf tlf.ID, block *FileBlock) (
 }
 
 // SetCleanBytesCapacity implements the BlockCache interface for
-// BlockCacheStandard.
+// BlockCacheStandard.  If the new capacity is smaller than the bytes
+// already cached, transient entries are evicted right away until the
+// cache fits.
 func (b *BlockCacheStandard) SetCleanBytesCapacity(capacity uint64) {
 	atomic.StoreUint64(&b.cleanBytesCapacity, capacity)
+	b.makeRoomForSize(0, TransientEntry)
 }
 
 // GetCleanBytesCapacity implements the BlockCache interface for
@@ -265,9 +269,11 @@ func (b *BlockCacheStandard) PutWithPrefetch(
 
 	switch lifetime {
 	case TransientEntry:
-		// If it's the right type of block, store the hash -> ID mapping.
+		// If it's the right type of block, store the hash -> ID
+		// mapping.  Inlined files have no block on the server that a
+		// duplicate could add a reference to.
 		if fBlock, isFileBlock := block.(*FileBlock); b.ids != nil &&
-			isFileBlock && !fBlock.IsInd {
+			isFileBlock && !fBlock.IsInd && ptr.DataVer != InlineDataVer {
 
 			key := idCacheKey{tlf, fBlock.GetHash()}
 			// zero out the refnonce, it doesn't matter
@@ -319,7 +325,8 @@ func (b *BlockCacheStandard) PutWithPrefetch(
 		if !transientCacheHasRoom {
 			return cachePutCacheFullError{ptr.ID}
 		}
-		b.cleanTransient.Add(ptr.ID, blockContainer{block, prefetchStatus})
+		b.cleanTransient.Add(
+			ptr.ID, blockContainer{block, prefetchStatus, tlf})
 	}
 
 	return nil
@@ -390,3 +397,27 @@ func (b *BlockCacheStandard) DeleteKnownPtr(tlf tlf.ID, block *FileBlock) error
 	b.ids.Remove(key)
 	return nil
 }
+
+// ClearTLF implements the BlockCache interface for BlockCacheStandard.
+func (b *BlockCacheStandard) ClearTLF(tlfID tlf.ID) {
+	if b.ids != nil {
+		for _, key := range b.ids.Keys() {
+			if idKey, ok := key.(idCacheKey); ok && idKey.tlf == tlfID {
+				b.ids.Remove(key)
+			}
+		}
+	}
+	if b.cleanTransient == nil {
+		return
+	}
+	for _, key := range b.cleanTransient.Keys() {
+		tmp, ok := b.cleanTransient.Peek(key)
+		if !ok {
+			continue
+		}
+		if bc, ok := tmp.(blockContainer); ok && bc.tlf == tlfID {
+			// The eviction callback subtracts the block's bytes.
+			b.cleanTransient.Remove(key)
+		}
+	}
+}
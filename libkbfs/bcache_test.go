@@ -248,6 +248,39 @@ func TestBlockCacheEvictOnBytes(t *testing.T) {
 	}
 }
 
+func TestBlockCacheShrinkCapacityEvicts(t *testing.T) {
+	ctx := context.Background()
+	config := blockCacheTestInit(t, 1000, 5)
+	defer config.Shutdown(ctx)
+
+	bcache := config.BlockCache()
+
+	tlf := tlf.FakeID(1, tlf.Private)
+	for i := byte(0); i < 5; i++ {
+		block := &FileBlock{
+			Contents: make([]byte, 1),
+		}
+		id := kbfsblock.FakeID(i)
+		ptr := BlockPointer{ID: id}
+
+		err := bcache.Put(ptr, tlf, block, TransientEntry)
+		require.NoError(t, err)
+	}
+
+	// Shrinking the capacity evicts the oldest blocks right away.
+	bcache.SetCleanBytesCapacity(2)
+	for i := byte(0); i < 3; i++ {
+		id := kbfsblock.FakeID(i)
+		testExpectedMissing(t, id, bcache)
+	}
+
+	for i := byte(3); i < 5; i++ {
+		id := kbfsblock.FakeID(i)
+		_, err := bcache.Get(BlockPointer{ID: id})
+		require.NoError(t, err)
+	}
+}
+
 func TestBlockCacheEvictIncludesPermanentSize(t *testing.T) {
 	ctx := context.Background()
 	// Make a cache that can only handle 5 bytes
@@ -378,3 +411,33 @@ func TestBlockCacheDoublePut(t *testing.T) {
 	testBcachePutWithBlock(t, id2, cache, TransientEntry, block)
 	require.Equal(t, bytes, cache.cleanTotalBytes)
 }
+
+func TestBlockCacheClearTLF(t *testing.T) {
+	ctx := context.Background()
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(ctx, t, config)
+	bcache := config.BlockCache()
+
+	tlf1 := tlf.FakeID(1, tlf.Private)
+	tlf2 := tlf.FakeID(2, tlf.Private)
+	block1 := NewFileBlock().(*FileBlock)
+	block1.Contents = []byte{1, 2, 3, 4}
+	ptr1 := BlockPointer{ID: kbfsblock.FakeID(1)}
+	err := bcache.Put(ptr1, tlf1, block1, TransientEntry)
+	require.NoError(t, err)
+	block2 := NewFileBlock().(*FileBlock)
+	block2.Contents = []byte{5, 6, 7, 8}
+	ptr2 := BlockPointer{ID: kbfsblock.FakeID(2)}
+	err = bcache.Put(ptr2, tlf2, block2, TransientEntry)
+	require.NoError(t, err)
+
+	bcache.ClearTLF(tlf1)
+	testExpectedMissing(t, ptr1.ID, bcache)
+	checkedPtr, err := bcache.CheckForKnownPtr(tlf1, block1)
+	require.NoError(t, err)
+	require.False(t, checkedPtr.IsInitialized())
+
+	block, err := bcache.Get(ptr2)
+	require.NoError(t, err)
+	require.Equal(t, block2, block)
+}
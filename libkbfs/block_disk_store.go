@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/ioutil"
@@ -58,6 +59,10 @@ import (
 //           something more generic if we ever upgrade the journal
 //           version.
 //
+// A block whose data has been moved to a cold store (see
+// BlockServerDisk.EnableColdTier) has no data file, and is marked
+// as cold in its info.
+//
 // Future versions of the disk store might add more files to this
 // directory; if any code is written to move blocks around, it should
 // be careful to preserve any unknown files in a block directory.
@@ -72,6 +77,10 @@ import (
 type blockDiskStore struct {
 	codec kbfscodec.Codec
 	dir   string
+	// crypter encrypts the info and key server half files; it may
+	// be nil.  The data files are left alone, since block data is
+	// already encrypted.
+	crypter *localStorageCrypter
 }
 
 // filesPerBlockMax is an upper bound for the number of files
@@ -82,10 +91,12 @@ const filesPerBlockMax = 7
 
 // makeBlockDiskStore returns a new blockDiskStore for the given
 // directory.
-func makeBlockDiskStore(codec kbfscodec.Codec, dir string) *blockDiskStore {
+func makeBlockDiskStore(codec kbfscodec.Codec, dir string,
+	crypter *localStorageCrypter) *blockDiskStore {
 	return &blockDiskStore{
-		codec: codec,
-		dir:   dir,
+		codec:   codec,
+		dir:     dir,
+		crypter: crypter,
 	}
 }
 
@@ -140,6 +151,10 @@ func (s *blockDiskStore) makeDir(id kbfsblock.ID) error {
 type blockJournalInfo struct {
 	Refs    blockRefMap
 	Flushed bool `codec:"f,omitempty"`
+	// Cold is set when the data has been moved to a cold store, and
+	// ColdSize is then its size.
+	Cold     bool  `codec:"c,omitempty"`
+	ColdSize int64 `codec:"cs,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -149,7 +164,7 @@ type blockJournalInfo struct {
 // getRefInfo returns the references for the given ID.
 func (s *blockDiskStore) getInfo(id kbfsblock.ID) (blockJournalInfo, error) {
 	var info blockJournalInfo
-	err := kbfscodec.DeserializeFromFile(s.codec, s.infoPath(id), &info)
+	err := s.crypter.deserializeFromFile(s.codec, s.infoPath(id), &info)
 	if !ioutil.IsNotExist(err) && err != nil {
 		return blockJournalInfo{}, err
 	}
@@ -163,7 +178,7 @@ func (s *blockDiskStore) getInfo(id kbfsblock.ID) (blockJournalInfo, error) {
 
 // putRefInfo stores the given references for the given ID.
 func (s *blockDiskStore) putInfo(id kbfsblock.ID, info blockJournalInfo) error {
-	return kbfscodec.SerializeToFile(s.codec, info, s.infoPath(id))
+	return s.crypter.serializeToFile(s.codec, info, s.infoPath(id))
 }
 
 // addRefs adds references for the given contexts to the given ID, all
@@ -195,36 +210,55 @@ func (s *blockDiskStore) addRefs(id kbfsblock.ID, contexts []kbfsblock.Context,
 	return s.putInfo(id, info)
 }
 
-// getData returns the data and server half for the given ID, if
+// getKeyServerHalf returns the server half for the given ID, if
 // present.
-func (s *blockDiskStore) getData(id kbfsblock.ID) (
-	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
-	data, err := ioutil.ReadFile(s.dataPath(id))
+func (s *blockDiskStore) getKeyServerHalf(id kbfsblock.ID) (
+	kbfscrypto.BlockCryptKeyServerHalf, error) {
+	buf, err := s.crypter.readFile(s.keyServerHalfPath(id))
 	if ioutil.IsNotExist(err) {
-		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+		return kbfscrypto.BlockCryptKeyServerHalf{},
 			blockNonExistentError{id}
 	} else if err != nil {
-		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+		return kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
 
-	keyServerHalfPath := s.keyServerHalfPath(id)
-	buf, err := ioutil.ReadFile(keyServerHalfPath)
+	var serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	err = serverHalf.UnmarshalBinary(buf)
+	if err != nil {
+		return kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return serverHalf, nil
+}
+
+// getData returns the data and server half for the given ID, if
+// present.  It returns blockColdError if the data has been moved to
+// a cold store.
+func (s *blockDiskStore) getData(id kbfsblock.ID) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	data, err := ioutil.ReadFile(s.dataPath(id))
 	if ioutil.IsNotExist(err) {
+		info, infoErr := s.getInfo(id)
+		if infoErr != nil {
+			return nil, kbfscrypto.BlockCryptKeyServerHalf{}, infoErr
+		}
+		if info.Cold {
+			return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+				blockColdError{id}
+		}
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
 			blockNonExistentError{id}
 	} else if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
 
-	// Check integrity.
-
-	err = kbfsblock.VerifyID(data, id)
+	serverHalf, err := s.getKeyServerHalf(id)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
 
-	var serverHalf kbfscrypto.BlockCryptKeyServerHalf
-	err = serverHalf.UnmarshalBinary(buf)
+	// Check integrity.
+
+	err = kbfsblock.VerifyID(data, id)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
@@ -325,31 +359,31 @@ func (s *blockDiskStore) getDataWithContext(id kbfsblock.ID, context kbfsblock.C
 	return s.getData(id)
 }
 
-func (s *blockDiskStore) getAllRefsForTest() (map[kbfsblock.ID]blockRefMap, error) {
-	res := make(map[kbfsblock.ID]blockRefMap)
-
+// forEachBlock calls `f` with the ID of each block in the store, in
+// no particular order, stopping at the first error.
+func (s *blockDiskStore) forEachBlock(f func(id kbfsblock.ID) error) error {
 	fileInfos, err := ioutil.ReadDir(s.dir)
 	if ioutil.IsNotExist(err) {
-		return res, nil
+		return nil
 	} else if err != nil {
-		return nil, err
+		return err
 	}
 
 	for _, fi := range fileInfos {
 		name := fi.Name()
 		if !fi.IsDir() {
-			return nil, errors.Errorf("Unexpected non-dir %q", name)
+			return errors.Errorf("Unexpected non-dir %q", name)
 		}
 
 		subFileInfos, err := ioutil.ReadDir(filepath.Join(s.dir, name))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for _, sfi := range subFileInfos {
 			subName := sfi.Name()
 			if !sfi.IsDir() {
-				return nil, errors.Errorf("Unexpected non-dir %q",
+				return errors.Errorf("Unexpected non-dir %q",
 					subName)
 			}
 
@@ -357,31 +391,46 @@ func (s *blockDiskStore) getAllRefsForTest() (map[kbfsblock.ID]blockRefMap, erro
 				s.dir, name, subName, idFilename)
 			idBytes, err := ioutil.ReadFile(idPath)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			id, err := kbfsblock.IDFromString(string(idBytes))
 			if err != nil {
-				return nil, errors.WithStack(err)
+				return errors.WithStack(err)
 			}
 
 			if !strings.HasPrefix(id.String(), name+subName) {
-				return nil, errors.Errorf(
+				return errors.Errorf(
 					"%q unexpectedly not a prefix of %q",
 					name+subName, id.String())
 			}
 
-			info, err := s.getInfo(id)
+			err = f(id)
 			if err != nil {
-				return nil, err
-			}
-
-			if len(info.Refs) > 0 {
-				res[id] = info.Refs
+				return err
 			}
 		}
 	}
 
+	return nil
+}
+
+func (s *blockDiskStore) getAllRefsForTest() (map[kbfsblock.ID]blockRefMap, error) {
+	res := make(map[kbfsblock.ID]blockRefMap)
+	err := s.forEachBlock(func(id kbfsblock.ID) error {
+		info, err := s.getInfo(id)
+		if err != nil {
+			return err
+		}
+
+		if len(info.Refs) > 0 {
+			res[id] = info.Refs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return res, nil
 }
 
@@ -407,6 +456,14 @@ func (s *blockDiskStore) put(isRegularPut bool, id kbfsblock.ID, context kbfsblo
 		exists = false
 	case nil:
 		exists = true
+	case blockColdError:
+		// The data is in the cold store; leave it there, and just
+		// check the server half.
+		exists = true
+		existingServerHalf, err = s.getKeyServerHalf(id)
+		if err != nil {
+			return false, err
+		}
 	default:
 		return false, err
 	}
@@ -419,7 +476,7 @@ func (s *blockDiskStore) put(isRegularPut bool, id kbfsblock.ID, context kbfsblo
 		// We checked that both buf and the existing data hash
 		// to id, so no need to check that they're both equal.
 
-		if isRegularPut && existingServerHalf != serverHalf {
+		if isRegularPut && !existingServerHalf.Equal(serverHalf) {
 			return false, errors.Errorf(
 				"key server half mismatch: expected %s, got %s",
 				existingServerHalf, serverHalf)
@@ -441,7 +498,7 @@ func (s *blockDiskStore) put(isRegularPut bool, id kbfsblock.ID, context kbfsblo
 		if err != nil {
 			return false, err
 		}
-		err = ioutil.WriteFile(s.keyServerHalfPath(id), data, 0600)
+		err = s.crypter.writeFile(s.keyServerHalfPath(id), data)
 		if err != nil {
 			return false, err
 		}
@@ -515,6 +572,45 @@ func (s *blockDiskStore) removeReferences(
 	return len(info.Refs), nil
 }
 
+// getDataModTime returns when the data for the given ID was put, or
+// the zero time if the data isn't present.
+func (s *blockDiskStore) getDataModTime(id kbfsblock.ID) (time.Time, error) {
+	fi, err := ioutil.Stat(s.dataPath(id))
+	if ioutil.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// moveToCold passes the data for the given ID to `put`, which should
+// store it somewhere else, and then marks the block as cold and
+// removes its data file.  It returns the size of the data.
+func (s *blockDiskStore) moveToCold(
+	id kbfsblock.ID, put func(data []byte) error) (int64, error) {
+	data, _, err := s.getData(id)
+	if err != nil {
+		return 0, err
+	}
+	err = put(data)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := s.getInfo(id)
+	if err != nil {
+		return 0, err
+	}
+	info.Cold = true
+	info.ColdSize = int64(len(data))
+	err = s.putInfo(id, info)
+	if err != nil {
+		return 0, err
+	}
+	return info.ColdSize, ioutil.Remove(s.dataPath(id))
+}
+
 // remove removes any existing data for the given ID, which must not
 // have any references left.
 func (s *blockDiskStore) remove(id kbfsblock.ID) error {
@@ -542,6 +638,118 @@ func (s *blockDiskStore) remove(id kbfsblock.ID) error {
 	return err
 }
 
+// blockDiskStoreCompactionStats describes what a compaction found.
+type blockDiskStoreCompactionStats struct {
+	// LiveBlocks is the number of blocks that still have
+	// references.
+	LiveBlocks int
+	// RemovedBlocks is the number of unreferenced or half-written
+	// block directories that were removed.
+	RemovedBlocks int
+	// RemovedDirs is the number of empty splay directories that
+	// were removed.
+	RemovedDirs int
+	// ReclaimedBytes is the total size of the files removed.
+	ReclaimedBytes int64
+}
+
+func dirSize(path string) (int64, error) {
+	fileInfos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, fi := range fileInfos {
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// compact removes everything from the store that no reference needs:
+// block directories with no references left, block directories whose
+// ID file was never written, and empty splay directories.  These are
+// left behind by operations that were interrupted partway through.
+// It must only be used on stores where a block with no references is
+// garbage, i.e. not on block journals, which record reference
+// removals separately.
+func (s *blockDiskStore) compact() (
+	stats blockDiskStoreCompactionStats, err error) {
+	fileInfos, err := ioutil.ReadDir(s.dir)
+	if ioutil.IsNotExist(err) {
+		return stats, nil
+	} else if err != nil {
+		return stats, err
+	}
+
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+		splayPath := filepath.Join(s.dir, fi.Name())
+		subFileInfos, err := ioutil.ReadDir(splayPath)
+		if err != nil {
+			return stats, err
+		}
+
+		removedAll := true
+		for _, sfi := range subFileInfos {
+			if !sfi.IsDir() {
+				removedAll = false
+				continue
+			}
+			blockPath := filepath.Join(splayPath, sfi.Name())
+			remove, err := func() (bool, error) {
+				idBytes, err := ioutil.ReadFile(
+					filepath.Join(blockPath, idFilename))
+				if ioutil.IsNotExist(err) {
+					// makeDir never finished.
+					return true, nil
+				} else if err != nil {
+					return false, err
+				}
+				id, err := kbfsblock.IDFromString(string(idBytes))
+				if err != nil {
+					return false, errors.WithStack(err)
+				}
+				hasAnyRef, err := s.hasAnyRef(id)
+				if err != nil {
+					return false, err
+				}
+				return !hasAnyRef, nil
+			}()
+			if err != nil {
+				return stats, err
+			}
+			if !remove {
+				stats.LiveBlocks++
+				removedAll = false
+				continue
+			}
+
+			size, err := dirSize(blockPath)
+			if err != nil {
+				return stats, err
+			}
+			err = ioutil.RemoveAll(blockPath)
+			if err != nil {
+				return stats, err
+			}
+			stats.RemovedBlocks++
+			stats.ReclaimedBytes += size
+		}
+
+		if removedAll {
+			err = ioutil.Remove(splayPath)
+			if err != nil {
+				return stats, err
+			}
+			stats.RemovedDirs++
+		}
+	}
+
+	return stats, nil
+}
+
 func (s blockDiskStore) clear() error {
 	return ioutil.RemoveAll(s.dir)
 }
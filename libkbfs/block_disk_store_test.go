@@ -24,7 +24,7 @@ func setupBlockDiskStoreTest(t *testing.T) (tempdir string, s *blockDiskStore) {
 	tempdir, err := ioutil.TempDir(os.TempDir(), "block_disk_store")
 	require.NoError(t, err)
 
-	s = makeBlockDiskStore(codec, tempdir)
+	s = makeBlockDiskStore(codec, tempdir, nil)
 	return tempdir, s
 }
 
@@ -94,7 +94,7 @@ func TestBlockDiskStoreBasic(t *testing.T) {
 	getAndCheckBlockDiskData(t, s, bID, bCtx2, data, serverHalf)
 
 	// Shutdown and restart.
-	s = makeBlockDiskStore(s.codec, tempdir)
+	s = makeBlockDiskStore(s.codec, tempdir, s.crypter)
 
 	// Make sure we get the same block for both refs.
 
@@ -218,3 +218,53 @@ func TestBlockDiskStoreRemove(t *testing.T) {
 		})
 	require.NoError(t, err)
 }
+
+func TestBlockDiskStoreCompact(t *testing.T) {
+	tempdir, s := setupBlockDiskStoreTest(t)
+	defer teardownBlockDiskStoreTest(t, tempdir)
+
+	// A live block.
+	liveData := []byte{1, 2, 3, 4}
+	liveID, liveCtx, liveServerHalf := putBlockDisk(t, s, liveData)
+
+	// A block whose last reference was removed, but whose data
+	// wasn't, as if a removal was interrupted.
+	deadID, deadCtx, _ := putBlockDisk(t, s, []byte{5, 6, 7, 8})
+	liveCount, err := s.removeReferences(
+		deadID, []kbfsblock.Context{deadCtx}, "")
+	require.NoError(t, err)
+	require.Equal(t, 0, liveCount)
+
+	// A block directory whose ID file was never written.
+	halfID, err := kbfsblock.MakePermanentID([]byte{9, 10})
+	require.NoError(t, err)
+	err = ioutil.MkdirAll(s.blockPath(halfID), 0700)
+	require.NoError(t, err)
+
+	stats, err := s.compact()
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.LiveBlocks)
+	require.Equal(t, 2, stats.RemovedBlocks)
+	require.True(t, stats.ReclaimedBytes > 0)
+
+	getAndCheckBlockDiskData(
+		t, s, liveID, liveCtx, liveData, liveServerHalf)
+	_, err = ioutil.Stat(s.blockPath(deadID))
+	require.True(t, ioutil.IsNotExist(err))
+	_, err = ioutil.Stat(s.blockPath(halfID))
+	require.True(t, ioutil.IsNotExist(err))
+
+	// Splay directories that ended up empty are gone too.
+	fileInfos, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	for _, fi := range fileInfos {
+		subFileInfos, err := ioutil.ReadDir(filepath.Join(tempdir, fi.Name()))
+		require.NoError(t, err)
+		require.NotEmpty(t, subFileInfos)
+	}
+
+	// Compacting again finds nothing to do.
+	stats, err = s.compact()
+	require.NoError(t, err)
+	require.Equal(t, blockDiskStoreCompactionStats{LiveBlocks: 1}, stats)
+}
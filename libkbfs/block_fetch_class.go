@@ -0,0 +1,117 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// BlockFetchClass is the priority class of a block fetch.  Block
+// retrievals are serviced in class order, so a background fetch never
+// delays an interactive one for long.
+type BlockFetchClass int
+
+const (
+	// BlockFetchForeground is for fetches a user is waiting on, like
+	// those for a Read.  It's the default for any fetch whose context
+	// doesn't specify a class.
+	BlockFetchForeground BlockFetchClass = iota
+	// BlockFetchBackground is for fetches made on behalf of
+	// background work, like conflict resolution, quota reclamation
+	// and background syncs.
+	BlockFetchBackground
+	// BlockFetchPrefetch is for speculative fetches, like those made
+	// by the prefetcher.  They have no starvation protection, and can
+	// wait indefinitely behind other fetches.
+	BlockFetchPrefetch
+)
+
+const (
+	// foregroundRequestPriority is the retrieval priority of
+	// foreground fetches.  Background fetches use
+	// defaultOnDemandRequestPriority, and prefetches use lower
+	// priorities still.
+	foregroundRequestPriority = defaultOnDemandRequestPriority + 1<<20
+	// backgroundFetchMaxWait is how long a queued background fetch
+	// can be passed over in favor of foreground fetches, before it's
+	// serviced first anyway.
+	backgroundFetchMaxWait = 2 * time.Second
+)
+
+func (c BlockFetchClass) String() string {
+	switch c {
+	case BlockFetchForeground:
+		return "Foreground"
+	case BlockFetchBackground:
+		return "Background"
+	case BlockFetchPrefetch:
+		return "Prefetch"
+	default:
+		return "Unknown"
+	}
+}
+
+// requestPriority returns the block retrieval priority for fetches
+// of class `c` made through BlockOps.
+func (c BlockFetchClass) requestPriority() int {
+	switch c {
+	case BlockFetchBackground:
+		return defaultOnDemandRequestPriority
+	case BlockFetchPrefetch:
+		return defaultPrefetchPriority
+	default:
+		return foregroundRequestPriority
+	}
+}
+
+// blockFetchClassForPriority returns the class of a block retrieval
+// with the given priority.
+func blockFetchClassForPriority(priority int) BlockFetchClass {
+	switch {
+	case priority >= foregroundRequestPriority:
+		return BlockFetchForeground
+	case priority >= defaultOnDemandRequestPriority:
+		return BlockFetchBackground
+	default:
+		return BlockFetchPrefetch
+	}
+}
+
+// blockFetchTimerName returns the name of the metrics timer that
+// tracks the latency of block retrievals of class `c`.
+func blockFetchTimerName(c BlockFetchClass) string {
+	return "BlockRetrieval." + c.String()
+}
+
+// CtxBlockFetchClassKeyType is the type for the context key holding
+// a BlockFetchClass.
+type CtxBlockFetchClassKeyType int
+
+const (
+	// CtxBlockFetchClassKey is set in the context of operations
+	// whose block fetches should use a class other than
+	// BlockFetchForeground.
+	CtxBlockFetchClassKey CtxBlockFetchClassKeyType = iota
+)
+
+// NewContextWithBlockFetchClass returns a replayable context derived
+// from ctx, whose block fetches are made with class `class`.
+func NewContextWithBlockFetchClass(
+	ctx context.Context, class BlockFetchClass) context.Context {
+	return NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, CtxBlockFetchClassKey, class)
+	})
+}
+
+// blockFetchClassFromContext returns the class for block fetches made
+// with ctx.
+func blockFetchClassFromContext(ctx context.Context) BlockFetchClass {
+	if class, ok := ctx.Value(CtxBlockFetchClassKey).(BlockFetchClass); ok {
+		return class
+	}
+	return BlockFetchForeground
+}
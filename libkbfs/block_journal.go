@@ -173,27 +173,31 @@ func deferredGCBlockJournalDir(dir string) string {
 }
 
 // makeBlockJournal returns a new blockJournal for the given
-// directory. Any existing journal entries are read.
+// directory. Any existing journal entries are read. The journal
+// entries and block metadata are encrypted with `crypter`, if it's
+// non-nil.
 func makeBlockJournal(
 	ctx context.Context, codec kbfscodec.Codec, dir string,
-	log logger.Logger) (*blockJournal, error) {
+	log logger.Logger, crypter *localStorageCrypter) (*blockJournal, error) {
 	journalPath := blockJournalDir(dir)
 	deferLog := log.CloneWithAddedDepth(1)
 	j, err := makeDiskJournal(
-		codec, journalPath, reflect.TypeOf(blockJournalEntry{}))
+		codec, journalPath, reflect.TypeOf(blockJournalEntry{}),
+		crypter)
 	if err != nil {
 		return nil, err
 	}
 
 	gcJournalPath := deferredGCBlockJournalDir(dir)
 	gcj, err := makeDiskJournal(
-		codec, gcJournalPath, reflect.TypeOf(blockJournalEntry{}))
+		codec, gcJournalPath, reflect.TypeOf(blockJournalEntry{}),
+		crypter)
 	if err != nil {
 		return nil, err
 	}
 
 	storeDir := blockJournalStoreDir(dir)
-	s := makeBlockDiskStore(codec, storeDir)
+	s := makeBlockDiskStore(codec, storeDir, crypter)
 	journal := &blockJournal{
 		codec:      codec,
 		dir:        dir,
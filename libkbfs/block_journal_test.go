@@ -118,7 +118,9 @@ func setupBlockJournalTest(t *testing.T) (
 		}
 	}()
 
-	j, err = makeBlockJournal(ctx, codec, tempdir, log)
+	j, err = makeBlockJournal(ctx, codec, tempdir, log,
+		makeLocalStorageCrypter(kbfscrypto.MakeLocalStorageKey(
+			[32]byte{0x1})))
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), j.length())
 
@@ -208,7 +210,7 @@ func TestBlockJournalBasic(t *testing.T) {
 	// Shutdown and restart.
 	err := j.checkInSyncForTest()
 	require.NoError(t, err)
-	j, err = makeBlockJournal(ctx, j.codec, tempdir, j.log)
+	j, err = makeBlockJournal(ctx, j.codec, tempdir, j.log, j.s.crypter)
 	require.NoError(t, err)
 
 	require.Equal(t, uint64(2), j.length())
@@ -22,6 +22,8 @@ type blockOpsConfig interface {
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	tuningProfileGetter
+	metricsRegistryGetter
 }
 
 // BlockOpsStandard implements the BlockOps interface by relaying
@@ -71,8 +73,8 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 
 	b.log.LazyTrace(ctx, "BOps: Requesting %s", blockPtr.ID)
 
-	errCh := b.queue.Request(ctx, defaultOnDemandRequestPriority, kmd,
-		blockPtr, block, lifetime)
+	priority := blockFetchClassFromContext(ctx).requestPriority()
+	errCh := b.queue.Request(ctx, priority, kmd, blockPtr, block, lifetime)
 	err := <-errCh
 
 	b.log.LazyTrace(ctx, "BOps: Request fulfilled for %s (err=%v)", blockPtr.ID, err)
@@ -101,8 +103,8 @@ func (b *BlockOpsStandard) GetEncodedSize(ctx context.Context, kmd KeyMetadata,
 	// can't trust the server to report the size without being able
 	// to verify the BlockID.
 	block := NewCommonBlock()
-	errCh := b.queue.Request(ctx, defaultOnDemandRequestPriority, kmd,
-		blockPtr, block, NoCacheEntry)
+	priority := blockFetchClassFromContext(ctx).requestPriority()
+	errCh := b.queue.Request(ctx, priority, kmd, blockPtr, block, NoCacheEntry)
 	err := <-errCh
 	if err != nil {
 		return 0, err
@@ -129,6 +131,10 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	if err != nil {
 		return
 	}
+	encVer, err := kmd.GetLatestDataEncryptionVer()
+	if err != nil {
+		return
+	}
 
 	// New server key half for the block.
 	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
@@ -137,7 +143,8 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	blockKey := kbfscrypto.UnmaskBlockCryptKey(serverHalf, tlfCryptKey)
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	defer blockKey.Zero()
+	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey, encVer)
 	if err != nil {
 		return
 	}
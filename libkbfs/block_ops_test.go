@@ -18,6 +18,7 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
@@ -53,6 +54,15 @@ func (kmd fakeKeyMetadata) TlfID() tlf.ID {
 	return kmd.tlfID
 }
 
+func (kmd fakeKeyMetadata) LatestKeyGeneration() kbfsmd.KeyGen {
+	return kbfsmd.FirstValidKeyGen + kbfsmd.KeyGen(len(kmd.keys)) - 1
+}
+
+func (kmd fakeKeyMetadata) GetLatestDataEncryptionVer() (
+	kbfscrypto.EncryptionVer, error) {
+	return kbfscrypto.EncryptionSecretbox, nil
+}
+
 type fakeBlockKeyGetter struct{}
 
 func (kg fakeBlockKeyGetter) GetTLFCryptKeyForEncryption(
@@ -87,6 +97,7 @@ type testBlockOpsConfig struct {
 	diskBlockCacheGetter
 	*testSyncedTlfGetterSetter
 	initModeGetter
+	*testTuningProfileGetter
 }
 
 var _ blockOpsConfig = (*testBlockOpsConfig)(nil)
@@ -111,6 +122,10 @@ func (config testBlockOpsConfig) DataVersion() DataVer {
 	return ChildHolesDataVer
 }
 
+func (config testBlockOpsConfig) MetricsRegistry() metrics.Registry {
+	return nil
+}
+
 func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	lm := newTestLogMaker(t)
 	codecGetter := newTestCodecGetter()
@@ -120,7 +135,7 @@ func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	dbcg := newTestDiskBlockCacheGetter(t, nil)
 	stgs := newTestSyncedTlfGetterSetter()
 	return testBlockOpsConfig{codecGetter, lm, bserver, crypto, cache, dbcg,
-		stgs, testInitModeGetter{InitDefault}}
+		stgs, testInitModeGetter{InitDefault}, newTestTuningProfileGetter()}
 }
 
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Ready()
@@ -215,7 +230,8 @@ type badBlockEncryptor struct {
 }
 
 func (c badBlockEncryptor) EncryptBlock(
-	block Block, key kbfscrypto.BlockCryptKey) (
+	block Block, key kbfscrypto.BlockCryptKey,
+	encVer kbfscrypto.EncryptionVer) (
 	plainSize int, encryptedBlock kbfscrypto.EncryptedBlock, err error) {
 	return 0, kbfscrypto.EncryptedBlock{}, errors.New("could not encrypt block")
 }
@@ -242,9 +258,11 @@ type tooSmallBlockEncryptor struct {
 }
 
 func (c tooSmallBlockEncryptor) EncryptBlock(
-	block Block, key kbfscrypto.BlockCryptKey) (
+	block Block, key kbfscrypto.BlockCryptKey,
+	encVer kbfscrypto.EncryptionVer) (
 	plainSize int, encryptedBlock kbfscrypto.EncryptedBlock, err error) {
-	plainSize, encryptedBlock, err = c.CryptoCommon.EncryptBlock(block, key)
+	plainSize, encryptedBlock, err = c.CryptoCommon.EncryptBlock(
+		block, key, encVer)
 	if err != nil {
 		return 0, kbfscrypto.EncryptedBlock{}, err
 	}
@@ -303,6 +321,50 @@ func TestBlockOpsReadyTooSmallEncode(t *testing.T) {
 	require.IsType(t, TooLowByteCountError{}, err)
 }
 
+// TestReadyBlockDedupSameBlockType checks that ReadyBlock() only
+// reuses a known pointer to an identical file block if it has the
+// same block type, so that a data block is never charged as a
+// reference to an MD block, or vice versa.
+func TestReadyBlockDedupSameBlockType(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(0, tlf.Private)
+	kmd := makeFakeKeyMetadata(tlfID, kbfsmd.FirstValidKeyGen)
+	chargedTo := keybase1.MakeTestUID(1).AsUserOrTeam()
+
+	block := &FileBlock{
+		Contents: []byte{1, 2, 3, 4, 5},
+	}
+	knownPtr := BlockPointer{
+		ID:         kbfsblock.FakeID(1),
+		KeyGen:     kbfsmd.FirstValidKeyGen,
+		DataVer:    FirstValidDataVer,
+		DirectType: DirectBlock,
+		Context: kbfsblock.MakeFirstContext(
+			chargedTo, keybase1.BlockType_MD),
+	}
+	err := config.BlockCache().Put(knownPtr, tlfID, block, TransientEntry)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	crypto := config.cryptoPure()
+	info, _, _, err := ReadyBlock(ctx, config.BlockCache(), bops, crypto,
+		kmd, block, chargedTo, keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	require.NotEqual(t, knownPtr.ID, info.ID)
+	require.Equal(t, kbfsblock.ZeroRefNonce, info.RefNonce)
+	require.Equal(t, keybase1.BlockType_DATA, info.GetBlockType())
+
+	info, _, _, err = ReadyBlock(ctx, config.BlockCache(), bops, crypto,
+		kmd, block, chargedTo, keybase1.BlockType_MD)
+	require.NoError(t, err)
+	require.Equal(t, knownPtr.ID, info.ID)
+	require.NotEqual(t, kbfsblock.ZeroRefNonce, info.RefNonce)
+}
+
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Get()
 // retrieves a block properly, even if that block was encoded for a
 // previous key generation.
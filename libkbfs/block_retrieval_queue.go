@@ -9,10 +9,12 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -36,6 +38,8 @@ type blockRetrievalPartialConfig interface {
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	tuningProfileGetter
+	metricsRegistryGetter
 }
 
 type blockRetrievalConfig interface {
@@ -87,6 +91,8 @@ type blockRetrieval struct {
 	// state of global request counter when this retrieval was created;
 	// maintains FIFO
 	insertionOrder uint64
+	// when this retrieval was created
+	created time.Time
 }
 
 // blockPtrLookup is used to uniquely identify block retrieval requests. The
@@ -113,6 +119,10 @@ type blockRetrievalQueue struct {
 	// capacity: ~584 years at 1 billion requests/sec
 	insertionCount uint64
 	heap           *blockRetrievalHeap
+	// queued background retrievals, oldest first, for starvation
+	// protection.  Retrievals that have since left the heap or been
+	// elevated to the foreground are skipped lazily.
+	backgroundFIFO []*blockRetrieval
 
 	// These are notification channels to maximize the time that each request
 	// is in the heap, allowing preemption as long as possible. This way, a
@@ -162,13 +172,46 @@ func newBlockRetrievalQueue(numWorkers int, numPrefetchWorkers int,
 	return q
 }
 
+// oldestBackgroundLocked returns the oldest background retrieval still
+// waiting in the heap, or nil if there is none.
+func (brq *blockRetrievalQueue) oldestBackgroundLocked() *blockRetrieval {
+	for len(brq.backgroundFIFO) > 0 {
+		br := brq.backgroundFIFO[0]
+		if br.index != -1 &&
+			blockFetchClassForPriority(br.priority) == BlockFetchBackground {
+			return br
+		}
+		brq.backgroundFIFO[0] = nil
+		brq.backgroundFIFO = brq.backgroundFIFO[1:]
+	}
+	return nil
+}
+
 func (brq *blockRetrievalQueue) popIfNotEmpty() *blockRetrieval {
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
-	if brq.heap.Len() > 0 {
-		return heap.Pop(brq.heap).(*blockRetrieval)
+	if brq.heap.Len() == 0 {
+		return nil
+	}
+	// Foreground retrievals are serviced first, but a background
+	// retrieval that has waited too long jumps ahead of them, so a
+	// steady stream of foreground reads can't starve it.
+	if blockFetchClassForPriority((*brq.heap)[0].priority) ==
+		BlockFetchForeground {
+		br := brq.oldestBackgroundLocked()
+		if br != nil && time.Since(br.created) > backgroundFetchMaxWait {
+			return heap.Remove(brq.heap, br.index).(*blockRetrieval)
+		}
+	}
+	return heap.Pop(brq.heap).(*blockRetrieval)
+}
+
+// noteBackgroundLocked records `br` for starvation protection, if it's
+// a background retrieval.
+func (brq *blockRetrievalQueue) noteBackgroundLocked(br *blockRetrieval) {
+	if blockFetchClassForPriority(br.priority) == BlockFetchBackground {
+		brq.backgroundFIFO = append(brq.backgroundFIFO, br)
 	}
-	return nil
 }
 
 func (brq *blockRetrievalQueue) shutdownRetrieval() {
@@ -262,11 +305,21 @@ func (brq *blockRetrievalQueue) checkCaches(ctx context.Context,
 	if dbc == nil {
 		return NoPrefetch, NoSuchBlockError{ptr.ID}
 	}
-	blockBuf, serverHalf, prefetchStatus, err := dbc.Get(ctx, kmd.TlfID(),
-		ptr.ID)
+	region, serverHalf, prefetchStatus, err := getMappedFromDiskCache(
+		ctx, dbc, kmd.TlfID(), ptr.ID)
 	if err != nil {
 		return NoPrefetch, err
 	}
+	// Assembling the block decrypts it into a new buffer, so the
+	// region is no longer needed once that's done.
+	defer func() {
+		releaseErr := region.Release()
+		if releaseErr != nil {
+			brq.log.CWarningf(ctx, "Error releasing disk cache region "+
+				"for %s: %+v", ptr.ID, releaseErr)
+		}
+	}()
+	blockBuf := region.Bytes()
 	if len(blockBuf) == 0 {
 		return NoPrefetch, NoSuchBlockError{ptr.ID}
 	}
@@ -344,12 +397,14 @@ func (brq *blockRetrievalQueue) request(ctx context.Context,
 				index:          -1,
 				priority:       priority,
 				insertionOrder: brq.insertionCount,
+				created:        time.Now(),
 				cacheLifetime:  lifetime,
 			}
 			br.ctx, br.cancelFunc = NewCoalescingContext(ctx)
 			brq.insertionCount++
 			brq.ptrs[bpLookup] = br
 			heap.Push(brq.heap, br)
+			brq.noteBackgroundLocked(br)
 			brq.notifyWorker(priority)
 		} else {
 			err := br.ctx.AddContext(ctx)
@@ -379,6 +434,9 @@ func (brq *blockRetrievalQueue) request(ctx context.Context,
 		// means it's actively being processed).
 		if br.index != -1 {
 			heap.Fix(brq.heap, br.index)
+			if blockFetchClassForPriority(oldPriority) == BlockFetchPrefetch {
+				brq.noteBackgroundLocked(br)
+			}
 			if oldPriority < defaultOnDemandRequestPriority &&
 				priority >= defaultOnDemandRequestPriority {
 				// We've crossed the priority threshold for prefetch workers,
@@ -422,6 +480,12 @@ func (brq *blockRetrievalQueue) FinalizeRequest(
 	brq.mtx.Unlock()
 	defer retrieval.cancelFunc()
 
+	if r := brq.config.MetricsRegistry(); r != nil {
+		class := blockFetchClassForPriority(retrieval.priority)
+		metrics.GetOrRegisterTimer(blockFetchTimerName(class), r).
+			UpdateSince(retrieval.created)
+	}
+
 	// This is a lock that exists for the race detector, since there
 	// shouldn't be any other goroutines accessing the retrieval at this
 	// point. In `Request`, the requests slice can be modified while locked
@@ -6,11 +6,14 @@ package libkbfs
 
 import (
 	"io"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
@@ -23,6 +26,7 @@ type testBlockRetrievalConfig struct {
 	*testDiskBlockCacheGetter
 	*testSyncedTlfGetterSetter
 	initModeGetter
+	*testTuningProfileGetter
 }
 
 func newTestBlockRetrievalConfig(t *testing.T, bg blockGetter,
@@ -35,6 +39,7 @@ func newTestBlockRetrievalConfig(t *testing.T, bg blockGetter,
 		newTestDiskBlockCacheGetter(t, dbc),
 		newTestSyncedTlfGetterSetter(),
 		testInitModeGetter{InitDefault},
+		newTestTuningProfileGetter(),
 	}
 }
 
@@ -50,6 +55,10 @@ func (c testBlockRetrievalConfig) blockGetter() blockGetter {
 	return c.bg
 }
 
+func (c testBlockRetrievalConfig) MetricsRegistry() metrics.Registry {
+	return nil
+}
+
 func makeRandomBlockPointer(t *testing.T) BlockPointer {
 	id, err := kbfsblock.MakeTemporaryID()
 	require.NoError(t, err)
@@ -295,3 +304,67 @@ func TestBlockRetrievalQueueCurrentlyProcessingRequest(t *testing.T) {
 	require.Len(t, br.requests, 1)
 	require.Equal(t, block, br.requests[0].block)
 }
+
+type testMeasuredBlockRetrievalConfig struct {
+	*testBlockRetrievalConfig
+	registry metrics.Registry
+}
+
+func (c testMeasuredBlockRetrievalConfig) MetricsRegistry() metrics.Registry {
+	return c.registry
+}
+
+func TestBlockRetrievalQueueFetchClasses(t *testing.T) {
+	t.Log("Service foreground retrievals first, without starving " +
+		"background retrievals.")
+	registry := metrics.NewRegistry()
+	q := newBlockRetrievalQueue(0, 0, testMeasuredBlockRetrievalConfig{
+		newTestBlockRetrievalConfig(t, nil, nil), registry})
+	<-q.TogglePrefetcher(false, nil)
+	defer q.Shutdown()
+
+	ctx := context.Background()
+	require.Equal(t, BlockFetchForeground, blockFetchClassFromContext(ctx))
+	bgCtx := NewContextWithBlockFetchClass(ctx, BlockFetchBackground)
+	require.Equal(t, BlockFetchBackground, blockFetchClassFromContext(bgCtx))
+	replayedCtx, err := NewContextWithReplayFrom(bgCtx)
+	require.NoError(t, err)
+	require.Equal(t, BlockFetchBackground,
+		blockFetchClassFromContext(replayedCtx))
+
+	request := func(class BlockFetchClass) BlockPointer {
+		ptr := makeRandomBlockPointer(t)
+		_ = q.Request(ctx, class.requestPriority(), makeKMD(), ptr,
+			&FileBlock{}, NoCacheEntry)
+		return ptr
+	}
+	pop := func(expected BlockPointer) {
+		br := q.popIfNotEmpty()
+		require.Equal(t, expected, br.blockPtr)
+		q.FinalizeRequest(br, &FileBlock{}, io.EOF)
+	}
+
+	t.Log("A foreground retrieval jumps ahead of a queued background one.")
+	ptr1 := request(BlockFetchBackground)
+	ptr2 := request(BlockFetchForeground)
+	pop(ptr2)
+	pop(ptr1)
+
+	t.Log("A background retrieval that has waited too long goes first.")
+	ptr3 := request(BlockFetchBackground)
+	ptr4 := request(BlockFetchForeground)
+	q.mtx.Lock()
+	q.ptrs[blockPtrLookup{ptr3, reflect.TypeOf(&FileBlock{})}].created =
+		time.Now().Add(-2 * backgroundFetchMaxWait)
+	q.mtx.Unlock()
+	pop(ptr3)
+	pop(ptr4)
+
+	t.Log("Retrieval latencies are recorded per class.")
+	fgTimer := metrics.GetOrRegisterTimer(
+		blockFetchTimerName(BlockFetchForeground), registry)
+	require.Equal(t, int64(2), fgTimer.Count())
+	bgTimer := metrics.GetOrRegisterTimer(
+		blockFetchTimerName(BlockFetchBackground), registry)
+	require.Equal(t, int64(2), bgTimer.Count())
+}
@@ -115,6 +115,12 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+
+	// childrenShared is true if Children may be shared with a
+	// copy-on-write copy of this block (or with the block this one
+	// was copied from), and so must be copied before it's modified.
+	// Guarded by cacheMtx.
+	childrenShared bool
 }
 
 // NewDirBlock creates a new, empty DirBlock.
@@ -141,6 +147,9 @@ func (db *DirBlock) Set(other Block) {
 	db.Children = dbCopy.Children
 	db.IPtrs = dbCopy.IPtrs
 	db.ToCommonBlock().Set(dbCopy.ToCommonBlock())
+	db.cacheMtx.Lock()
+	defer db.cacheMtx.Unlock()
+	db.childrenShared = false
 }
 
 // DeepCopy makes a complete copy of a DirBlock
@@ -158,6 +167,59 @@ func (db *DirBlock) DeepCopy() *DirBlock {
 	}
 }
 
+// copyOnWrite returns a copy of a DirBlock that shares its children
+// with `db` until one of them modifies them, which must be done via
+// setChild or removeChild.  This saves copying every entry of a big
+// directory for a write that might only touch one of them, or none.
+func (db *DirBlock) copyOnWrite() *DirBlock {
+	db.cacheMtx.Lock()
+	defer db.cacheMtx.Unlock()
+	db.childrenShared = true
+	return &DirBlock{
+		CommonBlock: CommonBlock{
+			IsInd:                  db.IsInd,
+			UnknownFieldSetHandler: db.UnknownFieldSetHandler,
+			cachedEncodedSize:      db.cachedEncodedSize,
+		},
+		Children:       db.Children,
+		IPtrs:          db.IPtrs,
+		childrenShared: true,
+	}
+}
+
+// unshareChildren makes sure that `db` has its own copy of Children,
+// which it can safely modify.
+func (db *DirBlock) unshareChildren() {
+	db.cacheMtx.Lock()
+	defer db.cacheMtx.Unlock()
+	if !db.childrenShared {
+		return
+	}
+	childrenCopy := make(map[string]DirEntry, len(db.Children))
+	for k, v := range db.Children {
+		childrenCopy[k] = v
+	}
+	db.Children = childrenCopy
+	db.childrenShared = false
+}
+
+// setChild sets the entry for `name`, copying the children first if
+// they're shared with another block.
+func (db *DirBlock) setChild(name string, de DirEntry) {
+	db.unshareChildren()
+	db.Children[name] = de
+}
+
+// removeChild removes the entry for `name`, copying the children
+// first if they're shared with another block.
+func (db *DirBlock) removeChild(name string) {
+	if _, ok := db.Children[name]; !ok {
+		return
+	}
+	db.unshareChildren()
+	delete(db.Children, name)
+}
+
 // FileBlock is the contents of a file
 type FileBlock struct {
 	CommonBlock
@@ -169,6 +231,12 @@ type FileBlock struct {
 	// this is used for caching plaintext (block.Contents) hash. It is used by
 	// only direct blocks.
 	hash *kbfshash.RawDefaultHash
+
+	// contentsShared is true if Contents may be shared with a
+	// copy-on-write copy of this block (or with the block this one
+	// was copied from), and so must be copied before it's modified
+	// in place.  Guarded by cacheMtx.
+	contentsShared bool
 }
 
 // NewFileBlock creates a new, empty FileBlock.
@@ -250,6 +318,11 @@ func (fb *FileBlock) Set(other Block) {
 	fb.Contents = fbCopy.Contents
 	fb.IPtrs = fbCopy.IPtrs
 	fb.ToCommonBlock().Set(fbCopy.ToCommonBlock())
+	func() {
+		fb.cacheMtx.Lock()
+		defer fb.cacheMtx.Unlock()
+		fb.contentsShared = false
+	}()
 	// Ensure that the Set is complete from Go's perspective by calculating the
 	// hash on the new FileBlock if the old one has been set. This is mainly so
 	// tests can blindly compare that blocks are equivalent.
@@ -277,6 +350,48 @@ func (fb *FileBlock) DeepCopy() *FileBlock {
 	}
 }
 
+// copyOnWrite returns a copy of a FileBlock that shares its contents
+// with `fb` until one of them modifies them in place, which must be
+// preceded by a call to unshareContents.  The indirect pointers are
+// small, and modified in place all over, so they're copied right
+// away.
+func (fb *FileBlock) copyOnWrite() *FileBlock {
+	fb.cacheMtx.Lock()
+	defer fb.cacheMtx.Unlock()
+	fb.contentsShared = true
+	var iptrsCopy []IndirectFilePtr
+	if fb.IPtrs != nil {
+		iptrsCopy = make([]IndirectFilePtr, len(fb.IPtrs))
+		copy(iptrsCopy, fb.IPtrs)
+	}
+	return &FileBlock{
+		CommonBlock: CommonBlock{
+			IsInd:                  fb.IsInd,
+			UnknownFieldSetHandler: fb.UnknownFieldSetHandler,
+			cachedEncodedSize:      fb.cachedEncodedSize,
+		},
+		Contents:       fb.Contents,
+		IPtrs:          iptrsCopy,
+		contentsShared: true,
+	}
+}
+
+// unshareContents makes sure that `fb` has its own copy of Contents,
+// which it can safely modify in place or append to.
+func (fb *FileBlock) unshareContents() {
+	fb.cacheMtx.Lock()
+	defer fb.cacheMtx.Unlock()
+	if !fb.contentsShared {
+		return
+	}
+	if fb.Contents != nil {
+		contentsCopy := make([]byte, len(fb.Contents))
+		copy(contentsCopy, fb.Contents)
+		fb.Contents = contentsCopy
+	}
+	fb.contentsShared = false
+}
+
 // GetHash returns the hash of this FileBlock. If the hash is nil, it first
 // calculates it.
 func (fb *FileBlock) GetHash() kbfshash.RawDefaultHash {
@@ -12,6 +12,7 @@ import (
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/require"
 )
 
 func makeFakeBlockContext(t *testing.T) kbfsblock.Context {
@@ -161,6 +162,7 @@ func makeFakeDirBlockFuture(t *testing.T) *dirBlockFuture {
 			},
 			nil,
 			nil,
+			false,
 		},
 		map[string]dirEntryFuture{
 			"child1": makeFakeDirEntryFuture(t),
@@ -232,6 +234,7 @@ func makeFakeFileBlockFuture(t *testing.T) *fileBlockFuture {
 			[]byte{0xa, 0xb},
 			nil,
 			nil,
+			false,
 		},
 		[]indirectFilePtrFuture{
 			makeFakeIndirectFilePtrFuture(t),
@@ -243,3 +246,71 @@ func makeFakeFileBlockFuture(t *testing.T) *fileBlockFuture {
 func TestFileBlockUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeFileBlockFuture(t))
 }
+
+func TestBlockPointerSameBlock(t *testing.T) {
+	ptr := makeFakeBlockPointer(t)
+	require.True(t, ptr.SameBlock(ptr))
+
+	// Pointers that differ only in fields that don't identify the
+	// reference are the same block.
+	ptr2 := ptr
+	ptr2.DirectType = IndirectBlock
+	require.True(t, ptr.SameBlock(ptr2))
+
+	// A dedup'd reference to the same block ID isn't.
+	ptr3 := ptr
+	ptr3.RefNonce = kbfsblock.RefNonce{0xc}
+	require.False(t, ptr.SameBlock(ptr3))
+
+	ptr4 := ptr
+	ptr4.ID = kbfsblock.FakeID(2)
+	require.False(t, ptr.SameBlock(ptr4))
+}
+
+func TestDirBlockCopyOnWrite(t *testing.T) {
+	db := NewDirBlock().(*DirBlock)
+	db.Children["a"] = DirEntry{EntryInfo: EntryInfo{Type: File, Size: 1}}
+	db.Children["b"] = DirEntry{EntryInfo: EntryInfo{Type: Dir}}
+
+	dbCopy := db.copyOnWrite()
+	require.Equal(t, db.Children, dbCopy.Children)
+
+	// Modifying the copy leaves the original alone.
+	dbCopy.setChild("a", DirEntry{EntryInfo: EntryInfo{Type: File, Size: 2}})
+	dbCopy.removeChild("b")
+	dbCopy.setChild("c", DirEntry{EntryInfo: EntryInfo{Type: Sym}})
+	require.Len(t, db.Children, 2)
+	require.Equal(t, uint64(1), db.Children["a"].Size)
+	require.Contains(t, db.Children, "b")
+	require.NotContains(t, db.Children, "c")
+	require.Len(t, dbCopy.Children, 2)
+	require.Equal(t, uint64(2), dbCopy.Children["a"].Size)
+
+	// And the other way around.
+	dbCopy2 := db.copyOnWrite()
+	db.removeChild("a")
+	require.NotContains(t, db.Children, "a")
+	require.Contains(t, dbCopy2.Children, "a")
+}
+
+func TestFileBlockCopyOnWrite(t *testing.T) {
+	fb := NewFileBlock().(*FileBlock)
+	fb.Contents = []byte{1, 2, 3}
+
+	fbCopy := fb.copyOnWrite()
+	require.Equal(t, fb.Contents, fbCopy.Contents)
+
+	// Modifying the copy leaves the original alone.
+	fbCopy.unshareContents()
+	fbCopy.Contents[0] = 4
+	fbCopy.Contents = append(fbCopy.Contents, 5)
+	require.Equal(t, []byte{1, 2, 3}, fb.Contents)
+	require.Equal(t, []byte{4, 2, 3, 5}, fbCopy.Contents)
+
+	// And the other way around.
+	fbCopy2 := fb.copyOnWrite()
+	fb.unshareContents()
+	fb.Contents[1] = 6
+	require.Equal(t, []byte{1, 6, 3}, fb.Contents)
+	require.Equal(t, []byte{1, 2, 3}, fbCopy2.Contents)
+}
@@ -14,20 +14,16 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func isRecoverableBlockError(err error) bool {
-	_, isArchiveError := err.(kbfsblock.ServerErrorBlockArchived)
-	_, isDeleteError := err.(kbfsblock.ServerErrorBlockDeleted)
-	_, isRefError := err.(kbfsblock.ServerErrorBlockNonExistent)
-	_, isMaxExceededError := err.(kbfsblock.ServerErrorMaxRefExceeded)
-	return isArchiveError || isDeleteError || isRefError || isMaxExceededError
-}
-
 // putBlockToServer either puts the full block to the block server, or
-// just adds a reference, depending on the refnonce in blockPtr.
+// just adds a reference, depending on the refnonce in blockPtr.  The
+// contents of inlined files live in their directory entries, so
+// nothing is put for them.
 func putBlockToServer(ctx context.Context, bserv BlockServer, tlfID tlf.ID,
 	blockPtr BlockPointer, readyBlockData ReadyBlockData) error {
 	var err error
-	if blockPtr.RefNonce == kbfsblock.ZeroRefNonce {
+	if blockPtr.DataVer == InlineDataVer {
+		return nil
+	} else if blockPtr.RefNonce == kbfsblock.ZeroRefNonce {
 		err = bserv.Put(ctx, tlfID, blockPtr.ID, blockPtr.Context,
 			readyBlockData.buf, readyBlockData.serverHalf)
 	} else {
@@ -181,6 +177,7 @@ func assembleBlock(ctx context.Context, keyGetter blockKeyGetter,
 	// construct the block crypt key
 	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
 		blockServerHalf, tlfCryptKey)
+	defer blockCryptKey.Zero()
 
 	var encryptedBlock kbfscrypto.EncryptedBlock
 	err = codec.Decode(buf, &encryptedBlock)
@@ -0,0 +1,429 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// ColdBlockStore is a cheaper, slower place to keep the data of
+// blocks that are rarely read.  It only stores opaque (encrypted)
+// block data; references and key server halves stay in the hot
+// store.
+type ColdBlockStore interface {
+	// PutCold stores the data for the given block, replacing any
+	// data already stored for it.
+	PutCold(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
+		data []byte) error
+	// GetCold returns the data for the given block.
+	GetCold(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (
+		[]byte, error)
+	// DeleteCold deletes the data for the given block.  It's not an
+	// error if there isn't any.
+	DeleteCold(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) error
+}
+
+// ColdBlockStoreDir is a ColdBlockStore that keeps each block in a
+// file under a directory, which would usually be on a slower or
+// network-mounted disk.
+type ColdBlockStoreDir struct {
+	dir string
+}
+
+var _ ColdBlockStore = ColdBlockStoreDir{}
+
+// NewColdBlockStoreDir returns a new ColdBlockStoreDir that stores its
+// blocks under `dir`.
+func NewColdBlockStoreDir(dir string) ColdBlockStoreDir {
+	return ColdBlockStoreDir{dir: dir}
+}
+
+func (c ColdBlockStoreDir) path(tlfID tlf.ID, id kbfsblock.ID) string {
+	idStr := id.String()
+	return filepath.Join(c.dir, tlfID.String(), idStr[:4], idStr)
+}
+
+// PutCold implements the ColdBlockStore interface for
+// ColdBlockStoreDir.
+func (c ColdBlockStoreDir) PutCold(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID, data []byte) error {
+	p := c.path(tlfID, id)
+	err := ioutil.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash can't leave a
+	// truncated block behind.
+	tmp := p + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.Rename(tmp, p)
+}
+
+// GetCold implements the ColdBlockStore interface for
+// ColdBlockStoreDir.
+func (c ColdBlockStoreDir) GetCold(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) ([]byte, error) {
+	data, err := ioutil.ReadFile(c.path(tlfID, id))
+	if ioutil.IsNotExist(err) {
+		return nil, blockNonExistentError{id}
+	}
+	return data, err
+}
+
+// DeleteCold implements the ColdBlockStore interface for
+// ColdBlockStoreDir.
+func (c ColdBlockStoreDir) DeleteCold(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) error {
+	err := ioutil.Remove(c.path(tlfID, id))
+	if ioutil.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+const (
+	// defaultColdTierMinAge is the ColdTierPolicy.MinAge used if a
+	// policy doesn't set one.
+	defaultColdTierMinAge = 30 * 24 * time.Hour
+	// coldTierMigrationInterval is how often a block server set up
+	// by Init migrates blocks to its cold store.
+	coldTierMigrationInterval = 6 * time.Hour
+)
+
+// ColdTierPolicy says which blocks a BlockServerDisk moves to its cold
+// store, and when.
+type ColdTierPolicy struct {
+	// MinAge is how long ago a block must have been put before it
+	// can be moved.  Only blocks that aren't referenced by the
+	// current revision of their TLF (i.e., whose references have all
+	// been archived) are ever moved.
+	MinAge time.Duration
+	// Interval is how often all the TLFs are checked for blocks to
+	// move.  If zero, blocks are only moved by MigrateToCold.
+	Interval time.Duration
+}
+
+// BlockServerTierStats counts the blocks in each tier of a
+// BlockServerDisk.
+type BlockServerTierStats struct {
+	HotBlocks  int64
+	HotBytes   int64
+	ColdBlocks int64
+	ColdBytes  int64
+	// MovedBlocks and MovedBytes count the blocks moved to the cold
+	// store by the migration that produced these stats.
+	MovedBlocks int64
+	MovedBytes  int64
+}
+
+func (s *BlockServerTierStats) add(other BlockServerTierStats) {
+	s.HotBlocks += other.HotBlocks
+	s.HotBytes += other.HotBytes
+	s.ColdBlocks += other.ColdBlocks
+	s.ColdBytes += other.ColdBytes
+	s.MovedBlocks += other.MovedBlocks
+	s.MovedBytes += other.MovedBytes
+}
+
+// BlockServerTierStatus describes the tiers of a BlockServerDisk.
+// Reads of cold blocks go through to the cold store, so they're
+// expected to be slower; ColdReads and its latencies show how much
+// slower.
+type BlockServerTierStatus struct {
+	// Stats are as of the last full migration, which is when they're
+	// counted, and LastMigration is when that finished.
+	Stats         BlockServerTierStats
+	LastMigration time.Time `json:",omitempty"`
+
+	ColdReads      int64
+	ColdReadMeanMs float64
+	ColdReadMaxMs  float64
+}
+
+// blockServerDiskColdTier holds the cold tier state of a
+// BlockServerDisk.
+type blockServerDiskColdTier struct {
+	store     ColdBlockStore
+	policy    ColdTierPolicy
+	readTimer metrics.Timer
+	shutdown  chan struct{}
+}
+
+// EnableColdTier makes `b` move the data of rarely-read blocks to
+// `cold`, according to `policy`.  Reads of those blocks fetch their
+// data from `cold`.  It must be called before `b` is used.
+func (b *BlockServerDisk) EnableColdTier(
+	cold ColdBlockStore, policy ColdTierPolicy) {
+	if policy.MinAge <= 0 {
+		policy.MinAge = defaultColdTierMinAge
+	}
+	b.coldTier = &blockServerDiskColdTier{
+		store:     cold,
+		policy:    policy,
+		readTimer: metrics.NewTimer(),
+		shutdown:  make(chan struct{}),
+	}
+	if policy.Interval > 0 {
+		go b.migrateToColdLoop()
+	}
+}
+
+// getCold fetches the data for a block that has been moved to the
+// cold store.
+func (b *BlockServerDisk) getCold(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (
+	data []byte, err error) {
+	if b.coldTier == nil {
+		return nil, blockNonExistentError{id}
+	}
+	start := time.Now()
+	data, err = b.coldTier.store.GetCold(ctx, tlfID, id)
+	latency := time.Since(start)
+	b.coldTier.readTimer.Update(latency)
+	b.log.CDebugf(ctx, "Read cold block %s in %s (err=%v)",
+		id, latency, err)
+	if err != nil {
+		return nil, err
+	}
+	err = kbfsblock.VerifyID(data, id)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// isColdCandidate returns whether the given block should be moved to
+// the cold store.  The caller must hold the TLF storage lock.
+func (b *BlockServerDisk) isColdCandidate(
+	store *blockDiskStore, id kbfsblock.ID, cutoff time.Time) (
+	bool, error) {
+	info, err := store.getInfo(id)
+	if err != nil {
+		return false, err
+	}
+	if info.Cold || len(info.Refs) == 0 || info.Refs.hasNonArchivedRef() {
+		return false, nil
+	}
+	put, err := store.getDataModTime(id)
+	if err != nil {
+		return false, err
+	}
+	return !put.IsZero() && put.Before(cutoff), nil
+}
+
+// migrateBlockToCold moves the given block to the cold store, if the
+// policy says it should be, and counts it in `stats`.
+func (b *BlockServerDisk) migrateBlockToCold(
+	ctx context.Context, tlfID tlf.ID, tlfStorage *blockServerDiskTlfStorage,
+	id kbfsblock.ID, cutoff time.Time, stats *BlockServerTierStats) error {
+	tlfStorage.lock.Lock()
+	defer tlfStorage.lock.Unlock()
+	store := tlfStorage.store
+	if store == nil {
+		return errBlockServerDiskShutdown
+	}
+
+	move, err := b.isColdCandidate(store, id, cutoff)
+	if err != nil {
+		return err
+	}
+	if move {
+		size, err := store.moveToCold(id, func(data []byte) error {
+			return b.coldTier.store.PutCold(ctx, tlfID, id, data)
+		})
+		if err != nil {
+			return err
+		}
+		stats.MovedBlocks++
+		stats.MovedBytes += size
+	}
+
+	info, err := store.getInfo(id)
+	if err != nil {
+		return err
+	}
+	if len(info.Refs) == 0 {
+		return nil
+	}
+	if info.Cold {
+		stats.ColdBlocks++
+		stats.ColdBytes += info.ColdSize
+		return nil
+	}
+	size, err := store.getDataSize(id)
+	if err != nil {
+		return err
+	}
+	stats.HotBlocks++
+	stats.HotBytes += size
+	return nil
+}
+
+func (b *BlockServerDisk) migrateTLFToCold(
+	ctx context.Context, tlfID tlf.ID) (BlockServerTierStats, error) {
+	tlfStorage, err := b.getStorage(tlfID)
+	if err != nil {
+		return BlockServerTierStats{}, err
+	}
+
+	var ids []kbfsblock.ID
+	err = func() error {
+		tlfStorage.lock.RLock()
+		defer tlfStorage.lock.RUnlock()
+		if tlfStorage.store == nil {
+			return errBlockServerDiskShutdown
+		}
+		return tlfStorage.store.forEachBlock(func(id kbfsblock.ID) error {
+			ids = append(ids, id)
+			return nil
+		})
+	}()
+	if err != nil {
+		return BlockServerTierStats{}, err
+	}
+
+	// Lock each block separately, so reads and writes of the TLF
+	// aren't held up for the whole migration.
+	var stats BlockServerTierStats
+	cutoff := time.Now().Add(-b.coldTier.policy.MinAge)
+	for _, id := range ids {
+		select {
+		case <-ctx.Done():
+			return BlockServerTierStats{}, ctx.Err()
+		default:
+		}
+		err := b.migrateBlockToCold(ctx, tlfID, tlfStorage, id, cutoff, &stats)
+		if err != nil {
+			return BlockServerTierStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+// MigrateToCold moves the blocks of the given TLF that the cold tier
+// policy allows to the cold store, and returns the resulting counts
+// of hot and cold blocks in the TLF.
+func (b *BlockServerDisk) MigrateToCold(
+	ctx context.Context, tlfID tlf.ID) (BlockServerTierStats, error) {
+	if err := checkContext(ctx); err != nil {
+		return BlockServerTierStats{}, err
+	}
+	if b.coldTier == nil {
+		return BlockServerTierStats{}, nil
+	}
+	b.log.CDebugf(ctx, "BlockServerDisk.MigrateToCold tlfID=%s", tlfID)
+	stats, err := b.migrateTLFToCold(ctx, tlfID)
+	if err != nil {
+		return BlockServerTierStats{}, err
+	}
+	b.log.CDebugf(ctx, "Migrated %s to cold storage: %+v", tlfID, stats)
+	return stats, nil
+}
+
+// migrateAllToCold migrates every TLF in the store, and records the
+// total stats for TierStatus.
+func (b *BlockServerDisk) migrateAllToCold(ctx context.Context) error {
+	fileInfos, err := ioutil.ReadDir(b.dirPath)
+	if ioutil.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var total BlockServerTierStats
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+		tlfID, err := tlf.ParseID(fi.Name())
+		if err != nil {
+			// Not a TLF store.
+			continue
+		}
+		stats, err := b.migrateTLFToCold(ctx, tlfID)
+		if err != nil {
+			return err
+		}
+		total.add(stats)
+	}
+	b.log.CDebugf(ctx, "Migrated all TLFs to cold storage: %+v", total)
+
+	b.coldStatsLock.Lock()
+	defer b.coldStatsLock.Unlock()
+	b.coldStats = total
+	b.lastMigration = time.Now()
+	return nil
+}
+
+func (b *BlockServerDisk) migrateToColdLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-b.coldTier.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(b.coldTier.policy.Interval)
+	defer ticker.Stop()
+	for {
+		err := b.migrateAllToCold(ctx)
+		if err != nil && ctx.Err() == nil {
+			b.log.CWarningf(ctx, "Couldn't migrate blocks to cold "+
+				"storage: %+v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TierStatus returns the status of the tiers of `b`.  The zero status
+// is returned if the cold tier isn't enabled.
+func (b *BlockServerDisk) TierStatus() BlockServerTierStatus {
+	if b.coldTier == nil {
+		return BlockServerTierStatus{}
+	}
+	b.coldStatsLock.Lock()
+	defer b.coldStatsLock.Unlock()
+	reads := b.coldTier.readTimer.Snapshot()
+	ms := float64(time.Millisecond)
+	return BlockServerTierStatus{
+		Stats:          b.coldStats,
+		LastMigration:  b.lastMigration,
+		ColdReads:      reads.Count(),
+		ColdReadMeanMs: reads.Mean() / ms,
+		ColdReadMaxMs:  float64(reads.Max()) / ms,
+	}
+}
+
+// getBlockServerTierStatus returns the tier status of `bserv`, if
+// it's a BlockServerDisk with a cold tier, possibly wrapped in a
+// BlockServerMeasured.
+func getBlockServerTierStatus(bserv BlockServer) *BlockServerTierStatus {
+	if measured, ok := bserv.(BlockServerMeasured); ok {
+		bserv = measured.delegate
+	}
+	disk, ok := bserv.(*BlockServerDisk)
+	if !ok || disk.coldTier == nil {
+		return nil
+	}
+	status := disk.TierStatus()
+	return &status
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBlockServerDiskColdTier(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_cold")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	b := NewBlockServerDir(kbfscodec.NewMsgpack(), logger.NewTestLogger(t),
+		filepath.Join(tempdir, "hot"))
+	defer b.Shutdown(ctx)
+	cold := NewColdBlockStoreDir(filepath.Join(tempdir, "cold"))
+	b.EnableColdTier(cold, ColdTierPolicy{MinAge: time.Hour})
+	tlfID := tlf.FakeID(1, tlf.Private)
+
+	uid := keybase1.MakeTestUID(1)
+	put := func(data []byte) (kbfsblock.ID, kbfsblock.Context) {
+		id, err := kbfsblock.MakePermanentID(data)
+		require.NoError(t, err)
+		bCtx := kbfsblock.MakeFirstContext(
+			uid.AsUserOrTeam(), keybase1.BlockType_DATA)
+		serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = b.Put(ctx, tlfID, id, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		return id, bCtx
+	}
+	liveData := []byte{1, 2, 3}
+	liveID, _ := put(liveData)
+	oldData := []byte{4, 5, 6, 7}
+	oldID, oldCtx := put(oldData)
+	newData := []byte{8}
+	newID, newCtx := put(newData)
+	err = b.ArchiveBlockReferences(ctx, tlfID, kbfsblock.ContextMap{
+		oldID: {oldCtx},
+		newID: {newCtx},
+	})
+	require.NoError(t, err)
+
+	t.Log("Only archived blocks older than the policy's minimum age move")
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	tlfStorage, err := b.getStorage(tlfID)
+	require.NoError(t, err)
+	for _, id := range []kbfsblock.ID{liveID, oldID} {
+		err := os.Chtimes(
+			tlfStorage.store.dataPath(id), twoHoursAgo, twoHoursAgo)
+		require.NoError(t, err)
+	}
+	stats, err := b.MigrateToCold(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, BlockServerTierStats{
+		HotBlocks:   2,
+		HotBytes:    int64(len(liveData) + len(newData)),
+		ColdBlocks:  1,
+		ColdBytes:   int64(len(oldData)),
+		MovedBlocks: 1,
+		MovedBytes:  int64(len(oldData)),
+	}, stats)
+	_, err = ioutil.Stat(tlfStorage.store.dataPath(oldID))
+	require.True(t, ioutil.IsNotExist(err))
+
+	t.Log("Cold blocks are read through the cold store")
+	data, _, err := b.Get(ctx, tlfID, oldID, oldCtx)
+	require.NoError(t, err)
+	require.Equal(t, oldData, data)
+	require.Equal(t, int64(1), b.TierStatus().ColdReads)
+
+	t.Log("Removing a cold block removes it from the cold store")
+	_, err = cold.GetCold(ctx, tlfID, oldID)
+	require.NoError(t, err)
+	_, err = b.RemoveBlockReferences(ctx, tlfID, kbfsblock.ContextMap{
+		oldID: {oldCtx},
+	})
+	require.NoError(t, err)
+	_, err = cold.GetCold(ctx, tlfID, oldID)
+	require.IsType(t, blockNonExistentError{}, err)
+
+	t.Log("Full migrations record the totals for the status")
+	err = b.migrateAllToCold(ctx)
+	require.NoError(t, err)
+	status := b.TierStatus()
+	require.Equal(t, int64(2), status.Stats.HotBlocks)
+	require.Equal(t, int64(0), status.Stats.ColdBlocks)
+	require.False(t, status.LastMigration.IsZero())
+	require.NotNil(t, getBlockServerTierStatus(b))
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -22,10 +23,18 @@ import (
 	"golang.org/x/net/context"
 )
 
+// blockServerDiskCompactionThreshold is the number of blocks that
+// can be removed from a TLF's store before it's automatically
+// compacted.
+const blockServerDiskCompactionThreshold = 1000
+
 type blockServerDiskTlfStorage struct {
 	lock sync.RWMutex
 	// store is nil after it is shut down in Shutdown().
 	store *blockDiskStore
+	// removalsSinceCompaction counts the blocks removed from store
+	// since it was last compacted.
+	removalsSinceCompaction int
 }
 
 // BlockServerDisk implements the BlockServer interface by just
@@ -39,6 +48,16 @@ type BlockServerDisk struct {
 	tlfStorageLock sync.RWMutex
 	// tlfStorage is nil after Shutdown() is called.
 	tlfStorage map[tlf.ID]*blockServerDiskTlfStorage
+	// versionChecked is true once upgradeBlockServerDisk has run on
+	// dirPath, and versionErr holds its result.
+	versionChecked bool
+	versionErr     error
+
+	// coldTier is non-nil if EnableColdTier has been called.
+	coldTier      *blockServerDiskColdTier
+	coldStatsLock sync.Mutex
+	coldStats     BlockServerTierStats
+	lastMigration time.Time
 }
 
 var _ blockServerLocal = (*BlockServerDisk)(nil)
@@ -49,8 +68,11 @@ func newBlockServerDisk(
 	codec kbfscodec.Codec, log logger.Logger,
 	dirPath string, shutdownFunc func(logger.Logger)) *BlockServerDisk {
 	bserv := &BlockServerDisk{
-		codec, log, dirPath, shutdownFunc, sync.RWMutex{},
-		make(map[tlf.ID]*blockServerDiskTlfStorage),
+		codec:        codec,
+		log:          log,
+		dirPath:      dirPath,
+		shutdownFunc: shutdownFunc,
+		tlfStorage:   make(map[tlf.ID]*blockServerDiskTlfStorage),
 	}
 	return bserv
 }
@@ -110,8 +132,19 @@ func (b *BlockServerDisk) getStorage(tlfID tlf.ID) (
 		return storage, nil
 	}
 
+	// Make sure the layout is one we understand before opening the
+	// first TLF store.
+	if !b.versionChecked {
+		b.versionErr = upgradeBlockServerDisk(b.log, b.dirPath,
+			blockServerDiskVersionCurrent, blockServerDiskMigrations)
+		b.versionChecked = true
+	}
+	if b.versionErr != nil {
+		return nil, b.versionErr
+	}
+
 	path := filepath.Join(b.dirPath, tlfID.String())
-	store := makeBlockDiskStore(b.codec, path)
+	store := makeBlockDiskStore(b.codec, path, nil)
 
 	storage = &blockServerDiskTlfStorage{
 		store: store,
@@ -139,18 +172,33 @@ func (b *BlockServerDisk) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
 
-	tlfStorage.lock.RLock()
-	defer tlfStorage.lock.RUnlock()
-	if tlfStorage.store == nil {
-		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
-			errBlockServerDiskShutdown
-	}
+	data, keyServerHalf, err := func() (
+		[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+		tlfStorage.lock.RLock()
+		defer tlfStorage.lock.RUnlock()
+		if tlfStorage.store == nil {
+			return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+				errBlockServerDiskShutdown
+		}
 
-	data, keyServerHalf, err := tlfStorage.store.getDataWithContext(
-		id, context)
+		data, keyServerHalf, err := tlfStorage.store.getDataWithContext(
+			id, context)
+		if _, ok := err.(blockColdError); ok {
+			keyServerHalf, err = tlfStorage.store.getKeyServerHalf(id)
+		}
+		return data, keyServerHalf, err
+	}()
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
 	}
+	if data == nil {
+		// The data is in the cold store, which may be slow, so fetch
+		// it without holding the lock.
+		data, err = b.getCold(ctx, tlfID, id)
+		if err != nil {
+			return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+		}
+	}
 	return data, keyServerHalf, nil
 }
 
@@ -298,16 +346,80 @@ func (b *BlockServerDisk) RemoveBlockReferences(ctx context.Context,
 		liveCounts[id] = liveCount
 
 		if liveCount == 0 {
-			err := tlfStorage.store.remove(id)
+			info, err := tlfStorage.store.getInfo(id)
 			if err != nil {
 				return nil, err
 			}
+			if info.Cold && b.coldTier != nil {
+				err := b.coldTier.store.DeleteCold(ctx, tlfID, id)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = tlfStorage.store.remove(id)
+			if err != nil {
+				return nil, err
+			}
+			tlfStorage.removalsSinceCompaction++
+		}
+	}
+
+	if tlfStorage.removalsSinceCompaction >=
+		blockServerDiskCompactionThreshold {
+		// Compaction is just housekeeping, so don't fail the
+		// removal if it doesn't work.
+		_, err := b.compactLocked(ctx, tlfID, tlfStorage)
+		if err != nil {
+			b.log.CWarningf(ctx, "Couldn't compact the store for %s: %+v",
+				tlfID, err)
 		}
 	}
 
 	return liveCounts, nil
 }
 
+func (b *BlockServerDisk) compactLocked(ctx context.Context, tlfID tlf.ID,
+	tlfStorage *blockServerDiskTlfStorage) (
+	blockDiskStoreCompactionStats, error) {
+	stats, err := tlfStorage.store.compact()
+	if err != nil {
+		return blockDiskStoreCompactionStats{}, err
+	}
+	tlfStorage.removalsSinceCompaction = 0
+	b.log.CDebugf(ctx, "Compacted the store for %s: %+v", tlfID, stats)
+	return stats, nil
+}
+
+func (b *BlockServerDisk) compactTLF(ctx context.Context, tlfID tlf.ID) (
+	blockDiskStoreCompactionStats, error) {
+	tlfStorage, err := b.getStorage(tlfID)
+	if err != nil {
+		return blockDiskStoreCompactionStats{}, err
+	}
+
+	tlfStorage.lock.Lock()
+	defer tlfStorage.lock.Unlock()
+	if tlfStorage.store == nil {
+		return blockDiskStoreCompactionStats{}, errBlockServerDiskShutdown
+	}
+
+	return b.compactLocked(ctx, tlfID, tlfStorage)
+}
+
+// CompactTLF removes any unreferenced or partially-written blocks
+// left in the given TLF's store, e.g. by operations interrupted by a
+// crash, and reclaims their disk space.  Other operations on the TLF
+// block until it's done.  Stores are also compacted automatically
+// after enough blocks are removed from them.
+func (b *BlockServerDisk) CompactTLF(ctx context.Context, tlfID tlf.ID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	b.log.CDebugf(ctx, "BlockServerDisk.CompactTLF tlfID=%s", tlfID)
+	_, err := b.compactTLF(ctx, tlfID)
+	return err
+}
+
 // ArchiveBlockReferences implements the BlockServer interface for
 // BlockServerDisk.
 func (b *BlockServerDisk) ArchiveBlockReferences(ctx context.Context,
@@ -416,6 +528,14 @@ func (b *BlockServerDisk) Shutdown(ctx context.Context) {
 		}()
 	}
 
+	if b.coldTier != nil {
+		select {
+		case <-b.coldTier.shutdown:
+		default:
+			close(b.coldTier.shutdown)
+		}
+	}
+
 	if b.shutdownFunc != nil {
 		b.shutdownFunc(b.log)
 	}
@@ -0,0 +1,137 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+)
+
+// blockServerDiskVersion is the version of the on-disk layout of a
+// BlockServerDisk, as recorded in its version file.
+type blockServerDiskVersion uint64
+
+const (
+	// blockServerDiskVersionUnversioned is the layout used before
+	// version files existed: one blockDiskStore directory per TLF
+	// ID.
+	blockServerDiskVersionUnversioned blockServerDiskVersion = 0
+	// blockServerDiskVersionInitial is the same layout as
+	// blockServerDiskVersionUnversioned, with a version file.
+	blockServerDiskVersionInitial blockServerDiskVersion = 1
+	// blockServerDiskVersionCurrent is the layout this code reads
+	// and writes.
+	blockServerDiskVersionCurrent = blockServerDiskVersionInitial
+)
+
+// blockServerDiskVersionFilename is the name of the file, in the root
+// of a BlockServerDisk's directory, that holds its layout version as a
+// decimal number.
+const blockServerDiskVersionFilename = "version"
+
+// blockServerDiskMigration upgrades the store at `dirPath`, in
+// place, from the version it's keyed by to the next one.  It must be
+// safe to re-run if it was interrupted, since the version file is
+// only updated after it succeeds.
+type blockServerDiskMigration func(log logger.Logger, dirPath string) error
+
+// blockServerDiskMigrations holds the migration from each old version
+// to the next.  Any change to the layout must bump
+// blockServerDiskVersionCurrent and add an entry here.
+var blockServerDiskMigrations = map[blockServerDiskVersion]blockServerDiskMigration{
+	blockServerDiskVersionUnversioned: func(logger.Logger, string) error {
+		// Nothing to do besides writing the version file.
+		return nil
+	},
+}
+
+func readBlockServerDiskVersion(dirPath string) (
+	version blockServerDiskVersion, exists bool, err error) {
+	versionBytes, err := ioutil.ReadFile(
+		filepath.Join(dirPath, blockServerDiskVersionFilename))
+	if ioutil.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	v, err := strconv.ParseUint(
+		strings.TrimSpace(string(versionBytes)), 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err,
+			"Corrupt version file in block server directory %s", dirPath)
+	}
+	return blockServerDiskVersion(v), true, nil
+}
+
+func writeBlockServerDiskVersion(
+	dirPath string, version blockServerDiskVersion) error {
+	return ioutil.WriteFile(
+		filepath.Join(dirPath, blockServerDiskVersionFilename),
+		[]byte(strconv.FormatUint(uint64(version), 10)), 0600)
+}
+
+// upgradeBlockServerDisk makes sure the store at `dirPath` is at
+// version `current`, running any needed migrations from
+// `migrations`.  A new store is simply stamped with `current`.  It
+// returns a BlockServerDiskVersionError if the store was written by a
+// newer version of KBFS.
+func upgradeBlockServerDisk(log logger.Logger, dirPath string,
+	current blockServerDiskVersion,
+	migrations map[blockServerDiskVersion]blockServerDiskMigration) error {
+	err := ioutil.MkdirAll(dirPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	version, exists, err := readBlockServerDiskVersion(dirPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fis, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		if len(fis) == 0 {
+			log.Debug("Creating block server directory %s at version %d",
+				dirPath, current)
+			return writeBlockServerDiskVersion(dirPath, current)
+		}
+		version = blockServerDiskVersionUnversioned
+	}
+
+	if version > current {
+		return BlockServerDiskVersionError{dirPath, version, current}
+	}
+
+	for version < current {
+		migrate, ok := migrations[version]
+		if !ok {
+			return errors.Errorf(
+				"No migration from version %d for block server directory %s",
+				version, dirPath)
+		}
+		log.Debug("Migrating block server directory %s from version %d",
+			dirPath, version)
+		err := migrate(log, dirPath)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf(
+				"Migrating block server directory %s from version %d",
+				dirPath, version))
+		}
+		version++
+		err = writeBlockServerDiskVersion(dirPath, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBlockServerDiskVersionNewAndUnversioned(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_disk_version")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	log := logger.NewTestLogger(t)
+
+	// A new directory gets the current version.
+	newDir := filepath.Join(tempdir, "new")
+	err = upgradeBlockServerDisk(log, newDir,
+		blockServerDiskVersionCurrent, blockServerDiskMigrations)
+	require.NoError(t, err)
+	version, exists, err := readBlockServerDiskVersion(newDir)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, blockServerDiskVersionCurrent, version)
+
+	// An existing directory without a version file is migrated,
+	// keeping its contents.
+	oldDir := filepath.Join(tempdir, "old")
+	tlfDir := filepath.Join(oldDir, tlf.FakeID(1, tlf.Private).String())
+	err = ioutil.MkdirAll(tlfDir, 0700)
+	require.NoError(t, err)
+	err = upgradeBlockServerDisk(log, oldDir,
+		blockServerDiskVersionCurrent, blockServerDiskMigrations)
+	require.NoError(t, err)
+	version, _, err = readBlockServerDiskVersion(oldDir)
+	require.NoError(t, err)
+	require.Equal(t, blockServerDiskVersionCurrent, version)
+	_, err = ioutil.Stat(tlfDir)
+	require.NoError(t, err)
+}
+
+func TestBlockServerDiskVersionMigrations(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_disk_version")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	log := logger.NewTestLogger(t)
+
+	err = writeBlockServerDiskVersion(tempdir, 1)
+	require.NoError(t, err)
+
+	var ran []blockServerDiskVersion
+	failAt2 := true
+	migrations := map[blockServerDiskVersion]blockServerDiskMigration{
+		1: func(logger.Logger, string) error {
+			ran = append(ran, 1)
+			return nil
+		},
+		2: func(logger.Logger, string) error {
+			if failAt2 {
+				return errors.New("interrupted")
+			}
+			ran = append(ran, 2)
+			return nil
+		},
+	}
+
+	// A failed migration leaves the version where it was, so it
+	// will be retried.
+	err = upgradeBlockServerDisk(log, tempdir, 3, migrations)
+	require.Error(t, err)
+	version, _, err := readBlockServerDiskVersion(tempdir)
+	require.NoError(t, err)
+	require.Equal(t, blockServerDiskVersion(2), version)
+
+	failAt2 = false
+	err = upgradeBlockServerDisk(log, tempdir, 3, migrations)
+	require.NoError(t, err)
+	require.Equal(t, []blockServerDiskVersion{1, 2}, ran)
+	version, _, err = readBlockServerDiskVersion(tempdir)
+	require.NoError(t, err)
+	require.Equal(t, blockServerDiskVersion(3), version)
+
+	// A missing migration is an error.
+	err = upgradeBlockServerDisk(log, tempdir, 4, migrations)
+	require.Error(t, err)
+}
+
+func TestBlockServerDiskRefusesNewerVersion(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_disk_version")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	err = writeBlockServerDiskVersion(
+		tempdir, blockServerDiskVersionCurrent+1)
+	require.NoError(t, err)
+
+	codec := kbfscodec.NewMsgpack()
+	bserver := NewBlockServerDir(codec, logger.NewTestLogger(t), tempdir)
+	defer bserver.Shutdown(context.Background())
+
+	_, err = bserver.IsUnflushed(
+		context.Background(), tlf.FakeID(1, tlf.Private), kbfsblock.FakeID(1))
+	require.Equal(t, BlockServerDiskVersionError{
+		tempdir, blockServerDiskVersionCurrent + 1,
+		blockServerDiskVersionCurrent,
+	}, errors.Cause(err))
+}
@@ -24,6 +24,7 @@ type BlockServerMeasured struct {
 	removeBlockReferencesTimer  metrics.Timer
 	archiveBlockReferencesTimer metrics.Timer
 	isUnflushedTimer            metrics.Timer
+	errCounter                  *serverErrorCounter
 }
 
 var _ BlockServer = BlockServerMeasured{}
@@ -45,6 +46,7 @@ func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServe
 		removeBlockReferencesTimer:  removeBlockReferencesTimer,
 		archiveBlockReferencesTimer: archiveBlockReferencesTimer,
 		isUnflushedTimer:            isUnflushedTimer,
+		errCounter:                  newServerErrorCounter(blockServerKind, r),
 	}
 }
 
@@ -55,6 +57,7 @@ func (b BlockServerMeasured) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock
 	b.getTimer.Time(func() {
 		buf, serverHalf, err = b.delegate.Get(ctx, tlfID, id, context)
 	})
+	b.errCounter.record(err)
 	return buf, serverHalf, err
 }
 
@@ -65,6 +68,7 @@ func (b BlockServerMeasured) Put(ctx context.Context, tlfID tlf.ID, id kbfsblock
 	b.putTimer.Time(func() {
 		err = b.delegate.Put(ctx, tlfID, id, context, buf, serverHalf)
 	})
+	b.errCounter.record(err)
 	return err
 }
 
@@ -75,6 +79,7 @@ func (b BlockServerMeasured) PutAgain(ctx context.Context, tlfID tlf.ID, id kbfs
 	b.putAgainTimer.Time(func() {
 		err = b.delegate.PutAgain(ctx, tlfID, id, context, buf, serverHalf)
 	})
+	b.errCounter.record(err)
 	return err
 }
 
@@ -85,6 +90,7 @@ func (b BlockServerMeasured) AddBlockReference(ctx context.Context, tlfID tlf.ID
 	b.addBlockReferenceTimer.Time(func() {
 		err = b.delegate.AddBlockReference(ctx, tlfID, id, context)
 	})
+	b.errCounter.record(err)
 	return err
 }
 
@@ -97,6 +103,7 @@ func (b BlockServerMeasured) RemoveBlockReferences(ctx context.Context,
 		liveCounts, err = b.delegate.RemoveBlockReferences(
 			ctx, tlfID, contexts)
 	})
+	b.errCounter.record(err)
 	return liveCounts, err
 }
 
@@ -107,6 +114,7 @@ func (b BlockServerMeasured) ArchiveBlockReferences(ctx context.Context,
 	b.archiveBlockReferencesTimer.Time(func() {
 		err = b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
 	})
+	b.errCounter.record(err)
 	return err
 }
 
@@ -116,6 +124,7 @@ func (b BlockServerMeasured) IsUnflushed(ctx context.Context, tlfID tlf.ID,
 	b.isUnflushedTimer.Time(func() {
 		isUnflushed, err = b.delegate.IsUnflushed(ctx, tlfID, id)
 	})
+	b.errCounter.record(err)
 	return isUnflushed, err
 
 }
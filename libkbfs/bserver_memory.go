@@ -23,6 +23,9 @@ type blockMemEntry struct {
 	blockData     []byte
 	keyServerHalf kbfscrypto.BlockCryptKeyServerHalf
 	refs          blockRefMap
+	// transferredFrom is the TLF the block's references were last
+	// transferred from, if any.
+	transferredFrom tlf.ID
 }
 
 // BlockServerMemory implements the BlockServer interface by just
@@ -36,6 +39,7 @@ type BlockServerMemory struct {
 }
 
 var _ blockServerLocal = (*BlockServerMemory)(nil)
+var _ BlockRefTransferer = (*BlockServerMemory)(nil)
 
 // NewBlockServerMemory constructs a new BlockServerMemory that stores
 // its data in memory.
@@ -146,7 +150,7 @@ func (b *BlockServerMemory) doPut(isRegularPut bool, tlfID tlf.ID, id kbfsblock.
 		// check that it's equal to entry.data (since that was
 		// presumably already checked previously).
 
-		if isRegularPut && entry.keyServerHalf != serverHalf {
+		if isRegularPut && !entry.keyServerHalf.Equal(serverHalf) {
 			return fmt.Errorf(
 				"key server half mismatch: expected %s, got %s",
 				entry.keyServerHalf, serverHalf)
@@ -253,6 +257,10 @@ func (b *BlockServerMemory) removeBlockReference(
 	}
 
 	if entry.tlfID != tlfID {
+		if entry.transferredFrom == tlfID {
+			// The references now belong to another TLF.
+			return len(entry.refs), nil
+		}
 		return 0, fmt.Errorf("TLF ID mismatch: expected %s, got %s",
 			entry.tlfID, tlfID)
 	}
@@ -312,6 +320,10 @@ func (b *BlockServerMemory) archiveBlockReference(
 	}
 
 	if entry.tlfID != tlfID {
+		if entry.transferredFrom == tlfID {
+			// The references now belong to another TLF.
+			return nil
+		}
 		return fmt.Errorf("TLF ID mismatch: expected %s, got %s",
 			entry.tlfID, tlfID)
 	}
@@ -356,6 +368,71 @@ func (b *BlockServerMemory) ArchiveBlockReferences(ctx context.Context,
 	return nil
 }
 
+// TransferBlockReferences implements the BlockRefTransferer
+// interface for BlockServerMemory.
+func (b *BlockServerMemory) TransferBlockReferences(ctx context.Context,
+	fromTlfID, toTlfID tlf.ID, contexts kbfsblock.ContextMap) (err error) {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	defer func() {
+		err = translateToBlockServerError(err)
+	}()
+	b.log.CDebugf(ctx, "BlockServerMemory.TransferBlockReferences "+
+		"fromTlfID=%s toTlfID=%s contexts=%v", fromTlfID, toTlfID, contexts)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.m == nil {
+		return errBlockServerMemoryShutdown
+	}
+
+	// Check all the blocks before moving any of them, so that a
+	// failed transfer leaves everything where it was.
+	for id, idContexts := range contexts {
+		entry, ok := b.m[id]
+		if !ok {
+			return kbfsblock.ServerErrorBlockNonExistent{
+				Msg: fmt.Sprintf("Block ID %s doesn't "+
+					"exist and cannot be transferred.", id)}
+		}
+
+		if entry.tlfID != fromTlfID {
+			return fmt.Errorf("TLF ID mismatch: expected %s, got %s",
+				entry.tlfID, fromTlfID)
+		}
+
+		nonces := make(map[kbfsblock.RefNonce]bool)
+		for _, context := range idContexts {
+			exists, err := entry.refs.checkExists(context)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return kbfsblock.ServerErrorBlockNonExistent{
+					Msg: fmt.Sprintf("Block ID %s (ref %s) "+
+						"doesn't exist and cannot be transferred.",
+						id, context.GetRefNonce())}
+			}
+			nonces[context.GetRefNonce()] = true
+		}
+		if len(nonces) != len(entry.refs) {
+			return fmt.Errorf("Block ID %s has references in %s that "+
+				"aren't being transferred", id, fromTlfID)
+		}
+	}
+
+	for id := range contexts {
+		entry := b.m[id]
+		entry.tlfID = toTlfID
+		entry.transferredFrom = fromTlfID
+		b.m[id] = entry
+	}
+	return nil
+}
+
 // getAllRefsForTest implements the blockServerLocal interface for
 // BlockServerMemory.
 func (b *BlockServerMemory) getAllRefsForTest(
@@ -378,6 +455,26 @@ func (b *BlockServerMemory) getAllRefsForTest(
 	return res, nil
 }
 
+// getTransferredIDsForTest implements the blockRefTransfererLocal
+// interface for BlockServerMemory.
+func (b *BlockServerMemory) getTransferredIDsForTest(
+	ctx context.Context, tlfID tlf.ID) (map[kbfsblock.ID]bool, error) {
+	res := make(map[kbfsblock.ID]bool)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.m == nil {
+		return nil, errBlockServerMemoryShutdown
+	}
+
+	for id, entry := range b.m {
+		if entry.tlfID != tlfID && entry.transferredFrom == tlfID {
+			res[id] = true
+		}
+	}
+	return res, nil
+}
+
 func (b *BlockServerMemory) numBlocks() int {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
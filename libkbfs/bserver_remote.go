@@ -258,7 +258,7 @@ func (b *blockServerRemoteClientHandler) ShouldRetry(rpcName string, err error)
 	case "keybase.1.block.archiveReferenceWithCount":
 		return false
 	}
-	return kbfsblock.IsThrottleError(err)
+	return serverErrorPolicyFor(blockServerKind, err).retryRPC
 }
 
 // ShouldRetryOnConnect implements the ConnectionHandler interface.
@@ -12,10 +12,14 @@ import (
 
 // BlockSplitterSimple implements the BlockSplitter interface by using
 // a simple max-size algorithm to determine when to split blocks.
+// Files of up to inlineMaxSize bytes are inlined into their directory
+// entries, rather than stored in a block; if it's 0, no files are
+// inlined.
 type BlockSplitterSimple struct {
 	maxSize                 int64
 	maxPtrsPerBlock         int
 	blockChangeEmbedMaxSize uint64
+	inlineMaxSize           int64
 }
 
 // NewBlockSplitterSimple creates a new BlockSplittleSimple and
@@ -147,3 +151,9 @@ func (b *BlockSplitterSimple) ShouldEmbedBlockChanges(
 	bc *BlockChanges) bool {
 	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
 }
+
+// ShouldInlineFile implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) ShouldInlineFile(size int64) bool {
+	return b.inlineMaxSize > 0 && size <= b.inlineMaxSize
+}
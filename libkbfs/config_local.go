@@ -63,6 +63,12 @@ const (
 	keyBundlesCacheCapacityBytes = 10 * cache.MB
 	// folder name for persisted config parameters.
 	syncedTlfConfigFolderName = "synced_tlf_config"
+	// crQuietPeriodDefault is the default for how long a TLF must go
+	// without local writes before conflict resolution starts.
+	crQuietPeriodDefault = 2 * time.Second
+	// logRingBufferBytesDefault is the default for how many bytes of
+	// recent log lines are kept in memory for each TLF.
+	logRingBufferBytesDefault = 64 * 1024
 
 	// By default, this will be the block type given to all blocks
 	// that aren't explicitly some other type.
@@ -76,6 +82,8 @@ type ConfigLocal struct {
 	kbfs             KBFSOps
 	keyman           KeyManager
 	rep              Reporter
+	activityNotifier ActivityNotifier
+	writeInterceptor WriteInterceptor
 	kcache           KeyCache
 	kbcache          kbfsmd.KeyBundleCache
 	bcache           BlockCache
@@ -112,6 +120,7 @@ type ConfigLocal struct {
 	rekeyQueue    RekeyQueue
 	storageRoot   string
 	diskCacheMode DiskCacheMode
+	storageMon    *storageMonitor
 
 	traceLock    sync.RWMutex
 	traceEnabled bool
@@ -136,6 +145,79 @@ type ConfigLocal struct {
 	// before syncing a set of changes to the servers.
 	bgFlushPeriod time.Duration
 
+	// tlfIdleEvictionTimeout indicates how long a folder-branch can
+	// go unaccessed before it is evicted; zero disables eviction.
+	tlfIdleEvictionTimeout time.Duration
+
+	// atimePolicy indicates when reads update access times.
+	atimePolicy AtimePolicy
+
+	// maxOpenTLFs caps how many folder-branches can be instantiated
+	// at once; zero means no limit.
+	maxOpenTLFs int
+
+	// keyCacheTTL indicates how long a decrypted TLF crypt key can
+	// stay in the key cache; zero means it stays until evicted.
+	keyCacheTTL time.Duration
+
+	// crQuietPeriod indicates how long a folder must go without
+	// local writes before conflict resolution starts on it.
+	crQuietPeriod time.Duration
+
+	// logRingBufferBytes indicates how many bytes of recent log
+	// lines are kept in memory for each TLF; zero means none.
+	logRingBufferBytes int
+
+	// conflictManifestEnabled indicates whether conflict resolution
+	// writes a manifest of its conflicted copies into each TLF.
+	conflictManifestEnabled bool
+
+	// crTextMergePolicy controls whether conflict resolution merges
+	// conflicting writes to text files.
+	crTextMergePolicy CRTextMergePolicy
+
+	// tlfUsageAlertPolicy controls the warnings about TLF growth,
+	// and the periodic usage reports written into TLFs.
+	tlfUsageAlertPolicy TlfUsageAlertPolicy
+
+	// unmergedBranchRetention indicates how long pruned unmerged
+	// branches are kept around for recovery.
+	unmergedBranchRetention time.Duration
+
+	// mdPutPipelining indicates whether the next MD revision of a
+	// folder may be prepared before the MD server acknowledges the
+	// previous one.
+	mdPutPipelining bool
+
+	// hideOpDeviceInfo indicates whether the device KID and client
+	// version should be left out of written ops.
+	hideOpDeviceInfo bool
+
+	// diskCacheMmapReads indicates whether new disk block caches
+	// map large blocks rather than copying them.
+	diskCacheMmapReads bool
+
+	// strictWriteVisibility indicates whether reads of a syncing
+	// file wait for the sync to finish.
+	strictWriteVisibility bool
+
+	// tuningProfiles holds the tuning profiles of TLFs that
+	// override the default, which is stored under tlf.NullID.
+	tuningProfiles map[tlf.ID]TuningProfile
+
+	// memoryPressureMonitor, if non-nil, adapts the clean block
+	// cache capacity to the memory available.
+	memoryPressureMonitor *memoryPressureMonitor
+
+	// telemetryReporter, if non-nil, periodically sends anonymized
+	// performance metrics; see EnableTelemetry.
+	telemetryReporter *telemetryReporter
+
+	// dirOpCoalescingWindows holds the directory op coalescing
+	// windows of TLFs that override the default, which is stored
+	// under tlf.NullID.
+	dirOpCoalescingWindows map[tlf.ID]time.Duration
+
 	// metadataVersion is the version to use when creating new metadata.
 	metadataVersion kbfsmd.MetadataVer
 
@@ -384,6 +466,8 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	}
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
+	config.storageMon = newStorageMonitor(
+		config.MakeLogger("STM"), config.Reporter)
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
 	config.ResetCaches()
 	config.SetCodec(kbfscodec.NewMsgpack())
@@ -409,6 +493,7 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	config.tlfValidDuration = tlfValidDurationDefault
 	config.bgFlushDirOpBatchSize = bgFlushDirOpBatchSizeDefault
 	config.bgFlushPeriod = bgFlushPeriodDefault
+	config.logRingBufferBytes = logRingBufferBytesDefault
 	config.metadataVersion = defaultClientMetadataVer
 	config.defaultBlockType = defaultBlockTypeDefault
 	config.quotaUsage =
@@ -424,6 +509,9 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	case InitSingleOp:
 		// Just block all rekeys and don't bother cleaning up requests since the process is short lived anyway.
 		config.rekeyFSMLimiter = NewOngoingWorkLimiter(0)
+	case InitReadOnly:
+		// Read-only services never write, so they never rekey.
+		config.rekeyFSMLimiter = NewOngoingWorkLimiter(0)
 	default:
 		panic(fmt.Sprintf("😱 unknown init mode %v", config.mode))
 	}
@@ -501,6 +589,34 @@ func (c *ConfigLocal) SetReporter(r Reporter) {
 	c.rep = r
 }
 
+// ActivityNotifier implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ActivityNotifier() ActivityNotifier {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.activityNotifier
+}
+
+// SetActivityNotifier implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetActivityNotifier(an ActivityNotifier) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.activityNotifier = an
+}
+
+// WriteInterceptor implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) WriteInterceptor() WriteInterceptor {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeInterceptor
+}
+
+// SetWriteInterceptor implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetWriteInterceptor(wi WriteInterceptor) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeInterceptor = wi
+}
+
 // KeyCache implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) KeyCache() KeyCache {
 	c.lock.RLock()
@@ -817,9 +933,9 @@ func (c *ConfigLocal) SetDefaultBlockType(blockType keybase1.BlockType) {
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DoBackgroundFlushes() bool {
-	if c.Mode() == InitMinimal {
-		// Don't do background flushes when in minimal mode, since
-		// there shouldn't be any data writes.
+	if c.Mode() == InitMinimal || c.Mode() == InitReadOnly {
+		// Don't do background flushes when in minimal or read-only
+		// mode, since there shouldn't be any data writes.
 		return false
 	}
 
@@ -911,7 +1027,11 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.mdcache = NewMDCacheStandard(defaultMDCacheCapacity)
-	c.kcache = NewKeyCacheStandard(defaultMDCacheCapacity)
+	if c.kcache != nil {
+		c.kcache.Clear()
+	}
+	c.kcache = NewKeyCacheStandardWithTTL(
+		defaultMDCacheCapacity, c.keyCacheTTL, c.clock)
 	c.kbcache = kbfsmd.NewKeyBundleCacheLRU(keyBundlesCacheCapacityBytes)
 
 	log := c.MakeLogger("")
@@ -950,6 +1070,11 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	// amount of memory used by dirty blocks). We use the same value from clean
 	// block cache capacity here.
 	maxSyncBufferSize := int64(capacity)
+	if c.Mode() == InitReadOnly {
+		// Nothing is dirtied in read-only mode, but block reads still
+		// check the dirty block cache, so keep a minimal one.
+		maxSyncBufferSize = minSyncBufferSize
+	}
 
 	// Start off conservatively to avoid getting immediate timeouts on
 	// slow connections.
@@ -1085,6 +1210,291 @@ func (c *ConfigLocal) BGFlushPeriod() time.Duration {
 	return c.bgFlushPeriod
 }
 
+// SetTLFIdleEvictionTimeout implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetTLFIdleEvictionTimeout(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tlfIdleEvictionTimeout = d
+}
+
+// TLFIdleEvictionTimeout implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) TLFIdleEvictionTimeout() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlfIdleEvictionTimeout
+}
+
+// SetAtimePolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetAtimePolicy(p AtimePolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.atimePolicy = p
+}
+
+// AtimePolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) AtimePolicy() AtimePolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.atimePolicy
+}
+
+// SetMaxOpenTLFs implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxOpenTLFs(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxOpenTLFs = n
+}
+
+// MaxOpenTLFs implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxOpenTLFs() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxOpenTLFs
+}
+
+// SetKeyCacheTTL implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetKeyCacheTTL(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keyCacheTTL = d
+	if c.kcache != nil {
+		c.kcache.Clear()
+	}
+	c.kcache = NewKeyCacheStandardWithTTL(defaultMDCacheCapacity, d, c.clock)
+}
+
+// KeyCacheTTL implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) KeyCacheTTL() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.keyCacheTTL
+}
+
+// SetCRQuietPeriod implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetCRQuietPeriod(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crQuietPeriod = d
+}
+
+// CRQuietPeriod implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) CRQuietPeriod() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.crQuietPeriod
+}
+
+// SetLogRingBufferBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetLogRingBufferBytes(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.logRingBufferBytes = n
+}
+
+// LogRingBufferBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) LogRingBufferBytes() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.logRingBufferBytes
+}
+
+// SetConflictManifestEnabled implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetConflictManifestEnabled(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conflictManifestEnabled = enabled
+}
+
+// ConflictManifestEnabled implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) ConflictManifestEnabled() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.conflictManifestEnabled
+}
+
+// SetCRTextMergePolicy implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetCRTextMergePolicy(p CRTextMergePolicy) {
+	if p.MaxSize == 0 {
+		p.MaxSize = crTextMergeMaxSizeDefault
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crTextMergePolicy = p
+}
+
+// CRTextMergePolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) CRTextMergePolicy() CRTextMergePolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.crTextMergePolicy
+}
+
+// SetTlfUsageAlertPolicy implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetTlfUsageAlertPolicy(p TlfUsageAlertPolicy) {
+	if p.GrowthWindow == 0 {
+		p.GrowthWindow = tlfUsageGrowthWindowDefault
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tlfUsageAlertPolicy = p
+}
+
+// TlfUsageAlertPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TlfUsageAlertPolicy() TlfUsageAlertPolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlfUsageAlertPolicy
+}
+
+// SetUnmergedBranchRetention implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetUnmergedBranchRetention(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unmergedBranchRetention = d
+}
+
+// UnmergedBranchRetention implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) UnmergedBranchRetention() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.unmergedBranchRetention
+}
+
+// SetMDPutPipelining implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMDPutPipelining(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.mdPutPipelining = enabled
+}
+
+// MDPutPipelining implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MDPutPipelining() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mdPutPipelining
+}
+
+// SetHideOpDeviceInfo implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetHideOpDeviceInfo(hide bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.hideOpDeviceInfo = hide
+}
+
+// HideOpDeviceInfo implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) HideOpDeviceInfo() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.hideOpDeviceInfo
+}
+
+// SetDiskCacheMmapReads implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskCacheMmapReads(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.diskCacheMmapReads = enabled
+}
+
+// DiskCacheMmapReads implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskCacheMmapReads() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskCacheMmapReads
+}
+
+// SetStrictWriteVisibility implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetStrictWriteVisibility(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.strictWriteVisibility = enabled
+}
+
+// StrictWriteVisibility implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) StrictWriteVisibility() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.strictWriteVisibility
+}
+
+// SetDirOpCoalescingWindow implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetDirOpCoalescingWindow(
+	tlfID tlf.ID, d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dirOpCoalescingWindows == nil {
+		c.dirOpCoalescingWindows = make(map[tlf.ID]time.Duration)
+	}
+	c.dirOpCoalescingWindows[tlfID] = d
+}
+
+// DirOpCoalescingWindow implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) DirOpCoalescingWindow(tlfID tlf.ID) time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if d, ok := c.dirOpCoalescingWindows[tlfID]; ok {
+		return d
+	}
+	return c.dirOpCoalescingWindows[tlf.NullID]
+}
+
+// SetTuningProfile implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTuningProfile(
+	tlfID tlf.ID, name TuningProfileName) error {
+	profile, err := GetTuningProfile(name)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tuningProfiles == nil {
+		c.tuningProfiles = make(map[tlf.ID]TuningProfile)
+	}
+	c.tuningProfiles[tlfID] = profile
+	return nil
+}
+
+// SetDefaultReadAheadBlocks overrides the ReadAheadBlocks setting
+// of the default tuning profile, used by all TLFs without one of
+// their own.
+func (c *ConfigLocal) SetDefaultReadAheadBlocks(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tuningProfiles == nil {
+		c.tuningProfiles = make(map[tlf.ID]TuningProfile)
+	}
+	p, ok := c.tuningProfiles[tlf.NullID]
+	if !ok {
+		p = tuningProfiles[TuningProfileDefault]
+	}
+	p.ReadAheadBlocks = n
+	c.tuningProfiles[tlf.NullID] = p
+}
+
+// TuningProfile implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) TuningProfile(tlfID tlf.ID) TuningProfile {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if p, ok := c.tuningProfiles[tlfID]; ok {
+		return p
+	}
+	if p, ok := c.tuningProfiles[tlf.NullID]; ok {
+		return p
+	}
+	return tuningProfiles[TuningProfileDefault]
+}
+
 // Shutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	c.RekeyQueue().Shutdown()
@@ -1155,6 +1565,18 @@ func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	if kbfsServ != nil {
 		kbfsServ.Shutdown()
 	}
+	c.lock.RLock()
+	mpm := c.memoryPressureMonitor
+	c.lock.RUnlock()
+	if mpm != nil {
+		mpm.shutdown()
+	}
+	c.lock.RLock()
+	tr := c.telemetryReporter
+	c.lock.RUnlock()
+	if tr != nil {
+		tr.shutdown()
+	}
 
 	if len(errorList) == 1 {
 		return errorList[0]
@@ -1269,6 +1691,12 @@ func (c *ConfigLocal) EnableJournaling(
 		return err
 	}
 
+	// Leave journaling off, rather than fill up the disk.
+	err = c.storageMon.preflight(ctx, journalRoot, "journal")
+	if err != nil {
+		return err
+	}
+
 	jServer = makeJournalServer(c, log, journalRoot, c.BlockCache(),
 		c.DirtyBlockCache(), c.BlockServer(), c.MDOps(), branchListener,
 		flushListener)
@@ -1306,7 +1734,8 @@ func (c *ConfigLocal) EnableJournaling(
 }
 
 func (c *ConfigLocal) resetDiskBlockCacheLocked() error {
-	dbc, err := newDiskBlockCacheWrapped(c, c.storageRoot)
+	dbc, err := newDiskBlockCacheWrapped(
+		c, c.storageRoot, c.diskCacheMmapReads)
 	if err != nil {
 		return err
 	}
@@ -1317,6 +1746,17 @@ func (c *ConfigLocal) resetDiskBlockCacheLocked() error {
 // MakeDiskBlockCacheIfNotExists implements the Config interface for
 // ConfigLocal.
 func (c *ConfigLocal) MakeDiskBlockCacheIfNotExists() error {
+	// Run without a disk cache, rather than fill up the disk; we'll
+	// check again the next time this is called.  This must happen
+	// outside of `c.lock`, since reporting the problem needs it.
+	if c.diskCacheMode == DiskCacheModeLocal && c.DiskBlockCache() == nil {
+		err := c.storageMon.preflight(
+			context.Background(), c.storageRoot, "disk block cache")
+		if err != nil {
+			return nil
+		}
+	}
+
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	if c.diskBlockCache != nil {
@@ -1461,6 +1901,31 @@ func (c *ConfigLocal) SetKBFSService(k *KBFSService) {
 	c.kbfsService = k
 }
 
+// EnableAdaptiveBlockCache starts shrinking the clean block cache
+// whenever the system runs low on memory, or this process's RSS goes
+// over `maxRSS` (if non-zero), and growing it back to its current
+// capacity once the pressure is gone.  It should be called after the
+// clean block cache capacity has been set.
+func (c *ConfigLocal) EnableAdaptiveBlockCache(maxRSS uint64) {
+	// The monitor uses the config's block cache, so don't hold the
+	// lock while making it or shutting down the old one.  Shutting
+	// down the old one first restores the normal capacity, which the
+	// new one reads.
+	c.lock.Lock()
+	oldMPM := c.memoryPressureMonitor
+	c.memoryPressureMonitor = nil
+	c.lock.Unlock()
+	if oldMPM != nil {
+		oldMPM.shutdown()
+	}
+
+	mpm := newMemoryPressureMonitor(c, maxRSS, getMemoryStats)
+	mpm.start(memoryPressureCheckPeriod)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.memoryPressureMonitor = mpm
+}
+
 // RootNodeWrappers implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) RootNodeWrappers() []func(Node) Node {
 	c.lock.RLock()
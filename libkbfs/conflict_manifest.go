@@ -0,0 +1,216 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ConflictManifestName is the name of the file, in the root
+	// directory of a TLF, that lists the conflicted copies created by
+	// conflict resolution in that TLF.
+	ConflictManifestName = ".keybase_conflicts.json"
+
+	// conflictManifestMaxEntries bounds the size of the manifest;
+	// the oldest entries are dropped first.
+	conflictManifestMaxEntries = 1000
+)
+
+// ConflictedCopy describes an entry that conflict resolution renamed,
+// in order to preserve both versions of it.
+type ConflictedCopy struct {
+	// OriginalPath is the path, relative to the TLF root, of the
+	// entry that was in conflict.
+	OriginalPath string
+	// CopyPath is the path, relative to the TLF root, of the
+	// conflicted copy that holds the other version.
+	CopyPath string
+}
+
+// conflictManifestEntry is one conflicted copy in the manifest.
+type conflictManifestEntry struct {
+	Original string          `json:"original"`
+	Copy     string          `json:"copy"`
+	Revision kbfsmd.Revision `json:"revision"`
+	Time     time.Time       `json:"time"`
+}
+
+// conflictManifest is the JSON content of ConflictManifestName.
+type conflictManifest struct {
+	Conflicts []conflictManifestEntry `json:"conflicts"`
+}
+
+// tlfRelativePath returns `p` relative to the root of its TLF.
+func tlfRelativePath(p path) string {
+	names := make([]string, 0, len(p.path))
+	for _, node := range p.path[1:] {
+		names = append(names, node.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// crConflictedCopy is a conflicted copy, with the full merged paths
+// of both entries.
+type crConflictedCopy struct {
+	original path
+	copy     path
+}
+
+// conflictedCopiesFromActions returns the conflicted copies that
+// `actionMap` will create.
+func conflictedCopiesFromActions(unmergedPaths []path,
+	mergedPaths map[BlockPointer]path,
+	actionMap map[BlockPointer]crActionList) (copies []crConflictedCopy) {
+	done := make(map[BlockPointer]bool)
+	for _, unmergedPath := range unmergedPaths {
+		mergedPath, ok := mergedPaths[unmergedPath.tailPointer()]
+		if !ok || done[mergedPath.tailPointer()] {
+			continue
+		}
+		done[mergedPath.tailPointer()] = true
+
+		for _, action := range actionMap[mergedPath.tailPointer()] {
+			var fromName, toName string
+			switch a := action.(type) {
+			case *renameUnmergedAction:
+				fromName, toName = a.fromName, a.toName
+			case *renameMergedAction:
+				fromName, toName = a.fromName, a.toName
+			case *copyUnmergedEntryAction:
+				if !a.unique {
+					continue
+				}
+				fromName, toName = a.fromName, a.toName
+			default:
+				continue
+			}
+			if fromName == toName {
+				continue
+			}
+			// Never report conflicts on the manifest itself, so
+			// that concurrent manifest updates can't keep each
+			// other going.
+			if len(mergedPath.path) == 1 && fromName == ConflictManifestName {
+				continue
+			}
+
+			copies = append(copies, crConflictedCopy{
+				original: mergedPath.ChildPathNoPtr(fromName),
+				copy:     mergedPath.ChildPathNoPtr(toName),
+			})
+		}
+	}
+	return copies
+}
+
+// reportConflictedCopies lets the reporter and any observers know
+// about the conflicted copies created by a resolution that completed
+// as revision `rev`, and records them in the TLF's manifest if that's
+// enabled.
+func (cr *ConflictResolver) reportConflictedCopies(ctx context.Context,
+	crCopies []crConflictedCopy, rev kbfsmd.Revision) {
+	if len(crCopies) == 0 {
+		return
+	}
+
+	session, err := cr.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		cr.log.CDebugf(ctx, "Couldn't get session: %+v", err)
+	}
+	now := cr.config.Clock().Now()
+	copies := make([]ConflictedCopy, 0, len(crCopies))
+	entries := make([]conflictManifestEntry, 0, len(crCopies))
+	for _, c := range crCopies {
+		cr.config.Reporter().Notify(ctx, conflictedCopyNotification(
+			c.original, c.copy, session.UID, now))
+		copies = append(copies, ConflictedCopy{
+			OriginalPath: tlfRelativePath(c.original),
+			CopyPath:     tlfRelativePath(c.copy),
+		})
+		entries = append(entries, conflictManifestEntry{
+			Original: tlfRelativePath(c.original),
+			Copy:     tlfRelativePath(c.copy),
+			Revision: rev,
+			Time:     now,
+		})
+	}
+	cr.log.CDebugf(ctx, "Created %d conflicted copies: %v",
+		len(copies), copies)
+	cr.fbo.observers.conflictedCopiesCreated(ctx, copies)
+
+	if !cr.config.ConflictManifestEnabled() {
+		return
+	}
+	// Use a fresh context, since writing to the TLF cancels the
+	// current resolution's context.
+	err = cr.fbo.runUnlessShutdown(func(ctx context.Context) error {
+		return cr.appendToConflictManifest(ctx, entries)
+	})
+	if err != nil {
+		cr.log.CDebugf(ctx, "Couldn't update the conflict manifest: %+v",
+			err)
+	}
+}
+
+// appendToConflictManifest adds `entries` to the manifest in the root
+// directory of the TLF, creating it if needed, and syncs it.
+func (cr *ConflictResolver) appendToConflictManifest(
+	ctx context.Context, entries []conflictManifestEntry) error {
+	fbo := cr.fbo
+	rootNode, _, _, err := fbo.getRootNode(ctx)
+	if err != nil {
+		return err
+	}
+
+	var manifest conflictManifest
+	node, ei, err := fbo.Lookup(ctx, rootNode, ConflictManifestName)
+	switch errors.Cause(err).(type) {
+	case nil:
+		buf := make([]byte, ei.Size)
+		n, err := fbo.Read(ctx, node, buf, 0)
+		if err != nil {
+			return err
+		}
+		// Start over if someone has mangled the manifest.
+		if err := json.Unmarshal(buf[:n], &manifest); err != nil {
+			cr.log.CDebugf(ctx, "Ignoring unparseable conflict "+
+				"manifest: %+v", err)
+			manifest = conflictManifest{}
+		}
+	case NoSuchNameError:
+		node, _, err = fbo.CreateFile(
+			ctx, rootNode, ConflictManifestName, false, NoExcl)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	manifest.Conflicts = append(manifest.Conflicts, entries...)
+	if extra := len(manifest.Conflicts) - conflictManifestMaxEntries; extra > 0 {
+		manifest.Conflicts = manifest.Conflicts[extra:]
+	}
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = fbo.Truncate(ctx, node, 0)
+	if err != nil {
+		return err
+	}
+	err = fbo.Write(ctx, node, buf, 0)
+	if err != nil {
+		return err
+	}
+	return fbo.SyncAll(ctx, fbo.folderBranch)
+}
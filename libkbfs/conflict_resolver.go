@@ -16,6 +16,7 @@ import (
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/kbfssync"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -38,6 +39,11 @@ const (
 	// How long we're allowed to block writes for if we exceed the max
 	// revisions threshold.
 	crMaxWriteLockTime = 10 * time.Second
+
+	// How many resolutions, across all the TLFs of a KBFSOps
+	// instance, can run at the same time.  Forced resolutions don't
+	// wait for this limit.
+	crMaxConcurrentDefault = 2
 )
 
 // CtxCROpID is the display name for the unique operation
@@ -65,25 +71,39 @@ type ConflictResolver struct {
 	// resolveGroup tracks the outstanding resolves.
 	resolveGroup kbfssync.RepeatedWaitGroup
 
-	inputLock     sync.Mutex
-	currInput     conflictInput
-	currCancel    context.CancelFunc
-	lockNextTime  bool
-	canceledCount int
+	// limiter, if non-nil, is shared with the resolvers of other
+	// TLFs, and bounds how many resolutions run at once.
+	limiter *kbfssync.Semaphore
+	// forceChan wakes up any resolution that's waiting to start, so
+	// that it can check cr.forceNext.
+	forceChan chan struct{}
+
+	inputLock      sync.Mutex
+	currInput      conflictInput
+	currCancel     context.CancelFunc
+	lockNextTime   bool
+	canceledCount  int
+	lastLocalWrite time.Time
+	forceNext      bool
+	// numStarted counts the resolutions that have been started by
+	// processInput, and haven't finished yet.
+	numStarted int
 }
 
 // NewConflictResolver constructs a new ConflictResolver (and launches
-// any necessary background goroutines).
-func NewConflictResolver(
-	config Config, fbo *folderBranchOps) *ConflictResolver {
+// any necessary background goroutines).  If `limiter` is non-nil,
+// each resolution acquires one unit from it before starting.
+func NewConflictResolver(config Config, fbo *folderBranchOps,
+	limiter *kbfssync.Semaphore) *ConflictResolver {
 	// make a logger with an appropriate module name
 	branchSuffix := ""
 	if fbo.branch() != MasterBranch {
 		branchSuffix = " " + string(fbo.branch())
 	}
 	tlfStringFull := fbo.id().String()
-	log := config.MakeLogger(fmt.Sprintf("CR %s%s", tlfStringFull[:8],
-		branchSuffix))
+	log := newRecentLogger(config.MakeLogger(
+		fmt.Sprintf("CR %s%s", tlfStringFull[:8], branchSuffix)),
+		fbo.recentLogs)
 
 	cr := &ConflictResolver{
 		config: config,
@@ -97,13 +117,15 @@ func NewConflictResolver(
 		log:              traceLogger{log},
 		deferLog:         traceLogger{log.CloneWithAddedDepth(1)},
 		maxRevsThreshold: crMaxRevsThresholdDefault,
+		limiter:          limiter,
+		forceChan:        make(chan struct{}, 1),
 		currInput: conflictInput{
 			unmerged: kbfsmd.RevisionUninitialized,
 			merged:   kbfsmd.RevisionUninitialized,
 		},
 	}
 
-	if config.Mode() != InitMinimal {
+	if config.Mode() != InitMinimal && config.Mode() != InitReadOnly {
 		cr.startProcessing(BackgroundContextWithCancellationDelayer())
 	} else {
 		// No need to run CR if there won't be any data writes on this
@@ -159,6 +181,83 @@ func (cr *ConflictResolver) ForceCancel() {
 	}
 }
 
+// noteLocalWrite records that the TLF was just written to locally.
+// Resolutions are deferred until the TLF has been quiet for
+// Config.CRQuietPeriod().
+func (cr *ConflictResolver) noteLocalWrite() {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	cr.lastLocalWrite = cr.config.Clock().Now()
+}
+
+// noteCanceledLocked must be called while holding cr.inputLock.
+func (cr *ConflictResolver) noteCanceledLocked() {
+	cr.canceledCount++
+	// TODO: decrease threshold for pending local squashes?
+	if cr.canceledCount > cr.maxRevsThreshold {
+		cr.lockNextTime = true
+	}
+}
+
+// waitToStart blocks until the TLF has had no local writes for
+// Config.CRQuietPeriod(), skipping the wait if the next resolution
+// has been forced, or if unmerged writes need to be blocked anyway.
+// It returns whether the resolution was forced.
+func (cr *ConflictResolver) waitToStart(ctx context.Context) (
+	forced bool, err error) {
+	for {
+		quietPeriod := cr.config.CRQuietPeriod()
+		wait, forced := func() (time.Duration, bool) {
+			cr.inputLock.Lock()
+			defer cr.inputLock.Unlock()
+			if cr.forceNext {
+				cr.forceNext = false
+				return 0, true
+			}
+			if cr.lockNextTime || quietPeriod <= 0 {
+				return 0, false
+			}
+			return quietPeriod -
+				cr.config.Clock().Now().Sub(cr.lastLocalWrite), false
+		}()
+		if wait <= 0 {
+			return forced, nil
+		}
+
+		cr.log.CDebugf(ctx, "Deferring resolution for %s, due to recent "+
+			"local writes", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-cr.forceChan:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return false, ctx.Err()
+		}
+	}
+}
+
+// acquireSlot blocks until there is room under cr.limiter for another
+// resolution.  Forced resolutions take a slot immediately.  The
+// caller must call the returned function once the resolution is
+// done.
+func (cr *ConflictResolver) acquireSlot(
+	ctx context.Context, forced bool) (release func(), err error) {
+	if cr.limiter == nil {
+		return func() {}, nil
+	}
+	if forced {
+		cr.limiter.ForceAcquire(1)
+	} else {
+		_, err := cr.limiter.Acquire(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func() { cr.limiter.Release(1) }, nil
+}
+
 // processInput processes conflict resolution jobs from the given
 // channel until it is closed. This function uses a parameter for the
 // channel instead of accessing cr.inputChan directly so that it
@@ -180,6 +279,7 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 	}()
 	for ci := range inputChan {
 		ctx := CtxWithRandomIDReplayable(baseCtx, CtxCRIDKey, CtxCROpID, cr.log)
+		ctx = NewContextWithBlockFetchClass(ctx, BlockFetchBackground)
 
 		valid := func() bool {
 			cr.inputLock.Lock()
@@ -192,6 +292,7 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 				"input %v", ci, cr.currInput)
 			cr.currInput = ci
 			ctx, cr.currCancel = context.WithCancel(ctx)
+			cr.numStarted++
 			return true
 		}()
 		if !valid {
@@ -205,6 +306,11 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 		go func(ci conflictInput, done chan<- struct{}) {
 			defer cr.resolveGroup.Done()
 			defer close(done)
+			defer func() {
+				cr.inputLock.Lock()
+				defer cr.inputLock.Unlock()
+				cr.numStarted--
+			}()
 			// Wait for the previous CR without blocking any
 			// Resolve callers, as that could result in deadlock
 			// (KBFS-1001).
@@ -214,6 +320,21 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 				cr.log.CDebugf(ctx, "Resolution canceled before starting")
 				return
 			}
+			forced, err := cr.waitToStart(ctx)
+			if err != nil {
+				cr.log.CDebugf(ctx, "Resolution canceled while deferred")
+				cr.inputLock.Lock()
+				cr.noteCanceledLocked()
+				cr.inputLock.Unlock()
+				return
+			}
+			release, err := cr.acquireSlot(ctx, forced)
+			if err != nil {
+				cr.log.CDebugf(ctx, "Resolution canceled while waiting "+
+					"for other resolutions")
+				return
+			}
+			defer release()
 			cr.doResolve(ctx, ci)
 		}(ci, prevCRDone)
 	}
@@ -254,6 +375,36 @@ func (cr *ConflictResolver) Resolve(ctx context.Context,
 	cr.inputChan <- ci
 }
 
+// ForceResolveNow makes the pending resolution, or the next one to
+// be started, run right away, without waiting for local writes to
+// quiet down or for resolutions of other TLFs to finish.  If no
+// resolution has been started, it starts one for the given unmerged
+// revision.
+func (cr *ConflictResolver) ForceResolveNow(
+	ctx context.Context, unmerged kbfsmd.Revision) {
+	idle := func() bool {
+		cr.inputLock.Lock()
+		defer cr.inputLock.Unlock()
+		cr.forceNext = true
+		if cr.numStarted > 0 {
+			return false
+		}
+		// The last resolution may have given up on this same
+		// input, so make sure the new one isn't ignored.
+		cr.currInput = conflictInput{}
+		return true
+	}()
+
+	if !idle {
+		select {
+		case cr.forceChan <- struct{}{}:
+		default:
+		}
+		return
+	}
+	cr.Resolve(ctx, unmerged, kbfsmd.RevisionUninitialized)
+}
+
 // Wait blocks until the current set of submitted resolutions are
 // complete (though not necessarily successful), or until the given
 // context is canceled.
@@ -2157,7 +2308,7 @@ func (cr *ConflictResolver) fetchDirBlockCopy(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	dblock = dblock.DeepCopy()
+	dblock = dblock.copyOnWrite()
 	lbc[ptr] = dblock
 	return dblock, nil
 }
@@ -2972,6 +3123,10 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	err = validateMDForPut(cr.config.Codec(), md, mostRecentMergedMD)
+	if err != nil {
+		return err
+	}
 
 	defer func() {
 		if err != nil {
@@ -3078,13 +3233,12 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 			if err == context.Canceled {
 				cr.inputLock.Lock()
 				defer cr.inputLock.Unlock()
-				cr.canceledCount++
-				// TODO: decrease threshold for pending local squashes?
-				if cr.canceledCount > cr.maxRevsThreshold {
-					cr.lockNextTime = true
-				}
+				cr.noteCanceledLocked()
 			}
 		} else {
+			if r := cr.config.MetricsRegistry(); r != nil {
+				metrics.GetOrRegisterMeter(crResolutionsMeterName, r).Mark(1)
+			}
 			// We finished successfully, so no need to lock next time.
 			cr.inputLock.Lock()
 			defer cr.inputLock.Unlock()
@@ -3107,6 +3261,23 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		}
 	}()
 
+	// Merging text conflicts and recording conflicted copies both
+	// write to the TLF through the normal write path, which needs
+	// mdWriterLock, so they can only run once any blocking of
+	// unmerged writes below has been undone.  Use the context from
+	// before the write-lock timeout is applied.
+	var copies []crConflictedCopy
+	var textMerges []crTextMergeCandidate
+	resolvedRev := kbfsmd.RevisionUninitialized
+	postResolveCtx := ctx
+	defer func() {
+		if err != nil || resolvedRev == kbfsmd.RevisionUninitialized {
+			return
+		}
+		copies = cr.mergeTextConflicts(postResolveCtx, textMerges, copies)
+		cr.reportConflictedCopies(postResolveCtx, copies, resolvedRev)
+	}()
+
 	// Check if we need to deploy the nuclear option and completely
 	// block unmerged writes while we try to resolve.
 	doLock := func() bool {
@@ -3286,6 +3457,12 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	}
 	cr.log.CDebugf(ctx, "Executed all actions, %d updated directory blocks",
 		len(lbc))
+	copies = conflictedCopiesFromActions(unmergedPaths, mergedPaths, actionMap)
+	textMerges, err = cr.findTextMergeCandidates(ctx, lState,
+		unmergedChains, unmergedPaths, mergedPaths, actionMap)
+	if err != nil {
+		return
+	}
 
 	// Step 4: finish up by syncing all the blocks, computing and
 	// putting the final resolved MD, and issuing all the local
@@ -3296,6 +3473,8 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	if err != nil {
 		return
 	}
+	resolvedRev = cr.fbo.getCurrMDRevision(lState)
+	cr.fbo.retainUnmergedBranch(ctx, unmergedMDs, true, resolvedRev-1)
 
 	// TODO: If conflict resolution fails after some blocks were put,
 	// remember these and include them in the later resolution so they
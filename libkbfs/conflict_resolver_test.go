@@ -30,7 +30,7 @@ func crTestInit(t *testing.T) (ctx context.Context, cancel context.CancelFunc,
 	config.SetClock(wallClock{})
 	id := tlf.FakeID(1, tlf.Private)
 	fbo := newFolderBranchOps(
-		ctx, config, FolderBranch{id, MasterBranch}, standard)
+		ctx, config, FolderBranch{id, MasterBranch}, standard, nil, nil)
 	// usernames don't matter for these tests
 	config.mockKbpki.EXPECT().GetNormalizedUsername(gomock.Any(), gomock.Any()).
 		AnyTimes().Return(libkb.NormalizedUsername("mockUser"), nil)
@@ -457,6 +457,63 @@ func TestCRMergedChainsSimple(t *testing.T) {
 		mergedPaths, nil, expectedActions)
 }
 
+// Make sure that resolution is deferred while there have been recent
+// local writes, and that ForceResolveNow starts it anyway.
+func TestCRQuietPeriodAndForceResolveNow(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+	config2.SetCRQuietPeriod(time.Hour)
+
+	name := userName1.String() + "," + userName2.String()
+
+	configs := make(map[keybase1.UID]Config)
+	configs[uid1] = config1
+	configs[uid2] = config2
+	nodes := testCRSharedFolderForUsers(t, ctx, name, uid1, configs, []string{"dir"})
+	dir1 := nodes[uid1]
+	dir2 := nodes[uid2]
+	fb := dir1.GetFolderBranch()
+
+	// pause user 2
+	_, err = DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+
+	// user1 makes a file
+	_, _, err = config1.KBFSOps().CreateFile(ctx, dir1, "file1", false, NoExcl)
+	require.NoError(t, err)
+	err = config1.KBFSOps().SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	// user2 makes a file (causes a conflict, and goes unstaged)
+	_, _, err = config2.KBFSOps().CreateFile(ctx, dir2, "file2", false, NoExcl)
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The resolution waits out the quiet period")
+	cr2 := testCRGetCROrBust(t, config2, fb)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer waitCancel()
+	err = cr2.Wait(waitCtx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	lState := makeFBOLockState()
+	require.False(t, cr2.fbo.isMasterBranch(lState))
+
+	t.Log("Forcing it resolves right away")
+	err = config2.KBFSOps().ForceResolveNow(ctx, fb)
+	require.NoError(t, err)
+	err = cr2.Wait(ctx)
+	require.NoError(t, err)
+	require.True(t, cr2.fbo.isMasterBranch(lState))
+}
+
 // Same as TestCRMergedChainsSimple, but the two users make changes in
 // different, unrelated subdirectories, forcing the resolver to use
 // mostly original block pointers when constructing the merged path.
@@ -0,0 +1,161 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"net/http"
+	stdpath "path"
+	"strings"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// contentSniffLen is how much of the start of a file is used to sniff
+// its MIME type, as in http.DetectContentType.
+const contentSniffLen = 512
+
+// TlfContentPolicy restricts what can be written to a TLF.  It's
+// stored in the TLF's private metadata, can only be changed by the
+// TLF's admins (its writers, for TLFs not backed by a team), and is
+// enforced by each client as files are created, written and synced.
+type TlfContentPolicy struct {
+	// MaxFileSize, if non-zero, is the largest a file may grow to, in
+	// bytes.
+	MaxFileSize uint64 `codec:"m,omitempty"`
+	// BannedExtensions are file name extensions, like ".mp4", that
+	// new files can't have.  They're matched case-insensitively.
+	BannedExtensions []string `codec:"e,omitempty"`
+	// BannedMIMETypes are MIME types, like "video/mp4", that files
+	// can't contain, as sniffed from their first 512 bytes.  A type
+	// ending in "/*", like "video/*", matches all its subtypes.
+	BannedMIMETypes []string `codec:"t,omitempty"`
+
+	// SetBy is the user who last changed the policy.
+	SetBy keybase1.UID `codec:"s,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// deepCopy returns a copy of p, or nil if p is nil.
+func (p *TlfContentPolicy) deepCopy(codec kbfscodec.Codec) (
+	*TlfContentPolicy, error) {
+	if p == nil {
+		return nil, nil
+	}
+	var pCopy TlfContentPolicy
+	if err := kbfscodec.Update(codec, &pCopy, p); err != nil {
+		return nil, err
+	}
+	return &pCopy, nil
+}
+
+func (p *TlfContentPolicy) checkSize(filename string, size uint64) error {
+	if p == nil || p.MaxFileSize == 0 || size <= p.MaxFileSize {
+		return nil
+	}
+	return ContentPolicyError{
+		Filename: filename,
+		Reason: fmt.Sprintf("it would be larger than %d bytes",
+			p.MaxFileSize),
+	}
+}
+
+func normalizeExtension(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// nameExtension returns the lower-cased extension of `name`, with
+// its dot, or "" if it has none.
+func nameExtension(name string) string {
+	return strings.ToLower(stdpath.Ext(name))
+}
+
+func (p *TlfContentPolicy) checkName(name string) error {
+	if p == nil || len(p.BannedExtensions) == 0 {
+		return nil
+	}
+	ext := nameExtension(name)
+	if ext == "" {
+		return nil
+	}
+	for _, banned := range p.BannedExtensions {
+		if ext == normalizeExtension(banned) {
+			return ContentPolicyError{
+				Filename: name,
+				Reason:   fmt.Sprintf("%s files aren't allowed", ext),
+			}
+		}
+	}
+	return nil
+}
+
+func (p *TlfContentPolicy) sniffsContent() bool {
+	return p != nil && len(p.BannedMIMETypes) > 0
+}
+
+// checkContent checks the sniffed MIME type of a file that starts
+// with `start`.
+func (p *TlfContentPolicy) checkContent(filename string, start []byte) error {
+	if !p.sniffsContent() || len(start) == 0 {
+		return nil
+	}
+	mimeType := http.DetectContentType(start)
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	for _, banned := range p.BannedMIMETypes {
+		banned = strings.ToLower(banned)
+		match := mimeType == banned
+		if strings.HasSuffix(banned, "/*") {
+			match = strings.HasPrefix(mimeType, banned[:len(banned)-1])
+		}
+		if match {
+			return ContentPolicyError{
+				Filename: filename,
+				Reason:   fmt.Sprintf("%s content isn't allowed", mimeType),
+			}
+		}
+	}
+	return nil
+}
+
+// checkCanSetContentPolicy returns an error if the current user can't
+// change the content policy of the TLF with handle `h`.
+func checkCanSetContentPolicy(
+	ctx context.Context, config Config, h *TlfHandle) error {
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	isAdmin := false
+	if h.Type() == tlf.SingleTeam {
+		tid, err := h.FirstResolvedWriter().AsTeam()
+		if err != nil {
+			return err
+		}
+		isAdmin, err = config.KeybaseService().IsCurrentUserTeamAdmin(ctx, tid)
+		if err != nil {
+			return err
+		}
+	} else {
+		isAdmin, err = isWriterFromHandle(
+			ctx, h, config.KBPKI(), session.UID, session.VerifyingKey)
+		if err != nil {
+			return err
+		}
+	}
+	if !isAdmin {
+		return ContentPolicyAdminError{
+			User: session.Name,
+			Tlf:  h.GetCanonicalPath(),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTlfContentPolicyChecks(t *testing.T) {
+	var nilPolicy *TlfContentPolicy
+	require.NoError(t, nilPolicy.checkName("a.mp4"))
+	require.NoError(t, nilPolicy.checkSize("a", 1<<40))
+	require.NoError(t, nilPolicy.checkContent("a", []byte("GIF89a")))
+
+	p := &TlfContentPolicy{
+		MaxFileSize:      10,
+		BannedExtensions: []string{".MP4", "mov"},
+		BannedMIMETypes:  []string{"image/*", "application/pdf"},
+	}
+
+	t.Log("Extensions are matched without regard to case or dots")
+	require.IsType(t, ContentPolicyError{}, p.checkName("a.mp4"))
+	require.IsType(t, ContentPolicyError{}, p.checkName("a.MOV"))
+	require.NoError(t, p.checkName("a.mp3"))
+	require.NoError(t, p.checkName("mp4"))
+
+	t.Log("Sizes up to the limit are fine")
+	require.NoError(t, p.checkSize("a", 10))
+	require.IsType(t, ContentPolicyError{}, p.checkSize("a", 11))
+
+	t.Log("MIME types are sniffed, and can be wildcarded")
+	require.IsType(t, ContentPolicyError{},
+		p.checkContent("a", []byte("GIF89a...")))
+	require.IsType(t, ContentPolicyError{},
+		p.checkContent("a", []byte("%PDF-1.4")))
+	require.NoError(t, p.checkContent("a", []byte("hello world")))
+}
+
+func TestKBFSOpsContentPolicy(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+
+	policy, err := kbfsOps.GetContentPolicy(ctx, fb)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	err = kbfsOps.SetContentPolicy(ctx, fb, &TlfContentPolicy{
+		MaxFileSize:      100,
+		BannedExtensions: []string{".mp4"},
+		BannedMIMETypes:  []string{"image/*"},
+	})
+	require.NoError(t, err)
+	policy, err = kbfsOps.GetContentPolicy(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), policy.MaxFileSize)
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	require.Equal(t, session.UID, policy.SetBy)
+
+	t.Log("Banned extensions can't be created or renamed to")
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a.mp4", false, NoExcl)
+	require.IsType(t, ContentPolicyError{}, errors.Cause(err))
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "a.mp4")
+	require.IsType(t, ContentPolicyError{}, errors.Cause(err))
+
+	t.Log("Files can't grow past the maximum size")
+	err = kbfsOps.Write(ctx, fileNode, make([]byte, 101), 0)
+	require.IsType(t, ContentPolicyError{}, errors.Cause(err))
+	err = kbfsOps.Truncate(ctx, fileNode, 101)
+	require.IsType(t, ContentPolicyError{}, errors.Cause(err))
+
+	t.Log("Banned types can't be synced")
+	err = kbfsOps.Write(ctx, fileNode, []byte("GIF89a"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, ContentPolicyError{}, errors.Cause(err))
+
+	t.Log("Removing the file drops the banned data")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Removing the policy lifts the restrictions")
+	err = kbfsOps.SetContentPolicy(ctx, fb, nil)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a.mp4", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+}
@@ -179,7 +179,7 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 			entry.Size = unmergedEntry.Size
 			entry.EncodedSize = unmergedEntry.EncodedSize
 			entry.BlockPointer = unmergedEntry.BlockPointer
-			mergedBlock.Children[cuea.toName] = entry
+			mergedBlock.setChild(cuea.toName, entry)
 			return nil
 		}
 		// copy any attrs that were explicitly set on the unmerged
@@ -190,11 +190,13 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+				unmergedEntry.Atime = cuea.unmergedEntry.Atime
+				unmergedEntry.Btime = cuea.unmergedEntry.Btime
 			}
 		}
 	}
 
-	mergedBlock.Children[cuea.toName] = unmergedEntry
+	mergedBlock.setChild(cuea.toName, unmergedEntry)
 	return nil
 }
 
@@ -410,13 +412,15 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Type = unmergedEntry.Type
 		case mtimeAttr:
 			mergedEntry.Mtime = unmergedEntry.Mtime
+			mergedEntry.Atime = unmergedEntry.Atime
+			mergedEntry.Btime = unmergedEntry.Btime
 		case sizeAttr:
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
 			mergedEntry.BlockPointer = unmergedEntry.BlockPointer
 		}
 	}
-	mergedBlock.Children[cuaa.toName] = mergedEntry
+	mergedBlock.setChild(cuaa.toName, mergedEntry)
 
 	return nil
 }
@@ -463,7 +467,7 @@ func (rmea *rmMergedEntryAction) swapUnmergedBlock(
 func (rmea *rmMergedEntryAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
-	delete(mergedBlock.Children, rmea.name)
+	mergedBlock.removeChild(rmea.name)
 	return nil
 }
 
@@ -536,7 +540,7 @@ func crActionCopyFile(ctx context.Context, copier fileBlockDeepCopier,
 	// Set the entry with the new pointer.
 	oldPointer := fromEntry.BlockPointer
 	fromEntry.BlockPointer = ptr
-	toBlock.Children[name] = fromEntry
+	toBlock.setChild(name, fromEntry)
 	return oldPointer, name, nil
 }
 
@@ -745,7 +749,7 @@ func (rma *renameMergedAction) do(ctx context.Context,
 	}
 	rma.toName = newName
 
-	mergedBlock.Children[rma.toName] = mergedEntry
+	mergedBlock.setChild(rma.toName, mergedEntry)
 
 	// Add the unmerged entry as the new "fromName".
 	unmergedEntry, ok := unmergedBlock.Children[rma.fromName]
@@ -756,7 +760,7 @@ func (rma *renameMergedAction) do(ctx context.Context,
 		unmergedEntry.Type = Sym
 		unmergedEntry.SymPath = rma.symPath
 	}
-	mergedBlock.Children[rma.fromName] = unmergedEntry
+	mergedBlock.setChild(rma.fromName, unmergedEntry)
 
 	return nil
 }
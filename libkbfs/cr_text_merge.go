@@ -0,0 +1,373 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	stdpath "path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// crTextMergeMaxSizeDefault is the default for the largest file
+	// that conflict resolution will try to merge as text.
+	crTextMergeMaxSizeDefault = 128 * 1024
+	// crTextMergeMaxCells bounds the size of the table used to diff
+	// two versions of a file, i.e. the product of their line counts.
+	crTextMergeMaxCells = 1 << 22
+)
+
+// looksLikeText returns whether `data` is UTF-8 without any NULs.
+func looksLikeText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// appliesTo returns whether the policy allows merging a file with the
+// given name and versions.
+func (p CRTextMergePolicy) appliesTo(name string, versions ...[]byte) bool {
+	if !p.Enabled {
+		return false
+	}
+	for _, v := range versions {
+		if int64(len(v)) > p.MaxSize {
+			return false
+		}
+	}
+	for _, glob := range p.Globs {
+		if ok, _ := stdpath.Match(glob, name); ok {
+			return true
+		}
+	}
+	for _, v := range versions {
+		if !looksLikeText(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLines splits `data` into lines, keeping the line endings so
+// that a missing newline at the end survives a merge.
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchLines computes a longest common subsequence of `a` and `b`,
+// and returns, for each line of `a`, the index of the line of `b` it
+// is matched with, or -1.  It returns false if the inputs are too big
+// to diff.
+func matchLines(a, b []string) ([]int, bool) {
+	n, m := len(a), len(b)
+	if (n+1)*(m+1) > crTextMergeMaxCells {
+		return nil, false
+	}
+	// lcs[i*(m+1)+j] is the LCS length of a[i:] and b[j:].
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+			default:
+				lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+			}
+		}
+	}
+
+	match := make([]int, n)
+	for i := range match {
+		match[i] = -1
+	}
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[i] == b[j]:
+			match[i] = j
+			i++
+			j++
+		case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return match, true
+}
+
+func linesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeTextLines does a three-way merge, line by line, of two
+// versions of a file, `ours` and `theirs`, that were both changed
+// from `base`.  It returns false if both versions changed the same
+// region of `base` in different ways.  The one exception is when
+// both versions only appended to the end of `base`: then both
+// additions are kept, ours first, which is the right thing for
+// append-only files like logs.
+func mergeTextLines(base, ours, theirs []byte) ([]byte, bool) {
+	o, a, b := splitLines(base), splitLines(ours), splitLines(theirs)
+	matchA, ok := matchLines(o, a)
+	if !ok {
+		return nil, false
+	}
+	matchB, ok := matchLines(o, b)
+	if !ok {
+		return nil, false
+	}
+
+	var merged []string
+	// mergeChunk merges the regions of the three versions between
+	// the current positions and the given ends.
+	mergeChunk := func(oi, ai, bi, oEnd, aEnd, bEnd int) bool {
+		oc, ac, bc := o[oi:oEnd], a[ai:aEnd], b[bi:bEnd]
+		switch {
+		case linesEqual(oc, ac):
+			merged = append(merged, bc...)
+		case linesEqual(oc, bc), linesEqual(ac, bc):
+			merged = append(merged, ac...)
+		case len(oc) == 0 && oEnd == len(o):
+			merged = append(merged, ac...)
+			merged = append(merged, bc...)
+		default:
+			return false
+		}
+		return true
+	}
+
+	oi, ai, bi := 0, 0, 0
+	for {
+		// Copy over any lines that are unchanged in both versions.
+		for oi < len(o) && matchA[oi] == ai && matchB[oi] == bi {
+			merged = append(merged, o[oi])
+			oi++
+			ai++
+			bi++
+		}
+
+		// Find the next base line that survives in both versions,
+		// and merge everything before it.
+		next := oi
+		for next < len(o) && (matchA[next] < 0 || matchB[next] < 0) {
+			next++
+		}
+		if next == len(o) {
+			if !mergeChunk(oi, ai, bi, len(o), len(a), len(b)) {
+				return nil, false
+			}
+			break
+		}
+		if !mergeChunk(oi, ai, bi, next, matchA[next], matchB[next]) {
+			return nil, false
+		}
+		oi, ai, bi = next, matchA[next], matchB[next]
+	}
+	return []byte(strings.Join(merged, "")), true
+}
+
+// crTextMergeCandidate is a conflicting write to a file that might
+// be mergeable as text, once the resolution completes.
+type crTextMergeCandidate struct {
+	// copy is the conflicted copy (the unmerged version), and its
+	// original (the merged version).
+	copy crConflictedCopy
+	// base is the contents of the file at the branch point.
+	base []byte
+}
+
+// findTextMergeCandidates returns the file write conflicts in
+// `actionMap` that the text merge policy might apply to, along with
+// the contents of each file at the branch point, which won't be easy
+// to get at after the resolution.
+func (cr *ConflictResolver) findTextMergeCandidates(ctx context.Context,
+	lState *lockState, unmergedChains *crChains, unmergedPaths []path,
+	mergedPaths map[BlockPointer]path,
+	actionMap map[BlockPointer]crActionList) (
+	candidates []crTextMergeCandidate, err error) {
+	policy := cr.config.CRTextMergePolicy()
+	if !policy.Enabled {
+		return nil, nil
+	}
+
+	for _, unmergedPath := range unmergedPaths {
+		chain, ok := unmergedChains.byMostRecent[unmergedPath.tailPointer()]
+		if !ok || !chain.isFile() {
+			continue
+		}
+		hasSync := false
+		for _, op := range chain.ops {
+			if _, ok := op.(*syncOp); ok {
+				hasSync = true
+				break
+			}
+		}
+		if !hasSync {
+			continue
+		}
+		// For files, this is the merged path of the parent.
+		mergedPath, ok := mergedPaths[unmergedPath.tailPointer()]
+		if !ok {
+			continue
+		}
+
+		for _, action := range actionMap[mergedPath.tailPointer()] {
+			rua, ok := action.(*renameUnmergedAction)
+			if !ok || rua.fromName != unmergedPath.tailName() ||
+				rua.fromName == rua.toName || rua.symPath != "" ||
+				!rua.unmergedParentMostRecent.IsValid() {
+				continue
+			}
+
+			// Read one more byte than allowed, to detect big files.
+			buf := make([]byte, policy.MaxSize+1)
+			basePath := mergedPath.ChildPath(rua.fromName, chain.original)
+			n, err := cr.fbo.blocks.ReadPath(ctx, lState,
+				unmergedChains.mostRecentChainMDInfo.kmd, basePath, buf, 0)
+			if err != nil {
+				return nil, err
+			}
+			if n > policy.MaxSize {
+				continue
+			}
+			candidates = append(candidates, crTextMergeCandidate{
+				copy: crConflictedCopy{
+					original: mergedPath.ChildPathNoPtr(rua.fromName),
+					copy:     mergedPath.ChildPathNoPtr(rua.toName),
+				},
+				base: buf[:n],
+			})
+		}
+	}
+	return candidates, nil
+}
+
+// readForTextMerge reads the file `name` in `dir`, unless it's bigger
+// than `maxSize`.
+func (cr *ConflictResolver) readForTextMerge(ctx context.Context,
+	dir Node, name string, maxSize int64) (Node, []byte, bool, error) {
+	node, ei, err := cr.fbo.Lookup(ctx, dir, name)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if ei.Type != File && ei.Type != Exec {
+		return nil, nil, false, nil
+	}
+	if int64(ei.Size) > maxSize {
+		return nil, nil, false, nil
+	}
+	buf := make([]byte, ei.Size)
+	n, err := cr.fbo.Read(ctx, node, buf, 0)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return node, buf[:n], true, nil
+}
+
+// mergeTextConflicts tries to merge each of the `candidates`, which
+// have just been resolved into conflicted copies, back into a single
+// file, and removes the conflicted copy when that works.  It returns
+// the conflicted copies from `copies` that are left.  The merges are
+// made as a normal write after the resolution, once it has stopped
+// blocking unmerged writes, so other devices may briefly see the
+// conflicted copies.
+func (cr *ConflictResolver) mergeTextConflicts(ctx context.Context,
+	candidates []crTextMergeCandidate,
+	copies []crConflictedCopy) []crConflictedCopy {
+	if len(candidates) == 0 {
+		return copies
+	}
+	policy := cr.config.CRTextMergePolicy()
+	fbo := cr.fbo
+
+	mergedCopies := make(map[string]bool)
+	// Use a fresh context, since writing to the TLF cancels the
+	// current resolution's context.
+	err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+		rootNode, _, _, err := fbo.getRootNode(ctx)
+		if err != nil {
+			return err
+		}
+		for _, c := range candidates {
+			dir := rootNode
+			for _, pn := range c.copy.original.parentPath().path[1:] {
+				dir, _, err = fbo.Lookup(ctx, dir, pn.Name)
+				if err != nil {
+					return err
+				}
+			}
+
+			origNode, ours, ok, err := cr.readForTextMerge(
+				ctx, dir, c.copy.original.tailName(), policy.MaxSize)
+			if err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			_, theirs, ok, err := cr.readForTextMerge(
+				ctx, dir, c.copy.copy.tailName(), policy.MaxSize)
+			if err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			if !policy.appliesTo(
+				c.copy.original.tailName(), c.base, ours, theirs) {
+				continue
+			}
+
+			merged, ok := mergeTextLines(c.base, ours, theirs)
+			if !ok {
+				cr.log.CDebugf(ctx, "Couldn't merge %s and %s as text",
+					c.copy.original, c.copy.copy)
+				continue
+			}
+			cr.log.CDebugf(ctx, "Merged %s into %s as text",
+				c.copy.copy, c.copy.original)
+			err = fbo.Truncate(ctx, origNode, 0)
+			if err != nil {
+				return err
+			}
+			err = fbo.Write(ctx, origNode, merged, 0)
+			if err != nil {
+				return err
+			}
+			err = fbo.RemoveEntry(ctx, dir, c.copy.copy.tailName())
+			if err != nil {
+				return err
+			}
+			mergedCopies[c.copy.copy.String()] = true
+		}
+		return fbo.SyncAll(ctx, fbo.folderBranch)
+	})
+	if err != nil {
+		// Whatever didn't get synced will be retried by the
+		// background flusher, or remain a conflicted copy.
+		cr.log.CDebugf(ctx, "Couldn't merge text conflicts: %+v", err)
+	}
+
+	remaining := make([]crConflictedCopy, 0, len(copies))
+	for _, c := range copies {
+		if !mergedCopies[c.copy.String()] {
+			remaining = append(remaining, c)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeTextLines(t *testing.T) {
+	base := "a\nb\nc\nd\n"
+	for _, tc := range []struct {
+		desc, ours, theirs, merged string
+		ok                         bool
+	}{
+		{"no changes", base, base, base, true},
+		{"only ours", "a\nB\nc\nd\n", base, "a\nB\nc\nd\n", true},
+		{"only theirs", base, "a\nb\nc\n", "a\nb\nc\n", true},
+		{"same change", "a\nB\nc\nd\n", "a\nB\nc\nd\n", "a\nB\nc\nd\n",
+			true},
+		{"separate changes", "A\nb\nc\nd\n", "a\nb\nc\nD\n",
+			"A\nb\nc\nD\n", true},
+		{"insert and delete", "a\nb\nx\nc\nd\n", "b\nc\nd\n",
+			"b\nx\nc\nd\n", true},
+		{"both append", base + "e\n", base + "f\n", base + "e\nf\n", true},
+		{"append without newline", base + "e", base + "f\n",
+			base + "ef\n", true},
+		{"overlapping changes", "a\nX\nc\nd\n", "a\nY\nc\nd\n", "", false},
+		{"both insert in the middle", "a\nb\nx\nc\nd\n",
+			"a\nb\ny\nc\nd\n", "", false},
+	} {
+		merged, ok := mergeTextLines(
+			[]byte(base), []byte(tc.ours), []byte(tc.theirs))
+		require.Equal(t, tc.ok, ok, tc.desc)
+		if ok {
+			require.Equal(t, tc.merged, string(merged), tc.desc)
+		}
+	}
+}
+
+func TestCRTextMergePolicyAppliesTo(t *testing.T) {
+	p := CRTextMergePolicy{Enabled: true, MaxSize: 10, Globs: []string{"*.bin"}}
+	require.True(t, p.appliesTo("x.txt", []byte("abc"), []byte("abcd")))
+	require.False(t, p.appliesTo("x.txt", []byte("abc"), []byte{0, 1}))
+	require.True(t, p.appliesTo("x.bin", []byte("abc"), []byte{0, 1}))
+	require.False(t, p.appliesTo("x.txt", []byte("abcdefghijk")))
+	p.Enabled = false
+	require.False(t, p.appliesTo("x.txt", []byte("abc")))
+}
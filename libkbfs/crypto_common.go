@@ -8,6 +8,8 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"math/bits"
+	"sync"
 
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -146,11 +148,52 @@ func powerOfTwoEqualOrGreater(n int) int {
 
 const padPrefixSize = 4
 
-// padBlock adds zero padding to an encoded block.
+// maxPooledPaddedBlockShift is the log2 of the biggest padded block
+// size (not counting the prefix) whose buffers are pooled.  Bigger
+// blocks are rare, and not worth keeping around.
+const maxPooledPaddedBlockShift = 22
+
+// paddedBlockPools holds spare padded block buffers, indexed by the
+// log2 of their size (not counting the prefix), so that readying a
+// block doesn't have to allocate a fresh one every time.  Every
+// buffer in a pool is all zeroes, so no plaintext lingers in them.
+var paddedBlockPools [maxPooledPaddedBlockShift + 1]sync.Pool
+
+func getPaddedBlockBuf(totalLen int) []byte {
+	shift := uint(bits.TrailingZeros(uint(totalLen)))
+	if shift <= maxPooledPaddedBlockShift {
+		if bufPtr, ok := paddedBlockPools[shift].Get().(*[]byte); ok {
+			return *bufPtr
+		}
+	}
+	return make([]byte, padPrefixSize+totalLen)
+}
+
+// releasePaddedBlock zeroes a buffer returned by padBlock, and makes
+// it available to later padBlock calls.  The caller must not use it
+// afterwards.
+func releasePaddedBlock(buf []byte) {
+	totalLen := len(buf) - padPrefixSize
+	if totalLen <= 0 || totalLen&(totalLen-1) != 0 {
+		return
+	}
+	shift := uint(bits.TrailingZeros(uint(totalLen)))
+	if shift > maxPooledPaddedBlockShift {
+		return
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	paddedBlockPools[shift].Put(&buf)
+}
+
+// padBlock adds zero padding to an encoded block.  The returned
+// buffer may be passed to releasePaddedBlock once it's no longer
+// needed.
 func (c CryptoCommon) padBlock(block []byte) ([]byte, error) {
 	totalLen := powerOfTwoEqualOrGreater(len(block))
 
-	buf := make([]byte, padPrefixSize+totalLen)
+	buf := getPaddedBlockBuf(totalLen)
 	binary.LittleEndian.PutUint32(buf, uint32(len(block)))
 
 	copy(buf[padPrefixSize:], block)
@@ -178,7 +221,8 @@ func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
 }
 
 // EncryptBlock implements the Crypto interface for CryptoCommon.
-func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
+func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+	encVer kbfscrypto.EncryptionVer) (
 	plainSize int, encryptedBlock kbfscrypto.EncryptedBlock, err error) {
 	encodedBlock, err := c.codec.Encode(block)
 	if err != nil {
@@ -189,9 +233,12 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 	if err != nil {
 		return -1, kbfscrypto.EncryptedBlock{}, err
 	}
+	// The encrypted block is sealed into a new buffer, so the padded
+	// one can be reused right away.
+	defer releasePaddedBlock(paddedBlock)
 
 	encryptedBlock, err =
-		kbfscrypto.EncryptPaddedEncodedBlock(paddedBlock, key)
+		kbfscrypto.EncryptPaddedEncodedBlock(paddedBlock, key, encVer)
 	if err != nil {
 		return -1, kbfscrypto.EncryptedBlock{}, err
 	}
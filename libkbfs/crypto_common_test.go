@@ -93,7 +93,8 @@ func TestCryptoCommonEncryptDecryptBlock(t *testing.T) {
 	block := TestBlock{42}
 	key := kbfscrypto.BlockCryptKey{}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, key)
+	_, encryptedBlock, err := c.EncryptBlock(
+		&block, key, kbfscrypto.EncryptionSecretbox)
 	require.NoError(t, err)
 
 	var decryptedBlock TestBlock
@@ -199,7 +200,8 @@ func TestEncryptBlock(t *testing.T) {
 	expectedEncodedBlock, err := c.codec.Encode(block)
 	require.NoError(t, err)
 
-	plainSize, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	plainSize, encryptedBlock, err := c.EncryptBlock(
+		&block, cryptKey, kbfscrypto.EncryptionSecretbox)
 	require.NoError(t, err)
 	require.Equal(t, len(expectedEncodedBlock), plainSize)
 
@@ -217,7 +219,8 @@ func TestDecryptEncryptedBlock(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(
+		&block, cryptKey, kbfscrypto.EncryptionSecretbox)
 	require.NoError(t, err)
 
 	var decryptedBlock TestBlock
@@ -278,6 +281,42 @@ func TestBlockDepadding(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// Tests that padded blocks released back to the pool come back
+// zeroed, and still depad correctly when reused.
+func TestBlockPaddingReuse(t *testing.T) {
+	var c CryptoCommon
+	f := func(b, b2 []byte) bool {
+		padded, err := c.padBlock(b)
+		if err != nil {
+			t.Logf("padBlock err: %s", err)
+			return false
+		}
+		releasePaddedBlock(padded)
+
+		padded, err = c.padBlock(b2)
+		if err != nil {
+			t.Logf("padBlock err: %s", err)
+			return false
+		}
+		defer releasePaddedBlock(padded)
+		for _, x := range padded[padPrefixSize+len(b2):] {
+			if x != 0 {
+				t.Logf("padBlock padding not zeroed")
+				return false
+			}
+		}
+		depadded, err := c.depadBlock(padded)
+		if err != nil {
+			t.Logf("depadBlock err: %s", err)
+			return false
+		}
+		return bytes.Equal(b2, depadded)
+	}
+
+	err := quick.Check(f, nil)
+	require.NoError(t, err)
+}
+
 // Test padding of blocks results in blocks at least 2^8.
 func TestBlockPadMinimum(t *testing.T) {
 	var c CryptoCommon
@@ -314,7 +353,8 @@ func TestSecretboxEncryptedLen(t *testing.T) {
 		var enclen int
 		for j := 0; j < iterations; j++ {
 			data := randomData[j : j+i]
-			enc, err := kbfscrypto.EncryptPaddedEncodedBlock(data, cryptKeys[j])
+			enc, err := kbfscrypto.EncryptPaddedEncodedBlock(
+				data, cryptKeys[j], kbfscrypto.EncryptionSecretbox)
 			require.NoError(t, err)
 			if j == 0 {
 				enclen = len(enc.EncryptedData)
@@ -368,7 +408,8 @@ func TestBlockEncryptedLen(t *testing.T) {
 	var expectedLen int
 	for i := 1025; i < 2000; i++ {
 		data := randomData[:i]
-		_, encBlock, err := c.EncryptBlock(&data, cryptKey)
+		_, encBlock, err := c.EncryptBlock(
+			&data, cryptKey, kbfscrypto.EncryptionSecretbox)
 		require.NoError(t, err)
 
 		if expectedLen == 0 {
@@ -395,7 +436,7 @@ func benchmarkEncryptBlock(b *testing.B, blockSize int) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		c.EncryptBlock(&block, key)
+		c.EncryptBlock(&block, key, kbfscrypto.EncryptionSecretbox)
 	}
 }
 
@@ -0,0 +1,229 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/base64"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ExternalDeviceKeys is implemented by key stores that keep a
+// device's private keys outside of KBFS's memory, such as an HSM, a
+// TPM, or an OS keychain.  KBFS never sees the private keys; it only
+// asks the store to sign messages and to open nacl/boxes with them.
+// These calls may be slow (e.g., if the user has to touch a hardware
+// token), so implementations should return early if their context
+// is canceled.
+type ExternalDeviceKeys interface {
+	// SigningPublicKey returns the public half of the device's
+	// ed25519 signing key.
+	SigningPublicKey() keybase1.ED25519PublicKey
+	// SignED25519 signs msg, exactly as given, with the device's
+	// ed25519 signing key.
+	SignED25519(ctx context.Context, msg []byte) (
+		keybase1.ED25519Signature, error)
+	// CryptPublicKey returns the public half of the device's crypt
+	// key.
+	CryptPublicKey() kbfscrypto.CryptPublicKey
+	// OpenBox opens a nacl/box that was sealed for the device's
+	// crypt key by the owner of peersPublicKey.
+	OpenBox(ctx context.Context, sealed []byte, nonce [24]byte,
+		peersPublicKey [32]byte) ([]byte, error)
+}
+
+// defaultExternalKeysParallelism is the default maximum number of
+// operations outstanding on an ExternalDeviceKeys at once.
+const defaultExternalKeysParallelism = 4
+
+// externalCryptoClient implements keybase1.CryptoInterface on top of
+// an ExternalDeviceKeys, so that CryptoClient can take care of
+// converting to and from KBFS types.
+type externalCryptoClient struct {
+	keys ExternalDeviceKeys
+	// sem bounds the number of outstanding operations on keys.
+	sem chan struct{}
+}
+
+var _ keybase1.CryptoInterface = externalCryptoClient{}
+
+// NewCryptoExternal constructs a Crypto that delegates everything
+// needing the device's private keys to the given ExternalDeviceKeys.
+// At most `parallelism` operations are sent to `keys` at once (or
+// defaultExternalKeysParallelism, if it's not positive).  Each one
+// runs in the background, so callers whose contexts are canceled
+// don't have to wait for slow hardware to finish.
+func NewCryptoExternal(codec kbfscodec.Codec, keys ExternalDeviceKeys,
+	parallelism int, log logger.Logger) *CryptoClient {
+	if parallelism <= 0 {
+		parallelism = defaultExternalKeysParallelism
+	}
+	client := externalCryptoClient{
+		keys: keys,
+		sem:  make(chan struct{}, parallelism),
+	}
+	return NewCryptoClient(codec, client, log)
+}
+
+// do runs fn in the background, once there's room for another
+// outstanding operation, and waits for it to finish or for ctx to be
+// canceled.  If ctx is canceled first, fn keeps running but its
+// results are ignored, so fn must only assign to variables that the
+// caller reads after a nil error.
+func (e externalCryptoClient) do(
+	ctx context.Context, fn func(context.Context) error) error {
+	select {
+	case e.sem <- struct{}{}:
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() { <-e.sem }()
+		errCh <- fn(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (e externalCryptoClient) sign(ctx context.Context, msg []byte) (
+	keybase1.ED25519Signature, error) {
+	var sig keybase1.ED25519Signature
+	err := e.do(ctx, func(ctx context.Context) (err error) {
+		sig, err = e.keys.SignED25519(ctx, msg)
+		return err
+	})
+	if err != nil {
+		return keybase1.ED25519Signature{}, err
+	}
+	return sig, nil
+}
+
+// SignED25519 implements the keybase1.CryptoInterface interface for
+// externalCryptoClient.
+func (e externalCryptoClient) SignED25519(
+	ctx context.Context, arg keybase1.SignED25519Arg) (
+	keybase1.ED25519SignatureInfo, error) {
+	sig, err := e.sign(ctx, arg.Msg)
+	if err != nil {
+		return keybase1.ED25519SignatureInfo{}, err
+	}
+	return keybase1.ED25519SignatureInfo{
+		Sig:       sig,
+		PublicKey: e.keys.SigningPublicKey(),
+	}, nil
+}
+
+// SignED25519ForKBFS implements the keybase1.CryptoInterface
+// interface for externalCryptoClient.
+func (e externalCryptoClient) SignED25519ForKBFS(
+	ctx context.Context, arg keybase1.SignED25519ForKBFSArg) (
+	keybase1.ED25519SignatureInfo, error) {
+	sig, err := e.sign(ctx, libkb.SignaturePrefixKBFS.Prefix(arg.Msg))
+	if err != nil {
+		return keybase1.ED25519SignatureInfo{}, err
+	}
+	return keybase1.ED25519SignatureInfo{
+		Sig:       sig,
+		PublicKey: e.keys.SigningPublicKey(),
+	}, nil
+}
+
+// SignToString implements the keybase1.CryptoInterface interface for
+// externalCryptoClient.  It produces the same encoding as
+// libkb.NaclSigningKeyPair.SignToString.
+func (e externalCryptoClient) SignToString(
+	ctx context.Context, arg keybase1.SignToStringArg) (string, error) {
+	sig, err := e.sign(ctx, arg.Msg)
+	if err != nil {
+		return "", err
+	}
+	sigInfo := libkb.NaclSigInfo{
+		Kid: libkb.NaclSigningKeyPublic(
+			e.keys.SigningPublicKey()).GetBinaryKID(),
+		Payload:  arg.Msg,
+		Sig:      libkb.NaclSignature(sig),
+		SigType:  libkb.SigKbEddsa,
+		HashType: libkb.HashPGPSha512,
+		Detached: true,
+	}
+	packet, err := sigInfo.ToPacket()
+	if err != nil {
+		return "", err
+	}
+	body, err := packet.Encode()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(body), nil
+}
+
+func (e externalCryptoClient) unbox(ctx context.Context,
+	encrypted keybase1.EncryptedBytes32, nonce keybase1.BoxNonce,
+	peersPublicKey keybase1.BoxPublicKey) (keybase1.Bytes32, error) {
+	var decrypted []byte
+	err := e.do(ctx, func(ctx context.Context) (err error) {
+		decrypted, err = e.keys.OpenBox(
+			ctx, encrypted[:], nonce, peersPublicKey)
+		return err
+	})
+	if err != nil {
+		return keybase1.Bytes32{}, err
+	}
+	var res keybase1.Bytes32
+	if len(decrypted) != len(res) {
+		return keybase1.Bytes32{}, errors.WithStack(libkb.DecryptionError{})
+	}
+	copy(res[:], decrypted)
+	return res, nil
+}
+
+// UnboxBytes32 implements the keybase1.CryptoInterface interface for
+// externalCryptoClient.
+func (e externalCryptoClient) UnboxBytes32(
+	ctx context.Context, arg keybase1.UnboxBytes32Arg) (
+	keybase1.Bytes32, error) {
+	return e.unbox(ctx, arg.EncryptedBytes32, arg.Nonce, arg.PeersPublicKey)
+}
+
+// UnboxBytes32Any implements the keybase1.CryptoInterface interface
+// for externalCryptoClient.  Only bundles for the device's own crypt
+// key are tried; external keys can't prompt for paper keys.
+func (e externalCryptoClient) UnboxBytes32Any(
+	ctx context.Context, arg keybase1.UnboxBytes32AnyArg) (
+	keybase1.UnboxAnyRes, error) {
+	kid := e.keys.CryptPublicKey().KID()
+	for i, bundle := range arg.Bundles {
+		if !bundle.Kid.Equal(kid) {
+			continue
+		}
+		plaintext, err := e.unbox(
+			ctx, bundle.Ciphertext, bundle.Nonce, bundle.PublicKey)
+		if err != nil {
+			if _, ok := errors.Cause(err).(libkb.DecryptionError); ok {
+				continue
+			}
+			return keybase1.UnboxAnyRes{}, err
+		}
+		return keybase1.UnboxAnyRes{
+			Kid:       bundle.Kid,
+			Plaintext: plaintext,
+			Index:     i,
+		}, nil
+	}
+	return keybase1.UnboxAnyRes{}, errors.WithStack(libkb.DecryptionError{})
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/context"
+)
+
+// testExternalDeviceKeys is an in-memory ExternalDeviceKeys.  If
+// block is non-nil, each operation waits for it to be closed first,
+// ignoring its context like unresponsive hardware might.
+type testExternalDeviceKeys struct {
+	signingKP libkb.NaclSigningKeyPair
+	cryptKP   libkb.NaclDHKeyPair
+	block     chan struct{}
+	started   chan struct{}
+}
+
+var _ ExternalDeviceKeys = (*testExternalDeviceKeys)(nil)
+
+func newTestExternalDeviceKeys(t *testing.T) *testExternalDeviceKeys {
+	signingKP, err := libkb.GenerateNaclSigningKeyPair()
+	require.NoError(t, err)
+	cryptKP, err := libkb.GenerateNaclDHKeyPair()
+	require.NoError(t, err)
+	return &testExternalDeviceKeys{
+		signingKP: signingKP,
+		cryptKP:   cryptKP,
+		started:   make(chan struct{}, 100),
+	}
+}
+
+func (k *testExternalDeviceKeys) wait() {
+	k.started <- struct{}{}
+	if k.block != nil {
+		<-k.block
+	}
+}
+
+func (k *testExternalDeviceKeys) SigningPublicKey() keybase1.ED25519PublicKey {
+	return keybase1.ED25519PublicKey(k.signingKP.Public)
+}
+
+func (k *testExternalDeviceKeys) SignED25519(
+	ctx context.Context, msg []byte) (keybase1.ED25519Signature, error) {
+	k.wait()
+	return keybase1.ED25519Signature(*k.signingKP.Private.Sign(msg)), nil
+}
+
+func (k *testExternalDeviceKeys) CryptPublicKey() kbfscrypto.CryptPublicKey {
+	return kbfscrypto.MakeCryptPublicKey(k.cryptKP.Public.GetKID())
+}
+
+func (k *testExternalDeviceKeys) OpenBox(ctx context.Context,
+	sealed []byte, nonce [24]byte, peersPublicKey [32]byte) (
+	[]byte, error) {
+	k.wait()
+	privateKey := [32]byte(*k.cryptKP.Private)
+	opened, ok := box.Open(nil, sealed, &nonce, &peersPublicKey, &privateKey)
+	if !ok {
+		return nil, libkb.DecryptionError{}
+	}
+	return opened, nil
+}
+
+func TestCryptoExternalSign(t *testing.T) {
+	keys := newTestExternalDeviceKeys(t)
+	c := NewCryptoExternal(
+		kbfscodec.NewMsgpack(), keys, 0, logger.NewTestLogger(t))
+	ctx := context.Background()
+	msg := []byte("message")
+
+	sigInfo, err := c.Sign(ctx, msg)
+	require.NoError(t, err)
+	require.Equal(t, kbfscrypto.SigED25519, sigInfo.Version)
+	require.Equal(t, keys.signingKP.GetKID(), sigInfo.VerifyingKey.KID())
+	require.NoError(t, kbfscrypto.Verify(msg, sigInfo))
+
+	sigInfo, err = c.SignForKBFS(ctx, msg)
+	require.NoError(t, err)
+	require.Equal(t, kbfscrypto.SigED25519ForKBFS, sigInfo.Version)
+	require.NoError(t, kbfscrypto.Verify(msg, sigInfo))
+
+	sig, err := c.SignToString(ctx, msg)
+	require.NoError(t, err)
+	expectedSig, _, err := keys.signingKP.SignToString(msg)
+	require.NoError(t, err)
+	require.Equal(t, expectedSig, sig)
+}
+
+func TestCryptoExternalDecryptTLFCryptKeyClientHalf(t *testing.T) {
+	keys := newTestExternalDeviceKeys(t)
+	c := NewCryptoExternal(
+		kbfscodec.NewMsgpack(), keys, 0, logger.NewTestLogger(t))
+	ctx := context.Background()
+
+	ePubKey, ePrivKey, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+	clientHalf := kbfscrypto.MakeTLFCryptKeyClientHalf([32]byte{0x1})
+	encryptedClientHalf, err := kbfscrypto.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, keys.CryptPublicKey(), clientHalf)
+	require.NoError(t, err)
+
+	decrypted, err := c.DecryptTLFCryptKeyClientHalf(
+		ctx, ePubKey, encryptedClientHalf)
+	require.NoError(t, err)
+	require.Equal(t, clientHalf, decrypted)
+
+	// Only the bundle for this device's key is tried.
+	otherKey := kbfscrypto.MakeFakeCryptPublicKeyOrBust("other")
+	decrypted, index, err := c.DecryptTLFCryptKeyClientHalfAny(ctx,
+		[]EncryptedTLFCryptKeyClientAndEphemeral{
+			{otherKey, encryptedClientHalf, ePubKey},
+			{keys.CryptPublicKey(), encryptedClientHalf, ePubKey},
+		}, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, index)
+	require.Equal(t, clientHalf, decrypted)
+}
+
+func TestCryptoExternalCanceled(t *testing.T) {
+	keys := newTestExternalDeviceKeys(t)
+	keys.block = make(chan struct{})
+	c := NewCryptoExternal(
+		kbfscodec.NewMsgpack(), keys, 1, logger.NewTestLogger(t))
+
+	t.Log("A canceled caller doesn't wait for the slow signer")
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Sign(ctx, []byte("message"))
+		errCh <- err
+	}()
+	<-keys.started
+	cancel()
+	err := <-errCh
+	require.Equal(t, context.Canceled, errors.Cause(err))
+
+	t.Log("Once the signer finishes, new operations go through")
+	close(keys.block)
+	sigInfo, err := c.Sign(context.Background(), []byte("message"))
+	require.NoError(t, err)
+	require.NoError(t, kbfscrypto.Verify([]byte("message"), sigInfo))
+}
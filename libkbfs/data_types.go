@@ -12,6 +12,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
@@ -130,6 +131,18 @@ const (
 // one indirect pointer with an indirect DirectType [although if it
 // holds for one, it should hold for all], and all of its indirect
 // pointers must have DataVer 3, by c).
+// e) A file small enough to fit in a single direct block may instead
+// have its contents inlined into its directory entry (see
+// DirEntry.InlineData), in which case its pointer has DataVer 4, and
+// there's no block for it on the server.
+//
+// The cipher a block is encrypted with is the one negotiated for the
+// key generation it was written under (see kbfsmd.TLFCryptKeyInfo),
+// and it's recorded in the encrypted block itself, not in its
+// DataVer.  When a cipher other than kbfscrypto.EncryptionSecretbox
+// is introduced, it must come with a new DataVer that all blocks
+// encrypted with it use, so that older clients fail with a
+// NewDataVersionError before trying to decrypt them.
 type DataVer int
 
 const (
@@ -144,6 +157,11 @@ const (
 	// blocks that have multiple levels of indirection below them
 	// (i.e., indirect blocks that point to other indirect blocks).
 	AtLeastTwoLevelsOfChildrenDataVer DataVer = 3
+	// InlineDataVer is the data version for the pointer to a file
+	// whose contents are inlined into its directory entry.  The
+	// pointer never refers to a block on the server; it just gives
+	// the file a unique identity, like any other top-level pointer.
+	InlineDataVer DataVer = 4
 )
 
 // BlockRef is a block ID/ref nonce pair, which defines a unique
@@ -242,6 +260,17 @@ func (p BlockPointer) Ref() BlockRef {
 	}
 }
 
+// SameBlock returns whether this pointer and `other` refer to the
+// same reference of the same block.  Dedup'd references to a block
+// share its ID, but have different ref nonces and are updated
+// separately, so they're not the same block.  The rest of the context
+// (like the writer) and the other pointer fields can't differ
+// between two pointers to the same reference, but they aren't always
+// filled in, so they're not compared.
+func (p BlockPointer) SameBlock(other BlockPointer) bool {
+	return p.Ref() == other.Ref()
+}
+
 // BlockInfo contains all information about a block in KBFS and its
 // contents.
 //
@@ -387,6 +416,9 @@ type BlockChanges struct {
 	Info BlockInfo `codec:"p,omitempty"`
 	// An ordered list of operations completed in this update
 	Ops opsList `codec:"o,omitempty"`
+
+	codec.UnknownFieldSetHandler
+
 	// Estimate the number of bytes that this set of changes will take to encode
 	sizeEstimate uint64
 }
@@ -526,6 +558,20 @@ type EntryInfo struct {
 	// If this is a team TLF, we want to track the last writer of an
 	// entry, since in the block, only the team ID will be tracked.
 	TeamWriter keybase1.UID `codec:"tw,omitempty"`
+	// Atime is in unix nanoseconds.  It's only recorded when set
+	// with SetTimes, or by reads under AtimeRelatime.
+	Atime int64 `codec:"at,omitempty"`
+	// Btime is the creation time, in unix nanoseconds.  It's only
+	// recorded when set with SetTimes.
+	Btime int64 `codec:"bt,omitempty"`
+}
+
+// DirChild is a child entry of a directory, along with the Node for
+// that child.  Node is nil if the child is a symlink; the link target
+// is then in EntryInfo.SymPath.
+type DirChild struct {
+	Node Node
+	EntryInfo
 }
 
 // ReportedError represents an error reported by KBFS.
@@ -542,6 +588,10 @@ type OpSummary struct {
 	Refs    []string
 	Unrefs  []string
 	Updates map[string]string
+	// DeviceKID and ClientVersion identify the writer's device and
+	// client, if the writer recorded them.
+	DeviceKID     string `json:",omitempty"`
+	ClientVersion string `json:",omitempty"`
 }
 
 // UpdateSummary describes the operations done by a single MD revision.
@@ -636,6 +686,9 @@ type NodeMetadata struct {
 	LastWriterUnverified libkb.NormalizedUsername
 	BlockInfo            BlockInfo
 	PrefetchStatus       string
+	// WriteTags are the tags the WriteInterceptor has set on this
+	// node, if any.
+	WriteTags map[string]string
 }
 
 // FavoritesOp defines an operation related to favorites.
@@ -654,6 +707,43 @@ const (
 	FavoritesOpNoChange
 )
 
+// CRTextMergePolicy controls when conflict resolution merges
+// conflicting writes to a text file line by line, rather than
+// keeping both versions as conflicted copies.
+type CRTextMergePolicy struct {
+	// Enabled turns on text merging.
+	Enabled bool
+	// MaxSize is the largest size, in bytes, of any version of a
+	// file that will be merged.
+	MaxSize int64
+	// Globs are patterns, in the syntax of path.Match, of file names
+	// that are always treated as text.  Other files are merged only
+	// if all their versions look like UTF-8 text.
+	Globs []string
+}
+
+// TlfUsageAlertPolicy controls when KBFS warns about the growth of
+// the TLFs it has open, and whether it writes a periodic usage report
+// into them.  The zero value turns all of it off.
+type TlfUsageAlertPolicy struct {
+	// GrowthBytes, if non-zero, is how much a TLF may grow within
+	// GrowthWindow before a TlfUsageGrowthWarning is reported.
+	GrowthBytes uint64
+	// GrowthWindow is the period over which growth is measured.
+	GrowthWindow time.Duration
+	// Marks are TLF sizes, in bytes; a TlfUsageMarkWarning is
+	// reported whenever a TLF grows past one of them.
+	Marks []uint64
+	// ReportPeriod, if non-zero, is how often a usage report is
+	// written to TlfUsageReportName, in the root directory of each
+	// TLF this user can write to.
+	ReportPeriod time.Duration
+}
+
+func (p TlfUsageAlertPolicy) enabled() bool {
+	return p.GrowthBytes > 0 || len(p.Marks) > 0 || p.ReportPeriod > 0
+}
+
 // RekeyResult represents the result of an rekey operation.
 type RekeyResult struct {
 	DidRekey      bool
@@ -680,6 +770,13 @@ const (
 	// needed, and some naming restrictions are lifted (e.g., `.kbfs_`
 	// filenames are allowed).
 	InitSingleOp
+	// InitReadOnly is for long-running services (e.g., kbpagesd)
+	// that only ever read data from many TLFs; none of the
+	// write-path machinery (conflict resolution, journaling, dirty
+	// state tracking, block archiving) is started, data writes are
+	// rejected, and old MD revisions are evicted from the cache as
+	// soon as they're replaced.
+	InitReadOnly
 )
 
 // Mode returns the mode absent any mode flags.
@@ -700,6 +797,8 @@ func (im InitMode) String() string {
 		return InitMinimalString
 	case InitSingleOp:
 		return InitSingleOpString
+	case InitReadOnly:
+		return InitReadOnlyString
 	default:
 		return "unknown"
 	}
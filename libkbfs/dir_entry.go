@@ -11,6 +11,11 @@ type DirEntry struct {
 	BlockInfo
 	EntryInfo
 
+	// InlineData holds the contents of a small file that are inlined
+	// into its entry, instead of being stored in a block.  It's only
+	// meaningful when the entry's pointer has DataVer InlineDataVer.
+	InlineData []byte `codec:"in,omitempty"`
+
 	codec.UnknownFieldSetHandler
 }
 
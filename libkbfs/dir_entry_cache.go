@@ -0,0 +1,164 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+)
+
+// deCacheEntry holds the unsynced changes to a single file or
+// directory.
+type deCacheEntry struct {
+	// dirEntry is the dirty directory entry corresponding to the
+	// BlockPointer that maps to this struct.
+	dirEntry DirEntry
+	// adds is a map of the pointers for new entry names that have
+	// been added to the DirBlock for the BlockPointer that maps to
+	// this struct.
+	adds map[string]BlockPointer
+	// dels is a set of the names that have been removed from the
+	// DirBlock for the BlockPointer that maps to this struct.
+	dels map[string]bool
+	// addedSyms is a map of the dir entries for added symlinks.
+	addedSyms map[string]DirEntry
+}
+
+func (dece deCacheEntry) deepCopy() deCacheEntry {
+	copy := deCacheEntry{}
+	copy.dirEntry = dece.dirEntry
+	if dece.adds != nil {
+		copy.adds = make(map[string]BlockPointer, len(dece.adds))
+		for k, v := range dece.adds {
+			copy.adds[k] = v
+		}
+	}
+	if dece.dels != nil {
+		copy.dels = make(map[string]bool, len(dece.dels))
+		for k, v := range dece.dels {
+			copy.dels[k] = v
+		}
+	}
+	if dece.addedSyms != nil {
+		copy.addedSyms = make(map[string]DirEntry, len(dece.addedSyms))
+		for k, v := range dece.addedSyms {
+			copy.addedSyms[k] = v
+		}
+	}
+	return copy
+}
+
+// hasDirChanges returns whether any children have been added to or
+// removed from the directory this entry is for.
+func (dece deCacheEntry) hasDirChanges() bool {
+	return len(dece.adds) > 0 || len(dece.dels) > 0 ||
+		len(dece.addedSyms) > 0
+}
+
+// dirEntryCache tracks the modified, but not yet synced, directory
+// entries of a folder-branch, keyed by the BlockRef of the file or
+// directory each one is for.  Its lifecycle per entry is explicit:
+// an entry is created by `put` the first time its file or directory
+// is dirtied, updated by further `put`s, and destroyed by `remove`
+// once it has been synced or its changes are abandoned.  The
+// folder-branch is dirty exactly as long as the cache isn't empty.
+//
+// dirEntryCache is not goroutine-safe; folderBlockOps protects it
+// with blockLock.  A nil *dirEntryCache is an empty cache that can't
+// be written to, which is what read-only folder-branches use.
+type dirEntryCache struct {
+	entries map[BlockRef]deCacheEntry
+}
+
+func newDirEntryCache() *dirEntryCache {
+	return &dirEntryCache{
+		entries: make(map[BlockRef]deCacheEntry),
+	}
+}
+
+// isEmpty returns whether there are no dirty entries at all.
+func (c *dirEntryCache) isEmpty() bool {
+	return c == nil || len(c.entries) == 0
+}
+
+// get returns the dirty entry for `ref`, and whether there is one.
+func (c *dirEntryCache) get(ref BlockRef) (deCacheEntry, bool) {
+	if c == nil {
+		return deCacheEntry{}, false
+	}
+	dece, ok := c.entries[ref]
+	return dece, ok
+}
+
+// put creates or replaces the dirty entry for `ref`.
+func (c *dirEntryCache) put(ref BlockRef, dece deCacheEntry) {
+	c.entries[ref] = dece
+}
+
+// remove destroys the dirty entry for `ref`, if there is one.
+func (c *dirEntryCache) remove(ref BlockRef) {
+	if c == nil {
+		return
+	}
+	delete(c.entries, ref)
+}
+
+// snapshot returns a function that puts the entry for `ref` back the
+// way it is now -- removing it, if it doesn't exist yet -- for
+// undoing changes that are later abandoned.
+func (c *dirEntryCache) snapshot(ref BlockRef) func() {
+	dece, ok := c.entries[ref]
+	if !ok {
+		return func() { c.remove(ref) }
+	}
+	dece = dece.deepCopy()
+	return func() { c.put(ref, dece) }
+}
+
+// forEach calls `f` on every dirty entry, in no particular order.
+func (c *dirEntryCache) forEach(f func(ref BlockRef, dece deCacheEntry)) {
+	if c == nil {
+		return
+	}
+	for ref, dece := range c.entries {
+		f(ref, dece)
+	}
+}
+
+// checkInvariants returns an error if the cache is in a state that
+// no sequence of completed operations should leave it in.  Every
+// entry must record some change, since an empty entry would keep the
+// folder-branch dirty with nothing to sync.  Every added child must
+// have an entry of its own, with an initialized dir entry to fill in
+// the parent directory with.  And no name can be both added and
+// deleted in the same directory.
+func (c *dirEntryCache) checkInvariants() error {
+	if c == nil {
+		return nil
+	}
+	for ref, dece := range c.entries {
+		if !dece.dirEntry.IsInitialized() && dece.dirEntry.Mtime == 0 &&
+			dece.dirEntry.Ctime == 0 && !dece.hasDirChanges() {
+			return fmt.Errorf("Empty dir entry cache entry for %v", ref)
+		}
+		for name, ptr := range dece.adds {
+			added, ok := c.entries[ptr.Ref()]
+			if !ok || !added.dirEntry.IsInitialized() {
+				return fmt.Errorf("No cached dir entry for new entry %s "+
+					"(%v) in dir %v", name, ptr, ref)
+			}
+			if dece.dels[name] {
+				return fmt.Errorf("Entry %s in dir %v is both added "+
+					"and deleted", name, ref)
+			}
+		}
+		for name := range dece.addedSyms {
+			if dece.dels[name] {
+				return fmt.Errorf("Symlink %s in dir %v is both added "+
+					"and deleted", name, ref)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func makeDirEntryCacheTestEntry(id byte, typ EntryType) DirEntry {
+	return DirEntry{
+		BlockInfo: BlockInfo{
+			BlockPointer: BlockPointer{
+				ID:         kbfsblock.FakeID(id),
+				DataVer:    FirstValidDataVer,
+				DirectType: DirectBlock,
+			},
+		},
+		EntryInfo: EntryInfo{Type: typ, Mtime: 1, Ctime: 1},
+	}
+}
+
+func TestDirEntryCacheLifecycle(t *testing.T) {
+	c := newDirEntryCache()
+	require.True(t, c.isEmpty())
+	require.NoError(t, c.checkInvariants())
+
+	dirDe := makeDirEntryCacheTestEntry(1, Dir)
+	fileDe := makeDirEntryCacheTestEntry(2, File)
+
+	t.Log("Adding a file creates entries for it and its directory")
+	c.put(fileDe.Ref(), deCacheEntry{dirEntry: fileDe})
+	c.put(dirDe.Ref(), deCacheEntry{
+		adds: map[string]BlockPointer{"a": fileDe.BlockPointer}})
+	require.False(t, c.isEmpty())
+	require.NoError(t, c.checkInvariants())
+
+	t.Log("Undoing restores the earlier state")
+	undo := c.snapshot(dirDe.Ref())
+	dece, ok := c.get(dirDe.Ref())
+	require.True(t, ok)
+	dece = dece.deepCopy()
+	dece.dels = map[string]bool{"b": true}
+	c.put(dirDe.Ref(), dece)
+	undo()
+	dece, ok = c.get(dirDe.Ref())
+	require.True(t, ok)
+	require.False(t, dece.dels["b"])
+
+	undoNew := c.snapshot(makeDirEntryCacheTestEntry(3, File).Ref())
+	c.put(makeDirEntryCacheTestEntry(3, File).Ref(), deCacheEntry{
+		dirEntry: makeDirEntryCacheTestEntry(3, File)})
+	undoNew()
+	_, ok = c.get(makeDirEntryCacheTestEntry(3, File).Ref())
+	require.False(t, ok)
+
+	t.Log("Syncing destroys the entries")
+	c.remove(fileDe.Ref())
+	c.remove(dirDe.Ref())
+	require.True(t, c.isEmpty())
+}
+
+func TestDirEntryCacheInvariants(t *testing.T) {
+	dirDe := makeDirEntryCacheTestEntry(1, Dir)
+	fileDe := makeDirEntryCacheTestEntry(2, File)
+
+	t.Log("Added children need entries of their own")
+	c := newDirEntryCache()
+	c.put(dirDe.Ref(), deCacheEntry{
+		adds: map[string]BlockPointer{"a": fileDe.BlockPointer}})
+	require.Error(t, c.checkInvariants())
+	c.put(fileDe.Ref(), deCacheEntry{dirEntry: fileDe})
+	require.NoError(t, c.checkInvariants())
+
+	t.Log("A name can't be both added and deleted")
+	c.put(dirDe.Ref(), deCacheEntry{
+		adds: map[string]BlockPointer{"a": fileDe.BlockPointer},
+		dels: map[string]bool{"a": true},
+	})
+	require.Error(t, c.checkInvariants())
+
+	t.Log("Empty entries are stale")
+	c = newDirEntryCache()
+	c.put(dirDe.Ref(), deCacheEntry{})
+	require.Error(t, c.checkInvariants())
+}
+
+func TestDirEntryCacheNil(t *testing.T) {
+	var c *dirEntryCache
+	require.True(t, c.isEmpty())
+	_, ok := c.get(makeDirEntryCacheTestEntry(1, File).Ref())
+	require.False(t, ok)
+	c.remove(makeDirEntryCacheTestEntry(1, File).Ref())
+	c.forEach(func(BlockRef, deCacheEntry) {
+		t.Fatal("Unexpected entry in nil cache")
+	})
+	require.NoError(t, c.checkInvariants())
+}
+
+func TestDirEntryCacheThroughSync(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	kbfsOps := config.KBFSOps()
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	checkCache := func(expectEmpty bool) {
+		lState := makeFBOLockState()
+		ops.blocks.blockLock.RLock(lState)
+		defer ops.blocks.blockLock.RUnlock(lState)
+		require.NoError(t, ops.blocks.deCache.checkInvariants())
+		require.Equal(t, expectEmpty, ops.blocks.deCache.isEmpty())
+	}
+	checkCache(true)
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	mtime := time.Now()
+	err = kbfsOps.SetMtime(ctx, fileNode, &mtime)
+	require.NoError(t, err)
+	checkCache(false)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	checkCache(true)
+}
@@ -34,7 +34,10 @@ func makeFakeDirEntry(t *testing.T, typ EntryType, size uint64) DirEntry {
 			101,
 			102,
 			"",
+			103,
+			104,
 		},
+		nil,
 		codec.UnknownFieldSetHandler{},
 	}
 }
@@ -214,6 +214,8 @@ func (df *dirtyFile) resetSyncingBlocksToDirty() {
 			df.dirtyBcache.UpdateSyncingBytes(df.path.Tlf, -state.syncSize)
 		}
 		if state.sync != blockNotSyncing {
+			// The bytes are waiting for the next sync again.
+			df.notYetSyncingBytes += state.syncSize
 			state.copy = blockAlreadyCopied
 			state.sync = blockNotSyncing
 			state.syncSize = 0
@@ -330,6 +332,15 @@ func (df *dirtyFile) addDeferredNewBytes(bytes int64) {
 	df.deferredNewBytes += bytes
 }
 
+// clearDeferredNewBytes forgets the bytes that writes deferred
+// during a sync extended the file by, once those writes are redone
+// without waiting for a sync to finish.
+func (df *dirtyFile) clearDeferredNewBytes() {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.deferredNewBytes = 0
+}
+
 func (df *dirtyFile) assimilateDeferredNewBytes() {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -49,6 +50,11 @@ const (
 
 // DiskBlockCacheLocal is the standard implementation for DiskBlockCache.
 type DiskBlockCacheLocal struct {
+	// numMapped is the number of mapped regions handed out and not
+	// yet released.  It's accessed atomically, so it must stay
+	// 64-bit aligned.
+	numMapped int64
+
 	config     diskBlockCacheConfig
 	log        logger.Logger
 	maxBlockID []byte
@@ -74,6 +80,12 @@ type DiskBlockCacheLocal struct {
 	blockDb *levelDb
 	metaDb  *levelDb
 	tlfDb   *levelDb
+	// blockFileDir holds the blocks that are stored in their own
+	// files instead of blockDb; it's empty for in-memory caches.
+	blockFileDir string
+	// mmapReads, if true, means new large blocks are put in their
+	// own files, so that GetMapped can map them.
+	mmapReads bool
 
 	startedCh  chan struct{}
 	startErrCh chan struct{}
@@ -120,10 +132,12 @@ type DiskBlockCacheStatus struct {
 
 // newDiskBlockCacheStandardFromStorage creates a new *DiskBlockCacheStandard
 // with the passed-in storage.Storage interfaces as storage layers for each
-// cache.
+// cache.  Large blocks are stored in files under blockFileDir, if it's
+// non-empty and mmapReads is true.
 func newDiskBlockCacheStandardFromStorage(
 	config diskBlockCacheConfig, cacheType diskLimitTrackerType,
-	blockStorage, metadataStorage, tlfStorage storage.Storage) (
+	blockStorage, metadataStorage, tlfStorage storage.Storage,
+	blockFileDir string, mmapReads bool) (
 	cache *DiskBlockCacheLocal, err error) {
 	log := config.MakeLogger("KBC")
 	closers := make([]io.Closer, 0, 3)
@@ -186,6 +200,8 @@ func newDiskBlockCacheStandardFromStorage(
 		blockDb:          blockDb,
 		metaDb:           metaDb,
 		tlfDb:            tlfDb,
+		blockFileDir:     blockFileDir,
+		mmapReads:        mmapReads,
 		startedCh:        startedCh,
 		startErrCh:       startErrCh,
 		shutdownCh:       make(chan struct{}),
@@ -290,9 +306,11 @@ func getVersionedPathForDiskCache(log logger.Logger, dirPath string) (
 }
 
 // newDiskBlockCacheStandard creates a new *DiskBlockCacheStandard with a
-// specified directory on the filesystem as storage.
+// specified directory on the filesystem as storage.  If mmapReads is
+// true, large blocks are stored in their own files, so they can be
+// mapped instead of copied when read.
 func newDiskBlockCacheStandard(config diskBlockCacheConfig,
-	cacheType diskLimitTrackerType, dirPath string) (
+	cacheType diskLimitTrackerType, dirPath string, mmapReads bool) (
 	cache *DiskBlockCacheLocal, err error) {
 	log := config.MakeLogger("DBC")
 	defer func() {
@@ -335,14 +353,15 @@ func newDiskBlockCacheStandard(config diskBlockCacheConfig,
 		}
 	}()
 	return newDiskBlockCacheStandardFromStorage(config, cacheType,
-		blockStorage, metadataStorage, tlfStorage)
+		blockStorage, metadataStorage, tlfStorage,
+		filepath.Join(versionPath, blockFilesDirname), mmapReads)
 }
 
 func newDiskBlockCacheStandardForTest(config diskBlockCacheConfig,
 	cacheType diskLimitTrackerType) (*DiskBlockCacheLocal, error) {
 	return newDiskBlockCacheStandardFromStorage(
 		config, cacheType, storage.NewMemStorage(),
-		storage.NewMemStorage(), storage.NewMemStorage())
+		storage.NewMemStorage(), storage.NewMemStorage(), "", false)
 }
 
 // WaitUntilStarted waits until this cache has started.
@@ -437,25 +456,29 @@ func (cache *DiskBlockCacheLocal) getLRULocked(blockID kbfsblock.ID) (
 	return metadata.LRUTime, nil
 }
 
-// decodeBlockCacheEntry decodes a disk block cache entry buffer into an
-// encoded block and server half.
-func (cache *DiskBlockCacheLocal) decodeBlockCacheEntry(buf []byte) ([]byte,
-	kbfscrypto.BlockCryptKeyServerHalf, error) {
+// decodeBlockCacheEntry decodes a disk block cache entry buffer.
+func (cache *DiskBlockCacheLocal) decodeBlockCacheEntry(buf []byte) (
+	diskBlockCacheEntry, error) {
 	entry := diskBlockCacheEntry{}
 	err := cache.config.Codec().Decode(buf, &entry)
 	if err != nil {
-		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+		return diskBlockCacheEntry{}, err
 	}
-	return entry.Buf, entry.ServerHalf, nil
+	return entry, nil
 }
 
 // encodeBlockCacheEntry encodes an encoded block and serverHalf into a single
-// buffer.
+// buffer.  If inFile is true, the block itself is left out, since it's
+// stored in its own file.
 func (cache *DiskBlockCacheLocal) encodeBlockCacheEntry(buf []byte,
-	serverHalf kbfscrypto.BlockCryptKeyServerHalf) ([]byte, error) {
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf, inFile bool) (
+	[]byte, error) {
 	entry := diskBlockCacheEntry{
-		Buf:        buf,
 		ServerHalf: serverHalf,
+		InFile:     inFile,
+	}
+	if !inFile {
+		entry.Buf = buf
 	}
 	return cache.config.Codec().Encode(&entry)
 }
@@ -486,9 +509,24 @@ func (cache *DiskBlockCacheLocal) Get(ctx context.Context, tlfID tlf.ID,
 	blockID kbfsblock.ID) (buf []byte,
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf,
 	prefetchStatus PrefetchStatus, err error) {
+	region, serverHalf, prefetchStatus, err := cache.get(
+		ctx, tlfID, blockID, "Get", false)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, NoPrefetch, err
+	}
+	return region.buf, serverHalf, prefetchStatus, nil
+}
+
+// get gets a block from the cache.  If mapped is true, blocks that are
+// stored in their own files are mapped rather than read.
+func (cache *DiskBlockCacheLocal) get(ctx context.Context, tlfID tlf.ID,
+	blockID kbfsblock.ID, method string, mapped bool) (
+	region *diskBlockCacheRegion,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf,
+	prefetchStatus PrefetchStatus, err error) {
 	cache.lock.RLock()
 	defer cache.lock.RUnlock()
-	err = cache.checkCacheLocked("Get")
+	err = cache.checkCacheLocked(method)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, NoPrefetch, err
 	}
@@ -514,14 +552,33 @@ func (cache *DiskBlockCacheLocal) Get(ctx context.Context, tlfID tlf.ID,
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, NoPrefetch, err
 	}
-	buf, serverHalf, err = cache.decodeBlockCacheEntry(entry)
+	decoded, err := cache.decodeBlockCacheEntry(entry)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, NoPrefetch, err
+	}
+	switch {
+	case !decoded.InFile:
+		region = newHeapDiskBlockCacheRegion(decoded.Buf)
+	case mapped:
+		region, err = cache.mapBlockFileLocked(blockID)
+	default:
+		var buf []byte
+		buf, err = ioutil.ReadFile(cache.blockFilePath(blockID))
+		if ioutil.IsNotExist(err) {
+			err = NoSuchBlockError{blockID}
+		}
+		region = newHeapDiskBlockCacheRegion(buf)
+	}
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, NoPrefetch, err
+	}
 	prefetchStatus = NoPrefetch
 	if md.FinishedPrefetch {
 		prefetchStatus = FinishedPrefetch
 	} else if md.TriggeredPrefetch {
 		prefetchStatus = TriggeredPrefetch
 	}
-	return buf, serverHalf, prefetchStatus, err
+	return region, decoded.ServerHalf, prefetchStatus, nil
 }
 
 func (cache *DiskBlockCacheLocal) evictUntilBytesAvailable(
@@ -568,11 +625,15 @@ func (cache *DiskBlockCacheLocal) Put(ctx context.Context, tlfID tlf.ID,
 	}
 
 	blockLen := len(buf)
-	entry, err := cache.encodeBlockCacheEntry(buf, serverHalf)
+	inFile := cache.shouldPutInFile(blockLen)
+	entry, err := cache.encodeBlockCacheEntry(buf, serverHalf, inFile)
 	if err != nil {
 		return err
 	}
 	encodedLen := int64(len(entry))
+	if inFile {
+		encodedLen += int64(blockLen)
+	}
 	defer func() {
 		if err == nil {
 			cache.putMeter.Mark(1)
@@ -620,7 +681,7 @@ func (cache *DiskBlockCacheLocal) Put(ctx context.Context, tlfID tlf.ID,
 				return cachePutCacheFullError{blockID}
 			}
 		}
-		err = cache.blockDb.Put(blockKey, entry, nil)
+		err = cache.putBlockLocked(blockID, buf, entry, inFile)
 		if err != nil {
 			cache.config.DiskLimiter().commitOrRollback(ctx,
 				cache.cacheType, encodedLen, 0, false, "")
@@ -659,6 +720,26 @@ func (cache *DiskBlockCacheLocal) Put(ctx context.Context, tlfID tlf.ID,
 	return cache.updateMetadataLocked(ctx, blockKey, md)
 }
 
+// putBlockLocked stores the given block entry, and writes the block to
+// its own file first if inFile is true.
+func (cache *DiskBlockCacheLocal) putBlockLocked(blockID kbfsblock.ID,
+	buf, entry []byte, inFile bool) error {
+	if inFile {
+		err := cache.writeBlockFile(blockID, buf)
+		if err != nil {
+			return err
+		}
+	}
+	err := cache.blockDb.Put(blockID.Bytes(), entry, nil)
+	if err != nil && inFile {
+		if removeErr := cache.removeBlockFile(blockID); removeErr != nil {
+			cache.log.Warning("Error removing block file for %s: %+v",
+				blockID, removeErr)
+		}
+	}
+	return err
+}
+
 // GetMetadata implements the DiskBlockCache interface for
 // DiskBlockCacheStandard.
 func (cache *DiskBlockCacheLocal) GetMetadata(ctx context.Context,
@@ -718,6 +799,7 @@ func (cache *DiskBlockCacheLocal) deleteLocked(ctx context.Context,
 	tlfBatch := new(leveldb.Batch)
 	removalCounts := make(map[tlf.ID]int)
 	removalSizes := make(map[tlf.ID]uint64)
+	removedIDs := make([]kbfsblock.ID, 0, len(blockEntries))
 	for _, entry := range blockEntries {
 		blockKey := entry.Bytes()
 		metadataBytes, err := cache.metaDb.Get(blockKey, nil)
@@ -737,6 +819,7 @@ func (cache *DiskBlockCacheLocal) deleteLocked(ctx context.Context,
 		tlfBatch.Delete(tlfDbKey)
 		removalCounts[metadata.TlfID]++
 		removalSizes[metadata.TlfID] += uint64(metadata.BlockSize)
+		removedIDs = append(removedIDs, entry)
 		sizeRemoved += int64(metadata.BlockSize)
 		numRemoved++
 	}
@@ -750,6 +833,14 @@ func (cache *DiskBlockCacheLocal) deleteLocked(ctx context.Context,
 	if err := cache.blockDb.Write(blockBatch, nil); err != nil {
 		return 0, 0, err
 	}
+	for _, id := range removedIDs {
+		// The blocks are already gone from blockDb, so a
+		// leftover file only wastes space.
+		if err := cache.removeBlockFile(id); err != nil {
+			cache.log.CWarningf(ctx, "Error removing block file for %s: "+
+				"%+v", id, err)
+		}
+	}
 
 	// Update the cache's totals.
 	for k, v := range removalCounts {
@@ -892,6 +983,7 @@ func (cache *DiskBlockCacheLocal) evictLocked(ctx context.Context,
 	defer iter.Release()
 
 	blockIDs := make(blockIDsByTime, 0, numElements)
+	now := cache.config.Clock().Now()
 
 	for i := 0; i < numElements; i++ {
 		if !iter.Next() {
@@ -911,7 +1003,11 @@ func (cache *DiskBlockCacheLocal) evictLocked(ctx context.Context,
 				blockID)
 			continue
 		}
-		blockIDs = append(blockIDs, lruEntry{blockID, metadata.LRUTime})
+		// Weigh the LRU time by the block's TLF's tuning profile,
+		// so TLFs with a higher weight keep their blocks longer.
+		lruTime := cache.config.TuningProfile(
+			metadata.TlfID).diskCacheWeightedTime(now, metadata.LRUTime)
+		blockIDs = append(blockIDs, lruEntry{blockID, lruTime})
 	}
 
 	return cache.evictSomeBlocks(ctx, numBlocks, blockIDs)
@@ -978,6 +1074,12 @@ func (cache *DiskBlockCacheLocal) Shutdown(ctx context.Context) {
 	if cache.blockDb == nil {
 		return
 	}
+	if numMapped := atomic.LoadInt64(&cache.numMapped); numMapped > 0 {
+		// The mappings stay valid without the databases, so
+		// this is only worth noting.
+		cache.log.CDebugf(ctx, "Shutting down with %d block(s) still mapped",
+			numMapped)
+	}
 	cache.closer()
 	cache.blockDb = nil
 	cache.metaDb = nil
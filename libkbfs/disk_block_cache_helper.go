@@ -3,6 +3,7 @@ package libkbfs
 import (
 	"time"
 
+	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
@@ -13,6 +14,9 @@ import (
 type diskBlockCacheEntry struct {
 	Buf        []byte
 	ServerHalf kbfscrypto.BlockCryptKeyServerHalf
+	// InFile is true if Buf is empty because the block is stored in
+	// its own file, so that it can be mapped.
+	InFile bool `codec:",omitempty"`
 }
 
 // DiskBlockCacheMetadata packages the metadata needed to make decisions on
@@ -30,6 +34,10 @@ type DiskBlockCacheMetadata struct {
 	TriggeredPrefetch bool `codec:"HasPrefetched"`
 	// whether the block's triggered prefetches are complete
 	FinishedPrefetch bool
+
+	// Preserve fields added by newer clients sharing the same cache,
+	// since the metadata is re-encoded every time a block is used.
+	codec.UnknownFieldSetHandler
 }
 
 // lruEntry is an entry for sorting LRU times
@@ -0,0 +1,183 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const (
+	// diskBlockCacheFileMinBytes is the smallest block that, in mmap
+	// read mode, is stored in its own file rather than in the block
+	// leveldb.  Smaller blocks aren't worth a file and a mapping.
+	diskBlockCacheFileMinBytes = 64 * 1024
+	blockFilesDirname          = "blocks"
+)
+
+// diskBlockCacheRegion is a read-only view of an encoded block from
+// the disk cache, which may be memory-mapped straight from the cache
+// file instead of copied onto the heap.
+//
+// The bytes stay valid until Release is called, even if the block is
+// evicted in the meantime, but must not be used (or retained) after
+// that.  Release must be called once the caller is done with the
+// bytes; calling it more than once is harmless.
+type diskBlockCacheRegion struct {
+	buf []byte
+
+	lock     sync.Mutex
+	unmap    func() error
+	released bool
+	// onRelease, if non-nil, is called after the region is
+	// released, for the cache's bookkeeping.
+	onRelease func()
+}
+
+func newHeapDiskBlockCacheRegion(buf []byte) *diskBlockCacheRegion {
+	return &diskBlockCacheRegion{buf: buf}
+}
+
+// Bytes returns the encoded block.
+func (r *diskBlockCacheRegion) Bytes() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.released {
+		panic("diskBlockCacheRegion used after Release")
+	}
+	return r.buf
+}
+
+// Release unmaps the region, if it was mapped.
+func (r *diskBlockCacheRegion) Release() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.released {
+		return nil
+	}
+	r.released = true
+	r.buf = nil
+	if r.onRelease != nil {
+		defer r.onRelease()
+	}
+	if r.unmap == nil {
+		return nil
+	}
+	return r.unmap()
+}
+
+// diskBlockCacheMapper is implemented by disk block caches that can
+// hand out blocks as mapped regions, to save copying large blocks
+// onto the heap before they're decrypted.
+type diskBlockCacheMapper interface {
+	// GetMapped is like DiskBlockCache.Get, but returns the
+	// encoded block as a region that the caller must release.
+	GetMapped(ctx context.Context, tlfID tlf.ID, blockID kbfsblock.ID) (
+		region *diskBlockCacheRegion,
+		serverHalf kbfscrypto.BlockCryptKeyServerHalf,
+		prefetchStatus PrefetchStatus, err error)
+}
+
+// getMappedFromDiskCache gets the given block from `dbc` as a region,
+// mapped if `dbc` supports it, and copied onto the heap otherwise.
+func getMappedFromDiskCache(ctx context.Context, dbc DiskBlockCache,
+	tlfID tlf.ID, blockID kbfsblock.ID) (
+	*diskBlockCacheRegion, kbfscrypto.BlockCryptKeyServerHalf,
+	PrefetchStatus, error) {
+	if mapper, ok := dbc.(diskBlockCacheMapper); ok {
+		return mapper.GetMapped(ctx, tlfID, blockID)
+	}
+	buf, serverHalf, prefetchStatus, err := dbc.Get(ctx, tlfID, blockID)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, NoPrefetch, err
+	}
+	return newHeapDiskBlockCacheRegion(buf), serverHalf, prefetchStatus, nil
+}
+
+// blockFilePath returns the path of the file holding the given
+// block, when it's too big to go in the block leveldb.
+func (cache *DiskBlockCacheLocal) blockFilePath(blockID kbfsblock.ID) string {
+	idStr := blockID.String()
+	return filepath.Join(cache.blockFileDir, idStr[:4], idStr[4:])
+}
+
+// shouldPutInFile returns whether a block of the given size should be
+// stored in its own file.
+func (cache *DiskBlockCacheLocal) shouldPutInFile(blockLen int) bool {
+	return cache.mmapReads && cache.blockFileDir != "" &&
+		blockLen >= diskBlockCacheFileMinBytes
+}
+
+// writeBlockFile writes the given block to its file.  It always
+// creates a new file, rather than overwriting an existing one, so
+// that anyone who still has the old one mapped keeps seeing valid
+// data.
+func (cache *DiskBlockCacheLocal) writeBlockFile(
+	blockID kbfsblock.ID, buf []byte) error {
+	path := cache.blockFilePath(blockID)
+	err := ioutil.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	err = ioutil.WriteFile(tempPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.Rename(tempPath, path)
+}
+
+// removeBlockFile removes the file for the given block, if there is
+// one.  Existing mappings of it stay valid until they're released.
+func (cache *DiskBlockCacheLocal) removeBlockFile(blockID kbfsblock.ID) error {
+	if cache.blockFileDir == "" {
+		return nil
+	}
+	err := ioutil.Remove(cache.blockFilePath(blockID))
+	if ioutil.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// mapBlockFileLocked maps the file for the given block, counting the
+// mapping until it's released.
+func (cache *DiskBlockCacheLocal) mapBlockFileLocked(
+	blockID kbfsblock.ID) (*diskBlockCacheRegion, error) {
+	buf, unmap, err := mmapFile(cache.blockFilePath(blockID))
+	if ioutil.IsNotExist(err) {
+		return nil, NoSuchBlockError{blockID}
+	} else if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&cache.numMapped, 1)
+	return &diskBlockCacheRegion{
+		buf:   buf,
+		unmap: unmap,
+		onRelease: func() {
+			atomic.AddInt64(&cache.numMapped, -1)
+		},
+	}, nil
+}
+
+// GetMapped implements the diskBlockCacheMapper interface for
+// DiskBlockCacheLocal.  Blocks stored in their own files are mapped;
+// others are copied out of the block leveldb as usual.
+func (cache *DiskBlockCacheLocal) GetMapped(ctx context.Context,
+	tlfID tlf.ID, blockID kbfsblock.ID) (
+	region *diskBlockCacheRegion,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf,
+	prefetchStatus PrefetchStatus, err error) {
+	return cache.get(ctx, tlfID, blockID, "GetMapped", true)
+}
+
+var _ diskBlockCacheMapper = (*DiskBlockCacheLocal)(nil)
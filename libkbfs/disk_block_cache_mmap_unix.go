@@ -0,0 +1,47 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"os"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps the whole file at `path` read-only, and returns the
+// mapped bytes along with a function to unmap them.  The mapping
+// stays valid after the file is closed or unlinked, but not if it's
+// truncated, so callers must only map files that are never modified
+// in place.  It may return an error for which ioutil.IsNotExist()
+// returns true.
+func mmapFile(path string) (buf []byte, unmap func() error, err error) {
+	f, err := ioutil.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if fi.Size() == 0 {
+		// Zero-length mappings aren't allowed.
+		return []byte{}, func() error { return nil }, nil
+	}
+
+	buf, err = unix.Mmap(
+		int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return buf, func() error {
+		return errors.WithStack(unix.Munmap(buf))
+	}, nil
+}
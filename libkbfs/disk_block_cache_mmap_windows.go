@@ -0,0 +1,20 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libkbfs
+
+import "github.com/keybase/kbfs/ioutil"
+
+// mmapFile reads the whole file at `path`.  Windows doesn't let a
+// mapped file be deleted, which would keep evicted blocks around
+// for as long as they're in use, so it gets a heap copy instead.
+func mmapFile(path string) (buf []byte, unmap func() error, err error) {
+	buf, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, func() error { return nil }, nil
+}
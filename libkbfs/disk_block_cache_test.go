@@ -6,15 +6,20 @@ package libkbfs
 
 import (
 	"math"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
 	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/net/context"
 )
@@ -30,6 +35,7 @@ type testDiskBlockCacheConfig struct {
 	limiter DiskLimiter
 	syncedTlfGetterSetter
 	initModeGetter
+	*testTuningProfileGetter
 }
 
 func newTestDiskBlockCacheConfig(t *testing.T) *testDiskBlockCacheConfig {
@@ -40,6 +46,7 @@ func newTestDiskBlockCacheConfig(t *testing.T) *testDiskBlockCacheConfig {
 		nil,
 		newTestSyncedTlfGetterSetter(),
 		testInitModeGetter{InitDefault},
+		newTestTuningProfileGetter(),
 	}
 }
 
@@ -141,6 +148,36 @@ func setupBlockForDiskCache(t *testing.T, config diskBlockCacheConfig) (
 	return ptr, block, blockEncoded, serverHalf
 }
 
+type diskBlockCacheMetadataFuture struct {
+	DiskBlockCacheMetadata
+	kbfscodec.Extra
+}
+
+func (dbcmf diskBlockCacheMetadataFuture) toCurrent() DiskBlockCacheMetadata {
+	return dbcmf.DiskBlockCacheMetadata
+}
+
+func (dbcmf diskBlockCacheMetadataFuture) ToCurrentStruct() kbfscodec.CurrentStruct {
+	return dbcmf.toCurrent()
+}
+
+func makeFakeDiskBlockCacheMetadataFuture(
+	t *testing.T) diskBlockCacheMetadataFuture {
+	return diskBlockCacheMetadataFuture{
+		DiskBlockCacheMetadata{
+			TlfID:             tlf.FakeID(1, tlf.Private),
+			LRUTime:           time.Unix(100, 0).UTC(),
+			BlockSize:         1000,
+			TriggeredPrefetch: true,
+		},
+		kbfscodec.MakeExtraOrBust("DiskBlockCacheMetadata", t),
+	}
+}
+
+func TestDiskBlockCacheMetadataUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeDiskBlockCacheMetadataFuture(t))
+}
+
 func TestDiskBlockCachePutAndGet(t *testing.T) {
 	t.Parallel()
 	t.Log("Test that basic disk cache Put and Get operations work.")
@@ -583,3 +620,91 @@ func TestSyncBlockCacheStaticLimit(t *testing.T) {
 	require.Equal(t, int64(standardCache.currBytes), currBytes)
 	require.Equal(t, numBlocks, standardCache.numBlocks)
 }
+
+func TestDiskBlockCacheMmapReads(t *testing.T) {
+	t.Parallel()
+	t.Log("Test that large blocks are stored in files and mapped when " +
+		"mmap reads are on.")
+	_, config := initDiskBlockCacheTest(t)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_block_cache_mmap")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	cache, err := newDiskBlockCacheStandardFromStorage(config,
+		workingSetCacheLimitTrackerType, storage.NewMemStorage(),
+		storage.NewMemStorage(), storage.NewMemStorage(), tempdir, true)
+	require.NoError(t, err)
+	cache.WaitUntilStarted()
+	defer shutdownDiskBlockCacheTest(cache)
+	ctx := context.Background()
+	tlf1 := tlf.FakeID(0, tlf.Private)
+
+	t.Log("Put a small block and a large one.")
+	smallPtr, _, smallEncoded, smallServerHalf := setupBlockForDiskCache(
+		t, config)
+	err = cache.Put(ctx, tlf1, smallPtr.ID, smallEncoded, smallServerHalf)
+	require.NoError(t, err)
+	largePtr := makeRandomBlockPointer(t)
+	largeEncoded := make([]byte, diskBlockCacheFileMinBytes)
+	err = kbfscrypto.RandRead(largeEncoded)
+	require.NoError(t, err)
+	largeServerHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = cache.Put(ctx, tlf1, largePtr.ID, largeEncoded, largeServerHalf)
+	require.NoError(t, err)
+
+	t.Log("Only the large block gets its own file.")
+	_, err = ioutil.Stat(cache.blockFilePath(smallPtr.ID))
+	require.True(t, ioutil.IsNotExist(err))
+	fileBuf, err := ioutil.ReadFile(cache.blockFilePath(largePtr.ID))
+	require.NoError(t, err)
+	require.Equal(t, largeEncoded, fileBuf)
+
+	t.Log("The file's size counts towards the cache's size.")
+	md, err := cache.GetMetadata(ctx, largePtr.ID)
+	require.NoError(t, err)
+	require.True(t, md.BlockSize > uint32(len(largeEncoded)))
+
+	t.Log("Both blocks can be read with Get and GetMapped.")
+	for _, b := range []struct {
+		ptr        BlockPointer
+		encoded    []byte
+		serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	}{
+		{smallPtr, smallEncoded, smallServerHalf},
+		{largePtr, largeEncoded, largeServerHalf},
+	} {
+		buf, serverHalf, _, err := cache.Get(ctx, tlf1, b.ptr.ID)
+		require.NoError(t, err)
+		require.Equal(t, b.encoded, buf)
+		require.Equal(t, b.serverHalf, serverHalf)
+
+		region, serverHalf, _, err := cache.GetMapped(ctx, tlf1, b.ptr.ID)
+		require.NoError(t, err)
+		require.Equal(t, b.encoded, region.Bytes())
+		require.Equal(t, b.serverHalf, serverHalf)
+		require.NoError(t, region.Release())
+	}
+	require.Equal(t, int64(0), atomic.LoadInt64(&cache.numMapped))
+
+	t.Log("A mapped block stays readable after it's deleted, until " +
+		"it's released.")
+	region, _, _, err := cache.GetMapped(ctx, tlf1, largePtr.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), atomic.LoadInt64(&cache.numMapped))
+	numRemoved, _, err := cache.Delete(ctx, []kbfsblock.ID{largePtr.ID})
+	require.NoError(t, err)
+	require.Equal(t, 1, numRemoved)
+	_, err = ioutil.Stat(cache.blockFilePath(largePtr.ID))
+	require.True(t, ioutil.IsNotExist(err))
+	require.Equal(t, largeEncoded, region.Bytes())
+	require.NoError(t, region.Release())
+	require.NoError(t, region.Release())
+	require.Equal(t, int64(0), atomic.LoadInt64(&cache.numMapped))
+	require.Panics(t, func() { region.Bytes() })
+
+	_, _, _, err = cache.GetMapped(ctx, tlf1, largePtr.ID)
+	require.EqualError(t, err, NoSuchBlockError{largePtr.ID}.Error())
+}
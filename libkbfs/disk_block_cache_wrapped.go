@@ -31,11 +31,13 @@ type diskBlockCacheConfig interface {
 	diskLimiterGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	tuningProfileGetter
 }
 
 type diskBlockCacheWrapped struct {
 	config      diskBlockCacheConfig
 	storageRoot string
+	mmapReads   bool
 	// Protects the caches
 	mtx             sync.RWMutex
 	workingSetCache *DiskBlockCacheLocal
@@ -68,16 +70,18 @@ func (cache *diskBlockCacheWrapped) enableCache(
 	} else {
 		cacheStorageRoot := filepath.Join(cache.storageRoot, cacheFolder)
 		*cachePtr, err = newDiskBlockCacheStandard(cache.config, typ,
-			cacheStorageRoot)
+			cacheStorageRoot, cache.mmapReads)
 	}
 	return err
 }
 
 func newDiskBlockCacheWrapped(config diskBlockCacheConfig,
-	storageRoot string) (cache *diskBlockCacheWrapped, err error) {
+	storageRoot string, mmapReads bool) (
+	cache *diskBlockCacheWrapped, err error) {
 	cache = &diskBlockCacheWrapped{
 		config:      config,
 		storageRoot: storageRoot,
+		mmapReads:   mmapReads,
 	}
 	err = cache.enableCache(workingSetCacheLimitTrackerType,
 		workingSetCacheFolderName)
@@ -134,6 +138,32 @@ func (cache *diskBlockCacheWrapped) Get(ctx context.Context, tlfID tlf.ID,
 	return buf, serverHalf, prefetchStatus, err
 }
 
+// GetMapped implements the diskBlockCacheMapper interface for
+// diskBlockCacheWrapped.
+func (cache *diskBlockCacheWrapped) GetMapped(ctx context.Context,
+	tlfID tlf.ID, blockID kbfsblock.ID) (
+	region *diskBlockCacheRegion,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf,
+	prefetchStatus PrefetchStatus, err error) {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
+	primaryCache := cache.workingSetCache
+	secondaryCache := cache.syncCache
+	if cache.config.IsSyncedTlf(tlfID) && cache.syncCache != nil {
+		primaryCache, secondaryCache = secondaryCache, primaryCache
+	}
+	// Check both caches if the primary cache doesn't have the block.
+	region, serverHalf, prefetchStatus, err =
+		primaryCache.GetMapped(ctx, tlfID, blockID)
+	if _, isNoSuchBlockError := err.(NoSuchBlockError); isNoSuchBlockError &&
+		secondaryCache != nil {
+		return secondaryCache.GetMapped(ctx, tlfID, blockID)
+	}
+	return region, serverHalf, prefetchStatus, err
+}
+
+var _ diskBlockCacheMapper = (*diskBlockCacheWrapped)(nil)
+
 // GetMetadata implements the DiskBlockCache interface for
 // diskBlockCacheWrapped.
 func (cache *diskBlockCacheWrapped) GetMetadata(ctx context.Context,
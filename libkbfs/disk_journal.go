@@ -65,6 +65,8 @@ type diskJournal struct {
 	codec     kbfscodec.Codec
 	dir       string
 	entryType reflect.Type
+	// crypter encrypts the journal entries; it may be nil.
+	crypter *localStorageCrypter
 
 	// The journal must be considered empty when either
 	// earliestValid or latestValid is false.
@@ -78,12 +80,13 @@ type diskJournal struct {
 
 // makeDiskJournal returns a new diskJournal for the given directory.
 func makeDiskJournal(
-	codec kbfscodec.Codec, dir string, entryType reflect.Type) (
-	*diskJournal, error) {
+	codec kbfscodec.Codec, dir string, entryType reflect.Type,
+	crypter *localStorageCrypter) (*diskJournal, error) {
 	j := &diskJournal{
 		codec:     codec,
 		dir:       dir,
 		entryType: entryType,
+		crypter:   crypter,
 	}
 
 	earliest, err := j.readEarliestOrdinalFromDisk()
@@ -214,7 +217,7 @@ func (j *diskJournal) clear() error {
 	j.latest = journalOrdinal(0)
 
 	// j.dir will be recreated on the next call to
-	// writeJournalEntry (via kbfscodec.SerializeToFile), which
+	// writeJournalEntry (via serializeToFile), which
 	// must always come before any ordinal write.
 	return ioutil.RemoveAll(j.dir)
 }
@@ -260,7 +263,7 @@ func (j *diskJournal) removeEarliest() (empty bool, err error) {
 func (j diskJournal) readJournalEntry(o journalOrdinal) (interface{}, error) {
 	p := j.journalEntryPath(o)
 	entry := reflect.New(j.entryType)
-	err := kbfscodec.DeserializeFromFile(j.codec, p, entry)
+	err := j.crypter.deserializeFromFile(j.codec, p, entry)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +279,7 @@ func (j *diskJournal) writeJournalEntry(
 			j.entryType, entryType))
 	}
 
-	return kbfscodec.SerializeToFile(j.codec, entry, j.journalEntryPath(o))
+	return j.crypter.serializeToFile(j.codec, entry, j.journalEntryPath(o))
 }
 
 // appendJournalEntry appends the given entry to the journal. If o is
@@ -0,0 +1,104 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+// AtimePolicy represents when reading a file updates its recorded
+// access time.
+type AtimePolicy int
+
+var _ flag.Value = (*AtimePolicy)(nil)
+
+const (
+	// AtimeNoatime indicates that reads never update a file's access
+	// time, like the "noatime" mount option.  A file's access time
+	// is then only what was last set with SetTimes, if anything.
+	AtimeNoatime AtimePolicy = iota
+	// AtimeRelatime indicates that a read updates a file's access
+	// time if it's older than the file's mtime or ctime, or more
+	// than a day old, like the "relatime" mount option.  Each such
+	// update is a metadata write, so it only happens for writers of
+	// the folder.
+	AtimeRelatime
+)
+
+// relatimeInterval is how old a file's access time has to be before
+// a read updates it under AtimeRelatime, even if the file hasn't
+// changed since.
+const relatimeInterval = 24 * time.Hour
+
+// String outputs a human-readable description of this AtimePolicy.
+func (p AtimePolicy) String() string {
+	switch p {
+	case AtimeNoatime:
+		return "noatime"
+	case AtimeRelatime:
+		return "relatime"
+	}
+	return "unknown"
+}
+
+// Set parses a string representing an atime policy, and outputs the
+// policy value corresponding to that string. Defaults to
+// AtimeNoatime.
+func (p *AtimePolicy) Set(s string) error {
+	*p = AtimeNoatime
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "relatime":
+		*p = AtimeRelatime
+	}
+	return nil
+}
+
+// shouldUpdateAtime returns whether a read at `now` of a file with
+// the given entry info should update its access time.
+func (p AtimePolicy) shouldUpdateAtime(ei EntryInfo, now time.Time) bool {
+	if p != AtimeRelatime {
+		return false
+	}
+	return ei.Atime <= ei.Mtime || ei.Atime <= ei.Ctime ||
+		now.Sub(time.Unix(0, ei.Atime)) >= relatimeInterval
+}
+
+// EntryTimes holds the timestamps to set on an entry with SetTimes.
+// A nil time leaves the corresponding timestamp unchanged.
+type EntryTimes struct {
+	Mtime *time.Time
+	Atime *time.Time
+	// Btime is the entry's creation time.
+	Btime *time.Time
+	// Ctime, if set, overrides the ctime the entry would otherwise
+	// get for the change (the current time), so that tools restoring
+	// a backup can restore it too.
+	Ctime *time.Time
+}
+
+func (t EntryTimes) isEmpty() bool {
+	return t.Mtime == nil && t.Atime == nil && t.Btime == nil &&
+		t.Ctime == nil
+}
+
+// AccessTime returns the access time to report for the entry: its
+// recorded access time if it has one, or otherwise its mtime.
+func (ei EntryInfo) AccessTime() time.Time {
+	if ei.Atime != 0 {
+		return time.Unix(0, ei.Atime)
+	}
+	return time.Unix(0, ei.Mtime)
+}
+
+// BirthTime returns the recorded creation time of the entry, or the
+// zero time if it has none.
+func (ei EntryInfo) BirthTime() time.Time {
+	if ei.Btime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ei.Btime)
+}
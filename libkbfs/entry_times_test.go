@@ -0,0 +1,85 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAtimePolicySet(t *testing.T) {
+	var p AtimePolicy
+	require.NoError(t, p.Set(" Relatime"))
+	require.Equal(t, AtimeRelatime, p)
+	require.NoError(t, p.Set("bogus"))
+	require.Equal(t, AtimeNoatime, p)
+	require.Equal(t, "noatime", p.String())
+}
+
+func TestKBFSOpsSetTimes(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Explicit times, including ctime, are all recorded")
+	mtime := time.Unix(1000, 0)
+	atime := time.Unix(2000, 0)
+	btime := time.Unix(500, 0)
+	ctime := time.Unix(3000, 0)
+	err = kbfsOps.SetTimes(ctx, fileNode, EntryTimes{
+		Mtime: &mtime,
+		Atime: &atime,
+		Btime: &btime,
+		Ctime: &ctime,
+	})
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, mtime.UnixNano(), ei.Mtime)
+	require.Equal(t, ctime.UnixNano(), ei.Ctime)
+	require.True(t, atime.Equal(ei.AccessTime()))
+	require.True(t, btime.Equal(ei.BirthTime()))
+
+	t.Log("Under noatime, reads leave the access time alone")
+	buf := make([]byte, 3)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, atime.Equal(ei.AccessTime()))
+
+	t.Log("Under relatime, a read updates a stale access time, " +
+		"but not the ctime")
+	config.SetAtimePolicy(AtimeRelatime)
+	c := make(chan struct{}, 10)
+	err = config.Notifier().RegisterForChanges(
+		[]FolderBranch{rootNode.GetFolderBranch()}, &testBGObserver{c})
+	require.NoError(t, err)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	// The access time update is the only change to the folder.
+	select {
+	case <-c:
+	case <-ctx.Done():
+		t.Fatal("The access time was never updated")
+	}
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, ei.AccessTime().After(atime))
+	require.Equal(t, ctime.UnixNano(), ei.Ctime)
+}
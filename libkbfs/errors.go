@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -200,6 +201,69 @@ func (e WriteAccessError) Error() string {
 	return fmt.Sprintf("%s does not have write access to %s", e.User, e.Filename)
 }
 
+// WriteRejectedError indicates that the configured WriteInterceptor
+// rejected the data written to a file, so it couldn't be synced.
+type WriteRejectedError struct {
+	Filename string
+	Reason   string
+}
+
+// Error implements the error interface for WriteRejectedError
+func (e WriteRejectedError) Error() string {
+	return fmt.Sprintf("Writes to %s were rejected: %s", e.Filename, e.Reason)
+}
+
+// ContentPolicyError indicates that a file couldn't be created or
+// written because of its TLF's content policy.
+type ContentPolicyError struct {
+	Filename string
+	Reason   string
+}
+
+// Error implements the error interface for ContentPolicyError
+func (e ContentPolicyError) Error() string {
+	return fmt.Sprintf("%s violates the folder's content policy: %s",
+		e.Filename, e.Reason)
+}
+
+// InvalidNodeTokenError indicates that a NodeToken couldn't be
+// decoded.
+type InvalidNodeTokenError struct {
+	Token NodeToken
+}
+
+// Error implements the error interface for InvalidNodeTokenError
+func (e InvalidNodeTokenError) Error() string {
+	return fmt.Sprintf("Invalid node token %q", string(e.Token))
+}
+
+// StaleNodeTokenError indicates that the node referenced by a
+// NodeToken no longer exists where the token expects it to.
+type StaleNodeTokenError struct {
+	Tlf    tlf.ID
+	Path   string
+	Reason string
+}
+
+// Error implements the error interface for StaleNodeTokenError
+func (e StaleNodeTokenError) Error() string {
+	return fmt.Sprintf("Node token for %s in folder %s is stale: %s",
+		e.Path, e.Tlf, e.Reason)
+}
+
+// ContentPolicyAdminError indicates that a user tried to change the
+// content policy of a TLF they aren't an admin of.
+type ContentPolicyAdminError struct {
+	User libkb.NormalizedUsername
+	Tlf  string
+}
+
+// Error implements the error interface for ContentPolicyAdminError
+func (e ContentPolicyAdminError) Error() string {
+	return fmt.Sprintf("%s can't change the content policy of %s, "+
+		"since they aren't an admin of it", e.User, e.Tlf)
+}
+
 // WriteUnsupportedError indicates an error when trying to write a file
 type WriteUnsupportedError struct {
 	Filename string
@@ -852,6 +916,36 @@ func NewRekeyPermissionError(
 	return RekeyPermissionError{username, dirname}
 }
 
+// ReaderMDChangeError indicates that a user who is only a reader of
+// a top-level folder tried to put an MD update that changes more
+// than its own reader keys and the rekey bit.
+type ReaderMDChangeError struct {
+	User libkb.NormalizedUsername
+	Dir  string
+	Rev  kbfsmd.Revision
+}
+
+// Error implements the error interface for ReaderMDChangeError.
+func (e ReaderMDChangeError) Error() string {
+	return fmt.Sprintf("%s is only a reader of directory %s, but revision "+
+		"%d changes more than their reader keys", e.User, e.Dir, e.Rev)
+}
+
+// MDPutValidationError indicates that an MD update failed the
+// client-side consistency checks that run before every put, and so
+// was never sent to the server.
+type MDPutValidationError struct {
+	Tlf tlf.ID
+	Rev kbfsmd.Revision
+	Err error
+}
+
+// Error implements the error interface for MDPutValidationError.
+func (e MDPutValidationError) Error() string {
+	return fmt.Sprintf("Invalid MD update for revision %d of TLF %s: %v",
+		e.Rev, e.Tlf, e.Err)
+}
+
 // RekeyIncompleteError is returned when a rekey is partially done but
 // needs a writer to finish it.
 type RekeyIncompleteError struct{}
@@ -994,6 +1088,103 @@ func (w OverQuotaWarning) Error() string {
 		"to %d bytes.  Please delete some data.", w.UsageBytes, w.LimitBytes)
 }
 
+// BlockServerDiskVersionError indicates that a local block server
+// directory was written by a newer version of KBFS, with a layout
+// this version can't read.
+type BlockServerDiskVersionError struct {
+	Path       string
+	Version    blockServerDiskVersion
+	MaxVersion blockServerDiskVersion
+}
+
+// Error implements the error interface for BlockServerDiskVersionError.
+func (e BlockServerDiskVersionError) Error() string {
+	return fmt.Sprintf("The block server directory %s is at version %d, "+
+		"but this version of KBFS only understands versions up to %d.  "+
+		"Please upgrade KBFS, or move the directory aside.",
+		e.Path, e.Version, e.MaxVersion)
+}
+
+// DiskSpaceLowWarning indicates that there wasn't enough free disk
+// space to start keeping some local state, like a disk cache or a
+// journal, so KBFS is running without it.
+type DiskSpaceLowWarning struct {
+	Path           string
+	What           string
+	AvailableBytes int64
+	MinBytes       int64
+}
+
+// Error implements the error interface for DiskSpaceLowWarning.
+func (w DiskSpaceLowWarning) Error() string {
+	return fmt.Sprintf("Only %d bytes are free on the disk holding %s, "+
+		"so the %s is disabled until at least %d bytes are free.  "+
+		"Please free up some disk space.",
+		w.AvailableBytes, w.Path, w.What, w.MinBytes)
+}
+
+// TlfUsageGrowthWarning indicates that a TLF grew by more than the
+// configured threshold within the configured window.
+type TlfUsageGrowthWarning struct {
+	Tlf         tlf.CanonicalName
+	GrowthBytes uint64
+	Window      time.Duration
+	UsageBytes  uint64
+}
+
+// Error implements the error interface for TlfUsageGrowthWarning.
+func (w TlfUsageGrowthWarning) Error() string {
+	return fmt.Sprintf("%s grew by %d bytes in less than %s, and is now "+
+		"using %d bytes.", w.Tlf, w.GrowthBytes, w.Window, w.UsageBytes)
+}
+
+// TlfUsageMarkWarning indicates that a TLF grew past one of the
+// configured size marks.
+type TlfUsageMarkWarning struct {
+	Tlf        tlf.CanonicalName
+	MarkBytes  uint64
+	UsageBytes uint64
+}
+
+// Error implements the error interface for TlfUsageMarkWarning.
+func (w TlfUsageMarkWarning) Error() string {
+	return fmt.Sprintf("%s is now using %d bytes, which is past the "+
+		"%d-byte mark.", w.Tlf, w.UsageBytes, w.MarkBytes)
+}
+
+// UnsyncedChangesLostError indicates that KBFS last exited, at
+// `Time`, with changes to the given files that had never been synced
+// to the server, and are now gone.
+type UnsyncedChangesLostError struct {
+	Tlf   tlf.CanonicalName
+	Time  time.Time
+	Paths []string
+}
+
+// Error implements the error interface for UnsyncedChangesLostError.
+func (e UnsyncedChangesLostError) Error() string {
+	return fmt.Sprintf("KBFS exited at %s before it could sync changes "+
+		"to %d files in %s: %v", e.Time.Format(time.RFC3339),
+		len(e.Paths), e.Tlf, e.Paths)
+}
+
+// QuarantinedError is returned for operations on a TLF that the
+// server has quarantined (e.g., for abuse or a legal hold).  Writes
+// always fail; reads fail only if the server has blocked them too.
+type QuarantinedError struct {
+	Tlf    tlf.CanonicalName
+	Reason string
+}
+
+// Error implements the error interface for QuarantinedError.
+func (e QuarantinedError) Error() string {
+	msg := fmt.Sprintf("%s has been quarantined by the server", e.Tlf)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
 // OpsCantHandleFavorite means that folderBranchOps wasn't able to
 // deal with a favorites request.
 type OpsCantHandleFavorite struct {
@@ -1060,6 +1251,16 @@ func (e blockNonExistentError) Error() string {
 	return fmt.Sprintf("block %s does not exist", e.id)
 }
 
+// blockColdError is returned by a blockDiskStore when a block's data
+// has been moved to a cold store.
+type blockColdError struct {
+	id kbfsblock.ID
+}
+
+func (e blockColdError) Error() string {
+	return fmt.Sprintf("block %s is in cold storage", e.id)
+}
+
 type cachePutCacheFullError struct {
 	blockID kbfsblock.ID
 }
@@ -1123,6 +1324,18 @@ func (e DiskCacheStartingError) Error() string {
 		"still starting", e.op)
 }
 
+// RetainedBranchNotFoundError indicates that a branch name doesn't
+// refer to any pruned branch that's still being retained.
+type RetainedBranchNotFoundError struct {
+	fb FolderBranch
+}
+
+// Error implements the error interface for RetainedBranchNotFoundError.
+func (e RetainedBranchNotFoundError) Error() string {
+	return fmt.Sprintf("No retained branch %s for folder %s",
+		e.fb.Branch, e.fb.Tlf)
+}
+
 // NoUpdatesWhileDirtyError indicates that updates aren't being
 // accepted while a TLF is locally dirty.
 type NoUpdatesWhileDirtyError struct{}
@@ -1132,6 +1345,28 @@ func (e NoUpdatesWhileDirtyError) Error() string {
 	return "Ignoring MD updates while writes are dirty"
 }
 
+// SyncCanceledError indicates that a sync was canceled, via
+// CancelSync, before all of its blocks were put.  All of the local
+// changes it was syncing are still dirty, and will be synced by the
+// next sync.
+type SyncCanceledError struct{}
+
+// Error implements the error interface for SyncCanceledError.
+func (e SyncCanceledError) Error() string {
+	return "Sync canceled"
+}
+
+// UnknownTuningProfileError indicates that there's no tuning profile
+// with the given name.
+type UnknownTuningProfileError struct {
+	Name TuningProfileName
+}
+
+// Error implements the error interface for UnknownTuningProfileError.
+func (e UnknownTuningProfileError) Error() string {
+	return fmt.Sprintf("Unknown tuning profile %q", e.Name)
+}
+
 // Disk Cache Errors
 const (
 	// StatusCodeDiskBlockCacheError is a generic disk cache error.
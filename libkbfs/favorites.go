@@ -65,6 +65,13 @@ type Favorites struct {
 	inFlightLock sync.Mutex
 	inFlightAdds map[favToAdd]*favReq
 
+	// coldStartLock protects coldStart, a list of favorites loaded
+	// from a local favorites bundle, which Get returns until the
+	// list has been fetched from the server once.
+	coldStartLock      sync.Mutex
+	coldStart          []Favorite
+	coldStartRefreshed bool
+
 	muShutdown sync.RWMutex
 	shutdown   bool
 }
@@ -113,6 +120,7 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 		for _, folder := range folders {
 			f.cache[*NewFavoriteFromFolder(folder)] = true
 		}
+		f.setColdStart(nil)
 		session, err := f.config.KBPKI().GetCurrentSession(req.ctx)
 		if err == nil {
 			// Add favorites for the current user, that cannot be deleted.
@@ -311,12 +319,43 @@ func (f *Favorites) RefreshCache(ctx context.Context) {
 	}
 }
 
+func (f *Favorites) setColdStart(favs []Favorite) {
+	f.coldStartLock.Lock()
+	defer f.coldStartLock.Unlock()
+	f.coldStart = favs
+	f.coldStartRefreshed = false
+}
+
+// getColdStart returns a copy of the locally-stored favorites list,
+// if the server's hasn't been fetched yet, and whether this is the
+// first time it has been returned.
+func (f *Favorites) getColdStart() (favs []Favorite, first bool) {
+	f.coldStartLock.Lock()
+	defer f.coldStartLock.Unlock()
+	if f.coldStart == nil {
+		return nil, false
+	}
+	favs = make([]Favorite, len(f.coldStart))
+	copy(favs, f.coldStart)
+	first = !f.coldStartRefreshed
+	f.coldStartRefreshed = true
+	return favs, first
+}
+
 // Get returns the logged-in users list of favorites. It
-// doesn't use the cache.
+// doesn't use the cache, unless the list hasn't been fetched from
+// the server yet and a locally-stored list is available, in which
+// case it returns that list and refreshes it in the background.
 func (f *Favorites) Get(ctx context.Context) ([]Favorite, error) {
 	if f.hasShutdown() {
 		return nil, ShutdownHappenedError{}
 	}
+	if favs, first := f.getColdStart(); favs != nil {
+		if first {
+			f.RefreshCache(ctx)
+		}
+		return favs, nil
+	}
 	favChan := make(chan []Favorite, 1)
 	req := &favReq{
 		ctx:  ctx,
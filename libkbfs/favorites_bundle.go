@@ -0,0 +1,203 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// favoritesBundleDir is the directory, under the storage root,
+	// where each user's favorites bundle is kept.
+	favoritesBundleDir = "kbfs_favorites"
+	// favoritesBundleVersion is the version of the favorites bundle
+	// format.  Bundles of any other version are ignored.
+	favoritesBundleVersion = 1
+	// favoritesBundleRefreshPeriod is how often the locally-stored
+	// favorites bundle is refreshed in the background.
+	favoritesBundleRefreshPeriod = 10 * time.Minute
+)
+
+// FavoritesBundleEntry describes one of the logged-in user's
+// favorites, along with what was known about its TLF the last time
+// the bundle was refreshed.  The TLF fields are empty for favorites
+// that hadn't been opened yet.
+type FavoritesBundleEntry struct {
+	Favorite
+	TlfID   tlf.ID          `codec:",omitempty"`
+	Head    kbfsmd.Revision `codec:",omitempty"`
+	RootPtr BlockPointer    `codec:",omitempty"`
+}
+
+// FavoritesBundle is a compact snapshot of the logged-in user's
+// favorites, which is stored locally so that a freshly started
+// client can list the user's folders, and find their TLFs, before
+// it hears back from the server.
+type FavoritesBundle struct {
+	Version int
+	UID     keybase1.UID
+	Entries []FavoritesBundleEntry
+}
+
+// Favorites returns the favorites in the bundle.
+func (b FavoritesBundle) Favorites() []Favorite {
+	favs := make([]Favorite, 0, len(b.Entries))
+	for _, e := range b.Entries {
+		favs = append(favs, e.Favorite)
+	}
+	return favs
+}
+
+func favoritesBundlePath(storageRoot string, uid keybase1.UID) string {
+	return filepath.Join(storageRoot, favoritesBundleDir, uid.String())
+}
+
+// makeFavoritesBundleCrypter returns the crypter used for the current
+// device's favorites bundle, since it lists the user's private
+// folders.
+func makeFavoritesBundleCrypter(
+	ctx context.Context, config Config) (*localStorageCrypter, error) {
+	key, err := deriveLocalStorageKey(ctx, config.Crypto())
+	if err != nil {
+		return nil, err
+	}
+	return makeLocalStorageCrypter(key), nil
+}
+
+// ExportFavoritesBundle returns a bundle of the logged-in user's
+// current favorites.  The favorites list is fetched from the server
+// if possible; TLF IDs, heads and root pointers are filled in for the
+// favorites whose TLFs are open.
+func (fs *KBFSOpsStandard) ExportFavoritesBundle(ctx context.Context) (
+	FavoritesBundle, error) {
+	session, err := fs.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return FavoritesBundle{}, err
+	}
+	favs, err := fs.favs.Get(ctx)
+	if err != nil {
+		return FavoritesBundle{}, err
+	}
+
+	bundle := FavoritesBundle{
+		Version: favoritesBundleVersion,
+		UID:     session.UID,
+		Entries: make([]FavoritesBundleEntry, 0, len(favs)),
+	}
+	for _, fav := range favs {
+		entry := FavoritesBundleEntry{Favorite: fav}
+		if fbo := fs.getOpsByFav(fav); fbo != nil {
+			// Read the head directly, rather than through getHead,
+			// so that exporting doesn't count as using the TLF.
+			lState := makeFBOLockState()
+			fbo.headLock.RLock(lState)
+			head := fbo.head
+			fbo.headLock.RUnlock(lState)
+			if head != (ImmutableRootMetadata{}) {
+				entry.TlfID = head.TlfID()
+				entry.Head = head.Revision()
+				entry.RootPtr = head.data.Dir.BlockPointer
+			}
+		}
+		bundle.Entries = append(bundle.Entries, entry)
+	}
+	return bundle, nil
+}
+
+// ImportFavoritesBundle makes the favorites in `bundle` available
+// through GetFavorites until the favorites list is next fetched from
+// the server.  It fails if the bundle isn't for the logged-in user.
+func (fs *KBFSOpsStandard) ImportFavoritesBundle(
+	ctx context.Context, bundle FavoritesBundle) error {
+	if bundle.Version != favoritesBundleVersion {
+		return errors.Errorf(
+			"Unknown favorites bundle version %d", bundle.Version)
+	}
+	session, err := fs.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	if bundle.UID != session.UID {
+		return errors.Errorf("Favorites bundle is for %s, not %s",
+			bundle.UID, session.UID)
+	}
+	fs.log.CDebugf(ctx, "Importing %d favorites from a bundle",
+		len(bundle.Entries))
+	fs.favs.setColdStart(bundle.Favorites())
+	return nil
+}
+
+// saveFavoritesBundle exports the logged-in user's favorites, and
+// stores them under the storage root.
+func (fs *KBFSOpsStandard) saveFavoritesBundle(ctx context.Context) error {
+	bundle, err := fs.ExportFavoritesBundle(ctx)
+	if err != nil {
+		return err
+	}
+	crypter, err := makeFavoritesBundleCrypter(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	return crypter.serializeToFile(fs.config.Codec(), bundle,
+		favoritesBundlePath(fs.config.StorageRoot(), bundle.UID))
+}
+
+// LoadFavoritesBundle imports the logged-in user's favorites bundle
+// from the storage root, if there is one, and then refreshes it in
+// the background until KBFSOpsStandard is shut down.
+func (fs *KBFSOpsStandard) LoadFavoritesBundle(ctx context.Context) error {
+	if fs.config.StorageRoot() == "" {
+		return errors.New("No storage root for the favorites bundle")
+	}
+	go fs.refreshFavoritesBundleLoop()
+
+	session, err := fs.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	crypter, err := makeFavoritesBundleCrypter(ctx, fs.config)
+	if err != nil {
+		return err
+	}
+	var bundle FavoritesBundle
+	err = crypter.deserializeFromFile(fs.config.Codec(),
+		favoritesBundlePath(fs.config.StorageRoot(), session.UID), &bundle)
+	if ioutil.IsNotExist(err) {
+		fs.log.CDebugf(ctx, "No favorites bundle to load")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fs.ImportFavoritesBundle(ctx, bundle)
+}
+
+func (fs *KBFSOpsStandard) refreshFavoritesBundleLoop() {
+	ticker := time.NewTicker(favoritesBundleRefreshPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fs.shutdownChan:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), favoritesBundleRefreshPeriod)
+		err := fs.saveFavoritesBundle(ctx)
+		cancel()
+		if err != nil {
+			fs.log.CDebugf(ctx, "Couldn't refresh the favorites bundle: %+v",
+				err)
+		}
+	}
+}
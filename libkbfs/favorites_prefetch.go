@@ -0,0 +1,153 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"flag"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// FavoritesPrefetchMode represents how much data should be fetched
+// ahead of time, at startup, for each of the logged-in user's
+// favorite TLFs.
+type FavoritesPrefetchMode int
+
+var _ flag.Value = (*FavoritesPrefetchMode)(nil)
+
+const (
+	// FavoritesPrefetchOff indicates that nothing should be
+	// prefetched for favorites.
+	FavoritesPrefetchOff FavoritesPrefetchMode = iota
+	// FavoritesPrefetchMD indicates that the head MD of each favorite
+	// should be fetched, warming up the MD cache.
+	FavoritesPrefetchMD
+	// FavoritesPrefetchRootDir indicates that the root directory
+	// block of each favorite should be fetched, in addition to its
+	// head MD.
+	FavoritesPrefetchRootDir
+)
+
+// favoritesPrefetchParallelism is the maximum number of favorites
+// that are prefetched at once.
+const favoritesPrefetchParallelism = 4
+
+// String outputs a human-readable description of this
+// FavoritesPrefetchMode.
+func (m FavoritesPrefetchMode) String() string {
+	switch m {
+	case FavoritesPrefetchOff:
+		return "off"
+	case FavoritesPrefetchMD:
+		return "md"
+	case FavoritesPrefetchRootDir:
+		return "rootdir"
+	}
+	return "unknown"
+}
+
+// Set parses a string representing a favorites prefetch mode, and
+// outputs the mode value corresponding to that string. Defaults to
+// FavoritesPrefetchOff.
+func (m *FavoritesPrefetchMode) Set(s string) error {
+	*m = FavoritesPrefetchOff
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "md":
+		*m = FavoritesPrefetchMD
+	case "rootdir":
+		*m = FavoritesPrefetchRootDir
+	}
+	return nil
+}
+
+type ctxFavoritesPrefetchTagKey int
+
+const (
+	ctxFavoritesPrefetchIDKey ctxFavoritesPrefetchTagKey = iota
+)
+
+const ctxFavoritesPrefetchID = "FPID"
+
+// prefetchFavorites fetches the head MD (and, depending on `mode`,
+// the root directory block) for each of the logged-in user's
+// favorites, with at most `parallelism` favorites in flight at once.
+// Failures for individual favorites are logged and otherwise
+// ignored, since this is just a best-effort cache warm-up.
+func prefetchFavorites(ctx context.Context, config Config,
+	mode FavoritesPrefetchMode, parallelism int) error {
+	if mode == FavoritesPrefetchOff {
+		return nil
+	}
+
+	log := config.MakeLogger("FAV")
+	ctx = CtxWithRandomIDReplayable(
+		ctx, ctxFavoritesPrefetchIDKey, ctxFavoritesPrefetchID, log)
+	// Don't bother the user with tracker popups for a background
+	// warm-up; TLFIdentifyBehavior_KBFS_QR suppresses them.
+	ctx, err := makeExtendedIdentify(
+		ctx, keybase1.TLFIdentifyBehavior_KBFS_QR)
+	if err != nil {
+		return err
+	}
+
+	favs, err := config.KBFSOps().GetFavorites(ctx)
+	if err != nil {
+		return err
+	}
+	log.CDebugf(ctx, "Prefetching %d favorites (mode=%s)", len(favs), mode)
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, fav := range favs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(fav Favorite) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := prefetchFavorite(ctx, config, fav, mode)
+			if err != nil {
+				log.CDebugf(ctx, "Couldn't prefetch favorite %s (%s): %+v",
+					fav.Name, fav.Type, err)
+			}
+		}(fav)
+	}
+	wg.Wait()
+	log.CDebugf(ctx, "Done prefetching favorites")
+	return nil
+}
+
+func prefetchFavorite(ctx context.Context, config Config, fav Favorite,
+	mode FavoritesPrefetchMode) error {
+	h, err := GetHandleFromFolderNameAndType(
+		ctx, config.KBPKI(), config.MDOps(), fav.Name, fav.Type)
+	if err != nil {
+		return err
+	}
+
+	// Getting the root node sets the head of the TLF, which fetches
+	// its latest MD.  It won't create the TLF if it doesn't exist yet.
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return err
+	}
+	if rootNode == nil || mode != FavoritesPrefetchRootDir {
+		return nil
+	}
+
+	_, err = kbfsOps.GetDirChildren(ctx, rootNode)
+	return err
+}
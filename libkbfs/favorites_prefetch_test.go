@@ -0,0 +1,69 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFavoritesPrefetchModeSet(t *testing.T) {
+	for _, m := range []FavoritesPrefetchMode{
+		FavoritesPrefetchOff, FavoritesPrefetchMD, FavoritesPrefetchRootDir,
+	} {
+		var parsed FavoritesPrefetchMode
+		err := parsed.Set(m.String())
+		require.NoError(t, err)
+		require.Equal(t, m, parsed)
+	}
+
+	m := FavoritesPrefetchMD
+	err := m.Set("bogus")
+	require.NoError(t, err)
+	require.Equal(t, FavoritesPrefetchOff, m)
+}
+
+func TestPrefetchFavorites(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	t.Log("Create a couple of TLFs, which become favorites")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	_, _, err := config.KBFSOps().CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = config.KBFSOps().SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	pubRootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Public)
+	privFB := rootNode.GetFolderBranch()
+	pubFB := pubRootNode.GetFolderBranch()
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps().(*KBFSOpsStandard)
+
+	t.Log("Nothing is fetched when prefetching is off")
+	err = prefetchFavorites(ctx, config2, FavoritesPrefetchOff, 1)
+	require.NoError(t, err)
+	kbfsOps2.opsLock.RLock()
+	require.Len(t, kbfsOps2.ops, 0)
+	kbfsOps2.opsLock.RUnlock()
+
+	t.Log("Prefetching sets up every favorite folder-branch")
+	err = prefetchFavorites(ctx, config2, FavoritesPrefetchRootDir, 1)
+	require.NoError(t, err)
+	kbfsOps2.opsLock.RLock()
+	require.Contains(t, kbfsOps2.ops, privFB)
+	require.Contains(t, kbfsOps2.ops, pubFB)
+	kbfsOps2.opsLock.RUnlock()
+
+	t.Log("The root directory is cached for the next lookup")
+	rootNode2 := GetRootNodeOrBust(
+		ctx, t, config2, "test_user", tlf.Private)
+	children, err := config2.KBFSOps().GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Contains(t, children, "a")
+}
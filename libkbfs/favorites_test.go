@@ -190,3 +190,35 @@ func TestFavoritesListFailsDuringAddAsync(t *testing.T) {
 	f.AddAsync(ctx, fav1) // should work
 	<-c
 }
+
+func TestFavoritesGetColdStart(t *testing.T) {
+	mockCtrl, config, ctx := favTestInit(t)
+	f := NewFavorites(config)
+	defer favTestShutdown(t, mockCtrl, config, f)
+
+	// The locally-stored list is returned right away, while the
+	// server's list is fetched in the background.
+	fav1 := Favorite{"test", tlf.Public}
+	f.setColdStart([]Favorite{fav1})
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).Return(nil, nil)
+	favs, err := f.Get(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get favorites: %v", err)
+	}
+	if len(favs) != 1 || favs[0] != fav1 {
+		t.Fatalf("Unexpected cold-start favorites: %v", favs)
+	}
+	if err := f.wg.Wait(ctx); err != nil {
+		t.Fatalf("Couldn't wait on favorites: %v", err)
+	}
+
+	// Once that's done, Get uses the server again.
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).Return(nil, nil)
+	favs, err = f.Get(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get favorites: %v", err)
+	}
+	if len(favs) != 2 {
+		t.Fatalf("Unexpected favorites: %v", favs)
+	}
+}
@@ -941,6 +941,18 @@ func (fd *fileData) shiftBlocksToFillHole(
 				immedParent.pblock.IPtrs[currIndex],
 				immedParent.pblock.IPtrs[currIndex-1]
 			currIndex--
+			immedParent.childIndex = currIndex
+			parents[len(parents)-1].childIndex = currIndex
+
+			// If the block is now the left-most child of its
+			// parent, the offsets leading to it must move down too.
+			leftDirtyPtrs, leftUnrefs, err := fd.updateLeftEdgeOffsets(
+				parents, newBlockStartOff)
+			newUnrefs = append(newUnrefs, leftUnrefs...)
+			if err != nil {
+				return nil, newUnrefs, 0, err
+			}
+			newDirtyPtrs = append(newDirtyPtrs, leftDirtyPtrs...)
 			continue
 		}
 
@@ -995,6 +1007,16 @@ func (fd *fileData) shiftBlocksToFillHole(
 			}
 		}
 
+		// If the shifted block is now the only child of its new
+		// parent, the offsets leading to it must move down too.
+		leftDirtyPtrs, leftUnrefs, err := fd.updateLeftEdgeOffsets(
+			newParents, newBlockStartOff)
+		newUnrefs = append(newUnrefs, leftUnrefs...)
+		if err != nil {
+			return nil, newUnrefs, 0, err
+		}
+		newDirtyPtrs = append(newDirtyPtrs, leftDirtyPtrs...)
+
 		// Now we need to update the parent offsets on the right side,
 		// all the way up to the common ancestor (which is the one
 		// with the one that doesn't have a childIndex of 0).  (We
@@ -1034,6 +1056,37 @@ func (fd *fileData) shiftBlocksToFillHole(
 	// The loop above must exit via one of the returns.
 }
 
+// updateLeftEdgeOffsets sets the incoming indirect pointer offsets
+// along `parents` to `off`, for as long as the block at the bottom of
+// the path is the left-most child at each level.  It caches every
+// modified block as dirty.
+func (fd *fileData) updateLeftEdgeOffsets(
+	parents []parentBlockAndChildIndex, off int64) (
+	dirtyPtrs []BlockPointer, unrefs []BlockInfo, err error) {
+	for level := len(parents) - 2; level >= 0; level-- {
+		if parents[level+1].childIndex > 0 {
+			break
+		}
+		parents[level].pblock.IPtrs[parents[level].childIndex].Off = off
+
+		ptr := fd.rootBlockPointer()
+		if level > 0 {
+			pb := parents[level-1]
+			ptr = pb.childIPtr().BlockPointer
+			// Remember the size of the dirtied block.
+			if pb.childIPtr().EncodedSize != 0 {
+				unrefs = append(unrefs, pb.childIPtr().BlockInfo)
+				pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
+			}
+		}
+		if err := fd.cacher(ptr, parents[level].pblock); err != nil {
+			return nil, unrefs, err
+		}
+		dirtyPtrs = append(dirtyPtrs, ptr)
+	}
+	return dirtyPtrs, unrefs, nil
+}
+
 // markParentsDirty caches all the blocks in `parentBlocks` as dirty,
 // and returns the dirtied block pointers as well as any block infos
 // with non-zero encoded sizes that will now need to be unreferenced.
@@ -1103,11 +1156,13 @@ func (fd *fileData) write(ctx context.Context, data []byte, off int64,
 			}
 		}
 		oldNCopied := nCopied
+		block.unshareContents()
 		nCopied += fd.bsplit.CopyUntilSplit(
 			block, nextBlockOff < 0, data[nCopied:max], off+nCopied-startOff)
 
 		// If we need another block but there are no more, then make one.
 		switchToIndirect := false
+		addedLevel := false
 		if nCopied < n {
 			needExtendFile := nextBlockOff < 0
 			needFillHole := off+nCopied < nextBlockOff
@@ -1146,6 +1201,7 @@ func (fd *fileData) write(ctx context.Context, data []byte, off int64,
 				if err != nil {
 					return newDe, nil, unrefs, newlyDirtiedChildBytes, 0, err
 				}
+				addedLevel = wasIndirect && rightParents[0].pblock != topBlock
 				topBlock = rightParents[0].pblock
 				for _, p := range newDirtyPtrs {
 					dirtyMap[p] = true
@@ -1186,9 +1242,12 @@ func (fd *fileData) write(ctx context.Context, data []byte, off int64,
 		// Nothing was copied, no need to dirty anything.  This can
 		// happen when trying to append to the contents of the file
 		// (i.e., either to the end of the file or right before the
-		// "hole"), and the last block is already full.
+		// "hole"), and the last block is already full.  If a new
+		// level of indirection was added, though, the path to this
+		// block must still be dirtied, so that the old top block is
+		// readied under its new ID during the next sync.
 		if nCopied == oldNCopied && oldLen == len(block.Contents) &&
-			!switchToIndirect {
+			!switchToIndirect && !addedLevel {
 			continue
 		}
 
@@ -1358,9 +1417,6 @@ func (fd *fileData) truncateShrink(ctx context.Context, size uint64,
 	}
 
 	if nextBlockOff > 0 {
-		// TODO: remove any unnecessary levels of indirection if the
-		// number of leaf nodes shrinks significantly (KBFS-1824).
-
 		// Get all paths to any leaf nodes following the new
 		// right-most block, since those blocks need to be
 		// unreferenced, and their parents need to be modified or
@@ -1407,8 +1463,11 @@ func (fd *fileData) truncateShrink(ctx context.Context, size uint64,
 					// If we remove iptr 0, this block can be
 					// unreferenced (unless it's on the left-most edge
 					// of the tree, in which case we keep it around
-					// for now -- see above TODO).
-					if pb.childIndex == 0 && !leftMost {
+					// until `collapseIndirection` below decides
+					// whether it is still needed).  Note that iptr 0
+					// is kept if the path continues past the first
+					// child of some lower level.
+					if removeStartingFromIndex == 0 && !leftMost {
 						if parentInfo.EncodedSize != 0 {
 							unrefs = append(unrefs, parentInfo)
 						}
@@ -1449,6 +1508,15 @@ func (fd *fileData) truncateShrink(ctx context.Context, size uint64,
 		}
 	}
 
+	// Remove any levels of indirection that are no longer needed
+	// now that the file has fewer leaf blocks (KBFS-1824).
+	ptr, block, collapsedUnrefs, err := fd.collapseIndirection(
+		ctx, topBlock, ptr, block, dirtyMap)
+	unrefs = append(unrefs, collapsedUnrefs...)
+	if err != nil {
+		return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, err
+	}
+
 	if topBlock.IsInd {
 		// Always make the top block dirty, so we will sync its
 		// indirect blocks.  This has the added benefit of ensuring
@@ -1480,6 +1548,56 @@ func (fd *fileData) truncateShrink(ctx context.Context, size uint64,
 	return newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, nil
 }
 
+// collapseIndirection removes levels of indirection from the top of
+// the file tree for as long as the top block has only a single
+// child.  If that child is another indirect block, its pointers are
+// pulled up into the top block; if it is the leaf block `block` at
+// `ptr`, its contents are moved into the top block, which becomes a
+// direct block.  Any removed blocks are dropped from `dirtyMap`, and
+// the ones that had already been synced are returned in `unrefs`.
+// The returned pointer and block are those of the (possibly new)
+// location of the file's final leaf block.
+func (fd *fileData) collapseIndirection(ctx context.Context,
+	topBlock *FileBlock, ptr BlockPointer, block *FileBlock,
+	dirtyMap map[BlockPointer]bool) (
+	newPtr BlockPointer, newBlock *FileBlock, unrefs []BlockInfo,
+	err error) {
+	for topBlock.IsInd && len(topBlock.IPtrs) == 1 {
+		child := topBlock.IPtrs[0]
+		// Any child that was dirtied by this truncate has already
+		// been accounted for by `markParentsDirty`, so only
+		// unreference blocks that still have an encoded size.
+		if child.EncodedSize != 0 {
+			unrefs = append(unrefs, child.BlockInfo)
+		}
+		delete(dirtyMap, child.BlockPointer)
+
+		if child.BlockPointer == ptr {
+			fd.log.CDebugf(ctx, "collapseIndirection: making block "+
+				"direct %v", fd.rootBlockPointer())
+			topBlock.IsInd = false
+			topBlock.IPtrs = nil
+			topBlock.Contents = block.Contents
+			return fd.rootBlockPointer(), topBlock, unrefs, nil
+		}
+
+		cblock, _, err := fd.getter(
+			ctx, fd.kmd, child.BlockPointer, fd.file, blockWrite)
+		if err != nil {
+			return zeroPtr, nil, unrefs, err
+		}
+		if !cblock.IsInd {
+			return zeroPtr, nil, unrefs, fmt.Errorf(
+				"Unexpected leaf block %v while collapsing %v",
+				child.BlockPointer, fd.rootBlockPointer())
+		}
+		fd.log.CDebugf(ctx, "collapseIndirection: removing indirect "+
+			"block %v", child.BlockPointer)
+		topBlock.IPtrs = cblock.IPtrs
+	}
+	return ptr, block, unrefs, nil
+}
+
 // split, if given an indirect top block of a file, checks whether any
 // of the dirty leaf blocks in that file need to be split up
 // differently (i.e., if the BlockSplitter is using
@@ -1522,6 +1640,9 @@ func (fd *fileData) split(ctx context.Context, id tlf.ID,
 		case splitAt == 0:
 			continue
 		case splitAt > 0:
+			// The right block may end up using the rest of this
+			// block's contents array, so it can't be shared.
+			block.unshareContents()
 			endOfBlock := startOff + int64(len(block.Contents))
 			extraBytes := block.Contents[splitAt:]
 			block.Contents = block.Contents[:splitAt]
@@ -1582,6 +1703,7 @@ func (fd *fileData) split(ctx context.Context, id tlf.ID,
 				return unrefs, err
 			}
 			// Copy some of that block's data into this block.
+			block.unshareContents()
 			nCopied := fd.bsplit.CopyUntilSplit(block, false,
 				rblock.Contents, int64(len(block.Contents)))
 			rblock.Contents = rblock.Contents[nCopied:]
@@ -1810,7 +1932,7 @@ func (fd *fileData) findIPtrsAndClearSize(
 			}
 			infoSeen[parentPtr] = true
 
-			for _, iptr := range pb.pblock.IPtrs {
+			for childIndex, iptr := range pb.pblock.IPtrs {
 				if ptrs[iptr.BlockPointer] {
 					// Mark this pointer, and all parent blocks, as dirty.
 					parentPtr := fd.rootBlockPointer()
@@ -1824,7 +1946,16 @@ func (fd *fileData) findIPtrsAndClearSize(
 						path[i].pblock = pblock
 						parentPtr = path[i].childIPtr().BlockPointer
 					}
-					_, _, err = fd.markParentsDirty(ctx, path[:level+1])
+					// Because we only check each parent once, the
+					// `path` we're using here will be the one with a
+					// childIndex of 0.  But, that's not necessarily the
+					// one that matches the pointer that needs to be
+					// dirty.  So make a new path and set the childIndex
+					// to the correct pointer instead.
+					newPath := make([]parentBlockAndChildIndex, level+1)
+					copy(newPath, path[:level+1])
+					newPath[level].childIndex = childIndex
+					_, _, err = fd.markParentsDirty(ctx, newPath)
 					if err != nil {
 						return nil, err
 					}
@@ -1855,7 +1986,7 @@ func (fd *fileData) deepCopy(ctx context.Context, dataVer DataVer) (
 
 	// Handle the single-level case first.
 	if !topBlock.IsInd {
-		newTopBlock := topBlock.DeepCopy()
+		newTopBlock := topBlock.copyOnWrite()
 		if err != nil {
 			return zeroPtr, nil, err
 		}
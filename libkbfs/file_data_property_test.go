@@ -0,0 +1,225 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const (
+	testFilePropMaxOps = 20
+	// testFilePropSeed is the default seed for generating operation
+	// sequences; set testFilePropSeedEnv to try a different one.
+	testFilePropSeed    = 1
+	testFilePropSeedEnv = "KBFS_TEST_FILE_PROP_SEED"
+)
+
+// testFilePropOp is one randomly-generated operation on a file.
+type testFilePropOp struct {
+	truncate bool
+	off      int64
+	data     []byte
+	// sync says whether to sync the file after this operation.
+	sync bool
+}
+
+func (op testFilePropOp) String() string {
+	s := fmt.Sprintf("write(%d bytes @ %d)", len(op.data), op.off)
+	if op.truncate {
+		s = fmt.Sprintf("truncate(%d)", op.off)
+	}
+	if op.sync {
+		s += "+sync"
+	}
+	return s
+}
+
+// testFilePropOps is a sequence of file operations.
+type testFilePropOps []testFilePropOp
+
+// makeTestFilePropOps randomly generates a sequence of operations on
+// a file of at most about `maxFileSize` bytes.
+func makeTestFilePropOps(r *rand.Rand, maxFileSize int64) testFilePropOps {
+	ops := make(testFilePropOps, 1+r.Intn(testFilePropMaxOps))
+	for i := range ops {
+		ops[i].truncate = r.Intn(4) == 0
+		ops[i].off = r.Int63n(maxFileSize)
+		ops[i].sync = r.Intn(3) == 0
+		if ops[i].truncate {
+			continue
+		}
+		// Never write zeroes, so holes are distinguishable from data.
+		ops[i].data = make([]byte, 1+r.Intn(int(maxFileSize/6)))
+		for j := range ops[i].data {
+			ops[i].data[j] = byte(1 + r.Intn(255))
+		}
+	}
+	return ops
+}
+
+// apply applies `op` to an in-memory reference copy of a file's
+// contents.
+func (op testFilePropOp) apply(model []byte) []byte {
+	if op.truncate {
+		if op.off <= int64(len(model)) {
+			return model[:op.off]
+		}
+		return append(model, make([]byte, op.off-int64(len(model)))...)
+	}
+	end := op.off + int64(len(op.data))
+	if end > int64(len(model)) {
+		model = append(model, make([]byte, end-int64(len(model)))...)
+	}
+	copy(model[op.off:], op.data)
+	return model
+}
+
+// testFilePropCheckBlocks walks the synced block tree under `ptr`,
+// which starts at `off` and must end by `end`, and checks that its
+// indirect pointers are sorted, non-overlapping and readied.  It
+// writes the leaf contents it finds into `contents`, which should be
+// zero-filled beforehand.
+func testFilePropCheckBlocks(ctx context.Context, t *testing.T,
+	ops *folderBranchOps, kmd KeyMetadata, ptr BlockPointer,
+	off, end int64, contents []byte) {
+	lState := makeFBOLockState()
+	block, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, kmd, ptr, MasterBranch, path{})
+	require.NoError(t, err)
+
+	if !block.IsInd {
+		require.True(t, off+int64(len(block.Contents)) <= end,
+			"Leaf at %d with %d bytes overlaps %d",
+			off, len(block.Contents), end)
+		copy(contents[off:], block.Contents)
+		return
+	}
+
+	require.NotEmpty(t, block.IPtrs)
+	require.Equal(t, off, block.IPtrs[0].Off)
+	for i, iptr := range block.IPtrs {
+		require.True(t, iptr.BlockPointer.IsValid(),
+			"Unreadied pointer at offset %d", iptr.Off)
+		childEnd := end
+		if i+1 < len(block.IPtrs) {
+			childEnd = block.IPtrs[i+1].Off
+			require.True(t, iptr.Off < childEnd,
+				"Unsorted offsets %d and %d", iptr.Off, childEnd)
+		}
+		require.True(t, iptr.Off <= end,
+			"Pointer at %d past the end %d", iptr.Off, end)
+		testFilePropCheckBlocks(
+			ctx, t, ops, kmd, iptr.BlockPointer, iptr.Off, childEnd,
+			contents)
+	}
+}
+
+func testFilePropSyncAndCheck(ctx context.Context, t *testing.T,
+	config Config, fileNode Node, model []byte) {
+	kbfsOps := config.KBFSOps()
+	err := kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, fileNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	kmd, _ := ops.getHead(lState)
+	file := ops.nodeCache.PathFromNode(fileNode)
+	contents := make([]byte, len(model))
+	testFilePropCheckBlocks(
+		ctx, t, ops, kmd, file.tailPointer(), 0, int64(len(model)),
+		contents)
+	require.True(t, bytes.Equal(model, contents),
+		"Synced blocks don't match the model")
+}
+
+func testFileDataProperties(t *testing.T, maxBlockSize int64,
+	maxPtrsPerBlock int, maxFileSize int64) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockSplitter(
+		&BlockSplitterSimple{maxBlockSize, maxPtrsPerBlock, 8 * 1024, 0})
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+
+	i := 0
+	check := func(fileOps testFilePropOps) bool {
+		i++
+		t.Logf("Sequence %d: %v", i, fileOps)
+		fileNode, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, fmt.Sprintf("f%d", i), false, NoExcl)
+		require.NoError(t, err)
+
+		var model []byte
+		for _, op := range fileOps {
+			if op.truncate {
+				err = kbfsOps.Truncate(ctx, fileNode, uint64(op.off))
+			} else {
+				err = kbfsOps.Write(ctx, fileNode, op.data, op.off)
+			}
+			require.NoError(t, err)
+			model = op.apply(model)
+
+			got := make([]byte, len(model)+1)
+			n, err := kbfsOps.Read(ctx, fileNode, got, 0)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(model, got[:n]),
+				"Contents don't match the model after %s", op)
+
+			if op.sync {
+				testFilePropSyncAndCheck(ctx, t, config, fileNode, model)
+			}
+		}
+		testFilePropSyncAndCheck(ctx, t, config, fileNode, model)
+		return true
+	}
+
+	seed := int64(testFilePropSeed)
+	if s := os.Getenv(testFilePropSeedEnv); s != "" {
+		var err error
+		seed, err = strconv.ParseInt(s, 10, 64)
+		require.NoError(t, err)
+	}
+	t.Logf("Seed: %d", seed)
+	err := quick.Check(check, &quick.Config{
+		MaxCount: 10,
+		Rand:     rand.New(rand.NewSource(seed)),
+		Values: func(args []reflect.Value, r *rand.Rand) {
+			args[0] = reflect.ValueOf(makeTestFilePropOps(r, maxFileSize))
+		},
+	})
+	require.NoError(t, err)
+}
+
+// Test that arbitrary sequences of writes and truncates produce the
+// same contents as a simple in-memory model, and leave a well-formed
+// block tree after every sync, for a variety of split boundaries.
+// Files are kept smaller for the smallest blocks, since their block
+// trees get deep quickly, and each sync walks the whole tree.
+func TestFileDataProperties(t *testing.T) {
+	for _, split := range []struct {
+		maxBlockSize    int64
+		maxPtrsPerBlock int
+		maxFileSize     int64
+	}{{8, 2, 200}, {20, 3, 600}, {64, 4, 600}} {
+		// capture range variable.
+		split := split
+		t.Run(fmt.Sprintf("%dBytes%dPtrs",
+			split.maxBlockSize, split.maxPtrsPerBlock), func(t *testing.T) {
+			testFileDataProperties(t, split.maxBlockSize,
+				split.maxPtrsPerBlock, split.maxFileSize)
+		})
+	}
+}
@@ -31,7 +31,7 @@ func setupFileDataTest(t *testing.T, maxBlockSize int64,
 	file := path{FolderBranch{Tlf: id}, []pathNode{{ptr, "file"}}}
 	chargedTo := keybase1.MakeTestUID(1).AsUserOrTeam()
 	crypto := MakeCryptoCommon(kbfscodec.NewMsgpack())
-	bsplit := &BlockSplitterSimple{maxBlockSize, maxPtrsPerBlock, 10}
+	bsplit := &BlockSplitterSimple{maxBlockSize, maxPtrsPerBlock, 10, 0}
 	kmd := emptyKeyMetadata{id, 1}
 
 	cleanCache := NewBlockCacheStandard(1<<10, 1<<20)
@@ -129,11 +129,11 @@ func testFileDataLevelFromData(t *testing.T, maxBlockSize int64,
 		prevChildren = append(prevChildren, newChild)
 	}
 
-	// Now fill in any parents.  If this is a shrink, force the new
-	// data to have the same number of levels (we never remove levels
-	// of indirection at the moment).
+	// Now fill in any parents.  A shrink removes any levels of
+	// indirection that are no longer needed, so the expected tree
+	// never has more levels than the data requires.
 	newLevels := 1
-	for len(prevChildren) != 1 || (endWrite < 0 && newLevels < existingLevels) {
+	for len(prevChildren) != 1 {
 		prevChildIndex := 0
 		var level []testFileDataLevel
 
@@ -440,8 +440,15 @@ func testFileDataWriteExtendExistingFile(t *testing.T, maxBlockSize int64,
 			Size: uint64(existingLen),
 		},
 	}
+	// If the existing blocks fill up a full level, the last existing
+	// block gets dirtied too, because it (or the old top block) needs
+	// to be inserted under a new ID.
+	dirtyStart := existingLen
+	if existingLen >= maxBlockSize {
+		dirtyStart = existingLen - 1
+	}
 	expectedTopLevel := testFileDataLevelFromData(
-		t, maxBlockSize, maxPtrsPerBlock, levels, fullDataLen, nil, existingLen,
+		t, maxBlockSize, maxPtrsPerBlock, levels, fullDataLen, nil, dirtyStart,
 		fullDataLen, 0, false)
 
 	extendedBytes := fullDataLen - existingLen
@@ -451,10 +458,9 @@ func testFileDataWriteExtendExistingFile(t *testing.T, maxBlockSize int64,
 	if remainder > 0 {
 		dirtiedBytes += (maxBlockSize - remainder)
 	}
-	// Add a block's worth of dirty bytes if we're extending past the
-	// first full level, because the original block still gets dirtied
-	// because it needs to be inserted under a new ID.
-	if existingLen == maxBlockSize {
+	// Add a block's worth of dirty bytes if we're extending past a
+	// full level, as explained above.
+	if existingLen >= maxBlockSize {
 		dirtiedBytes += maxBlockSize
 	}
 	testFileDataCheckWrite(
@@ -771,6 +777,8 @@ func TestFileDataTruncateShrink(t *testing.T) {
 		{"WithinBlock", 6, 5},
 		{"WithinLevel", 8, 5},
 		{"ToZero", 8, 0},
+		{"RemoveLevel", 8, 3},
+		{"ToOneBlock", 8, 1},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,102 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// fileOpSequencer makes the data-changing operations on each file
+// (writes, truncates and preallocations) take effect one at a time,
+// in the order they started.  Without it, an operation that's
+// waiting for room in the dirty block cache, or for deferred writes
+// to drain, could be overtaken by a later operation on the same file
+// that didn't have to wait, so two calls made one after the other by
+// a frontend might be applied in the opposite order.
+//
+// Since each operation runs to completion in its turn, a write or
+// truncate is applied in full, never interleaved with another
+// operation on the same file.  Operations that land while the file
+// is being synced are deferred and replayed after the sync in the
+// same order, so the order holds across syncs too.
+type fileOpSequencer struct {
+	lock sync.Mutex
+	// queues holds the files with operations in progress or waiting
+	// for their turn.
+	queues map[NodeID]*fileOpQueue
+}
+
+type fileOpQueue struct {
+	// tail is closed when the last operation in the queue is done.
+	tail chan struct{}
+	// n counts the operations in the queue.
+	n int
+}
+
+func newFileOpSequencer() *fileOpSequencer {
+	return &fileOpSequencer{
+		queues: make(map[NodeID]*fileOpQueue),
+	}
+}
+
+// wait blocks until every earlier operation on `file` is done, and
+// then returns a function that must be called once this operation
+// is done.  If `ctx` is canceled first, it returns the context's
+// error, and the operations that started after this one still wait
+// for the earlier ones.
+func (fos *fileOpSequencer) wait(
+	ctx context.Context, file NodeID) (func(), error) {
+	mine := make(chan struct{})
+	fos.lock.Lock()
+	q, ok := fos.queues[file]
+	if !ok {
+		q = &fileOpQueue{}
+		fos.queues[file] = q
+	}
+	prev := q.tail
+	q.tail = mine
+	q.n++
+	fos.lock.Unlock()
+
+	done := func() {
+		fos.lock.Lock()
+		defer fos.lock.Unlock()
+		q.n--
+		if q.n == 0 {
+			delete(fos.queues, file)
+		}
+		close(mine)
+	}
+
+	if prev == nil {
+		return done, nil
+	}
+	select {
+	case <-prev:
+		return done, nil
+	case <-ctx.Done():
+		// Give up our turn only once it comes, so that nothing
+		// behind us can overtake `prev`.
+		go func() {
+			<-prev
+			done()
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// queuedForTest returns the number of operations on `file` that are
+// in progress or waiting for their turn.
+func (fos *fileOpSequencer) queuedForTest(file NodeID) int {
+	fos.lock.Lock()
+	defer fos.lock.Unlock()
+	q, ok := fos.queues[file]
+	if !ok {
+		return 0
+	}
+	return q.n
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// waitForFileOpsQueued waits until `n` operations on `file` are in
+// progress or waiting for their turn.
+func waitForFileOpsQueued(
+	ctx context.Context, t *testing.T, fos *fileOpSequencer, file NodeID,
+	n int) {
+	for fos.queuedForTest(file) != n {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("Timeout waiting for %d queued ops: %v", n, ctx.Err())
+		}
+	}
+}
+
+func TestFileOpSequencerOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	file := NewMockNodeID(mockCtrl)
+	other := NewMockNodeID(mockCtrl)
+	fos := newFileOpSequencer()
+
+	t.Log("Hold the first turn, and queue up more operations")
+	done, err := fos.wait(ctx, file)
+	require.NoError(t, err)
+	const numOps = 10
+	order := make(chan int, numOps)
+	errCh := make(chan error, numOps)
+	for i := 0; i < numOps; i++ {
+		go func(i int) {
+			done, err := fos.wait(ctx, file)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			order <- i
+			done()
+			errCh <- nil
+		}(i)
+		waitForFileOpsQueued(ctx, t, fos, file, i+2)
+	}
+
+	t.Log("Other files don't wait")
+	doneOther, err := fos.wait(ctx, other)
+	require.NoError(t, err)
+	doneOther()
+	require.Len(t, order, 0)
+
+	t.Log("The operations run in the order they started")
+	done()
+	for i := 0; i < numOps; i++ {
+		require.NoError(t, <-errCh)
+	}
+	for i := 0; i < numOps; i++ {
+		require.Equal(t, i, <-order)
+	}
+	require.Equal(t, 0, fos.queuedForTest(file))
+	require.Equal(t, 0, fos.queuedForTest(other))
+}
+
+func TestFileOpSequencerCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	file := NewMockNodeID(mockCtrl)
+	fos := newFileOpSequencer()
+
+	done1, err := fos.wait(ctx, file)
+	require.NoError(t, err)
+
+	t.Log("Cancel an operation while it waits for its turn")
+	ctx2, cancel2 := context.WithCancel(ctx)
+	err2Ch := make(chan error, 1)
+	go func() {
+		_, err := fos.wait(ctx2, file)
+		err2Ch <- err
+	}()
+	waitForFileOpsQueued(ctx, t, fos, file, 2)
+	cancel2()
+	require.Equal(t, context.Canceled, <-err2Ch)
+
+	t.Log("A later operation still waits for the first one")
+	ran3 := make(chan error, 1)
+	go func() {
+		done3, err := fos.wait(ctx, file)
+		if err == nil {
+			done3()
+		}
+		ran3 <- err
+	}()
+	waitForFileOpsQueued(ctx, t, fos, file, 3)
+	select {
+	case <-ran3:
+		t.Fatal("Operation overtook an earlier one")
+	default:
+	}
+
+	done1()
+	select {
+	case err := <-ran3:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for operation: %v", ctx.Err())
+	}
+	waitForFileOpsQueued(ctx, t, fos, file, 0)
+}
+
+func TestFileOpSequencerCancelLast(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	file := NewMockNodeID(mockCtrl)
+	fos := newFileOpSequencer()
+
+	done1, err := fos.wait(ctx, file)
+	require.NoError(t, err)
+
+	t.Log("Cancel the last waiting operation")
+	ctx2, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	done2, err := fos.wait(ctx2, file)
+	require.Equal(t, context.Canceled, err)
+	require.Nil(t, done2)
+	require.Equal(t, 2, fos.queuedForTest(file))
+
+	t.Log("The canceled operation gives up its turn once it comes")
+	done1()
+	waitForFileOpsQueued(ctx, t, fos, file, 0)
+
+	t.Log("The file can be used again afterwards")
+	done3, err := fos.wait(ctx, file)
+	require.NoError(t, err)
+	done3()
+	require.Equal(t, 0, fos.queuedForTest(file))
+}
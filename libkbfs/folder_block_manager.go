@@ -115,6 +115,20 @@ type folderBlockManager struct {
 	lastQROldEnoughRev  kbfsmd.Revision
 	wasLastQRComplete   bool
 	lastReclamationTime time.Time
+
+	// Revisions that readers still need the blocks for.  Quota
+	// reclamation won't delete any block that is referenced by a
+	// leased revision, until the lease expires or is released.
+	leaseLock   sync.Mutex
+	leases      map[uint64]revisionLease
+	nextLeaseID uint64
+}
+
+// revisionLease represents a reader's interest in the block set of a
+// particular revision.
+type revisionLease struct {
+	rev        kbfsmd.Revision
+	expiration time.Time
 }
 
 func newFolderBlockManager(config Config, fb FolderBranch,
@@ -133,16 +147,17 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 		blocksToDeletePauseChan:   make(chan (<-chan struct{})),
 		forceReclamationChan:      make(chan struct{}, 1),
 		helper:                    helper,
+		leases:                    make(map[uint64]revisionLease),
 	}
 	// Pass in the BlockOps here so that the archive goroutine
 	// doesn't do possibly-racy-in-tests access to
 	// fbm.config.BlockOps().
 
-	if config.Mode() == InitMinimal {
-		// If this device is in minimal mode and won't be doing any
-		// data writes, no need deal with block-level cleanup
-		// operations.  TODO: in the future it might still be useful
-		// to have e.g. mobile devices doing QR.
+	if config.Mode() == InitMinimal || config.Mode() == InitReadOnly {
+		// If this device is in minimal or read-only mode and won't be
+		// doing any data writes, no need deal with block-level
+		// cleanup operations.  TODO: in the future it might still be
+		// useful to have e.g. mobile devices doing QR.
 		return fbm
 	}
 
@@ -413,6 +428,15 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 		len(ptrs), archive)
 	bops := fbm.config.BlockOps()
 
+	// Inlined files have no blocks on the server to downgrade.
+	serverPtrs := make([]BlockPointer, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		if ptr.DataVer != InlineDataVer {
+			serverPtrs = append(serverPtrs, ptr)
+		}
+	}
+	ptrs = serverPtrs
+
 	// Round up to find the number of chunks.
 	numChunks := (len(ptrs) + numPointersToDowngradePerChunk - 1) /
 		numPointersToDowngradePerChunk
@@ -604,7 +628,8 @@ const CtxFBMOpID = "FBMID"
 
 func (fbm *folderBlockManager) ctxWithFBMID(
 	ctx context.Context) context.Context {
-	return CtxWithRandomIDReplayable(ctx, CtxFBMIDKey, CtxFBMOpID, fbm.log)
+	ctx = CtxWithRandomIDReplayable(ctx, CtxFBMIDKey, CtxFBMOpID, fbm.log)
+	return NewContextWithBlockFetchClass(ctx, BlockFetchBackground)
 }
 
 // Run the passed function with a context that's canceled on shutdown.
@@ -727,6 +752,48 @@ func (fbm *folderBlockManager) deleteBlocksInBackground() {
 	}
 }
 
+// leaseRevision prevents quota reclamation from deleting any of the
+// blocks referenced by revision `rev`, for at most `d`.  This lets a
+// long-running read of an old revision complete safely.  The
+// returned function releases the lease early, and is idempotent.
+func (fbm *folderBlockManager) leaseRevision(
+	rev kbfsmd.Revision, d time.Duration) (release func()) {
+	fbm.leaseLock.Lock()
+	defer fbm.leaseLock.Unlock()
+	id := fbm.nextLeaseID
+	fbm.nextLeaseID++
+	fbm.leases[id] = revisionLease{
+		rev:        rev,
+		expiration: fbm.config.Clock().Now().Add(d),
+	}
+	return func() {
+		fbm.leaseLock.Lock()
+		defer fbm.leaseLock.Unlock()
+		delete(fbm.leases, id)
+	}
+}
+
+// getEarliestLeasedRevision returns the earliest revision with a
+// lease that hasn't expired as of `now`, or
+// kbfsmd.RevisionUninitialized if there is none.  Expired leases are
+// forgotten.
+func (fbm *folderBlockManager) getEarliestLeasedRevision(
+	now time.Time) kbfsmd.Revision {
+	fbm.leaseLock.Lock()
+	defer fbm.leaseLock.Unlock()
+	earliest := kbfsmd.RevisionUninitialized
+	for id, lease := range fbm.leases {
+		if !now.Before(lease.expiration) {
+			delete(fbm.leases, id)
+			continue
+		}
+		if earliest == kbfsmd.RevisionUninitialized || lease.rev < earliest {
+			earliest = lease.rev
+		}
+	}
+	return earliest
+}
+
 func (fbm *folderBlockManager) isOldEnough(rmd ImmutableRootMetadata) bool {
 	// Trust the server's timestamp on this MD.
 	mtime := rmd.localTimestamp
@@ -1119,6 +1186,23 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		return nil
 	}
 
+	// Blocks unreferenced after a leased revision are still needed
+	// by whoever holds the lease, so stop reclaiming just after it.
+	leasedRev := fbm.getEarliestLeasedRevision(fbm.config.Clock().Now())
+	leased := false
+	if leasedRev != kbfsmd.RevisionUninitialized &&
+		leasedRev < mostRecentOldEnoughRev {
+		leased = true
+		fbm.log.CDebugf(ctx, "Revision %d is leased; not reclaiming "+
+			"past it (instead of %d)", leasedRev, mostRecentOldEnoughRev)
+		mostRecentOldEnoughRev = leasedRev
+		if mostRecentOldEnoughRev <= lastGCRev {
+			// Try again once the lease is gone.
+			complete = false
+			return nil
+		}
+	}
+
 	// Don't try to do too many at a time.
 	shortened := false
 	if mostRecentOldEnoughRev-lastGCRev > numMaxRevisionsPerQR {
@@ -1139,8 +1223,12 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
+	if leased {
+		// There will be more to reclaim once the lease is gone.
+		complete = false
+	}
 	if len(ptrs) == 0 && !shortened {
-		complete = true
+		complete = !leased
 
 		// Add a new gcOp to show other clients that they don't need
 		// to explore this range again.
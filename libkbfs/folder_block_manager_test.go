@@ -12,6 +12,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
@@ -810,3 +811,117 @@ func TestQuotaReclamationGCOpsForGCOps(t *testing.T) {
 		t.Fatalf("Last GCOp revision was unexpected: %d vs %d", g, e)
 	}
 }
+
+// Test that quota reclamation doesn't delete blocks that are still
+// referenced by a leased revision, until the lease is released.
+func TestQuotaReclamationLeasedRevision(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	aPtr := ops.nodeCache.PathFromNode(aNode).tailPointer()
+
+	// Lease the revision that still has "a" in it.
+	md, err := config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %+v", err)
+	}
+	release := kbfsOps.(*KBFSOpsStandard).LeaseRevision(
+		ctx, fb, md.Revision(), time.Hour)
+	defer release()
+
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb, nil)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %+v", err)
+	}
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	checkABlock := func(expectExists bool) {
+		ops.fbm.forceQuotaReclamation()
+		err = ops.fbm.waitForQuotaReclamations(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for QR: %+v", err)
+		}
+		blocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+		if err != nil {
+			t.Fatalf("Couldn't get blocks: %+v", err)
+		}
+		if _, exists := blocks[aPtr.ID]; exists != expectExists {
+			t.Fatalf("Block for \"a\" exists=%t, expected %t",
+				exists, expectExists)
+		}
+	}
+
+	// The leased block must survive reclamation.
+	checkABlock(true)
+
+	// Once the lease is released, it can be reclaimed.
+	release()
+	checkABlock(false)
+}
+
+func TestFolderBlockManagerLeaseExpiration(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(context.Background(), t, config)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	fbm := newFolderBlockManager(
+		config, FolderBranch{Tlf: tlf.FakeID(1, tlf.Private)}, nil)
+	defer fbm.shutdown()
+	if rev := fbm.getEarliestLeasedRevision(now); rev !=
+		kbfsmd.RevisionUninitialized {
+		t.Fatalf("Unexpected leased revision %d", rev)
+	}
+
+	fbm.leaseRevision(5, 2*time.Minute)
+	release := fbm.leaseRevision(3, time.Minute)
+	if rev := fbm.getEarliestLeasedRevision(now); rev != 3 {
+		t.Fatalf("Unexpected leased revision %d", rev)
+	}
+	release()
+	release()
+	if rev := fbm.getEarliestLeasedRevision(now); rev != 5 {
+		t.Fatalf("Unexpected leased revision %d", rev)
+	}
+	if rev := fbm.getEarliestLeasedRevision(now.Add(2 * time.Minute)); rev !=
+		kbfsmd.RevisionUninitialized {
+		t.Fatalf("Lease didn't expire, revision %d", rev)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 )
@@ -128,45 +129,6 @@ func (si *syncInfo) mergeUnrefCache(md *RootMetadata) {
 	}
 }
 
-type deCacheEntry struct {
-	// dirEntry is the dirty directory entry corresponding to the
-	// BlockPointer that maps to this struct.
-	dirEntry DirEntry
-	// adds is a map of the pointers for new entry names that have
-	// been added to the DirBlock for the BlockPointer that maps to
-	// this struct.
-	adds map[string]BlockPointer
-	// dels is a set of the names that have been removed from the
-	// DirBlock for the BlockPointer that maps to this struct.
-	dels map[string]bool
-	// addedSyms is a map of the dir entries for added symlinks.
-	addedSyms map[string]DirEntry
-}
-
-func (dece deCacheEntry) deepCopy() deCacheEntry {
-	copy := deCacheEntry{}
-	copy.dirEntry = dece.dirEntry
-	if dece.adds != nil {
-		copy.adds = make(map[string]BlockPointer, len(dece.adds))
-		for k, v := range dece.adds {
-			copy.adds[k] = v
-		}
-	}
-	if dece.dels != nil {
-		copy.dels = make(map[string]bool, len(dece.dels))
-		for k, v := range dece.dels {
-			copy.dels[k] = v
-		}
-	}
-	if dece.addedSyms != nil {
-		copy.addedSyms = make(map[string]DirEntry, len(dece.addedSyms))
-		for k, v := range dece.addedSyms {
-			copy.addedSyms[k] = v
-		}
-	}
-	return copy
-}
-
 type deferredState struct {
 	// Writes and truncates for blocks that were being sync'd, and
 	// need to be replayed after the sync finishes on top of the new
@@ -255,16 +217,24 @@ type folderBlockOps struct {
 	// block infos, per-path.
 	unrefCache map[BlockRef]*syncInfo
 	// For writes and truncates, track the modified (but not yet
-	// committed) directory entries. Maps the entry BlockRef to a
-	// modified entry.
-	deCache map[BlockRef]deCacheEntry
+	// committed) directory entries.
+	deCache *dirEntryCache
+	// Tracks the temporary block IDs in use by unsynced changes.
+	tempIDs *tempBlockIDRegistry
 
 	// Track deferred operations on a per-file basis.
 	deferred map[BlockRef]deferredState
 
+	// Track the files with a sync in progress, by their pre-sync
+	// refs.  Each channel is closed when its file's sync is done.
+	syncing map[BlockRef]chan struct{}
+
 	// set to true if this write or truncate should be deferred
 	doDeferWrite bool
 
+	// Tags set on files by the WriteInterceptor, if any.
+	writeTags map[NodeID]map[string]string
+
 	// nodeCache itself is goroutine-safe, but write/truncate must
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
@@ -289,7 +259,7 @@ func (fbo *folderBlockOps) branch() BranchName {
 func (fbo *folderBlockOps) GetState(lState *lockState) overallBlockState {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	if len(fbo.deCache) == 0 {
+	if fbo.deCache.isEmpty() {
 		return cleanState
 	}
 	return dirtyState
@@ -326,6 +296,11 @@ func (fbo *folderBlockOps) getCleanEncodedBlockSizeLocked(ctx context.Context,
 		return block.GetEncodedSize(), nil
 	}
 
+	if ptr.DataVer == InlineDataVer {
+		// Inlined files take up no space on the server.
+		return 0, nil
+	}
+
 	if err := checkDataVersion(fbo.config, path{}, ptr); err != nil {
 		return 0, err
 	}
@@ -385,8 +360,15 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 		return block, nil
 	}
 
+	r := fbo.config.MetricsRegistry()
+	if r != nil {
+		metrics.GetOrRegisterMeter(blockCacheAttemptMeterName, r).Mark(1)
+	}
 	if block, prefetchStatus, lifetime, err :=
 		fbo.config.BlockCache().GetWithPrefetch(ptr); err == nil {
+		if r != nil {
+			metrics.GetOrRegisterMeter(blockCacheHitMeterName, r).Mark(1)
+		}
 		// If the block was cached in the past, we need to handle it as if it's
 		// an on-demand request so that its downstream prefetches are triggered
 		// correctly according to the new on-demand fetch priority.
@@ -396,6 +378,16 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 		return block, nil
 	}
 
+	if ptr.DataVer == InlineDataVer {
+		// Older clients fail the data version check below instead.
+		fblock, err := fbo.getInlinedFileBlockLocked(
+			ctx, lState, kmd, ptr, branch, notifyPath, rtype)
+		if err != nil {
+			return nil, err
+		}
+		return fblock, nil
+	}
+
 	if err := checkDataVersion(fbo.config, notifyPath, ptr); err != nil {
 		return nil, err
 	}
@@ -434,6 +426,43 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	return block, nil
 }
 
+// getInlinedFileBlockLocked makes the block for a file whose contents
+// are inlined into its directory entry, from that entry, and caches
+// it.  The entry is found through the file's parent, so `file` must
+// be the full path to the file, unless the file has been unlinked.
+// If `rtype` is `blockReadParallel`, it's assumed that some
+// coordinating goroutine is holding the correct locks, and in that
+// case `lState` must be `nil`.
+func (fbo *folderBlockOps) getInlinedFileBlockLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer, branch BranchName,
+	file path, rtype blockReqType) (*FileBlock, error) {
+	var de DirEntry
+	if node := fbo.nodeCache.Get(ptr.Ref()); node != nil &&
+		fbo.nodeCache.IsUnlinked(node) {
+		de = fbo.nodeCache.UnlinkedDirEntry(node)
+	} else if file.hasValidParent() && file.tailPointer() == ptr {
+		parentPath := *file.parentPath()
+		dblock, err := fbo.getDirBlockHelperLocked(ctx, lState, kmd,
+			parentPath.tailPointer(), branch, parentPath, rtype)
+		if err != nil {
+			return nil, err
+		}
+		de = dblock.Children[file.tailName()]
+	}
+	if de.BlockPointer != ptr {
+		return nil, errors.Errorf(
+			"Couldn't find the entry for inlined file %v (%s)", ptr, file)
+	}
+
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = append(fblock.Contents, de.InlineData...)
+	if err := fbo.config.BlockCache().Put(
+		ptr, fbo.id(), fblock, TransientEntry); err != nil {
+		return nil, err
+	}
+	return fblock, nil
+}
+
 // getFileBlockHelperLocked retrieves the block pointed to by ptr,
 // which must be valid, either from an internal cache, the block
 // cache, or from the server. An error is returned if the retrieved
@@ -695,7 +724,7 @@ func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 		// already dirty.
 		df := fbo.dirtyFiles[file.tailPointer()]
 		if !wasDirty || (df != nil && df.blockNeedsCopy(ptr)) {
-			fblock = fblock.DeepCopy()
+			fblock = fblock.copyOnWrite()
 		}
 	}
 	return fblock, wasDirty, nil
@@ -723,6 +752,10 @@ func (fbo *folderBlockOps) getFileLocked(ctx context.Context,
 // blocks.
 func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path) ([]BlockInfo, error) {
+	if file.tailPointer().DataVer == InlineDataVer {
+		// An inlined file never has any indirect blocks.
+		return nil, nil
+	}
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
@@ -846,7 +879,7 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 		fbo.id(), dir.tailPointer(), dir.Branch) {
 		// Copy the block if it's for writing and the block is
 		// not yet dirty.
-		dblock = dblock.DeepCopy()
+		dblock = dblock.copyOnWrite()
 	}
 	return dblock, nil
 }
@@ -889,8 +922,11 @@ func (fbo *folderBlockOps) wrapWithBlockLock(fn func()) dirCacheUndoFn {
 func (fbo *folderBlockOps) addDirEntryInCacheLocked(lState *lockState, dir path,
 	newName string, newDe DirEntry) func() {
 	fbo.blockLock.AssertLocked(lState)
-	cacheEntry, dirEntryExisted := fbo.deCache[dir.tailRef()]
-	cacheEntryCopy := cacheEntry.deepCopy()
+	// The dir entries for directories are protected at a higher level
+	// by `folderBranchOps.mdWriterLock`, so we can safely revert it
+	// even after giving up `blockLock`.
+	undo := fbo.deCache.snapshot(dir.tailRef())
+	cacheEntry, _ := fbo.deCache.get(dir.tailRef())
 	if newDe.IsInitialized() {
 		if cacheEntry.adds == nil {
 			cacheEntry.adds = make(map[string]BlockPointer)
@@ -916,20 +952,8 @@ func (fbo *folderBlockOps) addDirEntryInCacheLocked(lState *lockState, dir path,
 	// TODO: is there anyway we can update the directory size without
 	// encoding the whole block?
 
-	fbo.deCache[dir.tailRef()] = cacheEntry
-
-	// The dir entries for directories are protected at a higher level
-	// by `folderBranchOps.mdWriterLock`, so we can safely revert it
-	// even after giving up `blockLock`.
-	if dirEntryExisted {
-		return func() {
-			fbo.deCache[dir.tailRef()] = cacheEntryCopy
-		}
-	}
-	// It wasn't cached yet, so an undo just deletes the entry.
-	return func() {
-		delete(fbo.deCache, dir.tailRef())
-	}
+	fbo.deCache.put(dir.tailRef(), cacheEntry)
+	return undo
 }
 
 // AddDirEntryInCache adds a brand new entry to the given directory in
@@ -943,14 +967,12 @@ func (fbo *folderBlockOps) AddDirEntryInCache(lState *lockState, dir path,
 	undoFn := fbo.addDirEntryInCacheLocked(lState, dir, newName, newDe)
 	// Add target dir entry as well.
 	if newDe.IsInitialized() {
-		cacheEntry, ok := fbo.deCache[newDe.Ref()]
-		if ok {
+		if _, ok := fbo.deCache.get(newDe.Ref()); ok {
 			panic("New entry shouldn't already exist")
 		}
-		cacheEntry.dirEntry = newDe
-		fbo.deCache[newDe.Ref()] = cacheEntry
+		fbo.deCache.put(newDe.Ref(), deCacheEntry{dirEntry: newDe})
 		return fbo.wrapWithBlockLock(func() {
-			delete(fbo.deCache, newDe.Ref())
+			fbo.deCache.remove(newDe.Ref())
 			undoFn()
 		})
 	}
@@ -960,8 +982,8 @@ func (fbo *folderBlockOps) AddDirEntryInCache(lState *lockState, dir path,
 func (fbo *folderBlockOps) removeDirEntryInCacheLocked(lState *lockState,
 	dir path, oldName string, oldDe DirEntry) func() {
 	fbo.blockLock.AssertLocked(lState)
-	cacheEntry, dirEntryExisted := fbo.deCache[dir.tailRef()]
-	cacheEntryCopy := cacheEntry.deepCopy()
+	undoDir := fbo.deCache.snapshot(dir.tailRef())
+	cacheEntry, _ := fbo.deCache.get(dir.tailRef())
 
 	if cacheEntry.dels == nil {
 		cacheEntry.dels = make(map[string]bool)
@@ -976,7 +998,7 @@ func (fbo *folderBlockOps) removeDirEntryInCacheLocked(lState *lockState,
 	cacheEntry.dirEntry.Mtime = now
 	cacheEntry.dirEntry.Ctime = now
 
-	fbo.deCache[dir.tailRef()] = cacheEntry
+	fbo.deCache.put(dir.tailRef(), cacheEntry)
 
 	// If the removed target is a directory, we can delete the cache
 	// entry for it as well, since there won't be any open handles to
@@ -984,30 +1006,20 @@ func (fbo *folderBlockOps) removeDirEntryInCacheLocked(lState *lockState,
 	// syncing later.
 	var restoreDirFn func()
 	if oldDe.Type == Dir {
-		dece, ok := fbo.deCache[oldDe.Ref()]
-		if ok {
-			delete(fbo.deCache, oldDe.Ref())
-			restoreDirFn = func() { fbo.deCache[oldDe.Ref()] = dece }
+		if _, ok := fbo.deCache.get(oldDe.Ref()); ok {
+			restoreDirFn = fbo.deCache.snapshot(oldDe.Ref())
+			fbo.deCache.remove(oldDe.Ref())
 		}
 	}
 
 	// The dir entries for directories are protected at a higher level
 	// by `folderBranchOps.mdWriterLock`, so we can safely revert it
 	// even after giving up `blockLock`.
-	if dirEntryExisted {
-		return func() {
-			if restoreDirFn != nil {
-				restoreDirFn()
-			}
-			fbo.deCache[dir.tailRef()] = cacheEntryCopy
-		}
-	}
-	// It wasn't cached yet, so an undo just deletes the entry.
 	return func() {
 		if restoreDirFn != nil {
 			restoreDirFn()
 		}
-		delete(fbo.deCache, dir.tailRef())
+		undoDir()
 	}
 }
 
@@ -1074,20 +1086,16 @@ func (fbo *folderBlockOps) RenameDirEntryInCache(lState *lockState,
 
 	// If there's already an entry for the target, only update the
 	// Ctime on a rename.
-	cacheEntry, ok := fbo.deCache[newDe.Ref()]
-	cacheEntryCopy := cacheEntry.deepCopy()
+	undoTarget := fbo.deCache.snapshot(newDe.Ref())
+	cacheEntry, ok := fbo.deCache.get(newDe.Ref())
 	if ok && cacheEntry.dirEntry.IsInitialized() {
 		cacheEntry.dirEntry.Ctime = newDe.Ctime
 	} else {
 		cacheEntry.dirEntry = newDe
 	}
-	fbo.deCache[newDe.Ref()] = cacheEntry
+	fbo.deCache.put(newDe.Ref(), cacheEntry)
 	return fbo.wrapWithBlockLock(func() {
-		if ok {
-			fbo.deCache[newDe.Ref()] = cacheEntryCopy
-		} else {
-			delete(fbo.deCache, newDe.Ref())
-		}
+		undoTarget()
 		if undoMove != nil {
 			undoMove()
 		}
@@ -1103,7 +1111,7 @@ func (fbo *folderBlockOps) setCachedAttrLocked(
 	lState *lockState, ref BlockRef, attr attrChange, realEntry *DirEntry,
 	doCreate bool) {
 	fbo.blockLock.AssertLocked(lState)
-	fileEntry, ok := fbo.deCache[ref]
+	fileEntry, ok := fbo.deCache.get(ref)
 	if !ok || !fileEntry.dirEntry.IsInitialized() {
 		if !doCreate {
 			return
@@ -1116,9 +1124,11 @@ func (fbo *folderBlockOps) setCachedAttrLocked(
 		fileEntry.dirEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.dirEntry.Mtime = realEntry.Mtime
+		fileEntry.dirEntry.Atime = realEntry.Atime
+		fileEntry.dirEntry.Btime = realEntry.Btime
 	}
 	fileEntry.dirEntry.Ctime = realEntry.Ctime
-	fbo.deCache[ref] = fileEntry
+	fbo.deCache.put(ref, fileEntry)
 }
 
 // SetAttrInDirEntryInCache removes an entry from the given directory
@@ -1138,17 +1148,12 @@ func (fbo *folderBlockOps) SetAttrInDirEntryInCache(lState *lockState,
 	undoAdd := fbo.addDirEntryInCacheLocked(
 		lState, *p.parentPath(), p.tailName(), newDe)
 
-	cacheEntry, ok := fbo.deCache[newDe.Ref()]
-	cacheEntryCopy := cacheEntry.deepCopy()
+	undoAttr := fbo.deCache.snapshot(newDe.Ref())
 	fbo.setCachedAttrLocked(
 		lState, newDe.Ref(), attr, &newDe,
 		true /* create the deCache entry if it doesn't exist yet */)
 	return fbo.wrapWithBlockLock(func() {
-		if ok {
-			fbo.deCache[newDe.Ref()] = cacheEntryCopy
-		} else {
-			delete(fbo.deCache, newDe.Ref())
-		}
+		undoAttr()
 		undoAdd()
 	})
 }
@@ -1165,7 +1170,7 @@ func (fbo *folderBlockOps) ClearCachedRef(
 		return false
 	}
 
-	delete(fbo.deCache, ref)
+	fbo.deCache.remove(ref)
 	return true
 }
 
@@ -1174,7 +1179,7 @@ func (fbo *folderBlockOps) ClearCachedRef(
 func (fbo *folderBlockOps) ClearCachedDirEntry(lState *lockState, dir path) {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
-	delete(fbo.deCache, dir.tailRef())
+	fbo.deCache.remove(dir.tailRef())
 	err := fbo.config.DirtyBlockCache().Delete(
 		fbo.id(), dir.tailPointer(), fbo.branch())
 	if err != nil {
@@ -1190,7 +1195,7 @@ func (fbo *folderBlockOps) updateDirtyEntryFromCacheLocked(
 	updated bool, newDe DirEntry) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
-	refDe, ok := fbo.deCache[de.Ref()]
+	refDe, ok := fbo.deCache.get(de.Ref())
 	if !ok {
 		return false, de
 	}
@@ -1229,12 +1234,12 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 
 	// Save some time for the common case of having no dirty
 	// files.
-	if len(fbo.deCache) == 0 {
+	if fbo.deCache.isEmpty() {
 		return dblock, nil
 	}
 
 	var dblockCopy *DirBlock
-	dirCacheEntry := fbo.deCache[dir.tailRef()]
+	dirCacheEntry, _ := fbo.deCache.get(dir.tailRef())
 
 	// TODO: We should get rid of deCache completely and use only
 	// DirtyBlockCache to store the dirtied version of the DirBlock.
@@ -1250,26 +1255,26 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 
 	// Add cached additions to the copy.
 	for k, ptr := range dirCacheEntry.adds {
-		de, ok := fbo.deCache[ptr.Ref()]
+		de, ok := fbo.deCache.get(ptr.Ref())
 		if !ok {
 			return nil, fmt.Errorf("No cached dir entry found for new entry "+
 				"%s in dir %s (%v)", k, dir, dir.tailPointer())
 		}
 
 		if dblockCopy == nil {
-			dblockCopy = dblock.DeepCopy()
+			dblockCopy = dblock.copyOnWrite()
 		}
 
-		dblockCopy.Children[k] = de.dirEntry
+		dblockCopy.setChild(k, de.dirEntry)
 	}
 
 	// Add cached symlink additions to the copy.
 	for k, de := range dirCacheEntry.addedSyms {
 		if dblockCopy == nil {
-			dblockCopy = dblock.DeepCopy()
+			dblockCopy = dblock.copyOnWrite()
 		}
 
-		dblockCopy.Children[k] = de
+		dblockCopy.setChild(k, de)
 	}
 
 	// Remove cached removals from the copy.
@@ -1280,10 +1285,10 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 		}
 
 		if dblockCopy == nil {
-			dblockCopy = dblock.DeepCopy()
+			dblockCopy = dblock.copyOnWrite()
 		}
 
-		delete(dblockCopy.Children, k)
+		dblockCopy.removeChild(k)
 	}
 
 	// Update dir entries for any modified files.
@@ -1312,9 +1317,9 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 		}
 
 		if dblockCopy == nil {
-			dblockCopy = dblock.DeepCopy()
+			dblockCopy = dblock.copyOnWrite()
 		}
-		dblockCopy.Children[k] = newDe
+		dblockCopy.setChild(k, newDe)
 	}
 
 	if dblockCopy == nil {
@@ -1333,14 +1338,30 @@ func (fbo *folderBlockOps) getDirtyDirLocked(ctx context.Context,
 	*DirBlock, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
-	dblock, err := fbo.getDirLocked(ctx, lState, kmd, dir, rtype)
+	// updateWithDirtyEntriesLocked makes its own copy of the block if
+	// it has any dirty entries, so only fetch it for reading here and
+	// copy it below if that didn't happen, rather than copying it
+	// twice.
+	getType := rtype
+	if rtype == blockWrite {
+		getType = blockRead
+	}
+	dblock, err := fbo.getDirLocked(ctx, lState, kmd, dir, getType)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: if rtype == blockWrite, this may create a second copy of
-	// the directory for no real reason, which is inefficient.
-	return fbo.updateWithDirtyEntriesLocked(ctx, lState, dir, dblock)
+	updatedDblock, err := fbo.updateWithDirtyEntriesLocked(
+		ctx, lState, dir, dblock)
+	if err != nil {
+		return nil, err
+	}
+	if rtype == blockWrite && updatedDblock == dblock &&
+		!fbo.config.DirtyBlockCache().IsDirty(
+			fbo.id(), dir.tailPointer(), dir.Branch) {
+		updatedDblock = dblock.copyOnWrite()
+	}
+	return updatedDblock, nil
 }
 
 // GetDirtyDir returns the directory block for a dirty directory,
@@ -1383,6 +1404,44 @@ func (fbo *folderBlockOps) GetDirtyDirChildren(
 	return children, nil
 }
 
+// GetDirtyDirChildrenWithNodes returns the possibly-dirty children
+// of the given directory, along with a Node for each non-symlink
+// child.  Like Lookup, it does all of this under a single block lock
+// acquisition to avoid races with UpdatePointers.
+func (fbo *folderBlockOps) GetDirtyDirChildrenWithNodes(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir Node) (
+	map[string]DirChild, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	dirPath := fbo.nodeCache.PathFromNode(dir)
+	if !dirPath.isValid() {
+		return nil, InvalidPathError{dirPath}
+	}
+
+	dblock, err := fbo.getDirtyDirLocked(ctx, lState, kmd, dirPath, blockRead)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string]DirChild, len(dblock.Children))
+	for k, de := range dblock.Children {
+		if hiddenEntries[k] {
+			fbo.log.CDebugf(ctx, "Hiding entry %s", k)
+			continue
+		}
+		child := DirChild{EntryInfo: de.EntryInfo}
+		if de.Type != Sym {
+			child.Node, err = fbo.nodeCache.GetOrCreate(de.BlockPointer, k, dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		children[k] = child
+	}
+	return children, nil
+}
+
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, rtype blockReqType,
@@ -1401,29 +1460,47 @@ func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 		return nil, DirEntry{}, err
 	}
 
+	de, ok := dblock.Children[file.tailName()]
+	de, err = fbo.checkDirtyEntryLocked(
+		ctx, lState, file, de, ok, includeDeleted)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return dblock, de, nil
+}
+
+// checkDirtyEntryLocked makes sure that `de`, the entry found (if
+// `ok`) for the tail of `file` in its parent, matches `file`.  If
+// not, it returns a NoSuchNameError, unless `includeDeleted` is true
+// and the file is unlinked, in which case it returns the unlinked
+// entry.
+func (fbo *folderBlockOps) checkDirtyEntryLocked(ctx context.Context,
+	lState *lockState, file path, de DirEntry, ok bool,
+	includeDeleted bool) (DirEntry, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
 	// make sure it exists
 	name := file.tailName()
-	de, ok := dblock.Children[name]
-	if !ok || (file.tailPointer().IsValid() &&
-		de.BlockPointer != file.tailPointer()) {
-		if includeDeleted {
-			// Has the file been removed?
-			node := fbo.nodeCache.Get(file.tailRef())
-			if node == nil {
-				return nil, DirEntry{}, NoSuchNameError{name}
-			}
-			if !fbo.nodeCache.IsUnlinked(node) {
-				return nil, DirEntry{}, NoSuchNameError{name}
-			}
-			de = fbo.nodeCache.UnlinkedDirEntry(node)
-			// It's possible the unlinked file has been updated.
-			_, de = fbo.updateDirtyEntryFromCacheLocked(ctx, lState, de)
-		} else {
-			return nil, DirEntry{}, NoSuchNameError{name}
-		}
+	if ok && (!file.tailPointer().IsValid() ||
+		de.BlockPointer == file.tailPointer()) {
+		return de, nil
+	}
+	if !includeDeleted {
+		return DirEntry{}, NoSuchNameError{name}
 	}
 
-	return dblock, de, err
+	// Has the file been removed?
+	node := fbo.nodeCache.Get(file.tailRef())
+	if node == nil {
+		return DirEntry{}, NoSuchNameError{name}
+	}
+	if !fbo.nodeCache.IsUnlinked(node) {
+		return DirEntry{}, NoSuchNameError{name}
+	}
+	de = fbo.nodeCache.UnlinkedDirEntry(node)
+	// It's possible the unlinked file has been updated.
+	_, de = fbo.updateDirtyEntryFromCacheLocked(ctx, lState, de)
+	return de, nil
 }
 
 // GetDirtyParentAndEntry returns the parent DirBlock (which shouldn't
@@ -1441,15 +1518,73 @@ func (fbo *folderBlockOps) GetDirtyParentAndEntry(
 		ctx, lState, kmd, file, rtype, false)
 }
 
+// getDirtyEntryFromBlockLocked returns the possibly-dirty entry for
+// `name` in `dblock`, the block for `dir`, and whether it exists.
+// It's equivalent to looking `name` up in the block returned by
+// updateWithDirtyEntriesLocked, but it only has to check the one
+// entry, and never copies the block.
+func (fbo *folderBlockOps) getDirtyEntryFromBlockLocked(
+	ctx context.Context, lState *lockState, dir path, dblock *DirBlock,
+	name string) (DirEntry, bool, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	de, ok := dblock.Children[name]
+	if fbo.deCache.isEmpty() {
+		return de, ok, nil
+	}
+
+	dirCacheEntry, _ := fbo.deCache.get(dir.tailRef())
+	if _, deleted := dirCacheEntry.dels[name]; deleted && ok {
+		return DirEntry{}, false, nil
+	}
+	if symDe, ok := dirCacheEntry.addedSyms[name]; ok {
+		return symDe, true, nil
+	}
+	if ptr, ok := dirCacheEntry.adds[name]; ok {
+		addedDe, ok := fbo.deCache.get(ptr.Ref())
+		if !ok {
+			return DirEntry{}, false, fmt.Errorf(
+				"No cached dir entry found for new entry %s in dir %s (%v)",
+				name, dir, dir.tailPointer())
+		}
+		return addedDe.dirEntry, true, nil
+	}
+	if !ok {
+		return DirEntry{}, false, nil
+	}
+
+	if doUpdate, newDe := fbo.updateDirtyEntryFromCacheLocked(
+		ctx, lState, de); doUpdate {
+		de = newDe
+	}
+	return de, true, nil
+}
+
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, includeDeleted bool) (
 	DirEntry, error) {
-	// TODO: Since we only need a single DirEntry, avoid having to
-	// look up every entry in the DirBlock.
-	_, de, err := fbo.getDirtyParentAndEntryLocked(
-		ctx, lState, kmd, file, blockLookup, includeDeleted)
-	return de, err
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if !file.hasValidParent() {
+		return DirEntry{}, InvalidParentPathError{file}
+	}
+
+	// Only a single entry is needed, so look it up directly in the
+	// parent block, instead of getting a whole dirty copy of it.
+	parentPath := file.parentPath()
+	dblock, err := fbo.getDirLocked(
+		ctx, lState, kmd, *parentPath, blockLookup)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	de, ok, err := fbo.getDirtyEntryFromBlockLocked(
+		ctx, lState, *parentPath, dblock, file.tailName())
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return fbo.checkDirtyEntryLocked(
+		ctx, lState, file, de, ok, includeDeleted)
 }
 
 // GetDirtyEntry returns the possibly-dirty DirEntry of the given file
@@ -1578,13 +1713,13 @@ func (fbo *folderBlockOps) GetDirtyFileBlockRefs(lState *lockState) []BlockRef {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	var dirtyRefs []BlockRef
-	for ref := range fbo.deCache {
+	fbo.deCache.forEach(func(ref BlockRef, _ deCacheEntry) {
 		// A file is only dirty if it's been written to (and hence
 		// caused some block unrefs) but not been synced yet.
 		if _, ok := fbo.unrefCache[ref]; ok {
 			dirtyRefs = append(dirtyRefs, ref)
 		}
-	}
+	})
 	return dirtyRefs
 }
 
@@ -1594,20 +1729,20 @@ func (fbo *folderBlockOps) GetDirtyDirBlockRefs(lState *lockState) []BlockRef {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	var dirtyRefs []BlockRef
-	for ref, de := range fbo.deCache {
+	fbo.deCache.forEach(func(ref BlockRef, de deCacheEntry) {
 		// It's a directory if there's either no entry, or if the
 		// entry is explicitly typed as a directory.  (A directory
 		// should only have a dirEntry in the cache if it's newly
 		// created.)
 		if !de.dirEntry.IsInitialized() || de.dirEntry.Type == Dir {
-			if len(de.adds) == 0 && len(de.dels) == 0 && len(de.addedSyms) == 0 {
+			if !de.hasDirChanges() {
 				// The directory entry for this dir is dirty, but the
 				// directory itself is not.
-				continue
+				return
 			}
 			dirtyRefs = append(dirtyRefs, ref)
 		}
-	}
+	})
 	return dirtyRefs
 }
 
@@ -1741,9 +1876,7 @@ func (fbo *folderBlockOps) PrepRename(
 	// (e.g., for journal statuses).  TODO: allow a way to set more
 	// than one final path for renameOps?
 
-	// TODO: Write a SameBlock() function that can deal properly with
-	// dedup'd blocks that share an ID but can be updated separately.
-	if oldParentPtr.ID == newParentPtr.ID {
+	if oldParentPtr.SameBlock(newParentPtr) {
 		newPBlock = oldPBlock
 	} else {
 		newPBlock, err = fbo.getDirtyDirLocked(
@@ -1756,10 +1889,19 @@ func (fbo *folderBlockOps) PrepRename(
 	return oldPBlock, newPBlock, newDe, ro, nil
 }
 
+// tempIDCrypto returns the crypto to use for making temporary block
+// IDs for unsynced changes, which records them in the registry.
+func (fbo *folderBlockOps) tempIDCrypto() cryptoPure {
+	if fbo.tempIDs == nil {
+		return fbo.config.Crypto()
+	}
+	return tempBlockIDRecordingCrypto{fbo.config.Crypto(), fbo.tempIDs}
+}
+
 func (fbo *folderBlockOps) newFileData(lState *lockState,
 	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata) *fileData {
 	fbo.blockLock.AssertAnyLocked(lState)
-	return newFileData(file, chargedTo, fbo.config.Crypto(),
+	return newFileData(file, chargedTo, fbo.tempIDCrypto(),
 		fbo.config.BlockSplitter(), kmd,
 		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
 			file path, rtype blockReqType) (*FileBlock, bool, error) {
@@ -1780,7 +1922,7 @@ func (fbo *folderBlockOps) newFileDataWithCache(lState *lockState,
 	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata,
 	dirtyBcache DirtyBlockCache) *fileData {
 	fbo.blockLock.AssertAnyLocked(lState)
-	return newFileData(file, chargedTo, fbo.config.Crypto(),
+	return newFileData(file, chargedTo, fbo.tempIDCrypto(),
 		fbo.config.BlockSplitter(), kmd,
 		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
 			file path, rtype blockReqType) (*FileBlock, bool, error) {
@@ -1800,9 +1942,82 @@ func (fbo *folderBlockOps) newFileDataWithCache(lState *lockState,
 		}, fbo.log)
 }
 
+// newFileDataWriteLocked is like newFileData, but for reading the
+// file while `blockLock` is held for writing, as it is while a sync
+// is being started.  Block reads are done as for writes, which the
+// write lock allows.
+func (fbo *folderBlockOps) newFileDataWriteLocked(lState *lockState,
+	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata) *fileData {
+	fbo.blockLock.AssertLocked(lState)
+	return newFileData(file, chargedTo, fbo.tempIDCrypto(),
+		fbo.config.BlockSplitter(), kmd,
+		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+			file path, rtype blockReqType) (*FileBlock, bool, error) {
+			lState := lState
+			switch rtype {
+			case blockRead:
+				rtype = blockWrite
+			case blockReadParallel:
+				lState = nil
+			}
+			return fbo.getFileBlockLocked(
+				ctx, lState, kmd, ptr, file, rtype)
+		},
+		func(ptr BlockPointer, block Block) error {
+			return fbo.cacheBlockIfNotYetDirtyLocked(
+				lState, ptr, file, block)
+		}, fbo.log)
+}
+
+// waitForSyncLocked waits until `file` has no sync in progress, and
+// returns its path as of then.  It releases `blockLock` while it
+// waits, and holds it again when it returns, even on error.
+func (fbo *folderBlockOps) waitForSyncLocked(
+	ctx context.Context, lState *lockState, file Node) (path, error) {
+	fbo.blockLock.AssertRLocked(lState)
+	for {
+		filePath := fbo.nodeCache.PathFromNode(file)
+		syncDone, ok := fbo.syncing[filePath.tailRef()]
+		if !ok {
+			return filePath, nil
+		}
+
+		fbo.log.CDebugf(ctx, "Waiting for the sync of %v before reading",
+			filePath.tailPointer())
+		var err error
+		fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
+			select {
+			case <-syncDone:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		})
+		if err != nil {
+			return path{}, err
+		}
+	}
+}
+
+// doneSyncingLocked records that the sync of the file at `file` is
+// over, whether or not it succeeded.
+func (fbo *folderBlockOps) doneSyncingLocked(lState *lockState, file path) {
+	fbo.blockLock.AssertLocked(lState)
+	if syncDone, ok := fbo.syncing[file.tailRef()]; ok {
+		close(syncDone)
+		delete(fbo.syncing, file.tailRef())
+	}
+}
+
 // Read reads from the given file into the given buffer at the given
 // offset. It returns the number of bytes read and nil, or 0 and the
 // error if there was one.
+//
+// If the config asks for strict write visibility, a read of a file
+// that's being synced waits until the sync is done.  Since a sync
+// takes `blockLock` for writing when it starts, and again when it
+// swaps in the synced blocks and replays the writes deferred during
+// the sync, the read then sees a consistent version of the file:
+// either all of it from before the sync, or all of it from after.
 func (fbo *folderBlockOps) Read(
 	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
 	dest []byte, off int64) (int64, error) {
@@ -1810,6 +2025,13 @@ func (fbo *folderBlockOps) Read(
 	defer fbo.blockLock.RUnlock(lState)
 
 	filePath := fbo.nodeCache.PathFromNode(file)
+	if fbo.config.StrictWriteVisibility() {
+		var err error
+		filePath, err = fbo.waitForSyncLocked(ctx, lState, file)
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	fbo.log.CDebugf(ctx, "Reading from %v", filePath.tailPointer())
 
@@ -1818,6 +2040,67 @@ func (fbo *folderBlockOps) Read(
 	return fd.read(ctx, dest, off)
 }
 
+// ReadPath is like Read, but reads the version of the file at the
+// given path, which doesn't need to be in the node cache (e.g., the
+// version of a file at the branch point of a conflict).
+func (fbo *folderBlockOps) ReadPath(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	dest []byte, off int64) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	fbo.log.CDebugf(ctx, "Reading from path %v", file.tailPointer())
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
+	return fd.read(ctx, dest, off)
+}
+
+// GetReadAheadPointers returns the pointers of up to `n` leaf blocks
+// of the given file, starting with the one holding `off`, that share
+// a parent block with it.  It returns nothing for a file that's dirty,
+// since its dirty blocks can't be fetched, or that isn't indirect.
+func (fbo *folderBlockOps) GetReadAheadPointers(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	off int64, n int) ([]BlockPointer, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+	if fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), filePath.tailPointer(), filePath.Branch) {
+		return nil, nil
+	}
+	fblock, err := fbo.getFileLocked(ctx, lState, kmd, filePath, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !fblock.IsInd {
+		return nil, nil
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	pfr, err := fd.getIndirectBlocksForOffsetRange(ctx, fblock, off, off+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(pfr) == 0 || len(pfr[0]) == 0 {
+		// `off` is past the end of the file.
+		return nil, nil
+	}
+	parent := pfr[0][len(pfr[0])-1]
+	iptrs := parent.pblock.IPtrs[parent.childIndex:]
+	if len(iptrs) > n {
+		iptrs = iptrs[:n]
+	}
+	ptrs := make([]BlockPointer, 0, len(iptrs))
+	for _, iptr := range iptrs {
+		ptrs = append(ptrs, iptr.BlockPointer)
+	}
+	return ptrs, nil
+}
+
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState, file Node,
 	c DirtyPermChan) error {
@@ -2003,12 +2286,12 @@ func (fbo *folderBlockOps) writeDataLocked(
 	// the `deCache` is used to determine whether there are any dirty
 	// files.  TODO: combine `deCache` with `dirtyFiles` and
 	// `unrefCache`.
-	cacheEntry := fbo.deCache[file.tailRef()]
+	cacheEntry, _ := fbo.deCache.get(file.tailRef())
 	now := fbo.nowUnixNano()
 	newDe.Mtime = now
 	newDe.Ctime = now
 	cacheEntry.dirEntry = newDe
-	fbo.deCache[file.tailRef()] = cacheEntry
+	fbo.deCache.put(file.tailRef(), cacheEntry)
 
 	if fbo.doDeferWrite {
 		df.addDeferredNewBytes(bytesExtended)
@@ -2124,12 +2407,12 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 	if err != nil {
 		return WriteRange{}, nil, err
 	}
-	cacheEntry := fbo.deCache[file.tailRef()]
+	cacheEntry, _ := fbo.deCache.get(file.tailRef())
 	now := fbo.nowUnixNano()
 	newDe.Mtime = now
 	newDe.Ctime = now
 	cacheEntry.dirEntry = newDe
-	fbo.deCache[file.tailRef()] = cacheEntry
+	fbo.deCache.put(file.tailRef(), cacheEntry)
 
 	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
 	if err != nil {
@@ -2183,6 +2466,22 @@ func (fbo *folderBlockOps) truncateLocked(
 	}
 
 	currLen := int64(startOff) + int64(len(block.Contents))
+	if currLen < iSize && nextBlockOff >= 0 {
+		// The new size falls in a hole in the middle of the file.
+		// Drop everything after the hole first, and then extend
+		// the file into it.  The shrinking write range covers the
+		// extension too.
+		latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err :=
+			fbo.truncateLocked(ctx, lState, kmd, file, uint64(currLen))
+		if err != nil {
+			return latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err
+		}
+		_, moreDirtyPtrs, moreDirtiedChildBytes, err := fbo.truncateLocked(
+			ctx, lState, kmd, file, size)
+		return latestWrite, append(dirtyPtrs, moreDirtyPtrs...),
+			newlyDirtiedChildBytes + moreDirtiedChildBytes, err
+	}
+
 	if currLen+truncateExtendCutoffPoint < iSize {
 		latestWrite, dirtyPtrs, err := fbo.truncateExtendLocked(
 			ctx, lState, kmd, file, uint64(iSize), parentBlocks)
@@ -2229,12 +2528,12 @@ func (fbo *folderBlockOps) truncateLocked(
 	df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
 
 	latestWrite := si.op.addTruncate(size)
-	cacheEntry := fbo.deCache[file.tailRef()]
+	cacheEntry, _ := fbo.deCache.get(file.tailRef())
 	now := fbo.nowUnixNano()
 	newDe.Mtime = now
 	newDe.Ctime = now
 	cacheEntry.dirEntry = newDe
-	fbo.deCache[file.tailRef()] = cacheEntry
+	fbo.deCache.put(file.tailRef(), cacheEntry)
 
 	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
 }
@@ -2245,6 +2544,22 @@ func (fbo *folderBlockOps) truncateLocked(
 func (fbo *folderBlockOps) Truncate(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	file Node, size uint64) error {
+	return fbo.truncate(ctx, lState, kmd, file, size, false)
+}
+
+// Preallocate extends the given file to the given size, the same way
+// as Truncate, unless the file is already at least that big, in
+// which case it is a no-op.  A large extension is backed by holes,
+// so no data is dirtied beyond the file's current last block.
+func (fbo *folderBlockOps) Preallocate(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, size uint64) error {
+	return fbo.truncate(ctx, lState, kmd, file, size, true)
+}
+
+func (fbo *folderBlockOps) truncate(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, size uint64, extendOnly bool) error {
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
@@ -2272,6 +2587,18 @@ func (fbo *folderBlockOps) Truncate(
 		return err
 	}
 
+	if extendOnly {
+		// Check the size under `blockLock`, so a concurrent write
+		// can't make us shrink the file.
+		de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, filePath, true)
+		if err != nil {
+			return err
+		}
+		if de.Size >= size {
+			return nil
+		}
+	}
+
 	defer func() {
 		fbo.doDeferWrite = false
 	}()
@@ -2331,15 +2658,31 @@ func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
 	// Still count the file as dirty in that case; most likely, the
 	// caller will next call `ClearCacheInfo` to remove this entry.
 	// (See comments in `folderBranchOps.syncLocked`.)
-	_, ok := fbo.deCache[file.tailRef()]
+	_, ok := fbo.deCache.get(file.tailRef())
 	return ok
 }
 
+// IsDirtyFile returns whether the given path is a file (rather than
+// a directory) with dirty data or attributes.
+func (fbo *folderBlockOps) IsDirtyFile(lState *lockState, file path) bool {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	block, err := fbo.config.DirtyBlockCache().Get(
+		fbo.id(), file.tailPointer(), file.Branch)
+	if err == nil {
+		_, isFile := block.(*FileBlock)
+		return isFile
+	}
+
+	entry, ok := fbo.deCache.get(file.tailRef())
+	return ok && entry.dirEntry.IsInitialized() && entry.dirEntry.Type != Dir
+}
+
 func (fbo *folderBlockOps) clearCacheInfoLocked(lState *lockState,
 	file path) error {
 	fbo.blockLock.AssertLocked(lState)
 	ref := file.tailRef()
-	delete(fbo.deCache, ref)
+	fbo.deCache.remove(ref)
 	delete(fbo.unrefCache, ref)
 	df := fbo.dirtyFiles[file.tailPointer()]
 	if df != nil {
@@ -2356,9 +2699,131 @@ func (fbo *folderBlockOps) clearCacheInfoLocked(lState *lockState,
 func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) error {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
+	if node := fbo.nodeCache.Get(file.tailRef()); node != nil {
+		delete(fbo.writeTags, node.GetID())
+	}
 	return fbo.clearCacheInfoLocked(lState, file)
 }
 
+// GetWriteTags returns a copy of the tags the WriteInterceptor has
+// set on the given file, or nil if there are none.
+func (fbo *folderBlockOps) GetWriteTags(
+	lState *lockState, file Node) map[string]string {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	tags := fbo.writeTags[file.GetID()]
+	if len(tags) == 0 {
+		return nil
+	}
+	tagsCopy := make(map[string]string, len(tags))
+	for k, v := range tags {
+		tagsCopy[k] = v
+	}
+	return tagsCopy
+}
+
+// checkContentTypeLocked sniffs the MIME type of `file`, if its TLF's
+// content policy bans some types and the start of the file has been
+// written since its last sync.
+func (fbo *folderBlockOps) checkContentTypeLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path, si *syncInfo) error {
+	fbo.blockLock.AssertLocked(lState)
+	policy := md.data.ContentPolicy
+	if !policy.sniffsContent() {
+		return nil
+	}
+	startWritten := false
+	for _, w := range si.op.Writes {
+		if !w.isTruncate() && w.Off < contentSniffLen {
+			startWritten = true
+			break
+		}
+	}
+	if !startWritten {
+		return nil
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileDataWriteLocked(lState, file, id, md.ReadOnly())
+	start, err := fd.getBytes(ctx, 0, contentSniffLen)
+	if err != nil {
+		return err
+	}
+	return policy.checkContent(file.tailName(), start)
+}
+
+// interceptWritesLocked passes the data written to `file` since its
+// last sync to the WriteInterceptor, if there is one, and records the
+// tags it sets.  It returns a WriteRejectedError if the data was
+// rejected.
+func (fbo *folderBlockOps) interceptWritesLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, si *syncInfo) error {
+	fbo.blockLock.AssertLocked(lState)
+	interceptor := fbo.config.WriteInterceptor()
+	if interceptor == nil {
+		return nil
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileDataWriteLocked(lState, file, id, kmd)
+	var chunks []WriteChunk
+	for _, w := range si.op.collapseWriteRange(nil) {
+		if w.isTruncate() {
+			continue
+		}
+		off := int64(w.Off)
+		bytes, err := fd.getByteSlicesInOffsetRange(
+			ctx, off, int64(w.End()), false)
+		if err != nil {
+			return err
+		}
+		for _, b := range bytes {
+			chunks = append(chunks, WriteChunk{Off: off, Data: b})
+			off += int64(len(b))
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	filename := file.CanonicalPathString()
+	verdict, err := interceptor.InterceptWrite(ctx, filename, chunks)
+	if err != nil {
+		return err
+	}
+	if verdict.Reject != "" {
+		fbo.log.CDebugf(ctx, "Writes to %v rejected: %s",
+			file.tailPointer(), verdict.Reject)
+		return WriteRejectedError{Filename: filename, Reason: verdict.Reject}
+	}
+	if len(verdict.Tags) == 0 {
+		return nil
+	}
+	node := fbo.nodeCache.Get(file.tailRef())
+	if node == nil {
+		return nil
+	}
+	if fbo.writeTags == nil {
+		fbo.writeTags = make(map[NodeID]map[string]string)
+	}
+	tags := fbo.writeTags[node.GetID()]
+	if tags == nil {
+		tags = make(map[string]string, len(verdict.Tags))
+		fbo.writeTags[node.GetID()] = tags
+	}
+	for k, v := range verdict.Tags {
+		if v == "" {
+			delete(tags, k)
+		} else {
+			tags[k] = v
+		}
+	}
+	if len(tags) == 0 {
+		delete(fbo.writeTags, node.GetID())
+	}
+	return nil
+}
+
 // revertSyncInfoAfterRecoverableError updates the saved sync info to
 // include all the blocks from before the error, except for those that
 // have encountered recoverable block errors themselves.
@@ -2426,6 +2891,11 @@ func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 		if err != nil {
 			return
 		}
+		// A reference to a block of a different type (e.g., an MD
+		// block change block) would be charged to the wrong quota.
+		if ptr.IsInitialized() && ptr.GetBlockType() != bType {
+			ptr = BlockPointer{}
+		}
 	} else if dBlock, ok := block.(*DirBlock); ok {
 		if dBlock.IsInd {
 			panic("Indirect directory blocks aren't supported yet")
@@ -2530,6 +3000,17 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 			fmt.Errorf("No syncOp found for file ref %v", fileRef)
 	}
 
+	// Let the WriteInterceptor see the new data before anything is
+	// readied.
+	err = fbo.interceptWritesLocked(ctx, lState, md.ReadOnly(), file, si)
+	if err != nil {
+		return nil, nil, syncState, nil, err
+	}
+	err = fbo.checkContentTypeLocked(ctx, lState, md, file, si)
+	if err != nil {
+		return nil, nil, syncState, nil, err
+	}
+
 	// Collapse the write range to reduce the size of the sync op.
 	si.op.Writes = si.op.collapseWriteRange(nil)
 	// If this function returns a success, we need to make sure the op
@@ -2636,7 +3117,7 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 
 	// Capture the current de before we release the block lock, so
 	// other deferred writes don't slip in.
-	if de, ok := fbo.deCache[fileRef]; ok {
+	if de, ok := fbo.deCache.get(fileRef); ok {
 		dirtyDe = &de.dirEntry
 	}
 
@@ -2656,6 +3137,10 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 	// deferred list and will be retried on the next sync as well.
 	df.assimilateDeferredNewBytes()
 
+	if _, ok := fbo.syncing[fileRef]; !ok {
+		fbo.syncing[fileRef] = make(chan struct{})
+	}
+
 	// TODO: Returning si.bps in this way is racy, since si is a
 	// member of unrefCache.
 	return fblock, si.bps, syncState, dirtyDe, nil
@@ -2683,7 +3168,7 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 	// Update the file's directory entry to the cached copy.
 	if dirtyDe != nil {
 		dirtyDe.EncodedSize = si.oldInfo.EncodedSize
-		dblock.Children[file.tailName()] = *dirtyDe
+		dblock.setChild(file.tailName(), *dirtyDe)
 		lbc[parentPath.tailPointer()] = dblock
 	}
 
@@ -2765,7 +3250,11 @@ func (fbo *folderBlockOps) CleanupSyncState(
 		result.si.toCleanIfUnused = append(result.si.toCleanIfUnused,
 			mdToCleanIfUnused{md, result.si.bps.DeepCopy()})
 	}
-	if isRecoverableBlockError(err) {
+	// A canceled sync is rolled back just like one that hit a
+	// recoverable error, since the next sync will act as its retry:
+	// the file stays dirty, and the deferred writes are redone below.
+	_, isCanceled := err.(SyncCanceledError)
+	if isRecoverableBlockError(err) || isCanceled {
 		if result.si != nil {
 			fbo.revertSyncInfoAfterRecoverableError(blocksToRemove, result)
 		}
@@ -2810,6 +3299,40 @@ func (fbo *folderBlockOps) CleanupSyncState(
 	if df := fbo.dirtyFiles[file.tailPointer()]; df != nil {
 		df.resetSyncingBlocksToDirty()
 	}
+	fbo.doneSyncingLocked(lState, file)
+
+	if isCanceled {
+		fbo.redoDeferredWritesAfterCancelLocked(ctx, lState, md, file)
+	}
+}
+
+// redoDeferredWritesAfterCancelLocked redoes the writes that were
+// deferred during a canceled sync of `file`, on top of its rolled-back
+// dirty blocks, so that the next sync includes them.
+func (fbo *folderBlockOps) redoDeferredWritesAfterCancelLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) {
+	fbo.blockLock.AssertLocked(lState)
+	ds, ok := fbo.deferred[file.tailRef()]
+	if !ok {
+		return
+	}
+	delete(fbo.deferred, file.tailRef())
+
+	// Unlike after a successful sync, the dirty blocks made by the
+	// deferred writes are still the latest versions of those blocks,
+	// so `ds.dirtyDeletes` are left in the dirty cache, and the bytes
+	// they dirtied stay counted.  Add those bytes back first, since
+	// each redone write un-counts the bytes it originally dirtied.
+	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	df.clearDeferredNewBytes()
+	df.updateNotYetSyncingBytes(ds.waitBytes)
+	for _, f := range ds.writes {
+		err := f(ctx, lState, kmd, file)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't redo a deferred write to %v "+
+				"after a canceled sync: %+v", file.tailPointer(), err)
+		}
+	}
 }
 
 // cleanUpUnusedBlocks cleans up the blocks from any previous failed
@@ -2921,6 +3444,7 @@ func (fbo *folderBlockOps) FinishSyncLocked(
 	syncState fileSyncState, fbm *folderBlockManager) (
 	stillDirty bool, err error) {
 	fbo.blockLock.AssertLocked(lState)
+	defer fbo.doneSyncingLocked(lState, oldPath)
 
 	dirtyBcache := fbo.config.DirtyBlockCache()
 	for _, ptr := range syncState.oldFileBlockPtrs {
@@ -3258,7 +3782,7 @@ func (fbo *folderBlockOps) getUndirtiedEntry(
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 
-	_, ok := fbo.deCache[file.tailRef()]
+	_, ok := fbo.deCache.get(file.tailRef())
 	if !ok {
 		return nil, nil
 	}
@@ -3308,7 +3832,7 @@ func (fbo *folderBlockOps) UpdateCachedEntryAttributes(
 	addedToParent := func() bool {
 		fbo.blockLock.Lock(lState)
 		defer fbo.blockLock.Unlock(lState)
-		de := fbo.deCache[dir.tailRef()]
+		de, _ := fbo.deCache.get(dir.tailRef())
 		_, ok := de.adds[op.Name]
 		return ok
 	}()
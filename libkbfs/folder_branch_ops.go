@@ -5,13 +5,18 @@
 package libkbfs
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"os"
+	stdpath "path"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/backoff"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -22,6 +27,7 @@ import (
 	"github.com/keybase/kbfs/kbfssync"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -92,6 +98,10 @@ const (
 	// If there are more than this many new revisions, fast forward
 	// rather than downloading them all.
 	fastForwardRevThresh = 50
+	// If the deadline of an MD write is closer than this when it's
+	// about to be put to the server, fail it before the put, rather
+	// than risk timing out on a put that might still land.
+	minMDPutTimeRemaining = 1 * time.Second
 )
 
 type fboMutexLevel mutexLevel
@@ -178,6 +188,14 @@ const (
 	headTrusted
 )
 
+// speculativeLookupChildren is the number of children of a
+// looked-up directory whose blocks are fetched speculatively.
+const speculativeLookupChildren = 16
+
+// readAheadTrackedFiles is the number of recently-read files whose
+// read positions are remembered, to detect sequential reads.
+const readAheadTrackedFiles = 1000
+
 type cachedDirOp struct {
 	dirOp op
 	nodes []Node
@@ -243,11 +261,17 @@ type folderBranchOps struct {
 	bid          kbfsmd.BranchID // protected by mdWriterLock
 	bType        branchType
 	observers    *observerList
+	// retained holds the pruned unmerged branches of every TLF, for
+	// recovery.  It may be nil.
+	retained *retainedBranches
 
 	// these locks, when locked concurrently by the same goroutine,
 	// should only be taken in the following order to avoid deadlock:
 	mdWriterLock leveledMutex // taken by any method making MD modifications
 	dirOps       []cachedDirOp
+	// mdPutInFlight is the pipelined MD put, if any, that hasn't
+	// been settled yet.  Protected by mdWriterLock.
+	mdPutInFlight *mdPipelinedPut
 
 	// protects access to head, headStatus, latestMergedRevision,
 	// and hasBeenCleared.
@@ -308,6 +332,13 @@ type folderBranchOps struct {
 	// Cancels the goroutine currently waiting on TLF MD updates.
 	cancelUpdates context.CancelFunc
 
+	syncCancelLock sync.Mutex
+	// Cancels the block puts of the SyncAll currently in progress,
+	// if any.
+	syncCancel context.CancelFunc
+	// Whether CancelSync was called on the current SyncAll.
+	syncCanceled bool
+
 	// After a shutdown, this channel will be closed when the register
 	// goroutine completes.
 	updateDoneChan chan struct{}
@@ -328,13 +359,20 @@ type folderBranchOps struct {
 	fbm *folderBlockManager
 
 	rekeyFSM RekeyFSM
+	// Tracks the progress of this device's rekeys of the TLF.
+	rekeyProgress *rekeyProgress
 
 	editHistory *TlfEditHistory
+	activity    *tlfActivityDigester
+	usage       *tlfUsageMonitor
+	opStats     *tlfOpStats
 
 	branchChanges      kbfssync.RepeatedWaitGroup
 	mdFlushes          kbfssync.RepeatedWaitGroup
 	forcedFastForwards kbfssync.RepeatedWaitGroup
 	merkleFetches      kbfssync.RepeatedWaitGroup
+	pipelinedPuts      kbfssync.RepeatedWaitGroup
+	speculativeFetches kbfssync.RepeatedWaitGroup
 
 	muLastGetHead sync.Mutex
 	// We record a timestamp everytime getHead or getTrustedHead is called, and
@@ -343,6 +381,44 @@ type folderBranchOps struct {
 	// reconnect as soon as possible in case of a deployment causes
 	// disconnection.
 	lastGetHead time.Time
+	// createdTime stands in for lastGetHead until the first access,
+	// so that a brand new folder-branch isn't mistaken for an idle
+	// one.
+	createdTime time.Time
+	// lastOpsLookup is when KBFSOpsStandard last handed out this
+	// folder-branch, which also counts as an access, since the
+	// caller is about to use it.
+	lastOpsLookup time.Time
+
+	// atimeLock protects atimeUpdates, the nodes with an access time
+	// update in progress.
+	atimeLock    sync.Mutex
+	atimeUpdates map[NodeID]bool
+
+	// fileOps orders the writes, truncates and preallocations on
+	// each file.
+	fileOps *fileOpSequencer
+
+	// readPositions maps the NodeIDs of recently-read files to the
+	// offset where the last read of each one ended.
+	readPositions *lru.Cache
+
+	// quotaUsageLock protects quotaUsage, which is made on the first
+	// preallocation in this TLF.
+	quotaUsageLock sync.Mutex
+	quotaUsage     *EventuallyConsistentQuotaUsage
+
+	// quarantineLock protects quarantine, which is set once the
+	// server says it has quarantined this TLF.  It's never unset; a
+	// lifted quarantine takes effect when the TLF is next opened.
+	quarantineLock sync.RWMutex
+	quarantine     *kbfsmd.ServerErrorTlfQuarantined
+
+	// Debugging info for DebugDump.
+	mdWriterLockWaits *lockWaitStats
+	headLockWaits     *lockWaitStats
+	blockLockWaits    *lockWaitStats
+	recentLogs        *recentLogLines
 }
 
 var _ KBFSOps = (*folderBranchOps)(nil)
@@ -351,7 +427,8 @@ var _ fbmHelper = (*folderBranchOps)(nil)
 
 // newFolderBranchOps constructs a new folderBranchOps object.
 func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
-	bType branchType) *folderBranchOps {
+	bType branchType, crLimiter *kbfssync.Semaphore,
+	retained *retainedBranches) *folderBranchOps {
 	var nodeCache NodeCache
 	if config.Mode() == InitMinimal {
 		// If we're in minimal mode, let the node cache remain nil to
@@ -371,24 +448,57 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 	tlfStringFull := fb.Tlf.String()
 	// Shorten the TLF ID for the module name.  8 characters should be
 	// unique enough for a local node.
-	log := config.MakeLogger(fmt.Sprintf("FBO %s%s", tlfStringFull[:8],
-		branchSuffix))
+	// Keep the most recent log lines around for debug dumps.
+	recentLogs := newRecentLogLines(config.LogRingBufferBytes())
+	log := newRecentLogger(config.MakeLogger(
+		fmt.Sprintf("FBO %s%s", tlfStringFull[:8], branchSuffix)),
+		recentLogs)
 	// But print it out once in full, just in case.
 	log.CInfof(ctx, "Created new folder-branch for %s", tlfStringFull)
 
 	observers := newObserverList()
 
-	mdWriterLock := makeLeveledMutex(mutexLevel(fboMDWriter), &sync.Mutex{})
-	headLock := makeLeveledRWMutex(mutexLevel(fboHead), &sync.RWMutex{})
-	blockLockMu := makeLeveledRWMutex(mutexLevel(fboBlock), &sync.RWMutex{})
+	mdWriterLockWaits := &lockWaitStats{}
+	headLockWaits := &lockWaitStats{}
+	blockLockWaits := &lockWaitStats{}
+	mdWriterLock := makeLeveledMutex(mutexLevel(fboMDWriter),
+		&waitTimedMutex{stats: mdWriterLockWaits})
+	headLock := makeLeveledRWMutex(mutexLevel(fboHead),
+		&waitTimedRWMutex{stats: headLockWaits})
+	blockLockMu := makeLeveledRWMutex(mutexLevel(fboBlock),
+		&waitTimedRWMutex{stats: blockLockWaits})
 
 	forceSyncChan := make(chan struct{})
 
+	readPositions, err := lru.New(readAheadTrackedFiles)
+	if err != nil {
+		// lru.New only fails for a non-positive size.
+		panic(err)
+	}
+
+	// In read-only mode, nothing is ever dirtied, so leave the
+	// dirty-state maps nil to save memory.
+	var dirtyFiles map[BlockPointer]*dirtyFile
+	var deferred map[BlockRef]deferredState
+	var syncing map[BlockRef]chan struct{}
+	var unrefCache map[BlockRef]*syncInfo
+	var deCache *dirEntryCache
+	var tempIDs *tempBlockIDRegistry
+	if config.Mode() != InitReadOnly {
+		dirtyFiles = make(map[BlockPointer]*dirtyFile)
+		deferred = make(map[BlockRef]deferredState)
+		syncing = make(map[BlockRef]chan struct{})
+		unrefCache = make(map[BlockRef]*syncInfo)
+		deCache = newDirEntryCache()
+		tempIDs = newTempBlockIDRegistry(ctx, config, fb, log)
+	}
+
 	fbo := &folderBranchOps{
 		config:       config,
 		folderBranch: fb,
 		bid:          kbfsmd.BranchID{},
 		bType:        bType,
+		retained:     retained,
 		observers:    observers,
 		status:       newFolderBranchStatusKeeper(config, nodeCache),
 		mdWriterLock: mdWriterLock,
@@ -402,10 +512,12 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 			blockLock: blockLock{
 				leveledRWMutex: blockLockMu,
 			},
-			dirtyFiles: make(map[BlockPointer]*dirtyFile),
-			deferred:   make(map[BlockRef]deferredState),
-			unrefCache: make(map[BlockRef]*syncInfo),
-			deCache:    make(map[BlockRef]deCacheEntry),
+			dirtyFiles: dirtyFiles,
+			deferred:   deferred,
+			syncing:    syncing,
+			unrefCache: unrefCache,
+			deCache:    deCache,
+			tempIDs:    tempIDs,
 			nodeCache:  nodeCache,
 		},
 		nodeCache:       nodeCache,
@@ -415,6 +527,15 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 		updatePauseChan: make(chan (<-chan struct{})),
 		forceSyncChan:   forceSyncChan,
 		syncNeededChan:  make(chan struct{}, 1),
+		createdTime:     config.Clock().Now(),
+		atimeUpdates:    make(map[NodeID]bool),
+		fileOps:         newFileOpSequencer(),
+		readPositions:   readPositions,
+
+		mdWriterLockWaits: mdWriterLockWaits,
+		headLockWaits:     headLockWaits,
+		blockLockWaits:    blockLockWaits,
+		recentLogs:        recentLogs,
 	}
 	fbo.prepper = folderUpdatePrepper{
 		config:       config,
@@ -422,10 +543,14 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 		blocks:       &fbo.blocks,
 		log:          log,
 	}
-	fbo.cr = NewConflictResolver(config, fbo)
+	fbo.cr = NewConflictResolver(config, fbo, crLimiter)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
+	fbo.activity = newTlfActivityDigester(config, fbo, log)
+	fbo.usage = newTlfUsageMonitor(config, fbo, log)
+	fbo.opStats = newTlfOpStats(config, fb, log)
 	fbo.rekeyFSM = NewRekeyFSM(fbo)
+	fbo.rekeyProgress = newRekeyProgress(config)
 	if config.DoBackgroundFlushes() {
 		go fbo.backgroundFlusher()
 	}
@@ -447,7 +572,12 @@ func (fbo *folderBranchOps) markForReIdentifyIfNeeded(now time.Time, maxValid ti
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by folderBranchOps.
 func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
-	if fbo.config.CheckStateOnShutdown() {
+	return fbo.shutdown(ctx, fbo.config.CheckStateOnShutdown())
+}
+
+func (fbo *folderBranchOps) shutdown(
+	ctx context.Context, checkState bool) error {
+	if checkState {
 		lState := makeFBOLockState()
 
 		if fbo.blocks.GetState(lState) == dirtyState {
@@ -471,9 +601,14 @@ func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
 
 	close(fbo.shutdownChan)
 	fbo.merkleFetches.Wait(ctx)
+	fbo.pipelinedPuts.Wait(ctx)
+	fbo.speculativeFetches.Wait(ctx)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.editHistory.Shutdown()
+	fbo.activity.Shutdown()
+	fbo.usage.Shutdown()
+	fbo.opStats.Shutdown()
 	fbo.rekeyFSM.Shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
@@ -483,6 +618,44 @@ func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// flushForShutdown tries to sync any dirty files and batched
+// directory operations in this folder-branch, until `ctx` is done,
+// in preparation for a shutdown.  It returns the paths of any files
+// that are still dirty afterward.
+func (fbo *folderBranchOps) flushForShutdown(
+	ctx context.Context) (dirtyPaths []string) {
+	lState := makeFBOLockState()
+	if fbo.blocks.GetState(lState) == dirtyState ||
+		fbo.getCachedDirOpsCount(lState) > 0 {
+		fbo.log.CDebugf(ctx, "Flushing dirty state before shutdown")
+		err := fbo.SyncAll(ctx, fbo.folderBranch)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't flush before shutdown: %+v", err)
+		}
+	}
+
+	dirtyPaths = fbo.getDirtyFilePaths(lState)
+	if len(dirtyPaths) > 0 {
+		fbo.log.CWarningf(ctx, "Shutting down with %d dirty files: %v",
+			len(dirtyPaths), dirtyPaths)
+	}
+	return dirtyPaths
+}
+
+// getDirtyFilePaths returns the paths of the files that are
+// currently dirty.  Directories that are only dirty because of
+// batched operations on their children aren't included.
+func (fbo *folderBranchOps) getDirtyFilePaths(lState *lockState) []string {
+	var paths []string
+	for _, n := range fbo.status.getDirtyNodes() {
+		p := fbo.nodeCache.PathFromNode(n)
+		if fbo.blocks.IsDirtyFile(lState, p) {
+			paths = append(paths, p.String())
+		}
+	}
+	return paths
+}
+
 func (fbo *folderBranchOps) id() tlf.ID {
 	return fbo.folderBranch.Tlf
 }
@@ -578,6 +751,12 @@ func (fbo *folderBranchOps) updateLastGetHeadTimestamp() {
 	fbo.lastGetHead = fbo.config.Clock().Now()
 }
 
+func (fbo *folderBranchOps) updateLastOpsLookupTimestamp() {
+	fbo.muLastGetHead.Lock()
+	defer fbo.muLastGetHead.Unlock()
+	fbo.lastOpsLookup = fbo.config.Clock().Now()
+}
+
 // getTrustedHead should not be called outside of folder_branch_ops.go.
 // Returns ImmutableRootMetadata{} when the head is not trusted.
 // See the comment on headTrustedStatus for more information.
@@ -735,7 +914,11 @@ func (fbo *folderBranchOps) setHeadLocked(
 		fbo.setBranchIDLocked(lState, md.BID())
 		// Use uninitialized for the merged branch; the unmerged
 		// revision is enough to trigger conflict resolution.
-		fbo.cr.Resolve(ctx, md.Revision(), kbfsmd.RevisionUninitialized)
+		// Archived branches are read-only, and never resolved.
+		if fbo.bType != archive {
+			fbo.cr.Resolve(
+				ctx, md.Revision(), kbfsmd.RevisionUninitialized)
+		}
 	} else if md.MergedStatus() == kbfsmd.Merged {
 		journalEnabled := TLFJournalEnabled(fbo.config, fbo.id())
 		if journalEnabled {
@@ -795,11 +978,22 @@ func (fbo *folderBranchOps) setHeadLocked(
 		return errors.New("Must swap in block changes before setting head")
 	}
 
+	if fbo.config.Mode() == InitReadOnly && !isFirstHead &&
+		fbo.head.Revision() != md.Revision() {
+		// Read-only services only ever need the head, and might
+		// serve a lot of TLFs, so don't let the MD cache fill up
+		// with old revisions.
+		fbo.config.MDCache().Delete(
+			fbo.id(), fbo.head.Revision(), fbo.head.BID())
+	}
 	fbo.head = md
 	if isFirstHead && headStatus == headTrusted {
 		fbo.headStatus = headTrusted
 	}
 	fbo.status.setRootMetadata(md)
+	if md.MergedStatus() == kbfsmd.Merged && fbo.branch() == MasterBranch {
+		fbo.usage.update(ctx, md)
+	}
 	if isFirstHead {
 		// Start registering for updates right away, using this MD
 		// as a starting point. For now only the master branch can
@@ -929,6 +1123,8 @@ func (fbo *folderBranchOps) setHeadSuccessorLocked(ctx context.Context,
 			defer fbo.identifyLock.Unlock()
 			fbo.identifyDone = false
 		}()
+		// A handle change might have removed the current user.
+		_ = fbo.checkAccessRevoked(ctx, md)
 	}
 
 	return nil
@@ -1066,6 +1262,10 @@ func (fbo *folderBranchOps) getMDForWriteOrRekeyLocked(
 		return md, nil
 	}
 
+	if fbo.bType == archive {
+		return fbo.setRetainedHeadLocked(ctx, lState)
+	}
+
 	// MDs coming from from rekey notifications are marked untrusted.
 	//
 	// TODO: Make tests not take this code path.
@@ -1078,12 +1278,12 @@ func (fbo *folderBranchOps) getMDForWriteOrRekeyLocked(
 	// get the head of the unmerged branch for this device (if any)
 	md, err = mdops.GetUnmergedForTLF(ctx, fbo.id(), kbfsmd.NullBranchID)
 	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return ImmutableRootMetadata{}, fbo.noteQuarantine(ctx, err)
 	}
 
 	mergedMD, err := mdops.GetForTLF(ctx, fbo.id(), nil)
 	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return ImmutableRootMetadata{}, fbo.noteQuarantine(ctx, err)
 	}
 
 	if mergedMD == (ImmutableRootMetadata{}) {
@@ -1130,6 +1330,9 @@ func (fbo *folderBranchOps) getMDForWriteOrRekeyLocked(
 
 func (fbo *folderBranchOps) getMDForReadHelper(
 	ctx context.Context, lState *lockState, rtype mdReadType) (ImmutableRootMetadata, error) {
+	if err := fbo.checkQuarantine(ctx, false); err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	md, err := fbo.getMDForRead(ctx, lState, rtype)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -1199,6 +1402,9 @@ func (fbo *folderBranchOps) getMDForReadNeedIdentify(
 // one must be created by the caller.
 func (fbo *folderBranchOps) getMDForReadNeedIdentifyOnMaybeFirstAccess(
 	ctx context.Context, lState *lockState) (ImmutableRootMetadata, error) {
+	if err := fbo.checkQuarantine(ctx, false); err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
 
 	if _, ok := err.(MDWriteNeededInRequest); ok {
@@ -1235,6 +1441,9 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 	ImmutableRootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := fbo.checkQuarantine(ctx, true); err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	md, err := fbo.getMDForWriteOrRekeyLocked(ctx, lState, mdWrite)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -1291,6 +1500,9 @@ func (fbo *folderBranchOps) getMDForRekeyWriteLocked(
 	wasRekeySet bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := fbo.checkQuarantine(ctx, true); err != nil {
+		return nil, kbfscrypto.VerifyingKey{}, false, err
+	}
 	md, err := fbo.getMDForWriteOrRekeyLocked(ctx, lState, mdRekey)
 	if err != nil {
 		return nil, kbfscrypto.VerifyingKey{}, false, err
@@ -1326,6 +1538,44 @@ func (fbo *folderBranchOps) getMDForRekeyWriteLocked(
 	return newMd, md.LastModifyingWriterVerifyingKey(), md.IsRekeySet(), nil
 }
 
+// checkReaderMDChange returns a ReaderMDChangeError if the current
+// user is only a reader of the TLF, and `md` changes anything in
+// `prevMD` besides the user's own reader keys and the rekey bit.
+// The server enforces this as well, but checking it before the put
+// gives a clearer error and guards against client bugs.
+func (fbo *folderBranchOps) checkReaderMDChange(ctx context.Context,
+	md *RootMetadata, prevMD ImmutableRootMetadata) error {
+	if md.TypeForKeying() != tlf.PrivateKeying {
+		// Only private TLFs have readers that can put MD.
+		return nil
+	}
+
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	handle := md.GetTlfHandle()
+	if handle.IsWriter(session.UID) {
+		return nil
+	}
+
+	readerErr := ReaderMDChangeError{
+		session.Name, handle.GetCanonicalPath(), md.Revision()}
+	if prevMD == (ImmutableRootMetadata{}) || prevMD.mdID != md.PrevRoot() {
+		// Readers can only put direct successors of an existing MD.
+		return readerErr
+	}
+	ok, err := md.bareMd.IsValidRekeyRequest(fbo.config.Codec(),
+		prevMD.bareMd, session.UID, prevMD.extra, md.extra)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return readerErr
+	}
+	return nil
+}
+
 func (fbo *folderBranchOps) nowUnixNano() int64 {
 	return fbo.config.Clock().Now().UnixNano()
 }
@@ -1399,6 +1649,7 @@ func ResetRootBlock(ctx context.Context, config Config,
 	}
 	prevDiskUsage := rmd.DiskUsage()
 	rmd.SetDiskUsage(0)
+	rmd.SetDedupDiskUsage(0)
 	// Redundant, since this is called only for brand-new or
 	// successor RMDs, but leave in to be defensive.
 	rmd.ClearBlockChanges()
@@ -1513,6 +1764,12 @@ func (fbo *folderBranchOps) initMDLocked(
 		return err
 	}
 
+	err = validateMDForPut(
+		fbo.config.Codec(), md, ImmutableRootMetadata{})
+	if err != nil {
+		return err
+	}
+
 	// Write out the new metadata.  If journaling is enabled, we don't
 	// want the rekey to hit the journal and possibly end up on a
 	// conflict branch, so push straight to the server.
@@ -1565,6 +1822,12 @@ func (fbo *folderBranchOps) GetTLFID(ctx context.Context, h *TlfHandle) (tlf.ID,
 	return tlf.ID{}, errors.New("GetTLFID is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) RecoverFolderAccess(
+	ctx context.Context, h *TlfHandle) error {
+	return errors.New(
+		"RecoverFolderAccess is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) GetOrCreateRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName) (
 	node Node, ei EntryInfo, err error) {
@@ -1591,7 +1854,12 @@ func (fbo *folderBranchOps) checkNodeForWrite(
 	if err != nil {
 		return err
 	}
-	if !node.Readonly(ctx) {
+	err = fbo.checkQuarantine(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !node.Readonly(ctx) && fbo.bType != archive &&
+		fbo.config.Mode() != InitReadOnly {
 		return nil
 	}
 
@@ -1854,6 +2122,45 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 	return children, nil
 }
 
+func (fbo *folderBranchOps) GetDirChildrenWithNodes(
+	ctx context.Context, dir Node) (children map[string]DirChild, err error) {
+	fbo.log.CDebugf(ctx, "GetDirChildrenWithNodes %s", getNodeIDStr(dir))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx,
+			"GetDirChildrenWithNodes %s done, %d entries: %+v",
+			getNodeIDStr(dir), len(children), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		if fbo.nodeCache.IsUnlinked(dir) {
+			fbo.log.CDebugf(ctx, "Returning an empty children set for "+
+				"unlinked directory %v",
+				fbo.nodeCache.PathFromNode(dir).tailPointer())
+			return nil
+		}
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		children, err = fbo.blocks.GetDirtyDirChildrenWithNodes(
+			ctx, lState, md.ReadOnly(), dir)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return children, nil
+}
+
 func (fbo *folderBranchOps) processMissedLookup(
 	ctx context.Context, dir Node, name string, missErr error) (
 	node Node, ei EntryInfo, err error) {
@@ -1902,6 +2209,7 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	// `node`, so use a new param for that.
 	var n Node
 	var de DirEntry
+	var kmd KeyMetadata
 	err = runUnlessCanceled(ctx, func() error {
 		if fbo.nodeCache.IsUnlinked(dir) {
 			fbo.log.CDebugf(ctx, "Refusing a lookup for unlinked directory %v",
@@ -1914,6 +2222,7 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 		if err != nil {
 			return err
 		}
+		kmd = md
 
 		n, de, err = fbo.blocks.Lookup(ctx, lState, md.ReadOnly(), dir, name)
 		if _, isMiss := errors.Cause(err).(NoSuchNameError); isMiss {
@@ -1930,9 +2239,121 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
+	if de.Type == Dir {
+		fbo.fetchDirSpeculatively(ctx, kmd, de.BlockPointer)
+	}
 	return n, de.EntryInfo, nil
 }
 
+// fetchDirSpeculatively starts fetching, in the background, the block
+// of a directory that was just looked up, and then the blocks of its
+// first few children, since a lookup of a directory is usually
+// followed by a listing of it and stats of its children.  The fetches
+// are made as background fetches; the foreground fetches of a listing
+// that follows will elevate them if they're still queued.  It does
+// nothing if the directory's block is dirty, or is cached and has
+// already had its children prefetched, or if prefetching has been
+// turned off with TogglePrefetcher.
+func (fbo *folderBranchOps) fetchDirSpeculatively(
+	ctx context.Context, kmd KeyMetadata, ptr BlockPointer) {
+	if fbo.config.Mode() == InitMinimal || !ptr.IsValid() ||
+		fbo.config.DirtyBlockCache().IsDirty(fbo.id(), ptr, fbo.branch()) {
+		return
+	}
+	if p, ok := fbo.config.BlockOps().Prefetcher().(*blockPrefetcher); ok &&
+		p.isShutdown() {
+		return
+	}
+	_, prefetchStatus, _, err := fbo.config.BlockCache().GetWithPrefetch(ptr)
+	if err == nil && prefetchStatus != NoPrefetch {
+		return
+	}
+	fbo.log.CDebugf(ctx, "Speculatively fetching directory %v", ptr)
+	fbo.speculativeFetches.Add(1)
+	go func() {
+		defer fbo.speculativeFetches.Done()
+		_ = fbo.runUnlessShutdown(func(ctx context.Context) error {
+			return fbo.doFetchDirSpeculatively(ctx, kmd, ptr)
+		})
+	}()
+}
+
+func (fbo *folderBranchOps) doFetchDirSpeculatively(
+	ctx context.Context, kmd KeyMetadata, ptr BlockPointer) (err error) {
+	defer func() {
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Speculative fetch of directory %v "+
+				"failed: %+v", ptr, err)
+		}
+	}()
+	retriever := fbo.config.BlockOps().BlockRetriever()
+	priority := BlockFetchBackground.requestPriority()
+	wait := func(errCh <-chan error) error {
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	dblock := NewDirBlock().(*DirBlock)
+	err = wait(retriever.Request(
+		ctx, priority, kmd, ptr, dblock, TransientEntry))
+	if err != nil {
+		return err
+	}
+
+	// Fetch the first children, in name order, all at once.
+	var ptrs []BlockPointer
+	var blocks []Block
+	if dblock.IsInd {
+		for _, iptr := range dblock.IPtrs {
+			ptrs = append(ptrs, iptr.BlockPointer)
+			blocks = append(blocks, NewDirBlock())
+		}
+	} else {
+		names := make([]string, 0, len(dblock.Children))
+		for name := range dblock.Children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			de := dblock.Children[name]
+			if de.DataVer == InlineDataVer {
+				// The contents are in `de` itself, not in a block.
+				continue
+			}
+			switch de.Type {
+			case Dir:
+				ptrs = append(ptrs, de.BlockPointer)
+				blocks = append(blocks, NewDirBlock())
+			case File, Exec:
+				ptrs = append(ptrs, de.BlockPointer)
+				blocks = append(blocks, NewFileBlock())
+			}
+		}
+	}
+	if len(ptrs) > speculativeLookupChildren {
+		ptrs = ptrs[:speculativeLookupChildren]
+	}
+
+	errChs := make([]<-chan error, 0, len(ptrs))
+	for i, childPtr := range ptrs {
+		if !childPtr.IsValid() {
+			continue
+		}
+		errChs = append(errChs, retriever.Request(
+			ctx, priority, kmd, childPtr, blocks[i], TransientEntry))
+	}
+	for _, errCh := range errChs {
+		if childErr := wait(errCh); childErr != nil && err == nil {
+			err = childErr
+		}
+	}
+	return err
+}
+
 // statEntry is like Stat, but it returns a DirEntry. This is used by
 // tests.
 func (fbo *folderBranchOps) statEntry(ctx context.Context, node Node) (
@@ -2038,9 +2459,101 @@ func (fbo *folderBranchOps) GetNodeMetadata(ctx context.Context, node Node) (
 	prefetchStatus := fbo.config.PrefetchStatus(ctx, fbo.id(),
 		res.BlockInfo.BlockPointer)
 	res.PrefetchStatus = prefetchStatus.String()
+	res.WriteTags = fbo.blocks.GetWriteTags(makeFBOLockState(), node)
 	return res, nil
 }
 
+func (fbo *folderBranchOps) NodeToken(ctx context.Context, node Node) (
+	token NodeToken, err error) {
+	fbo.log.CDebugf(ctx, "NodeToken %s", getNodeIDStr(node))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "NodeToken %s done: %+v",
+			getNodeIDStr(node), err)
+	}()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return "", err
+	}
+	p, err := fbo.pathFromNodeForRead(node)
+	if err != nil {
+		return "", err
+	}
+	de, err := fbo.statEntry(ctx, node)
+	if err != nil {
+		return "", err
+	}
+
+	data := nodeTokenData{
+		Version: nodeTokenVersion,
+		Tlf:     fbo.id(),
+		Branch:  fbo.branch(),
+		Ptr:     p.tailPointer(),
+		Path:    make([]string, 0, len(p.path)-1),
+		Type:    de.Type,
+	}
+	for _, pn := range p.path[1:] {
+		data.Path = append(data.Path, pn.Name)
+	}
+	return makeNodeToken(fbo.config.Codec(), data)
+}
+
+func (fbo *folderBranchOps) NodeFromToken(
+	ctx context.Context, token NodeToken) (
+	node Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "NodeFromToken")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "NodeFromToken done: %s %+v",
+			getNodeIDStr(node), err)
+	}()
+
+	data, err := decodeNodeToken(fbo.config.Codec(), token)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	fb := FolderBranch{Tlf: data.Tlf, Branch: data.Branch}
+	if fb != fbo.folderBranch {
+		return nil, EntryInfo{}, WrongOpsError{fb, fbo.folderBranch}
+	}
+
+	// If the node hasn't changed since the token was made, and is
+	// still in use, it can be returned without any lookups.
+	n := fbo.nodeCache.Get(data.Ptr.Ref())
+	if n != nil && !fbo.nodeCache.IsUnlinked(n) {
+		ei, err := fbo.Stat(ctx, n)
+		if err == nil {
+			return n, ei, nil
+		}
+	}
+
+	// Otherwise, find the node again by its path in the current head.
+	n, ei, _, err = fbo.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if n == nil {
+		return nil, EntryInfo{}, data.staleError("the folder has no root")
+	}
+	for i, name := range data.Path {
+		if n == nil {
+			return nil, EntryInfo{}, data.staleError(
+				stdpath.Join(data.Path[:i]...) + " is no longer a directory")
+		}
+		n, ei, err = fbo.Lookup(ctx, n, name)
+		if _, isMiss := errors.Cause(err).(NoSuchNameError); isMiss {
+			return nil, EntryInfo{}, data.staleError(
+				stdpath.Join(data.Path[:i+1]...) + " no longer exists")
+		} else if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+	if n == nil || (ei.Type == Dir) != (data.Type == Dir) {
+		return nil, EntryInfo{}, data.staleError(
+			"it is now a " + ei.Type.String())
+	}
+	return n, ei, nil
+}
+
 // blockPutState is an internal structure to track data when putting blocks
 type blockPutState struct {
 	blockStates []blockState
@@ -2148,37 +2661,40 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 	return nil
 }
 
-// Returns true if the passed error indicates a revision conflict.
-func isRevisionConflict(err error) bool {
-	if err == nil {
-		return false
-	}
-	_, isConflictRevision := err.(kbfsmd.ServerErrorConflictRevision)
-	_, isConflictPrevRoot := err.(kbfsmd.ServerErrorConflictPrevRoot)
-	_, isConflictDiskUsage := err.(kbfsmd.ServerErrorConflictDiskUsage)
-	_, isConditionFailed := err.(kbfsmd.ServerErrorConditionFailed)
-	_, isConflictFolderMapping := err.(kbfsmd.ServerErrorConflictFolderMapping)
-	_, isJournal := err.(MDJournalConflictError)
-	return isConflictRevision || isConflictPrevRoot ||
-		isConflictDiskUsage || isConditionFailed ||
-		isConflictFolderMapping || isJournal
+// mdWritePrep is the state gathered by the prepare phase of an MD
+// write.
+type mdWritePrep struct {
+	session     SessionInfo
+	oldPrevRoot kbfsmd.ID
 }
 
-func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, bps *blockPutState, excl Excl,
-	notifyFn func(ImmutableRootMetadata) error) (
-	err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
-
-	// finally, write out the new metadata
-	mdops := fbo.config.MDOps()
-
-	doUnmergedPut := true
-	mergedRev := kbfsmd.RevisionUninitialized
-
-	oldPrevRoot := md.PrevRoot()
+// mdWritePut is the outcome of the put phase of an MD write.
+type mdWritePut struct {
+	irmd ImmutableRootMetadata
+	// unmerged is true if the MD was put on an unmerged branch.
+	unmerged bool
+	// mergedRev is the revision that conflicted with a merged put,
+	// if any.
+	mergedRev kbfsmd.Revision
+	// pipelined is true if the MD server hasn't acknowledged the
+	// put yet.
+	pipelined bool
+}
 
-	var irmd ImmutableRootMetadata
+// prepareMDWriteLocked runs all the checks on `md` that can fail
+// before anything is sent to the MD server.  It doesn't change the
+// head or the branch of the folder, so if it fails, the caller only
+// needs to clean up the blocks in `bps`.
+//
+// It has to run under mdWriterLock: `md` and `bps` are made from the
+// head under that lock by the caller, the checks compare `md` against
+// that same head, and the deadline check only means something right
+// before the put.  The session lookup is usually served from the
+// service's cache, so there's nothing to gain by doing it earlier.
+func (fbo *folderBranchOps) prepareMDWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState) (
+	mdWritePrep, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
 	// This puts on a delay on any cancellations arriving to ctx. It is intended
 	// to work sort of like a critical section, except that there isn't an
@@ -2198,9 +2714,9 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	// Ctrl-C, this might not be a big deal. However, it also happens for other
 	// interrupts.  For applications that use signals to communicate, e.g.
 	// SIGALRM and SIGUSR1, this can happen pretty often, which renders broken.
-	if err = EnableDelayedCancellationWithGracePeriod(
+	if err := EnableDelayedCancellationWithGracePeriod(
 		ctx, fbo.config.DelayedCancellationGracePeriod()); err != nil {
-		return err
+		return mdWritePrep{}, err
 	}
 	// we don't explicitly clean up (by using a defer) CancellationDelayer here
 	// because sometimes fuse makes another call using the same ctx.  For example, in
@@ -2211,92 +2727,167 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	// have already succeeded. Returning EINTR makes application thinks the file
 	// is not created successfully.
 
-	err = fbo.finalizeBlocks(bps)
+	// Delayed cancellation doesn't help with deadlines, so if there
+	// isn't enough time left to hear back from the server, don't
+	// start the put at all.  Journal puts are local, and don't need
+	// this.
+	if deadline, ok := ctx.Deadline(); ok &&
+		!TLFJournalEnabled(fbo.config, fbo.id()) {
+		// Context deadlines use the wall clock, not config.Clock().
+		if remaining := deadline.Sub(time.Now()); remaining <
+			minMDPutTimeRemaining {
+			fbo.log.CDebugf(ctx, "Not putting MD with only %s left before "+
+				"the deadline", remaining)
+			return mdWritePrep{}, context.DeadlineExceeded
+		}
+	}
+
+	err := fbo.finalizeBlocks(bps)
 	if err != nil {
-		return err
+		return mdWritePrep{}, err
 	}
 
 	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
-		return err
+		return mdWritePrep{}, err
+	}
+
+	head, _ := fbo.getHead(lState)
+	if err := fbo.checkReaderMDChange(ctx, md, head); err != nil {
+		return mdWritePrep{}, err
 	}
+	if err := validateMDForPut(fbo.config.Codec(), md, head); err != nil {
+		return mdWritePrep{}, err
+	}
+
+	return mdWritePrep{session, md.PrevRoot()}, nil
+}
+
+// putMDWriteLocked puts `md` to the MD server, on the master branch
+// if possible and on an unmerged branch otherwise.  If it fails, the
+// head and branch of the folder are unchanged, except that an
+// exclusive write that conflicts first syncs the folder with the
+// server.
+func (fbo *folderBranchOps) putMDWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, prep mdWritePrep, excl Excl) (
+	mdWritePut, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	mdops := fbo.config.MDOps()
+	res := mdWritePut{mergedRev: kbfsmd.RevisionUninitialized}
 
 	if fbo.isMasterBranchLocked(lState) {
 		// only do a normal Put if we're not already staged.
-		irmd, err = mdops.Put(
-			ctx, md, session.VerifyingKey, nil, keybase1.MDPriorityNormal)
-		if doUnmergedPut = isRevisionConflict(err); doUnmergedPut {
-			fbo.log.CDebugf(ctx, "Conflict: %v", err)
-			mergedRev = md.Revision()
-
-			if excl == WithExcl {
-				// If this was caused by an exclusive create, we shouldn't do an
-				// kbfsmd.UnmergedPut, but rather try to get newest update from server, and
-				// retry afterwards.
-				err = fbo.getAndApplyMDUpdates(ctx,
-					lState, nil, fbo.applyMDUpdatesLocked)
-				if err != nil {
-					return err
-				}
-				return ExclOnUnmergedError{}
+		irmd, err := mdops.Put(ctx, md, prep.session.VerifyingKey, nil,
+			keybase1.MDPriorityNormal)
+		if !isRevisionConflict(err) {
+			if err != nil {
+				return mdWritePut{}, fbo.noteQuarantine(ctx, err)
 			}
-		} else if err != nil {
-			return err
+			res.irmd = irmd
+			return res, nil
 		}
-	} else if excl == WithExcl {
-		return ExclOnUnmergedError{}
-	}
 
-	doResolve := false
-	resolveMergedRev := mergedRev
-	if doUnmergedPut {
-		// We're out of date, and this is not an exclusive write, so put it as an
-		// unmerged MD.
-		irmd, err = mdops.PutUnmerged(ctx, md, session.VerifyingKey)
-		if isRevisionConflict(err) {
-			// Self-conflicts are retried in `doMDWriteWithRetry`.
-			return UnmergedSelfConflictError{err}
-		} else if err != nil {
-			// If a PutUnmerged fails, we are in a bad situation: if
-			// we fail, but the put succeeded, then dirty data will
-			// remain cached locally and will be re-tried
-			// (non-idempotently) on the next sync call.  This should
-			// be a very rare situation when journaling is enabled, so
-			// instead let's pretend it succeeded so that the cached
-			// data is cleared and the nodeCache is updated.  If we're
-			// wrong, and the update didn't make it to the server,
-			// then the next call will get an
-			// kbfsmd.UnmergedSelfConflictError but fail to find any new
-			// updates and fail the operation, but things will get
-			// fixed up once conflict resolution finally completes.
-			//
-			// TODO: how confused will the kernel cache get if the
-			// pointers are updated but the file system operation
-			// still gets an error returned by the wrapper function
-			// that calls us (in the event of a user cancellation)?
-			fbo.log.CInfof(ctx, "Ignoring a PutUnmerged error: %+v", err)
-			err = encryptMDPrivateData(
-				ctx, fbo.config.Codec(), fbo.config.Crypto(),
-				fbo.config.Crypto(), fbo.config.KeyManager(), session.UID, md)
-			if err != nil {
-				return err
-			}
-			mdID, err := kbfsmd.MakeID(fbo.config.Codec(), md.bareMd)
-			if err != nil {
-				return err
-			}
-			irmd = MakeImmutableRootMetadata(
-				md, session.VerifyingKey, mdID, fbo.config.Clock().Now(), true)
-			err = fbo.config.MDCache().Put(irmd)
+		fbo.log.CDebugf(ctx, "Conflict: %v", err)
+		res.mergedRev = md.Revision()
+
+		if excl == WithExcl {
+			// If this was caused by an exclusive create, we shouldn't do an
+			// kbfsmd.UnmergedPut, but rather try to get newest update from server, and
+			// retry afterwards.
+			err = fbo.getAndApplyMDUpdates(ctx,
+				lState, nil, fbo.applyMDUpdatesLocked)
 			if err != nil {
-				return err
+				return mdWritePut{}, err
 			}
+			return mdWritePut{}, ExclOnUnmergedError{}
 		}
-		bid := md.BID()
-		fbo.setBranchIDLocked(lState, bid)
-		doResolve = true
-	} else {
-		fbo.setBranchIDLocked(lState, kbfsmd.NullBranchID)
+	} else if excl == WithExcl {
+		return mdWritePut{}, ExclOnUnmergedError{}
+	}
+
+	// We're out of date, and this is not an exclusive write, so put it as an
+	// unmerged MD.
+	res.unmerged = true
+	irmd, err := fbo.putUnmergedMDWriteLocked(ctx, lState, md, prep)
+	if err != nil {
+		return mdWritePut{}, err
+	}
+	res.irmd = irmd
+	return res, nil
+}
+
+// putUnmergedMDWriteLocked puts `md` to the MD server on an unmerged
+// branch, which is a new one unless `md` already has a branch ID.
+func (fbo *folderBranchOps) putUnmergedMDWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, prep mdWritePrep) (
+	ImmutableRootMetadata, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	mdops := fbo.config.MDOps()
+
+	irmd, err := mdops.PutUnmerged(ctx, md, prep.session.VerifyingKey)
+	if isRevisionConflict(err) {
+		// Self-conflicts are retried in `doMDWriteWithRetry`.
+		return ImmutableRootMetadata{}, UnmergedSelfConflictError{err}
+	} else if err != nil {
+		// If a PutUnmerged fails, we are in a bad situation: if
+		// we fail, but the put succeeded, then dirty data will
+		// remain cached locally and will be re-tried
+		// (non-idempotently) on the next sync call.  This should
+		// be a very rare situation when journaling is enabled, so
+		// instead let's pretend it succeeded so that the cached
+		// data is cleared and the nodeCache is updated.  If we're
+		// wrong, and the update didn't make it to the server,
+		// then the next call will get an
+		// kbfsmd.UnmergedSelfConflictError but fail to find any new
+		// updates and fail the operation, but things will get
+		// fixed up once conflict resolution finally completes.
+		//
+		// TODO: how confused will the kernel cache get if the
+		// pointers are updated but the file system operation
+		// still gets an error returned by the wrapper function
+		// that calls us (in the event of a user cancellation)?
+		fbo.log.CInfof(ctx, "Ignoring a PutUnmerged error: %+v", err)
+		err = encryptMDPrivateData(
+			ctx, fbo.config.Codec(), fbo.config.Crypto(),
+			fbo.config.Crypto(), fbo.config.KeyManager(),
+			prep.session.UID, md)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+		mdID, err := kbfsmd.MakeID(fbo.config.Codec(), md.bareMd)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+		irmd = MakeImmutableRootMetadata(md, prep.session.VerifyingKey,
+			mdID, fbo.config.Clock().Now(), true)
+		err = fbo.config.MDCache().Put(irmd)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
+	return irmd, nil
+}
+
+// commitMDWriteLocked makes the put MD the new head of the folder,
+// updates its branch, kicks off conflict resolution if needed, and
+// notifies observers.  The MD is already on the server at this
+// point, so nothing here can be rolled back; an error just means
+// the local state might lag behind the server until the next
+// update.
+func (fbo *folderBranchOps) commitMDWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState,
+	prep mdWritePrep, res mdWritePut,
+	notifyFn func(ImmutableRootMetadata) error) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	doResolve := false
+	resolveMergedRev := res.mergedRev
+	if res.unmerged {
+		fbo.assertTransitionLocked(ctx, lState, fbtStage)
+		fbo.setBranchIDLocked(lState, md.BID())
+		doResolve = true
+	} else {
+		fbo.setBranchIDLocked(lState, kbfsmd.NullBranchID)
 
 		if md.IsRekeySet() && !md.IsWriterMetadataCopiedSet() {
 			// Queue this folder for rekey if the bit was set and it's not a copy.
@@ -2313,7 +2904,7 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 
 	md.loadCachedBlockChanges(ctx, bps, fbo.log)
 
-	rebased := (oldPrevRoot != md.PrevRoot())
+	rebased := (prep.oldPrevRoot != md.PrevRoot())
 	if rebased {
 		bid := md.BID()
 		fbo.setBranchIDLocked(lState, bid)
@@ -2323,14 +2914,15 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
-	err = fbo.setHeadSuccessorLocked(ctx, lState, irmd, rebased)
+	err := fbo.setHeadSuccessorLocked(ctx, lState, res.irmd, rebased)
 	if err != nil {
 		return err
 	}
 
-	// Archive the old, unref'd blocks if journaling is off.
-	if !TLFJournalEnabled(fbo.config, fbo.id()) {
-		fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
+	// Archive the old, unref'd blocks if journaling is off.  For a
+	// pipelined put, this waits until the put is settled.
+	if !TLFJournalEnabled(fbo.config, fbo.id()) && !res.pipelined {
+		fbo.fbm.archiveUnrefBlocks(res.irmd.ReadOnly())
 	}
 
 	// Call Resolve() after the head is set, to make sure it fetches
@@ -2340,7 +2932,7 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	}
 
 	if notifyFn != nil {
-		err := notifyFn(irmd)
+		err := notifyFn(res.irmd)
 		if err != nil {
 			return err
 		}
@@ -2348,6 +2940,317 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	return nil
 }
 
+// finalizeMDWriteLocked writes out `md`, whose blocks in `bps` have
+// already been put, in three phases: prepare, put, and commit.  Only
+// the put talks to the MD server.  If it returns an error from the
+// prepare or put phases, the folder's head and branch are unchanged;
+// see the individual phases for details.
+//
+// If MD put pipelining is on, the put of `md` may still be in flight
+// when this returns; see `pipelineMDWriteLocked`.
+func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState, excl Excl,
+	notifyFn func(ImmutableRootMetadata) error) (
+	err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	prep, err := fbo.prepareMDWriteLocked(ctx, lState, md, bps)
+	if err != nil {
+		return err
+	}
+
+	// `md` may be the successor of a pipelined put that the server
+	// hasn't acknowledged yet, so settle that put before sending
+	// `md`.  If it had to be rolled back, the head `md` was made from
+	// is now on an unmerged branch, so rebase `md` onto it.
+	rolledBack, err := fbo.settleMDPutLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if rolledBack {
+		head, _ := fbo.getHead(lState)
+		md.SetPrevRoot(head.mdID)
+		md.SetBranchID(head.BID())
+	}
+
+	if mdOps := fbo.pipelinedMDOpsLocked(lState, md, excl); mdOps != nil {
+		return fbo.pipelineMDWriteLocked(
+			ctx, lState, mdOps, md, bps, prep, notifyFn)
+	}
+
+	res, err := fbo.putMDWriteLocked(ctx, lState, md, prep, excl)
+	if err != nil {
+		return err
+	}
+
+	return fbo.commitMDWriteLocked(
+		ctx, lState, md, bps, prep, res, notifyFn)
+}
+
+// mdPipelinedPut is an MD put that became the head of the folder
+// before the MD server acknowledged it, so that the next revision
+// could be prepared in the meantime.
+type mdPipelinedPut struct {
+	md    *RootMetadata
+	rmds  *RootMetadataSigned
+	irmd  ImmutableRootMetadata
+	prep  mdWritePrep
+	mdOps pipelinedMDOps
+
+	// acked is closed once the server has answered the put, and
+	// sendErr is its answer.
+	acked   chan struct{}
+	sendErr error
+
+	// settled is closed once the answer has been applied to the
+	// folder, and err is the result for the write that made the
+	// put.  isSettled is protected by mdWriterLock.
+	settled   chan struct{}
+	isSettled bool
+	err       error
+}
+
+// settle reports `err` to the write that made `p`, if it hasn't
+// gotten a result yet.  It must be called under mdWriterLock.
+func (p *mdPipelinedPut) settle(err error) {
+	if p.isSettled {
+		return
+	}
+	p.isSettled = true
+	p.err = err
+	close(p.settled)
+}
+
+// pipelinedMDOpsLocked returns the MDOps to use for a pipelined put
+// of `md`, or nil if `md` must be put and committed in one go.  Only
+// non-exclusive writes to the master branch of a standard folder are
+// pipelined, and never when journaling is on, since journal puts are
+// local anyway.
+func (fbo *folderBranchOps) pipelinedMDOpsLocked(lState *lockState,
+	md *RootMetadata, excl Excl) pipelinedMDOps {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if !fbo.config.MDPutPipelining() || excl == WithExcl ||
+		fbo.bType != standard || md.MergedStatus() != kbfsmd.Merged ||
+		!fbo.isMasterBranchLocked(lState) ||
+		TLFJournalEnabled(fbo.config, fbo.id()) {
+		return nil
+	}
+
+	mdOps := fbo.config.MDOps()
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		mdOps = jServer.delegateMDOps
+	}
+	pmdOps, _ := mdOps.(pipelinedMDOps)
+	return pmdOps
+}
+
+// pipelineMDWriteLocked signs `md` and commits it as the new head of
+// the folder right away, and then puts it to the MD server in the
+// background, so that the next MD write can be prepared against it.
+// The put is settled either by the next MD write, before that write
+// puts its own MD, or in the background once the server answers.
+// The caller must wait for `fbo.mdPutInFlight` to be settled before
+// reporting the write as done.
+func (fbo *folderBranchOps) pipelineMDWriteLocked(ctx context.Context,
+	lState *lockState, mdOps pipelinedMDOps, md *RootMetadata,
+	bps *blockPutState, prep mdWritePrep,
+	notifyFn func(ImmutableRootMetadata) error) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	rmds, irmd, err := mdOps.signForPut(ctx, md, prep.session.VerifyingKey)
+	if err != nil {
+		return err
+	}
+
+	p := &mdPipelinedPut{
+		md:      md,
+		rmds:    rmds,
+		irmd:    irmd,
+		prep:    prep,
+		mdOps:   mdOps,
+		acked:   make(chan struct{}),
+		settled: make(chan struct{}),
+	}
+	fbo.mdPutInFlight = p
+	fbo.pipelinedPuts.Add(1)
+	go func() {
+		defer fbo.pipelinedPuts.Done()
+		// The put can't be canceled along with the write that made
+		// it, since the folder already treats it as the head.
+		ctx, cancel := context.WithTimeout(
+			fbo.ctxWithFBOID(context.Background()), backgroundTaskTimeout)
+		defer cancel()
+		p.sendErr = fbo.sendPipelinedMDPut(
+			ctx, p, maxRetriesOnRecoverableErrors)
+		close(p.acked)
+
+		// Settle the put, unless the next MD write already did.
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		if fbo.mdPutInFlight != p {
+			return
+		}
+		if _, err := fbo.settleMDPutLocked(ctx, lState); err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't settle pipelined MD rev=%d: %+v",
+				irmd.Revision(), err)
+		}
+	}()
+
+	res := mdWritePut{
+		irmd:      irmd,
+		mergedRev: kbfsmd.RevisionUninitialized,
+		pipelined: true,
+	}
+	return fbo.commitMDWriteLocked(
+		ctx, lState, md, bps, prep, res, notifyFn)
+}
+
+// sendPipelinedMDPut sends the signed MD of `p` to the server.  If
+// the put may not have reached the server, it sends the same signed
+// MD again, up to `retries` times, with a backoff; the MD's
+// idempotency key lets the server tell us if an earlier attempt
+// landed after all.
+func (fbo *folderBranchOps) sendPipelinedMDPut(
+	ctx context.Context, p *mdPipelinedPut, retries int) error {
+	expBackoff := backoff.NewExponentialBackOff()
+	for i := 0; ; i++ {
+		fbo.log.CDebugf(ctx, "Putting pipelined MD rev=%d id=%s",
+			p.irmd.Revision(), p.irmd.mdID)
+		err := func() error {
+			ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+			defer cancel()
+			return p.mdOps.sendPut(
+				ctx, p.rmds, p.irmd, nil, keybase1.MDPriorityNormal)
+		}()
+		if err == nil || !isResendableMDPutError(err) ||
+			i >= retries {
+			return err
+		}
+
+		wait := expBackoff.NextBackOff()
+		if wait == backoff.Stop {
+			return err
+		}
+		fbo.log.CDebugf(ctx, "Sending pipelined MD rev=%d again in %s "+
+			"after error: %+v", p.irmd.Revision(), wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		case <-fbo.shutdownChan:
+			return err
+		}
+	}
+}
+
+// settleMDPutLocked waits for the MD server to answer the pipelined
+// put in flight, if any, and applies the answer to the folder.  If
+// the put conflicted with another writer, the optimistic head is
+// rolled back by putting the same changes on a new unmerged branch,
+// just as if a normal put had conflicted, and conflict resolution
+// takes over from there.  It returns true if the head was rolled
+// back.
+//
+// If the put failed for any other reason, the write that made it
+// fails, like a normal put would.  The head stays ahead of the server
+// though, since later writes may already depend on it, so the put
+// stays in flight, and the next call sends the same signed MD again.
+func (fbo *folderBranchOps) settleMDPutLocked(
+	ctx context.Context, lState *lockState) (rolledBack bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	p := fbo.mdPutInFlight
+	if p == nil {
+		return false, nil
+	}
+
+	select {
+	case <-p.acked:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	sendErr := p.sendErr
+	if p.isSettled {
+		// The write that made `p` has already failed, but the head
+		// still depends on `p`, so try again.  Only once though,
+		// since we're holding mdWriterLock.
+		sendErr = fbo.sendPipelinedMDPut(ctx, p, 0)
+		p.sendErr = sendErr
+	}
+
+	if sendErr == nil {
+		fbo.mdPutInFlight = nil
+		p.settle(nil)
+		if !TLFJournalEnabled(fbo.config, fbo.id()) {
+			fbo.fbm.archiveUnrefBlocks(p.irmd.ReadOnly())
+		}
+		return false, nil
+	}
+
+	if !isRevisionConflict(sendErr) {
+		fbo.log.CDebugf(ctx, "Pipelined put of MD rev=%d failed: %+v",
+			p.irmd.Revision(), sendErr)
+		err = fbo.noteQuarantine(ctx, sendErr)
+		p.settle(err)
+		return false, err
+	}
+
+	fbo.mdPutInFlight = nil
+	defer func() {
+		p.settle(err)
+	}()
+
+	fbo.log.CDebugf(ctx, "Pipelined put of MD rev=%d conflicted; rolling "+
+		"back to an unmerged branch: %+v", p.irmd.Revision(), sendErr)
+	mergedRev := p.irmd.Revision()
+
+	// The optimistic head shares its RootMetadata with `p.md`, so
+	// put a copy on the unmerged branch.
+	md, err := p.md.deepCopy(fbo.config.Codec())
+	if err != nil {
+		return false, err
+	}
+	irmd, err := fbo.putUnmergedMDWriteLocked(ctx, lState, md, p.prep)
+	if err != nil {
+		return false, err
+	}
+	fbo.setBranchIDLocked(lState, md.BID())
+
+	err = func() error {
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		// The unmerged MD has the same contents as the optimistic
+		// head it replaces, so there's nothing to notify.
+		err := fbo.setHeadLocked(ctx, lState, irmd, headTrusted)
+		if err != nil {
+			return err
+		}
+		fbo.setLatestMergedRevisionLocked(
+			ctx, lState, irmd.Revision()-1, true)
+		return nil
+	}()
+	if err != nil {
+		return false, err
+	}
+
+	fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
+	fbo.cr.Resolve(ctx, irmd.Revision(), mergedRev)
+	return true, nil
+}
+
+// waitForMDPutSettled waits for the pipelined put `p` to be settled,
+// and returns the result for the write that made it.
+func (fbo *folderBranchOps) waitForMDPutSettled(
+	ctx context.Context, p *mdPipelinedPut) error {
+	select {
+	case <-p.settled:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (fbo *folderBranchOps) waitForJournalLocked(ctx context.Context,
 	lState *lockState, jServer *JournalServer) error {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -2384,6 +3287,18 @@ func (fbo *folderBranchOps) finalizeMDRekeyWriteLocked(ctx context.Context,
 	lastWriterVerifyingKey kbfscrypto.VerifyingKey) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// A rekey conflicts with any unmerged head, so if a pipelined put
+	// gets rolled back, just let the rekey be retried.
+	rolledBack, err := fbo.settleMDPutLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if rolledBack {
+		fbo.config.RekeyQueue().Enqueue(md.TlfID())
+		return RekeyConflictError{errors.New(
+			"Pipelined MD put was rolled back")}
+	}
+
 	oldPrevRoot := md.PrevRoot()
 
 	// Write out the new metadata.  If journaling is enabled, we don't
@@ -2403,6 +3318,14 @@ func (fbo *folderBranchOps) finalizeMDRekeyWriteLocked(ctx context.Context,
 		mdOps = jServer.delegateMDOps
 	}
 
+	head, _ := fbo.getHead(lState)
+	if err := fbo.checkReaderMDChange(ctx, md, head); err != nil {
+		return err
+	}
+	if err := validateMDForPut(fbo.config.Codec(), md, head); err != nil {
+		return err
+	}
+
 	var key kbfscrypto.VerifyingKey
 	if md.IsWriterMetadataCopiedSet() {
 		key = lastWriterVerifyingKey
@@ -2464,6 +3387,10 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
 
+	if _, err := fbo.settleMDPutLocked(ctx, lState); err != nil {
+		return err
+	}
+
 	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
@@ -2495,6 +3422,12 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 		return err
 	}
 
+	head, _ := fbo.getHead(lState)
+	err = validateMDForPut(fbo.config.Codec(), md, head)
+	if err != nil {
+		return err
+	}
+
 	// finally, write out the new metadata
 	irmd, err := fbo.config.MDOps().Put(
 		ctx, md, session.VerifyingKey, nil, keybase1.MDPriorityNormal)
@@ -2524,6 +3457,105 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 	return fbo.notifyBatchLocked(ctx, lState, irmd)
 }
 
+// GetContentPolicy implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetContentPolicy(
+	ctx context.Context, folderBranch FolderBranch) (
+	*TlfContentPolicy, error) {
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	return md.data.ContentPolicy.deepCopy(fbo.config.Codec())
+}
+
+// SetContentPolicy implements the KBFSOps interface for
+// folderBranchOps.  The policy is changed in an MD update of its own,
+// with no ops.
+func (fbo *folderBranchOps) SetContentPolicy(
+	ctx context.Context, folderBranch FolderBranch,
+	policy *TlfContentPolicy) (err error) {
+	fbo.log.CDebugf(ctx, "SetContentPolicy %+v", policy)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetContentPolicy done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	if _, err := fbo.settleMDPutLocked(ctx, lState); err != nil {
+		return err
+	}
+
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	// Conflict resolution doesn't carry policy changes over from the
+	// unmerged branch.
+	if md.MergedStatus() == kbfsmd.Unmerged {
+		return UnexpectedUnmergedPutError{}
+	}
+
+	err = checkCanSetContentPolicy(ctx, fbo.config, md.GetTlfHandle())
+	if err != nil {
+		return err
+	}
+
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	newPolicy, err := policy.deepCopy(fbo.config.Codec())
+	if err != nil {
+		return err
+	}
+	if newPolicy != nil {
+		newPolicy.SetBy = session.UID
+	}
+	md.data.ContentPolicy = newPolicy
+	// Every MD needs at least one op, and an empty resolutionOp
+	// changes no blocks, as with the squashed batches in SyncAll.
+	md.AddOp(newResolutionOp())
+
+	head, _ := fbo.getHead(lState)
+	err = validateMDForPut(fbo.config.Codec(), md, head)
+	if err != nil {
+		return err
+	}
+
+	oldPrevRoot := md.PrevRoot()
+	irmd, err := fbo.config.MDOps().Put(
+		ctx, md, session.VerifyingKey, nil, keybase1.MDPriorityNormal)
+	if err != nil {
+		return err
+	}
+
+	fbo.setBranchIDLocked(lState, kbfsmd.NullBranchID)
+	rebased := (oldPrevRoot != md.PrevRoot())
+	if rebased {
+		bid := md.BID()
+		fbo.setBranchIDLocked(lState, bid)
+		fbo.cr.Resolve(ctx, md.Revision(), kbfsmd.RevisionUninitialized)
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	return fbo.setHeadSuccessorLocked(ctx, lState, irmd, rebased)
+}
+
 // CtxAllowNameKeyType is the type for a context allowable name override key.
 type CtxAllowNameKeyType int
 
@@ -2619,17 +3651,48 @@ func (fbo *folderBranchOps) signalWrite() {
 	// A local write always means any ongoing CR should be canceled,
 	// because the set of unmerged writes has changed.
 	fbo.cr.ForceCancel()
+	fbo.cr.noteLocalWrite()
 }
 
 func (fbo *folderBranchOps) syncDirUpdateOrSignal(
 	ctx context.Context, lState *lockState) error {
-	if fbo.config.BGFlushDirOpBatchSize() == 1 {
+	if fbo.dirOpBatchSize() == 1 {
 		return fbo.syncAllLocked(ctx, lState, NoExcl)
 	}
 	fbo.signalWrite()
 	return nil
 }
 
+// dirOpBatchSize returns how many directory ops can be buffered
+// before they must be synced.  A coalescing window for this TLF
+// overrides a configured batch size of 1, which would otherwise sync
+// each op right away; otherwise the TLF's tuning profile may set its
+// own batch size.
+func (fbo *folderBranchOps) dirOpBatchSize() int {
+	size := fbo.config.BGFlushDirOpBatchSize()
+	if size == 1 {
+		if fbo.config.DirOpCoalescingWindow(fbo.id()) > 0 {
+			return bgFlushDirOpBatchSizeDefault
+		}
+		return size
+	}
+	if profileSize := fbo.config.TuningProfile(
+		fbo.id()).DirOpBatchSize; profileSize > 0 {
+		return profileSize
+	}
+	return size
+}
+
+// bgFlushPeriod returns how long to wait for a batch of changes to
+// fill up before syncing them, as set by this TLF's tuning profile or
+// else the config.
+func (fbo *folderBranchOps) bgFlushPeriod() time.Duration {
+	if p := fbo.config.TuningProfile(fbo.id()).BGFlushPeriod; p > 0 {
+		return p
+	}
+	return fbo.config.BGFlushPeriod()
+}
+
 func (fbo *folderBranchOps) checkForUnlinkedDir(dir Node) error {
 	// Disallow directory operations within an unlinked directory.
 	// Shells don't seem to allow it, and it will just pollute the dir
@@ -2647,33 +3710,102 @@ func (fbo *folderBranchOps) createEntryLocked(
 	entryType EntryType, excl Excl) (childNode Node, de DirEntry, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	if err := checkDisallowedPrefixes(ctx, name); err != nil {
+	node, de, cleanupFn, err := fbo.cacheNewEntryLocked(
+		ctx, lState, dir, name, entryType)
+	if err != nil {
 		return nil, DirEntry{}, err
 	}
+	defer func() {
+		if err != nil && cleanupFn != nil {
+			cleanupFn()
+		}
+	}()
+
+	if excl == WithExcl {
+		// Sync this change to the server.
+		err := fbo.syncAllLocked(ctx, lState, WithExcl)
+		_, isNoUpdatesWhileDirty := errors.Cause(err).(NoUpdatesWhileDirtyError)
+		if isNoUpdatesWhileDirty {
+			// If an exclusive write hits a conflict, it will try to
+			// update, but won't be able to because of the dirty
+			// directory entries.  We need to clean up the dirty
+			// entries here first before trying to apply the updates
+			// again.  By returning `ExclOnUnmergedError` below, we
+			// force the caller to retry the whole operation again.
+			fbo.log.CDebugf(ctx, "Clearing dirty entry before applying new "+
+				"updates for exclusive write")
+			cleanupFn()
+			cleanupFn = nil
+
+			// Sync anything else that might be buffered (non-exclusively).
+			err = fbo.syncAllLocked(ctx, lState, NoExcl)
+			if err != nil {
+				return nil, DirEntry{}, err
+			}
+
+			// Now we should be in a clean state, so this should work.
+			err = fbo.getAndApplyMDUpdates(
+				ctx, lState, nil, fbo.applyMDUpdatesLocked)
+			if err != nil {
+				return nil, DirEntry{}, err
+			}
+			return nil, DirEntry{}, ExclOnUnmergedError{}
+		} else if err != nil {
+			return nil, DirEntry{}, err
+		}
+	} else {
+		err = fbo.syncDirUpdateOrSignal(ctx, lState)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
+	}
+
+	return node, de, nil
+}
+
+// cacheNewEntryLocked adds a new entry called `name` to `dir` in the
+// local cache, along with the createOp for it, without syncing
+// anything.  The returned function undoes all that, as long as no
+// other directory op was cached since.  entryType must not by Sym.
+func (fbo *folderBranchOps) cacheNewEntryLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType) (
+	childNode Node, de DirEntry, undoFn func(), err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(ctx, name); err != nil {
+		return nil, DirEntry{}, nil, err
+	}
 
 	if uint32(len(name)) > fbo.config.MaxNameBytes() {
-		return nil, DirEntry{},
+		return nil, DirEntry{}, nil,
 			NameTooLongError{name, fbo.config.MaxNameBytes()}
 	}
 
 	if err := fbo.checkForUnlinkedDir(dir); err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	filename, err := fbo.canonicalPath(ctx, dir, name)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	// Verify we have permission to write (but don't make a successor yet).
 	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, filename)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
+	}
+
+	if entryType != Dir {
+		if err := md.data.ContentPolicy.checkName(name); err != nil {
+			return nil, DirEntry{}, nil, err
+		}
 	}
 
 	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	// We're not going to modify this copy of the dirblock, so just
@@ -2681,23 +3813,23 @@ func (fbo *folderBranchOps) createEntryLocked(
 	dblock, err := fbo.blocks.GetDirtyDir(
 		ctx, lState, md.ReadOnly(), dirPath, blockRead)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	// does name already exist?
 	if _, ok := dblock.Children[name]; ok {
-		return nil, DirEntry{}, NameExistsError{name}
+		return nil, DirEntry{}, nil, NameExistsError{name}
 	}
 
 	if err := fbo.checkNewDirSize(
 		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	parentPtr := dirPath.tailPointer()
 	co, err := newCreateOp(name, parentPtr, entryType)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 	co.setFinalPath(dirPath)
 	// create new data block
@@ -2712,15 +3844,15 @@ func (fbo *folderBranchOps) createEntryLocked(
 
 	// Cache update and operations until batch happens.  Make a new
 	// temporary ID and directory entry.
-	newID, err := fbo.config.cryptoPure().MakeTemporaryBlockID()
+	newID, err := fbo.blocks.tempIDCrypto().MakeTemporaryBlockID()
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	chargedTo, err := chargedToForTLF(
 		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), md.GetTlfHandle())
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	newPtr := BlockPointer{
@@ -2736,13 +3868,13 @@ func (fbo *folderBranchOps) createEntryLocked(
 
 	node, err := fbo.nodeCache.GetOrCreate(newPtr, name, dir)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	err = fbo.config.DirtyBlockCache().Put(
 		fbo.id(), newPtr, fbo.branch(), newBlock)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return nil, DirEntry{}, nil, err
 	}
 
 	now := fbo.nowUnixNano()
@@ -2761,89 +3893,50 @@ func (fbo *folderBranchOps) createEntryLocked(
 
 	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(lState, dirPath, name, de)
 	fbo.dirOps = append(fbo.dirOps, cachedDirOp{co, []Node{dir, node}})
-	added := fbo.status.addDirtyNode(dir)
-
-	cleanupFn := func() {
-		if added {
-			fbo.status.rmDirtyNode(dir)
-		}
-		fbo.dirOps = fbo.dirOps[:len(fbo.dirOps)-1]
-		if dirCacheUndoFn != nil {
-			dirCacheUndoFn(lState)
-		}
-		// Delete should never fail.
-		_ = fbo.config.DirtyBlockCache().Delete(fbo.id(), newPtr, fbo.branch())
-	}
-	defer func() {
-		if err != nil && cleanupFn != nil {
-			cleanupFn()
-		}
-	}()
-
-	if entryType != Dir {
-		// Dirty the file with a zero-byte write, to ensure the new
-		// block is synced in SyncAll.  TODO: remove this if we ever
-		// embed 0-byte files in the directory entry itself.
-		err = fbo.blocks.Write(
-			ctx, lState, md.ReadOnly(), node, []byte{}, 0)
-		if err != nil {
-			return nil, DirEntry{}, err
-		}
-		oldCleanupFn := cleanupFn
-		cleanupFn = func() {
-			fbo.blocks.ClearCacheInfo(lState, fbo.nodeCache.PathFromNode(node))
-			oldCleanupFn()
-		}
-	}
-
-	// It's safe to notify before we've synced, since it is only
-	// sending invalidation notifications.  At worst the upper layer
-	// will just have to refresh its cache needlessly.
-	err = fbo.notifyOneOp(ctx, lState, co, md.ReadOnly(), false)
-	if err != nil {
-		return nil, DirEntry{}, err
-	}
-
-	if excl == WithExcl {
-		// Sync this change to the server.
-		err := fbo.syncAllLocked(ctx, lState, WithExcl)
-		_, isNoUpdatesWhileDirty := errors.Cause(err).(NoUpdatesWhileDirtyError)
-		if isNoUpdatesWhileDirty {
-			// If an exclusive write hits a conflict, it will try to
-			// update, but won't be able to because of the dirty
-			// directory entries.  We need to clean up the dirty
-			// entries here first before trying to apply the updates
-			// again.  By returning `ExclOnUnmergedError` below, we
-			// force the caller to retry the whole operation again.
-			fbo.log.CDebugf(ctx, "Clearing dirty entry before applying new "+
-				"updates for exclusive write")
-			cleanupFn()
-			cleanupFn = nil
-
-			// Sync anything else that might be buffered (non-exclusively).
-			err = fbo.syncAllLocked(ctx, lState, NoExcl)
-			if err != nil {
-				return nil, DirEntry{}, err
-			}
-
-			// Now we should be in a clean state, so this should work.
-			err = fbo.getAndApplyMDUpdates(
-				ctx, lState, nil, fbo.applyMDUpdatesLocked)
-			if err != nil {
-				return nil, DirEntry{}, err
-			}
-			return nil, DirEntry{}, ExclOnUnmergedError{}
-		} else if err != nil {
-			return nil, DirEntry{}, err
+	added := fbo.status.addDirtyNode(dir)
+
+	cleanupFn := func() {
+		if added {
+			fbo.status.rmDirtyNode(dir)
 		}
-	} else {
-		err = fbo.syncDirUpdateOrSignal(ctx, lState)
+		fbo.dirOps = fbo.dirOps[:len(fbo.dirOps)-1]
+		if dirCacheUndoFn != nil {
+			dirCacheUndoFn(lState)
+		}
+		// Delete should never fail.
+		_ = fbo.config.DirtyBlockCache().Delete(fbo.id(), newPtr, fbo.branch())
+	}
+	defer func() {
+		if err != nil && cleanupFn != nil {
+			cleanupFn()
+		}
+	}()
+
+	if entryType != Dir {
+		// Dirty the file with a zero-byte write, to ensure the new
+		// block is synced in SyncAll.  TODO: remove this if we ever
+		// embed 0-byte files in the directory entry itself.
+		err = fbo.blocks.Write(
+			ctx, lState, md.ReadOnly(), node, []byte{}, 0)
 		if err != nil {
-			return nil, DirEntry{}, err
+			return nil, DirEntry{}, nil, err
+		}
+		oldCleanupFn := cleanupFn
+		cleanupFn = func() {
+			fbo.blocks.ClearCacheInfo(lState, fbo.nodeCache.PathFromNode(node))
+			oldCleanupFn()
 		}
 	}
 
-	return node, de, nil
+	// It's safe to notify before we've synced, since it is only
+	// sending invalidation notifications.  At worst the upper layer
+	// will just have to refresh its cache needlessly.
+	err = fbo.notifyOneOp(ctx, lState, co, md.ReadOnly(), false)
+	if err != nil {
+		return nil, DirEntry{}, nil, err
+	}
+
+	return node, de, cleanupFn, nil
 }
 
 func (fbo *folderBranchOps) maybeWaitForSquash(
@@ -2875,8 +3968,9 @@ func (fbo *folderBranchOps) maybeWaitForSquash(
 }
 
 func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
-	lState *lockState, fn func(lState *lockState) error) error {
+	lState *lockState, fn func(lState *lockState) error) (err error) {
 	doUnlock := false
+	var pipelined *mdPipelinedPut
 	defer func() {
 		if doUnlock {
 			bid := fbo.bid
@@ -2884,6 +3978,11 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 			// Don't let a pending squash get too big.
 			fbo.maybeWaitForSquash(ctx, bid)
 		}
+		// Only wait for a pipelined put made by `fn` once the lock
+		// is released, so the next write can be prepared meanwhile.
+		if err == nil && pipelined != nil {
+			err = fbo.waitForMDPutSettled(ctx, pipelined)
+		}
 	}()
 
 	for i := 0; ; i++ {
@@ -2898,7 +3997,11 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 		default:
 		}
 
-		err := fn(lState)
+		inFlight := fbo.mdPutInFlight
+		err = fn(lState)
+		if p := fbo.mdPutInFlight; p != nil && p != inFlight {
+			pipelined = p
+		}
 		if isRetriableError(err, i) {
 			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
 			// Release the lock to give someone else a chance
@@ -2984,6 +4087,112 @@ func (fbo *folderBranchOps) CreateDir(
 	return retNode, retEntryInfo, nil
 }
 
+// createPathLocked walks down `names` from `dir`, caching a new
+// directory for each one that doesn't exist yet, and then syncs all
+// of them together so they land in a single revision.
+func (fbo *folderBranchOps) createPathLocked(
+	ctx context.Context, lState *lockState, dir Node, names []string) (
+	node Node, de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	var undoFns []func()
+	defer func() {
+		if err != nil {
+			// Each undo pops the latest cached dir op, so they must
+			// run in reverse order.
+			for i := len(undoFns) - 1; i >= 0; i-- {
+				undoFns[i]()
+			}
+		}
+	}()
+
+	node = dir
+	for _, name := range names {
+		child, childDe, err := fbo.blocks.Lookup(
+			ctx, lState, md.ReadOnly(), node, name)
+		switch errors.Cause(err).(type) {
+		case nil:
+			if childDe.Type != Dir {
+				return nil, DirEntry{}, NotDirError{
+					fbo.nodeCache.PathFromNode(node).ChildPathNoPtr(name)}
+			}
+		case NoSuchNameError:
+			var undoFn func()
+			child, childDe, undoFn, err = fbo.cacheNewEntryLocked(
+				ctx, lState, node, name, Dir)
+			if err != nil {
+				return nil, DirEntry{}, err
+			}
+			undoFns = append(undoFns, undoFn)
+		default:
+			return nil, DirEntry{}, err
+		}
+		node, de = child, childDe
+	}
+
+	if len(undoFns) == 0 {
+		return node, de, nil
+	}
+
+	fbo.log.CDebugf(ctx, "Syncing %d new directories", len(undoFns))
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return node, de, nil
+}
+
+func (fbo *folderBranchOps) CreatePath(
+	ctx context.Context, dir Node, path string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreatePath %s %s", getNodeIDStr(dir), path)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CreatePath %s %s done: %v %+v",
+			getNodeIDStr(dir), path, getNodeIDStr(n), err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		switch name {
+		case "":
+			continue
+		case ".", "..":
+			return nil, EntryInfo{}, errors.Errorf(
+				"Invalid component %q in path %s", name, path)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, EntryInfo{}, errors.Errorf("Empty path %q", path)
+	}
+
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			node, de, err := fbo.createPathLocked(ctx, lState, dir, names)
+			// Don't set node and ei directly, as that can cause a
+			// race when the CreatePath is canceled.
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return retNode, retEntryInfo, nil
+}
+
 func (fbo *folderBranchOps) CreateFile(
 	ctx context.Context, dir Node, path string, isExec bool, excl Excl) (
 	n Node, ei EntryInfo, err error) {
@@ -3133,64 +4342,256 @@ func (fbo *folderBranchOps) createLinkLocked(
 	if err != nil {
 		return DirEntry{}, err
 	}
-	co.setFinalPath(dirPath)
-	co.AddSelfUpdate(parentPtr)
+	co.setFinalPath(dirPath)
+	co.AddSelfUpdate(parentPtr)
+
+	// Nothing below here can fail, so no need to clean up the dir
+	// entry cache on a failure.  If this ever panics, we need to add
+	// cleanup code.
+
+	// Create a direntry for the link, and then sync
+	now := fbo.nowUnixNano()
+	de := DirEntry{
+		EntryInfo: EntryInfo{
+			Type:    Sym,
+			Size:    uint64(len(toPath)),
+			SymPath: toPath,
+			Mtime:   now,
+			Ctime:   now,
+		},
+	}
+
+	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(
+		lState, dirPath, fromName, de)
+
+	err = fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{dir}, co, md.ReadOnly())
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return de, nil
+}
+
+func (fbo *folderBranchOps) CreateLink(
+	ctx context.Context, dir Node, fromName string, toPath string) (
+	ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateLink %s %s -> %s",
+		getNodeIDStr(dir), fromName, toPath)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CreateLink %s %s -> %s done: %+v",
+			getNodeIDStr(dir), fromName, toPath, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, dir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set ei directly, as that can cause a race when
+			// the Create is canceled.
+			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return retEntryInfo, nil
+}
+
+// transferableEntry returns the entry for the file `name` in `dir`,
+// along with the infos for all of its blocks, after syncing any
+// outstanding writes so that all of those blocks are on the server.
+func (fbo *folderBranchOps) transferableEntry(
+	ctx context.Context, dir Node, name string) (
+	de DirEntry, infos []BlockInfo, err error) {
+	fbo.log.CDebugf(ctx, "transferableEntry %s %s", getNodeIDStr(dir), name)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "transferableEntry %s %s done: %+v",
+			getNodeIDStr(dir), name, err)
+	}()
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+
+	dblock, err := fbo.blocks.GetDirtyDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+
+	de, ok := dblock.Children[name]
+	if !ok {
+		return DirEntry{}, nil, NoSuchNameError{name}
+	}
+	childPath := dirPath.ChildPath(name, de.BlockPointer)
+	if de.Type != File && de.Type != Exec {
+		return DirEntry{}, nil, NotFileError{childPath}
+	}
+
+	infos, err = fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, md.ReadOnly(), childPath)
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+	return de, append([]BlockInfo{de.BlockInfo}, infos...), nil
+}
+
+// adoptEntryLocked links `de`, a file whose blocks (described by
+// `infos`) were just transferred to this TLF from another one, into
+// `dir` as `name`.  The blocks aren't new, so this can't be batched
+// like other directory ops; instead it syncs any that are buffered
+// and then writes its own MD revision.
+func (fbo *folderBranchOps) adoptEntryLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	de DirEntry, infos []BlockInfo) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(ctx, name); err != nil {
+		return err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return err
+	}
+
+	err := fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return err
+	}
+
+	filename, err := fbo.canonicalPath(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	md, err := fbo.getSuccessorMDForWriteLockedForFilename(
+		ctx, lState, filename)
+	if err != nil {
+		return err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+
+	// This is a copy of the block, so it's safe to modify.
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := dblock.Children[name]; ok {
+		return NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return err
+	}
+
+	co, err := newCreateOp(name, dirPath.tailPointer(), de.Type)
+	if err != nil {
+		return err
+	}
+	co.setFinalPath(dirPath)
+	md.AddOp(co)
+	for _, info := range infos {
+		md.AddRefBlock(info)
+	}
+
+	de.Ctime = fbo.nowUnixNano()
+	dblock.setChild(name, de)
+
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return err
+	}
+
+	_, _, bps, err := fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, false, zeroPtr,
+		make(localBcache), &sync.Mutex{})
+	if err != nil {
+		return err
+	}
 
-	// Nothing below here can fail, so no need to clean up the dir
-	// entry cache on a failure.  If this ever panics, we need to add
-	// cleanup code.
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
 
-	// Create a direntry for the link, and then sync
-	now := fbo.nowUnixNano()
-	de := DirEntry{
-		EntryInfo: EntryInfo{
-			Type:    Sym,
-			Size:    uint64(len(toPath)),
-			SymPath: toPath,
-			Mtime:   now,
-			Ctime:   now,
-		},
+	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+		fbo.deferLog, md.TlfID(), md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return err
+	}
+	if len(ptrsToDelete) > 0 {
+		return errors.Errorf("Unexpected pointers to delete after "+
+			"adopting %s: %v", name, ptrsToDelete)
 	}
 
-	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(
-		lState, dirPath, fromName, de)
-
-	err = fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{dir}, co, md.ReadOnly())
+	unembedBps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
 	if err != nil {
-		return DirEntry{}, err
+		return err
 	}
-	return de, nil
+	if unembedBps != nil {
+		bps.mergeOtherBps(unembedBps)
+	}
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
 }
 
-func (fbo *folderBranchOps) CreateLink(
-	ctx context.Context, dir Node, fromName string, toPath string) (
-	ei EntryInfo, err error) {
-	fbo.log.CDebugf(ctx, "CreateLink %s %s -> %s",
-		getNodeIDStr(dir), fromName, toPath)
+// adoptEntry is the unlocked version of adoptEntryLocked.
+func (fbo *folderBranchOps) adoptEntry(
+	ctx context.Context, dir Node, name string, de DirEntry,
+	infos []BlockInfo) (err error) {
+	fbo.log.CDebugf(ctx, "adoptEntry %s %s", getNodeIDStr(dir), name)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "CreateLink %s %s -> %s done: %+v",
-			getNodeIDStr(dir), fromName, toPath, err)
+		fbo.deferLog.CDebugf(ctx, "adoptEntry %s %s done: %+v",
+			getNodeIDStr(dir), name, err)
 	}()
 
 	err = fbo.checkNodeForWrite(ctx, dir)
 	if err != nil {
-		return EntryInfo{}, err
+		return err
 	}
 
-	var retEntryInfo EntryInfo
-	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			// Don't set ei directly, as that can cause a race when
-			// the Create is canceled.
-			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
-			retEntryInfo = de.EntryInfo
-			return err
-		})
-	if err != nil {
-		return EntryInfo{}, err
-	}
-	return retEntryInfo, nil
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.adoptEntryLocked(ctx, lState, dir, name, de, infos)
 }
 
 // unrefEntry modifies md to unreference all relevant blocks for the
@@ -3203,9 +4604,15 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 		return nil
 	}
 
-	unrefsToAdd := make(map[BlockPointer]bool)
-	fbo.prepper.cacheBlockInfos([]BlockInfo{de.BlockInfo})
-	unrefsToAdd[de.BlockPointer] = true
+	// Keyed by ref, so that refs of the same block made through
+	// slightly different pointers still match up below.
+	unrefsToAdd := make(map[BlockRef]BlockPointer)
+	// The entry of a dirty file has its encoded size cleared, so
+	// leave its size to be looked up rather than caching a zero.
+	if de.EncodedSize > 0 {
+		fbo.prepper.cacheBlockInfos([]BlockInfo{de.BlockInfo})
+	}
+	unrefsToAdd[de.Ref()] = de.BlockPointer
 	// construct a path for the child so we can unlink with it.
 	childPath := dir.ChildPath(name, de.BlockPointer)
 
@@ -3225,7 +4632,7 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 		}
 		fbo.prepper.cacheBlockInfos(blockInfos)
 		for _, blockInfo := range blockInfos {
-			unrefsToAdd[blockInfo.BlockPointer] = true
+			unrefsToAdd[blockInfo.Ref()] = blockInfo.BlockPointer
 		}
 	}
 
@@ -3235,13 +4642,13 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 	for _, dirOp := range fbo.dirOps {
 		for i := len(dirOp.dirOp.Refs()) - 1; i >= 0; i-- {
 			ref := dirOp.dirOp.Refs()[i]
-			if _, ok := unrefsToAdd[ref]; ok {
+			if _, ok := unrefsToAdd[ref.Ref()]; ok {
 				dirOp.dirOp.DelRefBlock(ref)
-				delete(unrefsToAdd, ref)
+				delete(unrefsToAdd, ref.Ref())
 			}
 		}
 	}
-	for unref := range unrefsToAdd {
+	for _, unref := range unrefsToAdd {
 		ro.AddUnrefBlock(unref)
 	}
 
@@ -3438,6 +4845,13 @@ func (fbo *folderBranchOps) renameLocked(
 		return err
 	}
 
+	// Files that already have a banned extension can keep it.
+	if newDe.Type != Dir && nameExtension(oldName) != nameExtension(newName) {
+		if err := md.data.ContentPolicy.checkName(newName); err != nil {
+			return err
+		}
+	}
+
 	// does name exist?
 	replacedDe, ok := newPBlock.Children[newName]
 	if ok {
@@ -3605,9 +5019,84 @@ func (fbo *folderBranchOps) Read(
 	if err != nil {
 		return 0, err
 	}
+	fbo.opStats.recordRead(fbo.statsPathForNode(file), bytesRead)
+	fbo.maybeUpdateAtime(ctx, file)
+	fbo.maybeReadAhead(file, off, bytesRead)
 	return bytesRead, nil
 }
 
+// maybeReadAhead fetches, in the background, the blocks of `file`
+// that follow a sequential read of `n` bytes at `off`: one that
+// starts where the previous read of the file ended.  The tuning
+// profile's ReadAheadBlocks sets how many blocks are fetched.  When
+// it's zero, all the blocks of a file are already prefetched as soon
+// as its top block is read, so nothing more is done here.
+func (fbo *folderBranchOps) maybeReadAhead(file Node, off, n int64) {
+	end := off + n
+	prevEnd, ok := fbo.readPositions.Get(file.GetID())
+	fbo.readPositions.Add(file.GetID(), end)
+	depth := fbo.config.TuningProfile(fbo.id()).ReadAheadBlocks
+	if depth <= 0 || n == 0 || !ok || prevEnd.(int64) != off {
+		return
+	}
+
+	go func() {
+		_ = fbo.runUnlessShutdown(func(ctx context.Context) error {
+			return fbo.doReadAhead(ctx, file, end, depth)
+		})
+	}()
+}
+
+func (fbo *folderBranchOps) doReadAhead(
+	ctx context.Context, file Node, off int64, depth int) (err error) {
+	defer func() {
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Read-ahead of %s at %d failed: %+v",
+				getNodeIDStr(file), off, err)
+		}
+	}()
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadHelper(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		return err
+	}
+	ptrs, err := fbo.blocks.GetReadAheadPointers(
+		ctx, lState, md.ReadOnly(), file, off, depth)
+	if err != nil {
+		return err
+	}
+
+	// Fetch the blocks all at once, and wait for them so they aren't
+	// canceled along with `ctx`.
+	retriever := fbo.config.BlockOps().BlockRetriever()
+	priority := BlockFetchBackground.requestPriority()
+	errChs := make([]<-chan error, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		errChs = append(errChs, retriever.RequestNoPrefetch(
+			ctx, priority, md, ptr, NewFileBlock(), TransientEntry))
+	}
+	for _, errCh := range errChs {
+		select {
+		case childErr := <-errCh:
+			if childErr != nil && err == nil {
+				err = childErr
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// statsPathForNode returns the path of `file` for counting distinct
+// files in the TLF op stats.
+func (fbo *folderBranchOps) statsPathForNode(file Node) string {
+	if fbo.nodeCache == nil {
+		return file.GetBasename()
+	}
+	return fbo.nodeCache.PathFromNode(file).String()
+}
+
 func (fbo *folderBranchOps) Write(
 	ctx context.Context, file Node, data []byte, off int64) (err error) {
 	fbo.log.CDebugf(ctx, "Write %s %d %d", getNodeIDStr(file),
@@ -3622,7 +5111,17 @@ func (fbo *folderBranchOps) Write(
 		return err
 	}
 
+	// Wait for our turn before anything else, so the order of
+	// operations on this file is the order they were called in.
+	// Hold the turn until the operation is really done, even if
+	// this call is canceled first.
+	doneWithFile, err := fbo.fileOps.wait(ctx, file.GetID())
+	if err != nil {
+		return err
+	}
+
 	return runUnlessCanceled(ctx, func() error {
+		defer doneWithFile()
 		lState := makeFBOLockState()
 
 		// Get the MD for reading.  We won't modify it; we'll track the
@@ -3633,52 +5132,319 @@ func (fbo *folderBranchOps) Write(
 			return err
 		}
 
+		err = md.data.ContentPolicy.checkSize(
+			file.GetBasename(), uint64(off)+uint64(len(data)))
+		if err != nil {
+			return err
+		}
+
 		err = fbo.blocks.Write(
 			ctx, lState, md.ReadOnly(), file, data, off)
 		if err != nil {
 			return err
 		}
 
-		fbo.status.addDirtyNode(file)
-		fbo.signalWrite()
-		return nil
-	})
+		fbo.opStats.recordWrite(
+			fbo.statsPathForNode(file), int64(len(data)))
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) Truncate(
+	ctx context.Context, file Node, size uint64) (err error) {
+	fbo.log.CDebugf(ctx, "Truncate %s %d", getNodeIDStr(file), size)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Truncate %s %d done: %+v",
+			getNodeIDStr(file), size, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	// Take our turn on this file, as in Write.
+	doneWithFile, err := fbo.fileOps.wait(ctx, file.GetID())
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		defer doneWithFile()
+		lState := makeFBOLockState()
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = md.data.ContentPolicy.checkSize(file.GetBasename(), size)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.Truncate(
+			ctx, lState, md.ReadOnly(), file, size)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return nil
+	})
+}
+
+// getQuotaUsage returns the quota usage tracker for whoever this TLF
+// is charged to.
+func (fbo *folderBranchOps) getQuotaUsage(
+	ctx context.Context, kmd KeyMetadata) (
+	*EventuallyConsistentQuotaUsage, error) {
+	fbo.quotaUsageLock.Lock()
+	defer fbo.quotaUsageLock.Unlock()
+	if fbo.quotaUsage != nil {
+		return fbo.quotaUsage, nil
+	}
+
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+	if err != nil {
+		return nil, err
+	}
+	loggerSuffix := fmt.Sprintf("prealloc-%s", fbo.id())
+	if chargedTo.IsTeam() {
+		fbo.quotaUsage = NewEventuallyConsistentTeamQuotaUsage(
+			fbo.config, chargedTo.AsTeamOrBust(), loggerSuffix)
+	} else {
+		fbo.quotaUsage = NewEventuallyConsistentQuotaUsage(
+			fbo.config, loggerSuffix)
+	}
+	return fbo.quotaUsage, nil
+}
+
+// checkQuotaForPreallocate returns an error if growing `file` to
+// `size` bytes would put this TLF's owner over quota.  The usage may
+// be up to a minute stale; if it isn't known at all, the
+// preallocation is allowed.
+func (fbo *folderBranchOps) checkQuotaForPreallocate(
+	ctx context.Context, kmd KeyMetadata, file Node, size uint64) error {
+	ei, err := fbo.Stat(ctx, file)
+	if err != nil {
+		return err
+	}
+	if ei.Size >= size {
+		return nil
+	}
+
+	quotaUsage, err := fbo.getQuotaUsage(ctx, kmd)
+	if err != nil {
+		return err
+	}
+	timestamp, usageBytes, limitBytes, err :=
+		quotaUsage.Get(ctx, 1*time.Minute, math.MaxInt64)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get quota usage: %+v", err)
+		return nil
+	}
+	if timestamp.IsZero() {
+		return nil
+	}
+
+	newUsage := usageBytes + int64(size-ei.Size)
+	if newUsage > limitBytes {
+		return kbfsblock.ServerErrorOverQuota{
+			Usage:     newUsage,
+			Limit:     limitBytes,
+			Throttled: false,
+		}
+	}
+	return nil
+}
+
+// GetTlfOpStats implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetTlfOpStats(
+	ctx context.Context, folderBranch FolderBranch) (TlfOpStats, error) {
+	if folderBranch != fbo.folderBranch {
+		return TlfOpStats{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	return fbo.opStats.get(), nil
+}
+
+// Preallocate implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) Preallocate(
+	ctx context.Context, file Node, size uint64) (err error) {
+	fbo.log.CDebugf(ctx, "Preallocate %s %d", getNodeIDStr(file), size)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Preallocate %s %d done: %+v",
+			getNodeIDStr(file), size, err)
+	}()
+
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	// Take our turn on this file, as in Write.
+	doneWithFile, err := fbo.fileOps.wait(ctx, file.GetID())
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		defer doneWithFile()
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = md.data.ContentPolicy.checkSize(file.GetBasename(), size)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.checkQuotaForPreallocate(ctx, md, file, size)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.Preallocate(
+			ctx, lState, md.ReadOnly(), file, size)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return nil
+	})
+}
+
+// writeWholeFile replaces the contents of `name` in `dir` and syncs
+// the change, without checking for conflicts.
+func (fbo *folderBranchOps) writeWholeFile(
+	ctx context.Context, dir Node, name string, contents []byte) (
+	Node, EntryInfo, error) {
+	node, ei, err := fbo.Lookup(ctx, dir, name)
+	switch errors.Cause(err).(type) {
+	case nil:
+		if !ei.Type.IsFile() {
+			return nil, EntryInfo{}, NotFileError{
+				fbo.nodeCache.PathFromNode(dir).ChildPathNoPtr(name)}
+		}
+		err = fbo.Truncate(ctx, node, 0)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	case NoSuchNameError:
+		node, ei, err = fbo.CreateFile(ctx, dir, name, false, NoExcl)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	default:
+		return nil, EntryInfo{}, err
+	}
+
+	if len(contents) > 0 {
+		err = fbo.Write(ctx, node, contents, 0)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+	err = fbo.SyncAll(ctx, fbo.folderBranch)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	ei.Size = uint64(len(contents))
+	return node, ei, nil
+}
+
+// fileHasContents returns whether `name` in `dir` is a file holding
+// exactly `contents`, along with its node and entry info if so.
+func (fbo *folderBranchOps) fileHasContents(
+	ctx context.Context, dir Node, name string, contents []byte) (
+	Node, EntryInfo, bool, error) {
+	node, ei, err := fbo.Lookup(ctx, dir, name)
+	if _, isMiss := errors.Cause(err).(NoSuchNameError); isMiss {
+		return nil, EntryInfo{}, false, nil
+	} else if err != nil {
+		return nil, EntryInfo{}, false, err
+	}
+	if !ei.Type.IsFile() || ei.Size != uint64(len(contents)) {
+		return nil, EntryInfo{}, false, nil
+	}
+	buf := make([]byte, len(contents))
+	n, err := fbo.Read(ctx, node, buf, 0)
+	if err != nil {
+		return nil, EntryInfo{}, false, err
+	}
+	return node, ei, bytes.Equal(buf[:n], contents), nil
 }
 
-func (fbo *folderBranchOps) Truncate(
-	ctx context.Context, file Node, size uint64) (err error) {
-	fbo.log.CDebugf(ctx, "Truncate %s %d", getNodeIDStr(file), size)
+func (fbo *folderBranchOps) WriteFileAtomic(
+	ctx context.Context, dir Node, name string, contents []byte) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "WriteFileAtomic %s %s %d",
+		getNodeIDStr(dir), name, len(contents))
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Truncate %s %d done: %+v",
-			getNodeIDStr(file), size, err)
+		fbo.deferLog.CDebugf(ctx, "WriteFileAtomic %s %s %d done: %v %+v",
+			getNodeIDStr(dir), name, len(contents), getNodeIDStr(n), err)
 	}()
 
-	err = fbo.checkNodeForWrite(ctx, file)
+	err = fbo.checkNodeForWrite(ctx, dir)
 	if err != nil {
-		return err
+		return nil, EntryInfo{}, err
 	}
 
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
-
-		// Get the MD for reading.  We won't modify it; we'll track the
-		// unref changes on the side, and put them into the MD during the
-		// sync.
-		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
+	lState := makeFBOLockState()
+	for i := 0; ; i++ {
+		n, ei, err = fbo.writeWholeFile(ctx, dir, name, contents)
 		if err != nil {
-			return err
+			return nil, EntryInfo{}, err
 		}
 
-		err = fbo.blocks.Truncate(
-			ctx, lState, md.ReadOnly(), file, size)
+		// A conflict may only show up once the journal flushes.
+		err = WaitForTLFJournal(ctx, fbo.config, fbo.id(), fbo.log)
 		if err != nil {
-			return err
+			return nil, EntryInfo{}, err
+		}
+		err = fbo.branchChanges.Wait(ctx)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		if fbo.isMasterBranch(lState) {
+			return n, ei, nil
 		}
 
-		fbo.status.addDirtyNode(file)
-		fbo.signalWrite()
-		return nil
-	})
+		fbo.log.CDebugf(ctx, "Write of %s conflicted; waiting for "+
+			"conflict resolution", name)
+		err = fbo.cr.Wait(ctx)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		if fbo.isMasterBranch(lState) {
+			node, nodeInfo, same, err := fbo.fileHasContents(
+				ctx, dir, name, contents)
+			if err != nil {
+				return nil, EntryInfo{}, err
+			}
+			if same {
+				return node, nodeInfo, nil
+			}
+		}
+		if i >= maxRetriesOnRecoverableErrors {
+			return nil, EntryInfo{}, errors.Errorf(
+				"Couldn't write %s without a conflict after %d tries",
+				name, i+1)
+		}
+		fbo.log.CDebugf(ctx, "Rewriting %s after conflict resolution", name)
+	}
 }
 
 func (fbo *folderBranchOps) setExLocked(
@@ -3767,9 +5533,12 @@ func (fbo *folderBranchOps) SetEx(
 		})
 }
 
-func (fbo *folderBranchOps) setMtimeLocked(
+// setTimesLocked sets the given times on `file`.  Unless
+// `times.Ctime` overrides it, the ctime is set to now if `bumpCtime`
+// is true, and left alone otherwise.
+func (fbo *folderBranchOps) setTimesLocked(
 	ctx context.Context, lState *lockState, file Node,
-	mtime *time.Time) error {
+	times EntryTimes, bumpCtime bool) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
@@ -3788,9 +5557,22 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	if err != nil {
 		return err
 	}
-	de.Mtime = mtime.UnixNano()
-	// setting the mtime counts as changing the file MD, so must set ctime too
-	de.Ctime = fbo.nowUnixNano()
+	if times.Mtime != nil {
+		de.Mtime = times.Mtime.UnixNano()
+	}
+	if times.Atime != nil {
+		de.Atime = times.Atime.UnixNano()
+	}
+	if times.Btime != nil {
+		de.Btime = times.Btime.UnixNano()
+	}
+	if times.Ctime != nil {
+		de.Ctime = times.Ctime.UnixNano()
+	} else if bumpCtime {
+		// setting the times counts as changing the file MD, so must
+		// set ctime too
+		de.Ctime = fbo.nowUnixNano()
+	}
 
 	parentPtr := filePath.parentPath().tailPointer()
 	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
@@ -3803,7 +5585,7 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	// If the node has been unlinked, we can safely ignore this
 	// setmtime.
 	if fbo.nodeCache.IsUnlinked(file) {
-		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+		fbo.log.CDebugf(ctx, "Skipping settimes for a removed file %v",
 			filePath.tailPointer())
 		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
 			ctx, lState, sao, de)
@@ -3838,8 +5620,91 @@ func (fbo *folderBranchOps) SetMtime(
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.setMtimeLocked(ctx, lState, file, mtime)
+			return fbo.setTimesLocked(
+				ctx, lState, file, EntryTimes{Mtime: mtime}, true)
+		})
+}
+
+func (fbo *folderBranchOps) SetTimes(
+	ctx context.Context, file Node, times EntryTimes) (err error) {
+	fbo.log.CDebugf(ctx, "SetTimes %s %+v", getNodeIDStr(file), times)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetTimes %s done: %+v",
+			getNodeIDStr(file), err)
+	}()
+
+	if times.isEmpty() {
+		return nil
+	}
+
+	err = fbo.checkNodeForWrite(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setTimesLocked(ctx, lState, file, times, true)
+		})
+}
+
+// maybeUpdateAtime records, in the background, that `file` was just
+// read, if the atime policy calls for it.
+func (fbo *folderBranchOps) maybeUpdateAtime(ctx context.Context, file Node) {
+	policy := fbo.config.AtimePolicy()
+	if policy == AtimeNoatime || fbo.checkNodeForWrite(ctx, file) != nil {
+		return
+	}
+	ei, err := fbo.Stat(ctx, file)
+	if err != nil {
+		return
+	}
+	now := fbo.config.Clock().Now()
+	if !policy.shouldUpdateAtime(ei, now) {
+		return
+	}
+
+	fbo.atimeLock.Lock()
+	defer fbo.atimeLock.Unlock()
+	if fbo.atimeUpdates[file.GetID()] {
+		return
+	}
+	fbo.atimeUpdates[file.GetID()] = true
+	go func() {
+		defer func() {
+			fbo.atimeLock.Lock()
+			defer fbo.atimeLock.Unlock()
+			delete(fbo.atimeUpdates, file.GetID())
+		}()
+		_ = fbo.runUnlessShutdown(func(ctx context.Context) error {
+			lState := makeFBOLockState()
+			md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+			if err != nil {
+				return err
+			}
+			session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+			if err != nil {
+				return err
+			}
+			// Readers can't record anything.
+			isWriter, err := md.IsWriter(
+				ctx, fbo.config.KBPKI(), session.UID, session.VerifyingKey)
+			if err != nil || !isWriter {
+				return err
+			}
+			// An access doesn't change the file's metadata, so it
+			// doesn't change its ctime.
+			err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+				func(lState *lockState) error {
+					return fbo.setTimesLocked(ctx, lState, file,
+						EntryTimes{Atime: &now}, false)
+				})
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Couldn't update atime: %+v", err)
+			}
+			return err
 		})
+	}()
 }
 
 type cleanupFn func(context.Context, *lockState, []BlockPointer, error)
@@ -3958,9 +5823,11 @@ func (fbo *folderBranchOps) syncAllLocked(
 		return err
 	}
 
-	bps := newBlockPutState(0)
-	resolvedPaths := make(map[BlockPointer]path)
-	lbc := make(localBcache)
+	// Every dirty file and directory needs at least one block put.
+	bps := newBlockPutState(len(dirtyFiles) + len(dirtyDirs))
+	resolvedPaths := make(
+		map[BlockPointer]path, len(dirtyFiles)+len(dirtyDirs))
+	lbc := make(localBcache, len(dirtyDirs))
 
 	var cleanups []func(context.Context, *lockState, error)
 	defer func() {
@@ -4123,7 +5990,7 @@ func (fbo *folderBranchOps) syncAllLocked(
 	fbo.log.LazyTrace(ctx, "Syncing %d file(s)", len(dirtyFiles))
 
 	fbo.log.CDebugf(ctx, "Syncing %d file(s)", len(dirtyFiles))
-	fileSyncBlocks := newBlockPutState(1)
+	fileSyncBlocks := newBlockPutState(len(dirtyFiles))
 	for _, ref := range dirtyFiles {
 		node := fbo.nodeCache.Get(ref)
 		if node == nil {
@@ -4190,8 +6057,8 @@ func (fbo *folderBranchOps) syncAllLocked(
 		// dirty entry.
 		parentPtr := file.parentPath().tailPointer()
 		if _, ok := lbc[parentPtr]; ok {
-			lbc[parentPtr].Children[file.tailName()] =
-				newLbc[parentPtr].Children[file.tailName()]
+			lbc[parentPtr].setChild(file.tailName(),
+				newLbc[parentPtr].Children[file.tailName()])
 		} else {
 			lbc[parentPtr] = newLbc[parentPtr]
 		}
@@ -4255,13 +6122,21 @@ func (fbo *folderBranchOps) syncAllLocked(
 		}
 	}()
 
-	// Put all the blocks.
-	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+	// Put all the blocks.  This is the only part of the sync that
+	// CancelSync can interrupt; once the blocks are all put, the MD
+	// write goes ahead regardless.
+	putCtx, finishPuts := fbo.startCancelableBlockPuts(ctx)
+	blocksToRemove, err = doBlockPuts(putCtx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
 		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if canceled := finishPuts(); canceled && err != nil {
+		fbo.log.CDebugf(ctx, "Sync canceled while putting blocks: %+v", err)
+		err = SyncCanceledError{}
+	}
 	if err != nil {
 		return err
 	}
+	fbo.blocks.tempIDs.remap(bps)
 
 	// Call this under the same blockLock as when the pointers are
 	// updated, so there's never any point in time where a read or
@@ -4283,7 +6158,7 @@ func (fbo *folderBranchOps) syncAllLocked(
 		return nil
 	}
 
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, excl,
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, excl,
 		func(md ImmutableRootMetadata) error {
 			// Just update the pointers using the resolutionOp, all
 			// the ops have already been notified.
@@ -4292,10 +6167,18 @@ func (fbo *folderBranchOps) syncAllLocked(
 			if err != nil {
 				return err
 			}
+			for _, op := range md.data.Changes.Ops {
+				fbo.activity.add(md.ReadOnly(), op)
+			}
 
 			fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
 			return nil
 		})
+	if err != nil {
+		return err
+	}
+	fbo.blocks.tempIDs.commit(fbo.blocks.GetState(lState) == cleanState)
+	return nil
 }
 
 func (fbo *folderBranchOps) syncAllUnlocked(
@@ -4327,10 +6210,54 @@ func (fbo *folderBranchOps) SyncAll(
 		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+	start := time.Now()
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
 			return fbo.syncAllLocked(ctx, lState, NoExcl)
 		})
+	if r := fbo.config.MetricsRegistry(); r != nil && err == nil {
+		metrics.GetOrRegisterTimer(syncTimerName, r).UpdateSince(start)
+	}
+	return err
+}
+
+// startCancelableBlockPuts returns a context for the block puts of
+// a SyncAll that CancelSync can cancel, along with a function that
+// must be called once the puts are done.  That function returns
+// whether the puts were canceled by CancelSync.
+func (fbo *folderBranchOps) startCancelableBlockPuts(
+	ctx context.Context) (context.Context, func() bool) {
+	putCtx, cancel := context.WithCancel(ctx)
+	fbo.syncCancelLock.Lock()
+	defer fbo.syncCancelLock.Unlock()
+	fbo.syncCancel = cancel
+	fbo.syncCanceled = false
+	return putCtx, func() bool {
+		fbo.syncCancelLock.Lock()
+		defer fbo.syncCancelLock.Unlock()
+		fbo.syncCancel = nil
+		cancel()
+		return fbo.syncCanceled
+	}
+}
+
+// CancelSync implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CancelSync(
+	ctx context.Context, folderBranch FolderBranch) error {
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbo.syncCancelLock.Lock()
+	defer fbo.syncCancelLock.Unlock()
+	if fbo.syncCancel == nil {
+		fbo.log.CDebugf(ctx, "No sync to cancel")
+		return nil
+	}
+	fbo.log.CDebugf(ctx, "Canceling the current sync")
+	fbo.syncCanceled = true
+	fbo.syncCancel()
+	return nil
 }
 
 func (fbo *folderBranchOps) FolderStatus(
@@ -4344,7 +6271,21 @@ func (fbo *folderBranchOps) FolderStatus(
 			WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	return fbo.status.getStatus(ctx, &fbo.blocks)
+	fbs, updateChan, err = fbo.status.getStatus(ctx, &fbo.blocks)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+	if rekeyStatus := fbo.rekeyProgress.getStatus(); !rekeyStatus.StartTime.IsZero() ||
+		rekeyStatus.LastErr != "" {
+		fbs.Rekey = &rekeyStatus
+	}
+	return fbs, updateChan, nil
+}
+
+// RekeyStatus returns the status of this device's current or most
+// recent rekey of the TLF.
+func (fbo *folderBranchOps) RekeyStatus() RekeyStatus {
+	return fbo.rekeyProgress.getStatus()
 }
 
 func (fbo *folderBranchOps) Status(
@@ -4379,6 +6320,7 @@ func (fbo *folderBranchOps) notifyBatchLocked(
 		if err != nil {
 			return err
 		}
+		fbo.activity.add(md.ReadOnly(), op)
 	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
 	return nil
@@ -4778,6 +6720,12 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 	lState *lockState, rmds []ImmutableRootMetadata) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// Our own pipelined put has to settle before we know whether
+	// these updates apply on top of it.
+	if _, err := fbo.settleMDPutLocked(ctx, lState); err != nil {
+		return err
+	}
+
 	// If there's anything in the journal, don't apply these MDs.
 	// Wait for CR to happen.
 	if fbo.isMasterBranchLocked(lState) {
@@ -4839,8 +6787,13 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 	// Don't allow updates while we're in the dirty state; the next
 	// sync will put us into an unmerged state anyway and we'll
 	// require conflict resolution.
-	if fbo.blocks.GetState(lState) != cleanState {
-		return errors.WithStack(NoUpdatesWhileDirtyError{})
+	res := fbo.tryTransitionLocked(
+		ctx, lState, folderBranchState{cleanState, false}, fbtApplyUpdates)
+	if !res.ok() {
+		if res.from.block != cleanState {
+			return errors.WithStack(NoUpdatesWhileDirtyError{})
+		}
+		return errors.WithStack(UnmergedError{})
 	}
 
 	appliedRevs := make([]ImmutableRootMetadata, 0, len(rmds))
@@ -4867,6 +6820,7 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 			if err != nil {
 				return err
 			}
+			fbo.activity.add(rmd.ReadOnly(), op)
 		}
 		if rmd.IsRekeySet() {
 			// One might have concern that a MD update written by the device
@@ -4898,7 +6852,10 @@ func (fbo *folderBranchOps) undoMDUpdatesLocked(ctx context.Context,
 	// Don't allow updates while we're in the dirty state; the next
 	// sync will put us into an unmerged state anyway and we'll
 	// require conflict resolution.
-	if fbo.blocks.GetState(lState) != cleanState {
+	expected := folderBranchState{
+		cleanState, !fbo.isMasterBranchLocked(lState)}
+	if res := fbo.tryTransitionLocked(
+		ctx, lState, expected, fbtUndoUpdates); !res.ok() {
 		return NotPermittedWhileDirtyError{}
 	}
 
@@ -4985,12 +6942,19 @@ func (fbo *folderBranchOps) setLatestMergedRevisionLocked(ctx context.Context, l
 func (fbo *folderBranchOps) getAndApplyMDUpdates(ctx context.Context,
 	lState *lockState, lockBeforeGet *keybase1.LockID,
 	applyFunc applyMDUpdatesFunc) error {
+	// Updates to a quarantined TLF aren't applied, since the server
+	// may be quarantining it because of their contents.
+	if fbo.isQuarantined() {
+		fbo.log.CDebugf(ctx, "Not applying updates to a quarantined TLF")
+		return nil
+	}
+
 	// first look up all MD revisions newer than my current head
 	start := fbo.getLatestMergedRevision(lState) + 1
 	rmds, err := getMergedMDUpdates(ctx,
 		fbo.config, fbo.id(), start, lockBeforeGet)
 	if err != nil {
-		return err
+		return fbo.noteQuarantine(ctx, err)
 	}
 
 	err = applyFunc(ctx, lState, rmds)
@@ -5069,19 +7033,20 @@ func (fbo *folderBranchOps) getUnmergedMDUpdatesLocked(
 }
 
 // Returns a list of block pointers that were created during the
-// staged era.
+// staged era, along with the undone MDs.
 func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
-	ctx context.Context, lState *lockState) ([]BlockPointer, error) {
+	ctx context.Context, lState *lockState) (
+	[]BlockPointer, []ImmutableRootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	currHead, unmergedRmds, err := fbo.getUnmergedMDUpdatesLocked(ctx, lState)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	err = fbo.undoMDUpdatesLocked(ctx, lState, unmergedRmds)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// We have arrived at the branch point.  The new root is
@@ -5090,12 +7055,13 @@ func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
 	// being currHead-1, so that future calls to
 	// applyMDUpdates will fetch this along with the rest of
 	// the updates.
+	fbo.assertTransitionLocked(ctx, lState, fbtUnstage)
 	fbo.setBranchIDLocked(lState, kbfsmd.NullBranchID)
 
 	rmd, err := getSingleMD(ctx, fbo.config, fbo.id(), kbfsmd.NullBranchID,
 		currHead, kbfsmd.Merged, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = func() error {
 		fbo.headLock.Lock(lState)
@@ -5108,7 +7074,7 @@ func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
 		return nil
 	}()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Return all new refs
@@ -5128,7 +7094,7 @@ func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
 		}
 	}
 
-	return unmergedPtrs, nil
+	return unmergedPtrs, unmergedRmds, nil
 }
 
 func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
@@ -5137,7 +7103,8 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 
 	// fetch all of my unstaged updates, and undo them one at a time
 	bid, wasMasterBranch := fbo.bid, fbo.isMasterBranchLocked(lState)
-	unmergedPtrs, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
+	unmergedPtrs, unmergedRmds, err :=
+		fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
@@ -5161,6 +7128,8 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	// `md` unreferences the branch's blocks.
+	fbo.retainUnmergedBranch(ctx, unmergedRmds, false, md.Revision()-1)
 
 	// Finally, create a resolutionOp with the newly-unref'd pointers.
 	resOp := newResolutionOp()
@@ -5180,6 +7149,87 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 		})
 }
 
+// ForceResolveNow implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) ForceResolveNow(
+	ctx context.Context, folderBranch FolderBranch) error {
+	fbo.log.CDebugf(ctx, "ForceResolveNow")
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	if fbo.bType == archive || fbo.isMasterBranch(lState) {
+		// Nothing to resolve.
+		return nil
+	}
+	fbo.cr.ForceResolveNow(ctx, fbo.getCurrMDRevision(lState))
+	return nil
+}
+
+// retainUnmergedBranch keeps `mds`, the MDs of an unmerged branch
+// that was just pruned, in memory for recovery, if that's enabled.
+// The blocks that only the branch referenced are unreferenced in the
+// revision after `lastMergedRev`, so that revision is leased to keep
+// quota reclamation from deleting them while the branch is retained.
+func (fbo *folderBranchOps) retainUnmergedBranch(ctx context.Context,
+	mds []ImmutableRootMetadata, resolved bool,
+	lastMergedRev kbfsmd.Revision) {
+	retention := fbo.config.UnmergedBranchRetention()
+	if fbo.retained == nil || retention <= 0 || len(mds) == 0 {
+		return
+	}
+
+	now := fbo.config.Clock().Now()
+	release := fbo.fbm.leaseRevision(lastMergedRev, retention)
+	fbo.retained.add(fbo.id(), mds, resolved, now, now.Add(retention),
+		release)
+	fbo.log.CDebugf(ctx, "Retaining pruned branch %s (revisions %d-%d) "+
+		"for %s", mds[0].BID(), mds[0].Revision(),
+		mds[len(mds)-1].Revision(), retention)
+}
+
+// setRetainedHeadLocked sets the head of this archived folder-branch
+// to the last MD of the retained branch it's named after.
+func (fbo *folderBranchOps) setRetainedHeadLocked(
+	ctx context.Context, lState *lockState) (ImmutableRootMetadata, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	var md ImmutableRootMetadata
+	ok := false
+	if fbo.retained != nil {
+		md, ok = fbo.retained.getHead(
+			fbo.id(), fbo.branch(), fbo.config.Clock().Now())
+	}
+	if !ok {
+		return ImmutableRootMetadata{},
+			errors.WithStack(RetainedBranchNotFoundError{fbo.folderBranch})
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	err := fbo.setHeadLocked(ctx, lState, md, headTrusted)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	return md, nil
+}
+
+// GetRetainedBranches implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetRetainedBranches(
+	ctx context.Context, folderBranch FolderBranch) (
+	[]RetainedBranchInfo, error) {
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if fbo.retained == nil {
+		return nil, nil
+	}
+	return fbo.retained.list(fbo.id(), fbo.config.Clock().Now()), nil
+}
+
 // TODO: remove once we have automatic conflict resolution
 func (fbo *folderBranchOps) UnstageForTesting(
 	ctx context.Context, folderBranch FolderBranch) (err error) {
@@ -5266,6 +7316,9 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 		return RekeyResult{}, err
 	}
 
+	ctx = fbo.rekeyProgress.attach(ctx, md.GetTlfHandle())
+	defer func() { fbo.rekeyProgress.finish(ctx, err) }()
+
 	currKeyGen := md.LatestKeyGeneration()
 	rekeyDone, tlfCryptKey, err := fbo.config.KeyManager().
 		Rekey(ctx, md, promptPaper)
@@ -5350,8 +7403,11 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 		// This device hasn't been keyed yet, fall through to set the rekey bit
 	}
 
-	// add an empty operation to satisfy assumptions elsewhere
-	md.AddOp(newRekeyOp())
+	// add a rekey operation to satisfy assumptions elsewhere, and to
+	// record any key purging that happened for revoked devices
+	ro := newRekeyOp()
+	ro.PurgedKeys = fbo.rekeyProgress.takePurged()
+	md.AddOp(ro)
 
 	// we still let readers push a new md block that we validate against reader
 	// permissions
@@ -5417,6 +7473,10 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(ctx context.Context,
 		return err
 	}
 
+	if err := fbo.pipelinedPuts.Wait(ctx); err != nil {
+		return err
+	}
+
 	// A journal flush before CR, if needed.
 	if err := WaitForTLFJournal(ctx, fbo.config, fbo.id(),
 		fbo.log); err != nil {
@@ -5599,8 +7659,13 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
-	// Don't update while the in-memory state is dirty.
-	if fbo.blocks.GetState(lState) != cleanState {
+	if _, err := fbo.settleMDPutLocked(ctx, lState); err != nil {
+		return false, err
+	}
+	// Don't update while the in-memory state is dirty, or if we've
+	// become staged since checking above.
+	if res := fbo.tryTransitionLocked(ctx, lState,
+		folderBranchState{cleanState, false}, fbtApplyUpdates); !res.ok() {
 		return false, nil
 	}
 
@@ -5615,11 +7680,6 @@ func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
 		return false, nil
 	}
 
-	if !fbo.isMasterBranchLocked(lState) {
-		// Don't update if we're staged.
-		return false, nil
-	}
-
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 
@@ -5708,6 +7768,99 @@ func (fbo *folderBranchOps) locallyFinalizeTLF(ctx context.Context) {
 	}
 }
 
+// checkAccessRevoked checks whether the current user is still a
+// reader of the TLF as of `md`, and if not, purges the TLF's cached
+// data and marks it inaccessible.  It returns true if access was
+// revoked.
+func (fbo *folderBranchOps) checkAccessRevoked(
+	ctx context.Context, md ImmutableRootMetadata) bool {
+	if md.TlfID().Type() == tlf.Public {
+		return false
+	}
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get the current session: %+v", err)
+		return false
+	}
+	isReader, err := md.IsReader(ctx, fbo.config.KBPKI(), session.UID)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't check reader status: %+v", err)
+		return false
+	}
+	if isReader {
+		return false
+	}
+
+	handle := md.GetTlfHandle()
+	fbo.log.CWarningf(ctx, "Read access to %s has been revoked; "+
+		"purging cached data", handle.GetCanonicalPath())
+	fbo.config.KeyCache().ClearTLF(fbo.id())
+	fbo.config.MDCache().ClearTLF(fbo.id())
+	fbo.config.BlockCache().ClearTLF(fbo.id())
+	fbo.status.setPermErr(NewReadAccessError(
+		handle, session.Name, handle.GetCanonicalPath()))
+	fbo.observers.accessRevoked(ctx, handle)
+	return true
+}
+
+func (fbo *folderBranchOps) isQuarantined() bool {
+	fbo.quarantineLock.RLock()
+	defer fbo.quarantineLock.RUnlock()
+	return fbo.quarantine != nil
+}
+
+func (fbo *folderBranchOps) quarantinedError(
+	q kbfsmd.ServerErrorTlfQuarantined) QuarantinedError {
+	qErr := QuarantinedError{Reason: q.Reason}
+	lState := makeFBOLockState()
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	if fbo.head != (ImmutableRootMetadata{}) {
+		qErr.Tlf = fbo.head.GetTlfHandle().GetCanonicalName()
+	}
+	return qErr
+}
+
+// checkQuarantine returns a QuarantinedError if the server has
+// quarantined this TLF, unless this is a read and the server still
+// allows reads.
+func (fbo *folderBranchOps) checkQuarantine(
+	ctx context.Context, forWrite bool) error {
+	fbo.quarantineLock.RLock()
+	q := fbo.quarantine
+	fbo.quarantineLock.RUnlock()
+	if q == nil || (!forWrite && q.ReadsAllowed) {
+		return nil
+	}
+	return fbo.quarantinedError(*q)
+}
+
+// noteQuarantine checks whether `err` is the server saying that it
+// has quarantined this TLF.  If so, it remembers that, so later
+// writes (and reads, if the server blocks them) fail without asking
+// the server, tells the user the first time, and returns a
+// QuarantinedError.  Otherwise it returns `err` unchanged.
+func (fbo *folderBranchOps) noteQuarantine(
+	ctx context.Context, err error) error {
+	q, ok := errors.Cause(err).(kbfsmd.ServerErrorTlfQuarantined)
+	if !ok {
+		return err
+	}
+	qErr := fbo.quarantinedError(q)
+
+	fbo.quarantineLock.Lock()
+	first := fbo.quarantine == nil
+	fbo.quarantine = &q
+	fbo.quarantineLock.Unlock()
+	if first {
+		fbo.log.CWarningf(ctx, "The server has quarantined this TLF "+
+			"(reads allowed: %t): %s", q.ReadsAllowed, q.Reason)
+		fbo.config.Reporter().ReportErr(
+			ctx, qErr.Tlf, fbo.id().Type(), WriteMode, qErr)
+	}
+	return qErr
+}
+
 func (fbo *folderBranchOps) registerAndWaitForUpdates() {
 	defer close(fbo.updateDoneChan)
 	childDone := make(chan struct{})
@@ -5775,6 +7928,32 @@ func (fbo *folderBranchOps) registerAndWaitForUpdates() {
 					// only set within this same goroutine.
 					fbo.cancelUpdates()
 					return context.Canceled
+				case kbfsmd.ServerErrorTlfQuarantined:
+					fbo.log.CDebugf(ctx, "Abandoning updates since the "+
+						"TLF has been quarantined: %+v", err)
+					_ = fbo.noteQuarantine(newCtx, err)
+					if qErr := fbo.checkQuarantine(newCtx, false); qErr != nil {
+						fbo.status.setPermErr(qErr)
+					}
+					// No need to lock here, since `cancelUpdates` is
+					// only set within this same goroutine.
+					fbo.cancelUpdates()
+					return context.Canceled
+				case kbfsmd.ServerErrorUnauthorized:
+					// The server stops serving updates to users who
+					// have been removed from the TLF, so check
+					// whether that happened.
+					lState := makeFBOLockState()
+					head := fbo.getTrustedHead(lState)
+					if head != (ImmutableRootMetadata{}) &&
+						fbo.checkAccessRevoked(newCtx, head) {
+						fbo.log.CDebugf(ctx, "Abandoning updates since "+
+							"read access was revoked: %+v", err)
+						// No need to lock here, since `cancelUpdates`
+						// is only set within this same goroutine.
+						fbo.cancelUpdates()
+						return context.Canceled
+					}
 				}
 				select {
 				case <-ctx.Done():
@@ -5807,6 +7986,45 @@ func (fbo *folderBranchOps) registerAndWaitForUpdates() {
 	<-childDone
 }
 
+// lastAccessTime returns when the folder-branch was last accessed or
+// looked up, or when it was created if neither has happened yet.
+func (fbo *folderBranchOps) lastAccessTime() time.Time {
+	fbo.muLastGetHead.Lock()
+	defer fbo.muLastGetHead.Unlock()
+	last := fbo.createdTime
+	if fbo.lastGetHead.After(last) {
+		last = fbo.lastGetHead
+	}
+	if fbo.lastOpsLookup.After(last) {
+		last = fbo.lastOpsLookup
+	}
+	return last
+}
+
+// isIdle returns true if this folder-branch hasn't been accessed
+// within `timeout` of `now`, and if it has no state that would be
+// lost by shutting it down: no dirty data, no unmerged changes, no
+// live nodes, and no observers other than the `internalObservers`
+// registered by KBFSOpsStandard itself.
+func (fbo *folderBranchOps) isIdle(lState *lockState, now time.Time,
+	timeout time.Duration, internalObservers int) bool {
+	if now.Sub(fbo.lastAccessTime()) < timeout {
+		return false
+	}
+
+	if fbo.blocks.GetState(lState) != cleanState ||
+		fbo.getCachedDirOpsCount(lState) > 0 ||
+		!fbo.isMasterBranch(lState) {
+		return false
+	}
+
+	if fbo.nodeCache != nil && len(fbo.nodeCache.AllNodes()) > 0 {
+		return false
+	}
+
+	return fbo.observers.count() <= internalObservers
+}
+
 func (fbo *folderBranchOps) registerForUpdatesShouldFireNow() bool {
 	fbo.muLastGetHead.Lock()
 	defer fbo.muLastGetHead.Unlock()
@@ -5911,7 +8129,7 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 			// the main attraction.
 			doSelect = false
 		} else if fbo.getCachedDirOpsCount(lState) >=
-			fbo.config.BGFlushDirOpBatchSize() {
+			fbo.dirOpBatchSize() {
 			doSelect = false
 		}
 
@@ -5921,7 +8139,7 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 			select {
 			case <-fbo.syncNeededChan:
 				if fbo.getCachedDirOpsCount(lState) >=
-					fbo.config.BGFlushDirOpBatchSize() {
+					fbo.dirOpBatchSize() {
 					doWait = false
 				}
 			case <-fbo.forceSyncChan:
@@ -5931,20 +8149,38 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 			}
 
 			if doWait {
-				timer := time.NewTimer(fbo.config.BGFlushPeriod())
+				timer := time.NewTimer(fbo.bgFlushPeriod())
+				// If there's a coalescing window, also stop waiting
+				// once no new writes have come in for that long.
+				var quietTimer *time.Timer
+				var quietC <-chan time.Time
+				window := fbo.config.DirOpCoalescingWindow(fbo.id())
+				if window > 0 {
+					quietTimer = time.NewTimer(window)
+					quietC = quietTimer.C
+				}
 				// Loop until either a tick's worth of time passes,
-				// the batch size of directory ops is full, a sync is
-				// forced, or a shutdown happens.
+				// the batch size of directory ops is full, the
+				// coalescing window passes quietly, a sync is forced,
+				// or a shutdown happens.
 			loop:
 				for {
 					select {
 					case <-timer.C:
 						break loop
+					case <-quietC:
+						break loop
 					case <-fbo.syncNeededChan:
 						if fbo.getCachedDirOpsCount(lState) >=
-							fbo.config.BGFlushDirOpBatchSize() {
+							fbo.dirOpBatchSize() {
 							break loop
 						}
+						if quietTimer != nil {
+							if !quietTimer.Stop() {
+								<-quietTimer.C
+							}
+							quietTimer.Reset(window)
+						}
 					case <-fbo.forceSyncChan:
 						break loop
 					case <-fbo.shutdownChan:
@@ -5980,6 +8216,7 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 				func(ctx context.Context) context.Context {
 					return context.WithValue(ctx, CtxBackgroundSyncKey, "1")
 				})
+			ctx = NewContextWithBlockFetchClass(ctx, BlockFetchBackground)
 
 			fbo.log.CDebugf(ctx, "Background sync triggered: %d dirty files, "+
 				"%d dir ops in batch", len(dirtyFiles), dirOpsCount)
@@ -6068,6 +8305,7 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 			"successful put: %v", err)
 		return err
 	}
+	fbo.assertTransitionLocked(ctx, lState, fbtResolve)
 	fbo.setBranchIDLocked(lState, kbfsmd.NullBranchID)
 
 	// Archive the old, unref'd blocks if journaling is off.
@@ -6088,6 +8326,7 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 		if err != nil {
 			return err
 		}
+		fbo.activity.add(mdCopyWithLocalOps.ReadOnly(), op)
 	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
 	return nil
@@ -6384,6 +8623,10 @@ func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
 				Unrefs:  make([]string, 0, len(op.Unrefs())),
 				Updates: make(map[string]string),
 			}
+			if kid, version := op.getDeviceInfo(); kid.Exists() {
+				opSummary.DeviceKID = kid.String()
+				opSummary.ClientVersion = version
+			}
 			for _, ptr := range op.Refs() {
 				opSummary.Refs = append(opSummary.Refs, ptr.String())
 			}
@@ -6468,6 +8711,18 @@ func (fbo *folderBranchOps) ClearPrivateFolderMD(ctx context.Context) {
 	fbo.hasBeenCleared = true
 }
 
+// LockKeys implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) LockKeys(ctx context.Context) {
+	fbo.config.KBFSOps().LockKeys(ctx)
+}
+
+// CrossTlfMove implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CrossTlfMove(ctx context.Context,
+	srcParent Node, srcName string, dstParent Node, dstName string) error {
+	return fbo.config.KBFSOps().CrossTlfMove(
+		ctx, srcParent, srcName, dstParent, dstName)
+}
+
 // ForceFastForward implements the KBFSOps interface for
 // folderBranchOps.
 func (fbo *folderBranchOps) ForceFastForward(ctx context.Context) {
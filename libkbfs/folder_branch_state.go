@@ -0,0 +1,199 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"golang.org/x/net/context"
+)
+
+// folderBranchState is the state of a folder-branch in the state
+// machine described in design/state_machine.md.  It combines the
+// overall block state (whether there are local writes that haven't
+// been synced yet) with whether the folder-branch is on the merged
+// branch, or on a staged (unmerged) one waiting for conflict
+// resolution.
+type folderBranchState struct {
+	block  overallBlockState
+	staged bool
+}
+
+func (s folderBranchState) String() string {
+	block := "clean"
+	if s.block == dirtyState {
+		block = "dirty"
+	}
+	branch := "merged"
+	if s.staged {
+		branch = "staged"
+	}
+	return block + "/" + branch
+}
+
+// folderBranchTransition is an MD-level event that moves a
+// folder-branch between the states of the state machine.  Writes
+// and syncs move it between clean and dirty on their own, so they
+// aren't modeled as transitions.
+type folderBranchTransition int
+
+const (
+	// fbtStage means a local MD write was put onto a staged branch,
+	// after a conflict or a rebase.  Allowed from any state.
+	fbtStage folderBranchTransition = iota
+	// fbtResolve means conflict resolution finished, bringing a
+	// staged branch back into the merged branch.  Local writes made
+	// in the meantime stay dirty.
+	fbtResolve
+	// fbtUnstage means the local staged branch was thrown away.
+	// Only allowed when clean, since dirty data would be written on
+	// top of the discarded branch.
+	fbtUnstage
+	// fbtApplyUpdates means updates from the server were applied
+	// on top of the current head.  Only allowed when clean and
+	// merged; anything else needs conflict resolution.
+	fbtApplyUpdates
+	// fbtUndoUpdates means updates were rolled back from the current
+	// head.  Only allowed when clean.
+	fbtUndoUpdates
+)
+
+func (t folderBranchTransition) String() string {
+	switch t {
+	case fbtStage:
+		return "stage"
+	case fbtResolve:
+		return "resolve"
+	case fbtUnstage:
+		return "unstage"
+	case fbtApplyUpdates:
+		return "apply updates"
+	case fbtUndoUpdates:
+		return "undo updates"
+	}
+	return fmt.Sprintf("folderBranchTransition(%d)", int(t))
+}
+
+// invalidFolderBranchTransitionError is returned when the state
+// machine doesn't allow a transition from a state.
+type invalidFolderBranchTransitionError struct {
+	from folderBranchState
+	t    folderBranchTransition
+}
+
+func (e invalidFolderBranchTransitionError) Error() string {
+	return fmt.Sprintf("Invalid folder-branch transition %q from state %s",
+		e.t, e.from)
+}
+
+// folderBranchStateChangedError is returned when a transition is
+// refused because the folder-branch is no longer in the state the
+// caller expected.
+type folderBranchStateChangedError struct {
+	expected folderBranchState
+	actual   folderBranchState
+}
+
+func (e folderBranchStateChangedError) Error() string {
+	return fmt.Sprintf("Folder-branch state changed from %s to %s",
+		e.expected, e.actual)
+}
+
+// folderBranchTransitionResult is the outcome of trying a transition.
+type folderBranchTransitionResult struct {
+	t    folderBranchTransition
+	from folderBranchState
+	to   folderBranchState
+	// refused is non-nil if the transition isn't allowed, and says
+	// why.  The caller must not go ahead with it.
+	refused error
+}
+
+func (r folderBranchTransitionResult) ok() bool {
+	return r.refused == nil
+}
+
+// next returns the state `t` leads to from `s`, or an error if `t`
+// isn't allowed from `s`.
+func (s folderBranchState) next(t folderBranchTransition) (
+	folderBranchState, error) {
+	invalid := invalidFolderBranchTransitionError{s, t}
+	switch t {
+	case fbtStage:
+		return folderBranchState{s.block, true}, nil
+	case fbtResolve:
+		if !s.staged {
+			return folderBranchState{}, invalid
+		}
+		return folderBranchState{s.block, false}, nil
+	case fbtUnstage:
+		if s.block != cleanState {
+			return folderBranchState{}, invalid
+		}
+		return folderBranchState{cleanState, false}, nil
+	case fbtApplyUpdates:
+		if s.block != cleanState || s.staged {
+			return folderBranchState{}, invalid
+		}
+		return s, nil
+	case fbtUndoUpdates:
+		if s.block != cleanState {
+			return folderBranchState{}, invalid
+		}
+		return s, nil
+	}
+	return folderBranchState{}, invalid
+}
+
+func (fbo *folderBranchOps) getStateLocked(
+	lState *lockState) folderBranchState {
+	fbo.mdWriterLock.AssertLocked(lState)
+	return folderBranchState{
+		block:  fbo.blocks.GetState(lState),
+		staged: fbo.bid != kbfsmd.NullBranchID,
+	}
+}
+
+// assertTransitionLocked checks that the state machine allows `t`
+// from the folder-branch's current state, for callers that have
+// already committed to the transition.  An invalid transition means
+// the locking strategy has been violated somewhere, so it panics in
+// tests; otherwise it's only logged.
+func (fbo *folderBranchOps) assertTransitionLocked(
+	ctx context.Context, lState *lockState, t folderBranchTransition) {
+	_, err := fbo.getStateLocked(lState).next(t)
+	if err == nil {
+		return
+	}
+	if fbo.config.IsTestMode() {
+		panic(err.Error())
+	}
+	fbo.log.CWarningf(ctx, "%v", err)
+}
+
+// tryTransitionLocked checks whether transition `t` can go ahead,
+// compare-and-set style: only if the folder-branch is still in state
+// `expected`, and the state machine allows `t` from there.  The
+// caller must hold mdWriterLock until it has made the transition, so
+// that no other MD-level transition can sneak in.  Refusals are
+// logged, and returned along with the reason for them.
+func (fbo *folderBranchOps) tryTransitionLocked(ctx context.Context,
+	lState *lockState, expected folderBranchState,
+	t folderBranchTransition) folderBranchTransitionResult {
+	res := folderBranchTransitionResult{
+		t:    t,
+		from: fbo.getStateLocked(lState),
+	}
+	if res.from != expected {
+		res.refused = folderBranchStateChangedError{expected, res.from}
+	} else {
+		res.to, res.refused = res.from.next(t)
+	}
+	if res.refused != nil {
+		fbo.log.CDebugf(ctx, "Transition %q blocked: %v", t, res.refused)
+	}
+	return res
+}
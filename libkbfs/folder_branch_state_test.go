@@ -0,0 +1,107 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestFolderBranchStateTransitions(t *testing.T) {
+	cleanMerged := folderBranchState{cleanState, false}
+	cleanStaged := folderBranchState{cleanState, true}
+	dirtyMerged := folderBranchState{dirtyState, false}
+	dirtyStaged := folderBranchState{dirtyState, true}
+
+	type result struct {
+		to folderBranchState
+		ok bool
+	}
+	invalid := result{}
+	tests := []struct {
+		t       folderBranchTransition
+		results map[folderBranchState]result
+	}{
+		{fbtStage, map[folderBranchState]result{
+			cleanMerged: {cleanStaged, true},
+			cleanStaged: {cleanStaged, true},
+			dirtyMerged: {dirtyStaged, true},
+			dirtyStaged: {dirtyStaged, true},
+		}},
+		{fbtResolve, map[folderBranchState]result{
+			cleanMerged: invalid,
+			cleanStaged: {cleanMerged, true},
+			dirtyMerged: invalid,
+			dirtyStaged: {dirtyMerged, true},
+		}},
+		{fbtUnstage, map[folderBranchState]result{
+			cleanMerged: {cleanMerged, true},
+			cleanStaged: {cleanMerged, true},
+			dirtyMerged: invalid,
+			dirtyStaged: invalid,
+		}},
+		{fbtApplyUpdates, map[folderBranchState]result{
+			cleanMerged: {cleanMerged, true},
+			cleanStaged: invalid,
+			dirtyMerged: invalid,
+			dirtyStaged: invalid,
+		}},
+		{fbtUndoUpdates, map[folderBranchState]result{
+			cleanMerged: {cleanMerged, true},
+			cleanStaged: {cleanStaged, true},
+			dirtyMerged: invalid,
+			dirtyStaged: invalid,
+		}},
+	}
+
+	for _, test := range tests {
+		for from, expected := range test.results {
+			to, err := from.next(test.t)
+			if !expected.ok {
+				require.IsType(t, invalidFolderBranchTransitionError{}, err,
+					"%s from %s", test.t, from)
+				continue
+			}
+			require.NoError(t, err, "%s from %s", test.t, from)
+			require.Equal(t, expected.to, to, "%s from %s", test.t, from)
+		}
+	}
+}
+
+func TestFolderBranchTryTransition(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(context.Background(), t, config)
+
+	ctx := context.Background()
+	h := parseTlfHandleOrBust(t, config, "u1", tlf.Private, tlf.NullID)
+	rootNode, _, err := config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, MasterBranch)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+
+	lState := makeFBOLockState()
+	ops.mdWriterLock.Lock(lState)
+	defer ops.mdWriterLock.Unlock(lState)
+
+	res := ops.tryTransitionLocked(ctx, lState,
+		folderBranchState{cleanState, false}, fbtApplyUpdates)
+	require.True(t, res.ok())
+	require.Equal(t, folderBranchState{cleanState, false}, res.to)
+
+	t.Log("A transition from a state we're no longer in is refused")
+	res = ops.tryTransitionLocked(ctx, lState,
+		folderBranchState{cleanState, true}, fbtUndoUpdates)
+	require.False(t, res.ok())
+	require.IsType(t, folderBranchStateChangedError{}, res.refused)
+
+	t.Log("So is one the state machine doesn't allow")
+	res = ops.tryTransitionLocked(ctx, lState,
+		folderBranchState{cleanState, false}, fbtResolve)
+	require.False(t, res.ok())
+	require.IsType(t, invalidFolderBranchTransitionError{}, res.refused)
+}
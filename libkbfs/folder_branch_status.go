@@ -23,6 +23,8 @@ type FolderBranchStatus struct {
 	BranchID            string
 	HeadWriter          libkb.NormalizedUsername
 	DiskUsage           uint64
+	DedupDiskUsage      uint64
+	UniqueDiskUsage     uint64
 	RekeyPending        bool
 	LatestKeyGeneration kbfsmd.KeyGen
 	FolderID            string
@@ -47,6 +49,10 @@ type FolderBranchStatus struct {
 
 	Journal *TLFJournalStatus `json:",omitempty"`
 
+	// Rekey describes this device's most recent rekey of the TLF,
+	// if any.
+	Rekey *RekeyStatus `json:",omitempty"`
+
 	PermanentErr string `json:",omitempty"`
 }
 
@@ -63,6 +69,9 @@ type KBFSStatus struct {
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus            `json:",omitempty"`
 	DiskCacheStatus map[string]DiskBlockCacheStatus `json:",omitempty"`
+	// BlockServerTiers is set when a local block server moves old
+	// blocks to cold storage.
+	BlockServerTiers *BlockServerTierStatus `json:",omitempty"`
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -171,6 +180,18 @@ func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) bool {
 	return fbsk.rmNode(fbsk.dirtyNodes, n)
 }
 
+// getDirtyNodes returns all the nodes that are currently marked
+// dirty.
+func (fbsk *folderBranchStatusKeeper) getDirtyNodes() []Node {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	nodes := make([]Node, 0, len(fbsk.dirtyNodes))
+	for _, n := range fbsk.dirtyNodes {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
 // dataMutex should be taken by the caller
 func (fbsk *folderBranchStatusKeeper) convertNodesToPathsLocked(
 	m map[NodeID]Node) []string {
@@ -203,6 +224,8 @@ func (fbsk *folderBranchStatusKeeper) getStatusWithoutJournaling(
 		}
 		fbs.HeadWriter = name
 		fbs.DiskUsage = fbsk.md.DiskUsage()
+		fbs.DedupDiskUsage = fbsk.md.DedupDiskUsage()
+		fbs.UniqueDiskUsage = fbsk.md.UniqueDiskUsage()
 		fbs.RekeyPending = fbsk.config.RekeyQueue().IsRekeyPending(fbsk.md.TlfID())
 		fbs.LatestKeyGeneration = fbsk.md.LatestKeyGeneration()
 		fbs.FolderID = fbsk.md.TlfID().String()
@@ -14,6 +14,7 @@ import (
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
 )
 
 // folderUpdatePrepper is a helper struct for preparing blocks and MD
@@ -57,9 +58,46 @@ func (fup *folderUpdatePrepper) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// readyInlinedBlock makes a pointer for a direct file block whose
+// contents will be inlined into the file's directory entry.  Nothing
+// is put to the server for it, so it gets a random ID and no encoded
+// size, but it's still added to `bps`, so that the file's node is
+// updated to the new pointer and the block is cached like any other.
+// Any encoded size left over from when the block was last put is
+// cleared, so that usage accounting doesn't charge for it.
+func (fup *folderUpdatePrepper) readyInlinedBlock(kmd KeyMetadata,
+	fblock *FileBlock, chargedTo keybase1.UserOrTeamID,
+	bps *blockPutState) (BlockInfo, error) {
+	id, err := fup.config.cryptoPure().MakeTemporaryBlockID()
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	ptr := BlockPointer{
+		ID:         id,
+		KeyGen:     kmd.LatestKeyGeneration(),
+		DataVer:    InlineDataVer,
+		DirectType: DirectBlock,
+		Context: kbfsblock.MakeFirstContext(
+			chargedTo, fup.config.DefaultBlockType()),
+	}
+	fblock.SetEncodedSize(0)
+	bps.addNewBlock(ptr, fblock, ReadyBlockData{}, nil)
+	return BlockInfo{BlockPointer: ptr}, nil
+}
+
 func (fup *folderUpdatePrepper) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, chargedTo keybase1.UserOrTeamID) error {
+	// The ops won't be encoded again when the MD is put, so record
+	// the writing device in them now.
+	if !fup.config.HideOpDeviceInfo() {
+		session, err := fup.config.KBPKI().GetCurrentSession(ctx)
+		if err != nil {
+			return err
+		}
+		addOpDeviceInfo(changes, session.VerifyingKey, false)
+	}
+
 	buf, err := fup.config.Codec().Encode(changes)
 	if err != nil {
 		return err
@@ -173,40 +211,72 @@ func (fup *folderUpdatePrepper) unembedBlockChanges(
 //
 // entryType must not be Sym.
 //
+// If `inline` is true, `newBlock` must be a direct file block, and
+// its contents are inlined into the new directory entry for `name`
+// instead of being readied as a block.  Otherwise any contents
+// inlined into that entry are dropped, since the entry now points to
+// a real block.
+//
 // TODO: deal with multiple nodes for indirect blocks
 func (fup *folderUpdatePrepper) prepUpdateForPath(
 	ctx context.Context, lState *lockState, chargedTo keybase1.UserOrTeamID,
 	md *RootMetadata, newBlock Block, dir path, name string,
-	entryType EntryType, mtime bool, ctime bool, stopAt BlockPointer,
-	lbc localBcache) (path, DirEntry, *blockPutState, error) {
+	entryType EntryType, mtime bool, ctime bool, inline bool,
+	stopAt BlockPointer, lbc localBcache, lock sync.Locker) (
+	path, DirEntry, *blockPutState, error) {
+	// `lock` protects `lbc`, `md` and the `stopAt` block, which other
+	// paths might be getting readied into at the same time.  It's
+	// only released while readying a block or fetching one that
+	// belongs to this path alone.
+	lock.Lock()
+	defer lock.Unlock()
+
 	// now ready each dblock and write the DirEntry for the next one
 	// in the path
 	currBlock := newBlock
 	currName := name
-	newPath := path{
-		FolderBranch: dir.FolderBranch,
-		path:         make([]pathNode, 0, len(dir.path)),
-	}
-	bps := newBlockPutState(len(dir.path))
-	refPath := dir.ChildPathNoPtr(name)
+	// The new path is filled in from its tail up to the root (or
+	// stopAt), so allocate all of it up front instead of prepending
+	// a node at a time.
+	newPathNodes := make([]pathNode, len(dir.path)+1)
+	numNewNodes := 0
+	bps := newBlockPutState(len(dir.path) + 1)
 	var newDe DirEntry
 	doSetTime := true
 	now := fup.nowUnixNano()
 	var uid keybase1.UID
-	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fup.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, chargedTo, bps,
-			fup.config.DefaultBlockType())
+	var inlineData []byte
+	for numNewNodes < len(newPathNodes) {
+		var info BlockInfo
+		var plainSize int
+		var err error
+		if inline && numNewNodes == 0 {
+			fblock, ok := currBlock.(*FileBlock)
+			if !ok || fblock.IsInd {
+				return path{}, DirEntry{}, nil, errors.Errorf(
+					"Can't inline the contents of %s", name)
+			}
+			info, err = fup.readyInlinedBlock(
+				md.ReadOnly(), fblock, chargedTo, bps)
+			inlineData = append([]byte(nil), fblock.Contents...)
+		} else {
+			lock.Unlock()
+			info, plainSize, err = fup.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, chargedTo, bps,
+				fup.config.DefaultBlockType())
+			lock.Lock()
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
 
 		// prepend to path and setup next one
-		newPath.path = append([]pathNode{{info.BlockPointer, currName}},
-			newPath.path...)
+		numNewNodes++
+		newPathNodes[len(newPathNodes)-numNewNodes] =
+			pathNode{info.BlockPointer, currName}
 
 		// get the parent block
-		prevIdx := len(dir.path) - len(newPath.path)
+		prevIdx := len(dir.path) - numNewNodes
 		var prevDblock *DirBlock
 		var de DirEntry
 		var nextName string
@@ -230,12 +300,26 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 				// have to fetch it, possibly from the
 				// network. Directory blocks are only ever
 				// modified while holding mdWriterLock, so it's
-				// safe to fetch them one at a time.
+				// safe to fetch them one at a time.  Only the
+				// `stopAt` block can be shared with other
+				// paths, so fetch it with the lock held and
+				// put it in the local bcache right away, so
+				// they all modify the same copy.
+				isStop := prevDir.tailPointer() == stopAt
+				if !isStop {
+					lock.Unlock()
+				}
 				prevDblock, err = fup.blocks.GetDir(
 					ctx, lState, md.ReadOnly(), prevDir, blockWrite)
+				if !isStop {
+					lock.Lock()
+				}
 				if err != nil {
 					return path{}, DirEntry{}, nil, err
 				}
+				if isStop {
+					lbc[stopAt] = prevDblock
+				}
 			}
 
 			// modify the direntry for currName; make one
@@ -247,7 +331,7 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 			if de, ok = prevDblock.Children[currName]; !ok {
 				// If this isn't the first time
 				// around, we have an error.
-				if len(newPath.path) > 1 {
+				if numNewNodes > 1 {
 					return path{}, DirEntry{}, nil, NoSuchNameError{currName}
 				}
 
@@ -289,10 +373,10 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 			md.AddRefBlock(info)
 		}
 
-		if len(refPath.path) > 1 {
-			refPath = *refPath.parentPath()
-		}
 		de.BlockInfo = info
+		// Only the first entry on the path can be inlined.
+		de.InlineData = inlineData
+		inlineData = nil
 
 		if doSetTime {
 			if mtime {
@@ -321,7 +405,7 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 		if prevIdx < 0 {
 			md.data.Dir = de
 		} else {
-			prevDblock.Children[currName] = de
+			prevDblock.setChild(currName, de)
 		}
 		currName = nextName
 
@@ -340,6 +424,10 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 		doSetTime = nextDoSetTime
 	}
 
+	newPath := path{
+		FolderBranch: dir.FolderBranch,
+		path:         newPathNodes[len(newPathNodes)-numNewNodes:],
+	}
 	return newPath, newDe, bps, nil
 }
 
@@ -359,6 +447,23 @@ const (
 	prepFolderDontCopyIndirectFileBlocks prepFolderCopyBehavior = 2
 )
 
+// prepTreeState is shared by all the prepTree calls for a single
+// update, some of which may run in parallel.
+type prepTreeState struct {
+	// lock protects the local block cache, the new MD, and the
+	// directory blocks at the tree's branch points, which the
+	// subtrees below them all write their new entries into.
+	lock sync.Mutex
+	// pathLimiter limits how many paths get readied at once.
+	pathLimiter chan struct{}
+}
+
+func newPrepTreeState() *prepTreeState {
+	return &prepTreeState{
+		pathLimiter: make(chan struct{}, maxParallelBlockGets),
+	}
+}
+
 // prepTree, given a node in part of the FS tree that needs to be
 // sync'd, either calls prepUpdateForPath on it if the node has no
 // children of its own, or it calls prepTree recursively for all
@@ -367,21 +472,35 @@ const (
 // last child which may sync back to the given stopAt pointer.  This
 // ensures that the sync process will ready blocks that are complete
 // (with all child changes applied) before readying any parent blocks.
+// The children that only sync up to this node are independent of
+// each other (e.g., the old and new parent directories of a rename
+// across distant directories), so they are readied in parallel.
 // prepTree returns the merged blockPutState for itself and all of its
 // children.
 func (fup *folderUpdatePrepper) prepTree(ctx context.Context, lState *lockState,
 	unmergedChains *crChains, newMD *RootMetadata,
 	chargedTo keybase1.UserOrTeamID, node *pathTreeNode, stopAt BlockPointer,
 	lbc localBcache, newFileBlocks fileBlockMap, dirtyBcache DirtyBlockCache,
-	copyBehavior prepFolderCopyBehavior) (
+	copyBehavior prepFolderCopyBehavior, state *prepTreeState) (
 	*blockPutState, error) {
 	// If this has no children, then sync it, as far back as stopAt.
 	if len(node.children) == 0 {
+		select {
+		case state.pathLimiter <- struct{}{}:
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+		defer func() { <-state.pathLimiter }()
+
 		// Look for the directory block or the new file block.
 		entryType := Dir
 		var block Block
 		var ok bool
-		block, ok = lbc[node.ptr]
+		func() {
+			state.lock.Lock()
+			defer state.lock.Unlock()
+			block, ok = lbc[node.ptr]
+		}()
 		// non-nil exactly when entryType != Dir.
 		var fblock *FileBlock
 		if !ok {
@@ -449,17 +568,29 @@ func (fup *folderUpdatePrepper) prepTree(ctx context.Context, lState *lockState,
 					}
 				}
 			}
-			for _, info := range infos {
-				newMD.AddRefBlock(info)
-			}
+			func() {
+				state.lock.Lock()
+				defer state.lock.Unlock()
+				for _, info := range infos {
+					newMD.AddRefBlock(info)
+				}
+			}()
 		}
 
+		// Small files can have their contents inlined into their
+		// entries, but only in a regular sync; conflict resolution
+		// always readies real blocks for the files it copies.
+		inline := copyBehavior == prepFolderDontCopyIndirectFileBlocks &&
+			entryType != Dir && !fblock.IsInd &&
+			fup.config.BlockSplitter().ShouldInlineFile(
+				int64(len(fblock.Contents)))
+
 		// Assume the mtime/ctime are already fixed up in the blocks
 		// in the lbc.
 		_, _, bps, err := fup.prepUpdateForPath(
 			ctx, lState, chargedTo, newMD, block,
 			*node.mergedPath.parentPath(), node.mergedPath.tailName(),
-			entryType, false, false, stopAt, lbc)
+			entryType, false, false, inline, stopAt, lbc, &state.lock)
 		if err != nil {
 			return nil, err
 		}
@@ -472,23 +603,50 @@ func (fup *folderUpdatePrepper) prepTree(ctx context.Context, lState *lockState,
 	}
 
 	// If there is more than one child, use this node as the stopAt
-	// since it is the branch point, except for the last child.
-	bps := newBlockPutState(len(lbc))
-	count := 0
+	// since it is the branch point, except for the last child.  The
+	// last child readies this node's block, so it has to wait until
+	// all the others have put their new entries in it.
+	children := make([]*pathTreeNode, 0, len(node.children))
 	for _, child := range node.children {
-		localStopAt := node.ptr
-		count++
-		if count == len(node.children) {
-			localStopAt = stopAt
-		}
-		childBps, err := fup.prepTree(
-			ctx, lState, unmergedChains, newMD, chargedTo, child, localStopAt, lbc,
-			newFileBlocks, dirtyBcache, copyBehavior)
-		if err != nil {
-			return nil, err
-		}
+		children = append(children, child)
+	}
+	lastChild := children[len(children)-1]
+	children = children[:len(children)-1]
+
+	childBpses := make([]*blockPutState, len(children))
+	eg, groupCtx := errgroup.WithContext(ctx)
+	for i, child := range children {
+		i, child := i, child
+		eg.Go(func() (err error) {
+			// Each parallel prep is its own execution flow, as
+			// far as the folder locks are concerned.
+			childBpses[i], err = fup.prepTree(
+				groupCtx, makeFBOLockState(), unmergedChains, newMD,
+				chargedTo, child, node.ptr, lbc, newFileBlocks,
+				dirtyBcache, copyBehavior, state)
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	lastBps, err := fup.prepTree(
+		ctx, lState, unmergedChains, newMD, chargedTo, lastChild, stopAt, lbc,
+		newFileBlocks, dirtyBcache, copyBehavior, state)
+	if err != nil {
+		return nil, err
+	}
+
+	numBlocks := len(lastBps.blockStates)
+	for _, childBps := range childBpses {
+		numBlocks += len(childBps.blockStates)
+	}
+	bps := newBlockPutState(numBlocks)
+	for _, childBps := range childBpses {
 		bps.mergeOtherBps(childBps)
 	}
+	bps.mergeOtherBps(lastBps)
 	return bps, nil
 }
 
@@ -506,6 +664,10 @@ func (fup *folderUpdatePrepper) updateResolutionUsageLockedCache(
 	md.SetMDRefBytes(0)
 	md.SetDiskUsage(mostRecentMergedMD.DiskUsage())
 	md.SetMDDiskUsage(mostRecentMergedMD.MDDiskUsage())
+	// Refs made during resolution are counted at full size, even if
+	// they are dedup'd, since we don't track their contexts here.
+	md.SetDedupRefBytes(0)
+	md.SetDedupDiskUsage(mostRecentMergedMD.DedupDiskUsage())
 
 	localBlocks := make(map[BlockPointer]Block)
 	for _, bs := range bps.blockStates {
@@ -699,6 +861,14 @@ func (fup *folderUpdatePrepper) updateResolutionUsageAndPointersLockedCache(
 			md.SetRefBytes(0)
 			md.SetUnrefBytes(mergedUsage - md.DiskUsage())
 		}
+		unmergedDedupUsage := mostRecentUnmergedMD.DedupDiskUsage()
+		mergedDedupUsage := mostRecentMergedMD.DedupDiskUsage()
+		md.SetDedupDiskUsage(unmergedDedupUsage)
+		if unmergedDedupUsage > mergedDedupUsage {
+			md.SetDedupRefBytes(unmergedDedupUsage - mergedDedupUsage)
+		} else {
+			md.SetDedupRefBytes(0)
+		}
 
 		mergedMDUsage := mostRecentMergedMD.MDDiskUsage()
 		if md.MDDiskUsage() < mergedMDUsage {
@@ -1014,7 +1184,7 @@ func (fup *folderUpdatePrepper) prepUpdateForPaths(ctx context.Context,
 		if root != nil {
 			bps, err = fup.prepTree(ctx, lState, unmergedChains,
 				md, chargedTo, root, BlockPointer{}, lbc, newFileBlocks,
-				dirtyBcache, copyBehavior)
+				dirtyBcache, copyBehavior, newPrepTreeState())
 			if err != nil {
 				return nil, nil, nil, err
 			}
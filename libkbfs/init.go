@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
 )
 
 const (
@@ -32,6 +34,13 @@ const (
 	// InitSingleOpString is for when KBFS will only be used for a
 	// single logical operation (e.g., as a git remote helper).
 	InitSingleOpString = "singleOp"
+	// InitReadOnlyString is for when KBFS will only be used to read
+	// data, by a long-running service (e.g., kbpagesd).
+	InitReadOnlyString = "readOnly"
+
+	// defaultLogFileMaxSize is the size a log file can grow to before
+	// it's rotated, unless InitParams.LogFileConfig says otherwise.
+	defaultLogFileMaxSize = 128 * 1024 * 1024
 )
 
 // InitParams contains the initialization parameters for Init(). It is
@@ -46,6 +55,13 @@ type InitParams struct {
 	// "dir:/path/to/dir" for an on-disk test server.
 	BServerAddr string
 
+	// BServerColdDir, if non-empty, is a directory that an on-disk
+	// block server ("dir:/path/to/dir") moves the data of old,
+	// unreferenced blocks to.  BServerColdAfter is how old those
+	// blocks must be.
+	BServerColdDir   string
+	BServerColdAfter time.Duration
+
 	// If non-empty the host:port of the metadata server. If
 	// empty, a default value is used depending on the run mode.
 	// Can also be "memory" for an in-memory test server or
@@ -56,6 +72,15 @@ type InitParams struct {
 	// zero, the capacity is set using getDefaultBlockCacheCapacity().
 	CleanBlockCacheCapacity uint64
 
+	// AdaptiveBlockCache, if true, shrinks the clean block cache
+	// when the system is low on memory, or when the process's RSS
+	// goes over MaxRSSBytes, and grows it back once there's room.
+	AdaptiveBlockCache bool
+
+	// MaxRSSBytes, if non-zero, is the process RSS above which
+	// AdaptiveBlockCache shrinks the clean block cache.
+	MaxRSSBytes uint64
+
 	// Fake local user name.
 	LocalUser string
 
@@ -97,6 +122,11 @@ type InitParams struct {
 	// DiskCacheMode specifies which mode to start the disk cache.
 	DiskCacheMode DiskCacheMode
 
+	// DiskCacheMmapReads, if true, makes a local disk cache store
+	// large blocks in their own files and map them when reading,
+	// instead of copying them onto the heap.
+	DiskCacheMmapReads bool
+
 	// StorageRoot, if non-empty, points to a local directory to put its local
 	// databases for things like the journal or disk cache.
 	StorageRoot string
@@ -110,8 +140,117 @@ type InitParams struct {
 	// flush.
 	BGFlushDirOpBatchSize int
 
+	// TLFIdleEvictionTimeout indicates how long a TLF can go without
+	// being accessed before its in-memory state is shut down.  Zero
+	// means TLFs are never evicted.
+	TLFIdleEvictionTimeout time.Duration
+
+	// AtimePolicy indicates when reads update the access times of
+	// files.
+	AtimePolicy AtimePolicy
+
+	// MaxOpenTLFs caps how many TLFs can have their in-memory state
+	// instantiated at once; past that, the least recently used idle
+	// ones are evicted.  Zero means no limit.
+	MaxOpenTLFs int
+
+	// KeyCacheTTL indicates how long a decrypted TLF crypt key can
+	// stay cached in memory before it has to be decrypted again.
+	// Zero means keys stay cached until evicted or explicitly
+	// dropped.
+	KeyCacheTTL time.Duration
+
+	// CRQuietPeriod indicates how long a TLF must go without local
+	// writes before conflict resolution starts on it.
+	CRQuietPeriod time.Duration
+
+	// LogRingBufferKB indicates how many kilobytes of recent log
+	// lines are kept in memory for each TLF, for debug dumps.
+	LogRingBufferKB int
+
+	// ConflictManifest indicates whether conflict resolution should
+	// record the conflicted copies it creates in a manifest file in
+	// the root of each TLF.  It is off by default.
+	ConflictManifest bool
+
+	// CRTextMerge indicates whether conflict resolution should merge
+	// conflicting writes to small text files line by line, instead
+	// of making conflicted copies.
+	CRTextMerge bool
+	// CRTextMergeGlobs is a comma-separated list of file name
+	// patterns that CRTextMerge always treats as text.
+	CRTextMergeGlobs string
+
+	// UnmergedBranchRetention indicates how long unmerged branches
+	// pruned by conflict resolution or unstaging are kept in memory
+	// for recovery.  Zero means they aren't kept.
+	UnmergedBranchRetention time.Duration
+
+	// MDPutPipelining, if true, lets a folder prepare its next MD
+	// revision while the put of the previous one is in flight.
+	// It has no effect on folders with journaling enabled.
+	MDPutPipelining bool
+
+	// HideOpDeviceInfo, if true, keeps this client from recording its
+	// device KID and version in the ops it writes.
+	HideOpDeviceInfo bool
+
+	// StrictWriteVisibility, if true, makes reads of a file that's
+	// being synced wait for the sync to finish, so they never see a
+	// mix of the file's state from before and after the sync.
+	StrictWriteVisibility bool
+
+	// TlfUsageGrowthBytes, if non-zero, is how much a TLF may grow
+	// within TlfUsageGrowthWindow before KBFS warns about it.
+	TlfUsageGrowthBytes uint64
+	// TlfUsageGrowthWindow is the period over which TLF growth is
+	// measured.
+	TlfUsageGrowthWindow time.Duration
+	// TlfUsageMarks is a comma-separated list of TLF sizes, in
+	// bytes, that KBFS warns about a TLF growing past.
+	TlfUsageMarks string
+	// TlfUsageReportPeriod, if non-zero, is how often a usage report
+	// is written into each TLF this user can write to.
+	TlfUsageReportPeriod time.Duration
+
+	// DirOpCoalescingWindow indicates how long a TLF waits after a
+	// directory operation for more to arrive, so they can all be
+	// synced in a single MD revision.  Zero disables coalescing.
+	DirOpCoalescingWindow time.Duration
+
+	// TuningProfile, if non-empty, names the tuning profile all TLFs
+	// use by default; see TuningProfileNames().
+	TuningProfile string
+
+	// ReadAheadBlocks, if positive, overrides how many blocks the
+	// default tuning profile reads ahead of sequential reads.
+	ReadAheadBlocks int
+
+	// InlineFileMaxSize, if positive, is the size in bytes of the
+	// largest file whose contents get inlined into its directory
+	// entry when it's synced, instead of being put as a block.
+	// Clients that predate InlineDataVer can't read inlined files.
+	InlineFileMaxSize int64
+
+	// FavoritesPrefetch specifies how much data to prefetch for each
+	// of the user's favorites at startup.
+	FavoritesPrefetch FavoritesPrefetchMode
+
+	// TelemetryEndpoint, if non-empty, is the URL that anonymized,
+	// aggregated performance metrics are POSTed to.  Telemetry is off
+	// when it's empty.
+	TelemetryEndpoint string
+	// TelemetryPeriod is how often telemetry is sent; if zero, it's
+	// sent daily.
+	TelemetryPeriod time.Duration
+
 	// Mode describes how KBFS should initialize itself.
 	Mode string
+
+	// Anonymous, if true, makes KBFS act as if no user is logged in,
+	// so that it can only read public TLFs.  It requires Mode to be
+	// InitReadOnlyString.
+	Anonymous bool
 }
 
 // defaultBServer returns the default value for the -bserver flag.
@@ -181,13 +320,15 @@ func DefaultInitParams(ctx Context) InitParams {
 		MetadataVersion:  defaultMetadataVersion(ctx),
 		LogFileConfig: logger.LogFileConfig{
 			MaxAge:       30 * 24 * time.Hour,
-			MaxSize:      128 * 1024 * 1024,
+			MaxSize:      defaultLogFileMaxSize,
 			MaxKeepFiles: 3,
 		},
 		TLFJournalBackgroundWorkStatus: TLFJournalBackgroundWorkEnabled,
 		StorageRoot:                    ctx.GetDataDir(),
 		BGFlushPeriod:                  bgFlushPeriodDefault,
 		BGFlushDirOpBatchSize:          bgFlushDirOpBatchSizeDefault,
+		CRQuietPeriod:                  crQuietPeriodDefault,
+		LogRingBufferKB:                logRingBufferBytesDefault / 1024,
 		EnableJournal:                  BoolForString(journalEnv),
 		DiskCacheMode:                  DiskCacheModeLocal,
 		Mode:                           InitDefaultString,
@@ -206,6 +347,14 @@ func AddFlagsWithDefaults(
 
 	flags.StringVar(&params.BServerAddr, "bserver", defaultParams.BServerAddr,
 		"host:port of the block server, 'memory', or 'dir:/path/to/dir'")
+	flags.StringVar(&params.BServerColdDir, "bserver-cold-dir",
+		defaultParams.BServerColdDir,
+		"Directory an on-disk block server moves the data of archived "+
+			"blocks to; reads of those blocks go through to it")
+	flags.DurationVar(&params.BServerColdAfter, "bserver-cold-after",
+		defaultParams.BServerColdAfter,
+		"How long ago an archived block must have been put before "+
+			"-bserver-cold-dir gets it (default 30 days)")
 	flags.StringVar(&params.MDServerAddr, "mdserver",
 		defaultParams.MDServerAddr,
 		"host:port of the metadata server, 'memory', or 'dir:/path/to/dir'")
@@ -227,7 +376,7 @@ func AddFlagsWithDefaults(
 		"Maximum age of a log file before rotation")
 	params.LogFileConfig.MaxSize = defaultParams.LogFileConfig.MaxSize
 	flags.Var(SizeFlag{&params.LogFileConfig.MaxSize}, "log-file-max-size",
-		"Maximum size of a log file before rotation")
+		"Maximum size of a log file before rotation; negative for no limit")
 	// The default is to *DELETE* old log files for kbfs.
 	flags.IntVar(&params.LogFileConfig.MaxKeepFiles, "log-file-max-keep-files",
 		defaultParams.LogFileConfig.MaxKeepFiles, "Maximum number of log "+
@@ -236,6 +385,14 @@ func AddFlagsWithDefaults(
 		defaultParams.CleanBlockCacheCapacity,
 		"If non-zero, specify the capacity of clean block cache. If zero, "+
 			"the capacity is set based on system RAM.")
+	flags.BoolVar(&params.AdaptiveBlockCache, "adaptive-bcache",
+		defaultParams.AdaptiveBlockCache,
+		"Shrink the clean block cache when memory is low, and grow it "+
+			"back when memory is available again.")
+	flags.Uint64Var(&params.MaxRSSBytes, "max-rss",
+		defaultParams.MaxRSSBytes,
+		"If non-zero, and -adaptive-bcache is set, shrink the clean block "+
+			"cache whenever the process RSS is above this many bytes.")
 	flags.StringVar(&params.StorageRoot, "storage-root",
 		defaultParams.StorageRoot, "Specifies where Keybase will store its "+
 			"local databases for the journal and disk cache.")
@@ -245,6 +402,10 @@ func AddFlagsWithDefaults(
 			"subdirectory of -storage-root to store the cache. If 'remote', "+
 			"then it connects to the local KBFS instance and delegates disk "+
 			"cache operations to it.")
+	flags.BoolVar(&params.DiskCacheMmapReads, "disk-cache-mmap",
+		defaultParams.DiskCacheMmapReads,
+		"Store large blocks in a local disk cache in their own files, "+
+			"and map them into memory when reading them.")
 	flags.BoolVar(&params.EnableJournal, "enable-journal",
 		defaultParams.EnableJournal, "Enables write journaling for TLFs.")
 
@@ -261,14 +422,118 @@ func AddFlagsWithDefaults(
 		int(defaultParams.BGFlushDirOpBatchSize),
 		"The number of unflushed directory operations in a TLF that will "+
 			"trigger an immediate data sync.")
+	flags.DurationVar(&params.TLFIdleEvictionTimeout, "tlf-idle-eviction",
+		defaultParams.TLFIdleEvictionTimeout,
+		"How long a TLF can go unaccessed before its in-memory state is "+
+			"evicted; 0 disables eviction.")
+	flags.Var(&params.AtimePolicy, "atime",
+		"When reads update file access times: noatime (never) or "+
+			"relatime (when older than the file's last change, or a "+
+			"day old).")
+	flags.IntVar(&params.MaxOpenTLFs, "max-open-tlfs",
+		defaultParams.MaxOpenTLFs,
+		"The maximum number of TLFs to keep in memory at once, evicting "+
+			"the least recently used idle ones; 0 means no limit.")
+	flags.DurationVar(&params.KeyCacheTTL, "key-cache-ttl",
+		defaultParams.KeyCacheTTL,
+		"How long a decrypted TLF key can stay cached in memory; 0 means "+
+			"keys stay cached until evicted.")
+	flags.DurationVar(&params.CRQuietPeriod, "cr-quiet-period",
+		defaultParams.CRQuietPeriod,
+		"How long a TLF must go without local writes before conflict "+
+			"resolution starts on it.")
+	flags.IntVar(&params.LogRingBufferKB, "log-ring-buffer-kb",
+		defaultParams.LogRingBufferKB,
+		"How many KB of recent log lines to keep in memory for each TLF, "+
+			"for debug dumps; 0 disables.")
+	flags.BoolVar(&params.ConflictManifest, "conflict-manifest",
+		defaultParams.ConflictManifest,
+		"Record the conflicted copies made by conflict resolution in "+
+			ConflictManifestName+" in the root of each TLF.")
+	flags.BoolVar(&params.CRTextMerge, "cr-text-merge",
+		defaultParams.CRTextMerge,
+		"Merge conflicting writes to small text files line by line, "+
+			"instead of making conflicted copies, when the writes don't "+
+			"overlap.")
+	flags.StringVar(&params.CRTextMergeGlobs, "cr-text-merge-globs",
+		defaultParams.CRTextMergeGlobs,
+		"Comma-separated file name patterns that -cr-text-merge always "+
+			"treats as text.")
+	flags.DurationVar(&params.UnmergedBranchRetention,
+		"unmerged-branch-retention", defaultParams.UnmergedBranchRetention,
+		"How long to keep unmerged branches after conflict resolution "+
+			"or unstaging prunes them, so their data can be recovered; "+
+			"0 disables retention.")
+	flags.BoolVar(&params.MDPutPipelining, "md-put-pipelining",
+		defaultParams.MDPutPipelining,
+		"Prepare the next MD revision of a folder while the previous "+
+			"one is still being put to the MD server, when journaling "+
+			"is off.")
+	flags.BoolVar(&params.HideOpDeviceInfo, "hide-op-device-info",
+		defaultParams.HideOpDeviceInfo,
+		"Don't record this device's KID and the client version in the "+
+			"metadata of each write.")
+	flags.BoolVar(&params.StrictWriteVisibility, "strict-write-visibility",
+		defaultParams.StrictWriteVisibility,
+		"Make reads of a file that's being synced wait for the sync to "+
+			"finish, so they see a consistent version of the file.")
+	flags.Uint64Var(&params.TlfUsageGrowthBytes, "tlf-usage-growth-bytes",
+		defaultParams.TlfUsageGrowthBytes,
+		"Warn when a folder grows by at least this many bytes within "+
+			"-tlf-usage-growth-window; 0 disables these warnings.")
+	flags.DurationVar(&params.TlfUsageGrowthWindow,
+		"tlf-usage-growth-window", defaultParams.TlfUsageGrowthWindow,
+		"The period over which -tlf-usage-growth-bytes is measured; "+
+			"defaults to 24h.")
+	flags.StringVar(&params.TlfUsageMarks, "tlf-usage-marks",
+		defaultParams.TlfUsageMarks,
+		"Comma-separated folder sizes, in bytes, to warn about folders "+
+			"growing past.")
+	flags.DurationVar(&params.TlfUsageReportPeriod,
+		"tlf-usage-report-period", defaultParams.TlfUsageReportPeriod,
+		"How often to write a usage report into each writable folder, "+
+			"e.g. 168h for weekly; 0 disables the reports.")
+	flags.DurationVar(&params.DirOpCoalescingWindow,
+		"dir-op-coalescing-window", defaultParams.DirOpCoalescingWindow,
+		"How long to wait after a directory operation for more to "+
+			"arrive before syncing them together, e.g. 200ms; 0 "+
+			"disables coalescing.")
+	flags.StringVar(&params.TuningProfile, "tuning-profile",
+		defaultParams.TuningProfile,
+		"The read-ahead, write-behind and caching profile to use for "+
+			"all folders: default, streaming, build or editing.")
+	flags.IntVar(&params.ReadAheadBlocks, "read-ahead-blocks",
+		defaultParams.ReadAheadBlocks,
+		"How many blocks to fetch ahead of sequential reads of a file, "+
+			"overriding the tuning profile; 0 keeps the profile's "+
+			"setting.")
+	flags.Int64Var(&params.InlineFileMaxSize, "inline-file-max-size",
+		defaultParams.InlineFileMaxSize,
+		"Store the contents of files up to this many bytes in their "+
+			"directory entries rather than in blocks of their own; 0 "+
+			"disables inlining.  Older clients can't read such files.")
+	params.FavoritesPrefetch = defaultParams.FavoritesPrefetch
+	flags.Var(&params.FavoritesPrefetch, "favorites-prefetch",
+		"What to prefetch for each favorite TLF at startup. If 'md', the "+
+			"latest metadata is fetched; if 'rootdir', the root directory "+
+			"is fetched as well. Defaults to 'off'.")
+	flags.StringVar(&params.TelemetryEndpoint, "telemetry-endpoint",
+		defaultParams.TelemetryEndpoint,
+		"If set, opt in to sending anonymized performance counters "+
+			"(sync latency, conflict resolution and cache hit rates, "+
+			"with no paths or identifiers) to this URL.")
+	flags.DurationVar(&params.TelemetryPeriod, "telemetry-period",
+		defaultParams.TelemetryPeriod,
+		"How often to send telemetry to -telemetry-endpoint; "+
+			"defaults to 24h.")
 
 	flags.IntVar((*int)(&params.MetadataVersion), "md-version",
 		int(defaultParams.MetadataVersion),
 		"Metadata version to use when creating new metadata")
 	flags.StringVar(&params.Mode, "mode", defaultParams.Mode,
 		fmt.Sprintf("Overall initialization mode for KBFS, indicating how "+
-			"heavy-weight it can be (%s, %s or %s)", InitDefaultString,
-			InitMinimalString, InitSingleOpString))
+			"heavy-weight it can be (%s, %s, %s or %s)", InitDefaultString,
+			InitMinimalString, InitSingleOpString, InitReadOnlyString))
 
 	return &params
 }
@@ -385,9 +650,10 @@ func makeKeyServer(config Config, keyserverAddr string,
 	return keyServer, nil
 }
 
-func makeBlockServer(config Config, bserverAddr string,
+func makeBlockServer(config Config, params InitParams,
 	rpcLogFactory rpc.LogFactory,
 	log logger.Logger) (BlockServer, error) {
+	bserverAddr := params.BServerAddr
 	if bserverAddr == memoryAddr {
 		log.Debug("Using in-memory bserver")
 		bserverLog := config.MakeLogger("BSM")
@@ -404,8 +670,18 @@ func makeBlockServer(config Config, bserverAddr string,
 		// local persistent block server
 		blockPath := filepath.Join(serverRootDir, "kbfs_block")
 		bserverLog := config.MakeLogger("BSD")
-		return NewBlockServerDir(config.Codec(),
-			bserverLog, blockPath), nil
+		bserv := NewBlockServerDir(config.Codec(), bserverLog, blockPath)
+		if params.BServerColdDir != "" {
+			log.Debug("Moving archived blocks to cold storage at %s",
+				params.BServerColdDir)
+			bserv.EnableColdTier(
+				NewColdBlockStoreDir(params.BServerColdDir),
+				ColdTierPolicy{
+					MinAge:   params.BServerColdAfter,
+					Interval: coldTierMigrationInterval,
+				})
+		}
+		return bserv, nil
 	}
 
 	remote, err := rpc.ParsePrioritizedRoundRobinRemote(bserverAddr)
@@ -436,6 +712,11 @@ func InitLogWithPrefix(
 	}
 
 	if params.LogFileConfig.Path != "" {
+		// Always rotate log files by size, unless explicitly told
+		// not to, so they can't fill up the disk.
+		if params.LogFileConfig.MaxSize == 0 {
+			params.LogFileConfig.MaxSize = defaultLogFileMaxSize
+		}
 		err = logger.SetLogFileConfig(&params.LogFileConfig)
 	}
 	log := logger.New(prefix)
@@ -562,10 +843,18 @@ func doInit(
 	case InitSingleOpString:
 		log.CDebugf(ctx, "Initializing in singleOp mode")
 		mode = InitSingleOp
+	case InitReadOnlyString:
+		log.CDebugf(ctx, "Initializing in readOnly mode")
+		mode = InitReadOnly
 	default:
 		return nil, fmt.Errorf("Unexpected mode: %s", params.Mode)
 	}
+	if params.Anonymous && mode != InitReadOnly {
+		return nil, fmt.Errorf(
+			"Anonymous use requires %s mode", InitReadOnlyString)
+	}
 
+	setDefaultDebugLogging(params.Debug)
 	config := NewConfigLocal(mode, func(module string) logger.Logger {
 		mname := logPrefix
 		if module != "" {
@@ -577,6 +866,8 @@ func doInit(
 			// style to be specified.
 			lg.Configure("", true, "")
 		}
+		// Let debugging be turned on and off at runtime, too.
+		registerLogModule(module, mname)
 		return lg
 	}, params.StorageRoot, params.DiskCacheMode, kbCtx)
 
@@ -588,6 +879,18 @@ func doInit(
 		config.BlockCache().SetCleanBytesCapacity(
 			params.CleanBlockCacheCapacity)
 	}
+	if params.AdaptiveBlockCache {
+		log.CDebugf(ctx, "Adapting the clean block cache capacity to "+
+			"memory pressure (max RSS %d)", params.MaxRSSBytes)
+		config.EnableAdaptiveBlockCache(params.MaxRSSBytes)
+	}
+	if params.TelemetryEndpoint != "" {
+		log.CDebugf(ctx, "Sending telemetry to %s every %s",
+			params.TelemetryEndpoint, params.TelemetryPeriod)
+		config.EnableTelemetry(
+			TelemetryHTTPSender{Endpoint: params.TelemetryEndpoint},
+			params.TelemetryPeriod)
+	}
 
 	workers := defaultBlockRetrievalWorkerQueueSize
 	prefetchWorkers := defaultPrefetchWorkerQueueSize
@@ -604,8 +907,13 @@ func doInit(
 	if err != nil {
 		return nil, err
 	}
+	bsplitter.inlineMaxSize = params.InlineFileMaxSize
 	config.SetBlockSplitter(bsplitter)
 
+	if params.KeyCacheTTL > 0 {
+		config.SetKeyCacheTTL(params.KeyCacheTTL)
+	}
+
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyCache := config.KeyCache()
 		keyCache = NewKeyCacheMeasured(keyCache, registry)
@@ -619,6 +927,48 @@ func doInit(
 	config.SetMetadataVersion(kbfsmd.MetadataVer(params.MetadataVersion))
 	config.SetTLFValidDuration(params.TLFValidDuration)
 	config.SetBGFlushPeriod(params.BGFlushPeriod)
+	config.SetTLFIdleEvictionTimeout(params.TLFIdleEvictionTimeout)
+	config.SetMaxOpenTLFs(params.MaxOpenTLFs)
+	config.SetAtimePolicy(params.AtimePolicy)
+	config.SetCRQuietPeriod(params.CRQuietPeriod)
+	config.SetLogRingBufferBytes(params.LogRingBufferKB * 1024)
+	config.SetConflictManifestEnabled(params.ConflictManifest)
+	crTextMergePolicy := CRTextMergePolicy{Enabled: params.CRTextMerge}
+	if params.CRTextMergeGlobs != "" {
+		crTextMergePolicy.Globs = strings.Split(params.CRTextMergeGlobs, ",")
+	}
+	config.SetCRTextMergePolicy(crTextMergePolicy)
+	tlfUsageAlertPolicy := TlfUsageAlertPolicy{
+		GrowthBytes:  params.TlfUsageGrowthBytes,
+		GrowthWindow: params.TlfUsageGrowthWindow,
+		ReportPeriod: params.TlfUsageReportPeriod,
+	}
+	if params.TlfUsageMarks != "" {
+		for _, m := range strings.Split(params.TlfUsageMarks, ",") {
+			mark, err := strconv.ParseUint(strings.TrimSpace(m), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -tlf-usage-marks: %v", err)
+			}
+			tlfUsageAlertPolicy.Marks = append(tlfUsageAlertPolicy.Marks, mark)
+		}
+	}
+	config.SetTlfUsageAlertPolicy(tlfUsageAlertPolicy)
+	config.SetUnmergedBranchRetention(params.UnmergedBranchRetention)
+	config.SetMDPutPipelining(params.MDPutPipelining)
+	config.SetHideOpDeviceInfo(params.HideOpDeviceInfo)
+	config.SetDiskCacheMmapReads(params.DiskCacheMmapReads)
+	config.SetStrictWriteVisibility(params.StrictWriteVisibility)
+	config.SetDirOpCoalescingWindow(tlf.NullID, params.DirOpCoalescingWindow)
+	if params.TuningProfile != "" {
+		err := config.SetTuningProfile(
+			tlf.NullID, TuningProfileName(params.TuningProfile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if params.ReadAheadBlocks > 0 {
+		config.SetDefaultReadAheadBlocks(params.ReadAheadBlocks)
+	}
 
 	kbfsOps := NewKBFSOpsStandard(config)
 	config.SetKBFSOps(kbfsOps)
@@ -637,6 +987,10 @@ func doInit(
 	if err != nil {
 		return nil, fmt.Errorf("problem creating service: %s", err)
 	}
+	if params.Anonymous {
+		log.CDebugf(ctx, "Initializing without a logged-in user")
+		service = keybaseServiceAnonymous{service}
+	}
 	if registry := config.MetricsRegistry(); registry != nil {
 		service = NewKeybaseServiceMeasured(service, registry)
 	}
@@ -676,7 +1030,7 @@ func doInit(
 
 	// Initialize BlockServer connection.
 	bserv, err := makeBlockServer(
-		config, params.BServerAddr, kbCtx.NewRPCLogFactory(), log)
+		config, params, kbCtx.NewRPCLogFactory(), log)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open block database: %+v", err)
 	}
@@ -722,7 +1076,8 @@ func doInit(
 	defer cancel()
 	// TODO: Don't turn on journaling if either -bserver or
 	// -mdserver point to local implementations.
-	if params.EnableJournal && config.Mode() != InitMinimal {
+	if params.EnableJournal && config.Mode() != InitMinimal &&
+		config.Mode() != InitReadOnly {
 		journalRoot := filepath.Join(params.StorageRoot, "kbfs_journal")
 		err = config.EnableJournaling(ctx10s, journalRoot,
 			params.TLFJournalBackgroundWorkStatus)
@@ -740,6 +1095,18 @@ func doInit(
 		params.BGFlushDirOpBatchSize)
 	config.SetBGFlushDirOpBatchSize(params.BGFlushDirOpBatchSize)
 
+	if config.Mode() == InitDefault {
+		if err := kbfsOps.ReportPendingChanges(ctx); err != nil {
+			log.CDebugf(ctx, "Couldn't report pending changes: %+v", err)
+		}
+		if err := kbfsOps.LoadFavoritesBundle(ctx); err != nil {
+			log.CDebugf(ctx, "Couldn't load the favorites bundle: %+v", err)
+		}
+		log.CDebugf(ctx, "Favorites prefetch mode: %s",
+			params.FavoritesPrefetch)
+		kbfsOps.PrefetchFavoritesInBackground(params.FavoritesPrefetch)
+	}
+
 	return config, nil
 }
 
@@ -0,0 +1,49 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/env"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestInitAnonymous(t *testing.T) {
+	ctx := context.Background()
+	tempdir, err := ioutil.TempDir(os.TempDir(), "init_anonymous")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+
+	kbCtx := env.NewContext()
+	params := DefaultInitParams(kbCtx)
+	params.BServerAddr = memoryAddr
+	params.MDServerAddr = memoryAddr
+	params.LocalUser = "strib"
+	params.LocalFavoriteStorage = memoryAddr
+	params.StorageRoot = tempdir
+	params.DiskCacheMode = DiskCacheModeOff
+	params.EnableJournal = false
+	params.Anonymous = true
+	log := logger.NewTestLogger(t)
+
+	t.Log("Anonymous use needs read-only mode")
+	_, err = doInit(ctx, kbCtx, params, nil, log, "kbfs")
+	require.Error(t, err)
+
+	params.Mode = InitReadOnlyString
+	config, err := doInit(ctx, kbCtx, params, nil, log, "kbfs")
+	require.NoError(t, err)
+	defer func() {
+		err := config.Shutdown(ctx)
+		require.NoError(t, err)
+	}()
+	_, err = config.KBPKI().GetCurrentSession(ctx)
+	require.IsType(t, NoCurrentSessionError{}, err)
+}
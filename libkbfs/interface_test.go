@@ -76,6 +76,25 @@ func (t *testSyncedTlfGetterSetter) SetTlfSyncState(tlfID tlf.ID,
 	return nil
 }
 
+type testTuningProfileGetter struct {
+	profiles map[tlf.ID]TuningProfile
+}
+
+var _ tuningProfileGetter = (*testTuningProfileGetter)(nil)
+
+func newTestTuningProfileGetter() *testTuningProfileGetter {
+	return &testTuningProfileGetter{
+		profiles: make(map[tlf.ID]TuningProfile),
+	}
+}
+
+func (t *testTuningProfileGetter) TuningProfile(tlfID tlf.ID) TuningProfile {
+	if p, ok := t.profiles[tlfID]; ok {
+		return p
+	}
+	return tuningProfiles[TuningProfileDefault]
+}
+
 type testInitModeGetter struct {
 	InitMode
 }
@@ -60,6 +60,12 @@ type signerGetter interface {
 	Signer() kbfscrypto.Signer
 }
 
+type tuningProfileGetter interface {
+	// TuningProfile returns the tuning profile in effect for the
+	// given TLF.
+	TuningProfile(tlfID tlf.ID) TuningProfile
+}
+
 type diskBlockCacheGetter interface {
 	DiskBlockCache() DiskBlockCache
 }
@@ -72,6 +78,14 @@ type clockGetter interface {
 	Clock() Clock
 }
 
+type metricsRegistryGetter interface {
+	// MetricsRegistry may be nil, which should be interpreted as
+	// not using metrics at all. (i.e., as if UseNilMetrics were
+	// set). This differs from how go-metrics treats nil Registry
+	// objects, which is to use the default registry.
+	MetricsRegistry() metrics.Registry
+}
+
 type diskLimiterGetter interface {
 	DiskLimiter() DiskLimiter
 }
@@ -214,6 +228,13 @@ type KBFSOps interface {
 
 	// GetTLFID gets the TLF ID for tlfHandle.
 	GetTLFID(ctx context.Context, tlfHandle *TlfHandle) (tlf.ID, error)
+	// RecoverFolderAccess lets the current device read the given
+	// private TLF when it hasn't been rekeyed for it, by decrypting
+	// the TLF's keys with another of the user's devices or a paper
+	// key (which the service prompts for).  The keys are only kept
+	// in the key cache, so a rekey is still needed for permanent
+	// access.
+	RecoverFolderAccess(ctx context.Context, tlfHandle *TlfHandle) error
 
 	// GetOrCreateRootNode returns the root node and root entry
 	// info associated with the given TLF handle and branch, if
@@ -235,6 +256,12 @@ type KBFSOps interface {
 	// permission for the top-level folder.  This is a remote-access
 	// operation.
 	GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error)
+	// GetDirChildrenWithNodes is like GetDirChildren, but also
+	// returns the Node for each child, saving the caller from doing
+	// a Lookup for every entry.  The Node is nil for symlinks.  This
+	// is a remote-access operation.
+	GetDirChildrenWithNodes(ctx context.Context, dir Node) (
+		map[string]DirChild, error)
 	// Lookup returns the Node and entry info associated with a
 	// given name in a directory, if the logged-in user has read
 	// permissions to the top-level folder.  The returned Node is nil
@@ -250,6 +277,23 @@ type KBFSOps interface {
 	// its new entry info.  This is a remote-sync operation.
 	CreateDir(ctx context.Context, dir Node, name string) (
 		Node, EntryInfo, error)
+	// CreatePath creates every missing directory along the
+	// slash-separated `path` under the given node, like `mkdir -p`,
+	// all in a single revision.  Returns the Node for the last
+	// directory in the path, and its entry info.  It's not an error
+	// if some or all of the directories already exist, but it is if
+	// any component of the path isn't a directory.  This is a
+	// remote-sync operation.
+	CreatePath(ctx context.Context, dir Node, path string) (
+		Node, EntryInfo, error)
+	// WriteFileAtomic replaces the contents of the file `name` in
+	// `dir` with `contents`, creating the file if needed, and syncs
+	// it.  If the write hits a conflict with another writer, it waits
+	// for conflict resolution, re-reads the file and writes it again
+	// if needed, so that `contents` ends up under `name` on the
+	// merged branch.  This is a remote-sync operation.
+	WriteFileAtomic(ctx context.Context, dir Node, name string,
+		contents []byte) (Node, EntryInfo, error)
 	// CreateFile creates a new file under the given node, if the
 	// logged-in user has write permission to the top-level folder.
 	// Returns the new Node for the created file, and its new
@@ -284,6 +328,17 @@ type KBFSOps interface {
 	// remote-sync operation.
 	Rename(ctx context.Context, oldParent Node, oldName string, newParent Node,
 		newName string) error
+	// CrossTlfMove moves the file or symlink `srcName` in
+	// `srcParent` to `dstName` in `dstParent`, which may be in a
+	// different top-level folder.  Within a single folder, this is
+	// just a Rename.  Otherwise, if the block server supports it and
+	// both folders share keys, the file's block references are
+	// transferred to the destination folder; if not, the file is
+	// copied and then removed from the source folder.  Unlike
+	// Rename, a move across folders is not atomic.  This is a
+	// remote-sync operation.
+	CrossTlfMove(ctx context.Context, srcParent Node, srcName string,
+		dstParent Node, dstName string) error
 	// Read fills in the given buffer with data from the file at the
 	// given node starting at the given offset, if the logged-in user
 	// has read permission to the top-level folder.  The read data
@@ -306,6 +361,14 @@ type KBFSOps interface {
 	// may or may not succeed as no-ops, depending on whether or not
 	// the necessary blocks have been locally cached.  This is a
 	// remote-access operation.
+	//
+	// Writes, truncates and preallocations of the same file take
+	// effect one at a time, in the order they were called, including
+	// while the file is being synced; a call that starts after
+	// another returns is never applied before it, and a read that
+	// starts after a write returns sees that write.  A call canceled
+	// while waiting for its turn has no effect; one canceled later
+	// may still take effect, but always before the calls after it.
 	Write(ctx context.Context, file Node, data []byte, off int64) error
 	// Truncate modifies the file at the given node, by either
 	// shrinking or extending its size to match the given size, if the
@@ -313,8 +376,15 @@ type KBFSOps interface {
 	// If extending the file, it pads the new data with 0s.  Truncates
 	// on an unlinked file may or may not succeed as no-ops, depending
 	// on whether or not the necessary blocks have been locally
-	// cached.  This is a remote-access operation.
+	// cached.  This is a remote-access operation.  Truncates are
+	// ordered with other changes to the file as described for Write.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// Preallocate extends the file at the given node to at least the
+	// given size, without uploading any data: large extensions are
+	// backed by holes.  It never shrinks the file, and fails if the
+	// extension would put the folder's owner over quota.  Like
+	// Truncate, the change is buffered until the next sync.
+	Preallocate(ctx context.Context, file Node, size uint64) error
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -325,6 +395,12 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// SetTimes sets any of the modification, access and creation
+	// times on the file or directory represented by a given node, if
+	// the logged-in user has write permissions to the top-level
+	// folder.  The ctime is set to now, unless `times.Ctime`
+	// overrides it.  This is a remote-sync operation.
+	SetTimes(ctx context.Context, file Node, times EntryTimes) error
 	// SyncAll flushes all outstanding writes and truncates for any
 	// dirty files to the KBFS servers within the given folder, if the
 	// logged-in user has write permissions to the top-level folder.
@@ -332,6 +408,33 @@ type KBFSOps interface {
 	// modifications done via multiple file handles.  This is a
 	// remote-sync operation.
 	SyncAll(ctx context.Context, folderBranch FolderBranch) error
+	// CancelSync aborts the block puts of any SyncAll in progress in
+	// the given folder.  The canceled SyncAll returns
+	// SyncCanceledError, and all of its changes stay dirty, to be
+	// synced again by the next SyncAll.  It's a no-op if no sync is
+	// in progress, or if the sync has already put all of its blocks.
+	CancelSync(ctx context.Context, folderBranch FolderBranch) error
+	// GetContentPolicy returns the content policy of the given
+	// folder, or nil if it has none.
+	GetContentPolicy(ctx context.Context, folderBranch FolderBranch) (
+		*TlfContentPolicy, error)
+	// SetContentPolicy changes the content policy of the given
+	// folder; nil removes it.  Only the folder's admins can change
+	// it.  Files that already break the new policy are left alone.
+	// This is a remote-sync operation.
+	SetContentPolicy(ctx context.Context, folderBranch FolderBranch,
+		policy *TlfContentPolicy) error
+	// GetTlfOpStats returns how much the given folder has been used
+	// through this device: cumulative and daily counts of reads,
+	// writes, bytes and distinct files touched.  It doesn't need the
+	// folder to be open, so it's cheap to call for every favorite.
+	GetTlfOpStats(ctx context.Context, folderBranch FolderBranch) (
+		TlfOpStats, error)
+	// DebugDump returns a JSON blob describing the state of the given
+	// folder, for attaching to bug reports: its status, unsynced
+	// local state, cache and conflict resolution state, lock wait
+	// times, and most recent log lines.  It contains no secrets.
+	DebugDump(ctx context.Context, folderBranch FolderBranch) ([]byte, error)
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
@@ -349,6 +452,19 @@ type KBFSOps interface {
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
 	UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error
+	// ForceResolveNow starts resolving this device's unmerged
+	// changes for the given folder-branch right away, rather than
+	// waiting for local writes to quiet down or for other folders'
+	// resolutions to finish.  It doesn't wait for the resolution to
+	// complete.  It's a no-op if the folder-branch isn't unmerged.
+	ForceResolveNow(ctx context.Context, folderBranch FolderBranch) error
+	// GetRetainedBranches returns the unmerged branches of the given
+	// folder-branch that were pruned recently enough to still be
+	// retained (see Config.UnmergedBranchRetention), oldest first.
+	// Each one can be browsed, read-only, by passing its name to
+	// GetRootNode.
+	GetRetainedBranches(ctx context.Context, folderBranch FolderBranch) (
+		[]RetainedBranchInfo, error)
 	// RequestRekey requests to rekey this folder. Note that this asynchronously
 	// requests a rekey, so canceling ctx doesn't cancel the rekey.
 	RequestRekey(ctx context.Context, id tlf.ID)
@@ -378,6 +494,16 @@ type KBFSOps interface {
 
 	// GetNodeMetadata gets metadata associated with a Node.
 	GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error)
+	// NodeToken returns a token for `node` that can be persisted,
+	// and later turned back into a Node with NodeFromToken, even by
+	// a new process.
+	NodeToken(ctx context.Context, node Node) (NodeToken, error)
+	// NodeFromToken returns a fresh Node for the node that `token`
+	// refers to, revalidated against the current head of its
+	// folder.  It returns a StaleNodeTokenError if the node no
+	// longer exists at the token's path.
+	NodeFromToken(ctx context.Context, token NodeToken) (
+		Node, EntryInfo, error)
 
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
@@ -396,6 +522,11 @@ type KBFSOps interface {
 	// newest version.  It works asynchronously, so no error is
 	// returned.
 	ForceFastForward(ctx context.Context)
+	// LockKeys drops all the decrypted TLF crypt keys KBFS has
+	// cached, e.g. when the device goes to sleep or its screen is
+	// locked.  The keys are decrypted again the next time they are
+	// needed.
+	LockKeys(ctx context.Context)
 	// TeamNameChanged indicates that a team has changed its name, and
 	// we should clean up any outstanding handle info associated with
 	// the team ID.
@@ -491,6 +622,11 @@ type KeybaseService interface {
 		desiredKeyGen kbfsmd.KeyGen, desiredUser keybase1.UserVersion,
 		desiredRole keybase1.TeamRole) (TeamInfo, error)
 
+	// IsCurrentUserTeamAdmin returns whether the logged-in user is
+	// an admin, or owner, of the given team.
+	IsCurrentUserTeamAdmin(ctx context.Context, tid keybase1.TeamID) (
+		bool, error)
+
 	// CurrentSession returns a SessionInfo struct with all the
 	// information for the current session, or an error otherwise.
 	CurrentSession(ctx context.Context, sessionID int) (SessionInfo, error)
@@ -733,6 +869,11 @@ type KeyMetadata interface {
 		kbfscrypto.EncryptedTLFCryptKeyClientHalf,
 		kbfscrypto.TLFCryptKeyServerHalfID, bool, error)
 
+	// GetLatestDataEncryptionVer returns the cipher to use for
+	// data encrypted with the latest key generation's TLF crypt
+	// key.
+	GetLatestDataEncryptionVer() (kbfscrypto.EncryptionVer, error)
+
 	// StoresHistoricTLFCryptKeys returns whether or not history keys are
 	// symmetrically encrypted; if not, they're encrypted per-device.
 	StoresHistoricTLFCryptKeys() bool
@@ -788,6 +929,13 @@ type KeyManager interface {
 	GetTLFCryptKeyOfAllGenerations(ctx context.Context, kmd KeyMetadata) (
 		keys []kbfscrypto.TLFCryptKey, err error)
 
+	// RecoverTLFCryptKeys decrypts the crypt keys of all generations
+	// using any of the current user's devices, prompting for a paper
+	// key if needed, and caches them.  This lets the current device
+	// read the TLF even if it hasn't been rekeyed for it yet, for as
+	// long as the keys stay cached.
+	RecoverTLFCryptKeys(ctx context.Context, kmd KeyMetadata) error
+
 	// Rekey checks the given MD object, if it is a private TLF,
 	// against the current set of device keys for all valid
 	// readers and writers.  If there are any new devices, it
@@ -825,6 +973,49 @@ type Reporter interface {
 	Shutdown()
 }
 
+// ActivityNotifier is told about the changes made to the TLFs this
+// client has open, so that a deployment can post summaries of them
+// somewhere else, such as a chat channel or a webhook.  Changes are
+// collected into a digest per TLF before being sent, so a busy folder
+// results in one call per digest period rather than one per write.
+type ActivityNotifier interface {
+	// NotifyTlfActivity is called, from a background goroutine, with
+	// a digest of the recent changes to one TLF.
+	NotifyTlfActivity(ctx context.Context, digest TlfActivityDigest) error
+}
+
+// WriteChunk is a range of plaintext data written to a file.
+type WriteChunk struct {
+	Off  int64
+	Data []byte
+}
+
+// WriteVerdict is a WriteInterceptor's decision about the data
+// written to a file.
+type WriteVerdict struct {
+	// Reject, if non-empty, fails the sync with a WriteRejectedError
+	// giving this reason.  The data stays dirty, and every later sync
+	// of the file fails the same way until it's rewritten or removed.
+	Reject string
+	// Tags are merged into the file's write tags, which are shown as
+	// extended attributes by the mounts that support them.  An empty
+	// value removes a tag.
+	Tags map[string]string
+}
+
+// WriteInterceptor is an optional hook that sees the plaintext of
+// the data written to each file, such as for virus or malware
+// scanning, before that data is encrypted and put.
+type WriteInterceptor interface {
+	// InterceptWrite is called during the sync of `file`, with the
+	// data written to it since its last sync.  It's called while the
+	// folder's block lock is held, so it should be quick.  The
+	// chunks' data must not be modified or kept after it returns.
+	// An error fails the sync, just like a rejection does.
+	InterceptWrite(ctx context.Context, file string, chunks []WriteChunk) (
+		WriteVerdict, error)
+}
+
 // MDCache gets and puts plaintext top-level metadata into the cache.
 type MDCache interface {
 	// Get gets the metadata object associated with the given TLF ID,
@@ -856,6 +1047,9 @@ type MDCache interface {
 	// ChangeHandleForID moves an ID to be under a new handle, if the
 	// ID is cached already.
 	ChangeHandleForID(oldHandle *TlfHandle, newHandle *TlfHandle)
+	// ClearTLF drops all the cached metadata objects for the given
+	// TLF, and any handles cached for its ID.
+	ClearTLF(tlfID tlf.ID)
 }
 
 // KeyCache handles caching for both TLFCryptKeys and BlockCryptKeys.
@@ -864,6 +1058,11 @@ type KeyCache interface {
 	GetTLFCryptKey(tlf.ID, kbfsmd.KeyGen) (kbfscrypto.TLFCryptKey, error)
 	// PutTLFCryptKey stores the crypt key for the given TLF.
 	PutTLFCryptKey(tlf.ID, kbfsmd.KeyGen, kbfscrypto.TLFCryptKey) error
+	// Clear drops all the cached keys, zeroing them out.
+	Clear()
+	// ClearTLF drops all the cached keys for the given TLF, zeroing
+	// them out.
+	ClearTLF(tlfID tlf.ID)
 }
 
 // BlockCacheLifetime denotes the lifetime of an entry in BlockCache.
@@ -945,12 +1144,18 @@ type BlockCache interface {
 		lifetime BlockCacheLifetime, prefetchStatus PrefetchStatus) error
 
 	// SetCleanBytesCapacity atomically sets clean bytes capacity for block
-	// cache.
+	// cache.  If the capacity shrinks, transient blocks are evicted
+	// until the cache fits.
 	SetCleanBytesCapacity(capacity uint64)
 
 	// GetCleanBytesCapacity atomically gets clean bytes capacity for block
 	// cache.
 	GetCleanBytesCapacity() (capacity uint64)
+
+	// ClearTLF removes all the transient entries, and cached IDs,
+	// that were put for the given TLF.  Permanent entries aren't
+	// tracked by TLF, and are left alone.
+	ClearTLF(tlfID tlf.ID)
 }
 
 // DirtyPermChan is a channel that gets closed when the holder has
@@ -1101,10 +1306,12 @@ type cryptoPure interface {
 		encryptedPMD kbfscrypto.EncryptedPrivateMetadata,
 		key kbfscrypto.TLFCryptKey) (PrivateMetadata, error)
 
-	// EncryptBlocks encrypts a block. plainSize is the size of the encoded
-	// block; EncryptBlock() must guarantee that plainSize <=
+	// EncryptBlocks encrypts a block with the cipher given by
+	// encVer. plainSize is the size of the encoded block;
+	// EncryptBlock() must guarantee that plainSize <=
 	// len(encryptedBlock).
-	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
+	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey,
+		encVer kbfscrypto.EncryptionVer) (
 		plainSize int, encryptedBlock kbfscrypto.EncryptedBlock, err error)
 
 	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
@@ -1609,6 +1816,21 @@ type BlockServer interface {
 		info *kbfsblock.QuotaInfo, err error)
 }
 
+// BlockRefTransferer is implemented by block servers that can move
+// block references from one TLF to another, so that the blocks don't
+// have to be uploaded again.  Blocks stay encrypted with the keys of
+// the TLF they were put to, so references must only be transferred
+// between TLFs that share keys.
+type BlockRefTransferer interface {
+	// TransferBlockReferences moves the given references from
+	// `fromTlfID` to `toTlfID`.  Each block must have no other
+	// references in `fromTlfID`, or nothing is transferred.  Once
+	// the references have been transferred, removing or archiving
+	// them in `fromTlfID` does nothing.
+	TransferBlockReferences(ctx context.Context, fromTlfID, toTlfID tlf.ID,
+		contexts kbfsblock.ContextMap) error
+}
+
 // blockServerLocal is the interface for BlockServer implementations
 // that store data locally.
 type blockServerLocal interface {
@@ -1619,6 +1841,17 @@ type blockServerLocal interface {
 		map[kbfsblock.ID]blockRefMap, error)
 }
 
+// blockRefTransfererLocal is the interface for local BlockServer
+// implementations that can also transfer block references.
+type blockRefTransfererLocal interface {
+	blockServerLocal
+	// getTransferredIDsForTest returns the IDs of all the blocks
+	// whose references were transferred out of the given TLF, and
+	// should only be used during testing.
+	getTransferredIDsForTest(ctx context.Context, tlfID tlf.ID) (
+		map[kbfsblock.ID]bool, error)
+}
+
 // BlockSplitter decides when a file or directory block needs to be split
 type BlockSplitter interface {
 	// CopyUntilSplit copies data into the block until we reach the
@@ -1643,6 +1876,12 @@ type BlockSplitter interface {
 	// ShouldEmbedBlockChanges decides whether we should keep the
 	// block changes embedded in the MD or not.
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
+
+	// ShouldInlineFile decides whether a file of the given size,
+	// held in a single direct block, should have its contents
+	// inlined into its directory entry instead of being put as a
+	// block of its own.
+	ShouldInlineFile(size int64) bool
 }
 
 // KeyServer fetches/writes server-side key halves from/to the key server.
@@ -1702,6 +1941,27 @@ type Observer interface {
 	TlfHandleChange(ctx context.Context, newHandle *TlfHandle)
 }
 
+// ConflictObserver can optionally be implemented by an Observer that
+// also wants to hear about the conflicted copies made by conflict
+// resolution.  The same rules apply as for Observer callbacks.
+type ConflictObserver interface {
+	// ConflictedCopiesCreated announces that a conflict resolution
+	// has been completed, and has created the given conflicted
+	// copies.
+	ConflictedCopiesCreated(ctx context.Context, copies []ConflictedCopy)
+}
+
+// AccessRevokedObserver can optionally be implemented by an Observer
+// that also wants to hear when the logged-in user loses read access
+// to a folder.  The same rules apply as for Observer callbacks.
+type AccessRevokedObserver interface {
+	// AccessRevoked announces that the logged-in user can no longer
+	// read the folder with the given handle, and that its cached
+	// keys, metadata and blocks have been purged.  Any further
+	// access to the folder will fail with a ReadAccessError.
+	AccessRevoked(ctx context.Context, handle *TlfHandle)
+}
+
 // Notifier notifies registrants of directory changes
 type Notifier interface {
 	// RegisterForChanges declares that the given Observer wants to
@@ -1775,6 +2035,18 @@ type Config interface {
 	SetKeyManager(KeyManager)
 	Reporter() Reporter
 	SetReporter(Reporter)
+	// ActivityNotifier returns the notifier for TLF activity
+	// digests, or nil if there is none.
+	ActivityNotifier() ActivityNotifier
+	// SetActivityNotifier sets the notifier for TLF activity
+	// digests; nil turns them off.
+	SetActivityNotifier(ActivityNotifier)
+	// WriteInterceptor returns the hook that sees data written to
+	// files before it's synced, or nil if there is none.
+	WriteInterceptor() WriteInterceptor
+	// SetWriteInterceptor sets the hook that sees data written to
+	// files before it's synced; nil, the default, turns it off.
+	SetWriteInterceptor(WriteInterceptor)
 	MDCache() MDCache
 	SetMDCache(MDCache)
 	KeyCache() KeyCache
@@ -1867,11 +2139,7 @@ type Config interface {
 	// StorageRoot returns the path to the storage root for this config.
 	StorageRoot() string
 
-	// MetricsRegistry may be nil, which should be interpreted as
-	// not using metrics at all. (i.e., as if UseNilMetrics were
-	// set). This differs from how go-metrics treats nil Registry
-	// objects, which is to use the default registry.
-	MetricsRegistry() metrics.Registry
+	metricsRegistryGetter
 	SetMetricsRegistry(metrics.Registry)
 
 	// SetTraceOptions set the options for tracing (via x/net/trace).
@@ -1896,6 +2164,139 @@ type Config interface {
 	// before syncing a set of changes to the servers.
 	SetBGFlushPeriod(p time.Duration)
 
+	// TLFIdleEvictionTimeout returns how long a folder-branch can go
+	// without being accessed before its in-memory state is shut down
+	// and evicted.  Zero means folder-branches are never evicted.
+	TLFIdleEvictionTimeout() time.Duration
+	// SetTLFIdleEvictionTimeout sets how long a folder-branch can go
+	// without being accessed before its in-memory state is shut down
+	// and evicted.
+	SetTLFIdleEvictionTimeout(d time.Duration)
+
+	// AtimePolicy returns when reads update the access times of
+	// files.
+	AtimePolicy() AtimePolicy
+	// SetAtimePolicy sets when reads update the access times of
+	// files.
+	SetAtimePolicy(p AtimePolicy)
+
+	// MaxOpenTLFs returns how many folder-branches may have their
+	// in-memory state instantiated at once; past that, the least
+	// recently used idle ones are shut down and evicted.  Zero means
+	// there is no limit.
+	MaxOpenTLFs() int
+	// SetMaxOpenTLFs sets how many folder-branches may have their
+	// in-memory state instantiated at once.
+	SetMaxOpenTLFs(n int)
+
+	// KeyCacheTTL returns how long a decrypted TLF crypt key may
+	// stay in the key cache before it must be decrypted again.  Zero
+	// means keys only leave the cache when they're evicted or
+	// explicitly dropped.
+	KeyCacheTTL() time.Duration
+	// SetKeyCacheTTL sets how long a decrypted TLF crypt key may stay
+	// in the key cache, and replaces the current key cache with an
+	// empty one that uses the new TTL.
+	SetKeyCacheTTL(d time.Duration)
+
+	// CRQuietPeriod returns how long a folder must go without local
+	// writes before conflict resolution starts on it.  Zero means
+	// conflict resolution starts right away.
+	CRQuietPeriod() time.Duration
+	// SetCRQuietPeriod sets how long a folder must go without local
+	// writes before conflict resolution starts on it.
+	SetCRQuietPeriod(d time.Duration)
+
+	// LogRingBufferBytes returns how many bytes of recent log lines
+	// are kept in memory for each folder, for debug dumps.  Zero
+	// means none are kept.
+	LogRingBufferBytes() int
+	// SetLogRingBufferBytes sets how many bytes of recent log lines
+	// are kept in memory for each folder opened from now on.
+	SetLogRingBufferBytes(n int)
+
+	// ConflictManifestEnabled returns whether conflict resolution
+	// records the conflicted copies it creates in a manifest file in
+	// the root of each TLF (see ConflictManifestName).
+	ConflictManifestEnabled() bool
+	// SetConflictManifestEnabled sets whether conflict resolution
+	// records the conflicted copies it creates in a manifest file.
+	SetConflictManifestEnabled(enabled bool)
+
+	// CRTextMergePolicy returns the policy for merging conflicting
+	// writes to text files during conflict resolution.
+	CRTextMergePolicy() CRTextMergePolicy
+	// SetCRTextMergePolicy sets the policy for merging conflicting
+	// writes to text files during conflict resolution.
+	SetCRTextMergePolicy(p CRTextMergePolicy)
+
+	// TlfUsageAlertPolicy returns the policy for warning about TLF
+	// growth, and for writing periodic usage reports into TLFs.
+	TlfUsageAlertPolicy() TlfUsageAlertPolicy
+	// SetTlfUsageAlertPolicy sets the policy for warning about TLF
+	// growth, and for writing periodic usage reports into TLFs.  It
+	// only affects TLFs opened afterwards.
+	SetTlfUsageAlertPolicy(p TlfUsageAlertPolicy)
+
+	// UnmergedBranchRetention returns how long local unmerged
+	// branches are kept around, for recovery, after conflict
+	// resolution or unstaging prunes them.  Zero means they aren't
+	// kept.
+	UnmergedBranchRetention() time.Duration
+	// SetUnmergedBranchRetention sets how long pruned unmerged
+	// branches are kept around.
+	SetUnmergedBranchRetention(d time.Duration)
+
+	// MDPutPipelining returns whether a folder may prepare its next
+	// MD revision while the put of the previous one is still waiting
+	// on the MD server.
+	MDPutPipelining() bool
+	// SetMDPutPipelining sets whether MD puts may be pipelined.
+	SetMDPutPipelining(enabled bool)
+
+	// HideOpDeviceInfo returns whether the device KID and client
+	// version should be left out of the ops this client writes.
+	HideOpDeviceInfo() bool
+	// SetHideOpDeviceInfo sets whether written ops omit the device
+	// KID and client version.
+	SetHideOpDeviceInfo(hide bool)
+
+	// DiskCacheMmapReads returns whether a local disk block cache
+	// stores large blocks in their own files, and maps them rather
+	// than copying them when they're read.
+	DiskCacheMmapReads() bool
+	// SetDiskCacheMmapReads sets whether the disk block cache maps
+	// large blocks.  It only affects disk block caches created
+	// afterwards.
+	SetDiskCacheMmapReads(enabled bool)
+
+	// StrictWriteVisibility returns whether a read of a file that's
+	// in the middle of being synced waits until the sync is done, so
+	// that it sees either all of the file's state from before the
+	// sync started or all of it from after, never a mix.
+	StrictWriteVisibility() bool
+	// SetStrictWriteVisibility sets whether reads wait for in-flight
+	// syncs of the file being read.
+	SetStrictWriteVisibility(enabled bool)
+
+	// DirOpCoalescingWindow returns how long the given TLF waits
+	// after a directory operation for more to arrive, before
+	// syncing them together in a single MD revision.  Zero means
+	// directory operations are only batched according to
+	// BGFlushDirOpBatchSize and BGFlushPeriod.
+	DirOpCoalescingWindow(tlfID tlf.ID) time.Duration
+	// SetDirOpCoalescingWindow sets the coalescing window for the
+	// given TLF, or the default for all TLFs if `tlfID` is
+	// tlf.NullID.
+	SetDirOpCoalescingWindow(tlfID tlf.ID, d time.Duration)
+
+	tuningProfileGetter
+	// SetTuningProfile switches the given TLF to the named tuning
+	// profile, or switches the default profile for all TLFs without
+	// their own if `tlfID` is tlf.NullID.  It takes effect right
+	// away.
+	SetTuningProfile(tlfID tlf.ID, name TuningProfileName) error
+
 	// Shutdown is called to free config resources.
 	Shutdown(context.Context) error
 	// CheckStateOnShutdown tells the caller whether or not it is safe
@@ -1918,7 +2319,7 @@ type Config interface {
 // NodeCache holds Nodes, and allows libkbfs to update them when
 // things change about the underlying KBFS blocks.  It is probably
 // most useful to instantiate this on a per-folder-branch basis, so
-// that it can create a Path with the correct DirId and Branch name.
+// that it can create a path with the correct TLF ID and branch name.
 type NodeCache interface {
 	// GetOrCreate either makes a new Node for the given
 	// BlockPointer, or returns an existing one. TODO: If we ever
@@ -1940,7 +2341,9 @@ type NodeCache interface {
 	// completely. If successful, it returns a function that can be
 	// called to undo the effect of the move (or `nil` if nothing
 	// needs to be done); if newParent cannot be found, it returns an
-	// error and a `nil` undo function.
+	// error and a `nil` undo function.  Only the moved node itself is
+	// touched; the paths of its descendants pick up the move the
+	// next time they're resolved, so moving a large subtree is cheap.
 	Move(ref BlockRef, newParent Node, newName string) (
 		undoFn func(), err error)
 	// Unlink set the corresponding node's parent to nil and caches
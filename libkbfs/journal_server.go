@@ -139,6 +139,10 @@ type JournalServer struct {
 	dirtyOps            uint
 	dirtyOpsDone        *sync.Cond
 	serverConfig        journalServerConfig
+
+	// crypter encrypts the journals of the current device; it's
+	// set along with currentVerifyingKey.
+	crypter *localStorageCrypter
 }
 
 func makeJournalServer(
@@ -337,10 +341,18 @@ func (j *JournalServer) EnableExistingJournals(
 		return err
 	}
 
+	// The journals are encrypted with a key derived from the
+	// current device's signing key.
+	localStorageKey, err := deriveLocalStorageKey(ctx, j.config.Crypto())
+	if err != nil {
+		return err
+	}
+
 	// Need to set it here since tlfJournalPathLocked and
 	// enableLocked depend on it.
 	j.currentUID = currentUID
 	j.currentVerifyingKey = currentVerifyingKey
+	j.crypter = makeLocalStorageCrypter(localStorageKey)
 
 	enableSucceeded := false
 	defer func() {
@@ -531,7 +543,8 @@ func (j *JournalServer) enableLocked(
 		ctx, j.currentUID, j.currentVerifyingKey, tlfDir,
 		tlfID, chargedTo, tlfJournalConfigAdapter{j.config},
 		j.delegateBlockServer,
-		bws, nil, j.onBranchChange, j.onMDFlush, j.config.DiskLimiter())
+		bws, nil, j.onBranchChange, j.onMDFlush, j.config.DiskLimiter(),
+		j.crypter)
 	if err != nil {
 		return nil, err
 	}
@@ -885,6 +898,7 @@ func (j *JournalServer) shutdownExistingJournalsLocked(ctx context.Context) {
 	j.tlfJournals = make(map[tlf.ID]*tlfJournal)
 	j.currentUID = keybase1.UID("")
 	j.currentVerifyingKey = kbfscrypto.VerifyingKey{}
+	j.crypter = nil
 }
 
 // shutdownExistingJournals shuts down all write journals, sets the
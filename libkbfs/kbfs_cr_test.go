@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"encoding/json"
 	"os"
 	"sync"
 	"testing"
@@ -768,6 +769,479 @@ func TestBasicCRFileConflict(t *testing.T) {
 	require.Equal(t, children1, children2)
 }
 
+type testConflictObserver struct {
+	testCRObserver
+	lock   sync.Mutex
+	copies []ConflictedCopy
+}
+
+func (t *testConflictObserver) BatchChanges(ctx context.Context,
+	changes []NodeChange) {
+	// ignore
+}
+
+func (t *testConflictObserver) ConflictedCopiesCreated(
+	ctx context.Context, copies []ConflictedCopy) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.copies = append(t.copies, copies...)
+}
+
+// blockUnmergedWritesOnNextCR makes the next resolution of `fb`
+// block unmerged writes while it runs, as it does after repeated
+// failures to resolve.
+func blockUnmergedWritesOnNextCR(config Config, fb FolderBranch) {
+	ops := getOps(config, fb.Tlf)
+	ops.cr.inputLock.Lock()
+	defer ops.cr.inputLock.Unlock()
+	ops.cr.lockNextTime = true
+}
+
+// Tests that a file conflict is announced to observers, and recorded
+// in the conflict manifest.
+func TestCRFileConflictManifest(t *testing.T) {
+	testCRFileConflictManifest(t, false)
+}
+
+// Tests that the conflict manifest is recorded even when the
+// resolution blocks unmerged writes while it runs.
+func TestCRFileConflictManifestBlockingWrites(t *testing.T) {
+	testCRFileConflictManifest(t, true)
+}
+
+func testCRFileConflictManifest(t *testing.T, blockWrites bool) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetConflictManifestEnabled(true)
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	obs := &testConflictObserver{}
+	err = config2.Notifier().RegisterForChanges(
+		[]FolderBranch{rootNode2.GetFolderBranch()}, obs)
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Both users write the file
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1, 2, 3, 4, 5}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte{5, 4, 3, 2, 1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	if blockWrites {
+		blockUnmergedWritesOnNextCR(config2, rootNode2.GetFolderBranch())
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	// Let the resolution, including its manifest write, finish
+	// before syncing, so the sync doesn't race with the manifest's
+	// first write.
+	err = getOps(config2, rootNode2.GetFolderBranch().Tlf).cr.Wait(ctx)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx,
+		rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+
+	cre := WriterDeviceDateConflictRenamer{}
+	expectedCopy := ConflictedCopy{
+		OriginalPath: "a/b",
+		CopyPath:     "a/" + cre.ConflictRenameHelper(now, "u2", "dev1", "b"),
+	}
+	func() {
+		obs.lock.Lock()
+		defer obs.lock.Unlock()
+		require.Equal(t, []ConflictedCopy{expectedCopy}, obs.copies)
+	}()
+
+	// The manifest is readable by the other user.
+	err = kbfsOps1.SyncFromServerForTesting(ctx,
+		rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	manifestNode, ei, err := kbfsOps1.Lookup(
+		ctx, rootNode1, ConflictManifestName)
+	require.NoError(t, err)
+	buf := make([]byte, ei.Size)
+	_, err = kbfsOps1.Read(ctx, manifestNode, buf, 0)
+	require.NoError(t, err)
+	var manifest conflictManifest
+	err = json.Unmarshal(buf, &manifest)
+	require.NoError(t, err)
+	require.Len(t, manifest.Conflicts, 1)
+	require.Equal(t, expectedCopy.OriginalPath,
+		manifest.Conflicts[0].Original)
+	require.Equal(t, expectedCopy.CopyPath, manifest.Conflicts[0].Copy)
+}
+
+// Tests that non-overlapping writes to a text file are merged when
+// the text merge policy is on, rather than making a conflicted copy.
+func TestCRFileConflictTextMerge(t *testing.T) {
+	testCRFileConflictTextMerge(t, false)
+}
+
+// Tests that a text conflict is still merged when the resolution
+// blocks unmerged writes while it runs.
+func TestCRFileConflictTextMergeBlockingWrites(t *testing.T) {
+	testCRFileConflictTextMerge(t, true)
+}
+
+func testCRFileConflictTextMerge(t *testing.T, blockWrites bool) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetCRTextMergePolicy(CRTextMergePolicy{Enabled: true})
+
+	config2.SetClock(newTestClockNow())
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a text file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	base := []byte("one\ntwo\nthree\n")
+	err = kbfsOps1.Write(ctx, fileB1, base, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// user1 changes the first line, while user2 appends a line.
+	err = kbfsOps1.Write(ctx, fileB1, []byte("ONE\n"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte("four\n"), int64(len(base)))
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	if blockWrites {
+		blockUnmergedWritesOnNextCR(config2, rootNode2.GetFolderBranch())
+	}
+
+	// re-enable updates, and wait for CR, including the merge, to
+	// complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = getOps(config2, rootNode2.GetFolderBranch().Tlf).cr.Wait(ctx)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx,
+		rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+
+	// Both users see a single file with both changes.
+	err = kbfsOps1.SyncFromServerForTesting(ctx,
+		rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	expected := []byte("ONE\ntwo\nthree\nfour\n")
+	checkMerged := func(kbfsOps KBFSOps, dir Node) {
+		children, err := kbfsOps.GetDirChildren(ctx, dir)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		require.Contains(t, children, "b")
+		fileB, ei, err := kbfsOps.Lookup(ctx, dir, "b")
+		require.NoError(t, err)
+		buf := make([]byte, ei.Size)
+		_, err = kbfsOps.Read(ctx, fileB, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf)
+	}
+	checkMerged(kbfsOps1, dirA1)
+	checkMerged(kbfsOps2, dirA2)
+}
+
+// Tests that an unmerged branch discarded by unstaging is retained,
+// and can be browsed read-only until it expires.
+func TestUnstagedBranchRetention(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetUnmergedBranchRetention(time.Hour)
+
+	clock, _ := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Both users write the file, making user 2 unmerged.
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+	unmergedData := []byte{3, 2, 1}
+	err = kbfsOps2.Write(ctx, fileB2, unmergedData, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Throw away user 2's changes.
+	c <- struct{}{}
+	err = kbfsOps2.UnstageForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	branches, err := kbfsOps2.GetRetainedBranches(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, branches, 1)
+	require.False(t, branches[0].Resolved)
+
+	// The discarded data is still readable on the retained branch.
+	h, err := ParseTlfHandle(
+		ctx, config2.KBPKI(), config2.MDOps(), name, tlf.Private)
+	require.NoError(t, err)
+	retainedRoot, _, err := kbfsOps2.GetRootNode(ctx, h, branches[0].Name)
+	require.NoError(t, err)
+	retainedDirA, _, err := kbfsOps2.Lookup(ctx, retainedRoot, "a")
+	require.NoError(t, err)
+	retainedFileB, ei, err := kbfsOps2.Lookup(ctx, retainedDirA, "b")
+	require.NoError(t, err)
+	buf := make([]byte, ei.Size)
+	_, err = kbfsOps2.Read(ctx, retainedFileB, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, unmergedData, buf)
+
+	// But it can't be written.
+	err = kbfsOps2.Write(ctx, retainedFileB, []byte{4}, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, err)
+
+	// Once the retention period is over, the branch is gone.
+	clock.Add(time.Hour)
+	branches, err = kbfsOps2.GetRetainedBranches(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, branches, 0)
+}
+
+// Tests that a pipelined MD put that conflicts gets rolled back to an
+// unmerged branch, which then gets resolved.
+func TestCRPipelinedMDPutConflict(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetMDPutPipelining(true)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a dir in a shared TLF
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	mdserver := newHeldPutMDServer(config2.MDServer())
+	config2.SetMDServer(mdserver)
+
+	// user2's put gets held after it becomes user2's head.
+	_, _, err = kbfsOps2.CreateFile(ctx, dirA2, "b", false, NoExcl)
+	require.NoError(t, err)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	}()
+	select {
+	case <-mdserver.held:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	// Meanwhile user1 takes the same revision.
+	_, _, err = kbfsOps1.CreateFile(ctx, dirA1, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// user2's sync still succeeds, on an unmerged branch.
+	close(mdserver.release)
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+
+	for _, kbfsOps := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		dir := dirA1
+		if kbfsOps == kbfsOps2 {
+			dir = dirA2
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, dir)
+		require.NoError(t, err)
+		require.Len(t, children, 2)
+		require.Contains(t, children, "b")
+		require.Contains(t, children, "c")
+	}
+}
+
+// Tests that WriteFileAtomic re-applies a whole-file write that lost
+// to a conflicting write from another user.
+func TestCRWriteFileAtomicConflict(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// user2 doesn't hear about user1's write before making its own.
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	_, _, err = kbfsOps1.WriteFileAtomic(ctx, dirA1, "f", []byte("one"))
+	require.NoError(t, err)
+
+	_, ei, err := kbfsOps2.WriteFileAtomic(ctx, dirA2, "f", []byte("two"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ei.Size)
+	c <- struct{}{}
+
+	err = kbfsOps1.SyncFromServerForTesting(
+		ctx, rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+
+	// user2's contents win, since it wrote last.
+	for _, kbfsOps := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		dir := dirA1
+		if kbfsOps == kbfsOps2 {
+			dir = dirA2
+		}
+		fileNode, ei, err := kbfsOps.Lookup(ctx, dir, "f")
+		require.NoError(t, err)
+		buf := make([]byte, ei.Size)
+		_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, "two", string(buf))
+	}
+}
+
 // Tests that two users can create the same file simultaneously, and
 // the unmerged user can write to it, and they will be merged into a
 // single file.
@@ -1298,7 +1772,7 @@ func TestCRSyncParallelBlocksErrorCleanup(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config1.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -6,15 +6,19 @@ package libkbfs
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/kbfssync"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -27,7 +31,16 @@ type KBFSOpsStandard struct {
 	deferLog logger.Logger
 	ops      map[FolderBranch]*folderBranchOps
 	opsByFav map[Favorite]*folderBranchOps
-	opsLock  sync.RWMutex
+	// opsRefs counts the outstanding holds on each folder-branch;
+	// held folder-branches are never evicted for idleness.
+	opsRefs map[FolderBranch]int
+	// evictedOps holds the folder-branches that have been evicted
+	// and not yet re-opened, for measuring how long re-opening takes.
+	evictedOps map[FolderBranch]bool
+	opsLock    sync.RWMutex
+	// evictLRUOpsCh is signaled whenever more folder-branches are
+	// instantiated than Config.MaxOpenTLFs allows.
+	evictLRUOpsCh chan struct{}
 	// reIdentifyControlChan controls reidentification.
 	// Sending a value to this channel forces all fbos
 	// to be marked for revalidation.
@@ -40,12 +53,41 @@ type KBFSOpsStandard struct {
 	currentStatus            kbfsCurrentStatus
 	quotaUsage               *EventuallyConsistentQuotaUsage
 	longOperationDebugDumper *ImpatientDebugDumper
+	// crLimiter bounds the number of conflict resolutions that can
+	// run at once across all folder-branches.
+	crLimiter *kbfssync.Semaphore
+	// retained holds the unmerged branches that were pruned
+	// recently, for recovery.
+	retained *retainedBranches
+
+	shutdownLock sync.Mutex
+	shutdown     bool
+	shutdownChan chan struct{}
 }
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
 
 const longOperationDebugDumpDuration = time.Minute
 
+// idleOpsCheckPeriod is how often KBFSOpsStandard looks for idle
+// folder-branches to evict, when eviction is enabled.
+const idleOpsCheckPeriod = time.Minute
+
+// lruOpsMinIdle is how long a folder-branch must go unaccessed
+// before it can be evicted to stay under Config.MaxOpenTLFs, so
+// that ops that are just being opened aren't evicted out from under
+// their callers.
+const lruOpsMinIdle = 10 * time.Second
+
+const (
+	// opsEvictionsMeterName counts the folder-branches evicted for
+	// idleness or to stay under Config.MaxOpenTLFs.
+	opsEvictionsMeterName = "KBFSOps.OpsEvictions"
+	// opsReopenTimerName times getting the root node of a TLF whose
+	// folder-branch had been evicted.
+	opsReopenTimerName = "KBFSOps.OpsReopen"
+)
+
 // NewKBFSOpsStandard constructs a new KBFSOpsStandard object.
 func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 	log := config.MakeLogger("")
@@ -55,14 +97,22 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		deferLog:              log.CloneWithAddedDepth(1),
 		ops:                   make(map[FolderBranch]*folderBranchOps),
 		opsByFav:              make(map[Favorite]*folderBranchOps),
+		opsRefs:               make(map[FolderBranch]int),
+		evictedOps:            make(map[FolderBranch]bool),
+		evictLRUOpsCh:         make(chan struct{}, 1),
 		reIdentifyControlChan: make(chan chan<- struct{}),
+		shutdownChan:          make(chan struct{}),
 		favs:       NewFavorites(config),
 		quotaUsage: NewEventuallyConsistentQuotaUsage(config, "KBFSOps"),
 		longOperationDebugDumper: NewImpatientDebugDumper(
 			config, longOperationDebugDumpDuration),
 	}
 	kops.currentStatus.Init()
+	kops.crLimiter = kbfssync.NewSemaphore()
+	kops.crLimiter.Release(crMaxConcurrentDefault)
+	kops.retained = newRetainedBranches()
 	go kops.markForReIdentifyIfNeededLoop()
+	go kops.evictIdleOpsLoop()
 	return kops
 }
 
@@ -108,20 +158,348 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeeded(
 	}
 }
 
+func (fs *KBFSOpsStandard) evictIdleOpsLoop() {
+	ticker := time.NewTicker(idleOpsCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := fs.config.Clock().Now()
+			if timeout := fs.config.TLFIdleEvictionTimeout(); timeout > 0 {
+				fs.evictIdleOps(context.Background(), now, timeout)
+			}
+			// Catch up on any LRU evictions that couldn't be done
+			// earlier, because the ops weren't idle yet.
+			if max := fs.config.MaxOpenTLFs(); max > 0 {
+				fs.evictLRUOps(context.Background(), now, max)
+			}
+		case <-fs.evictLRUOpsCh:
+			if max := fs.config.MaxOpenTLFs(); max > 0 {
+				fs.evictLRUOps(
+					context.Background(), fs.config.Clock().Now(), max)
+			}
+		case <-fs.shutdownChan:
+			return
+		}
+	}
+}
+
+// evictionCandidates returns the folder-branches that aren't held
+// by anyone, along with the favorites under which each ops is
+// tracked.
+func (fs *KBFSOpsStandard) evictionCandidates(now time.Time) (
+	ops map[FolderBranch]*folderBranchOps,
+	favsByOps map[*folderBranchOps][]Favorite) {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	favsByOps = make(map[*folderBranchOps][]Favorite)
+	for fav, fbo := range fs.opsByFav {
+		favsByOps[fbo] = append(favsByOps[fbo], fav)
+	}
+	ops = make(map[FolderBranch]*folderBranchOps, len(fs.ops))
+	for fb, fbo := range fs.ops {
+		// The master branch holds the leases that keep the blocks
+		// of any retained branches around.
+		if fs.opsRefs[fb] == 0 && (fb.Branch != MasterBranch ||
+			len(fs.retained.list(fb.Tlf, now)) == 0) {
+			ops[fb] = fbo
+		}
+	}
+	return ops, favsByOps
+}
+
+// removeOpsForEviction forgets about `fbo` and returns true, unless
+// it was replaced, held, or accessed within `minIdle` of `now` since
+// it was found to be evictable.
+func (fs *KBFSOpsStandard) removeOpsForEviction(fb FolderBranch,
+	fbo *folderBranchOps, now time.Time, minIdle time.Duration) bool {
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+	if fs.ops[fb] != fbo || fs.opsRefs[fb] != 0 {
+		return false
+	}
+	// getOpsNoAdd marks the ops as accessed under opsLock, so this
+	// catches any lookup that raced with the idleness check.
+	if now.Sub(fbo.lastAccessTime()) < minIdle {
+		return false
+	}
+	delete(fs.ops, fb)
+	for fav, favOps := range fs.opsByFav {
+		if favOps == fbo {
+			delete(fs.opsByFav, fav)
+		}
+	}
+	if fb.Branch == MasterBranch {
+		fs.evictedOps[fb] = true
+	}
+	return true
+}
+
+// shutdownEvictedOps shuts down ops that were already removed by
+// removeOpsForEviction.
+func (fs *KBFSOpsStandard) shutdownEvictedOps(
+	ctx context.Context, toShutdown []*folderBranchOps, reason string) {
+	for _, fbo := range toShutdown {
+		fs.log.CDebugf(ctx, "Evicting %s folder-branch %s",
+			reason, fbo.folderBranch)
+		// Skip the state check, since it would need to look up the
+		// ops we just removed, and would end up re-creating it.
+		if err := fbo.shutdown(ctx, false); err != nil {
+			fs.log.CDebugf(ctx, "Error shutting down %s folder-branch "+
+				"%s: %+v", reason, fbo.folderBranch, err)
+		}
+		// The update goroutine is gone now, so let the MD server
+		// know, in order for a new fbo to re-register later.
+		fs.config.MDServer().CancelRegistration(ctx, fbo.id())
+	}
+	if r := fs.config.MetricsRegistry(); r != nil && len(toShutdown) > 0 {
+		metrics.GetOrRegisterMeter(opsEvictionsMeterName, r).Mark(
+			int64(len(toShutdown)))
+	}
+}
+
+// evictIdleOps shuts down and forgets about every folder-branch that
+// has gone unaccessed for at least `timeout` as of `now`, and which
+// isn't being held by anyone.  A new folderBranchOps will be created
+// lazily the next time the folder-branch is accessed.  It returns
+// the number of evicted folder-branches.
+func (fs *KBFSOpsStandard) evictIdleOps(
+	ctx context.Context, now time.Time, timeout time.Duration) int {
+	// Find candidates without holding opsLock, since checking
+	// idleness requires taking some of the fbo locks.
+	ops, favsByOps := fs.evictionCandidates(now)
+
+	lState := makeFBOLockState()
+	var toShutdown []*folderBranchOps
+	for fb, fbo := range ops {
+		// Each favorite entry registers one observer on the ops.
+		if !fbo.isIdle(lState, now, timeout, len(favsByOps[fbo])) {
+			continue
+		}
+		if fs.removeOpsForEviction(fb, fbo, now, timeout) {
+			toShutdown = append(toShutdown, fbo)
+		}
+	}
+
+	fs.shutdownEvictedOps(ctx, toShutdown, "idle")
+	return len(toShutdown)
+}
+
+// evictLRUOps shuts down and forgets about the least recently used
+// idle folder-branches, until no more than `max` are left, as far as
+// possible.  Folder-branches that have been accessed within
+// lruOpsMinIdle of `now` are never evicted.  It returns the number
+// of evicted folder-branches.
+func (fs *KBFSOpsStandard) evictLRUOps(
+	ctx context.Context, now time.Time, max int) int {
+	fs.opsLock.RLock()
+	excess := len(fs.ops) - max
+	fs.opsLock.RUnlock()
+	if excess <= 0 {
+		return 0
+	}
+
+	ops, favsByOps := fs.evictionCandidates(now)
+	type candidate struct {
+		fb         FolderBranch
+		fbo        *folderBranchOps
+		lastAccess time.Time
+	}
+	candidates := make([]candidate, 0, len(ops))
+	for fb, fbo := range ops {
+		candidates = append(candidates, candidate{
+			fb, fbo, fbo.lastAccessTime()})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+	})
+
+	lState := makeFBOLockState()
+	var toShutdown []*folderBranchOps
+	for _, c := range candidates {
+		if len(toShutdown) >= excess {
+			break
+		}
+		if !c.fbo.isIdle(
+			lState, now, lruOpsMinIdle, len(favsByOps[c.fbo])) {
+			continue
+		}
+		if fs.removeOpsForEviction(
+			c.fb, c.fbo, now, lruOpsMinIdle) {
+			toShutdown = append(toShutdown, c.fbo)
+		}
+	}
+
+	fs.shutdownEvictedOps(ctx, toShutdown, "least recently used")
+	return len(toShutdown)
+}
+
+// noteOpsOpened records how long it took to get the root node of a
+// folder-branch, starting from `start`, if it had been evicted.
+func (fs *KBFSOpsStandard) noteOpsOpened(fb FolderBranch, start time.Time) {
+	fs.opsLock.Lock()
+	reopened := fs.evictedOps[fb]
+	delete(fs.evictedOps, fb)
+	fs.opsLock.Unlock()
+	if !reopened {
+		return
+	}
+	if r := fs.config.MetricsRegistry(); r != nil {
+		metrics.GetOrRegisterTimer(opsReopenTimerName, r).UpdateSince(start)
+	}
+}
+
+// HoldFolderBranch marks the given folder-branch as in use, so that
+// its in-memory state won't be evicted for idleness (see
+// Config.TLFIdleEvictionTimeout) until the returned release function
+// is called.  Holds are reference-counted, and the release function
+// is idempotent.
+func (fs *KBFSOpsStandard) HoldFolderBranch(
+	fb FolderBranch) (release func()) {
+	fs.opsLock.Lock()
+	defer fs.opsLock.Unlock()
+	fs.opsRefs[fb]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			fs.opsLock.Lock()
+			defer fs.opsLock.Unlock()
+			fs.opsRefs[fb]--
+			if fs.opsRefs[fb] <= 0 {
+				delete(fs.opsRefs, fb)
+			}
+		})
+	}
+}
+
+// LeaseRevision keeps quota reclamation from deleting any of the
+// blocks referenced by revision `rev` of the given folder-branch,
+// for at most `d`, so that a long-running read of that revision
+// won't fail partway through.  The folder-branch is also held (see
+// HoldFolderBranch) for as long as the lease is outstanding.  The
+// returned function releases the lease early, and is idempotent.
+func (fs *KBFSOpsStandard) LeaseRevision(ctx context.Context,
+	fb FolderBranch, rev kbfsmd.Revision, d time.Duration) (release func()) {
+	releaseHold := fs.HoldFolderBranch(fb)
+	ops := fs.getOpsNoAdd(ctx, fb)
+	releaseLease := ops.fbm.leaseRevision(rev, d)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			releaseLease()
+			releaseHold()
+		})
+	}
+}
+
+// PrefetchFavoritesInBackground launches a goroutine that warms up
+// the caches for each of the logged-in user's favorites, according
+// to `mode`.  The prefetch is canceled if KBFSOpsStandard is shut
+// down before it completes.
+func (fs *KBFSOpsStandard) PrefetchFavoritesInBackground(
+	mode FavoritesPrefetchMode) {
+	if mode == FavoritesPrefetchOff {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-fs.shutdownChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer cancel()
+		err := prefetchFavorites(
+			ctx, fs.config, mode, favoritesPrefetchParallelism)
+		if err != nil {
+			fs.log.CDebugf(ctx, "Couldn't prefetch favorites: %+v", err)
+		}
+	}()
+}
+
+// ShutdownWithFlush is like Shutdown, except that unless `force` is
+// true, it first tries to sync all dirty files in every open
+// folder-branch, in parallel, spending at most `timeout` in total.
+// Either way, it returns the paths of any files that were still
+// dirty when the folder-branches were shut down (and whose changes
+// were therefore lost), keyed by folder-branch.  Those paths are also
+// recorded under the storage root, to be reported by
+// ReportPendingChanges on the next start.
+func (fs *KBFSOpsStandard) ShutdownWithFlush(
+	ctx context.Context, timeout time.Duration, force bool) (
+	dirty map[FolderBranch][]string, err error) {
+	fs.opsLock.RLock()
+	ops := make(map[FolderBranch]*folderBranchOps, len(fs.ops))
+	for fb, fbo := range fs.ops {
+		ops[fb] = fbo
+	}
+	fs.opsLock.RUnlock()
+
+	// Use one deadline for all the flushes, so the total shutdown
+	// time doesn't grow with the number of open folder-branches.
+	flushCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dirtyLock sync.Mutex
+	dirty = make(map[FolderBranch][]string)
+	var wg sync.WaitGroup
+	for fb, fbo := range ops {
+		wg.Add(1)
+		go func(fb FolderBranch, fbo *folderBranchOps) {
+			defer wg.Done()
+			var dirtyPaths []string
+			if force {
+				dirtyPaths = fbo.getDirtyFilePaths(makeFBOLockState())
+			} else {
+				dirtyPaths = fbo.flushForShutdown(flushCtx)
+			}
+			if len(dirtyPaths) > 0 {
+				dirtyLock.Lock()
+				defer dirtyLock.Unlock()
+				dirty[fb] = dirtyPaths
+			}
+		}(fb, fbo)
+	}
+	wg.Wait()
+
+	err = fs.Shutdown(ctx)
+	if saveErr := fs.savePendingChanges(ctx, ops, dirty); saveErr != nil {
+		fs.log.CDebugf(ctx, "Couldn't record pending changes: %+v", saveErr)
+	}
+	return dirty, err
+}
+
 // Shutdown safely shuts down any background goroutines that may have
-// been launched by KBFSOpsStandard.
+// been launched by KBFSOpsStandard.  Any dirty data that hasn't yet
+// been synced is abandoned; see ShutdownWithFlush for an alternative.
+// Calling Shutdown more than once is a no-op.
 func (fs *KBFSOpsStandard) Shutdown(ctx context.Context) error {
+	fs.shutdownLock.Lock()
+	defer fs.shutdownLock.Unlock()
+	if fs.shutdown {
+		return nil
+	}
+	fs.shutdown = true
+
 	defer fs.longOperationDebugDumper.Shutdown() // shut it down last
 	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
 	defer timeTrackerDone()
 
 	close(fs.reIdentifyControlChan)
+	close(fs.shutdownChan)
 	var errors []error
 	if err := fs.favs.Shutdown(); err != nil {
 		errors = append(errors, err)
 	}
-	for _, ops := range fs.ops {
-		if err := ops.Shutdown(ctx); err != nil {
+	fs.opsLock.RLock()
+	ops := make([]*folderBranchOps, 0, len(fs.ops))
+	for _, fbo := range fs.ops {
+		ops = append(ops, fbo)
+	}
+	fs.opsLock.RUnlock()
+	for _, fbo := range ops {
+		if err := fbo.Shutdown(ctx); err != nil {
 			errors = append(errors, err)
 			// Continue on and try to shut down the other FBOs.
 		}
@@ -179,6 +557,12 @@ func (fs *KBFSOpsStandard) ForceFastForward(ctx context.Context) {
 	}
 }
 
+// LockKeys implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) LockKeys(ctx context.Context) {
+	fs.log.CDebugf(ctx, "Dropping all cached TLF crypt keys")
+	fs.config.KeyCache().Clear()
+}
+
 // GetFavorites implements the KBFSOps interface for
 // KBFSOpsStandard.
 func (fs *KBFSOpsStandard) GetFavorites(ctx context.Context) (
@@ -265,8 +649,12 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(
 		panic("zero FolderBranch in getOps")
 	}
 
+	// Mark the ops as accessed while still holding opsLock, so that
+	// an eviction that already decided it was idle will notice,
+	// under the same lock, before removing it.
 	fs.opsLock.RLock()
 	if ops, ok := fs.ops[fb]; ok {
+		ops.updateLastOpsLookupTimestamp()
 		fs.opsLock.RUnlock()
 		return ops
 	}
@@ -278,10 +666,23 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
-		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(ctx, fs.config, fb, standard)
+		// branch; for now assume online, and read-write unless it's
+		// a retained branch.
+		bType := standard
+		if isRetainedBranchName(fb.Branch) {
+			bType = archive
+		}
+		ops = newFolderBranchOps(
+			ctx, fs.config, fb, bType, fs.crLimiter, fs.retained)
 		fs.ops[fb] = ops
+		if max := fs.config.MaxOpenTLFs(); max > 0 && len(fs.ops) > max {
+			select {
+			case fs.evictLRUOpsCh <- struct{}{}:
+			default:
+			}
+		}
 	}
+	ops.updateLastOpsLookupTimestamp()
 	return ops
 }
 
@@ -443,8 +844,9 @@ func (fs *KBFSOpsStandard) getMDByHandle(ctx context.Context,
 	// Check for an unmerged MD first, unless we're in single-op
 	// mode.  If this is a single-op, we can skip this check because
 	// there's basically no way for a TLF to start off as unmerged
-	// since single-ops should be using a fresh journal.
-	if fs.config.Mode() != InitSingleOp {
+	// since single-ops should be using a fresh journal.  Read-only
+	// mode never writes, so it can't have an unmerged MD either.
+	if fs.config.Mode() != InitSingleOp && fs.config.Mode() != InitReadOnly {
 		rmd, err = fs.config.MDOps().GetUnmergedForTLF(
 			ctx, tlfHandle.tlfID, kbfsmd.NullBranchID)
 		if err != nil {
@@ -513,6 +915,55 @@ func (fs *KBFSOpsStandard) GetTLFID(ctx context.Context,
 	return rmd.TlfID(), err
 }
 
+// RecoverFolderAccess implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RecoverFolderAccess(
+	ctx context.Context, tlfHandle *TlfHandle) (err error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	fs.log.CDebugf(ctx, "RecoverFolderAccess(%s)",
+		tlfHandle.GetCanonicalPath())
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %+v", err) }()
+
+	id, err := fs.config.MDOps().GetIDForHandle(ctx, tlfHandle)
+	if err != nil {
+		return err
+	}
+	if id == tlf.NullID {
+		return errors.Errorf("%s doesn't exist yet",
+			tlfHandle.GetCanonicalPath())
+	}
+	rmd, err := fs.config.MDOps().GetForTLF(ctx, id, nil)
+	if err != nil {
+		return err
+	}
+	if rmd == (ImmutableRootMetadata{}) {
+		// No keys have been made yet, so there's nothing to recover.
+		return nil
+	}
+	// The handle may resolve to an implicit team even when the TLF
+	// itself is still keyed per-device, so check the keying type of
+	// the MD instead.
+	if rmd.TypeForKeying() != tlf.PrivateKeying {
+		return errors.Errorf("%s doesn't use per-device keys",
+			tlfHandle.GetCanonicalPath())
+	}
+
+	err = fs.config.KeyManager().RecoverTLFCryptKeys(ctx, rmd)
+	if err != nil {
+		return err
+	}
+
+	// An open folder may be holding an unreadable head; make it
+	// fetch the head again, now that the keys are cached.
+	if fbo := fs.getOpsByFav(tlfHandle.ToFavorite()); fbo != nil {
+		fbo.ClearPrivateFolderMD(ctx)
+		fbo.ForceFastForward(ctx)
+	}
+	return nil
+}
+
 // getMaybeCreateRootNode is called for GetOrCreateRootNode and GetRootNode.
 func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName, create bool) (
@@ -520,6 +971,11 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	fs.log.CDebugf(ctx, "getMaybeCreateRootNode(%s, %v, %v)",
 		h.GetCanonicalPath(), branch, create)
 	defer func() { fs.deferLog.CDebugf(ctx, "Done: %#v", err) }()
+	start := fs.config.Clock().Now()
+
+	if isRetainedBranchName(branch) {
+		return fs.getRetainedBranchRootNode(ctx, h, branch)
+	}
 
 	// Check if we already have the MD cached, before contacting any
 	// servers.
@@ -621,6 +1077,7 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
+	fs.noteOpsOpened(fb, start)
 
 	if err := ops.doFavoritesOp(ctx, fs.favs, FavoritesOpAdd, h); err != nil {
 		// Failure to favorite shouldn't cause a failure.  Just log
@@ -630,6 +1087,31 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	return node, ei, nil
 }
 
+// getRetainedBranchRootNode returns the root node of a retained,
+// read-only branch of the TLF for `h`.
+func (fs *KBFSOpsStandard) getRetainedBranchRootNode(
+	ctx context.Context, h *TlfHandle, branch BranchName) (
+	node Node, ei EntryInfo, err error) {
+	fb := FolderBranch{Tlf: h.tlfID, Branch: branch}
+	if h.tlfID == tlf.NullID {
+		return nil, EntryInfo{}, errors.WithStack(
+			RetainedBranchNotFoundError{fb})
+	}
+	// Make sure the branch exists before making an ops for it.
+	_, ok := fs.retained.getHead(fb.Tlf, branch, fs.config.Clock().Now())
+	if !ok {
+		return nil, EntryInfo{}, errors.WithStack(
+			RetainedBranchNotFoundError{fb})
+	}
+
+	ops := fs.getOpsNoAdd(ctx, fb)
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return node, ei, nil
+}
+
 // GetOrCreateRootNode implements the KBFSOps interface for
 // KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetOrCreateRootNode(
@@ -663,6 +1145,17 @@ func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	return ops.GetDirChildren(ctx, dir)
 }
 
+// GetDirChildrenWithNodes implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetDirChildrenWithNodes(
+	ctx context.Context, dir Node) (map[string]DirChild, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.GetDirChildrenWithNodes(ctx, dir)
+}
+
 // Lookup implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Lookup(ctx context.Context, dir Node, name string) (
 	Node, EntryInfo, error) {
@@ -693,6 +1186,27 @@ func (fs *KBFSOpsStandard) CreateDir(
 	return ops.CreateDir(ctx, dir, name)
 }
 
+// CreatePath implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreatePath(
+	ctx context.Context, dir Node, path string) (Node, EntryInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreatePath(ctx, dir, path)
+}
+
+// WriteFileAtomic implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WriteFileAtomic(
+	ctx context.Context, dir Node, name string, contents []byte) (
+	Node, EntryInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.WriteFileAtomic(ctx, dir, name, contents)
+}
+
 // CreateFile implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateFile(
 	ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
@@ -754,6 +1268,146 @@ func (fs *KBFSOpsStandard) Rename(
 	return ops.Rename(ctx, oldParent, oldName, newParent, newName)
 }
 
+// crossTlfCopyChunkSize is how much of a file is read and written at
+// once when CrossTlfMove has to copy it.
+const crossTlfCopyChunkSize = 1 << 20
+
+// canTransferBlockRefs returns whether blocks put to the TLF `from`
+// can be read in the TLF `to`.  Only public TLFs share keys (and key
+// generations), so only their blocks can be re-homed without being
+// re-encrypted.
+func canTransferBlockRefs(from, to FolderBranch) bool {
+	return from.Tlf.Type() == tlf.Public && to.Tlf.Type() == tlf.Public &&
+		from.Branch == MasterBranch && to.Branch == MasterBranch
+}
+
+// CrossTlfMove implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CrossTlfMove(
+	ctx context.Context, srcParent Node, srcName string, dstParent Node,
+	dstName string) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	srcFB := srcParent.GetFolderBranch()
+	dstFB := dstParent.GetFolderBranch()
+	if srcFB == dstFB {
+		return fs.Rename(ctx, srcParent, srcName, dstParent, dstName)
+	}
+
+	srcNode, ei, err := fs.Lookup(ctx, srcParent, srcName)
+	if err != nil {
+		return err
+	}
+	if ei.Type == Dir {
+		return errors.Errorf(
+			"Can't move directory %s across top-level folders", srcName)
+	}
+
+	srcOps := fs.getOpsByNode(ctx, srcParent)
+	dstOps := fs.getOpsByNode(ctx, dstParent)
+	transferer, ok := fs.config.BlockServer().(BlockRefTransferer)
+	transferred := false
+	if ok && ei.Type != Sym && canTransferBlockRefs(srcFB, dstFB) {
+		transferred, err = fs.transferAcrossTlfs(
+			ctx, transferer, srcOps, srcParent, srcName, dstOps, dstParent,
+			dstName)
+		if transferred && err != nil {
+			return err
+		} else if err != nil {
+			fs.log.CDebugf(ctx, "Couldn't transfer %s's block references, "+
+				"copying it instead: %+v", srcName, err)
+		}
+	}
+
+	if !transferred {
+		err = fs.copyAcrossTlfs(ctx, srcNode, ei, dstParent, dstName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = srcOps.RemoveEntry(ctx, srcParent, srcName)
+	if err != nil {
+		return err
+	}
+	return srcOps.SyncAll(ctx, srcFB)
+}
+
+// transferAcrossTlfs moves the file `srcName` into `dstParent` by
+// transferring its block references, rather than copying its data.
+// It returns true if the references were transferred; if not, the
+// caller may fall back to copying the file.
+func (fs *KBFSOpsStandard) transferAcrossTlfs(
+	ctx context.Context, transferer BlockRefTransferer,
+	srcOps *folderBranchOps, srcParent Node, srcName string,
+	dstOps *folderBranchOps, dstParent Node, dstName string) (
+	transferred bool, err error) {
+	de, infos, err := srcOps.transferableEntry(ctx, srcParent, srcName)
+	if err != nil {
+		return false, err
+	}
+
+	contexts := make(kbfsblock.ContextMap)
+	for _, info := range infos {
+		contexts[info.ID] = append(contexts[info.ID], info.Context)
+	}
+	srcID, dstID := srcOps.id(), dstOps.id()
+	err = transferer.TransferBlockReferences(ctx, srcID, dstID, contexts)
+	if err != nil {
+		return false, err
+	}
+
+	err = dstOps.adoptEntry(ctx, dstParent, dstName, de, infos)
+	if err != nil {
+		// Hand the blocks back, so the source file stays readable.
+		tErr := transferer.TransferBlockReferences(
+			ctx, dstID, srcID, contexts)
+		if tErr != nil {
+			fs.log.CWarningf(ctx, "Couldn't return %s's block references "+
+				"to %s: %+v", srcName, srcID, tErr)
+		}
+		return true, err
+	}
+	return true, nil
+}
+
+// copyAcrossTlfs copies the file or symlink at `srcNode`, described
+// by `ei`, to `dstName` in `dstParent`.
+func (fs *KBFSOpsStandard) copyAcrossTlfs(
+	ctx context.Context, srcNode Node, ei EntryInfo, dstParent Node,
+	dstName string) error {
+	if ei.Type == Sym {
+		_, err := fs.CreateLink(ctx, dstParent, dstName, ei.SymPath)
+		if err != nil {
+			return err
+		}
+		return fs.SyncAll(ctx, dstParent.GetFolderBranch())
+	}
+
+	dstNode, _, err := fs.CreateFile(
+		ctx, dstParent, dstName, ei.Type == Exec, WithExcl)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, crossTlfCopyChunkSize)
+	for off := int64(0); off < int64(ei.Size); {
+		n, err := fs.Read(ctx, srcNode, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		err = fs.Write(ctx, dstNode, buf[:n], off)
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	return fs.SyncAll(ctx, dstParent.GetFolderBranch())
+}
+
 // Read implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Read(
 	ctx context.Context, file Node, dest []byte, off int64) (
@@ -785,6 +1439,16 @@ func (fs *KBFSOpsStandard) Truncate(
 	return ops.Truncate(ctx, file, size)
 }
 
+// Preallocate implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Preallocate(
+	ctx context.Context, file Node, size uint64) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.Preallocate(ctx, file, size)
+}
+
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
 	ctx context.Context, file Node, ex bool) error {
@@ -805,6 +1469,16 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// SetTimes implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetTimes(
+	ctx context.Context, file Node, times EntryTimes) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SetTimes(ctx, file, times)
+}
+
 // SyncAll implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncAll(
 	ctx context.Context, folderBranch FolderBranch) error {
@@ -815,6 +1489,71 @@ func (fs *KBFSOpsStandard) SyncAll(
 	return ops.SyncAll(ctx, folderBranch)
 }
 
+// CancelSync implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CancelSync(
+	ctx context.Context, folderBranch FolderBranch) error {
+	// There can't be a sync in progress for a folder that hasn't
+	// been initialized yet.
+	fs.opsLock.RLock()
+	ops, ok := fs.ops[folderBranch]
+	fs.opsLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return ops.CancelSync(ctx, folderBranch)
+}
+
+// GetContentPolicy implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetContentPolicy(
+	ctx context.Context, folderBranch FolderBranch) (
+	*TlfContentPolicy, error) {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.GetContentPolicy(ctx, folderBranch)
+}
+
+// SetContentPolicy implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetContentPolicy(
+	ctx context.Context, folderBranch FolderBranch,
+	policy *TlfContentPolicy) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpAdd)
+	return ops.SetContentPolicy(ctx, folderBranch, policy)
+}
+
+// DebugDump implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) DebugDump(
+	ctx context.Context, folderBranch FolderBranch) ([]byte, error) {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.DebugDump(ctx, folderBranch)
+}
+
+// GetTlfOpStats implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetTlfOpStats(
+	ctx context.Context, folderBranch FolderBranch) (TlfOpStats, error) {
+	fs.opsLock.RLock()
+	ops, ok := fs.ops[folderBranch]
+	fs.opsLock.RUnlock()
+	if ok {
+		return ops.GetTlfOpStats(ctx, folderBranch)
+	}
+	if folderBranch.Branch != MasterBranch {
+		return TlfOpStats{}, nil
+	}
+
+	// Read the stored stats directly, rather than opening the TLF
+	// just to ask it.
+	file, err := loadTlfOpStats(fs.config.Codec(),
+		tlfOpStatsPath(fs.config.StorageRoot(), folderBranch.Tlf))
+	if err != nil {
+		return TlfOpStats{}, err
+	}
+	return file.Stats, nil
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
@@ -875,15 +1614,16 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 	}
 
 	return KBFSStatus{
-		CurrentUser:     session.Name.String(),
-		IsConnected:     fs.config.MDServer().IsConnected(),
-		UsageBytes:      usageBytes,
-		LimitBytes:      limitBytes,
-		GitUsageBytes:   gitUsageBytes,
-		GitLimitBytes:   gitLimitBytes,
-		FailingServices: failures,
-		JournalServer:   jServerStatus,
-		DiskCacheStatus: dbcStatus,
+		CurrentUser:      session.Name.String(),
+		IsConnected:      fs.config.MDServer().IsConnected(),
+		UsageBytes:       usageBytes,
+		LimitBytes:       limitBytes,
+		GitUsageBytes:    gitUsageBytes,
+		GitLimitBytes:    gitLimitBytes,
+		FailingServices:  failures,
+		JournalServer:    jServerStatus,
+		DiskCacheStatus:  dbcStatus,
+		BlockServerTiers: getBlockServerTierStatus(fs.config.BlockServer()),
 	}, ch, err
 }
 
@@ -898,6 +1638,28 @@ func (fs *KBFSOpsStandard) UnstageForTesting(
 	return ops.UnstageForTesting(ctx, folderBranch)
 }
 
+// ForceResolveNow implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ForceResolveNow(
+	ctx context.Context, folderBranch FolderBranch) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.ForceResolveNow(ctx, folderBranch)
+}
+
+// GetRetainedBranches implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetRetainedBranches(
+	ctx context.Context, folderBranch FolderBranch) (
+	[]RetainedBranchInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.GetRetainedBranches(ctx, folderBranch)
+}
+
 // RequestRekey implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RequestRekey(ctx context.Context, id tlf.ID) {
 	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
@@ -909,6 +1671,17 @@ func (fs *KBFSOpsStandard) RequestRekey(ctx context.Context, id tlf.ID) {
 	ops.RequestRekey(ctx, id)
 }
 
+// RekeyStatus returns the progress of this device's current or most
+// recent rekey of the given TLF, including the error that ended it,
+// if any.
+func (fs *KBFSOpsStandard) RekeyStatus(
+	ctx context.Context, id tlf.ID) RekeyStatus {
+	// We currently only support rekeys of master branches.
+	ops := fs.getOps(ctx,
+		FolderBranch{Tlf: id, Branch: MasterBranch}, FavoritesOpNoChange)
+	return ops.RekeyStatus()
+}
+
 // SyncFromServerForTesting implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncFromServerForTesting(ctx context.Context,
 	folderBranch FolderBranch, lockBeforeGet *keybase1.LockID) error {
@@ -949,6 +1722,55 @@ func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	return ops.GetNodeMetadata(ctx, node)
 }
 
+// NodeToken implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) NodeToken(ctx context.Context, node Node) (
+	NodeToken, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.NodeToken(ctx, node)
+}
+
+// NodeFromToken implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) NodeFromToken(
+	ctx context.Context, token NodeToken) (Node, EntryInfo, error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	data, err := decodeNodeToken(fs.config.Codec(), token)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	fb := FolderBranch{Tlf: data.Tlf, Branch: data.Branch}
+	fs.opsLock.RLock()
+	_, ok := fs.ops[fb]
+	fs.opsLock.RUnlock()
+	if !ok {
+		// The folder hasn't been opened by this process yet, so
+		// look up its handle to open it.
+		md, err := fs.config.MDOps().GetForTLF(ctx, data.Tlf, nil)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		if md == (ImmutableRootMetadata{}) {
+			return nil, EntryInfo{}, data.staleError(
+				"the folder doesn't exist")
+		}
+		rootNode, _, err := fs.GetRootNode(
+			ctx, md.GetTlfHandle(), data.Branch)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		if rootNode == nil {
+			return nil, EntryInfo{}, data.staleError(
+				"the folder has no root")
+		}
+	}
+	ops := fs.getOps(ctx, fb, FavoritesOpNoChange)
+	return ops.NodeFromToken(ctx, token)
+}
+
 // TeamNameChanged implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) TeamNameChanged(
 	ctx context.Context, tid keybase1.TeamID) {
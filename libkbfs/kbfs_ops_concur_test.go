@@ -20,6 +20,7 @@ import (
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
@@ -578,6 +579,12 @@ func (km *mdRecordingKeyManager) GetTLFCryptKeyOfAllGenerations(
 	return km.delegate.GetTLFCryptKeyOfAllGenerations(ctx, kmd)
 }
 
+func (km *mdRecordingKeyManager) RecoverTLFCryptKeys(
+	ctx context.Context, kmd KeyMetadata) error {
+	km.setLastKMD(kmd)
+	return km.delegate.RecoverTLFCryptKeys(ctx, kmd)
+}
+
 func (km *mdRecordingKeyManager) Rekey(
 	ctx context.Context, md *RootMetadata, promptPaper bool) (
 	bool, *kbfscrypto.TLFCryptKey, error) {
@@ -768,6 +775,294 @@ func TestKBFSOpsConcurBlockSyncTruncate(t *testing.T) {
 	}
 }
 
+// Tests that writes and truncates to a file that race with each
+// other during a sync are applied in the order they were called, both
+// before and after the sync finishes.
+func TestKBFSOpsConcurWriteTruncateOrderDuringSync(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdownNoCheck(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte("0123456789"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+
+	lState := makeFBOLockState()
+	fbo := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(
+		ctx, rootNode.GetFolderBranch())
+
+	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.SyncAll(ctxStallSync, fileNode.GetFolderBranch())
+	}()
+	select {
+	case <-onSyncStalledCh:
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync to stall: %v", ctx.Err())
+	}
+
+	// Hold the file's turn while the operations start, so that they
+	// all race for it once it's released.
+	doneWithFile, err := fbo.fileOps.wait(ctx, fileNode.GetID())
+	if err != nil {
+		t.Fatalf("Couldn't take a turn: %v", err)
+	}
+	ops := []func() error{
+		func() error {
+			return kbfsOps.Write(ctx, fileNode, []byte("abc"), 8)
+		},
+		func() error {
+			return kbfsOps.Truncate(ctx, fileNode, 4)
+		},
+		func() error {
+			return kbfsOps.Write(ctx, fileNode, []byte("xy"), 6)
+		},
+	}
+	opErrCh := make(chan error, len(ops))
+	for i, op := range ops {
+		go func(op func() error) {
+			opErrCh <- op()
+		}(op)
+		waitForFileOpsQueued(ctx, t, fbo.fileOps, fileNode.GetID(), i+2)
+	}
+	doneWithFile()
+	for range ops {
+		select {
+		case err := <-opErrCh:
+			if err != nil {
+				t.Fatalf("Couldn't change file: %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timeout waiting for op: %v", ctx.Err())
+		}
+	}
+
+	expected := []byte("0123\x00\x00xy")
+	checkData := func() {
+		buf := make([]byte, 20)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+		if !bytes.Equal(expected, buf[:nr]) {
+			t.Fatalf("Expected %q, got %q", expected, buf[:nr])
+		}
+	}
+	checkData()
+	if c := fbo.blocks.getDeferredWriteCountForTest(lState); c != len(ops) {
+		t.Errorf("Unexpected deferred write count %d", c)
+	}
+
+	close(syncUnstallCh)
+	select {
+	case err := <-syncErrCh:
+		if err != nil {
+			t.Fatalf("Couldn't sync: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync: %v", ctx.Err())
+	}
+	checkData()
+
+	// The deferred changes are replayed in order for the next sync.
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync: %v", err)
+	}
+	if fbo.blocks.GetState(lState) != cleanState {
+		t.Fatal("Unexpectedly not in clean state")
+	}
+	config.ResetCaches()
+	checkData()
+}
+
+// Tests that with strict write visibility, reads of a file that's
+// being synced wait for the sync, and then see the writes that were
+// deferred during it.
+func TestKBFSOpsConcurStrictWriteVisibility(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdownNoCheck(t, config, ctx, cancel)
+	config.SetStrictWriteVisibility(true)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+
+	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.SyncAll(ctxStallSync, fileNode.GetFolderBranch())
+	}()
+	select {
+	case <-onSyncStalledCh:
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync to stall: %v", ctx.Err())
+	}
+
+	// This write is deferred until after the sync.
+	err = kbfsOps.Write(ctx, fileNode, []byte{4}, 1)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+
+	// A read that gives up while waiting fails.
+	readCtx, readCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer readCancel()
+	buf := make([]byte, 3)
+	_, err = kbfsOps.Read(readCtx, fileNode, buf, 0)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+
+	readCh := make(chan []byte, 1)
+	readErrCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 3)
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		readErrCh <- err
+		readCh <- buf[:nr]
+	}()
+	select {
+	case err := <-readErrCh:
+		t.Fatalf("Read finished during the sync: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(syncUnstallCh)
+	select {
+	case err := <-syncErrCh:
+		if err != nil {
+			t.Fatalf("Couldn't sync: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync: %v", ctx.Err())
+	}
+	select {
+	case err := <-readErrCh:
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for read: %v", ctx.Err())
+	}
+	if data := <-readCh; !bytes.Equal([]byte{1, 4, 3}, data) {
+		t.Fatalf("Unexpected data after sync: %v", data)
+	}
+
+	// Sync the write that was deferred during the first sync.
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync deferred write: %v", err)
+	}
+}
+
+// Tests that canceling a sync while its blocks are being put leaves
+// the file dirty, keeps the writes that were deferred during the
+// sync, and that the next sync puts everything, including them.
+func TestKBFSOpsCancelSyncDuringBlockPuts(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+
+	lState := makeFBOLockState()
+	fbo := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(
+		ctx, rootNode.GetFolderBranch())
+
+	oldBServer := config.BlockServer()
+	defer config.SetBlockServer(oldBServer)
+	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.SyncAll(ctxStallSync, fileNode.GetFolderBranch())
+	}()
+	select {
+	case <-onSyncStalledCh:
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync to stall: %v", ctx.Err())
+	}
+
+	// This write gets deferred until after the sync.
+	err = kbfsOps.Write(ctx, fileNode, []byte{4}, 3)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+
+	err = kbfsOps.CancelSync(ctx, fileNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't cancel sync: %v", err)
+	}
+	close(syncUnstallCh)
+
+	select {
+	case syncErr := <-syncErrCh:
+		if _, ok := syncErr.(SyncCanceledError); !ok {
+			t.Fatalf("Unexpected sync error: %+v", syncErr)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for sync: %v", ctx.Err())
+	}
+
+	if fbo.blocks.GetState(lState) != dirtyState {
+		t.Fatal("Unexpectedly not in dirty state after canceled sync")
+	}
+	// The deferred write has been redone on the dirty file.
+	deferredWriteCount := fbo.blocks.getDeferredWriteCountForTest(lState)
+	if deferredWriteCount != 0 {
+		t.Errorf("Unexpected deferred write count %d", deferredWriteCount)
+	}
+
+	// Canceling with no sync in progress is a no-op.
+	err = kbfsOps.CancelSync(ctx, fileNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't cancel sync: %v", err)
+	}
+
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync: %v", err)
+	}
+	if fbo.blocks.GetState(lState) != cleanState {
+		t.Fatal("Unexpectedly not in clean state after sync")
+	}
+
+	buf := make([]byte, 4)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf[:n], []byte{1, 2, 3, 4}) {
+		t.Errorf("Unexpected file contents %v", buf[:n])
+	}
+}
+
 // Tests that a file that has been truncate-extended and overwritten
 // to several times can sync, and then take several deferred
 // overwrites, plus one write that blocks until the dirty bcache has
@@ -1045,7 +1340,7 @@ func TestKBFSOpsConcurWriteDuringSyncMultiBlocks(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -1242,7 +1537,7 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -1395,7 +1690,7 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create and write to a file
@@ -1950,6 +2245,51 @@ func TestKBFSOpsCanceledCreateDelayTimeoutErrors(t *testing.T) {
 	}
 }
 
+// Test that an MD write whose deadline is too close fails before the
+// MD is put, leaving the head unchanged.
+func TestKBFSOpsSyncNearDeadlineFails(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	md, err := config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %+v", err)
+	}
+	oldRev := md.Revision()
+
+	kbfsOps := config.KBFSOps()
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+
+	deadlineCtx, cancel2 := context.WithTimeout(
+		ctx, minMDPutTimeRemaining/2)
+	defer cancel2()
+	err = kbfsOps.SyncAll(deadlineCtx, fb)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Sync didn't fail near its deadline.  Got %v; "+
+			"expecting context.DeadlineExceeded", err)
+	}
+
+	md, err = config.MDOps().GetForTLF(ctx, fb.Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %+v", err)
+	}
+	if md.Revision() != oldRev {
+		t.Fatalf("MD was put anyway: revision %d, expected %d",
+			md.Revision(), oldRev)
+	}
+
+	// With enough time left, the same write succeeds.
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync: %+v", err)
+	}
+}
+
 // Test that a Sync that is canceled during a successful MD put works.
 func TestKBFSOpsConcurCanceledSyncSucceeds(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
@@ -2643,3 +2983,198 @@ func TestKBFSOpsConcurMultiblockOverwriteWithCanceledSync(t *testing.T) {
 		t.Errorf("Read wrong data.  Expected %v, got %v", data4, gotData)
 	}
 }
+
+// heldPutMDServer holds back every merged MD put until the test lets
+// it through, and reports the revision of each held put on `held`.
+type heldPutMDServer struct {
+	MDServer
+	held    chan kbfsmd.Revision
+	release chan struct{}
+}
+
+func newHeldPutMDServer(mdserver MDServer) heldPutMDServer {
+	return heldPutMDServer{mdserver, make(chan kbfsmd.Revision, 10),
+		make(chan struct{})}
+}
+
+func (md heldPutMDServer) Put(ctx context.Context, rmds *RootMetadataSigned,
+	extra kbfsmd.ExtraMetadata, lc *keybase1.LockContext,
+	priority keybase1.MDPriority) error {
+	if rmds.MD.MergedStatus() == kbfsmd.Merged {
+		md.held <- rmds.MD.RevisionNumber()
+		select {
+		case <-md.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return md.MDServer.Put(ctx, rmds, extra, lc, priority)
+}
+
+// Test that, with MD put pipelining, a sync gets prepared against the
+// previous revision while that revision is still being put, and that
+// both syncs return only once their own revisions are on the server.
+func TestKBFSOpsConcurMDPutPipelining(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.SetMDPutPipelining(true)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync: %v", err)
+	}
+
+	mdserver := newHeldPutMDServer(config.MDServer())
+	config.SetMDServer(mdserver)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	startRev := ops.getCurrMDRevision(lState)
+
+	// Start syncing a write to "a", and wait for its put.
+	err = kbfsOps.Write(ctx, fileNodeA, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	errChanA := make(chan error, 1)
+	go func() {
+		errChanA <- kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	}()
+	select {
+	case rev := <-mdserver.held:
+		if rev != startRev+1 {
+			t.Fatalf("Unexpected put of rev %d", rev)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	// The head moves on before the server acknowledges the put...
+	if rev := ops.getCurrMDRevision(lState); rev != startRev+1 {
+		t.Fatalf("Head is at rev %d, not %d", rev, startRev+1)
+	}
+	// ...but the sync doesn't return yet.
+	select {
+	case err := <-errChanA:
+		t.Fatalf("Sync returned before its put finished: %v", err)
+	default:
+	}
+
+	// Prepare the next revision while the first one is held.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	errChanB := make(chan error, 1)
+	go func() {
+		errChanB <- kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	}()
+
+	mdserver.release <- struct{}{}
+	select {
+	case err := <-errChanA:
+		if err != nil {
+			t.Fatalf("Couldn't sync: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	select {
+	case rev := <-mdserver.held:
+		if rev != startRev+2 {
+			t.Fatalf("Unexpected put of rev %d", rev)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	mdserver.release <- struct{}{}
+	select {
+	case err := <-errChanB:
+		if err != nil {
+			t.Fatalf("Couldn't sync: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	head, err := config.MDOps().GetForTLF(
+		ctx, rootNode.GetFolderBranch().Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get head: %v", err)
+	}
+	if head.Revision() != startRev+2 {
+		t.Fatalf("Server head is at rev %d, not %d",
+			head.Revision(), startRev+2)
+	}
+	if !ops.isMasterBranch(lState) {
+		t.Fatal("Unexpectedly on an unmerged branch")
+	}
+	close(mdserver.release)
+}
+
+// lostReplyMDServer lets the first merged MD put through to the
+// server, but then fails it as if the reply had been lost.
+type lostReplyMDServer struct {
+	MDServer
+	lock     sync.Mutex
+	lostOnce bool
+}
+
+func (md *lostReplyMDServer) Put(ctx context.Context,
+	rmds *RootMetadataSigned, extra kbfsmd.ExtraMetadata,
+	lc *keybase1.LockContext, priority keybase1.MDPriority) error {
+	err := md.MDServer.Put(ctx, rmds, extra, lc, priority)
+	if err != nil || rmds.MD.MergedStatus() != kbfsmd.Merged {
+		return err
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.lostOnce {
+		return nil
+	}
+	md.lostOnce = true
+	return kbfsmd.ServerError{Err: errors.New("reply lost")}
+}
+
+// Test that a pipelined MD put that fails with a transient error is
+// sent again, rather than being rolled back to an unmerged branch.
+func TestKBFSOpsConcurMDPutPipeliningResend(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+	config.SetMDPutPipelining(true)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	startRev := ops.getCurrMDRevision(lState)
+
+	config.SetMDServer(&lostReplyMDServer{MDServer: config.MDServer()})
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync: %v", err)
+	}
+
+	head, err := config.MDOps().GetForTLF(
+		ctx, rootNode.GetFolderBranch().Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get head: %v", err)
+	}
+	if head.Revision() != startRev+1 {
+		t.Fatalf("Server head is at rev %d, not %d",
+			head.Revision(), startRev+1)
+	}
+	if !ops.isMasterBranch(lState) {
+		t.Fatal("Unexpectedly on an unmerged branch")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -102,6 +104,9 @@ func kbfsOpsInit(t *testing.T) (mockCtrl *gomock.Controller,
 	// Max out MaxPtrsPerBlock
 	config.mockBsplit.EXPECT().MaxPtrsPerBlock().
 		Return(int((^uint(0)) >> 1)).AnyTimes()
+	// Never inline file contents
+	config.mockBsplit.EXPECT().ShouldInlineFile(gomock.Any()).
+		Return(false).AnyTimes()
 
 	// Ignore Archive calls for now
 	config.mockBops.EXPECT().Archive(gomock.Any(), gomock.Any(),
@@ -112,7 +117,8 @@ func kbfsOpsInit(t *testing.T) (mockCtrl *gomock.Controller,
 	// Ignore BlockRetriever calls
 	brc := &testBlockRetrievalConfig{nil, newTestLogMaker(t),
 		config.BlockCache(), nil, newTestDiskBlockCacheGetter(t, nil),
-		newTestSyncedTlfGetterSetter(), testInitModeGetter{InitDefault}}
+		newTestSyncedTlfGetterSetter(), testInitModeGetter{InitDefault},
+		newTestTuningProfileGetter()}
 	brq := newBlockRetrievalQueue(0, 0, brc)
 	config.mockBops.EXPECT().BlockRetriever().AnyTimes().Return(brq)
 	// Ignore Prefetcher calls
@@ -2648,8 +2654,6 @@ func TestKBFSOpsTruncateRemovesABlock(t *testing.T) {
 
 	newPBlock := getFileBlockFromCache(t, config, id, fileNode.BlockPointer,
 		p.Branch)
-	newBlock1 := getFileBlockFromCache(t, config, id,
-		fileBlock.IPtrs[0].BlockPointer, p.Branch)
 
 	lState := makeFBOLockState()
 
@@ -2665,10 +2669,11 @@ func TestKBFSOpsTruncateRemovesABlock(t *testing.T) {
 	} else if ctx.Value(tCtxID) != config.observer.ctx.Value(tCtxID) {
 		t.Errorf("Wrong context value passed in local notify: %v",
 			config.observer.ctx.Value(tCtxID))
-	} else if !bytes.Equal(data, newBlock1.Contents) {
-		t.Errorf("Wrote bad contents: %v", newBlock1.Contents)
-	} else if len(newPBlock.IPtrs) != 1 {
-		t.Errorf("Wrong number of indirect pointers: %d", len(newPBlock.IPtrs))
+	} else if newPBlock.IsInd {
+		// With only one block left, the file is no longer indirect.
+		t.Errorf("Top block still indirect: %v", newPBlock.IPtrs)
+	} else if !bytes.Equal(data, newPBlock.Contents) {
+		t.Errorf("Wrote bad contents: %v", newPBlock.Contents)
 	} else if rmd.UnrefBytes() != 0+5+6 {
 		// The fileid and both blocks were all modified and marked dirty
 		t.Errorf("Truncated block not correctly unref'd, unrefBytes = %d",
@@ -2676,8 +2681,7 @@ func TestKBFSOpsTruncateRemovesABlock(t *testing.T) {
 	}
 	checkBlockCache(t, config, id, []kbfsblock.ID{rootID, fileID, id1, id2},
 		map[BlockPointer]BranchName{
-			fileNode.BlockPointer:           p.Branch,
-			fileBlock.IPtrs[0].BlockPointer: p.Branch,
+			fileNode.BlockPointer: p.Branch,
 		})
 }
 
@@ -2743,6 +2747,48 @@ func TestKBFSOpsTruncateBiggerSuccess(t *testing.T) {
 		[]WriteRange{{Off: 5, Len: 5}})
 }
 
+func TestKBFSOpsPreallocate(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockSplitter(&BlockSplitterSimple{10, 2, 10, 0})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	t.Log("Preallocating past the end extends the file with zeroes")
+	const size = 1 << 20
+	err = kbfsOps.Preallocate(ctx, fileNode, size)
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(size), ei.Size)
+	expected := make([]byte, size)
+	copy(expected, data)
+	got := make([]byte, size)
+	n, err := kbfsOps.Read(ctx, fileNode, got, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(size), n)
+	require.True(t, bytes.Equal(expected, got))
+
+	t.Log("Preallocating less than the current size is a no-op")
+	err = kbfsOps.Preallocate(ctx, fileNode, 3)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(size), ei.Size)
+
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(size), ei.Size)
+}
+
 func TestSetExFailNoSuchName(t *testing.T) {
 	mockCtrl, config, ctx, cancel := kbfsOpsInit(t)
 	defer kbfsTestShutdown(mockCtrl, config, ctx, cancel)
@@ -3059,6 +3105,131 @@ func TestKBFSOpsBackgroundFlush(t *testing.T) {
 	}
 }
 
+// Tests that a coalescing window batches directory ops into a single
+// revision, even when each op would otherwise be synced on its own.
+func TestKBFSOpsDirOpCoalescingWindow(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBGFlushDirOpBatchSize(1)
+	config.SetBGFlushPeriod(time.Minute)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	startRev := ops.getCurrMDRevision(lState)
+
+	config.SetDirOpCoalescingWindow(
+		rootNode.GetFolderBranch().Tlf, 200*time.Millisecond)
+
+	staller := NewNaïveStaller(config)
+	staller.StallMDOp(StallableMDAfterPut, 1, false)
+	go ops.backgroundFlusher()
+
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	require.Equal(t, startRev, ops.getCurrMDRevision(lState))
+
+	// The background flusher syncs all the creates once the window
+	// passes.
+	staller.WaitForStallMDOp(StallableMDAfterPut)
+	staller.UnstallOneMDOp(StallableMDAfterPut)
+	err := kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, startRev+1, ops.getCurrMDRevision(lState))
+
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, len(names))
+}
+
+func TestKBFSOpsCreatePath(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBGFlushDirOpBatchSize(1)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	startRev := ops.getCurrMDRevision(lState)
+
+	dNode, ei, err := kbfsOps.CreatePath(ctx, rootNode, "a/b//c/d/")
+	require.NoError(t, err)
+	require.Equal(t, Dir, ei.Type)
+	require.Equal(t, startRev+1, ops.getCurrMDRevision(lState))
+
+	node := rootNode
+	for _, name := range []string{"a", "b", "c", "d"} {
+		node, ei, err = kbfsOps.Lookup(ctx, node, name)
+		require.NoError(t, err)
+		require.Equal(t, Dir, ei.Type)
+	}
+	require.Equal(t, dNode.GetID(), node.GetID())
+
+	// An existing prefix is reused, and only the rest is created.
+	_, _, err = kbfsOps.CreatePath(ctx, rootNode, "a/b/e/f")
+	require.NoError(t, err)
+	require.Equal(t, startRev+2, ops.getCurrMDRevision(lState))
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+
+	// A path that fully exists doesn't make a new revision.
+	_, _, err = kbfsOps.CreatePath(ctx, rootNode, "a/b/c")
+	require.NoError(t, err)
+	require.Equal(t, startRev+2, ops.getCurrMDRevision(lState))
+
+	// A file in the middle of the path is an error, and nothing new
+	// gets created.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "g", false, NoExcl)
+	require.NoError(t, err)
+	rev := ops.getCurrMDRevision(lState)
+	_, _, err = kbfsOps.CreatePath(ctx, rootNode, "h/g/i")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreatePath(ctx, rootNode, "g/i")
+	require.IsType(t, NotDirError{}, errors.Cause(err))
+	require.Equal(t, rev+1, ops.getCurrMDRevision(lState))
+
+	_, _, err = kbfsOps.CreatePath(ctx, rootNode, "a/../j")
+	require.Error(t, err)
+}
+
+func TestKBFSOpsGetDirChildrenWithNodes(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "c", "b")
+	require.NoError(t, err)
+
+	children, err := kbfsOps.GetDirChildrenWithNodes(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, Dir, children["a"].Type)
+	require.Equal(t, dirNode.GetID(), children["a"].Node.GetID())
+	require.Equal(t, File, children["b"].Type)
+	require.Equal(t, fileNode.GetID(), children["b"].Node.GetID())
+	require.Equal(t, Sym, children["c"].Type)
+	require.Nil(t, children["c"].Node)
+	require.Equal(t, "b", children["c"].SymPath)
+
+	// The entry infos match what GetDirChildren returns.
+	entries, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	for name, ei := range entries {
+		require.Equal(t, ei, children[name].EntryInfo)
+	}
+}
+
 func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
 	// TODO: Use kbfsTestShutdownNoMocks.
@@ -3107,6 +3278,58 @@ func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	}
 }
 
+type testWriteInterceptor struct {
+	data []byte
+}
+
+func (twi *testWriteInterceptor) InterceptWrite(
+	_ context.Context, _ string, chunks []WriteChunk) (WriteVerdict, error) {
+	twi.data = nil
+	for _, c := range chunks {
+		twi.data = append(twi.data, c.Data...)
+	}
+	if bytes.Contains(twi.data, []byte("EICAR")) {
+		return WriteVerdict{Reject: "test signature found"}, nil
+	}
+	return WriteVerdict{Tags: map[string]string{"scan": "clean"}}, nil
+}
+
+func TestKBFSOpsWriteInterceptor(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	twi := &testWriteInterceptor{}
+	config.SetWriteInterceptor(twi)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	t.Log("Clean data is synced, and the file is tagged")
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte("hello")
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, data, twi.data)
+	nmd, err := kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"scan": "clean"}, nmd.WriteTags)
+
+	t.Log("Rejected data fails the sync")
+	err = kbfsOps.Write(ctx, fileNode, []byte("EICAR"), 5)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.IsType(t, WriteRejectedError{}, errors.Cause(err))
+	require.Equal(t, []byte("EICAR"), twi.data)
+
+	t.Log("Removing the file drops the rejected data")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
 func TestKBFSOpsWriteRenameGetDirChildren(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
 	// TODO: Use kbfsTestShutdownNoMocks.
@@ -3156,6 +3379,166 @@ func TestKBFSOpsWriteRenameGetDirChildren(t *testing.T) {
 	}
 }
 
+// Tests that a rename between two distant directories, whose parent
+// chains get readied in parallel, leaves both directories correct.
+func TestKBFSOpsRenameAcrossDistantDirs(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	makeDirs := func(names ...string) Node {
+		n := rootNode
+		for _, name := range names {
+			var err error
+			n, _, err = kbfsOps.CreateDir(ctx, n, name)
+			require.NoError(t, err)
+		}
+		return n
+	}
+	oldParent := makeDirs("a", "b", "c", "d")
+	newParent := makeDirs("x", "y", "z")
+	fileNode, _, err := kbfsOps.CreateFile(
+		ctx, oldParent, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Rename the file, along with some other changes in both
+	// chains, and sync them all together.
+	err = kbfsOps.Rename(ctx, oldParent, "f", newParent, "g")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, oldParent, "h", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, newParent, "w")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Check the result from a different "device".
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	lookupDirs := func(names ...string) Node {
+		n := rootNode2
+		for _, name := range names {
+			var err error
+			n, _, err = kbfsOps2.Lookup(ctx, n, name)
+			require.NoError(t, err)
+		}
+		return n
+	}
+	oldParent2 := lookupDirs("a", "b", "c", "d")
+	children, err := kbfsOps2.GetDirChildren(ctx, oldParent2)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Contains(t, children, "h")
+	newParent2 := lookupDirs("x", "y", "z")
+	children, err = kbfsOps2.GetDirChildren(ctx, newParent2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Contains(t, children, "w")
+	fileNode2, ei, err := kbfsOps2.Lookup(ctx, newParent2, "g")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+}
+
+func TestKBFSOpsUpdateHistoryDeviceInfo(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+
+	createAndGetLastUpdate := func(name string) UpdateSummary {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		history, err := kbfsOps.GetUpdateHistory(
+			ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		require.NotEmpty(t, history.Updates)
+		return history.Updates[len(history.Updates)-1]
+	}
+
+	t.Log("Ops record the writing device and client version by default")
+	update := createAndGetLastUpdate("a")
+	require.NotEmpty(t, update.Ops)
+	for _, op := range update.Ops {
+		require.Equal(t, session.VerifyingKey.KID().String(), op.DeviceKID)
+		require.Equal(t, VersionString(), op.ClientVersion)
+	}
+
+	t.Log("Ops leave them out when the user opts out")
+	config.SetHideOpDeviceInfo(true)
+	update = createAndGetLastUpdate("b")
+	require.NotEmpty(t, update.Ops)
+	for _, op := range update.Ops {
+		require.Equal(t, "", op.DeviceKID)
+		require.Equal(t, "", op.ClientVersion)
+	}
+}
+
+// Tests that looking up and stat'ing single entries in a directory
+// with unsynced changes gives the same entries as listing it.
+func TestKBFSOpsLookupMatchesDirtyDirChildren(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetDoBackgroundFlushes(false)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirtyFile, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Make unsynced changes of every kind.
+	err = kbfsOps.Write(ctx, dirtyFile, []byte{1, 2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "d", "a")
+	require.NoError(t, err)
+
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	for name, childEI := range children {
+		n, ei, err := kbfsOps.Lookup(ctx, rootNode, name)
+		require.NoError(t, err)
+		require.Equal(t, childEI, ei, name)
+		if n != nil {
+			ei, err = kbfsOps.Stat(ctx, n)
+			require.NoError(t, err)
+			require.Equal(t, childEI, ei, name)
+		}
+	}
+	require.Equal(t, uint64(2), children["a"].Size)
+
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "b")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
 func TestKBFSOpsCreateFileWithArchivedBlock(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
 	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
@@ -3198,7 +3581,7 @@ func TestKBFSOpsMultiBlockSyncWithArchivedBlock(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create a file.
@@ -3253,49 +3636,289 @@ func TestKBFSOpsMultiBlockSyncWithArchivedBlock(t *testing.T) {
 	}
 }
 
-type corruptBlockServer struct {
-	BlockServer
-}
-
-func (cbs corruptBlockServer) Get(
-	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID, context kbfsblock.Context) (
-	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
-	data, keyServerHalf, err := cbs.BlockServer.Get(ctx, tlfID, id, context)
-	if err != nil {
-		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
-	}
-	return append(data, 0), keyServerHalf, nil
-}
-
-func TestKBFSOpsFailToReadUnverifiableBlock(t *testing.T) {
+func TestKBFSOpsMultiLevelWriteSyncRead(t *testing.T) {
 	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
 	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
-	config.SetBlockServer(&corruptBlockServer{
-		BlockServer: config.BlockServer(),
-	})
 
-	// create a file.
-	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	// Tiny blocks with a fan-out of two, so even a small file needs
+	// several levels of indirection.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024, 0}
+	config.SetBlockSplitter(bsplit)
 
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
 	kbfsOps := config.KBFSOps()
-	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
-	if err != nil {
-		t.Fatalf("Couldn't create file: %+v", err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	checkData := func(config Config, expected []byte) {
+		rootNode := GetRootNodeOrBust(
+			ctx, t, config, "test_user", tlf.Private)
+		fileNode, ei, err := config.KBFSOps().Lookup(ctx, rootNode, "a")
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(expected)), ei.Size)
+		gotData := make([]byte, len(expected))
+		n, err := config.KBFSOps().Read(ctx, fileNode, gotData, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(expected)), n)
+		require.Equal(t, expected, gotData)
 	}
 
-	// Read using a different "device"
+	t.Log("The file has more than two levels of indirection")
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	levels := 0
+	ptr := filePath.tailPointer()
+	for {
+		block, err := ops.blocks.GetFileBlockForReading(
+			ctx, lState, ops.getTrustedHead(lState).ReadOnly(), ptr,
+			MasterBranch, filePath)
+		require.NoError(t, err)
+		if !block.IsInd {
+			break
+		}
+		levels++
+		ptr = block.IPtrs[0].BlockPointer
+	}
+	require.True(t, levels > 2, "Only %d levels", levels)
+
+	t.Log("Another device reads it back")
 	config2 := ConfigAsUser(config, "test_user")
 	defer CheckConfigAndShutdown(ctx, t, config2)
-	// Shutdown the mdserver explicitly before the state checker tries to run
-	defer config2.MDServer().Shutdown()
+	checkData(config2, data)
 
-	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
-	// Lookup the file, which should fail on block ID verification
-	kbfsOps2 := config2.KBFSOps()
-	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
-	if _, ok := errors.Cause(err).(kbfshash.HashMismatchError); !ok {
-		t.Fatalf("Could unexpectedly lookup the file: %+v", err)
-	}
+	t.Log("Overwrite the middle, extend the end, and sync again")
+	middle := []byte{255, 254, 253, 252, 251, 250, 249, 248, 247, 246, 245}
+	err = kbfsOps.Write(ctx, fileNode, middle, 97)
+	require.NoError(t, err)
+	copy(data[97:], middle)
+	tail := []byte{1, 2, 3, 4, 5, 6, 7}
+	err = kbfsOps.Write(ctx, fileNode, tail, int64(len(data)))
+	require.NoError(t, err)
+	data = append(data, tail...)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(
+		ctx, rootNode.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	checkData(config2, data)
+
+	t.Log("Truncate away most of the levels")
+	err = kbfsOps.Truncate(ctx, fileNode, 12)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(
+		ctx, rootNode.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	checkData(config2, data[:12])
+}
+
+// Tests that sequential reads of a file fetch the blocks ahead of
+// them in the background, as far as the tuning profile's read-ahead
+// allows.
+func TestKBFSOpsSequentialReadAhead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	bsplit := &BlockSplitterSimple{10, 100, 100 * 1024, 0}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	fblock, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, ops.getTrustedHead(lState).ReadOnly(),
+		filePath.tailPointer(), MasterBranch, filePath)
+	require.NoError(t, err)
+	require.True(t, fblock.IsInd)
+	require.True(t, len(fblock.IPtrs) > 4, "Only %d blocks", len(fblock.IPtrs))
+	isCached := func(i int) bool {
+		_, err := config.BlockCache().Get(fblock.IPtrs[i].BlockPointer)
+		return err == nil
+	}
+
+	config.SetDefaultReadAheadBlocks(2)
+	config.ResetCaches()
+
+	t.Log("A first read doesn't read ahead")
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	require.Equal(t, data[:10], buf)
+
+	t.Log("A sequential read fetches the next two blocks")
+	n, err = kbfsOps.Read(ctx, fileNode, buf, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	require.Equal(t, data[10:20], buf)
+	for !isCached(2) || !isCached(3) {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("Timeout waiting for read-ahead: %v", ctx.Err())
+		}
+	}
+	require.False(t, isCached(4))
+}
+
+// Tests that small files are inlined into their directory entries,
+// and spill out into blocks of their own once they grow.
+func TestKBFSOpsInlineSmallFiles(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	bsplit := &BlockSplitterSimple{100, 100, 100 * 1024, 10}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, ".a", false, NoExcl)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	getEntry := func() DirEntry {
+		rootPath := ops.nodeCache.PathFromNode(rootNode)
+		dblock, err := ops.blocks.GetDirBlockForReading(
+			ctx, lState, ops.getTrustedHead(lState).ReadOnly(),
+			rootPath.tailPointer(), MasterBranch, rootPath)
+		require.NoError(t, err)
+		de, ok := dblock.Children[".a"]
+		require.True(t, ok)
+		return de
+	}
+	writeAndSync := func(data []byte, off int64) {
+		err := kbfsOps.Write(ctx, fileNode, data, off)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+		require.NoError(t, err)
+	}
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	checkData := func(config Config, expected []byte) {
+		err := config.KBFSOps().SyncFromServerForTesting(
+			ctx, rootNode.GetFolderBranch(), nil)
+		require.NoError(t, err)
+		rootNode := GetRootNodeOrBust(
+			ctx, t, config, "test_user", tlf.Private)
+		fileNode, ei, err := config.KBFSOps().Lookup(ctx, rootNode, ".a")
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(expected)), ei.Size)
+		gotData := make([]byte, len(expected))
+		n, err := config.KBFSOps().Read(ctx, fileNode, gotData, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(expected)), n)
+		require.Equal(t, expected, gotData)
+	}
+
+	t.Log("A small file is inlined, with no block on the server")
+	data := []byte("hello")
+	writeAndSync(data, 0)
+	de := getEntry()
+	require.Equal(t, InlineDataVer, de.DataVer)
+	require.Equal(t, data, de.InlineData)
+	_, _, err = config.BlockServer().Get(
+		ctx, rootNode.GetFolderBranch().Tlf, de.ID, de.Context)
+	require.Error(t, err)
+	config.ResetCaches()
+	checkData(config, data)
+	checkData(config2, data)
+
+	t.Log("Growing it spills the contents out into a block")
+	data = append(data, []byte(", world")...)
+	writeAndSync(data[5:], 5)
+	de = getEntry()
+	require.NotEqual(t, InlineDataVer, de.DataVer)
+	require.Nil(t, de.InlineData)
+	checkData(config2, data)
+
+	t.Log("Shrinking it inlines it again")
+	err = kbfsOps.Truncate(ctx, fileNode, 3)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+	data = data[:3]
+	de = getEntry()
+	require.Equal(t, InlineDataVer, de.DataVer)
+	require.Equal(t, data, de.InlineData)
+	checkData(config2, data)
+
+	t.Log("An inlined file can be removed")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, ".a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+type corruptBlockServer struct {
+	BlockServer
+}
+
+func (cbs corruptBlockServer) Get(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID, context kbfsblock.Context) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	data, keyServerHalf, err := cbs.BlockServer.Get(ctx, tlfID, id, context)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return append(data, 0), keyServerHalf, nil
+}
+
+func TestKBFSOpsFailToReadUnverifiableBlock(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockServer(&corruptBlockServer{
+		BlockServer: config.BlockServer(),
+	})
+
+	// create a file.
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+
+	// Read using a different "device"
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	// Shutdown the mdserver explicitly before the state checker tries to run
+	defer config2.MDServer().Shutdown()
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	// Lookup the file, which should fail on block ID verification
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if _, ok := errors.Cause(err).(kbfshash.HashMismatchError); !ok {
+		t.Fatalf("Could unexpectedly lookup the file: %+v", err)
+	}
 }
 
 // Test that the size of a single empty block doesn't change.  If this
@@ -3693,3 +4316,579 @@ func TestKBFSOpsAutocreateNodesDir(t *testing.T) {
 func TestKBFSOpsAutocreateNodesSym(t *testing.T) {
 	testKBFSOpsAutocreateNodes(t, Sym, "sympath")
 }
+
+func TestKBFSOpsShutdownWithFlush(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	t.Log("Shutting down with a flush should leave nothing dirty")
+	dirty, err := config.KBFSOps().(*KBFSOpsStandard).ShutdownWithFlush(
+		ctx, individualTestTimeout, false)
+	require.NoError(t, err)
+	require.Len(t, dirty, 0)
+
+	t.Log("A second shutdown is a no-op")
+	err = config.KBFSOps().Shutdown(ctx)
+	require.NoError(t, err)
+
+	t.Log("Another device sees the flushed data")
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := config2.KBFSOps().Read(ctx, fileNode2, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+}
+
+func TestKBFSOpsShutdownWithFlushForced(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	// The dirty data is abandoned on purpose, so skip the state check.
+	defer kbfsTestShutdownNoMocksNoCheck(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	dirty, err := config.KBFSOps().(*KBFSOpsStandard).ShutdownWithFlush(
+		ctx, individualTestTimeout, true)
+	require.NoError(t, err)
+	require.Len(t, dirty, 1)
+	require.Contains(t, dirty[rootNode.GetFolderBranch()], "test_user/a")
+}
+
+func TestKBFSOpsShutdownRecordsPendingChanges(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	// The dirty data is abandoned on purpose, so skip the state check.
+	defer kbfsTestShutdownNoMocksNoCheck(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "pending_changes")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	t.Log("Abandoning dirty data records it under the storage root")
+	fs := config.KBFSOps().(*KBFSOpsStandard)
+	_, err = fs.ShutdownWithFlush(ctx, individualTestTimeout, true)
+	require.NoError(t, err)
+	_, err = ioutil.Stat(pendingChangesPath(tempdir))
+	require.NoError(t, err)
+
+	t.Log("The next start reports the lost changes, just once")
+	err = fs.ReportPendingChanges(ctx)
+	require.NoError(t, err)
+	errs := config.Reporter().AllKnownErrors()
+	require.Len(t, errs, 1)
+	lost, ok := errs[0].Error.(UnsyncedChangesLostError)
+	require.True(t, ok)
+	require.Equal(t, tlf.CanonicalName("test_user"), lost.Tlf)
+	require.Equal(t, []string{"test_user/a"}, lost.Paths)
+	_, err = ioutil.Stat(pendingChangesPath(tempdir))
+	require.True(t, ioutil.IsNotExist(err))
+	err = fs.ReportPendingChanges(ctx)
+	require.NoError(t, err)
+	require.Len(t, config.Reporter().AllKnownErrors(), 1)
+}
+
+func TestKBFSOpsQuarantine(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("The server quarantines the TLF, but still allows reads")
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	err = ops.noteQuarantine(ctx, kbfsmd.ServerErrorTlfQuarantined{
+		Reason:       "legal hold",
+		ReadsAllowed: true,
+	})
+	expectedErr := QuarantinedError{
+		Tlf:    tlf.CanonicalName("test_user"),
+		Reason: "legal hold",
+	}
+	require.Equal(t, expectedErr, err)
+	errs := config.Reporter().AllKnownErrors()
+	require.Len(t, errs, 1)
+	require.Equal(t, expectedErr, errs[0].Error)
+
+	t.Log("Writes fail")
+	err = kbfsOps.Write(ctx, fileNode, data, 3)
+	require.Equal(t, expectedErr, errors.Cause(err))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.Equal(t, expectedErr, errors.Cause(err))
+
+	t.Log("Reads still work")
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+
+	t.Log("Until the server blocks them too, which is only reported once")
+	_ = ops.noteQuarantine(ctx, kbfsmd.ServerErrorTlfQuarantined{
+		Reason: "legal hold",
+	})
+	_, err = kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.Equal(t, expectedErr, errors.Cause(err))
+	require.Len(t, config.Reporter().AllKnownErrors(), 1)
+}
+
+func TestKBFSOpsEvictIdleOps(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "test_user", tlf.Private)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	tlfID, err := kbfsOps.GetTLFID(ctx, h)
+	require.NoError(t, err)
+	fb := FolderBranch{Tlf: tlfID, Branch: MasterBranch}
+	oldOps := getOps(config, tlfID)
+
+	timeout := time.Minute
+	now := config.Clock().Now()
+
+	t.Log("Nothing is evicted before the timeout")
+	require.Equal(t, 0, kbfsOps.evictIdleOps(ctx, now, timeout))
+
+	t.Log("Held folder-branches are never evicted")
+	release := kbfsOps.HoldFolderBranch(fb)
+	require.Equal(t, 0, kbfsOps.evictIdleOps(ctx, now.Add(2*timeout), timeout))
+	release()
+	release()
+
+	t.Log("A lookup racing with the idleness check prevents eviction")
+	require.Equal(t, oldOps, kbfsOps.getOpsNoAdd(ctx, fb))
+	require.False(t, kbfsOps.removeOpsForEviction(
+		fb, oldOps, config.Clock().Now(), timeout))
+
+	t.Log("Idle folder-branches are evicted")
+	require.Equal(t, 1, kbfsOps.evictIdleOps(ctx, now.Add(2*timeout), timeout))
+	kbfsOps.opsLock.RLock()
+	require.NotContains(t, kbfsOps.ops, fb)
+	require.NotContains(t, kbfsOps.opsByFav, h.ToFavorite())
+	kbfsOps.opsLock.RUnlock()
+
+	t.Log("The folder-branch is re-created on the next access")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	require.Equal(t, fb, rootNode.GetFolderBranch())
+	require.NotEqual(t, oldOps, getOps(config, tlfID))
+
+	t.Log("Live nodes prevent eviction")
+	require.Equal(t, 0, kbfsOps.evictIdleOps(
+		ctx, config.Clock().Now().Add(2*timeout), timeout))
+	require.Equal(t, fb, rootNode.GetFolderBranch())
+}
+
+func TestKBFSOpsEvictLRUOps(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+
+	var fbs []FolderBranch
+	for _, name := range []string{"u1,u2", "u1#u2", "u1"} {
+		h, err := ParseTlfHandle(
+			ctx, config.KBPKI(), config.MDOps(), name, tlf.Private)
+		require.NoError(t, err)
+		tlfID, err := kbfsOps.GetTLFID(ctx, h)
+		require.NoError(t, err)
+		fbs = append(fbs, FolderBranch{Tlf: tlfID, Branch: MasterBranch})
+	}
+	// Access them in order, a minute apart, so the last one is the
+	// most recently used.
+	for _, fb := range fbs {
+		clock.Add(time.Minute)
+		getOps(config, fb.Tlf).updateLastGetHeadTimestamp()
+	}
+	now := clock.Now()
+	kbfsOps.opsLock.RLock()
+	numOps := len(kbfsOps.ops)
+	kbfsOps.opsLock.RUnlock()
+
+	t.Log("The least recently used folder-branch is evicted first")
+	require.Equal(t, 1, kbfsOps.evictLRUOps(ctx, now, numOps-1))
+	kbfsOps.opsLock.RLock()
+	require.NotContains(t, kbfsOps.ops, fbs[0])
+	require.Contains(t, kbfsOps.ops, fbs[1])
+	require.Contains(t, kbfsOps.ops, fbs[2])
+	kbfsOps.opsLock.RUnlock()
+
+	t.Log("Recently used folder-branches aren't evicted, even over the cap")
+	kbfsOps.evictLRUOps(ctx, now, 0)
+	kbfsOps.opsLock.RLock()
+	require.NotContains(t, kbfsOps.ops, fbs[1])
+	require.Contains(t, kbfsOps.ops, fbs[2])
+	require.True(t, kbfsOps.evictedOps[fbs[0]])
+	kbfsOps.opsLock.RUnlock()
+
+	t.Log("Re-opening a folder-branch clears its eviction")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1,u2", tlf.Private)
+	require.Equal(t, fbs[0], rootNode.GetFolderBranch())
+	kbfsOps.opsLock.RLock()
+	require.False(t, kbfsOps.evictedOps[fbs[0]])
+	kbfsOps.opsLock.RUnlock()
+}
+
+func TestKBFSOpsAnonymousPublicRead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	t.Log("u1 writes a file to its public and private TLFs")
+	data := []byte{1, 2, 3, 4, 5}
+	for _, ty := range []tlf.Type{tlf.Public, tlf.Private} {
+		rootNode := GetRootNodeOrBust(ctx, t, config, "u1", ty)
+		kbfsOps := config.KBFSOps()
+		fileNode, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, "a", false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, data, 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+	}
+
+	config2 := ConfigAsAnonymous(config)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	_, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.IsType(t, NoCurrentSessionError{}, err)
+
+	t.Log("An anonymous reader can read the public TLF")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Public)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+
+	t.Log("But it can't write to it")
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.IsType(t, NoCurrentSessionError{}, errors.Cause(err))
+
+	t.Log("Nor read the private TLF")
+	_, err = ParseTlfHandle(
+		ctx, config2.KBPKI(), config2.MDOps(), "u1", tlf.Private)
+	require.IsType(t, NoCurrentSessionError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsCrossTlfMove(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1", "u2")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	kbfsOps := config.KBFSOps()
+
+	srcRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Public)
+	dstRoot := GetRootNodeOrBust(ctx, t, config, "u1,u2", tlf.Public)
+	privRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+
+	data := []byte{1, 2, 3, 4, 5}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, srcRoot, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, srcRoot.GetFolderBranch())
+	require.NoError(t, err)
+
+	checkMoved := func(from Node, fromName string, to Node, toName string) {
+		_, _, err := kbfsOps.Lookup(ctx, from, fromName)
+		require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+		node, ei, err := kbfsOps.Lookup(ctx, to, toName)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(data)), ei.Size)
+		gotData := make([]byte, len(data))
+		n, err := kbfsOps.Read(ctx, node, gotData, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+		require.Equal(t, data, gotData)
+	}
+
+	srcOps := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(
+		ctx, srcRoot.GetFolderBranch())
+	filePtr := srcOps.nodeCache.PathFromNode(fileNode).tailPointer()
+
+	t.Log("Moving between public TLFs transfers the block references")
+	err = kbfsOps.CrossTlfMove(ctx, srcRoot, "a", dstRoot, "b")
+	require.NoError(t, err)
+	checkMoved(srcRoot, "a", dstRoot, "b")
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	srcRefs, err := bserverLocal.getAllRefsForTest(
+		ctx, srcRoot.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+	require.NotContains(t, srcRefs, filePtr.ID)
+	dstRefs, err := bserverLocal.getAllRefsForTest(
+		ctx, dstRoot.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+	require.Contains(t, dstRefs, filePtr.ID)
+
+	t.Log("Moving to a private TLF copies the file instead")
+	err = kbfsOps.CrossTlfMove(ctx, dstRoot, "b", privRoot, "c")
+	require.NoError(t, err)
+	checkMoved(dstRoot, "b", privRoot, "c")
+}
+
+func TestKBFSOpsReaderMDChangeValidation(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := u1.String() + "#" + u2.String()
+	GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	ops2 := config2.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(
+		ctx, rootNode2.GetFolderBranch())
+	lState := makeFBOLockState()
+	ops2.mdWriterLock.Lock(lState)
+	defer ops2.mdWriterLock.Unlock(lState)
+	head, _ := ops2.getHead(lState)
+
+	t.Log("A reader may copy the writer metadata and set the rekey bit")
+	md, _, _, err := ops2.getMDForRekeyWriteLocked(ctx, lState)
+	require.NoError(t, err)
+	require.NoError(t, ops2.checkReaderMDChange(ctx, md, head))
+	md.SetRekeyBit()
+	require.NoError(t, ops2.checkReaderMDChange(ctx, md, head))
+
+	t.Log("A reader may not change writer metadata")
+	md.SetUnrefBytes(md.UnrefBytes() + 1)
+	err = ops2.checkReaderMDChange(ctx, md, head)
+	require.IsType(t, ReaderMDChangeError{}, errors.Cause(err))
+
+	t.Log("A reader may only put a successor of the head")
+	md, _, _, err = ops2.getMDForRekeyWriteLocked(ctx, lState)
+	require.NoError(t, err)
+	md.SetPrevRoot(kbfsmd.FakeID(1))
+	err = ops2.checkReaderMDChange(ctx, md, head)
+	require.IsType(t, ReaderMDChangeError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsReadOnlyMode(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := configAsUserWithMode(config1, u1, InitReadOnly)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := u1.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	ops2 := kbfsOps2.(*KBFSOpsStandard).getOpsNoAdd(
+		ctx, rootNode2.GetFolderBranch())
+	require.Nil(t, ops2.blocks.dirtyFiles)
+	require.Nil(t, ops2.blocks.deCache)
+
+	t.Log("A read-only config can't write")
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte{2}, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+
+	t.Log("But it sees new writes, and evicts replaced heads")
+	lState := makeFBOLockState()
+	oldHead, _ := ops2.getHead(lState)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(
+		ctx, rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	data := make([]byte, 1)
+	_, err = kbfsOps2.Read(ctx, fileNode2, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, data)
+	_, err = config2.MDCache().Get(
+		oldHead.TlfID(), oldHead.Revision(), oldHead.BID())
+	require.IsType(t, NoSuchMDError{}, err)
+}
+
+func benchmarkKBFSOpsSyncAll(b *testing.B, depth int) {
+	config := MakeTestConfigOrBust(noLogTB{b}, "test_user")
+	ctx, err := NewContextWithCancellationDelayer(NewContextReplayable(
+		context.Background(), func(c context.Context) context.Context {
+			return c
+		}))
+	require.NoError(b, err)
+	defer func() {
+		config.Shutdown(ctx)
+		CleanupCancellationDelayer(ctx)
+	}()
+	config.SetDoBackgroundFlushes(false)
+
+	// Make a file at the given depth, so that each sync has to ready
+	// a new block for every directory along its path.
+	dir := GetRootNodeOrBust(ctx, b, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	for i := 0; i < depth; i++ {
+		dir, _, err = kbfsOps.CreateDir(ctx, dir, fmt.Sprintf("d%d", i))
+		require.NoError(b, err)
+	}
+	file, _, err := kbfsOps.CreateFile(ctx, dir, "f", false, NoExcl)
+	require.NoError(b, err)
+	err = kbfsOps.SyncAll(ctx, file.GetFolderBranch())
+	require.NoError(b, err)
+
+	data := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data[0] = byte(i)
+		err = kbfsOps.Write(ctx, file, data, 0)
+		require.NoError(b, err)
+		err = kbfsOps.SyncAll(ctx, file.GetFolderBranch())
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkKBFSOpsSyncAll(b *testing.B) {
+	for _, depth := range []int{1, 10} {
+		depth := depth // capture range variable.
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkKBFSOpsSyncAll(b, depth)
+		})
+	}
+}
+
+func benchmarkKBFSOpsLookupInDirtyDir(b *testing.B, numEntries int) {
+	config := MakeTestConfigOrBust(noLogTB{b}, "test_user")
+	ctx, err := NewContextWithCancellationDelayer(NewContextReplayable(
+		context.Background(), func(c context.Context) context.Context {
+			return c
+		}))
+	require.NoError(b, err)
+	defer func() {
+		config.Shutdown(ctx)
+		CleanupCancellationDelayer(ctx)
+	}()
+	config.SetDoBackgroundFlushes(false)
+
+	rootNode := GetRootNodeOrBust(ctx, b, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	var dirtyFile Node
+	for i := 0; i < numEntries; i++ {
+		file, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, fmt.Sprintf("f%d", i), false, NoExcl)
+		require.NoError(b, err)
+		if i == 0 {
+			dirtyFile = file
+		}
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(b, err)
+
+	// Leave one file in the directory dirty, so every lookup has to
+	// account for its dirty entry.
+	err = kbfsOps.Write(ctx, dirtyFile, []byte{1}, 0)
+	require.NoError(b, err)
+
+	name := fmt.Sprintf("f%d", numEntries-1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, _, err := kbfsOps.Lookup(ctx, rootNode, name)
+		require.NoError(b, err)
+		_, err = kbfsOps.Stat(ctx, n)
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkKBFSOpsLookupInDirtyDir(b *testing.B) {
+	for _, numEntries := range []int{10, 1000} {
+		numEntries := numEntries // capture range variable.
+		b.Run(fmt.Sprintf("entries=%d", numEntries), func(b *testing.B) {
+			benchmarkKBFSOpsLookupInDirtyDir(b, numEntries)
+		})
+	}
+}
+
+func TestKBFSOpsLookupFetchesDirSpeculatively(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	t.Log("Make a directory with a file in it")
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, u1.String(), tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps1.CreateFile(ctx, dirNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	dirDE, err := ops1.statEntry(ctx, dirNode)
+	require.NoError(t, err)
+	fileDE, err := ops1.statEntry(ctx, fileNode)
+	require.NoError(t, err)
+
+	t.Log("Looking up the directory on a fresh device fetches its " +
+		"block and its children's blocks")
+	config2 := ConfigAsUser(config1, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	_, _, err = config2.KBFSOps().Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	ops2 := getOps(config2, rootNode2.GetFolderBranch().Tlf)
+	err = ops2.speculativeFetches.Wait(ctx)
+	require.NoError(t, err)
+	_, err = config2.BlockCache().Get(dirDE.BlockPointer)
+	require.NoError(t, err, "The directory block was never fetched")
+	_, err = config2.BlockCache().Get(fileDE.BlockPointer)
+	require.NoError(t, err, "The file block was never fetched")
+}
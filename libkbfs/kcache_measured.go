@@ -25,12 +25,12 @@ var _ KeyCache = KeyCacheMeasured{}
 // NewKeyCacheMeasured creates and returns a new KeyCacheMeasured
 // instance with the given delegate and registry.
 func NewKeyCacheMeasured(delegate KeyCache, r metrics.Registry) KeyCacheMeasured {
-	getTimer := metrics.GetOrRegisterTimer("KeyCache.GetTLFCryptKey", r)
+	getTimer := metrics.GetOrRegisterTimer(keyCacheGetTimerName, r)
 	putTimer := metrics.GetOrRegisterTimer("KeyCache.PutTLFCryptKey", r)
 	// TODO: Implement RatioGauge (
 	// http://metrics.dropwizard.io/3.1.0/manual/core/#ratio-gauges
 	// ) so we can actually display a hit ratio.
-	hitCountMeter := metrics.GetOrRegisterMeter("KeyCache.HitCount", r)
+	hitCountMeter := metrics.GetOrRegisterMeter(keyCacheHitMeterName, r)
 	return KeyCacheMeasured{
 		delegate:      delegate,
 		getTimer:      getTimer,
@@ -61,3 +61,13 @@ func (b KeyCacheMeasured) PutTLFCryptKey(
 	})
 	return err
 }
+
+// Clear implements the KeyCache interface for KeyCacheMeasured.
+func (b KeyCacheMeasured) Clear() {
+	b.delegate.Clear()
+}
+
+// ClearTLF implements the KeyCache interface for KeyCacheMeasured.
+func (b KeyCacheMeasured) ClearTLF(tlfID tlf.ID) {
+	b.delegate.ClearTLF(tlfID)
+}
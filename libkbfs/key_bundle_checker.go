@@ -0,0 +1,144 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// DeviceKeyMismatch identifies a device whose presence in a TLF's
+// latest key generation doesn't match the set of current devices of
+// its user.
+type DeviceKeyMismatch struct {
+	UID      keybase1.UID
+	Key      kbfscrypto.CryptPublicKey
+	IsWriter bool
+}
+
+// KeyBundleCheckResult is the result of checking the key bundles of
+// a TLF against the current devices of its writers and readers.
+type KeyBundleCheckResult struct {
+	KeyGen kbfsmd.KeyGen
+	// Missing lists current devices that have no key in the latest
+	// key generation.  Those devices can't read the TLF until it is
+	// rekeyed.
+	Missing []DeviceKeyMismatch
+	// Stale lists devices with keys in the latest key generation
+	// that are no longer current (e.g., because they were revoked).
+	Stale []DeviceKeyMismatch
+	// RekeyEnqueued is true if a rekey was requested to fix up the
+	// key bundles.
+	RekeyEnqueued bool
+}
+
+// Consistent returns true if the key bundles exactly match the
+// current devices of the TLF's users.
+func (r KeyBundleCheckResult) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0
+}
+
+// findKeyMismatches appends, to `mismatches`, every device in `keys`
+// that isn't in `other`.
+func findKeyMismatches(mismatches []DeviceKeyMismatch,
+	keys, other kbfsmd.UserDevicePublicKeys,
+	isWriter bool) []DeviceKeyMismatch {
+	for uid, deviceKeys := range keys {
+		for key := range deviceKeys {
+			if !other[uid][key] {
+				mismatches = append(mismatches, DeviceKeyMismatch{
+					UID:      uid,
+					Key:      key,
+					IsWriter: isWriter,
+				})
+			}
+		}
+	}
+	return mismatches
+}
+
+func sortKeyMismatches(mismatches []DeviceKeyMismatch) {
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].UID != mismatches[j].UID {
+			return mismatches[i].UID < mismatches[j].UID
+		}
+		return mismatches[i].Key.KID() < mismatches[j].Key.KID()
+	})
+}
+
+// CheckKeyBundles checks that every resolved writer and reader of the
+// given TLF has keys for all of their current devices in the TLF's
+// latest key generation, and that no other devices do.  If
+// `enqueueRekey` is true and the key bundles aren't consistent, a
+// rekey of the TLF is enqueued.  Only private TLFs have key bundles;
+// for other TLFs the result is always consistent.
+//
+// The device lists come from KBPKI's cache, so recently-added or
+// revoked devices might not be noticed right away.
+func CheckKeyBundles(ctx context.Context, config Config, tlfID tlf.ID,
+	enqueueRekey bool) (KeyBundleCheckResult, error) {
+	md, err := config.MDOps().GetForTLF(ctx, tlfID, nil)
+	if err != nil {
+		return KeyBundleCheckResult{}, err
+	}
+	if md == (ImmutableRootMetadata{}) ||
+		md.TypeForKeying() != tlf.PrivateKeying {
+		return KeyBundleCheckResult{}, nil
+	}
+
+	res := KeyBundleCheckResult{KeyGen: md.LatestKeyGeneration()}
+	bundleWriterKeys, bundleReaderKeys, err := md.getUserDevicePublicKeys()
+	if err != nil {
+		return KeyBundleCheckResult{}, err
+	}
+
+	getCurrentKeys := func(users []keybase1.UserOrTeamID) (
+		kbfsmd.UserDevicePublicKeys, error) {
+		keys := make(kbfsmd.UserDevicePublicKeys, len(users))
+		for _, u := range users {
+			uid := u.AsUserOrBust() // only private TLFs get here
+			publicKeys, err := config.KBPKI().GetCryptPublicKeys(ctx, uid)
+			if err != nil {
+				return nil, err
+			}
+			keys[uid] = make(kbfsmd.DevicePublicKeys, len(publicKeys))
+			for _, key := range publicKeys {
+				keys[uid][key] = true
+			}
+		}
+		return keys, nil
+	}
+	handle := md.GetTlfHandle()
+	currWriterKeys, err := getCurrentKeys(handle.ResolvedWriters())
+	if err != nil {
+		return KeyBundleCheckResult{}, err
+	}
+	currReaderKeys, err := getCurrentKeys(handle.ResolvedReaders())
+	if err != nil {
+		return KeyBundleCheckResult{}, err
+	}
+
+	res.Missing = findKeyMismatches(
+		res.Missing, currWriterKeys, bundleWriterKeys, true)
+	res.Missing = findKeyMismatches(
+		res.Missing, currReaderKeys, bundleReaderKeys, false)
+	res.Stale = findKeyMismatches(
+		res.Stale, bundleWriterKeys, currWriterKeys, true)
+	res.Stale = findKeyMismatches(
+		res.Stale, bundleReaderKeys, currReaderKeys, false)
+	sortKeyMismatches(res.Missing)
+	sortKeyMismatches(res.Stale)
+
+	if enqueueRekey && !res.Consistent() {
+		config.RekeyQueue().Enqueue(tlfID)
+		res.RekeyEnqueued = true
+	}
+	return res, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKeyBundles(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+
+	name := u1.String() + "#" + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	tlfID := rootNode1.GetFolderBranch().Tlf
+	sc := NewStateChecker(config1)
+
+	t.Log("A freshly-created TLF is consistent")
+	res, err := CheckKeyBundles(ctx, config1, tlfID, false)
+	require.NoError(t, err)
+	require.True(t, res.Consistent())
+	require.NoError(t, sc.CheckKeyBundles(ctx, tlfID))
+
+	t.Log("A new reader device is missing until the TLF is rekeyed")
+	devIndex := AddDeviceForLocalUserOrBust(t, config1, uid2)
+	keys, err := config1.KBPKI().GetCryptPublicKeys(ctx, uid2)
+	require.NoError(t, err)
+	newKey := keys[devIndex]
+	res, err = CheckKeyBundles(ctx, config1, tlfID, false)
+	require.NoError(t, err)
+	require.Equal(t, []DeviceKeyMismatch{{UID: uid2, Key: newKey}},
+		res.Missing)
+	require.Len(t, res.Stale, 0)
+	require.False(t, res.RekeyEnqueued)
+	require.Error(t, sc.CheckKeyBundles(ctx, tlfID))
+
+	_, err = RequestRekeyAndWaitForOneFinishEvent(
+		ctx, config1.KBFSOps(), tlfID)
+	require.NoError(t, err)
+	res, err = CheckKeyBundles(ctx, config1, tlfID, false)
+	require.NoError(t, err)
+	require.True(t, res.Consistent())
+
+	t.Log("A revoked device is stale, and a rekey can be enqueued for it")
+	RevokeDeviceForLocalUserOrBust(t, config1, uid2, devIndex)
+	res, err = CheckKeyBundles(ctx, config1, tlfID, true)
+	require.NoError(t, err)
+	require.Len(t, res.Missing, 0)
+	require.Equal(t, []DeviceKeyMismatch{{UID: uid2, Key: newKey}},
+		res.Stale)
+	require.True(t, res.RekeyEnqueued)
+}
@@ -71,6 +71,25 @@ func (km *KeyManagerStandard) GetTLFCryptKeyOfAllGenerations(
 	return keys, nil
 }
 
+// RecoverTLFCryptKeys implements the KeyManager interface for
+// KeyManagerStandard.
+func (km *KeyManagerStandard) RecoverTLFCryptKeys(
+	ctx context.Context, kmd KeyMetadata) error {
+	if kmd.TypeForKeying() != tlf.PrivateKeying {
+		return errors.Errorf("Can't recover keys for a TLF with %s",
+			kmd.TypeForKeying())
+	}
+	flags := getTLFCryptKeyAnyDevice | getTLFCryptKeyPromptPaper |
+		getTLFCryptKeyDoCache
+	for g := kbfsmd.FirstValidKeyGen; g <= kmd.LatestKeyGeneration(); g++ {
+		_, err := km.getTLFCryptKey(ctx, kmd, g, flags)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (km *KeyManagerStandard) getTLFCryptKeyUsingCurrentDevice(
 	ctx context.Context, kmd KeyMetadata, keyGen kbfsmd.KeyGen, cache bool) (
 	tlfCryptKey kbfscrypto.TLFCryptKey, err error) {
@@ -338,6 +357,8 @@ func (km *KeyManagerStandard) unmaskTLFCryptKey(ctx context.Context, serverHalfI
 	if err != nil {
 		return kbfscrypto.TLFCryptKey{}, err
 	}
+	defer serverHalf.Zero()
+	defer clientHalf.Zero()
 	tlfCryptKey := kbfscrypto.UnmaskTLFCryptKey(serverHalf, clientHalf)
 	return tlfCryptKey, nil
 }
@@ -366,6 +387,7 @@ func (km *KeyManagerStandard) updateKeyBundles(ctx context.Context,
 			PutTLFCryptKeyServerHalves(ctx, serverHalvesGen); err != nil {
 			return err
 		}
+		getRekeyProgress(ctx).uploadedServerHalves(ctx, serverHalvesGen)
 	}
 
 	return nil
@@ -473,6 +495,20 @@ func (km *KeyManagerStandard) generateKeyMapForUsers(
 	return keyMap, nil
 }
 
+// countNewDevices returns the number of devices in `updated` that
+// aren't in `curr`.
+func countNewDevices(curr, updated kbfsmd.UserDevicePublicKeys) int {
+	n := 0
+	for u, deviceKeys := range updated {
+		for key := range deviceKeys {
+			if !curr[u][key] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
 // Rekey implements the KeyManager interface for KeyManagerStandard.
 //
 // TODO: Make this less terrible. See KBFS-1799.
@@ -599,6 +635,7 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 	// If we're already incrementing the key generation then we don't need to
 	// figure out the key delta.
 	addNewReaderDeviceForSelf := false
+	var currWriterKeys, currReaderKeys kbfsmd.UserDevicePublicKeys
 	if !incKeyGen {
 		// See if there is at least one new device in relation to the
 		// current key bundle
@@ -606,6 +643,7 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 		if err != nil {
 			return false, nil, err
 		}
+		currWriterKeys, currReaderKeys = writers, readers
 
 		newWriterUsers = km.usersWithNewDevices(
 			ctx, md.TlfID(), writers, updatedWriterKeys)
@@ -680,6 +718,15 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 		}
 	}
 
+	// A new key generation needs server halves for every device;
+	// otherwise only the new devices need them.
+	if incKeyGen {
+		currWriterKeys, currReaderKeys = nil, nil
+	}
+	getRekeyProgress(ctx).start(ctx,
+		countNewDevices(currWriterKeys, updatedWriterKeys)+
+			countNewDevices(currReaderKeys, updatedReaderKeys))
+
 	// If promotedReader is non-empty, then isWriter is true (see
 	// check above).
 	err = md.promoteReaders(readersToPromote)
@@ -796,8 +843,8 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 	// there are any previous key generations. Do this before
 	// adding a new key generation, as MDv3 only keeps track of
 	// the latest key generation.
-	//
-	// TODO: Add test coverage for this.
+	// The purged devices are recorded in the rekeyOp of the
+	// resulting MD.
 	if currKeyGen >= kbfsmd.FirstValidKeyGen {
 		allRemovalInfo, err := md.revokeRemovedDevices(
 			updatedWriterKeys, updatedReaderKeys)
@@ -827,6 +874,8 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 						return false, nil, err
 					}
 				}
+				getRekeyProgress(ctx).purgedServerHalves(
+					ctx, uid, key, len(serverHalfIDs))
 			}
 		}
 	}
@@ -865,6 +914,7 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 	if err != nil {
 		return false, nil, err
 	}
+	getRekeyProgress(ctx).uploadedServerHalves(ctx, serverHalves)
 
 	return true, &tlfCryptKey, nil
 }
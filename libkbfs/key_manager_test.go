@@ -176,6 +176,11 @@ func (kmd emptyKeyMetadata) GetTLFCryptKeyParams(
 		kbfscrypto.TLFCryptKeyServerHalfID{}, false, nil
 }
 
+func (kmd emptyKeyMetadata) GetLatestDataEncryptionVer() (
+	kbfscrypto.EncryptionVer, error) {
+	return kbfscrypto.EncryptionSecretbox, nil
+}
+
 func (kmd emptyKeyMetadata) StoresHistoricTLFCryptKeys() bool {
 	return false
 }
@@ -2233,6 +2238,107 @@ func testKeyManagerRekeyAddDeviceWithPromptViaFolderAccess(t *testing.T, ver kbf
 	GetRootNodeOrBust(ctx, t, config2Dev2, name, tlf.Private)
 }
 
+// Test that rekey progress is tracked and exposed per TLF.
+func testKeyManagerRekeyProgress(t *testing.T, ver kbfsmd.MetadataVer) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config1.SetMetadataVersion(ver)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	tlfID := rootNode1.GetFolderBranch().Tlf
+	kbfsOps1 := config1.KBFSOps().(*KBFSOpsStandard)
+
+	t.Log("Creating the TLF isn't a rekey")
+	status := kbfsOps1.RekeyStatus(ctx, tlfID)
+	require.Equal(t, RekeyStatus{}, status)
+
+	t.Log("Give u2 a new device, and rekey it in")
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	_, err = RequestRekeyAndWaitForOneFinishEvent(ctx, kbfsOps1, tlfID)
+	require.NoError(t, err)
+
+	status = kbfsOps1.RekeyStatus(ctx, tlfID)
+	require.False(t, status.InProgress)
+	require.Equal(t, 1, status.DevicesTotal)
+	require.Equal(t, 1, status.DevicesProcessed)
+	require.NotZero(t, status.KeyHalvesUploaded)
+	require.False(t, status.StartTime.IsZero())
+	require.False(t, status.EndTime.IsZero())
+	require.Equal(t, "", status.LastErr)
+
+	t.Log("The folder status includes the rekey status")
+	fbs, _, err := kbfsOps1.FolderStatus(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	require.NotNil(t, fbs.Rekey)
+	require.Equal(t, status, *fbs.Rekey)
+
+	t.Log("Rekeying again with no changes leaves the status alone")
+	_, err = RequestRekeyAndWaitForOneFinishEvent(ctx, kbfsOps1, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, status, kbfsOps1.RekeyStatus(ctx, tlfID))
+	require.Zero(t, status.DevicesPurged)
+}
+
+func testKeyManagerRekeyPurgesRevokedDevice(
+	t *testing.T, ver kbfsmd.MetadataVer) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config1.SetMetadataVersion(ver)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	tlfID := rootNode1.GetFolderBranch().Tlf
+	kbfsOps1 := config1.KBFSOps().(*KBFSOpsStandard)
+
+	t.Log("Give u2 a new device, and rekey it in")
+	devIndex := AddDeviceForLocalUserOrBust(t, config1, uid2)
+	_, err = RequestRekeyAndWaitForOneFinishEvent(ctx, kbfsOps1, tlfID)
+	require.NoError(t, err)
+
+	rmd, err := config1.MDOps().GetForTLF(ctx, tlfID, nil)
+	require.NoError(t, err)
+	require.NotZero(t, len(rmd.data.Changes.Ops))
+	ro, ok := rmd.data.Changes.Ops[len(rmd.data.Changes.Ops)-1].(*rekeyOp)
+	require.True(t, ok)
+	require.Len(t, ro.PurgedKeys, 0)
+
+	t.Log("Revoke the new device; the rekey purges its server halves")
+	revokedKeys, err := config1.KBPKI().GetCryptPublicKeys(ctx, uid2)
+	require.NoError(t, err)
+	revokedKey := revokedKeys[devIndex]
+	RevokeDeviceForLocalUserOrBust(t, config1, uid2, devIndex)
+	_, err = RequestRekeyAndWaitForOneFinishEvent(ctx, kbfsOps1, tlfID)
+	require.NoError(t, err)
+
+	status := kbfsOps1.RekeyStatus(ctx, tlfID)
+	require.Equal(t, 1, status.DevicesPurged)
+	require.Equal(t, "", status.LastErr)
+
+	rmd, err = config1.MDOps().GetForTLF(ctx, tlfID, nil)
+	require.NoError(t, err)
+	ro, ok = rmd.data.Changes.Ops[len(rmd.data.Changes.Ops)-1].(*rekeyOp)
+	require.True(t, ok)
+	require.Len(t, ro.PurgedKeys, 1)
+	require.Equal(t, uid2, ro.PurgedKeys[0].UID)
+	require.Equal(t, revokedKey, ro.PurgedKeys[0].Key)
+	require.Equal(t, 1, ro.PurgedKeys[0].NumServerHalves)
+}
+
 func testKeyManagerRekeyMinimal(t *testing.T, ver kbfsmd.MetadataVer) {
 	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
 	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
@@ -2466,6 +2572,70 @@ func TestKeyManagerGetPublicImplicitTeamTLFCryptKey(t *testing.T) {
 	testKeyManagerGetImplicitTeamTLFCryptKey(t, tlf.Public)
 }
 
+// cryptoLocalPaperOnly uses `paperCrypto` for
+// DecryptTLFCryptKeyClientHalfAny calls with promptPaper set, and the
+// embedded Crypto for all other calls.
+type cryptoLocalPaperOnly struct {
+	Crypto
+	paperCrypto Crypto
+}
+
+func (clpo cryptoLocalPaperOnly) DecryptTLFCryptKeyClientHalfAny(
+	ctx context.Context,
+	keys []EncryptedTLFCryptKeyClientAndEphemeral, promptPaper bool) (
+	kbfscrypto.TLFCryptKeyClientHalf, int, error) {
+	if promptPaper {
+		return clpo.paperCrypto.DecryptTLFCryptKeyClientHalfAny(
+			ctx, keys, promptPaper)
+	}
+	return clpo.Crypto.DecryptTLFCryptKeyClientHalfAny(
+		ctx, keys, promptPaper)
+}
+
+func testKeyManagerRecoverFolderAccessWithPaperKey(
+	t *testing.T, ver kbfsmd.MetadataVer) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config1, uid1, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config1.SetMetadataVersion(ver)
+
+	name := u1.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Give u1 a new device, which the TLF isn't keyed for.
+	config1Dev2 := ConfigAsUser(config1, u1)
+	defer CheckConfigAndShutdown(ctx, t, config1Dev2)
+	AddDeviceForLocalUserOrBust(t, config1, uid1)
+	devIndex := AddDeviceForLocalUserOrBust(t, config1Dev2, uid1)
+	SwitchDeviceForLocalUserOrBust(t, config1Dev2, devIndex)
+
+	// Use the first device as a standin for the paper key, which is
+	// only available when prompted for.
+	dev2Crypto := config1Dev2.Crypto()
+	config1Dev2.SetCrypto(cryptoLocalPaperOnly{dev2Crypto, config1.Crypto()})
+
+	h, err := ParseTlfHandle(
+		ctx, config1Dev2.KBPKI(), config1Dev2.MDOps(), name, tlf.Private)
+	require.NoError(t, err)
+	err = config1Dev2.KBFSOps().RecoverFolderAccess(ctx, h)
+	require.NoError(t, err)
+
+	// The recovered keys are cached, so the new device can read the
+	// TLF without the paper key.
+	config1Dev2.SetCrypto(dev2Crypto)
+	readAndCompareData(t, config1Dev2, ctx, name, data, u1)
+}
+
 func TestKeyManager(t *testing.T) {
 	tests := []func(*testing.T, kbfsmd.MetadataVer){
 		testKeyManagerPublicTLFCryptKey,
@@ -2495,6 +2665,9 @@ func TestKeyManager(t *testing.T) {
 		testKeyManagerRekeyAddDeviceWithPromptAfterRestart,
 		testKeyManagerRekeyAddDeviceWithPromptViaFolderAccess,
 		testKeyManagerRekeyMinimal,
+		testKeyManagerRekeyProgress,
+		testKeyManagerRekeyPurgesRevokedDevice,
+		testKeyManagerRecoverFolderAccessWithPaperKey,
 	}
 	runTestsOverMetadataVers(t, "testKeyManager", tests)
 }
@@ -464,6 +464,24 @@ func (k *KeybaseDaemonLocal) LoadTeamPlusKeys(
 	return infoCopy, nil
 }
 
+// IsCurrentUserTeamAdmin implements KeybaseDaemon for
+// KeybaseDaemonLocal.  Local teams don't have admins, so their
+// writers are treated as admins.
+func (k *KeybaseDaemonLocal) IsCurrentUserTeamAdmin(
+	ctx context.Context, tid keybase1.TeamID) (bool, error) {
+	if err := checkContext(ctx); err != nil {
+		return false, err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	t, err := k.localTeams.getLocalTeam(tid)
+	if err != nil {
+		return false, err
+	}
+	return t.Writers[k.currentUID], nil
+}
+
 // CreateTeamTLF implements the KBPKI interface for
 // KeybaseDaemonLocal.
 func (k *KeybaseDaemonLocal) CreateTeamTLF(
@@ -519,6 +537,10 @@ func (k *KeybaseDaemonLocal) CurrentSession(ctx context.Context, sessionID int)
 
 	k.lock.Lock()
 	defer k.lock.Unlock()
+	if k.currentUID == keybase1.UID("") {
+		// Mimic a logged-out keybase service.
+		return SessionInfo{}, NoCurrentSessionError{}
+	}
 	u, err := k.localUsers.getLocalUser(k.currentUID)
 	if err != nil {
 		return SessionInfo{}, err
@@ -0,0 +1,23 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// keybaseServiceAnonymous delegates to another KeybaseService, but
+// acts as if no user is logged in, even if one is.  A Config using it
+// can read public TLFs, but nothing else.
+type keybaseServiceAnonymous struct {
+	KeybaseService
+}
+
+var _ KeybaseService = keybaseServiceAnonymous{}
+
+// CurrentSession implements the KeybaseService interface for
+// keybaseServiceAnonymous.
+func (k keybaseServiceAnonymous) CurrentSession(
+	ctx context.Context, sessionID int) (SessionInfo, error) {
+	return SessionInfo{}, NoCurrentSessionError{}
+}
@@ -671,6 +671,24 @@ func (k *KeybaseServiceBase) LoadTeamPlusKeys(
 	return info, nil
 }
 
+// IsCurrentUserTeamAdmin implements the KeybaseService interface for
+// KeybaseServiceBase.
+func (k *KeybaseServiceBase) IsCurrentUserTeamAdmin(
+	ctx context.Context, tid keybase1.TeamID) (bool, error) {
+	teamInfo, err := k.LoadTeamPlusKeys(
+		ctx, tid, kbfsmd.UnspecifiedKeyGen, keybase1.UserVersion{},
+		keybase1.TeamRole_NONE)
+	if err != nil {
+		return false, err
+	}
+	// Only admins and owners can manage a team's members.
+	ops, err := k.teamsClient.CanUserPerform(ctx, string(teamInfo.Name))
+	if err != nil {
+		return false, err
+	}
+	return ops.ManageMembers, nil
+}
+
 // CreateTeamTLF implements the KBPKI interface for
 // KeybaseServiceBase.
 func (k *KeybaseServiceBase) CreateTeamTLF(
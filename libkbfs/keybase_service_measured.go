@@ -23,6 +23,7 @@ type KeybaseServiceMeasured struct {
 	resolveImplicitTeamByIDTimer     metrics.Timer
 	loadUserPlusKeysTimer            metrics.Timer
 	loadTeamPlusKeysTimer            metrics.Timer
+	isCurrentUserTeamAdminTimer      metrics.Timer
 	loadUnverifiedKeysTimer          metrics.Timer
 	createTeamTLFTimer               metrics.Timer
 	getCurrentMerkleRootTimer        metrics.Timer
@@ -47,6 +48,8 @@ func NewKeybaseServiceMeasured(delegate KeybaseService, r metrics.Registry) Keyb
 		"KeybaseService.ResolveImplicitTeamByID", r)
 	loadUserPlusKeysTimer := metrics.GetOrRegisterTimer("KeybaseService.LoadUserPlusKeys", r)
 	loadTeamPlusKeysTimer := metrics.GetOrRegisterTimer("KeybaseService.LoadTeamPlusKeys", r)
+	isCurrentUserTeamAdminTimer := metrics.GetOrRegisterTimer(
+		"KeybaseService.IsCurrentUserTeamAdmin", r)
 	loadUnverifiedKeysTimer := metrics.GetOrRegisterTimer("KeybaseService.LoadUnverifiedKeys", r)
 	createTeamTLFTimer := metrics.GetOrRegisterTimer("KeybaseService.CreateTeamTLF", r)
 	getCurrentMerkleRootTimer := metrics.GetOrRegisterTimer("KeybaseService.GetCurrentMerkleRoot", r)
@@ -65,6 +68,7 @@ func NewKeybaseServiceMeasured(delegate KeybaseService, r metrics.Registry) Keyb
 		resolveImplicitTeamByIDTimer:     resolveImplicitTeamByIDTimer,
 		loadUserPlusKeysTimer:            loadUserPlusKeysTimer,
 		loadTeamPlusKeysTimer:            loadTeamPlusKeysTimer,
+		isCurrentUserTeamAdminTimer:      isCurrentUserTeamAdminTimer,
 		loadUnverifiedKeysTimer:          loadUnverifiedKeysTimer,
 		createTeamTLFTimer:               createTeamTLFTimer,
 		getCurrentMerkleRootTimer:        getCurrentMerkleRootTimer,
@@ -137,6 +141,16 @@ func (k KeybaseServiceMeasured) LoadTeamPlusKeys(ctx context.Context,
 	return teamInfo, err
 }
 
+// IsCurrentUserTeamAdmin implements the KeybaseService interface for
+// KeybaseServiceMeasured.
+func (k KeybaseServiceMeasured) IsCurrentUserTeamAdmin(
+	ctx context.Context, tid keybase1.TeamID) (isAdmin bool, err error) {
+	k.isCurrentUserTeamAdminTimer.Time(func() {
+		isAdmin, err = k.delegate.IsCurrentUserTeamAdmin(ctx, tid)
+	})
+	return isAdmin, err
+}
+
 // CreateTeamTLF implements the KBPKI interface for
 // KeybaseServiceMeasured.
 func (k KeybaseServiceMeasured) CreateTeamTLF(
@@ -5,15 +5,27 @@
 package libkbfs
 
 import (
+	"sync"
+	"time"
+
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 )
 
-// KeyCacheStandard is an LRU-based implementation of the KeyCache interface.
+// KeyCacheStandard is an LRU-based implementation of the KeyCache
+// interface.  If it was made with a TTL, keys that were put in the
+// cache more than that long ago are dropped instead of being
+// returned, so that they have to be decrypted again.
 type KeyCacheStandard struct {
-	lru *lru.Cache
+	ttl   time.Duration
+	clock Clock
+
+	// lock protects the keys in the cache entries, which are
+	// zeroed when they're evicted, as well as the LRU itself.
+	lock sync.Mutex
+	lru  *lru.Cache
 }
 
 type keyCacheKey struct {
@@ -21,25 +33,56 @@ type keyCacheKey struct {
 	keyGen kbfsmd.KeyGen
 }
 
+// keyCacheEntry is stored by pointer, so that the key can be zeroed
+// when the entry leaves the cache.
+type keyCacheEntry struct {
+	key     kbfscrypto.TLFCryptKey
+	expires time.Time
+}
+
 var _ KeyCache = (*KeyCacheStandard)(nil)
 
 // NewKeyCacheStandard constructs a new KeyCacheStandard with the given
 // cache capacity.
 func NewKeyCacheStandard(capacity int) *KeyCacheStandard {
-	head, err := lru.New(capacity)
+	return NewKeyCacheStandardWithTTL(capacity, 0, nil)
+}
+
+// NewKeyCacheStandardWithTTL constructs a new KeyCacheStandard with
+// the given cache capacity, whose keys expire `ttl` after they are
+// put in the cache, according to `clock`.  A zero `ttl` means keys
+// never expire.
+func NewKeyCacheStandardWithTTL(
+	capacity int, ttl time.Duration, clock Clock) *KeyCacheStandard {
+	head, err := lru.NewWithEvict(capacity, func(_, value interface{}) {
+		if entry, ok := value.(*keyCacheEntry); ok {
+			entry.key.Zero()
+		}
+	})
 	if err != nil {
 		panic(err.Error())
 	}
-	return &KeyCacheStandard{head}
+	if clock == nil {
+		clock = wallClock{}
+	}
+	return &KeyCacheStandard{ttl: ttl, clock: clock, lru: head}
 }
 
 // GetTLFCryptKey implements the KeyCache interface for KeyCacheStandard.
 func (k *KeyCacheStandard) GetTLFCryptKey(tlf tlf.ID, keyGen kbfsmd.KeyGen) (
 	kbfscrypto.TLFCryptKey, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
 	cacheKey := keyCacheKey{tlf, keyGen}
-	if entry, ok := k.lru.Get(cacheKey); ok {
-		if key, ok := entry.(kbfscrypto.TLFCryptKey); ok {
-			return key, nil
+	if value, ok := k.lru.Get(cacheKey); ok {
+		if entry, ok := value.(*keyCacheEntry); ok {
+			if k.ttl > 0 && !k.clock.Now().Before(entry.expires) {
+				// The eviction callback zeroes the key.
+				k.lru.Remove(cacheKey)
+				return kbfscrypto.TLFCryptKey{},
+					KeyCacheMissError{tlf, keyGen}
+			}
+			return entry.key, nil
 		}
 		// shouldn't really be possible
 		return kbfscrypto.TLFCryptKey{}, KeyCacheHitError{tlf, keyGen}
@@ -50,7 +93,39 @@ func (k *KeyCacheStandard) GetTLFCryptKey(tlf tlf.ID, keyGen kbfsmd.KeyGen) (
 // PutTLFCryptKey implements the KeyCache interface for KeyCacheStandard.
 func (k *KeyCacheStandard) PutTLFCryptKey(
 	tlf tlf.ID, keyGen kbfsmd.KeyGen, key kbfscrypto.TLFCryptKey) error {
+	entry := &keyCacheEntry{key: key}
+	if k.ttl > 0 {
+		entry.expires = k.clock.Now().Add(k.ttl)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
 	cacheKey := keyCacheKey{tlf, keyGen}
-	k.lru.Add(cacheKey, key)
+	// Replacing an entry doesn't call the eviction callback.
+	if old, ok := k.lru.Peek(cacheKey); ok {
+		if oldEntry, ok := old.(*keyCacheEntry); ok {
+			oldEntry.key.Zero()
+		}
+	}
+	k.lru.Add(cacheKey, entry)
 	return nil
 }
+
+// Clear implements the KeyCache interface for KeyCacheStandard.
+func (k *KeyCacheStandard) Clear() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	// The eviction callback zeroes every key.
+	k.lru.Purge()
+}
+
+// ClearTLF implements the KeyCache interface for KeyCacheStandard.
+func (k *KeyCacheStandard) ClearTLF(tlfID tlf.ID) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, key := range k.lru.Keys() {
+		if cacheKey, ok := key.(keyCacheKey); ok && cacheKey.tlf == tlfID {
+			// The eviction callback zeroes the key.
+			k.lru.Remove(key)
+		}
+	}
+}
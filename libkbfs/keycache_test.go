@@ -7,10 +7,12 @@ package libkbfs
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeyCacheBasic(t *testing.T) {
@@ -57,3 +59,67 @@ func TestKeyCacheBasic(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyCacheTTL(t *testing.T) {
+	clock := newTestClockNow()
+	cache := NewKeyCacheStandardWithTTL(10, time.Minute, clock)
+	id := tlf.FakeID(100, tlf.Private)
+	key := kbfscrypto.MakeTLFCryptKey([32]byte{0xf})
+	keyGen := kbfsmd.FirstValidKeyGen
+	err := cache.PutTLFCryptKey(id, keyGen, key)
+	require.NoError(t, err)
+
+	clock.Add(30 * time.Second)
+	key2, err := cache.GetTLFCryptKey(id, keyGen)
+	require.NoError(t, err)
+	require.Equal(t, key, key2)
+
+	clock.Add(30 * time.Second)
+	_, err = cache.GetTLFCryptKey(id, keyGen)
+	require.IsType(t, KeyCacheMissError{}, err)
+	require.Equal(t, 0, cache.lru.Len())
+}
+
+func TestKeyCacheClear(t *testing.T) {
+	cache := NewKeyCacheStandard(10)
+	id := tlf.FakeID(100, tlf.Private)
+	key := kbfscrypto.MakeTLFCryptKey([32]byte{0xf})
+	keyGen := kbfsmd.FirstValidKeyGen
+	err := cache.PutTLFCryptKey(id, keyGen, key)
+	require.NoError(t, err)
+	value, ok := cache.lru.Peek(keyCacheKey{id, keyGen})
+	require.True(t, ok)
+	entry := value.(*keyCacheEntry)
+
+	cache.Clear()
+	_, err = cache.GetTLFCryptKey(id, keyGen)
+	require.IsType(t, KeyCacheMissError{}, err)
+	require.Equal(t, kbfscrypto.TLFCryptKey{}, entry.key)
+}
+
+func TestKeyCacheClearTLF(t *testing.T) {
+	cache := NewKeyCacheStandard(10)
+	id1 := tlf.FakeID(1, tlf.Private)
+	id2 := tlf.FakeID(2, tlf.Private)
+	key := kbfscrypto.MakeTLFCryptKey([32]byte{0xf})
+	for _, keyGen := range []kbfsmd.KeyGen{
+		kbfsmd.FirstValidKeyGen, kbfsmd.FirstValidKeyGen + 1} {
+		err := cache.PutTLFCryptKey(id1, keyGen, key)
+		require.NoError(t, err)
+		err = cache.PutTLFCryptKey(id2, keyGen, key)
+		require.NoError(t, err)
+	}
+	value, ok := cache.lru.Peek(keyCacheKey{id1, kbfsmd.FirstValidKeyGen})
+	require.True(t, ok)
+	entry := value.(*keyCacheEntry)
+
+	cache.ClearTLF(id1)
+	_, err := cache.GetTLFCryptKey(id1, kbfsmd.FirstValidKeyGen)
+	require.IsType(t, KeyCacheMissError{}, err)
+	_, err = cache.GetTLFCryptKey(id1, kbfsmd.FirstValidKeyGen+1)
+	require.IsType(t, KeyCacheMissError{}, err)
+	require.Equal(t, kbfscrypto.TLFCryptKey{}, entry.key)
+	key2, err := cache.GetTLFCryptKey(id2, kbfsmd.FirstValidKeyGen)
+	require.NoError(t, err)
+	require.Equal(t, key, key2)
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// localStorageKeyDerivationMessage is signed by the device key to
+// derive the local storage key.  Device signatures are
+// deterministic, so the same device always gets the same key, and
+// changing this string changes every device's key.
+const localStorageKeyDerivationMessage = "Keybase-KBFS-Local-Storage-Key-1"
+
+// deriveLocalStorageKey returns the key used to encrypt the current
+// device's local journals, derived from a signature by the device
+// key so that it never has to be stored anywhere.
+func deriveLocalStorageKey(
+	ctx context.Context, signer kbfscrypto.Signer) (
+	kbfscrypto.LocalStorageKey, error) {
+	sigInfo, err := signer.SignForKBFS(
+		ctx, []byte(localStorageKeyDerivationMessage))
+	if err != nil {
+		return kbfscrypto.LocalStorageKey{}, err
+	}
+	return kbfscrypto.MakeLocalStorageKey(
+		sha256.Sum256(sigInfo.Signature)), nil
+}
+
+// localStorageCrypter encrypts and decrypts files in local persistent
+// stores.  A nil *localStorageCrypter writes plaintext, which is what
+// stores not tied to a particular device (like a BlockServerDisk)
+// use.
+//
+// Files written before encryption was turned on, or by a nil
+// crypter, are read back as-is, so existing stores keep working; new
+// writes to them are encrypted.
+type localStorageCrypter struct {
+	key kbfscrypto.LocalStorageKey
+}
+
+func makeLocalStorageCrypter(
+	key kbfscrypto.LocalStorageKey) *localStorageCrypter {
+	return &localStorageCrypter{key}
+}
+
+func (c *localStorageCrypter) seal(buf []byte) ([]byte, error) {
+	if c == nil {
+		return buf, nil
+	}
+	return kbfscrypto.SealLocalData(buf, c.key)
+}
+
+func (c *localStorageCrypter) open(buf []byte) ([]byte, error) {
+	if !kbfscrypto.IsSealedLocalData(buf) {
+		return buf, nil
+	}
+	if c == nil {
+		return nil, errors.New("Can't read encrypted local data without " +
+			"a local storage key")
+	}
+	return kbfscrypto.OpenLocalData(buf, c.key)
+}
+
+// writeFile is like ioutil.WriteSerializedFile, but encrypts `buf`.
+func (c *localStorageCrypter) writeFile(path string, buf []byte) error {
+	buf, err := c.seal(buf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteSerializedFile(path, buf, 0600)
+}
+
+// readFile is like ioutil.ReadFile, but decrypts the file's contents
+// if needed.  It may return an error for which ioutil.IsNotExist()
+// returns true.
+func (c *localStorageCrypter) readFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(buf)
+}
+
+// serializeToFile is like kbfscodec.SerializeToFile, but encrypts
+// the encoded object.
+func (c *localStorageCrypter) serializeToFile(
+	codec kbfscodec.Codec, obj interface{}, path string) error {
+	if c == nil {
+		return kbfscodec.SerializeToFile(codec, obj, path)
+	}
+	buf, err := codec.Encode(obj)
+	if err != nil {
+		return err
+	}
+	err = ioutil.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return c.writeFile(path, buf)
+}
+
+// serializeToFileIfNotExist is like serializeToFile, but does
+// nothing if the file already exists.
+func (c *localStorageCrypter) serializeToFileIfNotExist(
+	codec kbfscodec.Codec, obj interface{}, path string) error {
+	_, err := ioutil.Stat(path)
+	if err == nil {
+		return nil
+	} else if !ioutil.IsNotExist(err) {
+		return err
+	}
+
+	return c.serializeToFile(codec, obj, path)
+}
+
+// deserializeFromFile is like kbfscodec.DeserializeFromFile, but
+// decrypts the file's contents if needed.  It may return an error
+// for which ioutil.IsNotExist() returns true.
+func (c *localStorageCrypter) deserializeFromFile(
+	codec kbfscodec.Codec, path string, objPtr interface{}) error {
+	buf, err := c.readFile(path)
+	if err != nil {
+		return err
+	}
+	return codec.Decode(buf, objPtr)
+}
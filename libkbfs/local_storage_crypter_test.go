@@ -0,0 +1,134 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDeriveLocalStorageKey(t *testing.T) {
+	ctx := context.Background()
+	signer1 := kbfscrypto.SigningKeySigner{
+		Key: kbfscrypto.MakeFakeSigningKeyOrBust("device1"),
+	}
+	signer2 := kbfscrypto.SigningKeySigner{
+		Key: kbfscrypto.MakeFakeSigningKeyOrBust("device2"),
+	}
+
+	key1, err := deriveLocalStorageKey(ctx, signer1)
+	require.NoError(t, err)
+	key1Again, err := deriveLocalStorageKey(ctx, signer1)
+	require.NoError(t, err)
+	key2, err := deriveLocalStorageKey(ctx, signer2)
+	require.NoError(t, err)
+
+	// The same device must always get the same key, or it
+	// wouldn't be able to read its own journals after a restart.
+	require.Equal(t, key1, key1Again)
+	require.NotEqual(t, key1, key2)
+}
+
+func TestLocalStorageCrypterSerialize(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "local_storage_crypter")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+
+	codec := kbfscodec.NewMsgpack()
+	c := makeLocalStorageCrypter(kbfscrypto.MakeLocalStorageKey([32]byte{1}))
+	obj := testJournalEntry{1}
+
+	// Encrypted files can be read back, and don't contain the
+	// plaintext encoding.
+	sealedPath := filepath.Join(tempdir, "sub", "sealed")
+	err = c.serializeToFile(codec, obj, sealedPath)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadFile(sealedPath)
+	require.NoError(t, err)
+	require.True(t, kbfscrypto.IsSealedLocalData(buf))
+	plaintext, err := codec.Encode(obj)
+	require.NoError(t, err)
+	require.NotContains(t, string(buf), string(plaintext))
+
+	var readObj testJournalEntry
+	err = c.deserializeFromFile(codec, sealedPath, &readObj)
+	require.NoError(t, err)
+	require.Equal(t, obj, readObj)
+
+	// Without the key, encrypted files can't be read.
+	var nilCrypter *localStorageCrypter
+	err = nilCrypter.deserializeFromFile(codec, sealedPath, &readObj)
+	require.Error(t, err)
+
+	// With the wrong key, neither.
+	other := makeLocalStorageCrypter(
+		kbfscrypto.MakeLocalStorageKey([32]byte{2}))
+	err = other.deserializeFromFile(codec, sealedPath, &readObj)
+	require.Error(t, err)
+
+	// Plaintext files written before encryption was turned on
+	// can still be read.
+	plainPath := filepath.Join(tempdir, "plain")
+	err = nilCrypter.serializeToFile(codec, obj, plainPath)
+	require.NoError(t, err)
+	buf, err = ioutil.ReadFile(plainPath)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, buf)
+
+	readObj = testJournalEntry{}
+	err = c.deserializeFromFile(codec, plainPath, &readObj)
+	require.NoError(t, err)
+	require.Equal(t, obj, readObj)
+
+	// Existing files aren't overwritten.
+	err = c.serializeToFileIfNotExist(codec, testJournalEntry{2}, plainPath)
+	require.NoError(t, err)
+	buf2, err := ioutil.ReadFile(plainPath)
+	require.NoError(t, err)
+	require.Equal(t, buf, buf2)
+
+	_, err = c.readFile(filepath.Join(tempdir, "nonexistent"))
+	require.True(t, ioutil.IsNotExist(err))
+}
+
+func TestBlockDiskStoreEncrypted(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "block_disk_store")
+	require.NoError(t, err)
+	defer teardownBlockDiskStoreTest(t, tempdir)
+
+	codec := kbfscodec.NewMsgpack()
+	c := makeLocalStorageCrypter(kbfscrypto.MakeLocalStorageKey([32]byte{1}))
+	s := makeBlockDiskStore(codec, tempdir, c)
+
+	data := []byte{1, 2, 3, 4}
+	bID, bCtx, serverHalf := putBlockDisk(t, s, data)
+
+	for _, p := range []string{s.infoPath(bID), s.keyServerHalfPath(bID)} {
+		buf, err := ioutil.ReadFile(p)
+		require.NoError(t, err)
+		require.True(t, kbfscrypto.IsSealedLocalData(buf), p)
+	}
+
+	// The block data is stored as-is, since it's already
+	// encrypted.
+	buf, err := ioutil.ReadFile(s.dataPath(bID))
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// Restart with the same key.
+	s = makeBlockDiskStore(codec, tempdir, c)
+	getAndCheckBlockDiskData(t, s, bID, bCtx, data, serverHalf)
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+// lockWaitStats accumulates how long callers have waited to acquire
+// a lock.  It is goroutine-safe.
+type lockWaitStats struct {
+	lock    sync.Mutex
+	count   int64
+	total   time.Duration
+	longest time.Duration
+}
+
+// LockWaitStatsSnapshot is a point-in-time copy of the wait
+// statistics of one lock.
+type LockWaitStatsSnapshot struct {
+	Acquisitions int64
+	TotalWait    time.Duration
+	LongestWait  time.Duration
+}
+
+func (s *lockWaitStats) record(wait time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.count++
+	s.total += wait
+	if wait > s.longest {
+		s.longest = wait
+	}
+}
+
+func (s *lockWaitStats) snapshot() LockWaitStatsSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return LockWaitStatsSnapshot{
+		Acquisitions: s.count,
+		TotalWait:    s.total,
+		LongestWait:  s.longest,
+	}
+}
+
+// waitTimedMutex is a sync.Mutex that records how long each Lock
+// call waited.
+type waitTimedMutex struct {
+	sync.Mutex
+	stats *lockWaitStats
+}
+
+var _ sync.Locker = (*waitTimedMutex)(nil)
+
+func (m *waitTimedMutex) Lock() {
+	start := time.Now()
+	m.Mutex.Lock()
+	m.stats.record(time.Since(start))
+}
+
+// waitTimedRWMutex is a sync.RWMutex that records how long each Lock
+// and RLock call waited, in the same stats.
+type waitTimedRWMutex struct {
+	sync.RWMutex
+	stats *lockWaitStats
+}
+
+var _ rwLocker = (*waitTimedRWMutex)(nil)
+
+func (rw *waitTimedRWMutex) Lock() {
+	start := time.Now()
+	rw.RWMutex.Lock()
+	rw.stats.record(time.Since(start))
+}
+
+func (rw *waitTimedRWMutex) RLock() {
+	start := time.Now()
+	rw.RWMutex.RLock()
+	rw.stats.record(time.Since(start))
+}
+
+// RLocker returns a sync.Locker that read-locks `rw`, timing the
+// waits.
+func (rw *waitTimedRWMutex) RLocker() sync.Locker {
+	return (*waitTimedRLocker)(rw)
+}
+
+type waitTimedRLocker waitTimedRWMutex
+
+func (r *waitTimedRLocker) Lock()   { (*waitTimedRWMutex)(r).RLock() }
+func (r *waitTimedRLocker) Unlock() { (*waitTimedRWMutex)(r).RUnlock() }
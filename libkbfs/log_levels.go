@@ -0,0 +1,162 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	logging "github.com/keybase/go-logging"
+)
+
+// logLevels tracks the loggers made by Init, by module, so that debug
+// logging can be turned on and off at runtime.  Logging levels are
+// global to the process, so so is this.
+var logLevels = struct {
+	lock sync.Mutex
+	// modules maps each libkbfs module name (e.g., "FBO 1234abcd")
+	// to the name of its underlying logging module.
+	modules map[string]string
+	// rules maps module prefixes to whether debug logging has been
+	// turned on or off for them at runtime.  The longest matching
+	// prefix wins.
+	rules map[string]bool
+	// defaultDebug applies to modules that match no rule.
+	defaultDebug bool
+}{
+	modules: make(map[string]string),
+	rules:   make(map[string]bool),
+}
+
+func debugLoggingForModuleLocked(module string) bool {
+	debug := logLevels.defaultDebug
+	longest := -1
+	for prefix, enabled := range logLevels.rules {
+		if strings.HasPrefix(module, prefix) && len(prefix) > longest {
+			debug = enabled
+			longest = len(prefix)
+		}
+	}
+	return debug
+}
+
+func applyDebugLoggingLocked(module, loggingModule string) {
+	level := logging.INFO
+	if debugLoggingForModuleLocked(module) {
+		level = logging.DEBUG
+	}
+	logging.SetLevel(level, loggingModule)
+}
+
+// registerLogModule records that a logger for libkbfs module `module`
+// was made with logging module name `loggingModule`, and sets its
+// level according to the current rules.
+func registerLogModule(module, loggingModule string) {
+	logLevels.lock.Lock()
+	defer logLevels.lock.Unlock()
+	logLevels.modules[module] = loggingModule
+	applyDebugLoggingLocked(module, loggingModule)
+}
+
+// setDefaultDebugLogging sets whether modules that match no runtime
+// rule log debug messages.
+func setDefaultDebugLogging(debug bool) {
+	logLevels.lock.Lock()
+	defer logLevels.lock.Unlock()
+	logLevels.defaultDebug = debug
+	for module, loggingModule := range logLevels.modules {
+		applyDebugLoggingLocked(module, loggingModule)
+	}
+}
+
+// SetDebugLogging turns debug logging on or off, at runtime, for
+// every logger made by Init whose module name starts with `prefix`,
+// like "FBO", "CR" or "BSD".  It also applies to matching loggers
+// made later.  An empty prefix matches every module, and replaces all
+// previous rules.
+func SetDebugLogging(prefix string, enabled bool) {
+	logLevels.lock.Lock()
+	defer logLevels.lock.Unlock()
+	if prefix == "" {
+		logLevels.rules = make(map[string]bool)
+	}
+	logLevels.rules[prefix] = enabled
+	for module, loggingModule := range logLevels.modules {
+		if strings.HasPrefix(module, prefix) {
+			applyDebugLoggingLocked(module, loggingModule)
+		}
+	}
+}
+
+// DebugLoggingModules returns whether debug logging is currently on,
+// for each module that has a logger made by Init.
+func DebugLoggingModules() map[string]bool {
+	logLevels.lock.Lock()
+	defer logLevels.lock.Unlock()
+	debug := make(map[string]bool, len(logLevels.modules))
+	for module := range logLevels.modules {
+		debug[module] = debugLoggingForModuleLocked(module)
+	}
+	return debug
+}
+
+// ToggleDebugLogging flips debug logging for every module: it's
+// turned off everywhere if any module has it on, and turned on
+// everywhere otherwise.  It returns whether it's now on.
+func ToggleDebugLogging() bool {
+	anyOn := false
+	for _, on := range DebugLoggingModules() {
+		anyOn = anyOn || on
+	}
+	SetDebugLogging("", !anyOn)
+	return !anyOn
+}
+
+// DebugLoggingHandler returns an HTTP handler for controlling debug
+// logging at runtime.  A GET returns the debug state of each module as
+// JSON; a POST with "prefix" and "debug" form values calls
+// SetDebugLogging.  It does no authentication, so daemons should only
+// serve it on a local address.
+func DebugLoggingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			debug, err := strconv.ParseBool(r.FormValue("debug"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			SetDebugLogging(r.FormValue("prefix"), debug)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		modules := DebugLoggingModules()
+		names := make([]string, 0, len(modules))
+		for module := range modules {
+			names = append(names, module)
+		}
+		sort.Strings(names)
+		type moduleDebug struct {
+			Module string
+			Debug  bool
+		}
+		states := make([]moduleDebug, 0, len(names))
+		for _, module := range names {
+			states = append(states, moduleDebug{module, modules[module]})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(states)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// HandleDebugLoggingSignal toggles debug logging for every module
+// each time the process gets SIGUSR2, until `ctx` is canceled.  It's
+// meant to be run in the background by daemons.
+func HandleDebugLoggingSignal(ctx context.Context, log logger.Logger) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			on := ToggleDebugLogging()
+			log.CInfof(ctx, "Debug logging turned on=%t by SIGUSR2", on)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
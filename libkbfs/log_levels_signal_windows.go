@@ -0,0 +1,16 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// HandleDebugLoggingSignal does nothing on Windows, which has no
+// SIGUSR2; use DebugLoggingHandler instead.
+func HandleDebugLoggingSignal(ctx context.Context, log logger.Logger) {}
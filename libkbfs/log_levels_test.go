@@ -0,0 +1,49 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	logging "github.com/keybase/go-logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetDebugLogging(t *testing.T) {
+	defer func() {
+		logLevels.lock.Lock()
+		defer logLevels.lock.Unlock()
+		delete(logLevels.modules, "FBO test1")
+		delete(logLevels.modules, "FBO test2")
+		delete(logLevels.modules, "CR test1")
+		delete(logLevels.modules, "BSD test")
+		logLevels.rules = make(map[string]bool)
+	}()
+
+	registerLogModule("FBO test1", "kbfstest(FBO test1)")
+	registerLogModule("CR test1", "kbfstest(CR test1)")
+	require.Equal(t, logging.INFO, logging.GetLevel("kbfstest(FBO test1)"))
+
+	t.Log("Turning on a prefix affects existing and new modules")
+	SetDebugLogging("FBO", true)
+	registerLogModule("FBO test2", "kbfstest(FBO test2)")
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfstest(FBO test1)"))
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfstest(FBO test2)"))
+	require.Equal(t, logging.INFO, logging.GetLevel("kbfstest(CR test1)"))
+
+	t.Log("The longest matching prefix wins")
+	SetDebugLogging("FBO test2", false)
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfstest(FBO test1)"))
+	require.Equal(t, logging.INFO, logging.GetLevel("kbfstest(FBO test2)"))
+
+	t.Log("Toggling turns everything off, and then everything on")
+	registerLogModule("BSD test", "kbfstest(BSD test)")
+	require.False(t, ToggleDebugLogging())
+	for _, module := range []string{"FBO test1", "FBO test2", "CR test1"} {
+		require.False(t, DebugLoggingModules()[module])
+	}
+	require.True(t, ToggleDebugLogging())
+	require.Equal(t, logging.DEBUG, logging.GetLevel("kbfstest(BSD test)"))
+}
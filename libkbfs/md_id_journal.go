@@ -52,9 +52,10 @@ type mdIDJournalEntry struct {
 	codec.UnknownFieldSetHandler
 }
 
-func makeMdIDJournal(codec kbfscodec.Codec, dir string) (mdIDJournal, error) {
-	j, err :=
-		makeDiskJournal(codec, dir, reflect.TypeOf(mdIDJournalEntry{}))
+func makeMdIDJournal(codec kbfscodec.Codec, dir string,
+	crypter *localStorageCrypter) (mdIDJournal, error) {
+	j, err := makeDiskJournal(
+		codec, dir, reflect.TypeOf(mdIDJournalEntry{}), crypter)
 	if err != nil {
 		return mdIDJournal{}, err
 	}
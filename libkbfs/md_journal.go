@@ -134,6 +134,8 @@ type mdJournal struct {
 	tlfID          tlf.ID
 	mdVer          kbfsmd.MetadataVer
 	dir            string
+	// crypter encrypts the MD data and key bundles; it may be nil.
+	crypter *localStorageCrypter
 
 	log      logger.Logger
 	deferLog logger.Logger
@@ -162,7 +164,7 @@ func makeMDJournalWithIDJournal(
 	codec kbfscodec.Codec, crypto cryptoPure, clock Clock,
 	teamMemChecker kbfsmd.TeamMembershipChecker, tlfID tlf.ID,
 	mdVer kbfsmd.MetadataVer, dir string, idJournal mdIDJournal,
-	log logger.Logger) (*mdJournal, error) {
+	crypter *localStorageCrypter, log logger.Logger) (*mdJournal, error) {
 	if uid == keybase1.UID("") {
 		return nil, errors.New("Empty user")
 	}
@@ -181,6 +183,7 @@ func makeMDJournalWithIDJournal(
 		tlfID:          tlfID,
 		mdVer:          mdVer,
 		dir:            dir,
+		crypter:        crypter,
 		log:            log,
 		deferLog:       deferLog,
 		j:              idJournal,
@@ -225,16 +228,16 @@ func makeMDJournal(
 	ctx context.Context, uid keybase1.UID, key kbfscrypto.VerifyingKey,
 	codec kbfscodec.Codec, crypto cryptoPure, clock Clock,
 	teamMemChecker kbfsmd.TeamMembershipChecker, tlfID tlf.ID,
-	mdVer kbfsmd.MetadataVer, dir string,
+	mdVer kbfsmd.MetadataVer, dir string, crypter *localStorageCrypter,
 	log logger.Logger) (*mdJournal, error) {
 	journalDir := mdJournalPath(dir)
-	idJournal, err := makeMdIDJournal(codec, journalDir)
+	idJournal, err := makeMdIDJournal(codec, journalDir, crypter)
 	if err != nil {
 		return nil, err
 	}
 	return makeMDJournalWithIDJournal(
 		ctx, uid, key, codec, crypto, clock, teamMemChecker, tlfID, mdVer, dir,
-		idJournal, log)
+		idJournal, crypter, log)
 }
 
 // The functions below are for building various paths.
@@ -334,8 +337,11 @@ func (j mdJournal) getExtraMetadata(
 		return nil, nil
 	}
 
-	wkb, err := kbfsmd.DeserializeTLFWriterKeyBundleV3(
-		j.codec, j.writerKeyBundleV3Path(wkbID))
+	buf, err := j.crypter.readFile(j.writerKeyBundleV3Path(wkbID))
+	if err != nil {
+		return nil, err
+	}
+	wkb, err := kbfsmd.DecodeTLFWriterKeyBundleV3(j.codec, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -345,8 +351,11 @@ func (j mdJournal) getExtraMetadata(
 		return nil, err
 	}
 
-	rkb, err := kbfsmd.DeserializeTLFReaderKeyBundleV3(
-		j.codec, j.readerKeyBundleV3Path(rkbID))
+	buf, err = j.crypter.readFile(j.readerKeyBundleV3Path(rkbID))
+	if err != nil {
+		return nil, err
+	}
+	rkb, err := kbfsmd.DecodeTLFReaderKeyBundleV3(j.codec, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -401,13 +410,13 @@ func (j mdJournal) putExtraMetadata(rmd kbfsmd.RootMetadata, extra kbfsmd.ExtraM
 		return false, false, err
 	}
 
-	err = kbfscodec.SerializeToFileIfNotExist(
+	err = j.crypter.serializeToFileIfNotExist(
 		j.codec, extraV3.GetWriterKeyBundle(), j.writerKeyBundleV3Path(wkbID))
 	if err != nil {
 		return false, false, err
 	}
 
-	err = kbfscodec.SerializeToFileIfNotExist(
+	err = j.crypter.serializeToFileIfNotExist(
 		j.codec, extraV3.GetReaderKeyBundle(), j.readerKeyBundleV3Path(rkbID))
 	if err != nil {
 		return false, false, err
@@ -438,7 +447,7 @@ func (j mdJournal) getMDAndExtra(ctx context.Context, entry mdIDJournalEntry,
 	// Read data.
 
 	p := j.mdDataPath(entry.ID)
-	data, err := ioutil.ReadFile(p)
+	data, err := j.crypter.readFile(p)
 	if err != nil {
 		return nil, nil, time.Time{}, err
 	}
@@ -516,7 +525,7 @@ func (j mdJournal) putMD(rmd kbfsmd.RootMetadata) (kbfsmd.ID, error) {
 		return id, nil
 	}
 
-	err = kbfscodec.SerializeToFileIfNotExist(
+	err = j.crypter.serializeToFileIfNotExist(
 		j.codec, rmd, j.mdDataPath(id))
 	if err != nil {
 		return kbfsmd.ID{}, err
@@ -675,7 +684,7 @@ func (j *mdJournal) convertToBranch(
 		}
 	}()
 
-	tempJournal, err := makeMdIDJournal(j.codec, journalTempDir)
+	tempJournal, err := makeMdIDJournal(j.codec, journalTempDir, j.crypter)
 	if err != nil {
 		return err
 	}
@@ -1471,7 +1480,8 @@ func (j *mdJournal) resolveAndClear(
 	// be cleaned up whenever the entire journal goes empty.
 
 	j.log.CDebugf(ctx, "Using temp dir %s for new IDs", idJournalTempDir)
-	otherIDJournal, err := makeMdIDJournal(j.codec, idJournalTempDir)
+	otherIDJournal, err := makeMdIDJournal(
+		j.codec, idJournalTempDir, j.crypter)
 	if err != nil {
 		return kbfsmd.ID{}, err
 	}
@@ -1487,7 +1497,7 @@ func (j *mdJournal) resolveAndClear(
 
 	otherJournal, err := makeMDJournalWithIDJournal(
 		ctx, j.uid, j.key, j.codec, j.crypto, j.clock, j.teamMemChecker,
-		j.tlfID, j.mdVer, j.dir, otherIDJournal, j.log)
+		j.tlfID, j.mdVer, j.dir, otherIDJournal, j.crypter, j.log)
 	if err != nil {
 		return kbfsmd.ID{}, err
 	}
@@ -649,59 +649,126 @@ func (md *MDOpsStandard) GetUnmergedRange(ctx context.Context, id tlf.ID,
 	return md.getRange(ctx, id, bid, kbfsmd.Unmerged, start, stop, nil)
 }
 
-func (md *MDOpsStandard) put(ctx context.Context, rmd *RootMetadata,
-	verifyingKey kbfscrypto.VerifyingKey, lockContext *keybase1.LockContext,
-	priority keybase1.MDPriority) (ImmutableRootMetadata, error) {
+// pipelinedMDOps is implemented by MDOps implementations that can
+// sign an MD without sending it, so that the ID of the MD is known
+// before the server acknowledges it.  Folders use this to pipeline
+// their MD puts.
+type pipelinedMDOps interface {
+	signForPut(ctx context.Context, rmd *RootMetadata,
+		verifyingKey kbfscrypto.VerifyingKey) (
+		*RootMetadataSigned, ImmutableRootMetadata, error)
+	sendPut(ctx context.Context, rmds *RootMetadataSigned,
+		irmd ImmutableRootMetadata, lockContext *keybase1.LockContext,
+		priority keybase1.MDPriority) error
+}
+
+var _ pipelinedMDOps = (*MDOpsStandard)(nil)
+
+// signForPut encrypts and signs `rmd`, without sending it to the
+// server, and returns the signed MD along with the immutable MD it
+// will become once it is put.
+func (md *MDOpsStandard) signForPut(ctx context.Context, rmd *RootMetadata,
+	verifyingKey kbfscrypto.VerifyingKey) (
+	*RootMetadataSigned, ImmutableRootMetadata, error) {
 	session, err := md.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return nil, ImmutableRootMetadata{}, err
 	}
 
 	// Ensure that the block changes are properly unembedded.
 	if !rmd.IsWriterMetadataCopiedSet() &&
 		rmd.data.Changes.Info.BlockPointer == zeroPtr &&
 		!md.config.BlockSplitter().ShouldEmbedBlockChanges(&rmd.data.Changes) {
-		return ImmutableRootMetadata{},
+		return nil, ImmutableRootMetadata{},
 			errors.New("MD has embedded block changes, but shouldn't")
 	}
 
+	addOpDeviceInfo(
+		&rmd.data.Changes, verifyingKey, md.config.HideOpDeviceInfo())
 	err = encryptMDPrivateData(
 		ctx, md.config.Codec(), md.config.Crypto(),
 		md.config.Crypto(), md.config.KeyManager(), session.UID, rmd)
 	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return nil, ImmutableRootMetadata{}, err
 	}
 
 	rmds, err := SignBareRootMetadata(
 		ctx, md.config.Codec(), md.config.Crypto(), md.config.Crypto(),
 		rmd.bareMd, time.Time{})
 	if err != nil {
-		return ImmutableRootMetadata{}, err
-	}
-
-	err = md.config.MDServer().Put(ctx, rmds, rmd.extra, lockContext, priority)
-	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return nil, ImmutableRootMetadata{}, err
 	}
 
 	mdID, err := kbfsmd.MakeID(md.config.Codec(), rmds.MD)
 	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return nil, ImmutableRootMetadata{}, err
 	}
 
 	irmd := MakeImmutableRootMetadata(
 		rmd, verifyingKey, mdID, md.config.Clock().Now(), true)
+	return rmds, irmd, nil
+}
+
+// sendPut sends `rmds`, as signed by `signForPut` along with `irmd`,
+// to the server, and caches `irmd` if the put succeeds.
+func (md *MDOpsStandard) sendPut(ctx context.Context,
+	rmds *RootMetadataSigned, irmd ImmutableRootMetadata,
+	lockContext *keybase1.LockContext, priority keybase1.MDPriority) error {
+	err := md.config.MDServer().Put(ctx, rmds, irmd.extra, lockContext, priority)
+	if isRevisionConflict(err) && md.isOwnPut(ctx, rmds.MD) {
+		md.log.CDebugf(ctx, "Put MD rev=%d already landed with key=%s",
+			irmd.Revision(), rmds.MD.IdempotencyKey())
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
 	// Revisions created locally should always override anything else
 	// in the cache.
 	err = md.config.MDCache().Replace(irmd, irmd.BID())
 	if err != nil {
-		return ImmutableRootMetadata{}, err
+		return err
 	}
-	md.log.CDebugf(ctx, "Put MD rev=%d id=%s", rmd.Revision(), mdID)
+	md.log.CDebugf(ctx, "Put MD rev=%d id=%s", irmd.Revision(), irmd.mdID)
+	return nil
+}
 
+func (md *MDOpsStandard) put(ctx context.Context, rmd *RootMetadata,
+	verifyingKey kbfscrypto.VerifyingKey, lockContext *keybase1.LockContext,
+	priority keybase1.MDPriority) (ImmutableRootMetadata, error) {
+	rmds, irmd, err := md.signForPut(ctx, rmd, verifyingKey)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	err = md.sendPut(ctx, rmds, irmd, lockContext, priority)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	return irmd, nil
 }
 
+// isOwnPut returns true if the server already has `brmd` at its
+// revision, as recognized by its idempotency key.  This happens when
+// the mdserver client retries a put whose first attempt landed, but
+// whose reply was lost.
+func (md *MDOpsStandard) isOwnPut(
+	ctx context.Context, brmd kbfsmd.RootMetadata) bool {
+	key := brmd.IdempotencyKey()
+	if key == kbfsmd.NullIdempotencyKey {
+		return false
+	}
+	rev := brmd.RevisionNumber()
+	rmdses, err := md.config.MDServer().GetRange(ctx, brmd.TlfID(),
+		brmd.BID(), brmd.MergedStatus(), rev, rev, nil)
+	if err != nil {
+		md.log.CDebugf(ctx, "Couldn't get rev=%d to check for our own "+
+			"put: %+v", rev, err)
+		return false
+	}
+	return len(rmdses) == 1 && rmdses[0].MD.IdempotencyKey() == key
+}
+
 // Put implements the MDOps interface for MDOpsStandard.
 func (md *MDOpsStandard) Put(ctx context.Context, rmd *RootMetadata,
 	verifyingKey kbfscrypto.VerifyingKey, lockContext *keybase1.LockContext,
@@ -859,6 +859,73 @@ func testMDOpsPutPrivateSuccess(t *testing.T, ver kbfsmd.MetadataVer) {
 	}
 }
 
+// fakeMDServerLostPutReply stores each put, but then returns a
+// revision conflict, as if the reply to the put was lost and a retry
+// of it conflicted with the original.
+type fakeMDServerLostPutReply struct {
+	fakeMDServerPut
+}
+
+func (s *fakeMDServerLostPutReply) Put(ctx context.Context,
+	rmds *RootMetadataSigned, extra kbfsmd.ExtraMetadata,
+	lc *keybase1.LockContext, priority keybase1.MDPriority) error {
+	err := s.fakeMDServerPut.Put(ctx, rmds, extra, lc, priority)
+	if err != nil {
+		return err
+	}
+	return kbfsmd.ServerErrorConflictRevision{}
+}
+
+func (s *fakeMDServerLostPutReply) GetRange(ctx context.Context,
+	id tlf.ID, bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus,
+	start, stop kbfsmd.Revision, _ *keybase1.LockID) (
+	[]*RootMetadataSigned, error) {
+	rmds := s.getLastRmds()
+	if rmds == nil || rmds.MD.RevisionNumber() < start ||
+		rmds.MD.RevisionNumber() > stop {
+		return nil, nil
+	}
+	return []*RootMetadataSigned{rmds}, nil
+}
+
+func testMDOpsPutRetryAlreadyLanded(t *testing.T, ver kbfsmd.MetadataVer) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	config.SetMetadataVersion(ver)
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	config.MDServer().Shutdown()
+	var mdServer fakeMDServerLostPutReply
+	config.SetMDServer(&mdServer)
+
+	id := tlf.FakeID(1, tlf.Public)
+	h := parseTlfHandleOrBust(t, config, "alice,bob", tlf.Public, id)
+
+	rmd, err := makeInitialRootMetadata(config.MetadataVersion(), id, h)
+	require.NoError(t, err)
+	rmd.data = makeFakePrivateMetadataFuture(t).toCurrent()
+	rmd.tlfHandle = h
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	irmd, err := config.MDOps().Put(ctx, rmd, session.VerifyingKey,
+		nil, keybase1.MDPriorityNormal)
+	if ver < kbfsmd.SegregatedKeyBundlesVer {
+		// Older MDs have no idempotency keys, so the conflict
+		// can't be told apart from someone else's put.
+		require.IsType(t, kbfsmd.ServerErrorConflictRevision{}, err)
+		return
+	}
+	require.NoError(t, err)
+
+	rmds := mdServer.getLastRmds()
+	require.NotEqual(t,
+		kbfsmd.NullIdempotencyKey, rmds.MD.IdempotencyKey())
+	mdID, err := kbfsmd.MakeID(config.Codec(), rmds.MD)
+	require.NoError(t, err)
+	require.Equal(t, mdID, irmd.MdID())
+}
+
 type failEncodeCodec struct {
 	kbfscodec.Codec
 	err error
@@ -983,6 +1050,7 @@ func TestMDOps(t *testing.T) {
 		testMDOpsGetRangeFailBadPrevRoot,
 		testMDOpsPutPublicSuccess,
 		testMDOpsPutPrivateSuccess,
+		testMDOpsPutRetryAlreadyLanded,
 		testMDOpsPutFailEncode,
 		testMDOpsGetRangeFailFinal,
 		testMDOpsGetFinalSuccess,
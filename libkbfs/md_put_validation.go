@@ -0,0 +1,182 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+)
+
+// mdPutCheck is one stage of the validation that runs on an MD
+// update before it is put.  `prevMD` is the MD that `md` was made as
+// a successor of, or empty if `md` is the first MD of its TLF.
+type mdPutCheck func(codec kbfscodec.Codec, md *RootMetadata,
+	prevMD ImmutableRootMetadata) error
+
+// mdPutChecks lists the checks run by validateMDForPut, in order.
+var mdPutChecks = []mdPutCheck{
+	checkMDPutOps,
+	checkMDPutByteCounts,
+	checkMDPutSuccessor,
+	checkMDPutHandle,
+}
+
+// validateMDForPut checks the internal consistency of `md`, and its
+// relationship to `prevMD`, right before it is put.  The server
+// can't see inside the encrypted private data, so without this a
+// buggy client could write an MD that every other client of the TLF
+// then fails to process.
+func validateMDForPut(codec kbfscodec.Codec, md *RootMetadata,
+	prevMD ImmutableRootMetadata) error {
+	for _, check := range mdPutChecks {
+		err := check(codec, md, prevMD)
+		if err != nil {
+			return MDPutValidationError{md.TlfID(), md.Revision(), err}
+		}
+	}
+	return nil
+}
+
+// mdPutOps returns the ops of `md`, even if its block changes have
+// already been unembedded.
+func mdPutOps(md *RootMetadata) opsList {
+	if md.data.Changes.Info.BlockPointer.IsInitialized() {
+		return md.data.cachedChanges.Ops
+	}
+	return md.data.Changes.Ops
+}
+
+// checkOpPtrsValid makes sure `op` is valid, and that every block
+// pointer it references is valid.
+func checkOpPtrsValid(op op) error {
+	err := op.checkValid()
+	if err != nil {
+		return err
+	}
+	for i, ptr := range op.Refs() {
+		if !ptr.IsValid() {
+			return fmt.Errorf("ref[%d]=%v is invalid", i, ptr)
+		}
+	}
+	for i, ptr := range op.Unrefs() {
+		if !ptr.IsValid() {
+			return fmt.Errorf("unref[%d]=%v is invalid", i, ptr)
+		}
+	}
+	for i, update := range op.allUpdates() {
+		if update == (blockUpdate{}) {
+			// Whether an op may have nil updates (e.g., the
+			// createOp for a root directory) is up to checkValid.
+			continue
+		}
+		if !update.Unref.IsValid() || !update.Ref.IsValid() {
+			return fmt.Errorf("update[%d]=%v is invalid", i, update)
+		}
+	}
+	return nil
+}
+
+// checkMDPutOps makes sure every op in `md`, and every block pointer
+// they reference, is valid.
+func checkMDPutOps(_ kbfscodec.Codec, md *RootMetadata,
+	_ ImmutableRootMetadata) error {
+	for i, op := range mdPutOps(md) {
+		err := checkOpPtrsValid(op)
+		if err != nil {
+			return fmt.Errorf("op[%d]=%v invalid: %v", i, op, err)
+		}
+	}
+	return nil
+}
+
+// checkMDPutByteCounts makes sure that any bytes `md` claims to
+// reference or unreference are backed by block pointers in its ops.
+// MDs that copy the previous writer metadata (e.g., reader rekeys)
+// carry over the previous byte counts, and conflict resolutions
+// compute them from the usage of whole branches, so they are skipped.
+func checkMDPutByteCounts(_ kbfscodec.Codec, md *RootMetadata,
+	_ ImmutableRootMetadata) error {
+	if md.IsWriterMetadataCopiedSet() {
+		return nil
+	}
+
+	hasRefs, hasUnrefs := false, false
+	for _, op := range mdPutOps(md) {
+		if _, ok := op.(*resolutionOp); ok {
+			return nil
+		}
+		if len(op.Refs()) > 0 {
+			hasRefs = true
+		}
+		if len(op.Unrefs()) > 0 {
+			hasUnrefs = true
+		}
+		for _, update := range op.allUpdates() {
+			if update.Unref != update.Ref {
+				hasRefs, hasUnrefs = true, true
+			}
+		}
+	}
+
+	if md.RefBytes() > 0 && !hasRefs {
+		return errors.Errorf(
+			"%d ref bytes, but no referenced blocks", md.RefBytes())
+	}
+	if md.UnrefBytes() > 0 && !hasUnrefs {
+		return errors.Errorf(
+			"%d unref bytes, but no unreferenced blocks", md.UnrefBytes())
+	}
+	return nil
+}
+
+// checkMDPutSuccessor makes sure `md` is a valid successor of
+// `prevMD`, or the initial revision if there is no `prevMD`.
+func checkMDPutSuccessor(_ kbfscodec.Codec, md *RootMetadata,
+	prevMD ImmutableRootMetadata) error {
+	if prevMD == (ImmutableRootMetadata{}) {
+		if md.Revision() != kbfsmd.RevisionInitial {
+			return errors.Errorf("Revision %d has no predecessor",
+				md.Revision())
+		}
+		return nil
+	}
+	return prevMD.CheckValidSuccessor(prevMD.mdID, md.ReadOnly())
+}
+
+// checkMDPutHandle makes sure `md` has the same TLF handle as
+// `prevMD`.  Only rekeys may change the handle, when they resolve
+// assertions in it.
+func checkMDPutHandle(codec kbfscodec.Codec, md *RootMetadata,
+	prevMD ImmutableRootMetadata) error {
+	if prevMD == (ImmutableRootMetadata{}) {
+		return nil
+	}
+	for _, op := range mdPutOps(md) {
+		if _, ok := op.(*rekeyOp); ok {
+			return nil
+		}
+	}
+
+	handle, err := md.bareMd.MakeBareTlfHandle(md.extra)
+	if err != nil {
+		return err
+	}
+	prevHandle, err := prevMD.bareMd.MakeBareTlfHandle(prevMD.extra)
+	if err != nil {
+		return err
+	}
+	eq, err := kbfscodec.Equal(codec, handle, prevHandle)
+	if err != nil {
+		return err
+	}
+	if !eq {
+		return errors.Errorf("Handle changed from %v to %v without a rekey",
+			prevHandle, handle)
+	}
+	return nil
+}
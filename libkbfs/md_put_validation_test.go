@@ -0,0 +1,91 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestValidateMDForPut(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(ctx, t, config)
+	codec := config.Codec()
+
+	h := makeFakeTlfHandle(t, 14, tlf.Public, nil, nil)
+	rmd, err := makeInitialRootMetadata(
+		config.MetadataVersion(), tlf.FakeID(1, tlf.Public), h)
+	require.NoError(t, err)
+	rmd.SetDiskUsage(1000)
+
+	t.Log("The initial revision needs no predecessor")
+	require.NoError(t, validateMDForPut(codec, rmd, ImmutableRootMetadata{}))
+	prevMD := MakeImmutableRootMetadata(rmd,
+		kbfscrypto.MakeFakeVerifyingKeyOrBust("fake key"),
+		kbfsmd.FakeID(1), time.Now(), true)
+
+	makeSuccessor := func() *RootMetadata {
+		md, err := prevMD.MakeSuccessor(ctx, config.MetadataVersion(),
+			codec, config.KeyManager(), config.KBPKI(), config.KBPKI(),
+			prevMD.MdID(), true)
+		require.NoError(t, err)
+		return md
+	}
+	requireInvalid := func(md *RootMetadata) {
+		err := validateMDForPut(codec, md, prevMD)
+		require.IsType(t, MDPutValidationError{}, err)
+	}
+
+	t.Log("A successor whose unref bytes match its ops is valid")
+	md := makeSuccessor()
+	md.AddOp(newGCOp(0))
+	md.AddUnrefBlock(makeFakeBlockInfo(t))
+	require.NoError(t, validateMDForPut(codec, md, prevMD))
+
+	t.Log("Not a successor")
+	md = makeSuccessor()
+	md.AddOp(newGCOp(0))
+	md.AddUnrefBlock(makeFakeBlockInfo(t))
+	md.SetRevision(md.Revision() + 1)
+	requireInvalid(md)
+
+	t.Log("Unref bytes without any unreferenced blocks")
+	md = makeSuccessor()
+	md.AddOp(newGCOp(0))
+	md.AddUnrefBytes(150)
+	md.SetDiskUsage(md.DiskUsage() - 150)
+	requireInvalid(md)
+
+	t.Log("Disk usage that doesn't match the unref bytes")
+	md = makeSuccessor()
+	md.AddOp(newGCOp(0))
+	md.AddUnrefBlock(makeFakeBlockInfo(t))
+	md.SetDiskUsage(prevMD.DiskUsage())
+	requireInvalid(md)
+
+	t.Log("An op with an invalid block pointer")
+	md = makeSuccessor()
+	gco := newGCOp(0)
+	gco.AddUnrefBlock(BlockPointer{DataVer: FirstValidDataVer})
+	md.AddOp(gco)
+	requireInvalid(md)
+
+	t.Log("A handle change needs a rekey")
+	md = makeSuccessor()
+	md.AddOp(newGCOp(0))
+	md.SetUnresolvedWriters([]keybase1.SocialAssertion{
+		{User: "bob", Service: "twitter"}})
+	requireInvalid(md)
+	md.AddOp(newRekeyOp())
+	require.NoError(t, validateMDForPut(codec, md, prevMD))
+}
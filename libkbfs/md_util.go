@@ -346,6 +346,21 @@ func getUnmergedMDUpdates(ctx context.Context, config Config, id tlf.ID,
 	return currHead, unmergedRmds, nil
 }
 
+// addOpDeviceInfo records the device that owns `key`, along with this
+// client's version, in every op of `changes` that doesn't have them
+// yet.  It does nothing if `hide` is set.
+func addOpDeviceInfo(
+	changes *BlockChanges, key kbfscrypto.VerifyingKey, hide bool) {
+	kid := key.KID()
+	if hide || !kid.Exists() {
+		return
+	}
+	version := VersionString()
+	for _, op := range changes.Ops {
+		op.setDeviceInfo(kid, version)
+	}
+}
+
 // encryptMDPrivateData encrypts the private data of the given
 // RootMetadata and makes other modifications to prepare it for
 // signing (see signMD below). After this function is called, the
@@ -403,6 +418,15 @@ func encryptMDPrivateData(
 	// Record the last user to modify this metadata
 	brmd.SetLastModifyingUser(me)
 
+	// Give each attempt at putting this MD its own idempotency key,
+	// so that if a put lands without us hearing about it, a retry
+	// can tell that it's conflicting with itself.
+	key, err := kbfsmd.MakeRandomIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	brmd.SetIdempotencyKey(key)
+
 	return nil
 }
 
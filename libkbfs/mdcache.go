@@ -161,3 +161,19 @@ func (md *MDCacheStandard) ChangeHandleForID(
 	md.idLRU.Add(newKey, tmp)
 	return
 }
+
+// ClearTLF implements the MDCache interface for MDCacheStandard.
+func (md *MDCacheStandard) ClearTLF(tlfID tlf.ID) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	for _, key := range md.lru.Keys() {
+		if cacheKey, ok := key.(mdCacheKey); ok && cacheKey.tlf == tlfID {
+			md.lru.Remove(key)
+		}
+	}
+	for _, key := range md.idLRU.Keys() {
+		if id, ok := md.idLRU.Peek(key); ok && id == tlfID {
+			md.idLRU.Remove(key)
+		}
+	}
+}
@@ -118,3 +118,28 @@ func TestMdcacheReplace(t *testing.T) {
 	_, err = mdcache.Get(id, 1, bid)
 	require.NoError(t, err)
 }
+
+func TestMdcacheClearTLF(t *testing.T) {
+	id0 := tlf.FakeID(1, tlf.Private)
+	h0 := testMdcacheMakeHandle(t, 0)
+
+	id1 := tlf.FakeID(2, tlf.Private)
+	h1 := testMdcacheMakeHandle(t, 1)
+
+	mdcache := NewMDCacheStandard(10)
+	testMdcachePut(t, id0, 1, kbfsmd.NullBranchID, h0, mdcache)
+	testMdcachePut(t, id0, 2, kbfsmd.NullBranchID, h0, mdcache)
+	testMdcachePut(t, id1, 1, kbfsmd.NullBranchID, h1, mdcache)
+	err := mdcache.PutIDForHandle(h0, id0)
+	require.NoError(t, err)
+
+	mdcache.ClearTLF(id0)
+	_, err = mdcache.Get(id0, 1, kbfsmd.NullBranchID)
+	require.Equal(t, NoSuchMDError{id0, 1, kbfsmd.NullBranchID}, err)
+	_, err = mdcache.Get(id0, 2, kbfsmd.NullBranchID)
+	require.Equal(t, NoSuchMDError{id0, 2, kbfsmd.NullBranchID}, err)
+	_, err = mdcache.GetIDForHandle(h0)
+	require.IsType(t, NoSuchTlfIDError{}, err)
+	_, err = mdcache.Get(id1, 1, kbfsmd.NullBranchID)
+	require.NoError(t, err)
+}
@@ -348,9 +348,18 @@ func (md *MDServerDisk) GetForTLF(ctx context.Context, id tlf.ID,
 		return nil, err
 	}
 
-	// Lookup the branch ID if not supplied
+	uid, err := getCurrentUIDForRead(
+		ctx, md.config.currentSessionGetter(), id)
+	if err != nil {
+		return nil, kbfsmd.ServerError{Err: err}
+	}
+
+	// Lookup the branch ID if not supplied.  Anonymous readers
+	// never have any unmerged branches.
 	if mStatus == kbfsmd.Unmerged && bid == kbfsmd.NullBranchID {
-		var err error
+		if uid == keybase1.UID("") {
+			return nil, nil
+		}
 		bid, err = md.getBranchID(ctx, id)
 		if err != nil {
 			return nil, err
@@ -360,17 +369,12 @@ func (md *MDServerDisk) GetForTLF(ctx context.Context, id tlf.ID,
 		}
 	}
 
-	session, err := md.config.currentSessionGetter().GetCurrentSession(ctx)
-	if err != nil {
-		return nil, kbfsmd.ServerError{Err: err}
-	}
-
 	tlfStorage, err := md.getStorage(id)
 	if err != nil {
 		return nil, err
 	}
 
-	return tlfStorage.getForTLF(ctx, session.UID, bid)
+	return tlfStorage.getForTLF(ctx, uid, bid)
 }
 
 // GetRange implements the MDServer interface for MDServerDisk.
@@ -383,9 +387,18 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id tlf.ID,
 
 	md.log.CDebugf(ctx, "GetRange %d %d (%s)", start, stop, mStatus)
 
-	// Lookup the branch ID if not supplied
+	uid, err := getCurrentUIDForRead(
+		ctx, md.config.currentSessionGetter(), id)
+	if err != nil {
+		return nil, kbfsmd.ServerError{Err: err}
+	}
+
+	// Lookup the branch ID if not supplied.  Anonymous readers
+	// never have any unmerged branches.
 	if mStatus == kbfsmd.Unmerged && bid == kbfsmd.NullBranchID {
-		var err error
+		if uid == keybase1.UID("") {
+			return nil, nil
+		}
 		bid, err = md.getBranchID(ctx, id)
 		if err != nil {
 			return nil, err
@@ -395,17 +408,12 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id tlf.ID,
 		}
 	}
 
-	session, err := md.config.currentSessionGetter().GetCurrentSession(ctx)
-	if err != nil {
-		return nil, kbfsmd.ServerError{Err: err}
-	}
-
 	tlfStorage, err := md.getStorage(id)
 	if err != nil {
 		return nil, err
 	}
 
-	return tlfStorage.getRange(ctx, session.UID, bid, start, stop)
+	return tlfStorage.getRange(ctx, uid, bid, start, stop)
 }
 
 // Put implements the MDServer interface for MDServerDisk.
@@ -18,6 +18,22 @@ import (
 
 // TODO: Have the functions below wrap their errors.
 
+// getCurrentUIDForRead returns the UID of the logged-in user, for the
+// purpose of reading the metadata of the given TLF.  If no one is
+// logged in and the TLF is public, it returns an empty UID instead
+// of an error, since anyone may read a public TLF.
+func getCurrentUIDForRead(ctx context.Context,
+	sessionGetter CurrentSessionGetter, id tlf.ID) (keybase1.UID, error) {
+	session, err := sessionGetter.GetCurrentSession(ctx)
+	if _, noSession := errors.Cause(err).(NoCurrentSessionError); noSession &&
+		id.Type() == tlf.Public {
+		return keybase1.UID(""), nil
+	} else if err != nil {
+		return keybase1.UID(""), err
+	}
+	return session.UID, nil
+}
+
 // Helper to aid in enforcement that only specified public keys can
 // access TLF metadata. mergedMasterHead can be nil, in which case
 // true is returned.
@@ -240,7 +240,8 @@ func (md *MDServerMemory) checkGetParamsRLocked(
 		return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
 	}
 
-	session, err := md.config.currentSessionGetter().GetCurrentSession(ctx)
+	uid, err := getCurrentUIDForRead(
+		ctx, md.config.currentSessionGetter(), id)
 	if err != nil {
 		return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
 	}
@@ -252,7 +253,7 @@ func (md *MDServerMemory) checkGetParamsRLocked(
 		if err != nil {
 			return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
 		}
-		ok, err := isReader(ctx, md.config.teamMembershipChecker(), session.UID,
+		ok, err := isReader(ctx, md.config.teamMembershipChecker(), uid,
 			mergedMasterHead.MD, extra)
 		if err != nil {
 			return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
@@ -262,8 +263,10 @@ func (md *MDServerMemory) checkGetParamsRLocked(
 		}
 	}
 
-	// Lookup the branch ID if not supplied
-	if mStatus == kbfsmd.Unmerged && bid == kbfsmd.NullBranchID {
+	// Lookup the branch ID if not supplied.  Anonymous readers
+	// never have any unmerged branches.
+	if mStatus == kbfsmd.Unmerged && bid == kbfsmd.NullBranchID &&
+		uid != keybase1.UID("") {
 		return md.getBranchIDRLocked(ctx, id)
 	}
 
@@ -568,6 +571,22 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		recordBranchID = true
 	}
 
+	// If this exact put already landed (e.g., the client is retrying
+	// after losing the reply), just report success again.
+	if key := rmds.MD.IdempotencyKey(); head != nil &&
+		key != kbfsmd.NullIdempotencyKey &&
+		head.MD.RevisionNumber() >= rmds.MD.RevisionNumber() {
+		rev := rmds.MD.RevisionNumber()
+		rmdses, _, err := md.getRangeLocked(
+			ctx, id, bid, mStatus, rev, rev, nil)
+		if err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+		if len(rmdses) == 1 && rmdses[0].MD.IdempotencyKey() == key {
+			return nil
+		}
+	}
+
 	// Consistency checks
 	if head != nil {
 		id, err := kbfsmd.MakeID(md.config.Codec(), head.MD)
@@ -46,6 +46,7 @@ type MDServerRemote struct {
 	authToken     *kbfscrypto.AuthToken
 	squelchRekey  bool
 	pinger        pinger
+	errCounter    *serverErrorCounter
 
 	authenticatedMtx sync.RWMutex
 	isAuthenticated  bool
@@ -54,10 +55,7 @@ type MDServerRemote struct {
 	conn   *rpc.Connection
 	client keybase1.MetadataClient
 
-	observerMu sync.Mutex // protects observers
-	// chan is nil if we have unregistered locally, but not yet with
-	// the server.
-	observers map[tlf.ID]chan<- error
+	updates *mdUpdateStream
 
 	tickerCancel context.CancelFunc
 	tickerMu     sync.Mutex // protects the ticker cancel function
@@ -89,12 +87,14 @@ func NewMDServerRemote(config Config, srvRemote rpc.Remote,
 	deferLog := log.CloneWithAddedDepth(1)
 	mdServer := &MDServerRemote{
 		config:        config,
-		observers:     make(map[tlf.ID]chan<- error),
+		updates:       newMDUpdateStream(),
 		log:           traceLogger{log},
 		deferLog:      traceLogger{deferLog},
 		mdSrvRemote:   srvRemote,
 		rpcLogFactory: rpcLogFactory,
 		rekeyTimer:    time.NewTimer(nextRekeyTime()),
+		errCounter: newServerErrorCounter(
+			mdServerKind, config.MetricsRegistry()),
 	}
 
 	mdServer.pinger = pinger{
@@ -218,11 +218,48 @@ func (md *MDServerRemote) OnConnect(ctx context.Context,
 
 	md.config.KBFSOps().PushConnectionStatusChange(MDServiceName, nil)
 
+	// Register again for updates to any TLFs that were waiting on
+	// them when the last connection dropped.  Don't block the
+	// connection on it.
+	if err == nil {
+		go md.reregisterForUpdates(context.Background(), c)
+	} else {
+		md.updates.cancelAll(err)
+	}
+
 	// start pinging
 	md.pinger.resetTicker(pingIntervalSeconds)
 	return nil
 }
 
+// reregisterForUpdates registers every TLF that's waiting for an
+// update, but isn't registered with the server, from the last
+// revision known for it.  If there were updates while the connection
+// was down, the server notifies us about them right away.
+func (md *MDServerRemote) reregisterForUpdates(
+	ctx context.Context, c keybase1.MetadataClient) {
+	waiting := md.updates.waiting()
+	if len(waiting) == 0 {
+		return
+	}
+	md.log.CDebugf(ctx, "Re-registering %d folder(s) for updates",
+		len(waiting))
+	for id, rev := range waiting {
+		if !md.updates.markRegistered(id) {
+			continue
+		}
+		err := c.RegisterForUpdates(ctx, keybase1.RegisterForUpdatesArg{
+			FolderID:     id.String(),
+			CurrRevision: rev.Number(),
+		})
+		if err != nil {
+			md.log.CDebugf(ctx, "Couldn't re-register %s for updates: %+v",
+				id, err)
+			md.updates.registerFailed(id, err)
+		}
+	}
+}
+
 type ctxMDServerResetKeyType int
 
 const (
@@ -412,7 +449,9 @@ func (md *MDServerRemote) OnDisconnected(ctx context.Context,
 
 	md.setIsAuthenticated(false)
 
-	md.cancelObservers()
+	// Keep any waiting observers; they'll be registered again on
+	// the next connection.
+	md.updates.disconnected()
 	md.pinger.cancelTicker()
 	if md.authToken != nil {
 		md.authToken.Shutdown()
@@ -430,8 +469,8 @@ func (md *MDServerRemote) OnDisconnected(ctx context.Context,
 
 // ShouldRetry implements the ConnectionHandler interface.
 func (md *MDServerRemote) ShouldRetry(name string, err error) bool {
-	_, shouldThrottle := err.(kbfsmd.ServerErrorThrottle)
-	return shouldThrottle
+	md.errCounter.record(err)
+	return serverErrorPolicyFor(mdServerKind, err).retryRPC
 }
 
 // ShouldRetryOnConnect implements the ConnectionHandler interface.
@@ -464,39 +503,12 @@ func (md *MDServerRemote) CheckReachability(ctx context.Context) {
 
 // Signal errors and clear any registered observers.
 func (md *MDServerRemote) cancelObservers() {
-	md.observerMu.Lock()
-	defer md.observerMu.Unlock()
-	// fire errors for any registered observers
-	for id, observerChan := range md.observers {
-		md.signalObserverLocked(observerChan, id, MDServerDisconnected{})
-	}
+	md.updates.cancelAll(MDServerDisconnected{})
 }
 
 // CancelRegistration implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) CancelRegistration(ctx context.Context, id tlf.ID) {
-	md.observerMu.Lock()
-	defer md.observerMu.Unlock()
-	observerChan, ok := md.observers[id]
-	if !ok {
-		// not registered
-		return
-	}
-
-	// signal that we've seen the update
-	md.signalObserverLocked(
-		observerChan, id, errors.New("Registration canceled"))
-	// Setting nil here indicates that the remote MD server thinks
-	// we're still registered, though locally no one is listening.
-	md.observers[id] = nil
-}
-
-// Signal an observer. The observer lock must be held.
-func (md *MDServerRemote) signalObserverLocked(observerChan chan<- error, id tlf.ID, err error) {
-	if observerChan != nil {
-		observerChan <- err
-		close(observerChan)
-	}
-	delete(md.observers, id)
+	md.updates.cancel(id, errors.New("Registration canceled"))
 }
 
 // Helper used to retrieve metadata blocks from the MD server.
@@ -744,22 +756,23 @@ func (md *MDServerRemote) PruneBranch(
 }
 
 // MetadataUpdate implements the MetadataUpdateProtocol interface.
-func (md *MDServerRemote) MetadataUpdate(_ context.Context, arg keybase1.MetadataUpdateArg) error {
+func (md *MDServerRemote) MetadataUpdate(
+	ctx context.Context, arg keybase1.MetadataUpdateArg) error {
 	id, err := tlf.ParseID(arg.FolderID)
 	if err != nil {
 		return err
 	}
 
-	md.observerMu.Lock()
-	defer md.observerMu.Unlock()
-	observerChan, ok := md.observers[id]
+	rev := kbfsmd.Revision(arg.Revision)
+	seqno, skipped, ok := md.updates.deliver(id, rev)
 	if !ok {
-		// not registered
+		// Not registered, or we already knew about this revision.
 		return nil
 	}
-
-	// signal that we've seen the update
-	md.signalObserverLocked(observerChan, id, nil)
+	if skipped > 0 {
+		md.log.CDebugf(ctx, "Update %d for %s at revision %d skipped "+
+			"%d revision(s)", seqno, id, rev, skipped)
+	}
 	return nil
 }
 
@@ -821,7 +834,7 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id tlf.ID,
 	}
 
 	// register
-	var c chan error
+	var c <-chan error
 	conn := md.getConn()
 	err := conn.DoCommand(ctx, "register", func(rawClient rpc.GenericClient) error {
 		// set up the server to receive updates, since we may
@@ -837,41 +850,19 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id tlf.ID,
 		// done?
 		server.Run()
 
-		// keep re-adding the observer on retries, since
-		// disconnects or connection errors clear observers.
-		alreadyRegistered := func() bool {
-			md.observerMu.Lock()
-			defer md.observerMu.Unlock()
-			// It's possible for a nil channel to be in
-			// `md.observers`, if we are still registered with the
-			// server after a previous cancellation.
-			existingCh, alreadyRegistered := md.observers[id]
-			if existingCh != nil {
-				panic(fmt.Sprintf(
-					"Attempted double-registration for folder: %s", id))
-			}
-			c = make(chan error, 1)
-			md.observers[id] = c
-			return alreadyRegistered
-		}()
+		// Keep re-adding the observer on retries, since connection
+		// errors clear observers.
+		var alreadyRegistered bool
+		c, alreadyRegistered = md.updates.register(id, currHead)
 		if alreadyRegistered {
 			return nil
 		}
 		// Use this instead of md.client since we're already
 		// inside a DoCommand().
-		c := keybase1.MetadataClient{Cli: rawClient}
-		err = c.RegisterForUpdates(ctx, arg)
+		client := keybase1.MetadataClient{Cli: rawClient}
+		err = client.RegisterForUpdates(ctx, arg)
 		if err != nil {
-			func() {
-				md.observerMu.Lock()
-				defer md.observerMu.Unlock()
-				// we could've been canceled by a shutdown so look this up
-				// again before closing and deleting.
-				if updateChan, ok := md.observers[id]; ok {
-					close(updateChan)
-					delete(md.observers, id)
-				}
-			}()
+			md.updates.registerFailed(id, err)
 		}
 		return err
 	})
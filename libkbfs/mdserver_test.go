@@ -162,6 +162,62 @@ func TestMDServerBasics(t *testing.T) {
 	}
 }
 
+// This should pass for both local and remote servers.
+func TestMDServerIdempotentPut(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer := config.MDServer()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()},
+		[]keybase1.UserOrTeamID{keybase1.PublicUID.AsUserOrTeam()},
+		nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	makeRMDS := func(key kbfsmd.IdempotencyKey) *RootMetadataSigned {
+		brmd, err := kbfsmd.MakeInitialRootMetadataV3(id, h)
+		require.NoError(t, err)
+		brmd.SetSerializedPrivateMetadata([]byte{0x1})
+		brmd.SetLastModifyingWriter(uid)
+		brmd.SetLastModifyingUser(uid)
+		brmd.SetIdempotencyKey(key)
+		err = brmd.SignWriterMetadataInternally(
+			ctx, config.Codec(), config.Crypto())
+		require.NoError(t, err)
+		rmds, err := SignBareRootMetadata(ctx, config.Codec(),
+			config.Crypto(), config.Crypto(), brmd, time.Time{})
+		require.NoError(t, err)
+		return rmds
+	}
+
+	rmds := makeRMDS(kbfsmd.FakeIdempotencyKey(1))
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	// Retrying the same put succeeds.
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	// But a different put of the same revision conflicts.
+	rmds = makeRMDS(kbfsmd.FakeIdempotencyKey(2))
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.IsType(t, kbfsmd.ServerErrorConflictRevision{}, err)
+
+	rmdses, err := mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, 100, nil)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 1)
+	require.Equal(t,
+		kbfsmd.FakeIdempotencyKey(1), rmdses[0].MD.IdempotencyKey())
+}
+
 // This should pass for both local and remote servers. Make sure that
 // registering multiple TLFs for updates works. This is a regression
 // test for https://keybase.atlassian.net/browse/KBFS-467 .
@@ -209,7 +209,7 @@ func (s *mdServerTlfStorage) getOrCreateBranchJournalLocked(
 		return mdIDJournal{}, err
 	}
 
-	j, err = makeMdIDJournal(s.codec, dir)
+	j, err = makeMdIDJournal(s.codec, dir, nil)
 	if err != nil {
 		return mdIDJournal{}, err
 	}
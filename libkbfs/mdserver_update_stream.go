@@ -0,0 +1,187 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// mdUpdateStream keeps track of the update registrations of all the
+// TLFs that share a single MD server connection, over which the
+// server pushes MetadataUpdate notifications for all of them as one
+// stream.
+//
+// Each notification that's accepted gets the next sequence number in
+// the stream, and the stream remembers the latest revision it knows
+// about for each TLF.  That lets it drop stale and duplicate
+// notifications, and notice when a notification skips revisions.
+// It also means that after a reconnect, every TLF that's still
+// waiting can be registered again from its last-known revision, in
+// one pass, so that the server itself reports any updates that were
+// missed while disconnected -- rather than failing every waiting
+// observer and making each TLF re-register on its own.
+type mdUpdateStream struct {
+	lock    sync.Mutex
+	seqno   uint64
+	entries map[tlf.ID]*mdUpdateStreamEntry
+}
+
+type mdUpdateStreamEntry struct {
+	// c is nil if no one is waiting locally for an update to this
+	// TLF.
+	c chan error
+	// registered is whether the server thinks we're registered for
+	// the next update to this TLF.  It can be true even when c is
+	// nil, after a registration is canceled locally.
+	registered bool
+	// rev is the latest revision we know of for this TLF.
+	rev kbfsmd.Revision
+}
+
+func newMDUpdateStream() *mdUpdateStream {
+	return &mdUpdateStream{
+		entries: make(map[tlf.ID]*mdUpdateStreamEntry),
+	}
+}
+
+// register makes a new channel to be signaled on the next update to
+// `id` after `currHead`.  It returns whether the server still thinks
+// we're registered for `id`, in which case there's no need to
+// register with it again.
+func (s *mdUpdateStream) register(id tlf.ID, currHead kbfsmd.Revision) (
+	c <-chan error, alreadyRegistered bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		entry = &mdUpdateStreamEntry{rev: kbfsmd.RevisionUninitialized}
+		s.entries[id] = entry
+	}
+	if entry.c != nil {
+		panic(fmt.Sprintf("Attempted double-registration for folder: %s", id))
+	}
+	entry.c = make(chan error, 1)
+	// The observer's head is what it needs to hear about updates
+	// past, even if it's behind the last revision we delivered.
+	entry.rev = currHead
+	alreadyRegistered = entry.registered
+	entry.registered = true
+	return entry.c, alreadyRegistered
+}
+
+func (s *mdUpdateStream) signalLocked(entry *mdUpdateStreamEntry, err error) {
+	if entry.c != nil {
+		entry.c <- err
+		close(entry.c)
+		entry.c = nil
+	}
+}
+
+// registerFailed signals `err` to the observer waiting on `id`,
+// after the server refused to register it.
+func (s *mdUpdateStream) registerFailed(id tlf.ID, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		return
+	}
+	s.signalLocked(entry, err)
+	entry.registered = false
+}
+
+// cancel signals `err` to the observer waiting on `id`, if any.  The
+// server may still think we're registered.
+func (s *mdUpdateStream) cancel(id tlf.ID, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if entry, ok := s.entries[id]; ok {
+		s.signalLocked(entry, err)
+	}
+}
+
+// cancelAll signals `err` to every waiting observer, and forgets
+// everything about the stream.
+func (s *mdUpdateStream) cancelAll(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range s.entries {
+		s.signalLocked(entry, err)
+	}
+	s.entries = make(map[tlf.ID]*mdUpdateStreamEntry)
+}
+
+// deliver signals the observer waiting on `id` that revision `rev`
+// is available.  It returns false if the notification is stale or a
+// duplicate.  Otherwise it returns the notification's sequence
+// number in the stream, and how many revisions it skipped past the
+// last one we knew about.
+func (s *mdUpdateStream) deliver(id tlf.ID, rev kbfsmd.Revision) (
+	seqno uint64, skipped int64, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || !entry.registered {
+		return 0, 0, false
+	}
+	if entry.rev != kbfsmd.RevisionUninitialized {
+		if rev <= entry.rev {
+			return 0, 0, false
+		}
+		skipped = int64(rev - entry.rev - 1)
+	}
+	// The server only sends one notification per registration.
+	entry.registered = false
+	entry.rev = rev
+	s.signalLocked(entry, nil)
+	s.seqno++
+	return s.seqno, skipped, true
+}
+
+// disconnected notes that the server has forgotten all our
+// registrations.  Observers that are still waiting are kept, so they
+// can be registered again once the connection is back; any others
+// are forgotten.
+func (s *mdUpdateStream) disconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, entry := range s.entries {
+		entry.registered = false
+		if entry.c == nil {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// waiting returns the last-known revision of every TLF that has an
+// observer waiting, but isn't registered with the server.
+func (s *mdUpdateStream) waiting() map[tlf.ID]kbfsmd.Revision {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	waiting := make(map[tlf.ID]kbfsmd.Revision)
+	for id, entry := range s.entries {
+		if entry.c != nil && !entry.registered {
+			waiting[id] = entry.rev
+		}
+	}
+	return waiting
+}
+
+// markRegistered notes that the server has registered `id` again.
+// It returns false if nobody is waiting on `id` anymore.
+func (s *mdUpdateStream) markRegistered(id tlf.ID) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || entry.c == nil {
+		return false
+	}
+	entry.registered = true
+	return true
+}
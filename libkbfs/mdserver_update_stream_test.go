@@ -0,0 +1,77 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDUpdateStreamDeliver(t *testing.T) {
+	s := newMDUpdateStream()
+	id := tlf.FakeID(1, tlf.Private)
+
+	c, alreadyRegistered := s.register(id, kbfsmd.Revision(5))
+	require.False(t, alreadyRegistered)
+
+	t.Log("Stale notifications are dropped")
+	_, _, ok := s.deliver(id, kbfsmd.Revision(5))
+	require.False(t, ok)
+
+	seqno, skipped, ok := s.deliver(id, kbfsmd.Revision(8))
+	require.True(t, ok)
+	require.Equal(t, uint64(1), seqno)
+	require.Equal(t, int64(2), skipped)
+	require.NoError(t, <-c)
+
+	t.Log("Duplicates are dropped after the registration is used up")
+	_, _, ok = s.deliver(id, kbfsmd.Revision(9))
+	require.False(t, ok)
+
+	c, alreadyRegistered = s.register(id, kbfsmd.Revision(8))
+	require.False(t, alreadyRegistered)
+	seqno, skipped, ok = s.deliver(id, kbfsmd.Revision(9))
+	require.True(t, ok)
+	require.Equal(t, uint64(2), seqno)
+	require.Equal(t, int64(0), skipped)
+	require.NoError(t, <-c)
+}
+
+func TestMDUpdateStreamReconnect(t *testing.T) {
+	s := newMDUpdateStream()
+	id1 := tlf.FakeID(1, tlf.Private)
+	id2 := tlf.FakeID(2, tlf.Private)
+
+	c1, _ := s.register(id1, kbfsmd.Revision(3))
+	c2, _ := s.register(id2, kbfsmd.Revision(7))
+	s.cancel(id2, MDServerDisconnected{})
+	require.IsType(t, MDServerDisconnected{}, <-c2)
+
+	t.Log("A canceled registration is still registered with the server")
+	c2, alreadyRegistered := s.register(id2, kbfsmd.Revision(7))
+	require.True(t, alreadyRegistered)
+	s.cancel(id2, MDServerDisconnected{})
+	<-c2
+
+	t.Log("Only waiting observers survive a disconnect")
+	s.disconnected()
+	require.Equal(t, map[tlf.ID]kbfsmd.Revision{id1: kbfsmd.Revision(3)},
+		s.waiting())
+	require.False(t, s.markRegistered(id2))
+	require.True(t, s.markRegistered(id1))
+	require.Len(t, s.waiting(), 0)
+
+	_, _, ok := s.deliver(id1, kbfsmd.Revision(4))
+	require.True(t, ok)
+	require.NoError(t, <-c1)
+
+	c1, _ = s.register(id1, kbfsmd.Revision(4))
+	s.cancelAll(MDServerDisconnected{})
+	require.IsType(t, MDServerDisconnected{}, <-c1)
+	require.Len(t, s.waiting(), 0)
+}
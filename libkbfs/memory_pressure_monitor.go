@@ -0,0 +1,201 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/shirou/gopsutil/mem"
+)
+
+const (
+	// memoryPressureCheckPeriod is how often the memory pressure
+	// monitor checks the process and system memory use.
+	memoryPressureCheckPeriod = 10 * time.Second
+	// memoryPressureLowAvailableFraction is the fraction of system
+	// RAM below which the available memory counts as pressure.
+	memoryPressureLowAvailableFraction = 0.1
+	// memoryPressureHighAvailableFraction is the fraction of system
+	// RAM above which the available memory is plentiful enough to
+	// grow the cache again.  It's higher than the low mark, so the
+	// capacity doesn't flap around a single threshold.
+	memoryPressureHighAvailableFraction = 0.2
+	// memoryPressureRSSGrowFraction is the fraction of the maximum
+	// RSS below which the cache can grow again.
+	memoryPressureRSSGrowFraction = 0.8
+	// memoryPressureMinCapacityDivisor limits how far the clean
+	// block cache can shrink, relative to its normal capacity.
+	memoryPressureMinCapacityDivisor = 16
+	// memoryPressureGrowDivisor sets how much the clean block
+	// cache can grow per check, relative to its normal capacity.
+	// Growth is slower than shrinking, which halves the capacity.
+	memoryPressureGrowDivisor = 8
+)
+
+// memoryStats is a snapshot of the process and system memory use.
+type memoryStats struct {
+	// rss is the process's resident set size.
+	rss uint64
+	// systemTotal and systemAvailable are the total and available
+	// RAM on the system, or 0 if they're unknown.
+	systemTotal     uint64
+	systemAvailable uint64
+}
+
+func getMemoryStats() (memoryStats, error) {
+	rss, err := getProcessRSS()
+	if err != nil {
+		return memoryStats{}, err
+	}
+	stats := memoryStats{rss: rss}
+	vmstat, err := mem.VirtualMemory()
+	if err == nil {
+		stats.systemTotal = vmstat.Total
+		stats.systemAvailable = vmstat.Available
+	}
+	return stats, nil
+}
+
+type memoryPressureMonitorConfig interface {
+	blockCacher
+	logMaker
+}
+
+// memoryPressureMonitor periodically checks the process's RSS and the
+// available system memory, and shrinks the clean block cache (evicting
+// blocks right away) when memory is tight, growing it back towards its
+// normal capacity once the pressure is gone.  This keeps KBFS from
+// getting the process killed on devices with little RAM.
+type memoryPressureMonitor struct {
+	config      memoryPressureMonitorConfig
+	log         logger.Logger
+	getStats    func() (memoryStats, error)
+	maxRSS      uint64
+	maxCapacity uint64
+	minCapacity uint64
+
+	shutdownOnce sync.Once
+	shutdownCh   chan struct{}
+	doneCh       chan struct{}
+}
+
+// newMemoryPressureMonitor returns a monitor for the given config's
+// block cache, which treats the block cache's current capacity as its
+// normal one.  If `maxRSS` is non-zero, the process having a bigger
+// RSS also counts as memory pressure.
+func newMemoryPressureMonitor(config memoryPressureMonitorConfig,
+	maxRSS uint64,
+	getStats func() (memoryStats, error)) *memoryPressureMonitor {
+	maxCapacity := config.BlockCache().GetCleanBytesCapacity()
+	minCapacity := maxCapacity / memoryPressureMinCapacityDivisor
+	if minCapacity < MaxBlockSizeBytesDefault {
+		minCapacity = MaxBlockSizeBytesDefault
+	}
+	if minCapacity > maxCapacity {
+		minCapacity = maxCapacity
+	}
+	return &memoryPressureMonitor{
+		config:      config,
+		log:         config.MakeLogger("MPM"),
+		getStats:    getStats,
+		maxRSS:      maxRSS,
+		maxCapacity: maxCapacity,
+		minCapacity: minCapacity,
+		shutdownCh:  make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+}
+
+func (mpm *memoryPressureMonitor) underPressure(stats memoryStats) bool {
+	if mpm.maxRSS > 0 && stats.rss > mpm.maxRSS {
+		return true
+	}
+	return stats.systemTotal > 0 &&
+		float64(stats.systemAvailable) <
+			float64(stats.systemTotal)*memoryPressureLowAvailableFraction
+}
+
+func (mpm *memoryPressureMonitor) canGrow(stats memoryStats) bool {
+	if mpm.maxRSS > 0 &&
+		float64(stats.rss) >= float64(mpm.maxRSS)*memoryPressureRSSGrowFraction {
+		return false
+	}
+	return stats.systemTotal == 0 ||
+		float64(stats.systemAvailable) >
+			float64(stats.systemTotal)*memoryPressureHighAvailableFraction
+}
+
+// check adjusts the block cache capacity once, based on the current
+// memory stats.
+func (mpm *memoryPressureMonitor) check() {
+	stats, err := mpm.getStats()
+	if err != nil {
+		mpm.log.Debug("Couldn't get memory stats: %+v", err)
+		return
+	}
+
+	bcache := mpm.config.BlockCache()
+	capacity := bcache.GetCleanBytesCapacity()
+	switch {
+	case mpm.underPressure(stats):
+		newCapacity := capacity / 2
+		if newCapacity < mpm.minCapacity {
+			newCapacity = mpm.minCapacity
+		}
+		if newCapacity < capacity {
+			mpm.log.Debug("Memory pressure (rss=%d, available=%d/%d); "+
+				"shrinking clean block cache capacity from %d to %d",
+				stats.rss, stats.systemAvailable, stats.systemTotal,
+				capacity, newCapacity)
+			bcache.SetCleanBytesCapacity(newCapacity)
+		}
+		// Hand the evicted blocks back to the OS right away,
+		// rather than waiting for the scavenger.
+		debug.FreeOSMemory()
+	case capacity < mpm.maxCapacity && mpm.canGrow(stats):
+		newCapacity := capacity + mpm.maxCapacity/memoryPressureGrowDivisor
+		if newCapacity > mpm.maxCapacity {
+			newCapacity = mpm.maxCapacity
+		}
+		mpm.log.Debug("Memory pressure gone (rss=%d, available=%d/%d); "+
+			"growing clean block cache capacity from %d to %d",
+			stats.rss, stats.systemAvailable, stats.systemTotal,
+			capacity, newCapacity)
+		bcache.SetCleanBytesCapacity(newCapacity)
+	}
+}
+
+func (mpm *memoryPressureMonitor) loop(period time.Duration) {
+	defer close(mpm.doneCh)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mpm.check()
+		case <-mpm.shutdownCh:
+			return
+		}
+	}
+}
+
+// start starts checking the memory use in the background, every
+// `period`.
+func (mpm *memoryPressureMonitor) start(period time.Duration) {
+	go mpm.loop(period)
+}
+
+// shutdown stops the background checks, and restores the block
+// cache's normal capacity.
+func (mpm *memoryPressureMonitor) shutdown() {
+	mpm.shutdownOnce.Do(func() {
+		close(mpm.shutdownCh)
+		<-mpm.doneCh
+		mpm.config.BlockCache().SetCleanBytesCapacity(mpm.maxCapacity)
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testMemoryPressureConfig struct {
+	testLogMaker
+	bcache BlockCache
+}
+
+func (c testMemoryPressureConfig) BlockCache() BlockCache {
+	return c.bcache
+}
+
+func TestMemoryPressureMonitor(t *testing.T) {
+	const maxCapacity = 16 * MaxBlockSizeBytesDefault
+	const maxRSS = 100
+	bcache := NewBlockCacheStandard(100, maxCapacity)
+	config := testMemoryPressureConfig{newTestLogMaker(t), bcache}
+
+	var stats memoryStats
+	var statsErr error
+	mpm := newMemoryPressureMonitor(config, maxRSS,
+		func() (memoryStats, error) {
+			return stats, statsErr
+		})
+	require.Equal(t, uint64(MaxBlockSizeBytesDefault), mpm.minCapacity)
+
+	// Fill up the cache.
+	tlfID := tlf.FakeID(1, tlf.Private)
+	for i := byte(0); i < 16; i++ {
+		block := &FileBlock{
+			Contents: make([]byte, MaxBlockSizeBytesDefault),
+		}
+		err := bcache.Put(
+			BlockPointer{ID: kbfsblock.FakeID(i)}, tlfID, block,
+			TransientEntry)
+		require.NoError(t, err)
+	}
+	numCached := func() int {
+		return bcache.cleanTransient.Len()
+	}
+	require.Equal(t, 16, numCached())
+
+	t.Log("No pressure leaves the capacity alone.")
+	stats = memoryStats{rss: 10, systemTotal: 100, systemAvailable: 50}
+	mpm.check()
+	require.Equal(t, uint64(maxCapacity), bcache.GetCleanBytesCapacity())
+
+	t.Log("Going over the max RSS halves the capacity, and evicts " +
+		"blocks right away.")
+	stats.rss = maxRSS + 1
+	mpm.check()
+	require.Equal(t, uint64(maxCapacity/2), bcache.GetCleanBytesCapacity())
+	require.Equal(t, 8, numCached())
+
+	t.Log("So does low system memory, down to the minimum capacity.")
+	stats = memoryStats{rss: 10, systemTotal: 100, systemAvailable: 5}
+	for i := 0; i < 5; i++ {
+		mpm.check()
+	}
+	require.Equal(t, mpm.minCapacity, bcache.GetCleanBytesCapacity())
+	require.Equal(t, 1, numCached())
+
+	t.Log("Errors getting the stats change nothing.")
+	statsErr = errors.New("no stats")
+	stats = memoryStats{rss: 10, systemTotal: 100, systemAvailable: 50}
+	mpm.check()
+	require.Equal(t, mpm.minCapacity, bcache.GetCleanBytesCapacity())
+	statsErr = nil
+
+	t.Log("The capacity doesn't grow until there's plenty of memory.")
+	stats = memoryStats{rss: 10, systemTotal: 100, systemAvailable: 15}
+	mpm.check()
+	require.Equal(t, mpm.minCapacity, bcache.GetCleanBytesCapacity())
+	stats = memoryStats{rss: 90, systemTotal: 100, systemAvailable: 50}
+	mpm.check()
+	require.Equal(t, mpm.minCapacity, bcache.GetCleanBytesCapacity())
+
+	t.Log("Once there is, it grows back gradually to the normal " +
+		"capacity.")
+	stats = memoryStats{rss: 10, systemTotal: 100, systemAvailable: 50}
+	mpm.check()
+	require.Equal(t, mpm.minCapacity+maxCapacity/8,
+		bcache.GetCleanBytesCapacity())
+	for i := 0; i < 10; i++ {
+		mpm.check()
+	}
+	require.Equal(t, uint64(maxCapacity), bcache.GetCleanBytesCapacity())
+}
+
+func TestMemoryPressureMonitorShutdownRestoresCapacity(t *testing.T) {
+	const maxCapacity = 16 * MaxBlockSizeBytesDefault
+	bcache := NewBlockCacheStandard(100, maxCapacity)
+	config := testMemoryPressureConfig{newTestLogMaker(t), bcache}
+
+	checked := make(chan struct{}, 1)
+	mpm := newMemoryPressureMonitor(config, 0,
+		func() (memoryStats, error) {
+			select {
+			case checked <- struct{}{}:
+			default:
+			}
+			return memoryStats{
+				rss: 10, systemTotal: 100, systemAvailable: 1,
+			}, nil
+		})
+	mpm.start(time.Millisecond)
+	<-checked
+	mpm.shutdown()
+	require.Equal(t, uint64(maxCapacity), bcache.GetCleanBytesCapacity())
+
+	// Shutting down again is fine.
+	mpm.shutdown()
+}
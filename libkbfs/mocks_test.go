@@ -370,6 +370,41 @@ func (mr *MocksignerGetterMockRecorder) Signer() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Signer", reflect.TypeOf((*MocksignerGetter)(nil).Signer))
 }
 
+// MocktuningProfileGetter is a mock of tuningProfileGetter interface
+type MocktuningProfileGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MocktuningProfileGetterMockRecorder
+}
+
+// MocktuningProfileGetterMockRecorder is the mock recorder for MocktuningProfileGetter
+type MocktuningProfileGetterMockRecorder struct {
+	mock *MocktuningProfileGetter
+}
+
+// NewMocktuningProfileGetter creates a new mock instance
+func NewMocktuningProfileGetter(ctrl *gomock.Controller) *MocktuningProfileGetter {
+	mock := &MocktuningProfileGetter{ctrl: ctrl}
+	mock.recorder = &MocktuningProfileGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MocktuningProfileGetter) EXPECT() *MocktuningProfileGetterMockRecorder {
+	return m.recorder
+}
+
+// TuningProfile mocks base method
+func (m *MocktuningProfileGetter) TuningProfile(tlfID tlf.ID) TuningProfile {
+	ret := m.ctrl.Call(m, "TuningProfile", tlfID)
+	ret0, _ := ret[0].(TuningProfile)
+	return ret0
+}
+
+// TuningProfile indicates an expected call of TuningProfile
+func (mr *MocktuningProfileGetterMockRecorder) TuningProfile(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TuningProfile", reflect.TypeOf((*MocktuningProfileGetter)(nil).TuningProfile), tlfID)
+}
+
 // MockdiskBlockCacheGetter is a mock of diskBlockCacheGetter interface
 type MockdiskBlockCacheGetter struct {
 	ctrl     *gomock.Controller
@@ -925,6 +960,18 @@ func (mr *MockKBFSOpsMockRecorder) GetTLFID(ctx, tlfHandle interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTLFID", reflect.TypeOf((*MockKBFSOps)(nil).GetTLFID), ctx, tlfHandle)
 }
 
+// RecoverFolderAccess mocks base method
+func (m *MockKBFSOps) RecoverFolderAccess(ctx context.Context, tlfHandle *TlfHandle) error {
+	ret := m.ctrl.Call(m, "RecoverFolderAccess", ctx, tlfHandle)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecoverFolderAccess indicates an expected call of RecoverFolderAccess
+func (mr *MockKBFSOpsMockRecorder) RecoverFolderAccess(ctx, tlfHandle interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecoverFolderAccess", reflect.TypeOf((*MockKBFSOps)(nil).RecoverFolderAccess), ctx, tlfHandle)
+}
+
 // GetOrCreateRootNode mocks base method
 func (m *MockKBFSOps) GetOrCreateRootNode(ctx context.Context, h *TlfHandle, branch BranchName) (Node, EntryInfo, error) {
 	ret := m.ctrl.Call(m, "GetOrCreateRootNode", ctx, h, branch)
@@ -966,6 +1013,19 @@ func (mr *MockKBFSOpsMockRecorder) GetDirChildren(ctx, dir interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDirChildren", reflect.TypeOf((*MockKBFSOps)(nil).GetDirChildren), ctx, dir)
 }
 
+// GetDirChildrenWithNodes mocks base method
+func (m *MockKBFSOps) GetDirChildrenWithNodes(ctx context.Context, dir Node) (map[string]DirChild, error) {
+	ret := m.ctrl.Call(m, "GetDirChildrenWithNodes", ctx, dir)
+	ret0, _ := ret[0].(map[string]DirChild)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDirChildrenWithNodes indicates an expected call of GetDirChildrenWithNodes
+func (mr *MockKBFSOpsMockRecorder) GetDirChildrenWithNodes(ctx, dir interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDirChildrenWithNodes", reflect.TypeOf((*MockKBFSOps)(nil).GetDirChildrenWithNodes), ctx, dir)
+}
+
 // Lookup mocks base method
 func (m *MockKBFSOps) Lookup(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
 	ret := m.ctrl.Call(m, "Lookup", ctx, dir, name)
@@ -1007,6 +1067,34 @@ func (mr *MockKBFSOpsMockRecorder) CreateDir(ctx, dir, name interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDir", reflect.TypeOf((*MockKBFSOps)(nil).CreateDir), ctx, dir, name)
 }
 
+// CreatePath mocks base method
+func (m *MockKBFSOps) CreatePath(ctx context.Context, dir Node, path string) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "CreatePath", ctx, dir, path)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreatePath indicates an expected call of CreatePath
+func (mr *MockKBFSOpsMockRecorder) CreatePath(ctx, dir, path interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePath", reflect.TypeOf((*MockKBFSOps)(nil).CreatePath), ctx, dir, path)
+}
+
+// WriteFileAtomic mocks base method
+func (m *MockKBFSOps) WriteFileAtomic(ctx context.Context, dir Node, name string, contents []byte) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "WriteFileAtomic", ctx, dir, name, contents)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// WriteFileAtomic indicates an expected call of WriteFileAtomic
+func (mr *MockKBFSOpsMockRecorder) WriteFileAtomic(ctx, dir, name, contents interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteFileAtomic", reflect.TypeOf((*MockKBFSOps)(nil).WriteFileAtomic), ctx, dir, name, contents)
+}
+
 // CreateFile mocks base method
 func (m *MockKBFSOps) CreateFile(ctx context.Context, dir Node, name string, isExec bool, excl Excl) (Node, EntryInfo, error) {
 	ret := m.ctrl.Call(m, "CreateFile", ctx, dir, name, isExec, excl)
@@ -1070,6 +1158,18 @@ func (mr *MockKBFSOpsMockRecorder) Rename(ctx, oldParent, oldName, newParent, ne
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rename", reflect.TypeOf((*MockKBFSOps)(nil).Rename), ctx, oldParent, oldName, newParent, newName)
 }
 
+// CrossTlfMove mocks base method
+func (m *MockKBFSOps) CrossTlfMove(ctx context.Context, srcParent Node, srcName string, dstParent Node, dstName string) error {
+	ret := m.ctrl.Call(m, "CrossTlfMove", ctx, srcParent, srcName, dstParent, dstName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CrossTlfMove indicates an expected call of CrossTlfMove
+func (mr *MockKBFSOpsMockRecorder) CrossTlfMove(ctx, srcParent, srcName, dstParent, dstName interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CrossTlfMove", reflect.TypeOf((*MockKBFSOps)(nil).CrossTlfMove), ctx, srcParent, srcName, dstParent, dstName)
+}
+
 // Read mocks base method
 func (m *MockKBFSOps) Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error) {
 	ret := m.ctrl.Call(m, "Read", ctx, file, dest, off)
@@ -1107,6 +1207,18 @@ func (mr *MockKBFSOpsMockRecorder) Truncate(ctx, file, size interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Truncate", reflect.TypeOf((*MockKBFSOps)(nil).Truncate), ctx, file, size)
 }
 
+// Preallocate mocks base method
+func (m *MockKBFSOps) Preallocate(ctx context.Context, file Node, size uint64) error {
+	ret := m.ctrl.Call(m, "Preallocate", ctx, file, size)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Preallocate indicates an expected call of Preallocate
+func (mr *MockKBFSOpsMockRecorder) Preallocate(ctx, file, size interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Preallocate", reflect.TypeOf((*MockKBFSOps)(nil).Preallocate), ctx, file, size)
+}
+
 // SetEx mocks base method
 func (m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
 	ret := m.ctrl.Call(m, "SetEx", ctx, file, ex)
@@ -1131,6 +1243,18 @@ func (mr *MockKBFSOpsMockRecorder) SetMtime(ctx, file, mtime interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMtime", reflect.TypeOf((*MockKBFSOps)(nil).SetMtime), ctx, file, mtime)
 }
 
+// SetTimes mocks base method
+func (m *MockKBFSOps) SetTimes(ctx context.Context, file Node, times EntryTimes) error {
+	ret := m.ctrl.Call(m, "SetTimes", ctx, file, times)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTimes indicates an expected call of SetTimes
+func (mr *MockKBFSOpsMockRecorder) SetTimes(ctx, file, times interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTimes", reflect.TypeOf((*MockKBFSOps)(nil).SetTimes), ctx, file, times)
+}
+
 // SyncAll mocks base method
 func (m *MockKBFSOps) SyncAll(ctx context.Context, folderBranch FolderBranch) error {
 	ret := m.ctrl.Call(m, "SyncAll", ctx, folderBranch)
@@ -1143,6 +1267,69 @@ func (mr *MockKBFSOpsMockRecorder) SyncAll(ctx, folderBranch interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncAll", reflect.TypeOf((*MockKBFSOps)(nil).SyncAll), ctx, folderBranch)
 }
 
+// CancelSync mocks base method
+func (m *MockKBFSOps) CancelSync(ctx context.Context, folderBranch FolderBranch) error {
+	ret := m.ctrl.Call(m, "CancelSync", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CancelSync indicates an expected call of CancelSync
+func (mr *MockKBFSOpsMockRecorder) CancelSync(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelSync", reflect.TypeOf((*MockKBFSOps)(nil).CancelSync), ctx, folderBranch)
+}
+
+// GetContentPolicy mocks base method
+func (m *MockKBFSOps) GetContentPolicy(ctx context.Context, folderBranch FolderBranch) (*TlfContentPolicy, error) {
+	ret := m.ctrl.Call(m, "GetContentPolicy", ctx, folderBranch)
+	ret0, _ := ret[0].(*TlfContentPolicy)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetContentPolicy indicates an expected call of GetContentPolicy
+func (mr *MockKBFSOpsMockRecorder) GetContentPolicy(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetContentPolicy", reflect.TypeOf((*MockKBFSOps)(nil).GetContentPolicy), ctx, folderBranch)
+}
+
+// SetContentPolicy mocks base method
+func (m *MockKBFSOps) SetContentPolicy(ctx context.Context, folderBranch FolderBranch, policy *TlfContentPolicy) error {
+	ret := m.ctrl.Call(m, "SetContentPolicy", ctx, folderBranch, policy)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetContentPolicy indicates an expected call of SetContentPolicy
+func (mr *MockKBFSOpsMockRecorder) SetContentPolicy(ctx, folderBranch, policy interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetContentPolicy", reflect.TypeOf((*MockKBFSOps)(nil).SetContentPolicy), ctx, folderBranch, policy)
+}
+
+// GetTlfOpStats mocks base method
+func (m *MockKBFSOps) GetTlfOpStats(ctx context.Context, folderBranch FolderBranch) (TlfOpStats, error) {
+	ret := m.ctrl.Call(m, "GetTlfOpStats", ctx, folderBranch)
+	ret0, _ := ret[0].(TlfOpStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTlfOpStats indicates an expected call of GetTlfOpStats
+func (mr *MockKBFSOpsMockRecorder) GetTlfOpStats(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTlfOpStats", reflect.TypeOf((*MockKBFSOps)(nil).GetTlfOpStats), ctx, folderBranch)
+}
+
+// DebugDump mocks base method
+func (m *MockKBFSOps) DebugDump(ctx context.Context, folderBranch FolderBranch) ([]byte, error) {
+	ret := m.ctrl.Call(m, "DebugDump", ctx, folderBranch)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DebugDump indicates an expected call of DebugDump
+func (mr *MockKBFSOpsMockRecorder) DebugDump(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DebugDump", reflect.TypeOf((*MockKBFSOps)(nil).DebugDump), ctx, folderBranch)
+}
+
 // FolderStatus mocks base method
 func (m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := m.ctrl.Call(m, "FolderStatus", ctx, folderBranch)
@@ -1183,6 +1370,31 @@ func (mr *MockKBFSOpsMockRecorder) UnstageForTesting(ctx, folderBranch interface
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnstageForTesting", reflect.TypeOf((*MockKBFSOps)(nil).UnstageForTesting), ctx, folderBranch)
 }
 
+// ForceResolveNow mocks base method
+func (m *MockKBFSOps) ForceResolveNow(ctx context.Context, folderBranch FolderBranch) error {
+	ret := m.ctrl.Call(m, "ForceResolveNow", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ForceResolveNow indicates an expected call of ForceResolveNow
+func (mr *MockKBFSOpsMockRecorder) ForceResolveNow(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForceResolveNow", reflect.TypeOf((*MockKBFSOps)(nil).ForceResolveNow), ctx, folderBranch)
+}
+
+// GetRetainedBranches mocks base method
+func (m *MockKBFSOps) GetRetainedBranches(ctx context.Context, folderBranch FolderBranch) ([]RetainedBranchInfo, error) {
+	ret := m.ctrl.Call(m, "GetRetainedBranches", ctx, folderBranch)
+	ret0, _ := ret[0].([]RetainedBranchInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRetainedBranches indicates an expected call of GetRetainedBranches
+func (mr *MockKBFSOpsMockRecorder) GetRetainedBranches(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRetainedBranches", reflect.TypeOf((*MockKBFSOps)(nil).GetRetainedBranches), ctx, folderBranch)
+}
+
 // RequestRekey mocks base method
 func (m *MockKBFSOps) RequestRekey(ctx context.Context, id tlf.ID) {
 	m.ctrl.Call(m, "RequestRekey", ctx, id)
@@ -1244,6 +1456,33 @@ func (mr *MockKBFSOpsMockRecorder) GetNodeMetadata(ctx, node interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNodeMetadata", reflect.TypeOf((*MockKBFSOps)(nil).GetNodeMetadata), ctx, node)
 }
 
+// NodeToken mocks base method
+func (m *MockKBFSOps) NodeToken(ctx context.Context, node Node) (NodeToken, error) {
+	ret := m.ctrl.Call(m, "NodeToken", ctx, node)
+	ret0, _ := ret[0].(NodeToken)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NodeToken indicates an expected call of NodeToken
+func (mr *MockKBFSOpsMockRecorder) NodeToken(ctx, node interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NodeToken", reflect.TypeOf((*MockKBFSOps)(nil).NodeToken), ctx, node)
+}
+
+// NodeFromToken mocks base method
+func (m *MockKBFSOps) NodeFromToken(ctx context.Context, token NodeToken) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "NodeFromToken", ctx, token)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// NodeFromToken indicates an expected call of NodeFromToken
+func (mr *MockKBFSOpsMockRecorder) NodeFromToken(ctx, token interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NodeFromToken", reflect.TypeOf((*MockKBFSOps)(nil).NodeFromToken), ctx, token)
+}
+
 // Shutdown mocks base method
 func (m *MockKBFSOps) Shutdown(ctx context.Context) error {
 	ret := m.ctrl.Call(m, "Shutdown", ctx)
@@ -1296,6 +1535,16 @@ func (mr *MockKBFSOpsMockRecorder) ForceFastForward(ctx interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForceFastForward", reflect.TypeOf((*MockKBFSOps)(nil).ForceFastForward), ctx)
 }
 
+// LockKeys mocks base method
+func (m *MockKBFSOps) LockKeys(ctx context.Context) {
+	m.ctrl.Call(m, "LockKeys", ctx)
+}
+
+// LockKeys indicates an expected call of LockKeys
+func (mr *MockKBFSOpsMockRecorder) LockKeys(ctx interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LockKeys", reflect.TypeOf((*MockKBFSOps)(nil).LockKeys), ctx)
+}
+
 // TeamNameChanged mocks base method
 func (m *MockKBFSOps) TeamNameChanged(ctx context.Context, tid keybase1.TeamID) {
 	m.ctrl.Call(m, "TeamNameChanged", ctx, tid)
@@ -1542,6 +1791,19 @@ func (mr *MockKeybaseServiceMockRecorder) LoadTeamPlusKeys(ctx, tid, desiredKeyG
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadTeamPlusKeys", reflect.TypeOf((*MockKeybaseService)(nil).LoadTeamPlusKeys), ctx, tid, desiredKeyGen, desiredUser, desiredRole)
 }
 
+// IsCurrentUserTeamAdmin mocks base method
+func (m *MockKeybaseService) IsCurrentUserTeamAdmin(ctx context.Context, tid keybase1.TeamID) (bool, error) {
+	ret := m.ctrl.Call(m, "IsCurrentUserTeamAdmin", ctx, tid)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// IsCurrentUserTeamAdmin indicates an expected call of IsCurrentUserTeamAdmin
+func (mr *MockKeybaseServiceMockRecorder) IsCurrentUserTeamAdmin(ctx, tid interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsCurrentUserTeamAdmin", reflect.TypeOf((*MockKeybaseService)(nil).IsCurrentUserTeamAdmin), ctx, tid)
+}
+
 // CurrentSession mocks base method
 func (m *MockKeybaseService) CurrentSession(ctx context.Context, sessionID int) (SessionInfo, error) {
 	ret := m.ctrl.Call(m, "CurrentSession", ctx, sessionID)
@@ -2420,6 +2682,19 @@ func (mr *MockKeyMetadataMockRecorder) GetTLFCryptKeyParams(keyGen, user, key in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTLFCryptKeyParams", reflect.TypeOf((*MockKeyMetadata)(nil).GetTLFCryptKeyParams), keyGen, user, key)
 }
 
+// GetLatestDataEncryptionVer mocks base method
+func (m *MockKeyMetadata) GetLatestDataEncryptionVer() (kbfscrypto.EncryptionVer, error) {
+	ret := m.ctrl.Call(m, "GetLatestDataEncryptionVer")
+	ret0, _ := ret[0].(kbfscrypto.EncryptionVer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLatestDataEncryptionVer indicates an expected call of GetLatestDataEncryptionVer
+func (mr *MockKeyMetadataMockRecorder) GetLatestDataEncryptionVer() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLatestDataEncryptionVer", reflect.TypeOf((*MockKeyMetadata)(nil).GetLatestDataEncryptionVer))
+}
+
 // StoresHistoricTLFCryptKeys mocks base method
 func (m *MockKeyMetadata) StoresHistoricTLFCryptKeys() bool {
 	ret := m.ctrl.Call(m, "StoresHistoricTLFCryptKeys")
@@ -2677,6 +2952,18 @@ func (mr *MockKeyManagerMockRecorder) GetTLFCryptKeyOfAllGenerations(ctx, kmd in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTLFCryptKeyOfAllGenerations", reflect.TypeOf((*MockKeyManager)(nil).GetTLFCryptKeyOfAllGenerations), ctx, kmd)
 }
 
+// RecoverTLFCryptKeys mocks base method
+func (m *MockKeyManager) RecoverTLFCryptKeys(ctx context.Context, kmd KeyMetadata) error {
+	ret := m.ctrl.Call(m, "RecoverTLFCryptKeys", ctx, kmd)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecoverTLFCryptKeys indicates an expected call of RecoverTLFCryptKeys
+func (mr *MockKeyManagerMockRecorder) RecoverTLFCryptKeys(ctx, kmd interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecoverTLFCryptKeys", reflect.TypeOf((*MockKeyManager)(nil).RecoverTLFCryptKeys), ctx, kmd)
+}
+
 // Rekey mocks base method
 func (m *MockKeyManager) Rekey(ctx context.Context, md *RootMetadata, promptPaper bool) (bool, *kbfscrypto.TLFCryptKey, error) {
 	ret := m.ctrl.Call(m, "Rekey", ctx, md, promptPaper)
@@ -2766,6 +3053,77 @@ func (mr *MockReporterMockRecorder) Shutdown() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Shutdown", reflect.TypeOf((*MockReporter)(nil).Shutdown))
 }
 
+// MockActivityNotifier is a mock of ActivityNotifier interface
+type MockActivityNotifier struct {
+	ctrl     *gomock.Controller
+	recorder *MockActivityNotifierMockRecorder
+}
+
+// MockActivityNotifierMockRecorder is the mock recorder for MockActivityNotifier
+type MockActivityNotifierMockRecorder struct {
+	mock *MockActivityNotifier
+}
+
+// NewMockActivityNotifier creates a new mock instance
+func NewMockActivityNotifier(ctrl *gomock.Controller) *MockActivityNotifier {
+	mock := &MockActivityNotifier{ctrl: ctrl}
+	mock.recorder = &MockActivityNotifierMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockActivityNotifier) EXPECT() *MockActivityNotifierMockRecorder {
+	return m.recorder
+}
+
+// NotifyTlfActivity mocks base method
+func (m *MockActivityNotifier) NotifyTlfActivity(ctx context.Context, digest TlfActivityDigest) error {
+	ret := m.ctrl.Call(m, "NotifyTlfActivity", ctx, digest)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NotifyTlfActivity indicates an expected call of NotifyTlfActivity
+func (mr *MockActivityNotifierMockRecorder) NotifyTlfActivity(ctx, digest interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyTlfActivity", reflect.TypeOf((*MockActivityNotifier)(nil).NotifyTlfActivity), ctx, digest)
+}
+
+// MockWriteInterceptor is a mock of WriteInterceptor interface
+type MockWriteInterceptor struct {
+	ctrl     *gomock.Controller
+	recorder *MockWriteInterceptorMockRecorder
+}
+
+// MockWriteInterceptorMockRecorder is the mock recorder for MockWriteInterceptor
+type MockWriteInterceptorMockRecorder struct {
+	mock *MockWriteInterceptor
+}
+
+// NewMockWriteInterceptor creates a new mock instance
+func NewMockWriteInterceptor(ctrl *gomock.Controller) *MockWriteInterceptor {
+	mock := &MockWriteInterceptor{ctrl: ctrl}
+	mock.recorder = &MockWriteInterceptorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockWriteInterceptor) EXPECT() *MockWriteInterceptorMockRecorder {
+	return m.recorder
+}
+
+// InterceptWrite mocks base method
+func (m *MockWriteInterceptor) InterceptWrite(ctx context.Context, file string, chunks []WriteChunk) (WriteVerdict, error) {
+	ret := m.ctrl.Call(m, "InterceptWrite", ctx, file, chunks)
+	ret0, _ := ret[0].(WriteVerdict)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// InterceptWrite indicates an expected call of InterceptWrite
+func (mr *MockWriteInterceptorMockRecorder) InterceptWrite(ctx, file, chunks interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InterceptWrite", reflect.TypeOf((*MockWriteInterceptor)(nil).InterceptWrite), ctx, file, chunks)
+}
+
 // MockMDCache is a mock of MDCache interface
 type MockMDCache struct {
 	ctrl     *gomock.Controller
@@ -2881,6 +3239,16 @@ func (mr *MockMDCacheMockRecorder) ChangeHandleForID(oldHandle, newHandle interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangeHandleForID", reflect.TypeOf((*MockMDCache)(nil).ChangeHandleForID), oldHandle, newHandle)
 }
 
+// ClearTLF mocks base method
+func (m *MockMDCache) ClearTLF(tlfID tlf.ID) {
+	m.ctrl.Call(m, "ClearTLF", tlfID)
+}
+
+// ClearTLF indicates an expected call of ClearTLF
+func (mr *MockMDCacheMockRecorder) ClearTLF(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearTLF", reflect.TypeOf((*MockMDCache)(nil).ClearTLF), tlfID)
+}
+
 // MockKeyCache is a mock of KeyCache interface
 type MockKeyCache struct {
 	ctrl     *gomock.Controller
@@ -2929,6 +3297,26 @@ func (mr *MockKeyCacheMockRecorder) PutTLFCryptKey(arg0, arg1, arg2 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutTLFCryptKey", reflect.TypeOf((*MockKeyCache)(nil).PutTLFCryptKey), arg0, arg1, arg2)
 }
 
+// Clear mocks base method
+func (m *MockKeyCache) Clear() {
+	m.ctrl.Call(m, "Clear")
+}
+
+// Clear indicates an expected call of Clear
+func (mr *MockKeyCacheMockRecorder) Clear() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Clear", reflect.TypeOf((*MockKeyCache)(nil).Clear))
+}
+
+// ClearTLF mocks base method
+func (m *MockKeyCache) ClearTLF(tlfID tlf.ID) {
+	m.ctrl.Call(m, "ClearTLF", tlfID)
+}
+
+// ClearTLF indicates an expected call of ClearTLF
+func (mr *MockKeyCacheMockRecorder) ClearTLF(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearTLF", reflect.TypeOf((*MockKeyCache)(nil).ClearTLF), tlfID)
+}
+
 // MockBlockCacheSimple is a mock of BlockCacheSimple interface
 type MockBlockCacheSimple struct {
 	ctrl     *gomock.Controller
@@ -3123,6 +3511,16 @@ func (mr *MockBlockCacheMockRecorder) GetCleanBytesCapacity() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCleanBytesCapacity", reflect.TypeOf((*MockBlockCache)(nil).GetCleanBytesCapacity))
 }
 
+// ClearTLF mocks base method
+func (m *MockBlockCache) ClearTLF(tlfID tlf.ID) {
+	m.ctrl.Call(m, "ClearTLF", tlfID)
+}
+
+// ClearTLF indicates an expected call of ClearTLF
+func (mr *MockBlockCacheMockRecorder) ClearTLF(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearTLF", reflect.TypeOf((*MockBlockCache)(nil).ClearTLF), tlfID)
+}
+
 // MockDirtyBlockCache is a mock of DirtyBlockCache interface
 type MockDirtyBlockCache struct {
 	ctrl     *gomock.Controller
@@ -3526,8 +3924,8 @@ func (mr *MockcryptoPureMockRecorder) DecryptPrivateMetadata(encryptedPMD, key i
 }
 
 // EncryptBlock mocks base method
-func (m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (int, kbfscrypto.EncryptedBlock, error) {
-	ret := m.ctrl.Call(m, "EncryptBlock", block, key)
+func (m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey, encVer kbfscrypto.EncryptionVer) (int, kbfscrypto.EncryptedBlock, error) {
+	ret := m.ctrl.Call(m, "EncryptBlock", block, key, encVer)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(kbfscrypto.EncryptedBlock)
 	ret2, _ := ret[2].(error)
@@ -3535,8 +3933,8 @@ func (m *MockcryptoPure) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey)
 }
 
 // EncryptBlock indicates an expected call of EncryptBlock
-func (mr *MockcryptoPureMockRecorder) EncryptBlock(block, key interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptBlock", reflect.TypeOf((*MockcryptoPure)(nil).EncryptBlock), block, key)
+func (mr *MockcryptoPureMockRecorder) EncryptBlock(block, key, encVer interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptBlock", reflect.TypeOf((*MockcryptoPure)(nil).EncryptBlock), block, key, encVer)
 }
 
 // DecryptBlock mocks base method
@@ -3695,8 +4093,8 @@ func (mr *MockCryptoMockRecorder) DecryptPrivateMetadata(encryptedPMD, key inter
 }
 
 // EncryptBlock mocks base method
-func (m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (int, kbfscrypto.EncryptedBlock, error) {
-	ret := m.ctrl.Call(m, "EncryptBlock", block, key)
+func (m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey, encVer kbfscrypto.EncryptionVer) (int, kbfscrypto.EncryptedBlock, error) {
+	ret := m.ctrl.Call(m, "EncryptBlock", block, key, encVer)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(kbfscrypto.EncryptedBlock)
 	ret2, _ := ret[2].(error)
@@ -3704,8 +4102,8 @@ func (m *MockCrypto) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (in
 }
 
 // EncryptBlock indicates an expected call of EncryptBlock
-func (mr *MockCryptoMockRecorder) EncryptBlock(block, key interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptBlock", reflect.TypeOf((*MockCrypto)(nil).EncryptBlock), block, key)
+func (mr *MockCryptoMockRecorder) EncryptBlock(block, key, encVer interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptBlock", reflect.TypeOf((*MockCrypto)(nil).EncryptBlock), block, key, encVer)
 }
 
 // DecryptBlock mocks base method
@@ -5295,6 +5693,18 @@ func (mr *MockBlockSplitterMockRecorder) ShouldEmbedBlockChanges(bc interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ShouldEmbedBlockChanges", reflect.TypeOf((*MockBlockSplitter)(nil).ShouldEmbedBlockChanges), bc)
 }
 
+// ShouldInlineFile mocks base method
+func (m *MockBlockSplitter) ShouldInlineFile(size int64) bool {
+	ret := m.ctrl.Call(m, "ShouldInlineFile", size)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// ShouldInlineFile indicates an expected call of ShouldInlineFile
+func (mr *MockBlockSplitterMockRecorder) ShouldInlineFile(size interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ShouldInlineFile", reflect.TypeOf((*MockBlockSplitter)(nil).ShouldInlineFile), size)
+}
+
 // MockKeyServer is a mock of KeyServer interface
 type MockKeyServer struct {
 	ctrl     *gomock.Controller
@@ -5977,6 +6387,50 @@ func (mr *MockConfigMockRecorder) SetReporter(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetReporter", reflect.TypeOf((*MockConfig)(nil).SetReporter), arg0)
 }
 
+// ActivityNotifier mocks base method
+func (m *MockConfig) ActivityNotifier() ActivityNotifier {
+	ret := m.ctrl.Call(m, "ActivityNotifier")
+	ret0, _ := ret[0].(ActivityNotifier)
+	return ret0
+}
+
+// ActivityNotifier indicates an expected call of ActivityNotifier
+func (mr *MockConfigMockRecorder) ActivityNotifier() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ActivityNotifier", reflect.TypeOf((*MockConfig)(nil).ActivityNotifier))
+}
+
+// SetActivityNotifier mocks base method
+func (m *MockConfig) SetActivityNotifier(arg0 ActivityNotifier) {
+	m.ctrl.Call(m, "SetActivityNotifier", arg0)
+}
+
+// SetActivityNotifier indicates an expected call of SetActivityNotifier
+func (mr *MockConfigMockRecorder) SetActivityNotifier(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetActivityNotifier", reflect.TypeOf((*MockConfig)(nil).SetActivityNotifier), arg0)
+}
+
+// WriteInterceptor mocks base method
+func (m *MockConfig) WriteInterceptor() WriteInterceptor {
+	ret := m.ctrl.Call(m, "WriteInterceptor")
+	ret0, _ := ret[0].(WriteInterceptor)
+	return ret0
+}
+
+// WriteInterceptor indicates an expected call of WriteInterceptor
+func (mr *MockConfigMockRecorder) WriteInterceptor() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteInterceptor", reflect.TypeOf((*MockConfig)(nil).WriteInterceptor))
+}
+
+// SetWriteInterceptor mocks base method
+func (m *MockConfig) SetWriteInterceptor(arg0 WriteInterceptor) {
+	m.ctrl.Call(m, "SetWriteInterceptor", arg0)
+}
+
+// SetWriteInterceptor indicates an expected call of SetWriteInterceptor
+func (mr *MockConfigMockRecorder) SetWriteInterceptor(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetWriteInterceptor", reflect.TypeOf((*MockConfig)(nil).SetWriteInterceptor), arg0)
+}
+
 // MDCache mocks base method
 func (m *MockConfig) MDCache() MDCache {
 	ret := m.ctrl.Call(m, "MDCache")
@@ -6649,6 +7103,360 @@ func (mr *MockConfigMockRecorder) SetBGFlushPeriod(p interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBGFlushPeriod", reflect.TypeOf((*MockConfig)(nil).SetBGFlushPeriod), p)
 }
 
+// TLFIdleEvictionTimeout mocks base method
+func (m *MockConfig) TLFIdleEvictionTimeout() time.Duration {
+	ret := m.ctrl.Call(m, "TLFIdleEvictionTimeout")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// TLFIdleEvictionTimeout indicates an expected call of TLFIdleEvictionTimeout
+func (mr *MockConfigMockRecorder) TLFIdleEvictionTimeout() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TLFIdleEvictionTimeout", reflect.TypeOf((*MockConfig)(nil).TLFIdleEvictionTimeout))
+}
+
+// SetTLFIdleEvictionTimeout mocks base method
+func (m *MockConfig) SetTLFIdleEvictionTimeout(d time.Duration) {
+	m.ctrl.Call(m, "SetTLFIdleEvictionTimeout", d)
+}
+
+// SetTLFIdleEvictionTimeout indicates an expected call of SetTLFIdleEvictionTimeout
+func (mr *MockConfigMockRecorder) SetTLFIdleEvictionTimeout(d interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTLFIdleEvictionTimeout", reflect.TypeOf((*MockConfig)(nil).SetTLFIdleEvictionTimeout), d)
+}
+
+// AtimePolicy mocks base method
+func (m *MockConfig) AtimePolicy() AtimePolicy {
+	ret := m.ctrl.Call(m, "AtimePolicy")
+	ret0, _ := ret[0].(AtimePolicy)
+	return ret0
+}
+
+// AtimePolicy indicates an expected call of AtimePolicy
+func (mr *MockConfigMockRecorder) AtimePolicy() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AtimePolicy", reflect.TypeOf((*MockConfig)(nil).AtimePolicy))
+}
+
+// SetAtimePolicy mocks base method
+func (m *MockConfig) SetAtimePolicy(p AtimePolicy) {
+	m.ctrl.Call(m, "SetAtimePolicy", p)
+}
+
+// SetAtimePolicy indicates an expected call of SetAtimePolicy
+func (mr *MockConfigMockRecorder) SetAtimePolicy(p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAtimePolicy", reflect.TypeOf((*MockConfig)(nil).SetAtimePolicy), p)
+}
+
+// MaxOpenTLFs mocks base method
+func (m *MockConfig) MaxOpenTLFs() int {
+	ret := m.ctrl.Call(m, "MaxOpenTLFs")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// MaxOpenTLFs indicates an expected call of MaxOpenTLFs
+func (mr *MockConfigMockRecorder) MaxOpenTLFs() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxOpenTLFs", reflect.TypeOf((*MockConfig)(nil).MaxOpenTLFs))
+}
+
+// SetMaxOpenTLFs mocks base method
+func (m *MockConfig) SetMaxOpenTLFs(n int) {
+	m.ctrl.Call(m, "SetMaxOpenTLFs", n)
+}
+
+// SetMaxOpenTLFs indicates an expected call of SetMaxOpenTLFs
+func (mr *MockConfigMockRecorder) SetMaxOpenTLFs(n interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxOpenTLFs", reflect.TypeOf((*MockConfig)(nil).SetMaxOpenTLFs), n)
+}
+
+// KeyCacheTTL mocks base method
+func (m *MockConfig) KeyCacheTTL() time.Duration {
+	ret := m.ctrl.Call(m, "KeyCacheTTL")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// KeyCacheTTL indicates an expected call of KeyCacheTTL
+func (mr *MockConfigMockRecorder) KeyCacheTTL() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "KeyCacheTTL", reflect.TypeOf((*MockConfig)(nil).KeyCacheTTL))
+}
+
+// SetKeyCacheTTL mocks base method
+func (m *MockConfig) SetKeyCacheTTL(d time.Duration) {
+	m.ctrl.Call(m, "SetKeyCacheTTL", d)
+}
+
+// SetKeyCacheTTL indicates an expected call of SetKeyCacheTTL
+func (mr *MockConfigMockRecorder) SetKeyCacheTTL(d interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetKeyCacheTTL", reflect.TypeOf((*MockConfig)(nil).SetKeyCacheTTL), d)
+}
+
+// CRQuietPeriod mocks base method
+func (m *MockConfig) CRQuietPeriod() time.Duration {
+	ret := m.ctrl.Call(m, "CRQuietPeriod")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// CRQuietPeriod indicates an expected call of CRQuietPeriod
+func (mr *MockConfigMockRecorder) CRQuietPeriod() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CRQuietPeriod", reflect.TypeOf((*MockConfig)(nil).CRQuietPeriod))
+}
+
+// LogRingBufferBytes mocks base method
+func (m *MockConfig) LogRingBufferBytes() int {
+	ret := m.ctrl.Call(m, "LogRingBufferBytes")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// LogRingBufferBytes indicates an expected call of LogRingBufferBytes
+func (mr *MockConfigMockRecorder) LogRingBufferBytes() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LogRingBufferBytes", reflect.TypeOf((*MockConfig)(nil).LogRingBufferBytes))
+}
+
+// SetLogRingBufferBytes mocks base method
+func (m *MockConfig) SetLogRingBufferBytes(n int) {
+	m.ctrl.Call(m, "SetLogRingBufferBytes", n)
+}
+
+// SetLogRingBufferBytes indicates an expected call of SetLogRingBufferBytes
+func (mr *MockConfigMockRecorder) SetLogRingBufferBytes(n interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLogRingBufferBytes", reflect.TypeOf((*MockConfig)(nil).SetLogRingBufferBytes), n)
+}
+
+// SetCRQuietPeriod mocks base method
+func (m *MockConfig) SetCRQuietPeriod(d time.Duration) {
+	m.ctrl.Call(m, "SetCRQuietPeriod", d)
+}
+
+// SetCRQuietPeriod indicates an expected call of SetCRQuietPeriod
+func (mr *MockConfigMockRecorder) SetCRQuietPeriod(d interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCRQuietPeriod", reflect.TypeOf((*MockConfig)(nil).SetCRQuietPeriod), d)
+}
+
+// ConflictManifestEnabled mocks base method
+func (m *MockConfig) ConflictManifestEnabled() bool {
+	ret := m.ctrl.Call(m, "ConflictManifestEnabled")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// ConflictManifestEnabled indicates an expected call of ConflictManifestEnabled
+func (mr *MockConfigMockRecorder) ConflictManifestEnabled() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConflictManifestEnabled", reflect.TypeOf((*MockConfig)(nil).ConflictManifestEnabled))
+}
+
+// SetConflictManifestEnabled mocks base method
+func (m *MockConfig) SetConflictManifestEnabled(enabled bool) {
+	m.ctrl.Call(m, "SetConflictManifestEnabled", enabled)
+}
+
+// SetConflictManifestEnabled indicates an expected call of SetConflictManifestEnabled
+func (mr *MockConfigMockRecorder) SetConflictManifestEnabled(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConflictManifestEnabled", reflect.TypeOf((*MockConfig)(nil).SetConflictManifestEnabled), enabled)
+}
+
+// CRTextMergePolicy mocks base method
+func (m *MockConfig) CRTextMergePolicy() CRTextMergePolicy {
+	ret := m.ctrl.Call(m, "CRTextMergePolicy")
+	ret0, _ := ret[0].(CRTextMergePolicy)
+	return ret0
+}
+
+// CRTextMergePolicy indicates an expected call of CRTextMergePolicy
+func (mr *MockConfigMockRecorder) CRTextMergePolicy() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CRTextMergePolicy", reflect.TypeOf((*MockConfig)(nil).CRTextMergePolicy))
+}
+
+// SetCRTextMergePolicy mocks base method
+func (m *MockConfig) SetCRTextMergePolicy(p CRTextMergePolicy) {
+	m.ctrl.Call(m, "SetCRTextMergePolicy", p)
+}
+
+// SetCRTextMergePolicy indicates an expected call of SetCRTextMergePolicy
+func (mr *MockConfigMockRecorder) SetCRTextMergePolicy(p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCRTextMergePolicy", reflect.TypeOf((*MockConfig)(nil).SetCRTextMergePolicy), p)
+}
+
+// TlfUsageAlertPolicy mocks base method
+func (m *MockConfig) TlfUsageAlertPolicy() TlfUsageAlertPolicy {
+	ret := m.ctrl.Call(m, "TlfUsageAlertPolicy")
+	ret0, _ := ret[0].(TlfUsageAlertPolicy)
+	return ret0
+}
+
+// TlfUsageAlertPolicy indicates an expected call of TlfUsageAlertPolicy
+func (mr *MockConfigMockRecorder) TlfUsageAlertPolicy() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TlfUsageAlertPolicy", reflect.TypeOf((*MockConfig)(nil).TlfUsageAlertPolicy))
+}
+
+// SetTlfUsageAlertPolicy mocks base method
+func (m *MockConfig) SetTlfUsageAlertPolicy(p TlfUsageAlertPolicy) {
+	m.ctrl.Call(m, "SetTlfUsageAlertPolicy", p)
+}
+
+// SetTlfUsageAlertPolicy indicates an expected call of SetTlfUsageAlertPolicy
+func (mr *MockConfigMockRecorder) SetTlfUsageAlertPolicy(p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfUsageAlertPolicy", reflect.TypeOf((*MockConfig)(nil).SetTlfUsageAlertPolicy), p)
+}
+
+// UnmergedBranchRetention mocks base method
+func (m *MockConfig) UnmergedBranchRetention() time.Duration {
+	ret := m.ctrl.Call(m, "UnmergedBranchRetention")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// UnmergedBranchRetention indicates an expected call of UnmergedBranchRetention
+func (mr *MockConfigMockRecorder) UnmergedBranchRetention() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnmergedBranchRetention", reflect.TypeOf((*MockConfig)(nil).UnmergedBranchRetention))
+}
+
+// SetUnmergedBranchRetention mocks base method
+func (m *MockConfig) SetUnmergedBranchRetention(d time.Duration) {
+	m.ctrl.Call(m, "SetUnmergedBranchRetention", d)
+}
+
+// SetUnmergedBranchRetention indicates an expected call of SetUnmergedBranchRetention
+func (mr *MockConfigMockRecorder) SetUnmergedBranchRetention(d interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUnmergedBranchRetention", reflect.TypeOf((*MockConfig)(nil).SetUnmergedBranchRetention), d)
+}
+
+// MDPutPipelining mocks base method
+func (m *MockConfig) MDPutPipelining() bool {
+	ret := m.ctrl.Call(m, "MDPutPipelining")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// MDPutPipelining indicates an expected call of MDPutPipelining
+func (mr *MockConfigMockRecorder) MDPutPipelining() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MDPutPipelining", reflect.TypeOf((*MockConfig)(nil).MDPutPipelining))
+}
+
+// HideOpDeviceInfo mocks base method
+func (m *MockConfig) HideOpDeviceInfo() bool {
+	ret := m.ctrl.Call(m, "HideOpDeviceInfo")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// HideOpDeviceInfo indicates an expected call of HideOpDeviceInfo
+func (mr *MockConfigMockRecorder) HideOpDeviceInfo() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HideOpDeviceInfo", reflect.TypeOf((*MockConfig)(nil).HideOpDeviceInfo))
+}
+
+// SetHideOpDeviceInfo mocks base method
+func (m *MockConfig) SetHideOpDeviceInfo(hide bool) {
+	m.ctrl.Call(m, "SetHideOpDeviceInfo", hide)
+}
+
+// SetHideOpDeviceInfo indicates an expected call of SetHideOpDeviceInfo
+func (mr *MockConfigMockRecorder) SetHideOpDeviceInfo(hide interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetHideOpDeviceInfo", reflect.TypeOf((*MockConfig)(nil).SetHideOpDeviceInfo), hide)
+}
+
+// SetMDPutPipelining mocks base method
+func (m *MockConfig) SetMDPutPipelining(enabled bool) {
+	m.ctrl.Call(m, "SetMDPutPipelining", enabled)
+}
+
+// SetMDPutPipelining indicates an expected call of SetMDPutPipelining
+func (mr *MockConfigMockRecorder) SetMDPutPipelining(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMDPutPipelining", reflect.TypeOf((*MockConfig)(nil).SetMDPutPipelining), enabled)
+}
+
+// DiskCacheMmapReads mocks base method
+func (m *MockConfig) DiskCacheMmapReads() bool {
+	ret := m.ctrl.Call(m, "DiskCacheMmapReads")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// DiskCacheMmapReads indicates an expected call of DiskCacheMmapReads
+func (mr *MockConfigMockRecorder) DiskCacheMmapReads() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DiskCacheMmapReads", reflect.TypeOf((*MockConfig)(nil).DiskCacheMmapReads))
+}
+
+// SetDiskCacheMmapReads mocks base method
+func (m *MockConfig) SetDiskCacheMmapReads(enabled bool) {
+	m.ctrl.Call(m, "SetDiskCacheMmapReads", enabled)
+}
+
+// SetDiskCacheMmapReads indicates an expected call of SetDiskCacheMmapReads
+func (mr *MockConfigMockRecorder) SetDiskCacheMmapReads(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDiskCacheMmapReads", reflect.TypeOf((*MockConfig)(nil).SetDiskCacheMmapReads), enabled)
+}
+
+// StrictWriteVisibility mocks base method
+func (m *MockConfig) StrictWriteVisibility() bool {
+	ret := m.ctrl.Call(m, "StrictWriteVisibility")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// StrictWriteVisibility indicates an expected call of StrictWriteVisibility
+func (mr *MockConfigMockRecorder) StrictWriteVisibility() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StrictWriteVisibility", reflect.TypeOf((*MockConfig)(nil).StrictWriteVisibility))
+}
+
+// SetStrictWriteVisibility mocks base method
+func (m *MockConfig) SetStrictWriteVisibility(enabled bool) {
+	m.ctrl.Call(m, "SetStrictWriteVisibility", enabled)
+}
+
+// SetStrictWriteVisibility indicates an expected call of SetStrictWriteVisibility
+func (mr *MockConfigMockRecorder) SetStrictWriteVisibility(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetStrictWriteVisibility", reflect.TypeOf((*MockConfig)(nil).SetStrictWriteVisibility), enabled)
+}
+
+// DirOpCoalescingWindow mocks base method
+func (m *MockConfig) DirOpCoalescingWindow(tlfID tlf.ID) time.Duration {
+	ret := m.ctrl.Call(m, "DirOpCoalescingWindow", tlfID)
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// DirOpCoalescingWindow indicates an expected call of DirOpCoalescingWindow
+func (mr *MockConfigMockRecorder) DirOpCoalescingWindow(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DirOpCoalescingWindow", reflect.TypeOf((*MockConfig)(nil).DirOpCoalescingWindow), tlfID)
+}
+
+// SetDirOpCoalescingWindow mocks base method
+func (m *MockConfig) SetDirOpCoalescingWindow(tlfID tlf.ID, d time.Duration) {
+	m.ctrl.Call(m, "SetDirOpCoalescingWindow", tlfID, d)
+}
+
+// SetDirOpCoalescingWindow indicates an expected call of SetDirOpCoalescingWindow
+func (mr *MockConfigMockRecorder) SetDirOpCoalescingWindow(tlfID, d interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDirOpCoalescingWindow", reflect.TypeOf((*MockConfig)(nil).SetDirOpCoalescingWindow), tlfID, d)
+}
+
+// TuningProfile mocks base method
+func (m *MockConfig) TuningProfile(tlfID tlf.ID) TuningProfile {
+	ret := m.ctrl.Call(m, "TuningProfile", tlfID)
+	ret0, _ := ret[0].(TuningProfile)
+	return ret0
+}
+
+// TuningProfile indicates an expected call of TuningProfile
+func (mr *MockConfigMockRecorder) TuningProfile(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TuningProfile", reflect.TypeOf((*MockConfig)(nil).TuningProfile), tlfID)
+}
+
+// SetTuningProfile mocks base method
+func (m *MockConfig) SetTuningProfile(tlfID tlf.ID, name TuningProfileName) error {
+	ret := m.ctrl.Call(m, "SetTuningProfile", tlfID, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTuningProfile indicates an expected call of SetTuningProfile
+func (mr *MockConfigMockRecorder) SetTuningProfile(tlfID, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTuningProfile", reflect.TypeOf((*MockConfig)(nil).SetTuningProfile), tlfID, name)
+}
+
 // Shutdown mocks base method
 func (m *MockConfig) Shutdown(arg0 context.Context) error {
 	ret := m.ctrl.Call(m, "Shutdown", arg0)
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"runtime"
 	"testing"
 
@@ -260,6 +261,107 @@ func TestNodeCacheMoveNoParent(t *testing.T) {
 	}
 }
 
+// makeLargeNodeCacheSubtree adds a directory named "dir" under
+// `parent`, with `numDirs` subdirectories that each hold
+// `filesPerDir` files, and returns the directory node along with all
+// the other new nodes (which the caller must keep alive so they stay
+// in the cache).
+func makeLargeNodeCacheSubtree(tb testing.TB, ncs *nodeCacheStandard,
+	parent Node, firstID byte, numDirs, filesPerDir int) (
+	dirNode Node, descendants []Node) {
+	var numPtrs int
+	nextPtr := func() BlockPointer {
+		numPtrs++
+		id, err := kbfsblock.MakePermanentID(
+			[]byte(fmt.Sprintf("%d-%d", firstID, numPtrs)))
+		require.NoError(tb, err)
+		return BlockPointer{ID: id}
+	}
+	dirNode, err := ncs.GetOrCreate(nextPtr(), "dir", parent)
+	require.NoError(tb, err)
+	descendants = make([]Node, 0, numDirs*(filesPerDir+1))
+	for i := 0; i < numDirs; i++ {
+		subdir, err := ncs.GetOrCreate(
+			nextPtr(), fmt.Sprintf("sub%d", i), dirNode)
+		require.NoError(tb, err)
+		descendants = append(descendants, subdir)
+		for j := 0; j < filesPerDir; j++ {
+			file, err := ncs.GetOrCreate(
+				nextPtr(), fmt.Sprintf("file%d", j), subdir)
+			require.NoError(tb, err)
+			descendants = append(descendants, file)
+		}
+	}
+	return dirNode, descendants
+}
+
+// Tests that moving a directory with a large subtree, and updating
+// its pointer, is reflected in the paths of all its descendants.
+func TestNodeCacheMoveLargeSubtree(t *testing.T) {
+	ncs, _, childNode1, childNode2, _, path2 :=
+		setupNodeCache(t, tlf.FakeID(0, tlf.Private), MasterBranch, true)
+	dirNode, descendants := makeLargeNodeCacheSubtree(
+		t, ncs, childNode1, 10, 1000, 99)
+	require.Len(t, descendants, 100000)
+
+	checkUnder := func(parentPath []pathNode, dirName string) {
+		for _, i := range []int{0, 1, 50000, len(descendants) - 1} {
+			p := ncs.PathFromNode(descendants[i])
+			require.True(t, len(p.path) > len(parentPath)+1)
+			require.Equal(t, parentPath, p.path[:len(parentPath)])
+			require.Equal(t, dirName, p.path[len(parentPath)].Name)
+		}
+	}
+	path1 := ncs.PathFromNode(childNode1).path
+	checkUnder(path1, "dir")
+
+	t.Log("Move the directory, with all its descendants, under child2")
+	dirRef := ncs.PathFromNode(dirNode).tailRef()
+	undoMove, err := ncs.Move(dirRef, childNode2, "moved")
+	require.NoError(t, err)
+	checkUnder(path2, "moved")
+
+	t.Log("Give the directory a new pointer, as a sync would")
+	newPtr := BlockPointer{ID: kbfsblock.FakeID(9)}
+	require.True(t, ncs.UpdatePointer(dirRef, newPtr))
+	p := ncs.PathFromNode(descendants[0])
+	require.Equal(t, newPtr, p.path[len(path2)].BlockPointer)
+
+	t.Log("Undoing the move puts the whole subtree back")
+	undoMove()
+	checkUnder(path1, "dir")
+}
+
+// BenchmarkNodeCacheMoveLargeSubtree measures moving a directory with
+// 100k cached descendants, and then resolving the path of one of
+// them.
+func BenchmarkNodeCacheMoveLargeSubtree(b *testing.B) {
+	ncs := newNodeCacheStandard(
+		FolderBranch{tlf.FakeID(0, tlf.Private), MasterBranch})
+	rootNode, err := ncs.GetOrCreate(
+		BlockPointer{ID: kbfsblock.FakeID(0)}, "root", nil)
+	require.NoError(b, err)
+	childNode1, err := ncs.GetOrCreate(
+		BlockPointer{ID: kbfsblock.FakeID(1)}, "child1", rootNode)
+	require.NoError(b, err)
+	childNode2, err := ncs.GetOrCreate(
+		BlockPointer{ID: kbfsblock.FakeID(2)}, "child2", rootNode)
+	require.NoError(b, err)
+	dirNode, descendants := makeLargeNodeCacheSubtree(
+		b, ncs, childNode1, 10, 1000, 99)
+	dirRef := ncs.PathFromNode(dirNode).tailRef()
+	newParents := []Node{childNode2, childNode1}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ncs.Move(dirRef, newParents[i%2], "dir")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = ncs.PathFromNode(descendants[i%len(descendants)])
+	}
+}
+
 func checkNodeCachePath(t *testing.T, id tlf.ID, branch BranchName,
 	path path, expectedPath []pathNode) {
 	if len(path.path) != len(expectedPath) {
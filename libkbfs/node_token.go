@@ -0,0 +1,76 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/base64"
+	stdpath "path"
+
+	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// nodeTokenVersion is the version of the encoding of new node tokens.
+const nodeTokenVersion = 1
+
+// NodeToken is an opaque, serializable reference to a node.  Unlike a
+// Node, it stays meaningful across restarts, so frontends can persist
+// it (e.g., in a list of recent files) and later turn it back into a
+// Node with KBFSOps.NodeFromToken.
+type NodeToken string
+
+// nodeTokenData is what a NodeToken encodes.
+type nodeTokenData struct {
+	Version int        `codec:"v"`
+	Tlf     tlf.ID     `codec:"t"`
+	Branch  BranchName `codec:"b"`
+	// Ptr is the node's pointer when the token was made.  If the
+	// node still has it, it can be found without any lookups.
+	Ptr BlockPointer `codec:"p"`
+	// Path is the names leading to the node from the TLF root,
+	// used to find it again if its pointer has changed.
+	Path []string  `codec:"n,omitempty"`
+	Type EntryType `codec:"e"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// pathString returns the path hint of d, for error messages.
+func (d nodeTokenData) pathString() string {
+	return stdpath.Join(append([]string{"/"}, d.Path...)...)
+}
+
+func (d nodeTokenData) staleError(reason string) StaleNodeTokenError {
+	return StaleNodeTokenError{
+		Tlf:    d.Tlf,
+		Path:   d.pathString(),
+		Reason: reason,
+	}
+}
+
+func makeNodeToken(
+	codec kbfscodec.Codec, data nodeTokenData) (NodeToken, error) {
+	buf, err := codec.Encode(data)
+	if err != nil {
+		return "", err
+	}
+	return NodeToken(base64.RawURLEncoding.EncodeToString(buf)), nil
+}
+
+func decodeNodeToken(
+	codec kbfscodec.Codec, token NodeToken) (nodeTokenData, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(string(token))
+	if err != nil {
+		return nodeTokenData{}, InvalidNodeTokenError{token}
+	}
+	var data nodeTokenData
+	err = codec.Decode(buf, &data)
+	if err != nil || data.Version != nodeTokenVersion ||
+		data.Tlf == tlf.NullID {
+		return nodeTokenData{}, InvalidNodeTokenError{token}
+	}
+	return data, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsNodeTokens(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, u1.String(), tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps1.CreateFile(ctx, dirNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("A token for an unchanged node gives back the same node")
+	fileToken, err := kbfsOps1.NodeToken(ctx, fileNode)
+	require.NoError(t, err)
+	dirToken, err := kbfsOps1.NodeToken(ctx, dirNode)
+	require.NoError(t, err)
+	n, ei, err := kbfsOps1.NodeFromToken(ctx, fileToken)
+	require.NoError(t, err)
+	require.Equal(t, fileNode.GetID(), n.GetID())
+	require.Equal(t, uint64(len(data)), ei.Size)
+
+	t.Log("The token still works after the node is written")
+	data = append(data, 4)
+	err = kbfsOps1.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	n, ei, err = kbfsOps1.NodeFromToken(ctx, fileToken)
+	require.NoError(t, err)
+	require.Equal(t, fileNode.GetID(), n.GetID())
+	require.Equal(t, uint64(len(data)), ei.Size)
+
+	t.Log("The token works in a process that hasn't opened the folder")
+	config2 := ConfigAsUser(config1, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	n, ei, err = config2.KBFSOps().NodeFromToken(ctx, fileToken)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	buf := make([]byte, len(data))
+	_, err = config2.KBFSOps().Read(ctx, n, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	t.Log("Tokens go stale when their nodes move or change type")
+	err = kbfsOps1.Rename(ctx, dirNode, "f", dirNode, "g")
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.NodeFromToken(ctx, fileToken)
+	require.IsType(t, StaleNodeTokenError{}, errors.Cause(err))
+	err = kbfsOps1.RemoveEntry(ctx, dirNode, "g")
+	require.NoError(t, err)
+	err = kbfsOps1.RemoveDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "d", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.NodeFromToken(ctx, dirToken)
+	require.IsType(t, StaleNodeTokenError{}, errors.Cause(err))
+
+	_, _, err = kbfsOps1.NodeFromToken(ctx, "not a token")
+	require.IsType(t, InvalidNodeTokenError{}, errors.Cause(err))
+}
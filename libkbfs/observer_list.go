@@ -39,6 +39,12 @@ func (ol *observerList) remove(o Observer) {
 	}
 }
 
+func (ol *observerList) count() int {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	return len(ol.observers)
+}
+
 func (ol *observerList) localChange(
 	ctx context.Context, node Node, write WriteRange) {
 	ol.lock.RLock()
@@ -57,6 +63,32 @@ func (ol *observerList) batchChanges(
 	}
 }
 
+// conflictedCopiesCreated notifies only the observers that implement
+// ConflictObserver.
+func (ol *observerList) conflictedCopiesCreated(
+	ctx context.Context, copies []ConflictedCopy) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if co, ok := o.(ConflictObserver); ok {
+			co.ConflictedCopiesCreated(ctx, copies)
+		}
+	}
+}
+
+// accessRevoked notifies only the observers that implement
+// AccessRevokedObserver.
+func (ol *observerList) accessRevoked(
+	ctx context.Context, handle *TlfHandle) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if aro, ok := o.(AccessRevokedObserver); ok {
+			aro.AccessRevoked(ctx, handle)
+		}
+	}
+}
+
 func (ol *observerList) tlfHandleChange(
 	ctx context.Context, newHandle *TlfHandle) {
 	ol.lock.RLock()
@@ -12,8 +12,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 )
 
@@ -32,6 +34,8 @@ type op interface {
 	StringWithRefs(indent string) string
 	setWriterInfo(writerInfo)
 	getWriterInfo() writerInfo
+	setDeviceInfo(deviceKID keybase1.KID, clientVersion string)
+	getDeviceInfo() (deviceKID keybase1.KID, clientVersion string)
 	setFinalPath(p path)
 	getFinalPath() path
 	setLocalTimestamp(t time.Time)
@@ -136,6 +140,13 @@ type OpCommon struct {
 	UnrefBlocks []BlockPointer `codec:"u,omitempty"`
 	Updates     []blockUpdate  `codec:"o,omitempty"`
 
+	// DeviceKID and ClientVersion optionally identify the device and
+	// the client build that generated this op.  They are only used
+	// for debugging, and are empty for ops from older clients or
+	// from users who opted out of recording them.
+	DeviceKID     keybase1.KID `codec:"wd,omitempty"`
+	ClientVersion string       `codec:"wv,omitempty"`
+
 	codec.UnknownFieldSetHandler
 
 	// writerInfo is the keybase username and device that generated this
@@ -161,6 +172,8 @@ func (oc OpCommon) deepCopy() OpCommon {
 	copy(ocCopy.UnrefBlocks, oc.UnrefBlocks)
 	ocCopy.Updates = make([]blockUpdate, len(oc.Updates))
 	copy(ocCopy.Updates, oc.Updates)
+	ocCopy.DeviceKID = oc.DeviceKID
+	ocCopy.ClientVersion = oc.ClientVersion
 
 	// TODO: if we ever need to copy the unknown fields in this
 	// method, we'll have to change the codec interface to make it
@@ -243,6 +256,22 @@ func (oc *OpCommon) getWriterInfo() writerInfo {
 	return oc.writerInfo
 }
 
+// setDeviceInfo records the writing device and client version,
+// unless the op already has them.
+func (oc *OpCommon) setDeviceInfo(
+	deviceKID keybase1.KID, clientVersion string) {
+	if oc.DeviceKID.Exists() {
+		return
+	}
+	oc.DeviceKID = deviceKID
+	oc.ClientVersion = clientVersion
+}
+
+func (oc *OpCommon) getDeviceInfo() (
+	deviceKID keybase1.KID, clientVersion string) {
+	return oc.DeviceKID, oc.ClientVersion
+}
+
 func (oc *OpCommon) setFinalPath(p path) {
 	oc.finalPath = p
 }
@@ -282,6 +311,10 @@ func (oc *OpCommon) stringWithRefs(indent string) string {
 	for i, unref := range oc.UnrefBlocks {
 		res += indent + fmt.Sprintf("Unref[%d]: %v\n", i, unref)
 	}
+	if oc.DeviceKID.Exists() {
+		res += indent + fmt.Sprintf(
+			"Device: %s (client %s)\n", oc.DeviceKID, oc.ClientVersion)
+	}
 	return res
 }
 
@@ -1015,7 +1048,7 @@ type attrChange uint16
 
 const (
 	exAttr attrChange = iota
-	mtimeAttr
+	mtimeAttr // also covers atime and btime
 	sizeAttr // only used during conflict resolution
 )
 
@@ -1213,9 +1246,25 @@ func (ro *resolutionOp) getDefaultAction(mergedPath path) crAction {
 	return nil
 }
 
+// purgedDeviceKeys records that the server-side key halves of a
+// revoked device were deleted during a rekey.
+type purgedDeviceKeys struct {
+	UID keybase1.UID              `codec:"u"`
+	Key kbfscrypto.CryptPublicKey `codec:"k"`
+	// NumServerHalves is the number of server halves that were
+	// deleted for this device, one per previous key generation.
+	NumServerHalves int `codec:"n"`
+
+	codec.UnknownFieldSetHandler
+}
+
 // rekeyOp is an op that represents a rekey on a TLF.
 type rekeyOp struct {
 	OpCommon
+
+	// PurgedKeys lists the revoked devices whose server key halves
+	// were deleted by this rekey, if any.
+	PurgedKeys []purgedDeviceKeys `codec:"p,omitempty"`
 }
 
 func newRekeyOp() *rekeyOp {
@@ -1226,6 +1275,10 @@ func newRekeyOp() *rekeyOp {
 func (ro *rekeyOp) deepCopy() op {
 	roCopy := *ro
 	roCopy.OpCommon = ro.OpCommon.deepCopy()
+	if ro.PurgedKeys != nil {
+		roCopy.PurgedKeys = make([]purgedDeviceKeys, len(ro.PurgedKeys))
+		copy(roCopy.PurgedKeys, ro.PurgedKeys)
+	}
 	return &roCopy
 }
 
@@ -1242,7 +1295,10 @@ func (ro *rekeyOp) checkValid() error {
 }
 
 func (ro *rekeyOp) String() string {
-	return "rekey"
+	if len(ro.PurgedKeys) == 0 {
+		return "rekey"
+	}
+	return fmt.Sprintf("rekey (purged %d devices)", len(ro.PurgedKeys))
 }
 
 func (ro *rekeyOp) StringWithRefs(indent string) string {
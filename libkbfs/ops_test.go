@@ -11,9 +11,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/stretchr/testify/require"
 )
 
@@ -224,6 +226,8 @@ func makeFakeOpCommon(t *testing.T, withRefBlocks bool) OpCommon {
 		refBlocks,
 		[]BlockPointer{makeFakeBlockPointer(t)},
 		[]blockUpdate{makeFakeBlockUpdate(t)},
+		keybase1.KID("fake device kid"),
+		"fake client version",
 		codec.UnknownFieldSetHandler{},
 		writerInfo{},
 		path{},
@@ -432,6 +436,12 @@ func makeFakeRekeyOpFuture(t *testing.T) rekeyOpFuture {
 	rof := rekeyOpFuture{
 		rekeyOp{
 			makeFakeOpCommon(t, true),
+			[]purgedDeviceKeys{{
+				UID: keybase1.MakeTestUID(1),
+				Key: kbfscrypto.MakeFakeCryptPublicKeyOrBust(
+					"purged"),
+				NumServerHalves: 2,
+			}},
 		},
 		kbfscodec.MakeExtraOrBust("rekeyOp", t),
 	}
@@ -0,0 +1,173 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const (
+	// pendingChangesFile is the name of the file, under the storage
+	// root, that records the changes KBFS couldn't sync before it
+	// last exited.
+	pendingChangesFile = "kbfs_pending_changes"
+	// pendingChangesVersion is the version of the pending changes
+	// file format.  Files of any other version are ignored.
+	pendingChangesVersion = 1
+	// exitFlushTimeout is how long FlushOnExit spends trying to sync
+	// all the dirty folder-branches.  It's kept short, since the OS
+	// may not wait long for us during a shutdown.
+	exitFlushTimeout = 5 * time.Second
+)
+
+// pendingChangesTlf lists the files in one TLF that still had
+// unsynced changes at exit.
+type pendingChangesTlf struct {
+	Tlf   tlf.ID
+	Name  tlf.CanonicalName
+	Type  tlf.Type
+	Paths []string
+}
+
+type pendingChanges struct {
+	Version int
+	Time    time.Time
+	Tlfs    []pendingChangesTlf
+}
+
+func pendingChangesPath(storageRoot string) string {
+	return filepath.Join(storageRoot, pendingChangesFile)
+}
+
+// savePendingChanges records the paths in `dirty`, which weren't
+// synced before the folder-branches in `ops` were shut down, so they
+// can be reported on the next start.  Only the master branches
+// count, since other branches aren't user-visible.
+func (fs *KBFSOpsStandard) savePendingChanges(ctx context.Context,
+	ops map[FolderBranch]*folderBranchOps,
+	dirty map[FolderBranch][]string) error {
+	if fs.config.StorageRoot() == "" {
+		return nil
+	}
+
+	changes := pendingChanges{
+		Version: pendingChangesVersion,
+		Time:    fs.config.Clock().Now(),
+	}
+	for fb, paths := range dirty {
+		if fb.Branch != MasterBranch {
+			continue
+		}
+		changed := pendingChangesTlf{
+			Tlf:   fb.Tlf,
+			Type:  fb.Tlf.Type(),
+			Paths: paths,
+		}
+		// Read the head directly, rather than through getHead, since
+		// the folder-branch may already be shut down.
+		fbo := ops[fb]
+		lState := makeFBOLockState()
+		fbo.headLock.RLock(lState)
+		head := fbo.head
+		fbo.headLock.RUnlock(lState)
+		if head != (ImmutableRootMetadata{}) {
+			changed.Name = head.GetTlfHandle().GetCanonicalName()
+		}
+		changes.Tlfs = append(changes.Tlfs, changed)
+	}
+	if len(changes.Tlfs) == 0 {
+		return nil
+	}
+
+	fs.log.CWarningf(ctx, "Recording unsynced changes in %d folders",
+		len(changes.Tlfs))
+	return kbfscodec.SerializeToFile(fs.config.Codec(), changes,
+		pendingChangesPath(fs.config.StorageRoot()))
+}
+
+// ReportPendingChanges reports, through the Reporter, any unsynced
+// changes that were recorded when KBFS last exited, and then forgets
+// them.
+func (fs *KBFSOpsStandard) ReportPendingChanges(ctx context.Context) error {
+	if fs.config.StorageRoot() == "" {
+		return nil
+	}
+	path := pendingChangesPath(fs.config.StorageRoot())
+	var changes pendingChanges
+	err := kbfscodec.DeserializeFromFile(fs.config.Codec(), path, &changes)
+	if ioutil.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if changes.Version == pendingChangesVersion {
+		for _, changed := range changes.Tlfs {
+			lost := UnsyncedChangesLostError{
+				Tlf:   changed.Name,
+				Time:  changes.Time,
+				Paths: changed.Paths,
+			}
+			fs.log.CWarningf(ctx, "%s: %v", changed.Tlf, lost)
+			if changed.Name != "" {
+				fs.config.Reporter().ReportErr(
+					ctx, changed.Name, changed.Type, WriteMode, lost)
+			}
+		}
+	} else {
+		fs.log.CDebugf(ctx, "Ignoring pending changes version %d",
+			changes.Version)
+	}
+	return ioutil.Remove(path)
+}
+
+// FlushOnExit tries to sync the dirty state of every open
+// folder-branch in `config`, spending at most a few seconds in
+// total, and then shuts down its KBFSOps.  Changes that still couldn't be
+// synced are recorded under the storage root, and reported on the
+// next start.  It's meant to be called by daemons on their way out.
+func FlushOnExit(ctx context.Context, config Config, log logger.Logger) {
+	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	if !ok {
+		return
+	}
+	dirty, err := kbfsOps.ShutdownWithFlush(ctx, exitFlushTimeout, false)
+	if err != nil {
+		log.CDebugf(ctx, "Error shutting down KBFSOps: %+v", err)
+	}
+	if len(dirty) > 0 {
+		log.CWarningf(ctx, "Exiting with unsynced changes in %d "+
+			"folder-branches", len(dirty))
+	}
+}
+
+// HandleTerminateSignal flushes dirty state with FlushOnExit, and
+// then exits, when the process gets SIGTERM (which the OS sends on
+// shutdown, and which Windows delivers for console close, logoff and
+// shutdown events), until `ctx` is canceled.  It's meant to be run
+// in the background by daemons.
+func HandleTerminateSignal(
+	ctx context.Context, config Config, log logger.Logger) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	select {
+	case <-sigChan:
+		log.CInfof(ctx, "Got SIGTERM; flushing before exiting")
+		FlushOnExit(context.Background(), config, log)
+		os.Exit(0)
+	case <-ctx.Done():
+	}
+}
@@ -32,6 +32,7 @@ type prefetcherConfig interface {
 	logMaker
 	blockCacher
 	diskBlockCacheGetter
+	tuningProfileGetter
 }
 
 type prefetchRequest struct {
@@ -312,7 +313,14 @@ func (p *blockPrefetcher) prefetchIndirectFileBlock(ctx context.Context,
 	// Prefetch indirect block pointers.
 	startingPriority :=
 		p.calculatePriority(fileIndirectBlockPrefetchPriority, kmd.TlfID())
-	for i, ptr := range b.IPtrs {
+	iptrs := b.IPtrs
+	if !isDeepSync {
+		readAhead := p.config.TuningProfile(kmd.TlfID()).ReadAheadBlocks
+		if readAhead > 0 && len(iptrs) > readAhead {
+			iptrs = iptrs[:readAhead]
+		}
+	}
+	for i, ptr := range iptrs {
 		numBlocks += p.request(ctx, startingPriority-i, kmd,
 			ptr.BlockPointer, b.NewEmpty(), lifetime,
 			parentBlockID, isPrefetchNew, isDeepSync)
@@ -345,7 +353,19 @@ func (p *blockPrefetcher) prefetchDirectDirBlock(ctx context.Context,
 	startingPriority :=
 		p.calculatePriority(dirEntryPrefetchPriority, kmd.TlfID())
 	totalChildEntries := 0
+	maxEntries := 0
+	if !isDeepSync {
+		maxEntries = p.config.TuningProfile(kmd.TlfID()).DirPrefetchEntries
+	}
 	for i, entry := range dirEntries.dirEntries {
+		if maxEntries > 0 && totalChildEntries >= maxEntries {
+			break
+		}
+		if entry.DataVer == InlineDataVer {
+			// Skip inlined files, since their contents came with
+			// this block.
+			continue
+		}
 		// Prioritize small files
 		priority := startingPriority - i
 		var block Block
@@ -32,7 +32,10 @@ func makeRandomDirEntry(
 			101,
 			102,
 			"",
+			0,
+			0,
 		},
+		nil,
 		codec.UnknownFieldSetHandler{},
 	}
 }
@@ -179,6 +182,50 @@ func TestPrefetcherIndirectFileBlock(t *testing.T) {
 		indBlock2, NoPrefetch, TransientEntry)
 }
 
+func TestPrefetcherIndirectFileBlockReadAhead(t *testing.T) {
+	t.Log("Test that the tuning profile limits indirect file block " +
+		"prefetching.")
+	q, bg, config := initPrefetcherTest(t)
+	defer shutdownPrefetcherTest(q)
+	kmd := makeKMD()
+	config.profiles[kmd.TlfID()] = TuningProfile{ReadAheadBlocks: 1}
+
+	t.Log("Initialize an indirect file block pointing to 2 file data blocks.")
+	ptrs := []IndirectFilePtr{
+		makeFakeIndirectFilePtr(t, 0),
+		makeFakeIndirectFilePtr(t, 150),
+	}
+	rootPtr := makeRandomBlockPointer(t)
+	rootBlock := &FileBlock{IPtrs: ptrs}
+	rootBlock.IsInd = true
+	indBlock1 := makeFakeFileBlock(t, true)
+
+	_, continueChRootBlock := bg.setBlockToReturn(rootPtr, rootBlock)
+	_, continueChIndBlock1 :=
+		bg.setBlockToReturn(ptrs[0].BlockPointer, indBlock1)
+
+	var block Block = &FileBlock{}
+	ch := q.Request(context.Background(),
+		defaultOnDemandRequestPriority, kmd, rootPtr, block,
+		TransientEntry)
+	continueChRootBlock <- nil
+	err := <-ch
+	require.NoError(t, err)
+	require.Equal(t, rootBlock, block)
+
+	t.Log("Release the only prefetched indirect block.")
+	continueChIndBlock1 <- nil
+
+	t.Log("Wait for the prefetch to finish.")
+	waitForPrefetchOrBust(t, q.Prefetcher().Shutdown())
+
+	t.Log("Ensure that only the first block was prefetched.")
+	testPrefetcherCheckGet(t, config.BlockCache(), ptrs[0].BlockPointer,
+		indBlock1, NoPrefetch, TransientEntry)
+	_, err = config.BlockCache().Get(ptrs[1].BlockPointer)
+	require.EqualError(t, err, NoSuchBlockError{ptrs[1].ID}.Error())
+}
+
 func TestPrefetcherIndirectDirBlock(t *testing.T) {
 	t.Log("Test indirect dir block prefetching.")
 	q, bg, config := initPrefetcherTest(t)
@@ -0,0 +1,30 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package libkbfs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+)
+
+// getProcessRSS returns the resident set size of this process, in
+// bytes, as reported by the kernel.
+func getProcessRSS() (uint64, error) {
+	buf, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	var size, resident uint64
+	_, err = fmt.Sscanf(string(buf), "%d %d", &size, &resident)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return resident * uint64(os.Getpagesize()), nil
+}
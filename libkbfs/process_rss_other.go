@@ -0,0 +1,19 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package libkbfs
+
+import "runtime"
+
+// getProcessRSS approximates the resident set size of this process,
+// in bytes, by the memory the Go runtime has obtained from the OS and
+// not yet given back.  That misses memory allocated outside of Go,
+// but there's no portable way to get the real RSS.
+func getProcessRSS() (uint64, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// recentLogLines keeps the most recent lines logged, up to a total
+// size in bytes, dropping the oldest ones first.  It is
+// goroutine-safe.  A nil *recentLogLines keeps nothing.
+type recentLogLines struct {
+	maxBytes int
+
+	lock sync.Mutex
+	// lines[start:] are the kept lines; the ones before `start` have
+	// been dropped, and are only compacted away once in a while.
+	lines []string
+	start int
+	bytes int
+}
+
+// newRecentLogLines returns a buffer for the last `maxBytes` bytes of
+// log lines, or nil if `maxBytes` isn't positive.
+func newRecentLogLines(maxBytes int) *recentLogLines {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &recentLogLines{maxBytes: maxBytes}
+}
+
+func (r *recentLogLines) add(level, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	line := fmt.Sprintf("%s ▶ [%s] %s",
+		time.Now().Format(time.RFC3339Nano), level,
+		fmt.Sprintf(format, args...))
+	if len(line) > r.maxBytes {
+		line = line[:r.maxBytes]
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines = append(r.lines, line)
+	r.bytes += len(line)
+	for r.bytes > r.maxBytes {
+		r.bytes -= len(r.lines[r.start])
+		r.lines[r.start] = ""
+		r.start++
+	}
+	if r.start > len(r.lines)/2 {
+		r.lines = append([]string(nil), r.lines[r.start:]...)
+		r.start = 0
+	}
+}
+
+// get returns the kept lines, oldest first.
+func (r *recentLogLines) get() []string {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.lines[r.start:]...)
+}
+
+// recentLogger is a logger.Logger that also keeps its most recent
+// lines in memory, so they can be included in debug dumps.  All the
+// loggers of a folder-branch share the same recent lines.
+type recentLogger struct {
+	logger.Logger
+	recent *recentLogLines
+}
+
+// newRecentLogger wraps `log`, keeping its lines in `recent`, which
+// may be shared with other loggers.  It adds a level of call depth to
+// `log`, to account for the wrapper.
+func newRecentLogger(
+	log logger.Logger, recent *recentLogLines) recentLogger {
+	return recentLogger{log.CloneWithAddedDepth(1), recent}
+}
+
+var _ logger.Logger = recentLogger{}
+
+// CDebugf implements the logger.Logger interface for recentLogger.
+func (l recentLogger) CDebugf(
+	ctx context.Context, format string, args ...interface{}) {
+	l.recent.add("DEBU", format, args...)
+	l.Logger.CDebugf(ctx, format, args...)
+}
+
+// CInfof implements the logger.Logger interface for recentLogger.
+func (l recentLogger) CInfof(
+	ctx context.Context, format string, args ...interface{}) {
+	l.recent.add("INFO", format, args...)
+	l.Logger.CInfof(ctx, format, args...)
+}
+
+// CWarningf implements the logger.Logger interface for recentLogger.
+func (l recentLogger) CWarningf(
+	ctx context.Context, format string, args ...interface{}) {
+	l.recent.add("WARN", format, args...)
+	l.Logger.CWarningf(ctx, format, args...)
+}
+
+// CErrorf implements the logger.Logger interface for recentLogger.
+func (l recentLogger) CErrorf(
+	ctx context.Context, format string, args ...interface{}) {
+	l.recent.add("ERRO", format, args...)
+	l.Logger.CErrorf(ctx, format, args...)
+}
+
+// CloneWithAddedDepth implements the logger.Logger interface for
+// recentLogger.  The clone shares the same recent lines.
+func (l recentLogger) CloneWithAddedDepth(depth int) logger.Logger {
+	return recentLogger{l.Logger.CloneWithAddedDepth(depth), l.recent}
+}
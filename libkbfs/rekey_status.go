@@ -0,0 +1,231 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"golang.org/x/net/context"
+)
+
+// RekeyStatus describes the progress of the most recent rekey of a
+// TLF performed by this device.  It is suitable for encoding directly
+// as JSON.
+type RekeyStatus struct {
+	InProgress bool
+	StartTime  time.Time
+	EndTime    time.Time `json:",omitempty"`
+
+	// DevicesTotal is the number of devices that need keys in the
+	// new key bundle, and DevicesProcessed is how many of those have
+	// had their server key halves uploaded so far.
+	DevicesTotal      int
+	DevicesProcessed  int
+	KeyHalvesUploaded int
+	// DevicesPurged is the number of revoked devices whose server
+	// key halves were deleted.
+	DevicesPurged int
+
+	// ETA is a rough estimate of how much longer an in-progress
+	// rekey will take, based on the rate of progress so far.  It is
+	// zero if unknown.
+	ETA time.Duration `json:",omitempty"`
+
+	// LastErr is the error that ended the most recent rekey, if any.
+	LastErr string `json:",omitempty"`
+}
+
+// Keys used in the params of rekey progress notifications.
+const (
+	rekeyParamDevicesTotal      = "devicesTotal"
+	rekeyParamDevicesProcessed  = "devicesProcessed"
+	rekeyParamKeyHalvesUploaded = "keyHalvesUploaded"
+)
+
+// rekeyProgress tracks the progress of the rekeys of a single TLF,
+// and reports it through the Reporter.  A rekey is only considered to
+// be in progress once the KeyManager has determined that there are
+// devices that need keys; attempts that turn out to be no-ops aren't
+// tracked.
+type rekeyProgress struct {
+	config Config
+
+	lock    sync.Mutex
+	handle  *TlfHandle
+	status  RekeyStatus
+	devices map[kbfscrypto.CryptPublicKey]bool
+	purged  []purgedDeviceKeys
+}
+
+func newRekeyProgress(config Config) *rekeyProgress {
+	return &rekeyProgress{config: config}
+}
+
+type ctxRekeyProgressKeyType int
+
+const (
+	// ctxRekeyProgressKey is a context key for the rekeyProgress of
+	// the TLF being rekeyed.
+	ctxRekeyProgressKey ctxRekeyProgressKeyType = iota
+)
+
+// attach returns a context that lets the KeyManager report its
+// progress while rekeying the TLF with the given handle.
+func (rp *rekeyProgress) attach(
+	ctx context.Context, handle *TlfHandle) context.Context {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	rp.handle = handle
+	return NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, ctxRekeyProgressKey, rp)
+	})
+}
+
+// getRekeyProgress returns the rekeyProgress attached to the
+// context, or nil if there isn't one.  All rekeyProgress methods
+// are safe to call on a nil receiver.
+func getRekeyProgress(ctx context.Context) *rekeyProgress {
+	rp, _ := ctx.Value(ctxRekeyProgressKey).(*rekeyProgress)
+	return rp
+}
+
+func (rp *rekeyProgress) notifyLocked(
+	ctx context.Context, code keybase1.FSStatusCode, status string) {
+	if rp.handle == nil {
+		return
+	}
+	n := rekeyNotification(ctx, rp.config, rp.handle, false)
+	n.StatusCode = code
+	n.Status = status
+	n.Params = map[string]string{
+		rekeyParamDevicesTotal: strconv.Itoa(rp.status.DevicesTotal),
+		rekeyParamDevicesProcessed: strconv.Itoa(
+			rp.status.DevicesProcessed),
+		rekeyParamKeyHalvesUploaded: strconv.Itoa(
+			rp.status.KeyHalvesUploaded),
+	}
+	rp.config.Reporter().Notify(ctx, n)
+}
+
+// start records that a rekey needing new keys for `devicesTotal`
+// devices has begun.
+func (rp *rekeyProgress) start(ctx context.Context, devicesTotal int) {
+	if rp == nil {
+		return
+	}
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	rp.status = RekeyStatus{
+		InProgress:   true,
+		StartTime:    rp.config.Clock().Now(),
+		DevicesTotal: devicesTotal,
+	}
+	rp.devices = make(map[kbfscrypto.CryptPublicKey]bool)
+	rp.purged = nil
+	rp.notifyLocked(ctx, keybase1.FSStatusCode_START, "")
+}
+
+// uploadedServerHalves records that the given server key halves have
+// been put to the key server.
+func (rp *rekeyProgress) uploadedServerHalves(ctx context.Context,
+	serverHalves kbfsmd.UserDeviceKeyServerHalves) {
+	if rp == nil {
+		return
+	}
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	if !rp.status.InProgress {
+		return
+	}
+	for _, deviceHalves := range serverHalves {
+		for key := range deviceHalves {
+			rp.devices[key] = true
+			rp.status.KeyHalvesUploaded++
+		}
+	}
+	rp.status.DevicesProcessed = len(rp.devices)
+
+	rp.status.ETA = 0
+	remaining := rp.status.DevicesTotal - rp.status.DevicesProcessed
+	if rp.status.DevicesProcessed > 0 && remaining > 0 {
+		elapsed := rp.config.Clock().Now().Sub(rp.status.StartTime)
+		rp.status.ETA = elapsed / time.Duration(
+			rp.status.DevicesProcessed) * time.Duration(remaining)
+	}
+	rp.notifyLocked(ctx, keybase1.FSStatusCode_START, "")
+}
+
+// purgedServerHalves records that `numServerHalves` server key
+// halves of the given revoked device have been deleted from the key
+// server.
+func (rp *rekeyProgress) purgedServerHalves(ctx context.Context,
+	uid keybase1.UID, key kbfscrypto.CryptPublicKey, numServerHalves int) {
+	if rp == nil {
+		return
+	}
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	if !rp.status.InProgress {
+		return
+	}
+	rp.purged = append(rp.purged, purgedDeviceKeys{
+		UID:             uid,
+		Key:             key,
+		NumServerHalves: numServerHalves,
+	})
+	rp.status.DevicesPurged = len(rp.purged)
+}
+
+// takePurged returns the devices purged by the current rekey, so
+// they can be recorded in the rekey's MD, and forgets about them.
+func (rp *rekeyProgress) takePurged() []purgedDeviceKeys {
+	if rp == nil {
+		return nil
+	}
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	purged := rp.purged
+	rp.purged = nil
+	return purged
+}
+
+// finish records the result of the current rekey attempt.  Errors
+// are reported even if the rekey never started processing devices,
+// so that failures are visible outside of the debug logs.
+func (rp *rekeyProgress) finish(ctx context.Context, err error) {
+	if rp == nil {
+		return
+	}
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	// Any purged devices have already been recorded in the MD by
+	// now, or the rekey failed; either way, don't let them leak
+	// into the next rekey attempt.
+	rp.purged = nil
+	if !rp.status.InProgress && err == nil {
+		return
+	}
+	rp.status.InProgress = false
+	rp.status.ETA = 0
+	rp.status.EndTime = rp.config.Clock().Now()
+	if err != nil {
+		rp.status.LastErr = err.Error()
+		rp.notifyLocked(ctx, keybase1.FSStatusCode_ERROR, err.Error())
+		return
+	}
+	rp.status.LastErr = ""
+}
+
+// getStatus returns the status of the current or most recent rekey.
+func (rp *rekeyProgress) getStatus() RekeyStatus {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	return rp.status
+}
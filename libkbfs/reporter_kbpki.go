@@ -30,7 +30,9 @@ const (
 	errorParamLimitBytes          = "limitBytes"
 	errorParamUsageFiles          = "usageFiles"
 	errorParamLimitFiles          = "limitFiles"
+	errorParamAvailableBytes      = "availableBytes"
 	errorParamRenameOldFilename   = "oldFilename"
+	errorParamConflictedCopyOf    = "conflictedCopyOf"
 	errorParamFoldersCreated      = "foldersCreated"
 	errorParamFolderLimit         = "folderLimit"
 	errorParamApplicationExecPath = "applicationExecPath"
@@ -172,6 +174,11 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 		params[errorParamUsageFiles] = strconv.FormatInt(e.usageFiles, 10)
 		params[errorParamLimitFiles] =
 			strconv.FormatFloat(e.limitFiles, 'f', 0, 64)
+	case DiskSpaceLowWarning:
+		code = keybase1.FSErrorType_DISK_LIMIT_REACHED
+		params[errorParamAvailableBytes] =
+			strconv.FormatInt(e.AvailableBytes, 10)
+		params[errorParamLimitBytes] = strconv.FormatInt(e.MinBytes, 10)
 	case NoSigChainError:
 		code = keybase1.FSErrorType_NO_SIG_CHAIN
 		params[errorParamUsername] = e.User.String()
@@ -346,6 +353,17 @@ func fileRenameNotification(oldFile path, newFile path, writer keybase1.UID,
 	return n
 }
 
+// conflictedCopyNotification creates FSNotifications from paths for
+// the conflicted copies made by conflict resolution.
+func conflictedCopyNotification(original path, copy path,
+	writer keybase1.UID, localTime time.Time) *keybase1.FSNotification {
+	n := baseFileEditNotification(copy, writer, localTime)
+	n.NotificationType = keybase1.FSNotificationType_FILE_CREATED
+	n.Params = map[string]string{
+		errorParamConflictedCopyOf: original.CanonicalPathString()}
+	return n
+}
+
 // connectionNotification creates FSNotifications based on whether
 // or not KBFS is online.
 func connectionNotification(status keybase1.FSStatusCode) *keybase1.FSNotification {
@@ -0,0 +1,149 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// retainedBranchPrefix starts the name of every branch that was
+// retained after being pruned.
+const retainedBranchPrefix = "unmerged-"
+
+// RetainedBranchInfo describes a local unmerged branch that was
+// pruned, either by conflict resolution or by unstaging, but was kept
+// around so that any data that didn't make it into the merged branch
+// can still be recovered.
+type RetainedBranchInfo struct {
+	// Name can be passed to KBFSOps.GetRootNode to browse the
+	// branch, read-only, as of its last revision.
+	Name BranchName
+	// BranchID is the ID the branch had before it was pruned.
+	BranchID kbfsmd.BranchID
+	// FirstRevision and LastRevision are the revision numbers of
+	// the first and last MD on the branch.
+	FirstRevision kbfsmd.Revision
+	LastRevision  kbfsmd.Revision
+	// Resolved is true if the branch was pruned by conflict
+	// resolution, and false if it was discarded by unstaging.
+	Resolved bool
+	// PruneTime is when the branch was pruned.
+	PruneTime time.Time
+	// Expiration is when the branch will be forgotten.
+	Expiration time.Time
+}
+
+// retainedBranchName returns the name under which the pruned branch
+// `bid` can be browsed.
+func retainedBranchName(bid kbfsmd.BranchID) BranchName {
+	return BranchName(retainedBranchPrefix + bid.String())
+}
+
+// isRetainedBranchName returns whether `branch` names a retained
+// branch.
+func isRetainedBranchName(branch BranchName) bool {
+	return strings.HasPrefix(string(branch), retainedBranchPrefix)
+}
+
+type retainedBranch struct {
+	info RetainedBranchInfo
+	// mds are the unmerged MDs of the branch, in revision order.
+	mds []ImmutableRootMetadata
+	// releaseLease lets quota reclamation delete the branch's
+	// blocks again.
+	releaseLease func()
+}
+
+// retainedBranches keeps pruned unmerged branches in memory for all
+// the TLFs of a KBFSOps, until they expire.  Retained branches don't
+// survive a restart.
+type retainedBranches struct {
+	lock     sync.Mutex
+	branches map[tlf.ID][]retainedBranch
+}
+
+func newRetainedBranches() *retainedBranches {
+	return &retainedBranches{
+		branches: make(map[tlf.ID][]retainedBranch),
+	}
+}
+
+// expireLocked forgets every branch of `id` that has expired as of
+// `now`.
+func (rb *retainedBranches) expireLocked(id tlf.ID, now time.Time) {
+	branches := rb.branches[id]
+	kept := branches[:0]
+	for _, b := range branches {
+		if now.Before(b.info.Expiration) {
+			kept = append(kept, b)
+		} else if b.releaseLease != nil {
+			b.releaseLease()
+		}
+	}
+	if len(kept) == 0 {
+		delete(rb.branches, id)
+	} else {
+		rb.branches[id] = kept
+	}
+}
+
+// add retains `mds`, the unmerged MDs of a pruned branch of `id`,
+// until `expiration`.
+func (rb *retainedBranches) add(id tlf.ID, mds []ImmutableRootMetadata,
+	resolved bool, now, expiration time.Time, releaseLease func()) {
+	bid := mds[0].BID()
+	b := retainedBranch{
+		info: RetainedBranchInfo{
+			Name:          retainedBranchName(bid),
+			BranchID:      bid,
+			FirstRevision: mds[0].Revision(),
+			LastRevision:  mds[len(mds)-1].Revision(),
+			Resolved:      resolved,
+			PruneTime:     now,
+			Expiration:    expiration,
+		},
+		mds:          mds,
+		releaseLease: releaseLease,
+	}
+
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.expireLocked(id, now)
+	rb.branches[id] = append(rb.branches[id], b)
+}
+
+// list returns the branches of `id` that haven't expired as of
+// `now`, oldest first.
+func (rb *retainedBranches) list(
+	id tlf.ID, now time.Time) []RetainedBranchInfo {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.expireLocked(id, now)
+	infos := make([]RetainedBranchInfo, 0, len(rb.branches[id]))
+	for _, b := range rb.branches[id] {
+		infos = append(infos, b.info)
+	}
+	return infos
+}
+
+// getHead returns the last MD of the retained branch `branch` of
+// `id`, if it hasn't expired as of `now`.
+func (rb *retainedBranches) getHead(id tlf.ID, branch BranchName,
+	now time.Time) (ImmutableRootMetadata, bool) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.expireLocked(id, now)
+	for _, b := range rb.branches[id] {
+		if b.info.Name == branch {
+			return b.mds[len(b.mds)-1], true
+		}
+	}
+	return ImmutableRootMetadata{}, false
+}
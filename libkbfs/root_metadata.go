@@ -36,6 +36,9 @@ type PrivateMetadata struct {
 	// was performed on this TLF.
 	LastGCRevision kbfsmd.Revision `codec:"lgc"`
 
+	// The restrictions on what can be written to this TLF, if any.
+	ContentPolicy *TlfContentPolicy `codec:"cp,omitempty"`
+
 	codec.UnknownFieldSetHandler
 
 	// When the above Changes field gets unembedded into its own
@@ -319,18 +322,41 @@ func (md *RootMetadata) IsInitialized() bool {
 	return keyGen >= kbfsmd.FirstValidKeyGen
 }
 
-// AddRefBlock adds the newly-referenced block to the add block change list.
+// AddRefBlock adds the newly-referenced block to the add block change
+// list.  If the block already existed (i.e., this is a dedup'd
+// reference to it), its size is also counted as deduplicated, since
+// the new reference doesn't take up any more space on the server.
 func (md *RootMetadata) AddRefBlock(info BlockInfo) {
 	md.AddRefBytes(uint64(info.EncodedSize))
 	md.AddDiskUsage(uint64(info.EncodedSize))
+	if !info.IsFirstRef() {
+		md.AddDedupRefBytes(uint64(info.EncodedSize))
+		md.AddDedupDiskUsage(uint64(info.EncodedSize))
+	}
 	md.data.Changes.AddRefBlock(info.BlockPointer)
 }
 
+// removeDedupDiskUsage undoes the dedup accounting for a reference
+// to an existing block that is no longer referenced.  Since the
+// usage is only an estimate, it never goes below zero.
+func (md *RootMetadata) removeDedupDiskUsage(info BlockInfo) {
+	if info.IsFirstRef() {
+		return
+	}
+	size := uint64(info.EncodedSize)
+	if dedupUsage := md.DedupDiskUsage(); size < dedupUsage {
+		md.SetDedupDiskUsage(dedupUsage - size)
+	} else {
+		md.SetDedupDiskUsage(0)
+	}
+}
+
 // AddUnrefBlock adds the newly-unreferenced block to the add block change list.
 func (md *RootMetadata) AddUnrefBlock(info BlockInfo) {
 	if info.EncodedSize > 0 {
 		md.AddUnrefBytes(uint64(info.EncodedSize))
 		md.SetDiskUsage(md.DiskUsage() - uint64(info.EncodedSize))
+		md.removeDedupDiskUsage(info)
 		md.data.Changes.AddUnrefBlock(info.BlockPointer)
 	}
 }
@@ -341,9 +367,21 @@ func (md *RootMetadata) AddUpdate(oldInfo BlockInfo, newInfo BlockInfo) {
 	md.AddRefBytes(uint64(newInfo.EncodedSize))
 	md.AddDiskUsage(uint64(newInfo.EncodedSize))
 	md.SetDiskUsage(md.DiskUsage() - uint64(oldInfo.EncodedSize))
+	md.removeDedupDiskUsage(oldInfo)
 	md.data.Changes.AddUpdate(oldInfo.BlockPointer, newInfo.BlockPointer)
 }
 
+// UniqueDiskUsage returns the estimated number of bytes of data
+// blocks in this folder as of this revision, not counting extra
+// references to blocks that were copied within the folder.
+func (md *RootMetadata) UniqueDiskUsage() uint64 {
+	usage, dedupUsage := md.DiskUsage(), md.DedupDiskUsage()
+	if dedupUsage > usage {
+		return 0
+	}
+	return usage - dedupUsage
+}
+
 // AddOp starts a new operation for this MD update.  Subsequent
 // AddRefBlock, AddUnrefBlock, and AddUpdate calls will be applied to
 // this operation.
@@ -357,6 +395,7 @@ func (md *RootMetadata) ClearBlockChanges() {
 	md.SetRefBytes(0)
 	md.SetUnrefBytes(0)
 	md.SetMDRefBytes(0)
+	md.SetDedupRefBytes(0)
 	md.data.Changes.sizeEstimate = 0
 	md.data.Changes.Info = BlockInfo{}
 	md.data.Changes.Ops = nil
@@ -509,6 +548,12 @@ func (md *RootMetadata) GetTLFCryptKeyParams(
 	return md.bareMd.GetTLFCryptKeyParams(keyGen, user, key, md.extra)
 }
 
+// GetLatestDataEncryptionVer wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) GetLatestDataEncryptionVer() (
+	kbfscrypto.EncryptionVer, error) {
+	return md.bareMd.GetLatestDataEncryptionVer(md.extra)
+}
+
 // KeyGenerationsToUpdate wraps the respective method of the underlying BareRootMetadata for convenience.
 func (md *RootMetadata) KeyGenerationsToUpdate() (kbfsmd.KeyGen, kbfsmd.KeyGen) {
 	return md.bareMd.KeyGenerationsToUpdate()
@@ -609,6 +654,36 @@ func (md *RootMetadata) AddMDDiskUsage(mdDiskUsage uint64) {
 	md.bareMd.AddMDDiskUsage(mdDiskUsage)
 }
 
+// DedupRefBytes wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) DedupRefBytes() uint64 {
+	return md.bareMd.DedupRefBytes()
+}
+
+// DedupDiskUsage wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) DedupDiskUsage() uint64 {
+	return md.bareMd.DedupDiskUsage()
+}
+
+// SetDedupRefBytes wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) SetDedupRefBytes(dedupRefBytes uint64) {
+	md.bareMd.SetDedupRefBytes(dedupRefBytes)
+}
+
+// SetDedupDiskUsage wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) SetDedupDiskUsage(dedupDiskUsage uint64) {
+	md.bareMd.SetDedupDiskUsage(dedupDiskUsage)
+}
+
+// AddDedupRefBytes wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) AddDedupRefBytes(dedupRefBytes uint64) {
+	md.bareMd.AddDedupRefBytes(dedupRefBytes)
+}
+
+// AddDedupDiskUsage wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) AddDedupDiskUsage(dedupDiskUsage uint64) {
+	md.bareMd.AddDedupDiskUsage(dedupDiskUsage)
+}
+
 // IsWriterMetadataCopiedSet wraps the respective method of the underlying BareRootMetadata for convenience.
 func (md *RootMetadata) IsWriterMetadataCopiedSet() bool {
 	return md.bareMd.IsWriterMetadataCopiedSet()
@@ -635,6 +710,12 @@ func (md *RootMetadata) MerkleRoot() keybase1.MerkleRootV2 {
 	return md.bareMd.MerkleRoot()
 }
 
+// IdempotencyKey wraps the respective method of the underlying
+// BareRootMetadata for convenience.
+func (md *RootMetadata) IdempotencyKey() kbfsmd.IdempotencyKey {
+	return md.bareMd.IdempotencyKey()
+}
+
 // MergedStatus wraps the respective method of the underlying BareRootMetadata for convenience.
 func (md *RootMetadata) MergedStatus() kbfsmd.MergeStatus {
 	return md.bareMd.MergedStatus()
@@ -725,6 +806,12 @@ func (md *RootMetadata) SetMerkleRoot(root keybase1.MerkleRootV2) {
 	md.bareMd.SetMerkleRoot(root)
 }
 
+// SetIdempotencyKey wraps the respective method of the underlying
+// BareRootMetadata for convenience.
+func (md *RootMetadata) SetIdempotencyKey(key kbfsmd.IdempotencyKey) {
+	md.bareMd.SetIdempotencyKey(key)
+}
+
 // SetWriters wraps the respective method of the underlying BareRootMetadata for convenience.
 func (md *RootMetadata) SetWriters(writers []keybase1.UserOrTeamID) {
 	md.bareMd.SetWriters(writers)
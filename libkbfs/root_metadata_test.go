@@ -160,9 +160,11 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 					&rekeyOp,
 					&gcOp,
 				},
+				codec.UnknownFieldSetHandler{},
 				0,
 			},
 			0,
+			nil,
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
@@ -176,6 +178,45 @@ func TestPrivateMetadataUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakePrivateMetadataFuture(t))
 }
 
+type blockChangesFuture struct {
+	BlockChanges
+	kbfscodec.Extra
+}
+
+func (bcf blockChangesFuture) toCurrent() BlockChanges {
+	bc := bcf.BlockChanges
+	bc.Ops = make(opsList, len(bcf.Ops))
+	for i, opFuture := range bcf.Ops {
+		currentOp := opFuture.(kbfscodec.FutureStruct).ToCurrentStruct()
+		// A generic version of "v := currentOp; ...Ops[i] = &v".
+		v := reflect.New(reflect.TypeOf(currentOp))
+		v.Elem().Set(reflect.ValueOf(currentOp))
+		bc.Ops[i] = v.Interface().(op)
+	}
+	return bc
+}
+
+func (bcf blockChangesFuture) ToCurrentStruct() kbfscodec.CurrentStruct {
+	return bcf.toCurrent()
+}
+
+func makeFakeBlockChangesFuture(t *testing.T) blockChangesFuture {
+	createOp := makeFakeCreateOpFuture(t)
+	syncOp := makeFakeSyncOpFuture(t)
+	bcf := blockChangesFuture{
+		BlockChanges{
+			Info: makeFakeBlockInfo(t),
+			Ops:  opsList{&createOp, &syncOp},
+		},
+		kbfscodec.MakeExtraOrBust("BlockChanges", t),
+	}
+	return bcf
+}
+
+func TestBlockChangesUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeBlockChangesFuture(t))
+}
+
 // makeFakeTlfHandle should only be used in this file.
 func makeFakeTlfHandle(
 	t *testing.T, x uint32, ty tlf.Type,
@@ -386,6 +427,10 @@ func (kc *dummyNoKeyCache) PutTLFCryptKey(_ tlf.ID, _ kbfsmd.KeyGen, _ kbfscrypt
 	return nil
 }
 
+func (kc *dummyNoKeyCache) Clear() {}
+
+func (kc *dummyNoKeyCache) ClearTLF(_ tlf.ID) {}
+
 // Test upconversion from MDv2 to MDv3 for a private folder.
 func TestRootMetadataUpconversionPrivate(t *testing.T) {
 	config := MakeTestConfigOrBust(t, "alice", "bob", "charlie")
@@ -921,6 +966,49 @@ func TestRootMetadataTeamMakeSuccessor(t *testing.T) {
 	require.Equal(t, firstKeyGen+1, kg)
 }
 
+// Test that references to existing blocks are counted as dedup'd
+// usage, and that unique usage doesn't include them.
+func testRootMetadataDedupUsage(t *testing.T, ver kbfsmd.MetadataVer) {
+	h := makeFakeTlfHandle(t, 14, tlf.Private, nil, nil)
+	tlfID := tlf.FakeID(0, tlf.Private)
+	rmd, err := makeInitialRootMetadata(ver, tlfID, h)
+	require.NoError(t, err)
+
+	firstRef := BlockInfo{
+		BlockPointer: BlockPointer{
+			ID:      kbfsblock.FakeID(1),
+			Context: kbfsblock.MakeFirstContext(
+				keybase1.MakeTestUID(1).AsUserOrTeam(),
+				keybase1.BlockType_DATA),
+		},
+		EncodedSize: 100,
+	}
+	dedupRef := firstRef
+	dedupRef.RefNonce = kbfsblock.RefNonce{1}
+
+	// Block changes are recorded in the last op of the MD.
+	rmd.AddOp(newGCOp(0))
+	rmd.AddRefBlock(firstRef)
+	rmd.AddRefBlock(dedupRef)
+	require.Equal(t, uint64(200), rmd.RefBytes())
+	require.Equal(t, uint64(100), rmd.DedupRefBytes())
+	require.Equal(t, uint64(200), rmd.DiskUsage())
+	require.Equal(t, uint64(100), rmd.DedupDiskUsage())
+	require.Equal(t, uint64(100), rmd.UniqueDiskUsage())
+
+	// The dedup'd usage carries over to the next revision, but
+	// the per-revision ref bytes don't.
+	rmd.ClearBlockChanges()
+	require.Equal(t, uint64(0), rmd.DedupRefBytes())
+	require.Equal(t, uint64(100), rmd.DedupDiskUsage())
+
+	rmd.AddOp(newGCOp(0))
+	rmd.AddUnrefBlock(dedupRef)
+	require.Equal(t, uint64(100), rmd.DiskUsage())
+	require.Equal(t, uint64(0), rmd.DedupDiskUsage())
+	require.Equal(t, uint64(100), rmd.UniqueDiskUsage())
+}
+
 func TestRootMetadata(t *testing.T) {
 	tests := []func(*testing.T, kbfsmd.MetadataVer){
 		testRootMetadataGetTlfHandlePublic,
@@ -930,6 +1018,7 @@ func TestRootMetadata(t *testing.T) {
 		testMakeRekeyReadError,
 		testMakeRekeyReadErrorResolvedHandle,
 		testRootMetadataFinalIsFinal,
+		testRootMetadataDedupUsage,
 	}
 	runTestsOverMetadataVers(t, "testRootMetadata", tests)
 }
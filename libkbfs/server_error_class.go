@@ -0,0 +1,302 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+	"net"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// serverErrorClass is a broad category of errors returned by the
+// block server or the MD server.  Callers should decide how to react
+// to a server error by looking at its class (via the policy table
+// below) rather than by checking for individual error types.
+type serverErrorClass int
+
+const (
+	// serverErrorClassNone is the class of a nil error.
+	serverErrorClassNone serverErrorClass = iota
+	// serverErrorClassThrottle means the server asked us to back
+	// off and try again later.
+	serverErrorClassThrottle
+	// serverErrorClassAuth means the current user isn't allowed to
+	// do what was asked.
+	serverErrorClassAuth
+	// serverErrorClassNotFound means a referenced object (block,
+	// reference, or TLF) doesn't exist, or no longer exists.
+	serverErrorClassNotFound
+	// serverErrorClassConflict means the request raced with a
+	// change made by someone else.
+	serverErrorClassConflict
+	// serverErrorClassTransientNetwork means the request failed
+	// for reasons that might go away on their own, like a dropped
+	// connection or a generic server-side failure.
+	serverErrorClassTransientNetwork
+	// serverErrorClassFatal covers everything else; retrying the
+	// same request won't help.
+	serverErrorClassFatal
+)
+
+var serverErrorClasses = []serverErrorClass{
+	serverErrorClassThrottle,
+	serverErrorClassAuth,
+	serverErrorClassNotFound,
+	serverErrorClassConflict,
+	serverErrorClassTransientNetwork,
+	serverErrorClassFatal,
+}
+
+func (c serverErrorClass) String() string {
+	switch c {
+	case serverErrorClassNone:
+		return "none"
+	case serverErrorClassThrottle:
+		return "throttle"
+	case serverErrorClassAuth:
+		return "auth"
+	case serverErrorClassNotFound:
+		return "not-found"
+	case serverErrorClassConflict:
+		return "conflict"
+	case serverErrorClassTransientNetwork:
+		return "transient-network"
+	case serverErrorClassFatal:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+// classifyBlockServerError returns the class of the given error if
+// it came from the block server, and false otherwise.
+func classifyBlockServerError(err error) (serverErrorClass, bool) {
+	if kbfsblock.IsThrottleError(err) {
+		return serverErrorClassThrottle, true
+	}
+	switch err.(type) {
+	case kbfsblock.ServerErrorUnauthorized,
+		kbfsblock.ServerErrorNoPermission:
+		return serverErrorClassAuth, true
+	case kbfsblock.ServerErrorBlockNonExistent,
+		kbfsblock.ServerErrorBlockArchived,
+		kbfsblock.ServerErrorBlockDeleted,
+		kbfsblock.ServerErrorNonceNonExistent:
+		return serverErrorClassNotFound, true
+	case kbfsblock.ServerErrorMaxRefExceeded:
+		// Someone else used up the references to this block.
+		return serverErrorClassConflict, true
+	case kbfsblock.ServerError:
+		return serverErrorClassTransientNetwork, true
+	case kbfsblock.ServerErrorBadRequest,
+		kbfsblock.ServerErrorOverQuota:
+		return serverErrorClassFatal, true
+	}
+	return serverErrorClassNone, false
+}
+
+// classifyMDServerError returns the class of the given error if it
+// came from the MD server or the MD journal, and false otherwise.
+func classifyMDServerError(err error) (serverErrorClass, bool) {
+	switch err.(type) {
+	case kbfsmd.ServerErrorThrottle:
+		return serverErrorClassThrottle, true
+	case kbfsmd.ServerErrorUnauthorized,
+		kbfsmd.ServerErrorWriteAccess,
+		kbfsmd.ServerErrorCannotReadFinalizedTLF:
+		return serverErrorClassAuth, true
+	case kbfsmd.ServerErrorClassicTLFDoesNotExist:
+		return serverErrorClassNotFound, true
+	case kbfsmd.ServerErrorConflictRevision,
+		kbfsmd.ServerErrorConflictPrevRoot,
+		kbfsmd.ServerErrorConflictDiskUsage,
+		kbfsmd.ServerErrorConditionFailed,
+		kbfsmd.ServerErrorConflictFolderMapping,
+		MDJournalConflictError:
+		return serverErrorClassConflict, true
+	case kbfsmd.ServerError,
+		kbfsmd.ServerErrorLocked:
+		return serverErrorClassTransientNetwork, true
+	case kbfsmd.ServerErrorBadRequest,
+		kbfsmd.ServerErrorTooManyFoldersCreated,
+		kbfsmd.ServerErrorLockConflict:
+		return serverErrorClassFatal, true
+	}
+	return serverErrorClassNone, false
+}
+
+// classifyCommonError classifies errors that either server (or the
+// connection to it) might return.
+func classifyCommonError(err error) serverErrorClass {
+	if err == nil {
+		return serverErrorClassNone
+	}
+	switch err.(type) {
+	case errDisconnected, net.Error:
+		return serverErrorClassTransientNetwork
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return serverErrorClassTransientNetwork
+	}
+	return serverErrorClassFatal
+}
+
+// classifyServerError returns the class of the given error, which
+// may come from either the block server or the MD server (or the
+// local journal standing in for them).
+func classifyServerError(err error) serverErrorClass {
+	err = errors.Cause(err)
+	if class, ok := classifyBlockServerError(err); ok {
+		return class
+	}
+	if class, ok := classifyMDServerError(err); ok {
+		return class
+	}
+	return classifyCommonError(err)
+}
+
+// classifyServerErrorFrom is like classifyServerError, but treats
+// errors specific to the other kind of server as fatal, so that,
+// say, a block reference conflict is never mistaken for an MD
+// revision conflict.
+func classifyServerErrorFrom(kind serverKind, err error) serverErrorClass {
+	err = errors.Cause(err)
+	blockClass, isBlock := classifyBlockServerError(err)
+	mdClass, isMD := classifyMDServerError(err)
+	switch {
+	case isBlock && kind == blockServerKind:
+		return blockClass
+	case isMD && kind == mdServerKind:
+		return mdClass
+	case isBlock || isMD:
+		return serverErrorClassFatal
+	}
+	return classifyCommonError(err)
+}
+
+// serverKind distinguishes the servers whose errors we classify,
+// since the same class of error calls for different reactions from
+// each.
+type serverKind int
+
+const (
+	blockServerKind serverKind = iota
+	mdServerKind
+)
+
+func (k serverKind) String() string {
+	switch k {
+	case blockServerKind:
+		return "BlockServer"
+	case mdServerKind:
+		return "MDServer"
+	default:
+		return "unknown"
+	}
+}
+
+// serverErrorPolicy describes how KBFS reacts to a class of error
+// from one kind of server.
+type serverErrorPolicy struct {
+	// retryRPC means the RPC layer should back off and retry the
+	// same call.
+	retryRPC bool
+	// retryWithNewBlocks means the whole set of block puts should
+	// be retried after re-readying the affected blocks under new
+	// IDs or ref nonces.
+	retryWithNewBlocks bool
+	// putUnmerged means the MD put should be retried on an
+	// unmerged branch, to be resolved by conflict resolution.
+	putUnmerged bool
+}
+
+// serverErrorPolicies is the retry policy table, by server and error
+// class.  Classes not listed get the zero policy: the error is
+// returned to the caller as-is.
+var serverErrorPolicies = map[serverKind]map[serverErrorClass]serverErrorPolicy{
+	blockServerKind: {
+		serverErrorClassThrottle: {retryRPC: true},
+		serverErrorClassNotFound: {retryWithNewBlocks: true},
+		serverErrorClassConflict: {retryWithNewBlocks: true},
+	},
+	mdServerKind: {
+		serverErrorClassThrottle: {retryRPC: true},
+		serverErrorClassConflict: {putUnmerged: true},
+	},
+}
+
+// serverErrorPolicyFor returns the policy for the given error from
+// the given kind of server.
+func serverErrorPolicyFor(kind serverKind, err error) serverErrorPolicy {
+	return serverErrorPolicies[kind][classifyServerErrorFrom(kind, err)]
+}
+
+// isRecoverableBlockError returns true if the given block server
+// error can be fixed by retrying with new block pointers.
+func isRecoverableBlockError(err error) bool {
+	return serverErrorPolicyFor(blockServerKind, err).retryWithNewBlocks
+}
+
+// isRevisionConflict returns true if the given MD server (or MD
+// journal) error means the MD put should go to an unmerged branch.
+func isRevisionConflict(err error) bool {
+	return serverErrorPolicyFor(mdServerKind, err).putUnmerged
+}
+
+// isResendableMDPutError returns true if the given error from an MD
+// put means the put may not have reached the MD server, so that the
+// same signed MD can be sent again.
+func isResendableMDPutError(err error) bool {
+	if errors.Cause(err) == context.DeadlineExceeded {
+		return true
+	}
+	switch classifyServerErrorFrom(mdServerKind, err) {
+	case serverErrorClassThrottle, serverErrorClassTransientNetwork:
+		return true
+	default:
+		return false
+	}
+}
+
+// serverErrorCounter keeps per-class counts of the errors returned
+// by one kind of server, in a metrics registry.
+type serverErrorCounter struct {
+	kind     serverKind
+	counters map[serverErrorClass]metrics.Counter
+}
+
+// newServerErrorCounter registers counters named
+// "<server>.Errors.<class>" in the given registry.  It returns nil if
+// `r` is nil; a nil *serverErrorCounter ignores everything.
+func newServerErrorCounter(
+	kind serverKind, r metrics.Registry) *serverErrorCounter {
+	if r == nil {
+		return nil
+	}
+	counters := make(map[serverErrorClass]metrics.Counter)
+	for _, class := range serverErrorClasses {
+		counters[class] = metrics.GetOrRegisterCounter(
+			kind.String()+".Errors."+class.String(), r)
+	}
+	return &serverErrorCounter{kind, counters}
+}
+
+// record classifies `err` and bumps the counter for its class.  It
+// returns the class for the caller's convenience.
+func (sec *serverErrorCounter) record(err error) serverErrorClass {
+	if sec == nil {
+		return classifyServerError(err)
+	}
+	class := classifyServerErrorFrom(sec.kind, err)
+	if c, ok := sec.counters[class]; ok {
+		c.Inc(1)
+	}
+	return class
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	pkgerrors "github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyServerError(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class serverErrorClass
+	}{
+		{nil, serverErrorClassNone},
+		{kbfsblock.ServerErrorThrottle{}, serverErrorClassThrottle},
+		{kbfsblock.ServerErrorOverQuota{Throttled: true},
+			serverErrorClassThrottle},
+		{kbfsmd.ServerErrorThrottle{}, serverErrorClassThrottle},
+		{kbfsblock.ServerErrorUnauthorized{}, serverErrorClassAuth},
+		{kbfsmd.ServerErrorWriteAccess{}, serverErrorClassAuth},
+		{kbfsblock.ServerErrorBlockArchived{}, serverErrorClassNotFound},
+		{kbfsmd.ServerErrorClassicTLFDoesNotExist{},
+			serverErrorClassNotFound},
+		{kbfsblock.ServerErrorMaxRefExceeded{}, serverErrorClassConflict},
+		{kbfsmd.ServerErrorConflictRevision{}, serverErrorClassConflict},
+		{MDJournalConflictError{}, serverErrorClassConflict},
+		{pkgerrors.WithStack(kbfsmd.ServerErrorConditionFailed{}),
+			serverErrorClassConflict},
+		{kbfsmd.ServerErrorLocked{}, serverErrorClassTransientNetwork},
+		{errDisconnected{}, serverErrorClassTransientNetwork},
+		{io.EOF, serverErrorClassTransientNetwork},
+		{kbfsblock.ServerErrorBadRequest{}, serverErrorClassFatal},
+		{errors.New("unknown"), serverErrorClassFatal},
+	} {
+		require.Equal(t, tc.class, classifyServerError(tc.err), "%v", tc.err)
+	}
+}
+
+func TestServerErrorPolicies(t *testing.T) {
+	require.True(t, isRecoverableBlockError(
+		kbfsblock.ServerErrorBlockDeleted{}))
+	require.True(t, isRecoverableBlockError(
+		kbfsblock.ServerErrorMaxRefExceeded{}))
+	require.False(t, isRecoverableBlockError(kbfsblock.ServerErrorThrottle{}))
+
+	require.True(t, isRevisionConflict(kbfsmd.ServerErrorConflictPrevRoot{}))
+	require.False(t, isRevisionConflict(kbfsmd.ServerErrorLocked{}))
+	require.False(t, isRevisionConflict(
+		kbfsblock.ServerErrorMaxRefExceeded{}))
+
+	require.True(t, serverErrorPolicyFor(
+		mdServerKind, kbfsmd.ServerErrorThrottle{}).retryRPC)
+	require.False(t, serverErrorPolicyFor(
+		mdServerKind, kbfsmd.ServerErrorConflictRevision{}).retryRPC)
+}
+
+func TestServerErrorCounter(t *testing.T) {
+	var nilCounter *serverErrorCounter
+	require.Equal(t, serverErrorClassThrottle,
+		nilCounter.record(kbfsmd.ServerErrorThrottle{}))
+
+	r := metrics.NewRegistry()
+	sec := newServerErrorCounter(mdServerKind, r)
+	sec.record(kbfsmd.ServerErrorThrottle{})
+	sec.record(kbfsmd.ServerErrorThrottle{})
+	sec.record(kbfsmd.ServerErrorConflictRevision{})
+	sec.record(nil)
+
+	throttles := r.Get("MDServer.Errors.throttle").(metrics.Counter)
+	require.Equal(t, int64(2), throttles.Count())
+	conflicts := r.Get("MDServer.Errors.conflict").(metrics.Counter)
+	require.Equal(t, int64(1), conflicts.Count())
+}
@@ -356,14 +356,31 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 		return err
 	}
 
+	// Blocks whose references were transferred to another TLF are
+	// unreferenced here, but this TLF doesn't archive them.
+	var transferredIDs map[kbfsblock.ID]bool
+	if transferer, ok := bserverLocal.(blockRefTransfererLocal); ok {
+		transferredIDs, err = transferer.getTransferredIDsForTest(ctx, tlfID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Inlined files are live, but have no blocks on the server.
 	blockRefsByID := make(map[kbfsblock.ID]blockRefMap)
 	for ptr := range expectedLiveBlocks {
+		if ptr.DataVer == InlineDataVer {
+			continue
+		}
 		if _, ok := blockRefsByID[ptr.ID]; !ok {
 			blockRefsByID[ptr.ID] = make(blockRefMap)
 		}
 		blockRefsByID[ptr.ID].put(ptr.Context, liveBlockRef, "")
 	}
 	for ptr := range archivedBlocks {
+		if ptr.DataVer == InlineDataVer || transferredIDs[ptr.ID] {
+			continue
+		}
 		if _, ok := blockRefsByID[ptr.ID]; !ok {
 			blockRefsByID[ptr.ID] = make(blockRefMap)
 		}
@@ -390,3 +407,22 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 	// TODO: Check the archived and deleted blocks as well.
 	return nil
 }
+
+// CheckKeyBundles verifies that the latest key generation of the
+// given TLF has keys for exactly the current devices of its writers
+// and readers.  See the package-level CheckKeyBundles.
+func (sc *StateChecker) CheckKeyBundles(
+	ctx context.Context, tlfID tlf.ID) error {
+	res, err := CheckKeyBundles(ctx, sc.config, tlfID, false)
+	if err != nil {
+		return err
+	}
+	if !res.Consistent() {
+		sc.log.CDebugf(ctx, "Key bundles for folder %s at key gen %d: "+
+			"missing=%+v, stale=%+v", tlfID, res.KeyGen, res.Missing,
+			res.Stale)
+		return fmt.Errorf("Folder %v has %d missing and %d stale device "+
+			"keys", tlfID, len(res.Missing), len(res.Stale))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// minFreeBytesForLocalStorageDefault is how much free space the disk
+// must have before we'll start keeping a disk cache or journal on it.
+// Below that, the cache or journal would fill the disk almost
+// immediately, and the user would see I/O errors instead of
+// something actionable.
+const minFreeBytesForLocalStorageDefault = 100 * 1024 * 1024
+
+// storageMonitor checks the free space on the disks KBFS keeps local
+// state on, so that disk caches and journals can be left off when
+// there isn't room for them.
+type storageMonitor struct {
+	log          logger.Logger
+	reporter     func() Reporter
+	minFreeBytes int64
+	// getFreeBytesAndFiles is overridable for testing.
+	getFreeBytesAndFiles func(path string) (int64, int64, error)
+}
+
+func newStorageMonitor(log logger.Logger, reporter func() Reporter) *storageMonitor {
+	return &storageMonitor{
+		log:                  log,
+		reporter:             reporter,
+		minFreeBytes:         minFreeBytesForLocalStorageDefault,
+		getFreeBytesAndFiles: defaultGetFreeBytesAndFiles,
+	}
+}
+
+// existingAncestor returns the closest ancestor of `path`, including
+// `path` itself, that exists, since the storage for a cache or
+// journal might not have been created yet.
+func existingAncestor(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// preflight returns a DiskSpaceLowWarning, after reporting it, if
+// the disk holding `path` doesn't have enough free space to start
+// keeping `what` (e.g. "journal") there.  If the free space can't be
+// determined, it logs that and returns nil, since failing to stat the
+// disk isn't a reason to turn anything off.
+func (sm *storageMonitor) preflight(
+	ctx context.Context, path, what string) error {
+	freeBytes, _, err := sm.getFreeBytesAndFiles(existingAncestor(path))
+	if err != nil {
+		sm.log.CDebugf(ctx, "Couldn't get the free space for %s at %s: %+v",
+			what, path, err)
+		return nil
+	}
+	if freeBytes >= sm.minFreeBytes {
+		return nil
+	}
+
+	warning := DiskSpaceLowWarning{
+		Path:           path,
+		What:           what,
+		AvailableBytes: freeBytes,
+		MinBytes:       sm.minFreeBytes,
+	}
+	sm.log.CWarningf(ctx, "%v", warning)
+	sm.reporter().ReportErr(ctx, tlf.CanonicalName(""), tlf.Private,
+		WriteMode, warning)
+	return errors.WithStack(warning)
+}
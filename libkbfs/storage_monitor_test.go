@@ -0,0 +1,68 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestStorageMonitorPreflight(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "storage_monitor")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	freeBytes := int64(minFreeBytesForLocalStorageDefault - 1)
+	var checkedPath string
+	config.storageMon.getFreeBytesAndFiles = func(path string) (
+		int64, int64, error) {
+		checkedPath = path
+		return freeBytes, 1000, nil
+	}
+
+	// A disk cache that can't fit is left off, without failing.
+	config.diskCacheMode = DiskCacheModeLocal
+	config.storageRoot = filepath.Join(tempdir, "storage")
+	err = config.MakeDiskBlockCacheIfNotExists()
+	require.NoError(t, err)
+	require.Nil(t, config.DiskBlockCache())
+	require.Equal(t, tempdir, checkedPath)
+	config.diskCacheMode = DiskCacheModeOff
+
+	// A journal that can't fit isn't enabled.
+	journalRoot := filepath.Join(tempdir, "journal")
+	err = config.EnableJournaling(
+		ctx, journalRoot, TLFJournalBackgroundWorkEnabled)
+	require.IsType(t, DiskSpaceLowWarning{}, errors.Cause(err))
+	_, err = GetJournalServer(config)
+	require.Error(t, err)
+
+	// Both were reported.
+	reported := config.Reporter().AllKnownErrors()
+	require.Len(t, reported, 2)
+	for _, re := range reported {
+		require.IsType(t, DiskSpaceLowWarning{}, re.Error)
+	}
+
+	// Once there's room, the journal can be enabled.
+	freeBytes = minFreeBytesForLocalStorageDefault
+	err = config.EnableJournaling(
+		ctx, journalRoot, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	require.Equal(t, journalRoot, checkedPath)
+}
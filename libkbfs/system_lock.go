@@ -0,0 +1,28 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// SystemLockNotifier is implemented by platform-specific code that
+// can tell when the device is about to go to sleep, or when its
+// screen gets locked.
+type SystemLockNotifier interface {
+	// SystemLockEvents returns a channel that receives a value
+	// each time the device goes to sleep or its screen is locked.
+	// The channel is closed once `ctx` is canceled.
+	SystemLockEvents(ctx context.Context) <-chan struct{}
+}
+
+// LockKeysOnSystemLock drops all the decrypted TLF crypt keys cached
+// by `config` each time `notifier` reports that the device went to
+// sleep or was locked, until `ctx` is canceled.  Frontends that can
+// observe such events should run it in its own goroutine.
+func LockKeysOnSystemLock(
+	ctx context.Context, config Config, notifier SystemLockNotifier) {
+	for range notifier.SystemLockEvents(ctx) {
+		config.KBFSOps().LockKeys(ctx)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+const (
+	// telemetryReportVersion is the version of TelemetryReport.
+	telemetryReportVersion = 1
+	// telemetryPeriodDefault is how often telemetry is reported,
+	// when no period is given.
+	telemetryPeriodDefault = 24 * time.Hour
+	// telemetryMinSyncs is the fewest syncs in a period for which
+	// sync latency percentiles are reported, so that the timing of
+	// any single sync can't be picked out of a report.
+	telemetryMinSyncs = 20
+	// telemetrySendTimeout bounds each attempt to send a report.
+	telemetrySendTimeout = 30 * time.Second
+)
+
+// The metrics below are recorded for telemetry, among other uses.
+// Telemetry only ever reads the metrics named here, never the whole
+// registry, so metric names that embed paths or IDs can't leak into
+// a report.
+const (
+	// syncTimerName times each successful SyncAll.
+	syncTimerName = "folderBranchOps.SyncAll"
+	// crResolutionsMeterName counts successful conflict resolutions.
+	crResolutionsMeterName = "ConflictResolver.Resolutions"
+	// blockCacheAttemptMeterName counts clean block cache lookups
+	// made while reading blocks, and blockCacheHitMeterName counts
+	// the ones that found the block.
+	blockCacheAttemptMeterName = "BlockCache.AttemptCount"
+	blockCacheHitMeterName     = "BlockCache.HitCount"
+	// keyCacheGetTimerName and keyCacheHitMeterName are recorded by
+	// KeyCacheMeasured.
+	keyCacheGetTimerName = "KeyCache.GetTLFCryptKey"
+	keyCacheHitMeterName = "KeyCache.HitCount"
+)
+
+// TelemetryReport is the anonymized performance summary for one
+// reporting period.  It must only ever hold numbers: no paths, no
+// TLF, user or device names or IDs, and nothing else that could
+// identify a user or their data.  checkTelemetryReport enforces
+// this before every send.
+type TelemetryReport struct {
+	Version int `json:"version"`
+	// PeriodSeconds is the length of the period the report covers.
+	PeriodSeconds int64 `json:"period_seconds"`
+
+	// SyncCount is the number of syncs in the period.
+	SyncCount int64 `json:"sync_count"`
+	// SyncLatency*Ms are percentiles of the recent sync latencies,
+	// in milliseconds.  They're zero if there were fewer than
+	// telemetryMinSyncs syncs in the period.
+	SyncLatencyP50Ms int64 `json:"sync_latency_p50_ms"`
+	SyncLatencyP90Ms int64 `json:"sync_latency_p90_ms"`
+	SyncLatencyP99Ms int64 `json:"sync_latency_p99_ms"`
+
+	// CRCount is the number of conflict resolutions in the period.
+	CRCount int64 `json:"cr_count"`
+
+	// BlockCacheHitRate and KeyCacheHitRate are the fractions of
+	// lookups in the period that hit the cache, rounded to two
+	// decimal places, or -1 if there were no lookups.
+	BlockCacheHitRate float64 `json:"block_cache_hit_rate"`
+	KeyCacheHitRate   float64 `json:"key_cache_hit_rate"`
+}
+
+// checkTelemetryFields returns an error if the struct type `t` has
+// any field that isn't a number, since only numbers are safe to
+// report.
+func checkTelemetryFields(t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+			reflect.Uint32, reflect.Uint64, reflect.Float32,
+			reflect.Float64:
+		default:
+			return errors.Errorf("Telemetry field %s has non-numeric "+
+				"type %s", f.Name, f.Type)
+		}
+	}
+	return nil
+}
+
+func checkTelemetryReport(report TelemetryReport) error {
+	return checkTelemetryFields(reflect.TypeOf(report))
+}
+
+// TelemetrySender sends telemetry reports to wherever they're
+// collected.
+type TelemetrySender interface {
+	SendTelemetry(ctx context.Context, report TelemetryReport) error
+}
+
+// TelemetryHTTPSender is a TelemetrySender that POSTs each report, as
+// JSON, to an HTTP(S) endpoint.  It sends no cookies or credentials.
+type TelemetryHTTPSender struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+var _ TelemetrySender = TelemetryHTTPSender{}
+
+// SendTelemetry implements the TelemetrySender interface for
+// TelemetryHTTPSender.
+func (s TelemetryHTTPSender) SendTelemetry(
+	ctx context.Context, report TelemetryReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Telemetry endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// telemetryAggregator turns the cumulative metrics in a registry
+// into per-period reports.
+type telemetryAggregator struct {
+	registry metrics.Registry
+	// last holds each counter's value as of the previous report.
+	last map[string]int64
+}
+
+func newTelemetryAggregator(registry metrics.Registry) *telemetryAggregator {
+	return &telemetryAggregator{
+		registry: registry,
+		last:     make(map[string]int64),
+	}
+}
+
+// delta returns how much the count of the named metric has grown
+// since the last report.
+func (ta *telemetryAggregator) delta(name string, count int64) int64 {
+	d := count - ta.last[name]
+	ta.last[name] = count
+	if d < 0 {
+		// The metric must have been re-registered.
+		return count
+	}
+	return d
+}
+
+func (ta *telemetryAggregator) meterDelta(name string) int64 {
+	return ta.delta(name, metrics.GetOrRegisterMeter(
+		name, ta.registry).Snapshot().Count())
+}
+
+func hitRate(hits, attempts int64) float64 {
+	if attempts <= 0 {
+		return -1
+	}
+	rate := float64(hits) / float64(attempts)
+	if rate > 1 {
+		// The hit and attempt counts are read at slightly different
+		// times.
+		rate = 1
+	}
+	return math.Floor(rate*100+0.5) / 100
+}
+
+// report returns the report for the period of length `period`
+// since the last call.
+func (ta *telemetryAggregator) report(period time.Duration) TelemetryReport {
+	report := TelemetryReport{
+		Version:       telemetryReportVersion,
+		PeriodSeconds: int64(period / time.Second),
+	}
+
+	syncTimer := metrics.GetOrRegisterTimer(
+		syncTimerName, ta.registry).Snapshot()
+	report.SyncCount = ta.delta(syncTimerName, syncTimer.Count())
+	if report.SyncCount >= telemetryMinSyncs {
+		ps := syncTimer.Percentiles([]float64{0.5, 0.9, 0.99})
+		report.SyncLatencyP50Ms = int64(ps[0]) / int64(time.Millisecond)
+		report.SyncLatencyP90Ms = int64(ps[1]) / int64(time.Millisecond)
+		report.SyncLatencyP99Ms = int64(ps[2]) / int64(time.Millisecond)
+	}
+
+	report.CRCount = ta.meterDelta(crResolutionsMeterName)
+
+	report.BlockCacheHitRate = hitRate(
+		ta.meterDelta(blockCacheHitMeterName),
+		ta.meterDelta(blockCacheAttemptMeterName))
+	keyCacheGets := ta.delta(keyCacheGetTimerName, metrics.GetOrRegisterTimer(
+		keyCacheGetTimerName, ta.registry).Snapshot().Count())
+	report.KeyCacheHitRate = hitRate(
+		ta.meterDelta(keyCacheHitMeterName), keyCacheGets)
+	return report
+}
+
+// telemetryReporter periodically sends a report of the metrics in
+// a registry through a TelemetrySender.
+type telemetryReporter struct {
+	aggregator *telemetryAggregator
+	sender     TelemetrySender
+	log        logger.Logger
+	period     time.Duration
+
+	shutdownOnce sync.Once
+	shutdownCh   chan struct{}
+	doneCh       chan struct{}
+}
+
+func newTelemetryReporter(registry metrics.Registry, sender TelemetrySender,
+	period time.Duration, log logger.Logger) *telemetryReporter {
+	if period <= 0 {
+		period = telemetryPeriodDefault
+	}
+	return &telemetryReporter{
+		aggregator: newTelemetryAggregator(registry),
+		sender:     sender,
+		log:        log,
+		period:     period,
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+}
+
+// send sends the report for the period that just ended.  Reports
+// that can't be sent are dropped, rather than queued.
+func (tr *telemetryReporter) send() {
+	report := tr.aggregator.report(tr.period)
+	if err := checkTelemetryReport(report); err != nil {
+		tr.log.CWarningf(nil, "Not sending telemetry: %+v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), telemetrySendTimeout)
+	defer cancel()
+	if err := tr.sender.SendTelemetry(ctx, report); err != nil {
+		tr.log.CDebugf(ctx, "Couldn't send telemetry: %+v", err)
+	}
+}
+
+func (tr *telemetryReporter) loop() {
+	defer close(tr.doneCh)
+	ticker := time.NewTicker(tr.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tr.send()
+		case <-tr.shutdownCh:
+			return
+		}
+	}
+}
+
+// start starts sending reports in the background, once per period.
+func (tr *telemetryReporter) start() {
+	go tr.loop()
+}
+
+// shutdown stops sending reports.  The partial period in progress
+// isn't reported.
+func (tr *telemetryReporter) shutdown() {
+	tr.shutdownOnce.Do(func() {
+		close(tr.shutdownCh)
+		<-tr.doneCh
+	})
+}
+
+// EnableTelemetry starts sending an anonymized summary of this
+// config's performance metrics through `sender` every `period` (or
+// every day, if `period` is zero).  Telemetry is off unless this is
+// called.  It has no effect if the config has no metrics registry.
+func (c *ConfigLocal) EnableTelemetry(
+	sender TelemetrySender, period time.Duration) {
+	registry := c.MetricsRegistry()
+	if registry == nil {
+		return
+	}
+	c.lock.Lock()
+	oldTR := c.telemetryReporter
+	c.telemetryReporter = nil
+	c.lock.Unlock()
+	if oldTR != nil {
+		oldTR.shutdown()
+	}
+
+	tr := newTelemetryReporter(
+		registry, sender, period, c.MakeLogger("TEL"))
+	tr.start()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.telemetryReporter = tr
+}
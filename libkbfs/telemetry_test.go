@@ -0,0 +1,101 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestTelemetryReportOnlyNumbers(t *testing.T) {
+	require.NoError(t, checkTelemetryReport(TelemetryReport{}))
+
+	type badReport struct {
+		SyncCount int64
+		Path      string
+	}
+	require.Error(t, checkTelemetryFields(reflect.TypeOf(badReport{})))
+	type badReport2 struct {
+		SyncCount int64
+		TlfIDs    []uint64
+	}
+	require.Error(t, checkTelemetryFields(reflect.TypeOf(badReport2{})))
+}
+
+func TestTelemetryAggregator(t *testing.T) {
+	r := metrics.NewRegistry()
+	ta := newTelemetryAggregator(r)
+
+	t.Log("No activity gives an empty report")
+	report := ta.report(time.Hour)
+	require.Equal(t, TelemetryReport{
+		Version:           telemetryReportVersion,
+		PeriodSeconds:     3600,
+		BlockCacheHitRate: -1,
+		KeyCacheHitRate:   -1,
+	}, report)
+
+	t.Log("Too few syncs for latency percentiles")
+	syncTimer := metrics.GetOrRegisterTimer(syncTimerName, r)
+	for i := 0; i < telemetryMinSyncs-1; i++ {
+		syncTimer.Update(10 * time.Millisecond)
+	}
+	metrics.GetOrRegisterMeter(crResolutionsMeterName, r).Mark(2)
+	metrics.GetOrRegisterMeter(blockCacheAttemptMeterName, r).Mark(3)
+	metrics.GetOrRegisterMeter(blockCacheHitMeterName, r).Mark(2)
+	// Metrics that telemetry doesn't know about are never reported,
+	// whatever their names.
+	metrics.GetOrRegisterMeter("Path./keybase/private/alice/secret", r).Mark(1)
+	report = ta.report(time.Hour)
+	require.Equal(t, int64(telemetryMinSyncs-1), report.SyncCount)
+	require.Equal(t, int64(0), report.SyncLatencyP50Ms)
+	require.Equal(t, int64(2), report.CRCount)
+	require.Equal(t, 0.67, report.BlockCacheHitRate)
+	require.Equal(t, -1.0, report.KeyCacheHitRate)
+	buf, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(string(buf), "alice"))
+
+	t.Log("Counts are per period, and enough syncs give percentiles")
+	for i := 0; i < telemetryMinSyncs; i++ {
+		syncTimer.Update(10 * time.Millisecond)
+	}
+	report = ta.report(time.Hour)
+	require.Equal(t, int64(telemetryMinSyncs), report.SyncCount)
+	require.Equal(t, int64(10), report.SyncLatencyP50Ms)
+	require.Equal(t, int64(10), report.SyncLatencyP99Ms)
+	require.Equal(t, int64(0), report.CRCount)
+	require.Equal(t, -1.0, report.BlockCacheHitRate)
+}
+
+func TestTelemetryHTTPSender(t *testing.T) {
+	reports := make(chan TelemetryReport, 1)
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			require.Empty(t, req.Header.Get("Cookie"))
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			var report TelemetryReport
+			require.NoError(t, json.Unmarshal(body, &report))
+			reports <- report
+		}))
+	defer s.Close()
+
+	report := TelemetryReport{Version: telemetryReportVersion, CRCount: 3}
+	err := TelemetryHTTPSender{Endpoint: s.URL}.SendTelemetry(
+		context.Background(), report)
+	require.NoError(t, err)
+	require.Equal(t, report, <-reports)
+}
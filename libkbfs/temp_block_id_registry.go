@@ -0,0 +1,233 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"golang.org/x/net/context"
+)
+
+const (
+	// tempBlockIDRegistryDir is the directory, under the storage
+	// root, where each TLF's temporary block ID registry is kept.
+	tempBlockIDRegistryDir = "kbfs_temp_block_ids"
+	// tempBlockIDRegistryVersion is the version of the registry file
+	// format.  Files of any other version are ignored.
+	tempBlockIDRegistryVersion = 1
+)
+
+// tempBlockIDRemap is a temporary block ID, along with the final ID
+// its block was readied under.  Final is zero until the block has
+// been readied by a sync.
+type tempBlockIDRemap struct {
+	Temp  kbfsblock.ID
+	Final kbfsblock.ID `codec:",omitempty"`
+}
+
+type tempBlockIDRegistryFile struct {
+	Version int
+	Remaps  []tempBlockIDRemap
+}
+
+// tempBlockIDRecovery summarizes what a registry left behind by a
+// previous run says about the unsynced state lost when that run
+// ended.
+type tempBlockIDRecovery struct {
+	// lost are temporary IDs that were never readied, so the data
+	// in them was never put to the server.
+	lost []kbfsblock.ID
+	// unreferenced are final IDs of blocks that may have been put to
+	// the server, but whose sync never got as far as writing an MD
+	// that references them.
+	unreferenced []kbfsblock.ID
+}
+
+// tempBlockIDRegistry tracks the temporary block IDs handed out for a
+// folder-branch's unsynced changes, and the final IDs that a sync
+// remaps them to, until the sync's MD write succeeds.  The dirty
+// block cache and deferred writes only live in memory, so the
+// registry is persisted under the storage root, so that a restart
+// after a crash can tell what was lost.
+//
+// A nil *tempBlockIDRegistry ignores everything, which is what
+// read-only folder-branches use.
+type tempBlockIDRegistry struct {
+	codec kbfscodec.Codec
+	log   logger.Logger
+	// path is where the registry is persisted, or empty if it's only
+	// kept in memory.
+	path string
+
+	lock   sync.Mutex
+	remaps map[kbfsblock.ID]kbfsblock.ID
+}
+
+func tempBlockIDRegistryPath(storageRoot string, fb FolderBranch) string {
+	if storageRoot == "" || fb.Branch != MasterBranch {
+		return ""
+	}
+	return filepath.Join(storageRoot, tempBlockIDRegistryDir, fb.Tlf.String())
+}
+
+// newTempBlockIDRegistry makes a new, empty registry for `fb`.  If a
+// registry was left behind by a previous run, what it says was lost
+// is logged, and it is then discarded.
+func newTempBlockIDRegistry(ctx context.Context, config Config,
+	fb FolderBranch, log logger.Logger) *tempBlockIDRegistry {
+	r := &tempBlockIDRegistry{
+		codec:  config.Codec(),
+		log:    log,
+		path:   tempBlockIDRegistryPath(config.StorageRoot(), fb),
+		remaps: make(map[kbfsblock.ID]kbfsblock.ID),
+	}
+	if r.path == "" {
+		return r
+	}
+
+	recovery, err := r.recover()
+	if err != nil {
+		log.CWarningf(ctx, "Couldn't read temporary block ID registry: %+v",
+			err)
+	} else if len(recovery.lost) > 0 || len(recovery.unreferenced) > 0 {
+		log.CWarningf(ctx, "Unsynced changes were lost when KBFS last "+
+			"exited: %d temporary blocks were never put, and %d put "+
+			"blocks were never referenced by an MD",
+			len(recovery.lost), len(recovery.unreferenced))
+		log.CDebugf(ctx, "Lost temporary blocks: %v; unreferenced "+
+			"blocks: %v", recovery.lost, recovery.unreferenced)
+	}
+	if err := ioutil.RemoveAll(r.path); err != nil {
+		log.CWarningf(ctx, "Couldn't remove temporary block ID registry: "+
+			"%+v", err)
+	}
+	return r
+}
+
+// recover reads the registry file left behind by a previous run, if
+// any, and reconciles it against the in-memory state, which starts
+// out empty: everything in it was lost.
+func (r *tempBlockIDRegistry) recover() (tempBlockIDRecovery, error) {
+	var file tempBlockIDRegistryFile
+	err := kbfscodec.DeserializeFromFile(r.codec, r.path, &file)
+	if ioutil.IsNotExist(err) {
+		return tempBlockIDRecovery{}, nil
+	} else if err != nil {
+		return tempBlockIDRecovery{}, err
+	}
+	if file.Version != tempBlockIDRegistryVersion {
+		r.log.CDebugf(nil, "Ignoring temporary block ID registry "+
+			"version %d", file.Version)
+		return tempBlockIDRecovery{}, nil
+	}
+
+	var recovery tempBlockIDRecovery
+	for _, remap := range file.Remaps {
+		if remap.Final == (kbfsblock.ID{}) {
+			recovery.lost = append(recovery.lost, remap.Temp)
+		} else {
+			recovery.unreferenced = append(recovery.unreferenced, remap.Final)
+		}
+	}
+	return recovery, nil
+}
+
+func (r *tempBlockIDRegistry) saveLocked() {
+	if r.path == "" {
+		return
+	}
+	if len(r.remaps) == 0 {
+		if err := ioutil.RemoveAll(r.path); err != nil {
+			r.log.CDebugf(nil, "Couldn't remove temporary block ID "+
+				"registry: %+v", err)
+		}
+		return
+	}
+
+	file := tempBlockIDRegistryFile{
+		Version: tempBlockIDRegistryVersion,
+		Remaps:  make([]tempBlockIDRemap, 0, len(r.remaps)),
+	}
+	for temp, final := range r.remaps {
+		file.Remaps = append(file.Remaps, tempBlockIDRemap{temp, final})
+	}
+	err := kbfscodec.SerializeToFile(r.codec, file, r.path)
+	if err != nil {
+		r.log.CDebugf(nil, "Couldn't save temporary block ID registry: %+v",
+			err)
+	}
+}
+
+// add records a newly-made temporary block ID.
+func (r *tempBlockIDRegistry) add(id kbfsblock.ID) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.remaps[id] = kbfsblock.ID{}
+	r.saveLocked()
+}
+
+// remap records the final IDs that the temporary blocks in `bps`
+// were readied under.
+func (r *tempBlockIDRegistry) remap(bps *blockPutState) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changed := false
+	for _, bs := range bps.blockStates {
+		if _, ok := r.remaps[bs.oldPtr.ID]; ok {
+			r.remaps[bs.oldPtr.ID] = bs.blockPtr.ID
+			changed = true
+		}
+	}
+	if changed {
+		r.saveLocked()
+	}
+}
+
+// commit forgets the remapped IDs once the MD that references their
+// final IDs has been written.  If the folder-branch is clean, no
+// temporary IDs are in use anymore, and everything is forgotten.
+func (r *tempBlockIDRegistry) commit(clean bool) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for temp, final := range r.remaps {
+		if clean || final != (kbfsblock.ID{}) {
+			delete(r.remaps, temp)
+		}
+	}
+	r.saveLocked()
+}
+
+// tempBlockIDRecordingCrypto records every temporary block ID it
+// makes in a registry.
+type tempBlockIDRecordingCrypto struct {
+	cryptoPure
+	registry *tempBlockIDRegistry
+}
+
+// MakeTemporaryBlockID implements the cryptoPure interface for
+// tempBlockIDRecordingCrypto.
+func (c tempBlockIDRecordingCrypto) MakeTemporaryBlockID() (
+	kbfsblock.ID, error) {
+	id, err := c.cryptoPure.MakeTemporaryBlockID()
+	if err != nil {
+		return kbfsblock.ID{}, err
+	}
+	c.registry.add(id)
+	return id, nil
+}
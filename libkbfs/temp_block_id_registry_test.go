@@ -0,0 +1,82 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTempBlockIDRegistryForTest(
+	t *testing.T, path string) *tempBlockIDRegistry {
+	return &tempBlockIDRegistry{
+		codec:  kbfscodec.NewMsgpack(),
+		log:    logger.NewTestLogger(t),
+		path:   path,
+		remaps: make(map[kbfsblock.ID]kbfsblock.ID),
+	}
+}
+
+func TestTempBlockIDRegistryRecover(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "temp_block_id_registry")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+	path := filepath.Join(tempdir, "registry")
+
+	r := makeTempBlockIDRegistryForTest(t, path)
+	crypto := tempBlockIDRecordingCrypto{MakeCryptoCommon(r.codec), r}
+	lostID, err := crypto.MakeTemporaryBlockID()
+	require.NoError(t, err)
+	syncedID, err := crypto.MakeTemporaryBlockID()
+	require.NoError(t, err)
+
+	t.Log("Remap one of the IDs, as if it was readied by a sync")
+	finalID := kbfsblock.FakeID(1)
+	bps := newBlockPutState(1)
+	bps.addNewBlock(BlockPointer{ID: finalID}, nil, ReadyBlockData{}, nil)
+	bps.saveOldPtr(BlockPointer{ID: syncedID})
+	r.remap(bps)
+
+	t.Log("A crash now leaves both behind")
+	r2 := makeTempBlockIDRegistryForTest(t, path)
+	recovery, err := r2.recover()
+	require.NoError(t, err)
+	require.Equal(t, []kbfsblock.ID{lostID}, recovery.lost)
+	require.Equal(t, []kbfsblock.ID{finalID}, recovery.unreferenced)
+
+	t.Log("Committing forgets the remapped ID")
+	r.commit(false)
+	recovery, err = r2.recover()
+	require.NoError(t, err)
+	require.Equal(t, []kbfsblock.ID{lostID}, recovery.lost)
+	require.Len(t, recovery.unreferenced, 0)
+
+	t.Log("Committing while clean forgets everything")
+	r.commit(true)
+	_, err = ioutil.Stat(path)
+	require.True(t, ioutil.IsNotExist(err))
+	recovery, err = r2.recover()
+	require.NoError(t, err)
+	require.Len(t, recovery.lost, 0)
+	require.Len(t, recovery.unreferenced, 0)
+}
+
+func TestTempBlockIDRegistryNil(t *testing.T) {
+	var r *tempBlockIDRegistry
+	r.add(kbfsblock.FakeID(1))
+	r.remap(newBlockPutState(0))
+	r.commit(true)
+}
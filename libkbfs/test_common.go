@@ -52,7 +52,7 @@ func newConfigForTest(mode InitMode,
 	config.SetBlockOps(bops)
 
 	config.SetBlockSplitter(&BlockSplitterSimple{
-		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024})
+		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024, 0})
 
 	return config
 }
@@ -241,9 +241,14 @@ func configAsUserWithMode(config *ConfigLocal,
 	c.SetClock(config.Clock())
 
 	daemon := config.KeybaseService().(*KeybaseDaemonLocal)
-	loggedInUID, ok := daemon.asserts[string(loggedInUser)]
-	if !ok {
-		panic("bad test: unknown user: " + loggedInUser)
+	// An empty user name means no one is logged in.
+	var loggedInUID keybase1.UID
+	if loggedInUser != "" {
+		id, ok := daemon.asserts[string(loggedInUser)]
+		if !ok {
+			panic("bad test: unknown user: " + loggedInUser)
+		}
+		loggedInUID = id.AsUserOrBust()
 	}
 
 	var localUsers []LocalUser
@@ -251,7 +256,7 @@ func configAsUserWithMode(config *ConfigLocal,
 		localUsers = append(localUsers, u)
 	}
 	newDaemon := NewKeybaseDaemonMemory(
-		loggedInUID.AsUserOrBust(), localUsers, nil, c.Codec())
+		loggedInUID, localUsers, nil, c.Codec())
 	c.SetKeybaseService(newDaemon)
 	c.SetKBPKI(NewKBPKIClient(c, c.MakeLogger("")))
 
@@ -319,6 +324,13 @@ func ConfigAsUser(config *ConfigLocal,
 	return configAsUserWithMode(config, loggedInUser, config.Mode())
 }
 
+// ConfigAsAnonymous clones a test configuration in the same init
+// mode, but with no logged-in user.  The returned Config can read
+// public TLFs, but nothing else.
+func ConfigAsAnonymous(config *ConfigLocal) *ConfigLocal {
+	return configAsUserWithMode(config, "", config.Mode())
+}
+
 // NewEmptyTLFWriterKeyBundle creates a new empty kbfsmd.TLFWriterKeyBundleV2
 func NewEmptyTLFWriterKeyBundle() kbfsmd.TLFWriterKeyBundleV2 {
 	return kbfsmd.TLFWriterKeyBundleV2{
@@ -409,6 +421,33 @@ func SwitchDeviceForLocalUserOrBust(t logger.TestLogBackend, config Config, inde
 		NewCryptoLocal(config.Codec(), signingKey, cryptPrivateKey))
 }
 
+// ConfigAsUserOnNewDeviceOrBust clones a test configuration like
+// ConfigAsUser, but logs `loggedInUser` in on a brand new device.
+// The new device is added for `loggedInUser` in every config cloned
+// from the same original test config, so they all know its keys.
+// The new device won't be able to read existing TLFs until one of the
+// user's other devices rekeys them.
+func ConfigAsUserOnNewDeviceOrBust(t logger.TestLogBackend,
+	config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *ConfigLocal {
+	c := ConfigAsUser(config, loggedInUser)
+	session, err := c.KBPKI().GetCurrentSession(context.Background())
+	if err != nil {
+		t.Fatalf("Couldn't get UID: %+v", err)
+	}
+
+	index := -1
+	for _, other := range *c.allKnownConfigsForTesting {
+		i := AddDeviceForLocalUserOrBust(t, other, session.UID)
+		if index >= 0 && i != index {
+			t.Fatalf("Inconsistent device indices for %s: %d vs %d",
+				loggedInUser, index, i)
+		}
+		index = i
+	}
+	SwitchDeviceForLocalUserOrBust(t, c, index)
+	return c
+}
+
 // AddNewAssertionForTest makes newAssertion, which should be a single
 // assertion that doesn't already resolve to anything, resolve to the
 // same UID as oldAssertion, which should be an arbitrary assertion
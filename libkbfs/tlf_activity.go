@@ -0,0 +1,357 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/kbfssync"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+const (
+	// tlfActivityDigestPeriod is how long a TLF collects changes
+	// before handing them to the ActivityNotifier as one digest.
+	tlfActivityDigestPeriod = 1 * time.Minute
+	// maxTlfActivitiesPerWriter limits how many changes by a single
+	// writer go into one digest; the rest are only counted.
+	maxTlfActivitiesPerWriter = 100
+)
+
+// TlfActivityType indicates what kind of change was made to an entry
+// in a TLF.
+type TlfActivityType int
+
+const (
+	// TlfActivityCreated indicates a new file, directory or symlink.
+	TlfActivityCreated TlfActivityType = iota
+	// TlfActivityModified indicates an existing entry whose contents
+	// or attributes changed.
+	TlfActivityModified
+	// TlfActivityRemoved indicates a removed entry.
+	TlfActivityRemoved
+	// TlfActivityRenamed indicates an entry that was moved.
+	TlfActivityRenamed
+)
+
+func (t TlfActivityType) String() string {
+	switch t {
+	case TlfActivityCreated:
+		return "created"
+	case TlfActivityModified:
+		return "modified"
+	case TlfActivityRemoved:
+		return "removed"
+	case TlfActivityRenamed:
+		return "renamed"
+	default:
+		return fmt.Sprintf("TlfActivityType(%d)", int(t))
+	}
+}
+
+// TlfActivity is a single change within a TlfActivityDigest.
+type TlfActivity struct {
+	Type TlfActivityType
+	// Path is the changed entry, starting with the TLF name.  For
+	// renames, it's the old location of the entry.
+	Path string
+	// NewPath is the new location of a renamed entry.
+	NewPath string `json:",omitempty"`
+}
+
+// TlfActivityDigest summarizes the changes made to a TLF over one
+// digest period, grouped by writer.
+type TlfActivityDigest struct {
+	Tlf     tlf.CanonicalName
+	TlfType tlf.Type
+	// FirstRevision and LastRevision bound the MD revisions covered
+	// by this digest.
+	FirstRevision kbfsmd.Revision
+	LastRevision  kbfsmd.Revision
+	// Changes lists each writer's changes, oldest first.  Repeated
+	// changes to the same entry are only listed once.
+	Changes map[libkb.NormalizedUsername][]TlfActivity
+	// Dropped counts the changes that were left out because a writer
+	// made too many of them in one period.
+	Dropped int
+}
+
+type tlfActivityKey struct {
+	t    TlfActivityType
+	path string
+}
+
+// tlfWriterActivity is the pending activity of a single writer.
+type tlfWriterActivity struct {
+	changes []TlfActivity
+	seen    map[tlfActivityKey]bool
+}
+
+func (twa *tlfWriterActivity) add(a TlfActivity) (dropped bool) {
+	// A write to a new entry is part of its creation.
+	if a.Type == TlfActivityModified &&
+		twa.seen[tlfActivityKey{TlfActivityCreated, a.Path}] {
+		return false
+	}
+	key := tlfActivityKey{a.Type, a.Path}
+	if a.Type != TlfActivityRenamed && twa.seen[key] {
+		return false
+	}
+	if len(twa.changes) >= maxTlfActivitiesPerWriter {
+		return true
+	}
+	twa.seen[key] = true
+	twa.changes = append(twa.changes, a)
+	return false
+}
+
+// tlfActivityDigester collects the changes applied to a TLF, and
+// periodically sends a digest of them to the configured
+// ActivityNotifier, so that busy folders don't turn into a flood of
+// notifications.
+type tlfActivityDigester struct {
+	config Config
+	fbo    *folderBranchOps
+	log    logger.Logger
+	period time.Duration
+	sends  kbfssync.RepeatedWaitGroup
+
+	lock          sync.Mutex
+	handle        *TlfHandle
+	firstRevision kbfsmd.Revision
+	lastRevision  kbfsmd.Revision
+	byWriter      map[keybase1.UID]*tlfWriterActivity
+	dropped       int
+	timer         *time.Timer
+	shutdown      bool
+}
+
+func newTlfActivityDigester(
+	config Config, fbo *folderBranchOps,
+	log logger.Logger) *tlfActivityDigester {
+	return &tlfActivityDigester{
+		config: config,
+		fbo:    fbo,
+		log:    log,
+		period: tlfActivityDigestPeriod,
+	}
+}
+
+// pathForPtr looks up the path of the node for `ptr` in the node
+// cache.
+func (tad *tlfActivityDigester) pathForPtr(ptr BlockPointer) (path, bool) {
+	n := tad.fbo.nodeCache.Get(ptr.Ref())
+	if n == nil {
+		return path{}, false
+	}
+	p := tad.fbo.nodeCache.PathFromNode(n)
+	return p, p.isValid()
+}
+
+// pathForOp returns the path of the directory or file touched by an
+// op.  Locally-made ops carry their final path; for the others, it's
+// looked up in the node cache using `ptr`, the op's updated pointer
+// for that directory or file.
+func (tad *tlfActivityDigester) pathForOp(
+	op op, ptr BlockPointer) (path, bool) {
+	if p := op.getFinalPath(); p.isValid() {
+		return p, true
+	}
+	return tad.pathForPtr(ptr)
+}
+
+func (tad *tlfActivityDigester) activityForOp(op op) (TlfActivity, bool) {
+	switch realOp := op.(type) {
+	case *createOp:
+		if realOp.renamed {
+			return TlfActivity{}, false
+		}
+		dir, ok := tad.pathForOp(op, realOp.Dir.Ref)
+		if !ok {
+			return TlfActivity{}, false
+		}
+		return TlfActivity{
+			Type: TlfActivityCreated,
+			Path: dir.ChildPathNoPtr(realOp.NewName).String(),
+		}, true
+	case *rmOp:
+		dir, ok := tad.pathForOp(op, realOp.Dir.Ref)
+		if !ok {
+			return TlfActivity{}, false
+		}
+		return TlfActivity{
+			Type: TlfActivityRemoved,
+			Path: dir.ChildPathNoPtr(realOp.OldName).String(),
+		}, true
+	case *renameOp:
+		oldDir, ok := tad.pathForPtr(realOp.OldDir.Ref)
+		if !ok {
+			return TlfActivity{}, false
+		}
+		newDir := oldDir
+		if realOp.NewDir != (blockUpdate{}) {
+			newDir, ok = tad.pathForPtr(realOp.NewDir.Ref)
+			if !ok {
+				return TlfActivity{}, false
+			}
+		}
+		return TlfActivity{
+			Type:    TlfActivityRenamed,
+			Path:    oldDir.ChildPathNoPtr(realOp.OldName).String(),
+			NewPath: newDir.ChildPathNoPtr(realOp.NewName).String(),
+		}, true
+	case *syncOp:
+		file, ok := tad.pathForOp(op, realOp.File.Ref)
+		if !ok {
+			return TlfActivity{}, false
+		}
+		return TlfActivity{
+			Type: TlfActivityModified,
+			Path: file.String(),
+		}, true
+	case *setAttrOp:
+		if p := op.getFinalPath(); p.isValid() {
+			return TlfActivity{Type: TlfActivityModified, Path: p.String()}, true
+		}
+		dir, ok := tad.pathForOp(op, realOp.Dir.Ref)
+		if !ok {
+			return TlfActivity{}, false
+		}
+		return TlfActivity{
+			Type: TlfActivityModified,
+			Path: dir.ChildPathNoPtr(realOp.Name).String(),
+		}, true
+	default:
+		return TlfActivity{}, false
+	}
+}
+
+// add records the change made by `op`, part of the MD update `md`.
+// It must be called right after the op's pointers have been applied
+// to the node cache, and before those of any later op are.  The
+// caller must hold `fbo.headLock`.
+func (tad *tlfActivityDigester) add(md ReadOnlyRootMetadata, op op) {
+	if tad.config.ActivityNotifier() == nil ||
+		md.IsWriterMetadataCopiedSet() {
+		return
+	}
+	a, ok := tad.activityForOp(op)
+	if !ok {
+		return
+	}
+
+	tad.lock.Lock()
+	defer tad.lock.Unlock()
+	if tad.shutdown {
+		return
+	}
+	if tad.byWriter == nil {
+		tad.byWriter = make(map[keybase1.UID]*tlfWriterActivity)
+		tad.firstRevision = md.Revision()
+	}
+	writer := md.LastModifyingWriter()
+	twa, ok := tad.byWriter[writer]
+	if !ok {
+		twa = &tlfWriterActivity{seen: make(map[tlfActivityKey]bool)}
+		tad.byWriter[writer] = twa
+	}
+	if twa.add(a) {
+		tad.dropped++
+	}
+	tad.handle = md.GetTlfHandle()
+	tad.lastRevision = md.Revision()
+
+	if tad.timer == nil {
+		tad.sends.Add(1)
+		tad.timer = time.AfterFunc(tad.period, tad.send)
+	}
+}
+
+// send hands the pending changes to the ActivityNotifier.
+func (tad *tlfActivityDigester) send() {
+	defer tad.sends.Done()
+
+	tad.lock.Lock()
+	byWriter := tad.byWriter
+	handle := tad.handle
+	digest := TlfActivityDigest{
+		FirstRevision: tad.firstRevision,
+		LastRevision:  tad.lastRevision,
+		Dropped:       tad.dropped,
+	}
+	tad.byWriter = nil
+	tad.dropped = 0
+	tad.timer = nil
+	shutdown := tad.shutdown
+	tad.lock.Unlock()
+	if shutdown || byWriter == nil {
+		return
+	}
+
+	notifier := tad.config.ActivityNotifier()
+	if notifier == nil {
+		return
+	}
+
+	ctx, cancel := tad.fbo.newCtxWithFBOID()
+	defer cancel()
+	digest.Tlf = handle.GetCanonicalName()
+	digest.TlfType = handle.Type()
+	digest.Changes = make(
+		map[libkb.NormalizedUsername][]TlfActivity, len(byWriter))
+	for uid, twa := range byWriter {
+		name, err := tad.config.KBPKI().GetNormalizedUsername(
+			ctx, uid.AsUserOrTeam())
+		if err != nil {
+			tad.log.CDebugf(ctx, "Couldn't get the username for %s: %+v",
+				uid, err)
+			name = libkb.NormalizedUsername(uid.String())
+		}
+		digest.Changes[name] = append(digest.Changes[name], twa.changes...)
+	}
+
+	tad.log.CDebugf(ctx, "Sending a TLF activity digest for revisions "+
+		"%d through %d", digest.FirstRevision, digest.LastRevision)
+	err := notifier.NotifyTlfActivity(ctx, digest)
+	if err != nil {
+		tad.log.CDebugf(ctx, "Couldn't send the TLF activity digest: %+v",
+			err)
+	}
+}
+
+// Wait returns once all the digests scheduled so far have been sent.
+func (tad *tlfActivityDigester) Wait(ctx context.Context) error {
+	return tad.sends.Wait(ctx)
+}
+
+// flush sends any pending changes right away, rather than at the
+// end of the current digest period.
+func (tad *tlfActivityDigester) flush(ctx context.Context) error {
+	tad.lock.Lock()
+	if tad.timer != nil && tad.timer.Stop() {
+		go tad.send()
+	}
+	tad.lock.Unlock()
+	return tad.Wait(ctx)
+}
+
+// Shutdown drops any pending changes and stops sending digests.
+func (tad *tlfActivityDigester) Shutdown() {
+	tad.lock.Lock()
+	defer tad.lock.Unlock()
+	tad.shutdown = true
+	if tad.timer != nil && tad.timer.Stop() {
+		tad.sends.Done()
+	}
+	tad.timer = nil
+	tad.byWriter = nil
+}
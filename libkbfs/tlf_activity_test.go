@@ -0,0 +1,145 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testActivityNotifier struct {
+	digests chan TlfActivityDigest
+}
+
+func newTestActivityNotifier() *testActivityNotifier {
+	return &testActivityNotifier{make(chan TlfActivityDigest, 10)}
+}
+
+func (tan *testActivityNotifier) NotifyTlfActivity(
+	_ context.Context, digest TlfActivityDigest) error {
+	tan.digests <- digest
+	return nil
+}
+
+func (tan *testActivityNotifier) getDigest(
+	ctx context.Context, t *testing.T) TlfActivityDigest {
+	select {
+	case digest := <-tan.digests:
+		return digest
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+		return TlfActivityDigest{}
+	}
+}
+
+func TestTlfActivityDigest(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	notifier := newTestActivityNotifier()
+	config1.SetActivityNotifier(notifier)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	ops1.activity.period = time.Hour
+
+	t.Log("User 1 creates and writes a file, and makes a directory")
+	kbfsOps1 := config1.KBFSOps()
+	fileNode, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("User 2 creates a file and renames it")
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.SyncFromServerForTesting(
+		ctx, rootNode2.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.Rename(ctx, rootNode2, "b", rootNode2, "c")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("User 1 gets one digest covering all of it")
+	err = kbfsOps1.SyncFromServerForTesting(
+		ctx, rootNode1.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	err = ops1.activity.flush(ctx)
+	require.NoError(t, err)
+	digest := notifier.getDigest(ctx, t)
+	require.Equal(t, tlf.CanonicalName(name), digest.Tlf)
+	require.Equal(t, tlf.Private, digest.TlfType)
+	require.Equal(t, 0, digest.Dropped)
+	require.Len(t, digest.Changes, 2)
+	require.Len(t, digest.Changes[userName1], 2)
+	require.Contains(t, digest.Changes[userName1], TlfActivity{
+		Type: TlfActivityCreated,
+		Path: name + "/a",
+	})
+	require.Contains(t, digest.Changes[userName1], TlfActivity{
+		Type: TlfActivityCreated,
+		Path: name + "/d",
+	})
+	require.Equal(t, []TlfActivity{{
+		Type: TlfActivityCreated,
+		Path: name + "/b",
+	}, {
+		Type:    TlfActivityRenamed,
+		Path:    name + "/b",
+		NewPath: name + "/c",
+	}}, digest.Changes[userName2])
+
+	t.Log("The next change is sent once the digest period is over")
+	ops1.activity.period = time.Millisecond
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "c")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	err = ops1.activity.Wait(ctx)
+	require.NoError(t, err)
+	digest = notifier.getDigest(ctx, t)
+	require.Equal(t, map[libkb.NormalizedUsername][]TlfActivity{
+		userName1: {{Type: TlfActivityRemoved, Path: name + "/c"}},
+	}, digest.Changes)
+}
+
+func TestTlfWriterActivityLimit(t *testing.T) {
+	twa := &tlfWriterActivity{seen: make(map[tlfActivityKey]bool)}
+	for i := 0; i < maxTlfActivitiesPerWriter; i++ {
+		p := fmt.Sprintf("tlf/%d", i)
+		require.False(t, twa.add(
+			TlfActivity{Type: TlfActivityCreated, Path: p}))
+		// Repeats of the same change, and writes to the new file,
+		// don't count against the limit.
+		require.False(t, twa.add(
+			TlfActivity{Type: TlfActivityCreated, Path: p}))
+		require.False(t, twa.add(
+			TlfActivity{Type: TlfActivityModified, Path: p}))
+	}
+	require.Len(t, twa.changes, maxTlfActivitiesPerWriter)
+	require.True(t, twa.add(
+		TlfActivity{Type: TlfActivityRemoved, Path: "tlf/0"}))
+	require.Len(t, twa.changes, maxTlfActivitiesPerWriter)
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"golang.org/x/net/context"
+)
+
+// TlfBlocksDebugDump describes the unsynced local state of a
+// folder-branch.
+type TlfBlocksDebugDump struct {
+	DirtyFiles []string
+	DirtyDirs  []string
+	// DeferredWrites is the number of deferred writes for each file
+	// being synced, keyed by its block ref.
+	DeferredWrites     map[string]int
+	DirEntryCacheSize  int
+	UnrefCacheSize     int
+	DirtyBlockCacheAny bool
+}
+
+// TlfCacheDebugDump describes the global block cache, as seen by a
+// folder-branch.
+type TlfCacheDebugDump struct {
+	CleanBytesCapacity uint64
+	CleanBytes         uint64 `json:",omitempty"`
+}
+
+// TlfCRDebugDump describes the state of a folder-branch's conflict
+// resolver.
+type TlfCRDebugDump struct {
+	UnmergedRevision kbfsmd.Revision
+	MergedRevision   kbfsmd.Revision
+	NumStarted       int
+	CanceledCount    int
+	LastLocalWrite   time.Time
+	ForceNext        bool
+}
+
+// TlfDebugDump is everything a folder-branch knows about itself that
+// is useful in a bug report.  It only includes state that's safe to
+// share: no keys, key halves, or block contents are gathered.
+type TlfDebugDump struct {
+	Time      time.Time
+	Tlf       string
+	Branch    BranchName
+	Status    FolderBranchStatus
+	Blocks    TlfBlocksDebugDump
+	Cache     TlfCacheDebugDump
+	CR        TlfCRDebugDump
+	LockWaits map[string]LockWaitStatsSnapshot
+	// RecentLogs are the most recent log lines of the folder-branch
+	// and its conflict resolver, oldest first.
+	RecentLogs []string
+}
+
+func (fbo *folderBlockOps) getDebugDump(lState *lockState) TlfBlocksDebugDump {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dump := TlfBlocksDebugDump{
+		DeferredWrites:     make(map[string]int, len(fbo.deferred)),
+		UnrefCacheSize:     len(fbo.unrefCache),
+		DirtyBlockCacheAny: fbo.config.DirtyBlockCache().IsAnyDirty(fbo.id()),
+	}
+	fbo.deCache.forEach(func(ref BlockRef, de deCacheEntry) {
+		dump.DirEntryCacheSize++
+		if _, ok := fbo.unrefCache[ref]; ok {
+			dump.DirtyFiles = append(dump.DirtyFiles, ref.String())
+		} else if de.hasDirChanges() {
+			dump.DirtyDirs = append(dump.DirtyDirs, ref.String())
+		}
+	})
+	for ref, ds := range fbo.deferred {
+		dump.DeferredWrites[ref.String()] = len(ds.writes)
+	}
+	return dump
+}
+
+func (cr *ConflictResolver) getDebugDump() TlfCRDebugDump {
+	cr.inputLock.Lock()
+	defer cr.inputLock.Unlock()
+	return TlfCRDebugDump{
+		UnmergedRevision: cr.currInput.unmerged,
+		MergedRevision:   cr.currInput.merged,
+		NumStarted:       cr.numStarted,
+		CanceledCount:    cr.canceledCount,
+		LastLocalWrite:   cr.lastLocalWrite,
+		ForceNext:        cr.forceNext,
+	}
+}
+
+// DebugDump implements the KBFSOps interface for folderBranchOps.  It
+// doesn't take mdWriterLock, so that it can be used while a
+// folder-branch is stuck behind a long-running write.
+func (fbo *folderBranchOps) DebugDump(
+	ctx context.Context, folderBranch FolderBranch) (data []byte, err error) {
+	fbo.log.CDebugf(ctx, "DebugDump")
+	defer func() { fbo.deferLog.CDebugf(ctx, "DebugDump done: %+v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	status, _, err := fbo.FolderStatus(ctx, folderBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	lState := makeFBOLockState()
+	dump := TlfDebugDump{
+		Time:   fbo.config.Clock().Now(),
+		Tlf:    fbo.id().String(),
+		Branch: fbo.branch(),
+		Status: status,
+		Blocks: fbo.blocks.getDebugDump(lState),
+		Cache: TlfCacheDebugDump{
+			CleanBytesCapacity: fbo.config.BlockCache().GetCleanBytesCapacity(),
+		},
+		CR: fbo.cr.getDebugDump(),
+		LockWaits: map[string]LockWaitStatsSnapshot{
+			"mdWriterLock": fbo.mdWriterLockWaits.snapshot(),
+			"headLock":     fbo.headLockWaits.snapshot(),
+			"blockLock":    fbo.blockLockWaits.snapshot(),
+		},
+	}
+	if bcache, ok := fbo.config.BlockCache().(*BlockCacheStandard); ok {
+		bcache.bytesLock.Lock()
+		dump.Cache.CleanBytes = bcache.cleanTotalBytes
+		bcache.bytesLock.Unlock()
+	}
+	dump.RecentLogs = fbo.recentLogs.get()
+	return json.MarshalIndent(dump, "", "  ")
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentLogLines(t *testing.T) {
+	const maxBytes = 200
+	r := newRecentLogLines(maxBytes)
+	require.Len(t, r.get(), 0)
+	for i := 0; i < 100; i++ {
+		r.add("DEBU", "line %d", i)
+	}
+	lines := r.get()
+	require.NotEmpty(t, lines)
+	require.True(t, len(lines) < 100)
+	total := 0
+	for _, line := range lines {
+		total += len(line)
+	}
+	require.True(t, total <= maxBytes)
+	require.Contains(t, lines[len(lines)-1], "line 99")
+	for i, line := range lines {
+		require.Contains(t, line, fmt.Sprintf("line %d", 100-len(lines)+i))
+	}
+
+	require.Nil(t, newRecentLogLines(0))
+	var nilLines *recentLogLines
+	nilLines.add("DEBU", "line")
+	require.Len(t, nilLines.get(), 0)
+}
+
+func TestLockWaitStats(t *testing.T) {
+	stats := &lockWaitStats{}
+	rw := &waitTimedRWMutex{stats: stats}
+	rw.Lock()
+	rw.Unlock()
+	rw.RLocker().Lock()
+	rw.RLocker().Unlock()
+	require.Equal(t, int64(2), stats.snapshot().Acquisitions)
+}
+
+func TestKBFSOpsDebugDump(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	kbfsOps := config.KBFSOps()
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	data, err := kbfsOps.DebugDump(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	var dump TlfDebugDump
+	err = json.Unmarshal(data, &dump)
+	require.NoError(t, err)
+	require.Equal(t, rootNode.GetFolderBranch().Tlf.String(), dump.Tlf)
+	require.Len(t, dump.Blocks.DirtyFiles, 1)
+	require.True(t, dump.Blocks.DirtyBlockCacheAny)
+	require.NotZero(t, dump.LockWaits["mdWriterLock"].Acquisitions)
+	require.NotEmpty(t, dump.RecentLogs)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	data, err = kbfsOps.DebugDump(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	dump = TlfDebugDump{}
+	err = json.Unmarshal(data, &dump)
+	require.NoError(t, err)
+	require.Len(t, dump.Blocks.DirtyFiles, 0)
+	require.Len(t, dump.Blocks.DirtyDirs, 0)
+}
@@ -46,6 +46,7 @@ type tlfJournalConfig interface {
 	diskLimitTimeout() time.Duration
 	teamMembershipChecker() kbfsmd.TeamMembershipChecker
 	BGFlushDirOpBatchSize() int
+	HideOpDeviceInfo() bool
 	tlfIDGetter() tlfIDGetter
 }
 
@@ -346,7 +347,8 @@ func makeTLFJournal(
 	config tlfJournalConfig, delegateBlockServer BlockServer,
 	bws TLFJournalBackgroundWorkStatus, bwDelegate tlfJournalBWDelegate,
 	onBranchChange branchChangeListener, onMDFlush mdFlushListener,
-	diskLimiter DiskLimiter) (*tlfJournal, error) {
+	diskLimiter DiskLimiter, crypter *localStorageCrypter) (
+	*tlfJournal, error) {
 	if uid == keybase1.UID("") {
 		return nil, errors.New("Empty user")
 	}
@@ -403,7 +405,8 @@ func makeTLFJournal(
 
 	log := config.MakeLogger("TLFJ")
 
-	blockJournal, err := makeBlockJournal(ctx, config.Codec(), dir, log)
+	blockJournal, err := makeBlockJournal(
+		ctx, config.Codec(), dir, log, crypter)
 	if err != nil {
 		return nil, err
 	}
@@ -411,7 +414,7 @@ func makeTLFJournal(
 	mdJournal, err := makeMDJournal(
 		ctx, uid, key, config.Codec(), config.Crypto(), config.Clock(),
 		config.teamMembershipChecker(), tlfID, config.MetadataVersion(), dir,
-		log)
+		crypter, log)
 	if err != nil {
 		return nil, err
 	}
@@ -2168,6 +2171,8 @@ func (j *tlfJournal) doPutMD(ctx context.Context, rmd *RootMetadata,
 	// TODO: remove the revision from the cache on any errors below?
 	// Tricky when the append is only queued.
 
+	addOpDeviceInfo(
+		&rmd.data.Changes, verifyingKey, j.config.HideOpDeviceInfo())
 	mdID, err := j.mdJournal.put(ctx, j.config.Crypto(),
 		j.config.encryptionKeyGetter(), j.config.BlockSplitter(),
 		rmd, isFirstRev)
@@ -2309,6 +2314,8 @@ func (j *tlfJournal) doResolveBranch(ctx context.Context,
 
 	// First write the resolution to a new branch, and swap it with
 	// the existing branch, then clear the existing branch.
+	addOpDeviceInfo(
+		&rmd.data.Changes, verifyingKey, j.config.HideOpDeviceInfo())
 	mdID, err := j.mdJournal.resolveAndClear(
 		ctx, j.config.Crypto(), j.config.encryptionKeyGetter(),
 		j.config.BlockSplitter(), j.config.MDCache(), bid, rmd)
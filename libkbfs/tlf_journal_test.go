@@ -164,6 +164,10 @@ func (c testTLFJournalConfig) BGFlushDirOpBatchSize() int {
 	return 1
 }
 
+func (c testTLFJournalConfig) HideOpDeviceInfo() bool {
+	return false
+}
+
 func (c testTLFJournalConfig) makeBlock(data []byte) (
 	kbfsblock.ID, kbfsblock.Context, kbfscrypto.BlockCryptKeyServerHalf) {
 	id, err := kbfsblock.MakePermanentID(data)
@@ -219,7 +223,7 @@ func setupTLFJournalTest(
 	delegate testBWDelegate) {
 	// Set up config and dependencies.
 	bsplitter := &BlockSplitterSimple{
-		64 * 1024, int(64 * 1024 / bpSize), 8 * 1024}
+		64 * 1024, int(64 * 1024 / bpSize), 8 * 1024, 0}
 	codec := kbfscodec.NewMsgpack()
 	signingKey := kbfscrypto.MakeFakeSigningKeyOrBust("client sign")
 	cryptPrivateKey := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("client crypt private")
@@ -282,7 +286,9 @@ func setupTLFJournalTest(
 		math.MaxInt64, math.MaxInt64, math.MaxInt64)
 	tlfJournal, err = makeTLFJournal(ctx, uid, verifyingKey,
 		tempdir, config.tlfID, uid.AsUserOrTeam(), config, delegateBlockServer,
-		bwStatus, delegate, nil, nil, diskLimitSemaphore)
+		bwStatus, delegate, nil, nil, diskLimitSemaphore,
+		makeLocalStorageCrypter(
+			kbfscrypto.MakeLocalStorageKey([32]byte{0x1})))
 	require.NoError(t, err)
 
 	switch bwStatus {
@@ -0,0 +1,268 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+const (
+	// tlfOpStatsDir is the directory, under the storage root, where
+	// each TLF's operation statistics are kept.
+	tlfOpStatsDir = "kbfs_tlf_stats"
+	// tlfOpStatsVersion is the version of the statistics file
+	// format.  Files of any other version are ignored.
+	tlfOpStatsVersion = 1
+	// tlfOpStatsMaxDays is how many daily rollups are kept per TLF.
+	tlfOpStatsMaxDays = 90
+	// tlfOpStatsSaveDelay is how long newly-counted operations may
+	// go unsaved, so that busy TLFs don't write the file on every
+	// operation.
+	tlfOpStatsSaveDelay = 1 * time.Minute
+)
+
+// TlfOpCounts counts the operations made on a TLF through this
+// device.
+type TlfOpCounts struct {
+	Reads      uint64
+	Writes     uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+	// FilesTouched is the number of distinct files read or written.
+	// In a total over several days, a file touched on more than one
+	// day is counted once per day.
+	FilesTouched uint64
+}
+
+// TlfOpStatsDay is one day's rollup of TlfOpCounts.
+type TlfOpStatsDay struct {
+	// Day is midnight UTC at the start of the day.
+	Day time.Time
+	TlfOpCounts
+}
+
+// TlfOpStats describes how much a TLF has been used through this
+// device, as returned by KBFSOps.GetTlfOpStats.
+type TlfOpStats struct {
+	// Since is when counting started, or zero if the TLF has never
+	// been used through this device.
+	Since time.Time
+	// LastOp is the time of the most recent operation.
+	LastOp time.Time
+	// Total counts every operation since `Since`.
+	Total TlfOpCounts
+	// Days holds the daily rollups for (at most) the last
+	// tlfOpStatsMaxDays days with any operations, oldest first.
+	Days []TlfOpStatsDay
+}
+
+type tlfOpStatsFile struct {
+	Version int
+	Stats   TlfOpStats
+	// TodayFiles holds hashes of the files touched during the last
+	// day in `Stats.Days`, so they aren't counted again after a
+	// restart.
+	TodayFiles []uint64 `codec:",omitempty"`
+}
+
+func tlfOpStatsPath(storageRoot string, id tlf.ID) string {
+	if storageRoot == "" {
+		return ""
+	}
+	return filepath.Join(storageRoot, tlfOpStatsDir, id.String())
+}
+
+// loadTlfOpStats reads the statistics stored at `path`, returning
+// empty statistics if there aren't any.
+func loadTlfOpStats(codec kbfscodec.Codec, path string) (
+	tlfOpStatsFile, error) {
+	if path == "" {
+		return tlfOpStatsFile{}, nil
+	}
+	var file tlfOpStatsFile
+	err := kbfscodec.DeserializeFromFile(codec, path, &file)
+	if ioutil.IsNotExist(err) {
+		return tlfOpStatsFile{}, nil
+	} else if err != nil {
+		return tlfOpStatsFile{}, err
+	}
+	if file.Version != tlfOpStatsVersion {
+		return tlfOpStatsFile{}, nil
+	}
+	return file, nil
+}
+
+// tlfOpStats counts the reads and writes made on a TLF's master
+// branch, rolled up by day, and persists them under the storage
+// root so they accumulate across restarts.
+//
+// A nil *tlfOpStats ignores everything, which is what non-master
+// folder-branches use.
+type tlfOpStats struct {
+	codec kbfscodec.Codec
+	clock Clock
+	log   logger.Logger
+	// path is where the statistics are persisted, or empty if
+	// they're only kept in memory.
+	path string
+
+	lock       sync.Mutex
+	stats      TlfOpStats
+	todayFiles map[uint64]bool
+	saveTimer  *time.Timer
+	shutdown   bool
+}
+
+func newTlfOpStats(
+	config Config, fb FolderBranch, log logger.Logger) *tlfOpStats {
+	if fb.Branch != MasterBranch {
+		return nil
+	}
+	s := &tlfOpStats{
+		codec:      config.Codec(),
+		clock:      config.Clock(),
+		log:        log,
+		path:       tlfOpStatsPath(config.StorageRoot(), fb.Tlf),
+		todayFiles: make(map[uint64]bool),
+	}
+	file, err := loadTlfOpStats(s.codec, s.path)
+	if err != nil {
+		log.CDebugf(nil, "Couldn't read TLF op stats: %+v", err)
+		return s
+	}
+	s.stats = file.Stats
+	for _, h := range file.TodayFiles {
+		s.todayFiles[h] = true
+	}
+	return s
+}
+
+// todayLocked returns the rollup for the day containing `now`,
+// starting a new one if needed.
+func (s *tlfOpStats) todayLocked(now time.Time) *TlfOpStatsDay {
+	day := now.UTC().Truncate(24 * time.Hour)
+	if n := len(s.stats.Days); n > 0 && s.stats.Days[n-1].Day.Equal(day) {
+		return &s.stats.Days[n-1]
+	}
+	s.stats.Days = append(s.stats.Days, TlfOpStatsDay{Day: day})
+	if len(s.stats.Days) > tlfOpStatsMaxDays {
+		s.stats.Days = append([]TlfOpStatsDay(nil),
+			s.stats.Days[len(s.stats.Days)-tlfOpStatsMaxDays:]...)
+	}
+	s.todayFiles = make(map[uint64]bool)
+	return &s.stats.Days[len(s.stats.Days)-1]
+}
+
+func (s *tlfOpStats) record(file string, isWrite bool, bytes int64) {
+	if s == nil {
+		return
+	}
+	now := s.clock.Now()
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(file))
+	fileHash := h.Sum64()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shutdown {
+		return
+	}
+	if s.stats.Since.IsZero() {
+		s.stats.Since = now
+	}
+	s.stats.LastOp = now
+	today := s.todayLocked(now)
+	allCounts := []*TlfOpCounts{&s.stats.Total, &today.TlfOpCounts}
+	for _, counts := range allCounts {
+		if isWrite {
+			counts.Writes++
+			counts.WriteBytes += uint64(bytes)
+		} else {
+			counts.Reads++
+			counts.ReadBytes += uint64(bytes)
+		}
+		if !s.todayFiles[fileHash] {
+			counts.FilesTouched++
+		}
+	}
+	s.todayFiles[fileHash] = true
+
+	if s.path != "" && s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(tlfOpStatsSaveDelay, s.save)
+	}
+}
+
+// recordRead counts a read of `bytes` bytes from `file`.
+func (s *tlfOpStats) recordRead(file string, bytes int64) {
+	s.record(file, false, bytes)
+}
+
+// recordWrite counts a write of `bytes` bytes to `file`.
+func (s *tlfOpStats) recordWrite(file string, bytes int64) {
+	s.record(file, true, bytes)
+}
+
+func (s *tlfOpStats) saveLocked() {
+	file := tlfOpStatsFile{
+		Version:    tlfOpStatsVersion,
+		Stats:      s.stats,
+		TodayFiles: make([]uint64, 0, len(s.todayFiles)),
+	}
+	for h := range s.todayFiles {
+		file.TodayFiles = append(file.TodayFiles, h)
+	}
+	err := kbfscodec.SerializeToFile(s.codec, file, s.path)
+	if err != nil {
+		s.log.CDebugf(nil, "Couldn't save TLF op stats: %+v", err)
+	}
+}
+
+func (s *tlfOpStats) save() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shutdown {
+		return
+	}
+	s.saveTimer = nil
+	s.saveLocked()
+}
+
+// get returns a copy of the current statistics.
+func (s *tlfOpStats) get() TlfOpStats {
+	if s == nil {
+		return TlfOpStats{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.stats
+	stats.Days = append([]TlfOpStatsDay(nil), s.stats.Days...)
+	return stats
+}
+
+// Shutdown saves any unsaved statistics, and stops counting.
+func (s *tlfOpStats) Shutdown() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shutdown {
+		return
+	}
+	s.shutdown = true
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+		s.saveTimer = nil
+		s.saveLocked()
+	}
+}
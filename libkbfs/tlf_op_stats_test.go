@@ -0,0 +1,103 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTlfOpStatsForTest(
+	t *testing.T, clock Clock, path string) *tlfOpStats {
+	s := &tlfOpStats{
+		codec:      kbfscodec.NewMsgpack(),
+		clock:      clock,
+		log:        logger.NewTestLogger(t),
+		path:       path,
+		todayFiles: make(map[uint64]bool),
+	}
+	file, err := loadTlfOpStats(s.codec, path)
+	require.NoError(t, err)
+	s.stats = file.Stats
+	for _, h := range file.TodayFiles {
+		s.todayFiles[h] = true
+	}
+	return s
+}
+
+func TestTlfOpStatsRollup(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "tlf_op_stats")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+	path := filepath.Join(tempdir, "stats")
+
+	clock := &TestClock{}
+	day1 := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	clock.Set(day1)
+	s := makeTlfOpStatsForTest(t, clock, path)
+	s.recordWrite("/a", 10)
+	s.recordRead("/a", 5)
+	s.recordRead("/b", 7)
+
+	t.Log("Stats survive a restart, including the files touched today")
+	s.Shutdown()
+	s = makeTlfOpStatsForTest(t, clock, path)
+	clock.Add(time.Hour)
+	s.recordRead("/b", 1)
+
+	stats := s.get()
+	require.True(t, day1.Equal(stats.Since))
+	require.True(t, day1.Add(time.Hour).Equal(stats.LastOp))
+	expected := TlfOpCounts{
+		Reads:        3,
+		Writes:       1,
+		ReadBytes:    13,
+		WriteBytes:   10,
+		FilesTouched: 2,
+	}
+	require.Equal(t, expected, stats.Total)
+	require.Len(t, stats.Days, 1)
+	require.Equal(t, expected, stats.Days[0].TlfOpCounts)
+
+	t.Log("A new day starts a new rollup")
+	clock.Add(24 * time.Hour)
+	s.recordRead("/a", 2)
+	stats = s.get()
+	require.Len(t, stats.Days, 2)
+	require.True(t, day1.Add(24*time.Hour).Truncate(24*time.Hour).Equal(
+		stats.Days[1].Day))
+	require.Equal(t, TlfOpCounts{Reads: 1, ReadBytes: 2, FilesTouched: 1},
+		stats.Days[1].TlfOpCounts)
+	require.Equal(t, uint64(3), stats.Total.FilesTouched)
+
+	t.Log("Only the most recent days are kept")
+	for i := 0; i < tlfOpStatsMaxDays; i++ {
+		clock.Add(24 * time.Hour)
+		s.recordWrite("/c", 1)
+	}
+	stats = s.get()
+	require.Len(t, stats.Days, tlfOpStatsMaxDays)
+	require.Equal(t, uint64(4), stats.Total.Reads)
+	s.Shutdown()
+}
+
+func TestTlfOpStatsNil(t *testing.T) {
+	var s *tlfOpStats
+	s.recordRead("/a", 1)
+	s.recordWrite("/a", 1)
+	require.Equal(t, TlfOpStats{}, s.get())
+	s.Shutdown()
+}
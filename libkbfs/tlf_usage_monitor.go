@@ -0,0 +1,304 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// TlfUsageReportName is the name of the file, in the root
+	// directory of a TLF, holding the TLF's latest periodic usage
+	// report.
+	TlfUsageReportName = ".keybase_usage_report.json"
+
+	// tlfUsageGrowthWindowDefault is the growth window used when a
+	// policy doesn't set one.
+	tlfUsageGrowthWindowDefault = 24 * time.Hour
+	// tlfUsageMaxSamples bounds how many usage samples are kept per
+	// TLF to measure growth; samples closer together than
+	// window/tlfUsageMaxSamples are merged.
+	tlfUsageMaxSamples = 256
+	// tlfUsageReportRetryDelay is how long to wait before trying to
+	// write a usage report again, after failing to.
+	tlfUsageReportRetryDelay = 1 * time.Hour
+)
+
+// TlfUsageReport is the JSON content of TlfUsageReportName.
+type TlfUsageReport struct {
+	Tlf        tlf.CanonicalName `json:"tlf"`
+	Time       time.Time         `json:"time"`
+	Revision   kbfsmd.Revision   `json:"revision"`
+	UsageBytes uint64            `json:"usage_bytes"`
+	// The previous report's time, revision and usage, if there was
+	// one, and how much the TLF has grown (or shrunk) since.
+	PrevTime       *time.Time      `json:"prev_time,omitempty"`
+	PrevRevision   kbfsmd.Revision `json:"prev_revision,omitempty"`
+	PrevUsageBytes uint64          `json:"prev_usage_bytes,omitempty"`
+	GrowthBytes    int64           `json:"growth_bytes"`
+}
+
+type tlfUsageSample struct {
+	t     time.Time
+	usage uint64
+}
+
+// tlfUsageMonitor watches the disk usage of a TLF as its head
+// changes, reporting warnings when it grows too fast or past one of
+// the configured marks, and periodically writes a usage report into
+// the TLF.
+type tlfUsageMonitor struct {
+	config Config
+	fbo    *folderBranchOps
+	log    logger.Logger
+
+	lock        sync.Mutex
+	initialized bool
+	handle      *TlfHandle
+	revision    kbfsmd.Revision
+	usage       uint64
+	samples     []tlfUsageSample
+	reportTimer *time.Timer
+	shutdown    bool
+}
+
+func newTlfUsageMonitor(
+	config Config, fbo *folderBranchOps,
+	log logger.Logger) *tlfUsageMonitor {
+	return &tlfUsageMonitor{
+		config: config,
+		fbo:    fbo,
+		log:    log,
+	}
+}
+
+// update checks the usage of `md`, the new merged head of the TLF.
+// The caller must hold `fbo.headLock`.
+func (tum *tlfUsageMonitor) update(
+	ctx context.Context, md ImmutableRootMetadata) {
+	policy := tum.config.TlfUsageAlertPolicy()
+	if !policy.enabled() {
+		return
+	}
+	now := tum.config.Clock().Now()
+	usage := md.DiskUsage()
+
+	tum.lock.Lock()
+	defer tum.lock.Unlock()
+	if tum.shutdown {
+		return
+	}
+	prevUsage := tum.usage
+	tum.handle = md.GetTlfHandle()
+	tum.revision = md.Revision()
+	tum.usage = usage
+	if !tum.initialized {
+		// Only changes seen while the TLF is open count.
+		tum.initialized = true
+		tum.samples = []tlfUsageSample{{now, usage}}
+		if policy.ReportPeriod > 0 {
+			tum.reportTimer = time.AfterFunc(0, tum.checkReport)
+		}
+		return
+	}
+
+	var warnings []error
+	for _, mark := range policy.Marks {
+		if prevUsage < mark && usage >= mark {
+			warnings = append(warnings, TlfUsageMarkWarning{
+				Tlf:        tum.handle.GetCanonicalName(),
+				MarkBytes:  mark,
+				UsageBytes: usage,
+			})
+		}
+	}
+	if policy.GrowthBytes > 0 {
+		if w := tum.addSampleLocked(policy, now, usage); w != nil {
+			warnings = append(warnings, *w)
+		}
+	}
+
+	for _, w := range warnings {
+		tum.log.CWarningf(ctx, "%v", w)
+		tum.config.Reporter().ReportErr(ctx, tum.handle.GetCanonicalName(),
+			tum.handle.Type(), WriteMode, w)
+	}
+}
+
+// addSampleLocked records the usage at time `now`, and returns a
+// warning if the TLF has grown too much over the growth window.
+func (tum *tlfUsageMonitor) addSampleLocked(policy TlfUsageAlertPolicy,
+	now time.Time, usage uint64) *TlfUsageGrowthWarning {
+	window := policy.GrowthWindow
+	// Keep the newest sample from before the window, since it gives
+	// the usage at the start of the window.
+	cutoff := now.Add(-window)
+	i := 0
+	for i+1 < len(tum.samples) && !tum.samples[i+1].t.After(cutoff) {
+		i++
+	}
+	tum.samples = tum.samples[i:]
+
+	start := tum.samples[0].usage
+	if usage > start && usage-start >= policy.GrowthBytes {
+		// Start measuring over, so the same growth isn't reported
+		// again.
+		tum.samples = []tlfUsageSample{{now, usage}}
+		return &TlfUsageGrowthWarning{
+			Tlf:         tum.handle.GetCanonicalName(),
+			GrowthBytes: usage - start,
+			Window:      window,
+			UsageBytes:  usage,
+		}
+	}
+
+	last := len(tum.samples) - 1
+	if last > 0 &&
+		now.Sub(tum.samples[last-1].t) < window/tlfUsageMaxSamples {
+		tum.samples[last] = tlfUsageSample{now, usage}
+	} else {
+		tum.samples = append(tum.samples, tlfUsageSample{now, usage})
+	}
+	return nil
+}
+
+// checkReport writes a new usage report if it's due, and schedules
+// the next check.
+func (tum *tlfUsageMonitor) checkReport() {
+	var next time.Duration
+	err := tum.fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
+		next, err = tum.writeReportIfDue(ctx)
+		return err
+	})
+	if err != nil {
+		tum.log.CDebugf(nil, "Couldn't write the usage report: %+v", err)
+		next = tlfUsageReportRetryDelay
+	}
+
+	tum.lock.Lock()
+	defer tum.lock.Unlock()
+	if tum.shutdown || next <= 0 {
+		tum.reportTimer = nil
+		return
+	}
+	tum.reportTimer = time.AfterFunc(next, tum.checkReport)
+}
+
+// writeReportIfDue writes a new usage report into the root directory
+// of the TLF, unless this user can't write to the TLF or the current
+// report is newer than the report period.  Since the report lives in
+// the TLF, that limits reports to one per period across all of the
+// TLF's writers.  It returns how long to wait before the next
+// report, or 0 if reports are turned off.
+func (tum *tlfUsageMonitor) writeReportIfDue(
+	ctx context.Context) (next time.Duration, err error) {
+	period := tum.config.TlfUsageAlertPolicy().ReportPeriod
+	if period <= 0 {
+		return 0, nil
+	}
+
+	tum.lock.Lock()
+	handle, revision, usage := tum.handle, tum.revision, tum.usage
+	tum.lock.Unlock()
+	if handle == nil {
+		return period, nil
+	}
+
+	session, err := tum.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !handle.IsWriter(session.UID) {
+		return period, nil
+	}
+	lState := makeFBOLockState()
+	if !tum.fbo.isMasterBranch(lState) {
+		// Don't add to a branch that still needs to be resolved.
+		return tlfUsageReportRetryDelay, nil
+	}
+
+	fbo := tum.fbo
+	rootNode, _, _, err := fbo.getRootNode(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := tum.config.Clock().Now()
+	report := TlfUsageReport{
+		Tlf:        handle.GetCanonicalName(),
+		Time:       now,
+		Revision:   revision,
+		UsageBytes: usage,
+	}
+	node, ei, err := fbo.Lookup(ctx, rootNode, TlfUsageReportName)
+	switch errors.Cause(err).(type) {
+	case nil:
+		buf := make([]byte, ei.Size)
+		n, err := fbo.Read(ctx, node, buf, 0)
+		if err != nil {
+			return 0, err
+		}
+		var prev TlfUsageReport
+		if err := json.Unmarshal(buf[:n], &prev); err != nil {
+			// Start over if someone has mangled the report.
+			tum.log.CDebugf(ctx, "Ignoring unparseable usage report: %+v",
+				err)
+		} else {
+			if due := prev.Time.Add(period); now.Before(due) {
+				return due.Sub(now), nil
+			}
+			report.PrevTime = &prev.Time
+			report.PrevRevision = prev.Revision
+			report.PrevUsageBytes = prev.UsageBytes
+			report.GrowthBytes = int64(usage) - int64(prev.UsageBytes)
+		}
+	case NoSuchNameError:
+		node, _, err = fbo.CreateFile(
+			ctx, rootNode, TlfUsageReportName, false, NoExcl)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	err = fbo.Truncate(ctx, node, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = fbo.Write(ctx, node, buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = fbo.SyncAll(ctx, fbo.folderBranch)
+	if err != nil {
+		return 0, err
+	}
+	tum.log.CDebugf(ctx, "Wrote a usage report for revision %d", revision)
+	return period, nil
+}
+
+// Shutdown stops all reporting.
+func (tum *tlfUsageMonitor) Shutdown() {
+	tum.lock.Lock()
+	defer tum.lock.Unlock()
+	tum.shutdown = true
+	if tum.reportTimer != nil {
+		tum.reportTimer.Stop()
+		tum.reportTimer = nil
+	}
+}
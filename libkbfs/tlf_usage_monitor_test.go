@@ -0,0 +1,144 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func testTlfUsageWrite(ctx context.Context, t *testing.T, config Config,
+	rootNode Node, name string, size int) {
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, make([]byte, size), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestTlfUsageMonitorWarnings(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	config.SetTlfUsageAlertPolicy(TlfUsageAlertPolicy{
+		GrowthBytes:  3000,
+		GrowthWindow: time.Hour,
+	})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	getUsage := func() uint64 {
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		return head.DiskUsage()
+	}
+	getWarnings := func() (warnings []error) {
+		for _, re := range config.Reporter().AllKnownErrors() {
+			switch re.Error.(type) {
+			case TlfUsageGrowthWarning, TlfUsageMarkWarning:
+				warnings = append(warnings, re.Error)
+			}
+		}
+		return warnings
+	}
+
+	t.Log("Growth spread out over more than the window isn't reported")
+	testTlfUsageWrite(ctx, t, config, rootNode, "a", 2000)
+	clock.Add(2 * time.Hour)
+	startUsage := getUsage()
+	testTlfUsageWrite(ctx, t, config, rootNode, "b", 2000)
+	require.Len(t, getWarnings(), 0)
+
+	t.Log("Growth within the window is")
+	testTlfUsageWrite(ctx, t, config, rootNode, "c", 2000)
+	usage := getUsage()
+	require.Equal(t, []error{TlfUsageGrowthWarning{
+		Tlf:         "u1",
+		GrowthBytes: usage - startUsage,
+		Window:      time.Hour,
+		UsageBytes:  usage,
+	}}, getWarnings())
+
+	t.Log("Passing a mark is reported once")
+	mark := usage + 1000
+	config.SetTlfUsageAlertPolicy(TlfUsageAlertPolicy{
+		Marks: []uint64{mark},
+	})
+	testTlfUsageWrite(ctx, t, config, rootNode, "d", 2000)
+	usage = getUsage()
+	testTlfUsageWrite(ctx, t, config, rootNode, "e", 2000)
+	warnings := getWarnings()
+	require.Len(t, warnings, 2)
+	require.Equal(t, TlfUsageMarkWarning{
+		Tlf:        "u1",
+		MarkBytes:  mark,
+		UsageBytes: usage,
+	}, warnings[1])
+}
+
+func TestTlfUsageMonitorReport(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	// Only turn the reports on after the TLF is open, so that they
+	// aren't written in the background.
+	config.SetTlfUsageAlertPolicy(TlfUsageAlertPolicy{GrowthBytes: 1 << 40})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	const period = 7 * 24 * time.Hour
+	config.SetTlfUsageAlertPolicy(TlfUsageAlertPolicy{ReportPeriod: period})
+	readReport := func() (report TlfUsageReport) {
+		kbfsOps := config.KBFSOps()
+		n, ei, err := kbfsOps.Lookup(ctx, rootNode, TlfUsageReportName)
+		require.NoError(t, err)
+		buf := make([]byte, ei.Size)
+		_, err = kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		err = json.Unmarshal(buf, &report)
+		require.NoError(t, err)
+		return report
+	}
+
+	t.Log("Write the first report")
+	testTlfUsageWrite(ctx, t, config, rootNode, "a", 1000)
+	next, err := ops.usage.writeReportIfDue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, period, next)
+	report1 := readReport()
+	require.Equal(t, tlf.CanonicalName("u1"), report1.Tlf)
+	require.True(t, clock.Now().Equal(report1.Time))
+	require.Nil(t, report1.PrevTime)
+
+	t.Log("Nothing is written before the period is up")
+	clock.Add(time.Hour)
+	next, err = ops.usage.writeReportIfDue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, period-time.Hour, next)
+	require.Equal(t, report1.Revision, readReport().Revision)
+
+	t.Log("The next report covers the growth since the last one")
+	testTlfUsageWrite(ctx, t, config, rootNode, "b", 1000)
+	clock.Add(period)
+	_, err = ops.usage.writeReportIfDue(ctx)
+	require.NoError(t, err)
+	report2 := readReport()
+	require.True(t, report1.Time.Equal(*report2.PrevTime))
+	require.Equal(t, report1.Revision, report2.PrevRevision)
+	require.Equal(t, report1.UsageBytes, report2.PrevUsageBytes)
+	require.True(t, report2.Revision > report1.Revision)
+	require.Equal(t, int64(report2.UsageBytes-report1.UsageBytes),
+		report2.GrowthBytes)
+	require.True(t, report2.GrowthBytes > 1000)
+}
@@ -0,0 +1,782 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	stdpath "path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// transferImportChunkSize is how much of a local file an import
+	// writes and syncs at a time.  Each synced chunk is durable, so a
+	// paused import resumes from the end of its last chunk.
+	transferImportChunkSize = 4 << 20
+	// transferHistorySize bounds how many finished transfers are kept
+	// around to be listed.
+	transferHistorySize = 64
+	// defaultMaxRunningTransfers is how many transfers run at once,
+	// if NewTransferManager isn't given a limit.
+	defaultMaxRunningTransfers = 2
+)
+
+// TransferID identifies a transfer in a TransferManager.
+type TransferID string
+
+// TransferKind is the kind of work a transfer does.
+type TransferKind int
+
+const (
+	// TransferSync syncs all the dirty files of a TLF.
+	TransferSync TransferKind = iota
+	// TransferImport copies a local file into a TLF.
+	TransferImport
+)
+
+func (k TransferKind) String() string {
+	switch k {
+	case TransferSync:
+		return "sync"
+	case TransferImport:
+		return "import"
+	default:
+		return fmt.Sprintf("TransferKind(%d)", int(k))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// TransferKind.
+func (k TransferKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// TransferState is where a transfer is in its life.
+type TransferState int
+
+const (
+	// TransferQueued transfers are waiting for a turn to run.
+	TransferQueued TransferState = iota
+	// TransferRunning transfers are running.
+	TransferRunning
+	// TransferPaused transfers won't run until they're resumed.
+	TransferPaused
+	// TransferDone transfers finished successfully.
+	TransferDone
+	// TransferFailed transfers stopped with an error.
+	TransferFailed
+	// TransferCanceled transfers were canceled before they finished.
+	TransferCanceled
+)
+
+func (s TransferState) String() string {
+	switch s {
+	case TransferQueued:
+		return "queued"
+	case TransferRunning:
+		return "running"
+	case TransferPaused:
+		return "paused"
+	case TransferDone:
+		return "done"
+	case TransferFailed:
+		return "failed"
+	case TransferCanceled:
+		return "canceled"
+	default:
+		return fmt.Sprintf("TransferState(%d)", int(s))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// TransferState.
+func (s TransferState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// TransferInfo describes a transfer, as listed by a TransferManager.
+type TransferInfo struct {
+	ID      TransferID
+	Kind    TransferKind
+	TlfName tlf.CanonicalName
+	TlfType tlf.Type
+	// Files are the paths of the files being transferred, starting
+	// with the TLF name.  For a sync, these are the TLF's dirty files
+	// as of when the sync was queued or started.
+	Files []string
+	// Size is the total number of bytes to transfer, and Progress is
+	// how many of them have been transferred durably, so far.  Size
+	// is 0 if it isn't known ahead of time, as for syncs.
+	Size     int64
+	Progress int64
+	State    TransferState
+	// Error is the error a failed transfer stopped with.
+	Error  string `json:",omitempty"`
+	Queued time.Time
+}
+
+// TransferNotFoundError indicates that the given transfer doesn't
+// exist, or has finished so long ago that it's been forgotten.
+type TransferNotFoundError struct {
+	ID TransferID
+}
+
+// Error implements the error interface for TransferNotFoundError.
+func (e TransferNotFoundError) Error() string {
+	return fmt.Sprintf("No transfer with ID %s", e.ID)
+}
+
+// TransferStateError indicates that the given transfer is in the
+// wrong state for the requested action, like resuming a transfer
+// that isn't paused.
+type TransferStateError struct {
+	ID     TransferID
+	State  TransferState
+	Action string
+}
+
+// Error implements the error interface for TransferStateError.
+func (e TransferStateError) Error() string {
+	return fmt.Sprintf("Can't %s transfer %s, since it's %s",
+		e.Action, e.ID, e.State)
+}
+
+type transfer struct {
+	info TransferInfo
+	// For imports: the slash-separated destination directory,
+	// relative to the TLF root, and the local file to copy from.
+	dirPath   string
+	name      string
+	localPath string
+	// created is set once an import has created its destination
+	// file, so that canceling it knows to remove the file.
+	created bool
+	// stopTo, if set, is the state a running transfer has been asked
+	// to stop in, either TransferPaused or TransferCanceled.
+	stopTo *TransferState
+}
+
+// TransferManager runs syncs and imports of local files as a queue
+// of transfers that can be listed, paused, resumed, canceled and
+// reordered, so frontends can show what's being uploaded and let the
+// user control it.  Transfers run in queue order, a few at a time.
+//
+// Running transfers are stopped between chunks, or, for a sync in
+// progress, with KBFSOps.CancelSync, so they're never left half-done:
+// a paused import resumes from its last synced chunk, and a paused or
+// canceled sync leaves its files dirty, to be synced again later.  A
+// canceled or failed import removes what it had copied so far.  The
+// queue isn't persisted across restarts.
+type TransferManager struct {
+	config     Config
+	log        logger.Logger
+	maxRunning int
+
+	lock      sync.Mutex
+	active    []*transfer // queued, running and paused, in queue order
+	finished  []*transfer // oldest first
+	byID      map[TransferID]*transfer
+	running   int
+	isStopped bool
+	wg        sync.WaitGroup
+	// changed is closed, and replaced, whenever a transfer changes
+	// state.
+	changed chan struct{}
+}
+
+// NewTransferManager returns a new TransferManager that runs at most
+// `maxRunning` transfers at once, or a default number if that's 0.
+func NewTransferManager(config Config, maxRunning int) *TransferManager {
+	if maxRunning <= 0 {
+		maxRunning = defaultMaxRunningTransfers
+	}
+	return &TransferManager{
+		config:     config,
+		log:        config.MakeLogger("XFER"),
+		maxRunning: maxRunning,
+		byID:       make(map[TransferID]*transfer),
+		changed:    make(chan struct{}),
+	}
+}
+
+type ctxTransferTagKey int
+
+const (
+	ctxTransferIDKey ctxTransferTagKey = iota
+)
+
+const ctxTransferOpID = "XFERID"
+
+func (tm *TransferManager) add(ctx context.Context, t *transfer) (
+	TransferID, error) {
+	idStr, err := MakeRandomRequestID()
+	if err != nil {
+		return "", err
+	}
+	t.info.ID = TransferID(idStr)
+	t.info.State = TransferQueued
+	t.info.Queued = tm.config.Clock().Now()
+
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	if tm.isStopped {
+		return "", ShutdownHappenedError{}
+	}
+	tm.log.CDebugf(ctx, "Queued %s transfer %s in %s: %v",
+		t.info.Kind, t.info.ID, t.info.TlfName, t.info.Files)
+	tm.active = append(tm.active, t)
+	tm.byID[t.info.ID] = t
+	tm.scheduleLocked()
+	return t.info.ID, nil
+}
+
+// QueueSync queues a sync of all the dirty files of the given TLF.
+// If a sync of the TLF is already waiting to run, its ID is returned
+// instead.
+func (tm *TransferManager) QueueSync(
+	ctx context.Context, h *TlfHandle) (TransferID, error) {
+	name, t := h.GetCanonicalName(), h.Type()
+	tm.lock.Lock()
+	for _, other := range tm.active {
+		if other.info.Kind == TransferSync && other.info.TlfName == name &&
+			other.info.TlfType == t && other.info.State == TransferQueued {
+			tm.lock.Unlock()
+			return other.info.ID, nil
+		}
+	}
+	tm.lock.Unlock()
+
+	rootNode, _, err := tm.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, MasterBranch)
+	if err != nil {
+		return "", err
+	}
+	files, err := tm.dirtyFiles(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		return "", err
+	}
+	return tm.add(ctx, &transfer{info: TransferInfo{
+		Kind:    TransferSync,
+		TlfName: name,
+		TlfType: t,
+		Files:   files,
+	}})
+}
+
+// QueueImport queues a copy of the local file at `localPath` into a
+// new file called `name`, in the directory at the slash-separated
+// path `dirPath` of the given TLF.  The import fails if there's
+// already something called `name` there.
+func (tm *TransferManager) QueueImport(
+	ctx context.Context, h *TlfHandle, dirPath, name, localPath string) (
+	TransferID, error) {
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errors.Errorf("%s is not a regular file", localPath)
+	}
+	dirPath = strings.Trim(dirPath, "/")
+	file := stdpath.Join(string(h.GetCanonicalName()), dirPath, name)
+	return tm.add(ctx, &transfer{
+		info: TransferInfo{
+			Kind:    TransferImport,
+			TlfName: h.GetCanonicalName(),
+			TlfType: h.Type(),
+			Files:   []string{file},
+			Size:    fi.Size(),
+		},
+		dirPath:   dirPath,
+		name:      name,
+		localPath: localPath,
+	})
+}
+
+// List returns all the transfers: first the unfinished ones, in
+// queue order, and then the most recently finished ones, newest
+// first.
+func (tm *TransferManager) List() []TransferInfo {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	infos := make([]TransferInfo, 0, len(tm.active)+len(tm.finished))
+	for _, t := range tm.active {
+		infos = append(infos, t.info)
+	}
+	for i := len(tm.finished) - 1; i >= 0; i-- {
+		infos = append(infos, tm.finished[i].info)
+	}
+	return infos
+}
+
+// Info returns the current state of the given transfer.
+func (tm *TransferManager) Info(id TransferID) (TransferInfo, error) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	t, ok := tm.byID[id]
+	if !ok {
+		return TransferInfo{}, TransferNotFoundError{id}
+	}
+	return t.info, nil
+}
+
+func (tm *TransferManager) getActiveLocked(
+	id TransferID, action string) (*transfer, int, error) {
+	t, ok := tm.byID[id]
+	if !ok {
+		return nil, 0, TransferNotFoundError{id}
+	}
+	for i, other := range tm.active {
+		if other == t {
+			return t, i, nil
+		}
+	}
+	return nil, 0, TransferStateError{id, t.info.State, action}
+}
+
+// stopRunningLocked asks the running transfer `t` to stop in state
+// `to` as soon as it can.  The caller must call the returned
+// function, if any, after releasing `tm.lock`.
+func (tm *TransferManager) stopRunningLocked(
+	t *transfer, to TransferState) func(context.Context) {
+	t.stopTo = &to
+	// Cut short any sync in progress; the block puts are the only
+	// part of a transfer that takes long.
+	name, tlfType := t.info.TlfName, t.info.TlfType
+	return func(ctx context.Context) {
+		err := tm.cancelSync(ctx, name, tlfType)
+		if err != nil {
+			tm.log.CDebugf(ctx, "Couldn't cancel the sync of %s: %+v",
+				name, err)
+		}
+	}
+}
+
+func (tm *TransferManager) cancelSync(
+	ctx context.Context, name tlf.CanonicalName, t tlf.Type) error {
+	fb, err := tm.getFolderBranch(ctx, name, t)
+	if err != nil {
+		return err
+	}
+	return tm.config.KBFSOps().CancelSync(ctx, fb)
+}
+
+// Pause keeps the given transfer from running until it's resumed.
+// If it's running, it stops at the next chance it gets.
+func (tm *TransferManager) Pause(ctx context.Context, id TransferID) error {
+	tm.lock.Lock()
+	t, _, err := tm.getActiveLocked(id, "pause")
+	if err != nil {
+		tm.lock.Unlock()
+		return err
+	}
+	var stop func(context.Context)
+	switch t.info.State {
+	case TransferQueued:
+		tm.setStateLocked(t, TransferPaused)
+	case TransferRunning:
+		stop = tm.stopRunningLocked(t, TransferPaused)
+	}
+	tm.lock.Unlock()
+
+	tm.log.CDebugf(ctx, "Pausing transfer %s", id)
+	if stop != nil {
+		stop(ctx)
+	}
+	return nil
+}
+
+// Resume lets the given paused transfer run again, from where it
+// left off.
+func (tm *TransferManager) Resume(ctx context.Context, id TransferID) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	t, _, err := tm.getActiveLocked(id, "resume")
+	if err != nil {
+		return err
+	}
+	switch {
+	case t.info.State == TransferPaused:
+		tm.setStateLocked(t, TransferQueued)
+	case t.stopTo != nil && *t.stopTo == TransferPaused:
+		// It hasn't stopped yet; let it keep running.
+		t.stopTo = nil
+	default:
+		return TransferStateError{id, t.info.State, "resume"}
+	}
+	tm.log.CDebugf(ctx, "Resuming transfer %s", id)
+	tm.scheduleLocked()
+	return nil
+}
+
+// Cancel stops the given transfer for good.  A canceled import
+// removes the file it was copying to; a canceled sync leaves the
+// TLF's files dirty.
+func (tm *TransferManager) Cancel(ctx context.Context, id TransferID) error {
+	tm.lock.Lock()
+	t, i, err := tm.getActiveLocked(id, "cancel")
+	if err != nil {
+		tm.lock.Unlock()
+		return err
+	}
+	if t.info.State == TransferRunning {
+		stop := tm.stopRunningLocked(t, TransferCanceled)
+		tm.lock.Unlock()
+		tm.log.CDebugf(ctx, "Canceling running transfer %s", id)
+		stop(ctx)
+		return nil
+	}
+	tm.finishLocked(t, i, TransferCanceled, nil)
+	created := t.created
+	tm.lock.Unlock()
+
+	tm.log.CDebugf(ctx, "Canceled transfer %s", id)
+	if created {
+		return tm.removeImport(ctx, t)
+	}
+	return nil
+}
+
+// Move moves the given unfinished transfer to position `pos` in the
+// queue, where 0 is the front.  Positions past the end of the queue
+// move it to the back.  Moving a transfer ahead of running ones
+// doesn't stop them.
+func (tm *TransferManager) Move(
+	ctx context.Context, id TransferID, pos int) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	t, i, err := tm.getActiveLocked(id, "move")
+	if err != nil {
+		return err
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	if pos >= len(tm.active) {
+		pos = len(tm.active) - 1
+	}
+	tm.log.CDebugf(ctx, "Moving transfer %s from %d to %d", id, i, pos)
+	copy(tm.active[i:], tm.active[i+1:])
+	copy(tm.active[pos+1:], tm.active[pos:len(tm.active)-1])
+	tm.active[pos] = t
+	tm.scheduleLocked()
+	return nil
+}
+
+// Shutdown pauses all the running transfers, and waits for them to
+// stop.  No transfers can be queued or run after that.
+func (tm *TransferManager) Shutdown(ctx context.Context) {
+	tm.lock.Lock()
+	tm.isStopped = true
+	var stops []func(context.Context)
+	for _, t := range tm.active {
+		if t.info.State == TransferRunning {
+			stops = append(stops, tm.stopRunningLocked(t, TransferPaused))
+		}
+	}
+	tm.lock.Unlock()
+
+	for _, stop := range stops {
+		stop(ctx)
+	}
+	tm.wg.Wait()
+}
+
+// finishLocked moves the transfer at `i` in the queue to the
+// finished list, in state `s`.
+func (tm *TransferManager) finishLocked(
+	t *transfer, i int, s TransferState, err error) {
+	tm.active = append(tm.active[:i], tm.active[i+1:]...)
+	tm.setStateLocked(t, s)
+	if err != nil {
+		t.info.Error = err.Error()
+	}
+	tm.finished = append(tm.finished, t)
+	if len(tm.finished) > transferHistorySize {
+		delete(tm.byID, tm.finished[0].info.ID)
+		tm.finished = tm.finished[1:]
+	}
+}
+
+// setStateLocked moves `t` to state `s`, and wakes up anyone waiting
+// for a state change.
+func (tm *TransferManager) setStateLocked(t *transfer, s TransferState) {
+	t.info.State = s
+	close(tm.changed)
+	tm.changed = make(chan struct{})
+}
+
+// stateChanges returns a channel that is closed the next time any
+// transfer changes state.
+func (tm *TransferManager) stateChanges() <-chan struct{} {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	return tm.changed
+}
+
+// scheduleLocked starts as many queued transfers as it can, in queue
+// order.
+func (tm *TransferManager) scheduleLocked() {
+	if tm.isStopped {
+		return
+	}
+	for _, t := range tm.active {
+		if tm.running >= tm.maxRunning {
+			return
+		}
+		if t.info.State != TransferQueued {
+			continue
+		}
+		tm.setStateLocked(t, TransferRunning)
+		t.stopTo = nil
+		tm.running++
+		tm.wg.Add(1)
+		go tm.run(t)
+	}
+}
+
+func (tm *TransferManager) stopRequested(t *transfer) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	return t.stopTo != nil
+}
+
+func (tm *TransferManager) setProgress(t *transfer, progress int64) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	t.info.Progress = progress
+}
+
+func (tm *TransferManager) run(t *transfer) {
+	defer tm.wg.Done()
+	ctx, err := NewContextWithCancellationDelayer(CtxWithRandomIDReplayable(
+		context.Background(), ctxTransferIDKey, ctxTransferOpID, tm.log))
+	if err != nil {
+		panic(err)
+	}
+	defer CleanupCancellationDelayer(ctx)
+	ctx = NewContextWithBlockFetchClass(ctx, BlockFetchBackground)
+	tm.log.CDebugf(ctx, "Running %s transfer %s", t.info.Kind, t.info.ID)
+
+	var done bool
+	switch t.info.Kind {
+	case TransferSync:
+		done, err = tm.runSync(ctx, t)
+	case TransferImport:
+		done, err = tm.runImport(ctx, t)
+	default:
+		err = errors.Errorf("Unknown transfer kind %s", t.info.Kind)
+	}
+	if _, ok := errors.Cause(err).(SyncCanceledError); ok &&
+		tm.stopRequested(t) {
+		err = nil
+	}
+
+	tm.lock.Lock()
+	tm.running--
+	state := TransferDone
+	switch {
+	case done && err == nil:
+	case err != nil:
+		state = TransferFailed
+	case t.stopTo != nil:
+		state = *t.stopTo
+	}
+	t.stopTo = nil
+	// Don't leave partial copies behind.
+	removeCreated := !done && t.created &&
+		(state == TransferCanceled || state == TransferFailed)
+	tm.log.CDebugf(ctx, "Transfer %s is %s: %+v", t.info.ID, state, err)
+	if state == TransferPaused {
+		tm.setStateLocked(t, state)
+	} else {
+		for i, other := range tm.active {
+			if other == t {
+				tm.finishLocked(t, i, state, err)
+				break
+			}
+		}
+	}
+	tm.scheduleLocked()
+	tm.lock.Unlock()
+
+	if removeCreated {
+		err := tm.removeImport(ctx, t)
+		if err != nil {
+			tm.log.CDebugf(ctx, "Couldn't remove unfinished import %s: %+v",
+				t.info.ID, err)
+		}
+	}
+}
+
+func (tm *TransferManager) getFolderBranch(
+	ctx context.Context, name tlf.CanonicalName, t tlf.Type) (
+	FolderBranch, error) {
+	h, err := ParseTlfHandle(
+		ctx, tm.config.KBPKI(), tm.config.MDOps(), string(name), t)
+	if err != nil {
+		return FolderBranch{}, err
+	}
+	rootNode, _, err := tm.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, MasterBranch)
+	if err != nil {
+		return FolderBranch{}, err
+	}
+	return rootNode.GetFolderBranch(), nil
+}
+
+func (tm *TransferManager) dirtyFiles(
+	ctx context.Context, fb FolderBranch) ([]string, error) {
+	status, _, err := tm.config.KBFSOps().FolderStatus(ctx, fb)
+	if err != nil {
+		return nil, err
+	}
+	return status.DirtyPaths, nil
+}
+
+func (tm *TransferManager) runSync(
+	ctx context.Context, t *transfer) (done bool, err error) {
+	fb, err := tm.getFolderBranch(ctx, t.info.TlfName, t.info.TlfType)
+	if err != nil {
+		return false, err
+	}
+	files, err := tm.dirtyFiles(ctx, fb)
+	if err != nil {
+		return false, err
+	}
+	tm.lock.Lock()
+	t.info.Files = files
+	tm.lock.Unlock()
+
+	err = tm.config.KBFSOps().SyncAll(ctx, fb)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getImportDir looks up the destination directory of the import,
+// starting from the TLF root.
+func (tm *TransferManager) getImportDir(
+	ctx context.Context, t *transfer) (Node, error) {
+	h, err := ParseTlfHandle(
+		ctx, tm.config.KBPKI(), tm.config.MDOps(), string(t.info.TlfName),
+		t.info.TlfType)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := tm.config.KBFSOps()
+	n, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	if t.dirPath == "" {
+		return n, nil
+	}
+	for _, name := range strings.Split(t.dirPath, "/") {
+		var ei EntryInfo
+		n, ei, err = kbfsOps.Lookup(ctx, n, name)
+		if err != nil {
+			return nil, err
+		}
+		if ei.Type != Dir {
+			return nil, errors.Errorf("%s is not a directory", name)
+		}
+	}
+	return n, nil
+}
+
+func (tm *TransferManager) runImport(
+	ctx context.Context, t *transfer) (done bool, err error) {
+	f, err := os.Open(t.localPath)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	dir, err := tm.getImportDir(ctx, t)
+	if err != nil {
+		return false, err
+	}
+	kbfsOps := tm.config.KBFSOps()
+	tm.lock.Lock()
+	created, off := t.created, t.info.Progress
+	tm.lock.Unlock()
+	var file Node
+	if created {
+		file, _, err = kbfsOps.Lookup(ctx, dir, t.name)
+		if err != nil {
+			return false, err
+		}
+		// Drop anything written past the last synced chunk.
+		err = kbfsOps.Truncate(ctx, file, uint64(off))
+		if err != nil {
+			return false, err
+		}
+	} else {
+		file, _, err = kbfsOps.CreateFile(ctx, dir, t.name, false, WithExcl)
+		if err != nil {
+			return false, err
+		}
+		tm.lock.Lock()
+		t.created = true
+		tm.lock.Unlock()
+	}
+
+	buf := make([]byte, transferImportChunkSize)
+	for {
+		if tm.stopRequested(t) {
+			return false, nil
+		}
+		n, readErr := f.ReadAt(buf, off)
+		if readErr != nil && readErr != io.EOF {
+			return false, errors.WithStack(readErr)
+		}
+		if n > 0 {
+			err = kbfsOps.Write(ctx, file, buf[:n], off)
+			if err != nil {
+				return false, err
+			}
+		}
+		// Sync even an empty file, so its creation is durable.
+		err = kbfsOps.SyncAll(ctx, file.GetFolderBranch())
+		if err != nil {
+			return false, err
+		}
+		off += int64(n)
+		tm.setProgress(t, off)
+		if readErr == io.EOF {
+			return true, nil
+		}
+	}
+}
+
+// removeImport removes the file a canceled import was copying to.
+func (tm *TransferManager) removeImport(
+	ctx context.Context, t *transfer) error {
+	dir, err := tm.getImportDir(ctx, t)
+	if err != nil {
+		return err
+	}
+	kbfsOps := tm.config.KBFSOps()
+	err = kbfsOps.RemoveEntry(ctx, dir, t.name)
+	switch errors.Cause(err).(type) {
+	case nil:
+	case NoSuchNameError:
+		return nil
+	default:
+		return err
+	}
+	return kbfsOps.SyncAll(ctx, dir.GetFolderBranch())
+}
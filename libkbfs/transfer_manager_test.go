@@ -0,0 +1,162 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func waitForTransfer(ctx context.Context, t *testing.T, tm *TransferManager,
+	id TransferID, state TransferState) TransferInfo {
+	for {
+		// Get the channel first, so no change is missed.
+		changed := tm.stateChanges()
+		info, err := tm.Info(id)
+		require.NoError(t, err)
+		if info.State == state {
+			return info
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatalf("Transfer %s is %s, not %s (%s)",
+				id, info.State, state, info.Error)
+		}
+	}
+}
+
+func transferIDs(infos []TransferInfo) (ids []TransferID) {
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+	return ids
+}
+
+func TestTransferManager(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "transfer_manager")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	localPath := filepath.Join(tempdir, "local")
+	data := []byte("hello world")
+	err = ioutil.WriteFile(localPath, data, 0600)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "test_user", tlf.Private)
+	require.NoError(t, err)
+
+	tm := NewTransferManager(config, 1)
+	defer tm.Shutdown(context.Background())
+	// Hold everything in the queue for now.
+	tm.lock.Lock()
+	tm.maxRunning = 0
+	tm.lock.Unlock()
+
+	t.Log("Transfers are listed in queue order, and can be reordered")
+	a, err := tm.QueueImport(ctx, h, "", "a", localPath)
+	require.NoError(t, err)
+	b, err := tm.QueueImport(ctx, h, "/", "b", localPath)
+	require.NoError(t, err)
+	c, err := tm.QueueSync(ctx, h)
+	require.NoError(t, err)
+	c2, err := tm.QueueSync(ctx, h)
+	require.NoError(t, err)
+	require.Equal(t, c, c2)
+	require.Equal(t, []TransferID{a, b, c}, transferIDs(tm.List()))
+	err = tm.Move(ctx, c, 0)
+	require.NoError(t, err)
+	err = tm.Move(ctx, a, 10)
+	require.NoError(t, err)
+	infos := tm.List()
+	require.Equal(t, []TransferID{c, b, a}, transferIDs(infos))
+	require.Equal(t, TransferImport, infos[1].Kind)
+	require.Equal(t, []string{"test_user/b"}, infos[1].Files)
+	require.Equal(t, int64(len(data)), infos[1].Size)
+
+	t.Log("Queued transfers can be paused and canceled")
+	err = tm.Pause(ctx, b)
+	require.NoError(t, err)
+	err = tm.Cancel(ctx, c)
+	require.NoError(t, err)
+	infos = tm.List()
+	require.Equal(t, []TransferID{b, a, c}, transferIDs(infos))
+	require.Equal(t, TransferPaused, infos[0].State)
+	require.Equal(t, TransferCanceled, infos[2].State)
+	err = tm.Resume(ctx, a)
+	require.IsType(t, TransferStateError{}, err)
+	err = tm.Cancel(ctx, c)
+	require.IsType(t, TransferStateError{}, err)
+
+	t.Log("Unpaused transfers run")
+	tm.lock.Lock()
+	tm.maxRunning = 1
+	tm.scheduleLocked()
+	tm.lock.Unlock()
+	info := waitForTransfer(ctx, t, tm, a, TransferDone)
+	require.Equal(t, int64(len(data)), info.Progress)
+	info, err = tm.Info(b)
+	require.NoError(t, err)
+	require.Equal(t, TransferPaused, info.State)
+	err = tm.Resume(ctx, b)
+	require.NoError(t, err)
+	waitForTransfer(ctx, t, tm, b, TransferDone)
+
+	kbfsOps := config.KBFSOps()
+	for _, name := range []string{"a", "b"} {
+		n, ei, err := kbfsOps.Lookup(ctx, rootNode, name)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(data)), ei.Size)
+		buf := make([]byte, len(data))
+		_, err = kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+
+	t.Log("Imports don't overwrite existing files, and clean up on failure")
+	d, err := tm.QueueImport(ctx, h, "", "a", localPath)
+	require.NoError(t, err)
+	info = waitForTransfer(ctx, t, tm, d, TransferFailed)
+	require.NotEmpty(t, info.Error)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	t.Log("Syncs sync dirty files")
+	n, _, err := kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, n, []byte("HELLO"), 0)
+	require.NoError(t, err)
+	e, err := tm.QueueSync(ctx, h)
+	require.NoError(t, err)
+	waitForTransfer(ctx, t, tm, e, TransferDone)
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.DirtyPaths, 0)
+
+	t.Log("Finished transfers are listed newest first, and can't be moved")
+	require.Equal(t, []TransferID{e, d, b, a, c}, transferIDs(tm.List()))
+	err = tm.Move(ctx, a, 0)
+	require.IsType(t, TransferStateError{}, err)
+	_, err = tm.Info("nope")
+	require.IsType(t, TransferNotFoundError{}, errors.Cause(err))
+
+	tm.Shutdown(ctx)
+	_, err = tm.QueueSync(ctx, h)
+	require.IsType(t, ShutdownHappenedError{}, err)
+}
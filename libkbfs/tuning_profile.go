@@ -0,0 +1,119 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"time"
+)
+
+// TuningProfileName names one of the built-in tuning profiles.
+type TuningProfileName string
+
+const (
+	// TuningProfileDefault keeps the usual settings.
+	TuningProfileDefault TuningProfileName = "default"
+	// TuningProfileStreaming suits reading big media files from
+	// start to end: whole files are read ahead, directories are
+	// barely prefetched, and blocks are evicted from the disk cache
+	// early, since they're usually only read once.
+	TuningProfileStreaming TuningProfileName = "streaming"
+	// TuningProfileBuild suits code builds, which touch many small
+	// files in bursts: whole directories are prefetched, and
+	// directory ops are batched longer before they're flushed.
+	// Blocks stay in the disk cache longer, since builds read the
+	// same files over and over.
+	TuningProfileBuild TuningProfileName = "build"
+	// TuningProfileEditing suits editing documents: only a little is
+	// read ahead, and changes are flushed soon after they're made.
+	TuningProfileEditing TuningProfileName = "editing"
+)
+
+// TuningProfile bundles the read-ahead, write-behind and caching
+// settings that suit a particular kind of workload.  Zero values
+// leave the corresponding setting alone.
+type TuningProfile struct {
+	Name TuningProfileName
+	// ReadAheadBlocks limits how many child blocks of an indirect
+	// file block are prefetched when it's read, and is how many
+	// blocks past the end of each sequential read of a file are
+	// fetched in the background.  Zero means no limit, in which case
+	// all of a file's blocks are prefetched when it's first read.
+	// Synced TLFs always prefetch everything.
+	ReadAheadBlocks int
+	// DirPrefetchEntries limits how many entries of a directory are
+	// prefetched when it's read, smallest first.  Zero means no
+	// limit.  Synced TLFs always prefetch everything.
+	DirPrefetchEntries int
+	// BGFlushPeriod, if non-zero, overrides Config.BGFlushPeriod.
+	BGFlushPeriod time.Duration
+	// DirOpBatchSize, if non-zero, overrides
+	// Config.BGFlushDirOpBatchSize, unless that's 1 (which turns
+	// off batching altogether).
+	DirOpBatchSize int
+	// DiskCacheWeight scales how long this TLF's blocks last in the
+	// disk block cache compared to other TLFs' blocks: when picking
+	// blocks to evict, a block with weight 2 looks half as old as it
+	// is.  Zero means 1.
+	DiskCacheWeight float64
+}
+
+var tuningProfiles = map[TuningProfileName]TuningProfile{
+	TuningProfileDefault: {
+		Name: TuningProfileDefault,
+	},
+	TuningProfileStreaming: {
+		Name:               TuningProfileStreaming,
+		DirPrefetchEntries: 16,
+		DiskCacheWeight:    0.5,
+	},
+	TuningProfileBuild: {
+		Name:            TuningProfileBuild,
+		ReadAheadBlocks: 8,
+		BGFlushPeriod:   5 * time.Second,
+		DirOpBatchSize:  500,
+		DiskCacheWeight: 2,
+	},
+	TuningProfileEditing: {
+		Name:               TuningProfileEditing,
+		ReadAheadBlocks:    2,
+		DirPrefetchEntries: 32,
+		BGFlushPeriod:      200 * time.Millisecond,
+		DirOpBatchSize:     10,
+	},
+}
+
+// GetTuningProfile returns the built-in tuning profile with the given
+// name.
+func GetTuningProfile(name TuningProfileName) (TuningProfile, error) {
+	p, ok := tuningProfiles[name]
+	if !ok {
+		return TuningProfile{}, UnknownTuningProfileError{name}
+	}
+	return p, nil
+}
+
+// TuningProfileNames returns the names of all the built-in tuning
+// profiles, sorted.
+func TuningProfileNames() []TuningProfileName {
+	names := make([]TuningProfileName, 0, len(tuningProfiles))
+	for name := range tuningProfiles {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// diskCacheWeightedTime returns the LRU time to use for a block last
+// used at `lruTime` when deciding what to evict, scaled by the
+// profile's disk cache weight.
+func (p TuningProfile) diskCacheWeightedTime(
+	now, lruTime time.Time) time.Time {
+	if p.DiskCacheWeight <= 0 || p.DiskCacheWeight == 1 {
+		return lruTime
+	}
+	age := now.Sub(lruTime)
+	return now.Add(-time.Duration(float64(age) / p.DiskCacheWeight))
+}
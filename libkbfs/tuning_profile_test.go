@@ -0,0 +1,55 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestTuningProfileConfig(t *testing.T) {
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test")
+	defer CheckConfigAndShutdown(ctx, t, config)
+
+	tlfID1 := tlf.FakeID(1, tlf.Private)
+	tlfID2 := tlf.FakeID(2, tlf.Private)
+	require.Equal(t, TuningProfileDefault, config.TuningProfile(tlfID1).Name)
+
+	err := config.SetTuningProfile(tlf.NullID, TuningProfileEditing)
+	require.NoError(t, err)
+	err = config.SetTuningProfile(tlfID2, TuningProfileStreaming)
+	require.NoError(t, err)
+	require.Equal(t, TuningProfileEditing, config.TuningProfile(tlfID1).Name)
+	require.Equal(t, TuningProfileStreaming, config.TuningProfile(tlfID2).Name)
+
+	err = config.SetTuningProfile(tlfID1, "bogus")
+	require.Equal(t, UnknownTuningProfileError{"bogus"}, err)
+	require.Equal(t, TuningProfileEditing, config.TuningProfile(tlfID1).Name)
+
+	for _, name := range TuningProfileNames() {
+		p, err := GetTuningProfile(name)
+		require.NoError(t, err)
+		require.Equal(t, name, p.Name)
+	}
+}
+
+func TestTuningProfileDiskCacheWeightedTime(t *testing.T) {
+	now := time.Now()
+	lruTime := now.Add(-time.Hour)
+
+	require.Equal(t, lruTime, TuningProfile{}.diskCacheWeightedTime(
+		now, lruTime))
+	require.Equal(t, now.Add(-30*time.Minute),
+		TuningProfile{DiskCacheWeight: 2}.diskCacheWeightedTime(
+			now, lruTime))
+	require.Equal(t, now.Add(-2*time.Hour),
+		TuningProfile{DiskCacheWeight: 0.5}.diskCacheWeightedTime(
+			now, lruTime))
+}
@@ -0,0 +1,402 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// uploadStagingPrefix starts the name of the hidden file that holds
+// the data of an in-progress upload, next to its final destination.
+const uploadStagingPrefix = "._upload-"
+
+// uploadSessionInfoSuffix ends the name of each file in the session
+// directory.
+const uploadSessionInfoSuffix = ".json"
+
+// UploadSessionID identifies an upload session.  It's safe to hand
+// out to clients as a resumability token.
+type UploadSessionID string
+
+// UploadSessionInfo describes an in-progress upload session.
+type UploadSessionInfo struct {
+	ID      UploadSessionID
+	TlfName tlf.CanonicalName
+	TlfType tlf.Type
+	// Dir holds the path components, relative to the TLF root, of
+	// the directory the file will be committed to.
+	Dir  []string
+	Name string
+	// Offset is the number of bytes that have been durably stored
+	// so far; the next chunk must start there.
+	Offset int64
+	// Started is when the session began.
+	Started time.Time
+}
+
+func (info UploadSessionInfo) stagingName() string {
+	return uploadStagingPrefix + string(info.ID)
+}
+
+// UploadSessionNotFoundError indicates that the given upload session
+// doesn't exist, or has already been committed or aborted.
+type UploadSessionNotFoundError struct {
+	ID UploadSessionID
+}
+
+// Error implements the error interface for UploadSessionNotFoundError.
+func (e UploadSessionNotFoundError) Error() string {
+	return fmt.Sprintf("No upload session with ID %s", e.ID)
+}
+
+// UploadSessionOffsetError indicates that a chunk didn't start where
+// the session left off.  The client should resume from Expected.
+type UploadSessionOffsetError struct {
+	ID       UploadSessionID
+	Expected int64
+	Got      int64
+}
+
+// Error implements the error interface for UploadSessionOffsetError.
+func (e UploadSessionOffsetError) Error() string {
+	return fmt.Sprintf("Upload session %s expected a chunk at offset %d, "+
+		"not %d", e.ID, e.Expected, e.Got)
+}
+
+// UploadSessionManager lets gateway frontends upload large files in
+// chunks.  Each chunk is written to a hidden staging file in the
+// destination directory and synced, so it's stored in the journal
+// (or on the server) rather than only in memory.  The session
+// bookkeeping is kept in a local directory, so that an interrupted
+// upload can be resumed from its last chunk even after a restart.
+// Committing a session renames the staging file into place.
+type UploadSessionManager struct {
+	config Config
+	dir    string
+	log    logger.Logger
+
+	lock     sync.Mutex
+	sessions map[UploadSessionID]UploadSessionInfo
+	// opLocks serialize the operations on each session.
+	opLocks map[UploadSessionID]*sync.Mutex
+}
+
+// NewUploadSessionManager returns a new UploadSessionManager that
+// keeps its state in `dir`, picking up any sessions left there by a
+// previous process.
+func NewUploadSessionManager(config Config, dir string) (
+	*UploadSessionManager, error) {
+	err := ioutil.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	usm := &UploadSessionManager{
+		config:   config,
+		dir:      dir,
+		log:      config.MakeLogger(""),
+		sessions: make(map[UploadSessionID]UploadSessionInfo),
+		opLocks:  make(map[UploadSessionID]*sync.Mutex),
+	}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), uploadSessionInfoSuffix) {
+			continue
+		}
+		var info UploadSessionInfo
+		err := ioutil.DeserializeFromJSONFile(
+			filepath.Join(dir, fi.Name()), &info)
+		if err != nil {
+			return nil, err
+		}
+		usm.sessions[info.ID] = info
+	}
+	return usm, nil
+}
+
+func (usm *UploadSessionManager) infoPath(id UploadSessionID) string {
+	return filepath.Join(usm.dir, string(id)+uploadSessionInfoSuffix)
+}
+
+// lockSession keeps any other operation on the given session from
+// running until the returned function is called.
+func (usm *UploadSessionManager) lockSession(id UploadSessionID) func() {
+	usm.lock.Lock()
+	opLock, ok := usm.opLocks[id]
+	if !ok {
+		opLock = &sync.Mutex{}
+		usm.opLocks[id] = opLock
+	}
+	usm.lock.Unlock()
+
+	opLock.Lock()
+	return opLock.Unlock
+}
+
+func (usm *UploadSessionManager) getSession(id UploadSessionID) (
+	UploadSessionInfo, error) {
+	usm.lock.Lock()
+	defer usm.lock.Unlock()
+	info, ok := usm.sessions[id]
+	if !ok {
+		return UploadSessionInfo{}, UploadSessionNotFoundError{id}
+	}
+	return info, nil
+}
+
+func (usm *UploadSessionManager) putSession(info UploadSessionInfo) error {
+	err := ioutil.SerializeToJSONFile(info, usm.infoPath(info.ID))
+	if err != nil {
+		return err
+	}
+	usm.lock.Lock()
+	defer usm.lock.Unlock()
+	usm.sessions[info.ID] = info
+	return nil
+}
+
+func (usm *UploadSessionManager) deleteSession(id UploadSessionID) error {
+	usm.lock.Lock()
+	defer usm.lock.Unlock()
+	delete(usm.sessions, id)
+	delete(usm.opLocks, id)
+	err := ioutil.Remove(usm.infoPath(id))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	return nil
+}
+
+// getDirNode looks up the destination directory of the session,
+// starting from the TLF root.
+func (usm *UploadSessionManager) getDirNode(
+	ctx context.Context, info UploadSessionInfo) (Node, error) {
+	h, err := ParseTlfHandle(
+		ctx, usm.config.KBPKI(), usm.config.MDOps(), string(info.TlfName),
+		info.TlfType)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := usm.config.KBFSOps()
+	n, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range info.Dir {
+		var ei EntryInfo
+		n, ei, err = kbfsOps.Lookup(ctx, n, name)
+		if err != nil {
+			return nil, err
+		}
+		if ei.Type != Dir {
+			return nil, errors.Errorf("%s is not a directory", name)
+		}
+	}
+	return n, nil
+}
+
+// Start begins a new upload session for a file called `name` in the
+// directory at the slash-separated path `dirPath` of the given TLF.
+// The file doesn't appear under its own name until Commit.
+func (usm *UploadSessionManager) Start(
+	ctx context.Context, h *TlfHandle, dirPath, name string) (
+	UploadSessionInfo, error) {
+	idStr, err := MakeRandomRequestID()
+	if err != nil {
+		return UploadSessionInfo{}, err
+	}
+	info := UploadSessionInfo{
+		ID:      UploadSessionID(idStr),
+		TlfName: h.GetCanonicalName(),
+		TlfType: h.Type(),
+		Name:    name,
+		Started: usm.config.Clock().Now(),
+	}
+	for _, p := range strings.Split(dirPath, "/") {
+		if p != "" {
+			info.Dir = append(info.Dir, p)
+		}
+	}
+	usm.log.CDebugf(ctx, "Starting upload session %s for %s/%s",
+		info.ID, dirPath, name)
+
+	dir, err := usm.getDirNode(ctx, info)
+	if err != nil {
+		return UploadSessionInfo{}, err
+	}
+	kbfsOps := usm.config.KBFSOps()
+	_, _, err = kbfsOps.CreateFile(
+		ctx, dir, info.stagingName(), false, WithExcl)
+	if err != nil {
+		return UploadSessionInfo{}, err
+	}
+	err = kbfsOps.SyncAll(ctx, dir.GetFolderBranch())
+	if err != nil {
+		return UploadSessionInfo{}, err
+	}
+
+	err = usm.putSession(info)
+	if err != nil {
+		return UploadSessionInfo{}, err
+	}
+	return info, nil
+}
+
+// Info returns the current state of the given session, so a client
+// can find out where to resume.
+func (usm *UploadSessionManager) Info(id UploadSessionID) (
+	UploadSessionInfo, error) {
+	return usm.getSession(id)
+}
+
+// List returns all the in-progress upload sessions.
+func (usm *UploadSessionManager) List() []UploadSessionInfo {
+	usm.lock.Lock()
+	defer usm.lock.Unlock()
+	infos := make([]UploadSessionInfo, 0, len(usm.sessions))
+	for _, info := range usm.sessions {
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (usm *UploadSessionManager) getStagingNode(
+	ctx context.Context, info UploadSessionInfo) (dir, file Node, err error) {
+	dir, err = usm.getDirNode(ctx, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, _, err = usm.config.KBFSOps().Lookup(ctx, dir, info.stagingName())
+	if err != nil {
+		return nil, nil, err
+	}
+	return dir, file, nil
+}
+
+// Append writes `data` to the session at offset `off`, which must be
+// the session's current offset, and syncs it.  Once it returns
+// successfully, the chunk will survive a restart.  It returns the
+// new offset.
+func (usm *UploadSessionManager) Append(
+	ctx context.Context, id UploadSessionID, off int64, data []byte) (
+	int64, error) {
+	unlock := usm.lockSession(id)
+	defer unlock()
+
+	info, err := usm.getSession(id)
+	if err != nil {
+		return 0, err
+	}
+	if off != info.Offset {
+		return 0, UploadSessionOffsetError{id, info.Offset, off}
+	}
+
+	_, file, err := usm.getStagingNode(ctx, info)
+	if err != nil {
+		return 0, err
+	}
+	kbfsOps := usm.config.KBFSOps()
+	// If an earlier attempt wrote past the recorded offset but didn't
+	// finish, drop those bytes first.
+	err = kbfsOps.Truncate(ctx, file, uint64(off))
+	if err != nil {
+		return 0, err
+	}
+	err = kbfsOps.Write(ctx, file, data, off)
+	if err != nil {
+		return 0, err
+	}
+	err = kbfsOps.SyncAll(ctx, file.GetFolderBranch())
+	if err != nil {
+		return 0, err
+	}
+
+	info.Offset += int64(len(data))
+	err = usm.putSession(info)
+	if err != nil {
+		return 0, err
+	}
+	return info.Offset, nil
+}
+
+// Commit finishes the given session by moving the uploaded data to
+// its final name, replacing any existing file there.
+func (usm *UploadSessionManager) Commit(
+	ctx context.Context, id UploadSessionID) error {
+	unlock := usm.lockSession(id)
+	defer unlock()
+
+	info, err := usm.getSession(id)
+	if err != nil {
+		return err
+	}
+	usm.log.CDebugf(ctx, "Committing upload session %s (%d bytes)",
+		id, info.Offset)
+
+	dir, file, err := usm.getStagingNode(ctx, info)
+	if err != nil {
+		return err
+	}
+	kbfsOps := usm.config.KBFSOps()
+	err = kbfsOps.Truncate(ctx, file, uint64(info.Offset))
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.Rename(ctx, dir, info.stagingName(), dir, info.Name)
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.SyncAll(ctx, dir.GetFolderBranch())
+	if err != nil {
+		return err
+	}
+	return usm.deleteSession(id)
+}
+
+// Abort cancels the given session and deletes its data.
+func (usm *UploadSessionManager) Abort(
+	ctx context.Context, id UploadSessionID) error {
+	unlock := usm.lockSession(id)
+	defer unlock()
+
+	info, err := usm.getSession(id)
+	if err != nil {
+		return err
+	}
+	usm.log.CDebugf(ctx, "Aborting upload session %s", id)
+
+	dir, err := usm.getDirNode(ctx, info)
+	if err != nil {
+		return err
+	}
+	kbfsOps := usm.config.KBFSOps()
+	err = kbfsOps.RemoveEntry(ctx, dir, info.stagingName())
+	switch errors.Cause(err).(type) {
+	case nil:
+		err = kbfsOps.SyncAll(ctx, dir.GetFolderBranch())
+		if err != nil {
+			return err
+		}
+	case NoSuchNameError:
+		// Already gone.
+	default:
+		return err
+	}
+	return usm.deleteSession(id)
+}
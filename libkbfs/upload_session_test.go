@@ -0,0 +1,111 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSessionResumeAndCommit(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "upload_session")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "alice", tlf.Private)
+	require.NoError(t, err)
+	usm, err := NewUploadSessionManager(config, tempdir)
+	require.NoError(t, err)
+	info, err := usm.Start(ctx, h, "/d", "big")
+	require.NoError(t, err)
+
+	off, err := usm.Append(ctx, info.ID, 0, []byte("hello "))
+	require.NoError(t, err)
+	require.Equal(t, int64(6), off)
+
+	_, err = usm.Append(ctx, info.ID, 0, []byte("again"))
+	require.IsType(t, UploadSessionOffsetError{}, errors.Cause(err))
+
+	// A new manager over the same directory, as after a restart,
+	// picks up where the old one left off.
+	usm, err = NewUploadSessionManager(config, tempdir)
+	require.NoError(t, err)
+	require.Len(t, usm.List(), 1)
+	info, err = usm.Info(info.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), info.Offset)
+	off, err = usm.Append(ctx, info.ID, info.Offset, []byte("world"))
+	require.NoError(t, err)
+	require.Equal(t, int64(11), off)
+
+	err = usm.Commit(ctx, info.ID)
+	require.NoError(t, err)
+	require.Len(t, usm.List(), 0)
+	_, err = usm.Info(info.ID)
+	require.IsType(t, UploadSessionNotFoundError{}, errors.Cause(err))
+
+	dirNode, _, err := kbfsOps.Lookup(ctx, rootNode, "d")
+	require.NoError(t, err)
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	fileNode, ei, err := kbfsOps.Lookup(ctx, dirNode, "big")
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), ei.Size)
+	buf := make([]byte, ei.Size)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(buf))
+}
+
+func TestUploadSessionAbort(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "upload_session")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "alice", tlf.Private)
+	require.NoError(t, err)
+	usm, err := NewUploadSessionManager(config, tempdir)
+	require.NoError(t, err)
+	info, err := usm.Start(ctx, h, "", "f")
+	require.NoError(t, err)
+	_, err = usm.Append(ctx, info.ID, 0, []byte("data"))
+	require.NoError(t, err)
+
+	err = usm.Abort(ctx, info.ID)
+	require.NoError(t, err)
+	children, err := config.KBFSOps().GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+
+	usm, err = NewUploadSessionManager(config, tempdir)
+	require.NoError(t, err)
+	require.Len(t, usm.List(), 0)
+}
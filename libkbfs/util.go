@@ -108,6 +108,21 @@ func CtxWithRandomIDReplayable(ctx context.Context, tagKey interface{},
 	})
 }
 
+// CtxWithTagReplayable returns a replayable context with `value`
+// associated with the given log key.  Callers outside of libkbfs can
+// use this to tag requests with their own identifiers, which then
+// show up in the libkbfs logs for any work done on their behalf,
+// including block fetches.
+func CtxWithTagReplayable(ctx context.Context, tagKey interface{},
+	tagName string, value string) context.Context {
+	return NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+		logTags := make(logger.CtxLogTags)
+		logTags[tagKey] = tagName
+		newCtx := logger.NewContextWithLogTags(ctx, logTags)
+		return context.WithValue(newCtx, tagKey, value)
+	})
+}
+
 // checkDataVersion validates that the data version for a
 // block pointer is valid for the given version validator
 func checkDataVersion(versioner dataVersioner, p path, ptr BlockPointer) error {
@@ -0,0 +1,568 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libmirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// BridgeConflictPolicy says how a Bridge resolves a file that has
+// changed both in KBFS and in the external store since they were
+// last synced.  A file that was changed on one side and removed on
+// the other is always kept, whatever the policy.
+type BridgeConflictPolicy int
+
+const (
+	// BridgeConflictKBFSWins keeps the KBFS version of the file,
+	// overwriting the external one.
+	BridgeConflictKBFSWins BridgeConflictPolicy = iota
+	// BridgeConflictExternalWins keeps the external version of the
+	// file, overwriting the KBFS one.
+	BridgeConflictExternalWins
+	// BridgeConflictKeepBoth keeps the KBFS version of the file
+	// under its name, and the external version next to it, under the
+	// name returned by `ConflictPath`, on both sides.
+	BridgeConflictKeepBoth
+)
+
+func (p BridgeConflictPolicy) String() string {
+	switch p {
+	case BridgeConflictKBFSWins:
+		return "kbfs-wins"
+	case BridgeConflictExternalWins:
+		return "external-wins"
+	case BridgeConflictKeepBoth:
+		return "keep-both"
+	default:
+		return fmt.Sprintf("BridgeConflictPolicy(%d)", int(p))
+	}
+}
+
+// ConflictPath returns the path under which BridgeConflictKeepBoth
+// keeps the external version of the conflicted file at `p`.
+func ConflictPath(p string) string {
+	ext := path.Ext(p)
+	return strings.TrimSuffix(p, ext) + ".external-conflict" + ext
+}
+
+const (
+	// Debug tag ID for an individual bridge sync pass.
+	ctxBridgeOpID = "BRDG"
+)
+
+// bridgeSyncState is what the state database remembers about a file
+// that was last seen to be the same in KBFS and the external store:
+// the versions it had on each side.
+type bridgeSyncState struct {
+	KBFSVersion     string `codec:"k"`
+	ExternalVersion string `codec:"e"`
+}
+
+// kbfsFile is a file found in KBFS by a sync pass.
+type kbfsFile struct {
+	parent  libkbfs.Node
+	node    libkbfs.Node
+	ei      libkbfs.EntryInfo
+	version string
+}
+
+func kbfsVersion(ei libkbfs.EntryInfo) string {
+	return fmt.Sprintf("%d-%d", ei.Mtime, ei.Size)
+}
+
+// kbfsWrite is a file a sync pass wrote to KBFS; its KBFS version is
+// only known once the pass syncs its writes.
+type kbfsWrite struct {
+	path            string
+	node            libkbfs.Node
+	externalVersion string
+}
+
+// Bridge keeps a directory in a TLF and an ExternalStore in sync in
+// both directions, for example while migrating data into KBFS.  Only
+// regular files are synced; empty directories, symlinks and the
+// executable bit are not.
+//
+// Each sync pass compares both sides with a state database, which
+// records the versions each file had on both sides the last time
+// they were in sync.  That tells the pass which side changed, so
+// that it can copy the change to the other side, and also keeps the
+// bridge from copying its own writes back to where they came from.
+// All the KBFS writes from a pass are synced to the server together,
+// as a single batch.
+//
+// A pass runs when a Bridge is created, when KBFS notifies it of
+// changes to the TLF, every poll interval (since external stores
+// generally can't notify anyone of changes), and whenever `SyncOnce`
+// is called.
+type Bridge struct {
+	config libkbfs.Config
+	root   libkbfs.Node
+	store  ExternalStore
+	db     *leveldb.DB
+	policy BridgeConflictPolicy
+	log    logger.Logger
+
+	updatesCh chan struct{}
+	cancel    context.CancelFunc
+	doneCh    chan struct{}
+	// passesDone, if set, gets the result of each pass run by the
+	// background loop.  It's only used by tests.
+	passesDone chan<- error
+
+	// syncLock serializes sync passes.
+	syncLock sync.Mutex
+}
+
+var _ libkbfs.Observer = (*Bridge)(nil)
+
+// NewBridge starts syncing `subdir` (which may be empty, for the
+// whole TLF) of the given TLF with `store`, keeping its state
+// database in the local directory `stateDir`.  A `stateDir` must
+// only ever be used with one pair of directory and store; if it's
+// lost, the next pass treats every file that differs between the two
+// sides as a conflict.  If `pollInterval` is positive, the store is
+// checked for changes that often.  The caller must call Shutdown
+// once the Bridge is no longer needed.
+func NewBridge(ctx context.Context, config libkbfs.Config,
+	tlfHandle *libkbfs.TlfHandle, subdir string, store ExternalStore,
+	stateDir string, policy BridgeConflictPolicy,
+	pollInterval time.Duration) (*Bridge, error) {
+	b, err := newBridge(
+		ctx, config, tlfHandle, subdir, store, stateDir, policy)
+	if err != nil {
+		return nil, err
+	}
+	err = b.start(pollInterval)
+	if err != nil {
+		_ = b.db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// start registers for changes to the TLF, and starts running sync
+// passes in the background.
+func (b *Bridge) start(pollInterval time.Duration) error {
+	err := b.config.Notifier().RegisterForChanges(
+		[]libkbfs.FolderBranch{b.root.GetFolderBranch()}, b)
+	if err != nil {
+		return err
+	}
+	loopCtx, cancel := context.WithCancel(
+		libkbfs.BackgroundContextWithCancellationDelayer())
+	b.cancel = cancel
+	b.doneCh = make(chan struct{})
+	go b.run(loopCtx, pollInterval)
+	return nil
+}
+
+// newBridge returns a Bridge that only syncs when `SyncOnce` is
+// called.
+func newBridge(ctx context.Context, config libkbfs.Config,
+	tlfHandle *libkbfs.TlfHandle, subdir string, store ExternalStore,
+	stateDir string, policy BridgeConflictPolicy) (*Bridge, error) {
+	root, err := lookupSubdir(ctx, config, tlfHandle, subdir)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(stateDir, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	b := &Bridge{
+		config:    config,
+		root:      root,
+		store:     store,
+		db:        db,
+		policy:    policy,
+		log:       config.MakeLogger("BRG"),
+		updatesCh: make(chan struct{}, 1),
+		cancel:    func() {},
+		doneCh:    doneCh,
+	}
+	b.log.CDebugf(ctx, "Bridging %s/%s, with conflict policy %s",
+		tlfHandle.GetCanonicalPath(), subdir, policy)
+	return b, nil
+}
+
+// Shutdown stops the syncing, and closes the state database.
+func (b *Bridge) Shutdown() error {
+	b.cancel()
+	<-b.doneCh
+	err := b.config.Notifier().UnregisterFromChanges(
+		[]libkbfs.FolderBranch{b.root.GetFolderBranch()}, b)
+	if err != nil {
+		b.log.CDebugf(nil, "Couldn't unregister from changes: %+v", err)
+	}
+	return errors.WithStack(b.db.Close())
+}
+
+// LocalChange implements the libkbfs.Observer interface for Bridge.
+func (b *Bridge) LocalChange(
+	ctx context.Context, node libkbfs.Node, write libkbfs.WriteRange) {
+	// Unsynced local writes don't get bridged.
+}
+
+// BatchChanges implements the libkbfs.Observer interface for Bridge.
+func (b *Bridge) BatchChanges(
+	ctx context.Context, changes []libkbfs.NodeChange) {
+	select {
+	case b.updatesCh <- struct{}{}:
+	default:
+	}
+}
+
+// TlfHandleChange implements the libkbfs.Observer interface for
+// Bridge.
+func (b *Bridge) TlfHandleChange(
+	ctx context.Context, newHandle *libkbfs.TlfHandle) {
+}
+
+func (b *Bridge) run(ctx context.Context, pollInterval time.Duration) {
+	defer close(b.doneCh)
+	var tickCh <-chan time.Time
+	if pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+	for {
+		passCtx := libkbfs.CtxWithRandomIDReplayable(
+			ctx, ctxIDKey, ctxBridgeOpID, b.log)
+		err := b.SyncOnce(passCtx)
+		if err != nil {
+			b.log.CDebugf(passCtx, "Bridge sync failed: %+v", err)
+		}
+		if b.passesDone != nil {
+			select {
+			case b.passesDone <- err:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-b.updatesCh:
+		case <-tickCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listKBFS adds every file under `dir`, which is at `p`, to `files`.
+func (b *Bridge) listKBFS(ctx context.Context, dir libkbfs.Node, p string,
+	files map[string]kbfsFile) error {
+	children, err := b.config.KBFSOps().GetDirChildrenWithNodes(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for name, child := range children {
+		childPath := path.Join(p, name)
+		switch child.Type {
+		case libkbfs.Dir:
+			err := b.listKBFS(ctx, child.Node, childPath, files)
+			if err != nil {
+				return err
+			}
+		case libkbfs.File, libkbfs.Exec:
+			files[childPath] = kbfsFile{
+				parent:  dir,
+				node:    child.Node,
+				ei:      child.EntryInfo,
+				version: kbfsVersion(child.EntryInfo),
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) loadStates() (map[string]bridgeSyncState, error) {
+	states := make(map[string]bridgeSyncState)
+	iter := b.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var st bridgeSyncState
+		err := b.config.Codec().Decode(iter.Value(), &st)
+		if err != nil {
+			return nil, err
+		}
+		states[string(iter.Key())] = st
+	}
+	return states, errors.WithStack(iter.Error())
+}
+
+func (b *Bridge) putState(
+	batch *leveldb.Batch, p string, st bridgeSyncState) error {
+	buf, err := b.config.Codec().Encode(st)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(p), buf)
+	return nil
+}
+
+// sameFile returns whether a file that changed on both sides since
+// the last sync probably changed the same way, so that it isn't a
+// conflict.  External stores might only keep whole seconds.
+func sameFile(k kbfsFile, e ExternalEntry) bool {
+	return k.ei.Size == uint64(e.Size) &&
+		time.Unix(0, k.ei.Mtime).Truncate(time.Second).Equal(
+			e.Mtime.Truncate(time.Second))
+}
+
+// copyToExternal writes the KBFS file `k` to `p` in the external
+// store.
+func (b *Bridge) copyToExternal(
+	ctx context.Context, p string, k kbfsFile) (ExternalEntry, error) {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(copyFromKBFS(ctx, b.config, k.node, w))
+	}()
+	defer r.Close()
+	return b.store.Write(ctx, p, r, time.Unix(0, k.ei.Mtime))
+}
+
+// copyToKBFS writes the external file `e` at `srcPath` to `p` in
+// KBFS, without syncing it.
+func (b *Bridge) copyToKBFS(ctx context.Context, srcPath, p string,
+	e ExternalEntry) (libkbfs.Node, error) {
+	kbfsOps := b.config.KBFSOps()
+	dir, name := path.Split(p)
+	parent := b.root
+	if dir != "" {
+		var err error
+		parent, _, err = kbfsOps.CreatePath(ctx, b.root, path.Clean(dir))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	node, ei, err := kbfsOps.Lookup(ctx, parent, name)
+	switch errors.Cause(err).(type) {
+	case nil:
+		if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+			return nil, errors.Errorf(
+				"Can't replace non-file %s with a file", p)
+		}
+		err = kbfsOps.Truncate(ctx, node, 0)
+		if err != nil {
+			return nil, err
+		}
+	case libkbfs.NoSuchNameError:
+		node, _, err = kbfsOps.CreateFile(
+			ctx, parent, name, false, libkbfs.NoExcl)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	r, err := b.store.Read(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf := make([]byte, copyBufSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			werr := kbfsOps.Write(ctx, node, buf[:n], off)
+			if werr != nil {
+				return nil, werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	mtime := e.Mtime
+	err = kbfsOps.SetMtime(ctx, node, &mtime)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// SyncOnce runs a sync pass right away, and returns once all of its
+// changes have been written to both sides.
+func (b *Bridge) SyncOnce(ctx context.Context) (err error) {
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	kbfsFiles := make(map[string]kbfsFile)
+	err = b.listKBFS(ctx, b.root, "", kbfsFiles)
+	if err != nil {
+		return err
+	}
+	extFiles, err := b.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	states, err := b.loadStates()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for p := range kbfsFiles {
+		paths = append(paths, p)
+	}
+	for p := range extFiles {
+		if _, ok := kbfsFiles[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	for p := range states {
+		_, kok := kbfsFiles[p]
+		_, eok := extFiles[p]
+		if !kok && !eok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	batch := new(leveldb.Batch)
+	var writes []kbfsWrite
+	toExternal := func(p string, k kbfsFile) error {
+		b.log.CDebugf(ctx, "Copying %s to the external store", p)
+		e, err := b.copyToExternal(ctx, p, k)
+		if err != nil {
+			return err
+		}
+		return b.putState(batch, p, bridgeSyncState{k.version, e.Version})
+	}
+	toKBFS := func(srcPath, p string, e ExternalEntry) error {
+		b.log.CDebugf(ctx, "Copying %s from the external store", p)
+		node, err := b.copyToKBFS(ctx, srcPath, p, e)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, kbfsWrite{p, node, e.Version})
+		return nil
+	}
+
+	for _, p := range paths {
+		k, kok := kbfsFiles[p]
+		e, eok := extFiles[p]
+		st, sok := states[p]
+		kChanged := kok != sok || (kok && k.version != st.KBFSVersion)
+		eChanged := eok != sok || (eok && e.Version != st.ExternalVersion)
+
+		switch {
+		case !kChanged && !eChanged:
+		case !kok && !eok:
+			batch.Delete([]byte(p))
+		case kok && eok && kChanged && eChanged:
+			if sameFile(k, e) {
+				err = b.putState(
+					batch, p, bridgeSyncState{k.version, e.Version})
+				break
+			}
+			b.log.CDebugf(ctx, "Resolving a conflict in %s with policy %s",
+				p, b.policy)
+			switch b.policy {
+			case BridgeConflictExternalWins:
+				err = toKBFS(p, p, e)
+			case BridgeConflictKeepBoth:
+				// Save the external version under the conflict path
+				// on both sides before overwriting it.
+				cp := ConflictPath(p)
+				var r io.ReadCloser
+				r, err = b.store.Read(ctx, p)
+				if err != nil {
+					break
+				}
+				var ce ExternalEntry
+				ce, err = b.store.Write(ctx, cp, r, e.Mtime)
+				r.Close()
+				if err != nil {
+					break
+				}
+				err = toKBFS(cp, cp, ce)
+				if err != nil {
+					break
+				}
+				err = toExternal(p, k)
+			default:
+				err = toExternal(p, k)
+			}
+		case kok && kChanged:
+			err = toExternal(p, k)
+		case eok && eChanged:
+			err = toKBFS(p, p, e)
+		case kok:
+			b.log.CDebugf(ctx, "Removing %s from KBFS", p)
+			err = b.config.KBFSOps().RemoveEntry(ctx, k.parent, path.Base(p))
+			if err == nil {
+				batch.Delete([]byte(p))
+			}
+		default:
+			b.log.CDebugf(ctx, "Removing %s from the external store", p)
+			err = b.store.Remove(ctx, p)
+			if err == nil {
+				batch.Delete([]byte(p))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Whatever happened, record the state of what has already been
+	// copied, so that it isn't mistaken for a conflict next time.
+	defer func() {
+		dbErr := b.db.Write(batch, nil)
+		if err == nil {
+			err = errors.WithStack(dbErr)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+
+	err = b.config.KBFSOps().SyncAll(ctx, b.root.GetFolderBranch())
+	if err != nil {
+		return err
+	}
+	for _, w := range writes {
+		ei, err := b.config.KBFSOps().Stat(ctx, w.node)
+		if err != nil {
+			return err
+		}
+		err = b.putState(batch, w.path, bridgeSyncState{
+			kbfsVersion(ei), w.externalVersion})
+		if err != nil {
+			return err
+		}
+	}
+	b.log.CDebugf(ctx, "Synced %d files from the external store",
+		len(writes))
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libmirror
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// readKBFSTree returns the contents of every file under `root` in
+// `fs`, keyed by slash-separated path.
+func readKBFSTree(t *testing.T, fs billy.Filesystem, root string) (
+	tree map[string]string) {
+	tree = make(map[string]string)
+	var walk func(dir string)
+	walk = func(dir string) {
+		fis, err := fs.ReadDir(dir)
+		require.NoError(t, err)
+		for _, fi := range fis {
+			p := fs.Join(dir, fi.Name())
+			if fi.IsDir() {
+				walk(p)
+				continue
+			}
+			f, err := fs.Open(p)
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(f)
+			require.NoError(t, err)
+			err = f.Close()
+			require.NoError(t, err)
+			rel, err := filepath.Rel(root, p)
+			require.NoError(t, err)
+			tree[filepath.ToSlash(rel)] = string(data)
+		}
+	}
+	walk(root)
+	return tree
+}
+
+func writeLocalFile(t *testing.T, root, p, data string) {
+	localPath := filepath.Join(root, filepath.FromSlash(p))
+	err := os.MkdirAll(filepath.Dir(localPath), 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(localPath, []byte(data), 0644)
+	require.NoError(t, err)
+	// Make sure the version changes, even on file systems with a
+	// coarse mtime.
+	mtime := time.Now().Add(time.Minute)
+	err = os.Chtimes(localPath, mtime, mtime)
+	require.NoError(t, err)
+}
+
+func TestBridge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(
+		libkbfs.BackgroundContextWithCancellationDelayer(), 30*time.Second)
+	defer cancel()
+	config := libkbfs.MakeTestConfigOrBust(t, "user1")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	// Config shutdown doesn't wait for the prefetcher, which could
+	// then log after the test is done.
+	<-config.BlockOps().TogglePrefetcher(false)
+
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "user1", tlf.Private)
+	require.NoError(t, err)
+	fs, err := libfs.NewFS(
+		ctx, config, h, "", "", keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	err = fs.MkdirAll("bridged/a", 0755)
+	require.NoError(t, err)
+	writeFile(t, fs, "bridged/a/x", "kbfs1")
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bridge")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	extRoot := filepath.Join(tempdir, "ext")
+	writeLocalFile(t, extRoot, "b/y", "ext1")
+	store, err := NewLocalDirStore(extRoot)
+	require.NoError(t, err)
+
+	// Sync passes only run when the test asks for them, so that
+	// it can set up conflicts.
+	b, err := newBridge(ctx, config, h, "bridged", store,
+		filepath.Join(tempdir, "state"), BridgeConflictKeepBoth)
+	require.NoError(t, err)
+	defer func() {
+		err := b.Shutdown()
+		require.NoError(t, err)
+	}()
+	check := func(expected map[string]string) {
+		err := b.SyncOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected, readKBFSTree(t, fs, "bridged"))
+		extFiles := readLocalTree(t, extRoot)
+		for p := range extFiles {
+			if strings.HasSuffix(p, "/") {
+				delete(extFiles, p)
+			}
+		}
+		require.Equal(t, expected, extFiles)
+	}
+
+	t.Log("The initial sync copies everything both ways")
+	check(map[string]string{"a/x": "kbfs1", "b/y": "ext1"})
+	extEntries, err := store.List(ctx)
+	require.NoError(t, err)
+	kfi, err := fs.Stat("bridged/b/y")
+	require.NoError(t, err)
+	require.True(t, extEntries["b/y"].Mtime.Equal(kfi.ModTime()))
+
+	t.Log("Changes on each side are copied to the other")
+	writeFile(t, fs, "bridged/a/x", "kbfs2")
+	writeFile(t, fs, "bridged/c", "kbfs3")
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	writeLocalFile(t, extRoot, "b/y", "ext2")
+	writeLocalFile(t, extRoot, "b/z/w", "ext3")
+	expected := map[string]string{
+		"a/x":   "kbfs2",
+		"b/y":   "ext2",
+		"b/z/w": "ext3",
+		"c":     "kbfs3",
+	}
+	check(expected)
+
+	t.Log("The bridge's own writes aren't copied back")
+	extEntries, err = store.List(ctx)
+	require.NoError(t, err)
+	kfi, err = fs.Stat("bridged/b/y")
+	require.NoError(t, err)
+	check(expected)
+	extEntries2, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, extEntries, extEntries2)
+	kfi2, err := fs.Stat("bridged/b/y")
+	require.NoError(t, err)
+	require.True(t, kfi.ModTime().Equal(kfi2.ModTime()))
+
+	t.Log("Removals on each side are copied to the other")
+	err = fs.Remove("bridged/a/x")
+	require.NoError(t, err)
+	err = os.Remove(filepath.Join(extRoot, "b", "z", "w"))
+	require.NoError(t, err)
+	check(map[string]string{"b/y": "ext2", "c": "kbfs3"})
+
+	t.Log("Conflicting changes are both kept")
+	writeFile(t, fs, "bridged/c", "kbfs4")
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	writeLocalFile(t, extRoot, "c", "ext4")
+	check(map[string]string{
+		"b/y":             "ext2",
+		"c":               "kbfs4",
+		ConflictPath("c"): "ext4",
+	})
+
+	t.Log("A change beats a removal")
+	writeLocalFile(t, extRoot, "b/y", "ext5")
+	err = fs.Remove("bridged/b/y")
+	require.NoError(t, err)
+	check(map[string]string{
+		"b/y":             "ext5",
+		"c":               "kbfs4",
+		ConflictPath("c"): "ext4",
+	})
+}
+
+func TestBridgePolling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(
+		libkbfs.BackgroundContextWithCancellationDelayer(), 30*time.Second)
+	defer cancel()
+	config := libkbfs.MakeTestConfigOrBust(t, "user1")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	<-config.BlockOps().TogglePrefetcher(false)
+
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "user1", tlf.Private)
+	require.NoError(t, err)
+	fs, err := libfs.NewFS(
+		ctx, config, h, "", "", keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bridge")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	extRoot := filepath.Join(tempdir, "ext")
+	store, err := NewLocalDirStore(extRoot)
+	require.NoError(t, err)
+	b, err := newBridge(ctx, config, h, "", store,
+		filepath.Join(tempdir, "state"), BridgeConflictExternalWins)
+	require.NoError(t, err)
+	passesDone := make(chan error)
+	b.passesDone = passesDone
+	err = b.start(10 * time.Millisecond)
+	require.NoError(t, err)
+	defer func() {
+		err := b.Shutdown()
+		require.NoError(t, err)
+	}()
+	waitForPass := func() {
+		select {
+		case err := <-passesDone:
+			require.NoError(t, err)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	waitForPass()
+
+	t.Log("External changes are picked up by polling")
+	writeLocalFile(t, extRoot, "a", "ext1")
+	// A pass may have already been running during the write, but
+	// the one after it must have seen the change.
+	waitForPass()
+	waitForPass()
+	f, err := fs.Open("a")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "ext1", string(data))
+}
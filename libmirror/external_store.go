@@ -0,0 +1,187 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libmirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+)
+
+// ExternalEntry describes a file in an ExternalStore.
+type ExternalEntry struct {
+	Size  int64
+	Mtime time.Time
+	// Version must change whenever the contents of the file do,
+	// like an S3 ETag.
+	Version string
+}
+
+// ExternalStore is a store of files outside of KBFS that a Bridge can
+// sync a TLF with, like a local directory or an S3 bucket.  Files are
+// named by slash-separated paths relative to the root of the store;
+// directories are implied by the paths of the files in them, like S3
+// key prefixes.
+type ExternalStore interface {
+	// List returns every file in the store, keyed by path.
+	List(ctx context.Context) (map[string]ExternalEntry, error)
+	// Read returns the contents of the file at `p`.  The caller
+	// must close it.
+	Read(ctx context.Context, p string) (io.ReadCloser, error)
+	// Write replaces the file at `p`, creating it if needed, with
+	// the contents of `r` and modification time `mtime`, and
+	// returns its new entry.
+	Write(ctx context.Context, p string, r io.Reader, mtime time.Time) (
+		ExternalEntry, error)
+	// Remove removes the file at `p`.  It's not an error if the
+	// file doesn't exist.
+	Remove(ctx context.Context, p string) error
+}
+
+// LocalDirStore is an ExternalStore backed by a local directory.
+// Only regular files are stored; empty directories and symlinks in
+// the local directory are ignored.
+type LocalDirStore struct {
+	root string
+}
+
+var _ ExternalStore = (*LocalDirStore)(nil)
+
+// NewLocalDirStore returns an ExternalStore for the local directory
+// `root`, which is created if needed.
+func NewLocalDirStore(root string) (*LocalDirStore, error) {
+	err := ioutil.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalDirStore{root: root}, nil
+}
+
+func localVersion(fi os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (lds *LocalDirStore) localPath(p string) string {
+	return filepath.Join(lds.root, filepath.FromSlash(p))
+}
+
+// List implements the ExternalStore interface for LocalDirStore.
+func (lds *LocalDirStore) List(ctx context.Context) (
+	map[string]ExternalEntry, error) {
+	entries := make(map[string]ExternalEntry)
+	err := filepath.Walk(lds.root,
+		func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() ||
+				strings.HasPrefix(fi.Name(), tmpFilePrefix) {
+				return nil
+			}
+			rel, err := filepath.Rel(lds.root, p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			entries[filepath.ToSlash(rel)] = ExternalEntry{
+				Size:    fi.Size(),
+				Mtime:   fi.ModTime(),
+				Version: localVersion(fi),
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Read implements the ExternalStore interface for LocalDirStore.
+func (lds *LocalDirStore) Read(ctx context.Context, p string) (
+	io.ReadCloser, error) {
+	return ioutil.OpenFile(lds.localPath(p), os.O_RDONLY, 0)
+}
+
+// Write implements the ExternalStore interface for LocalDirStore.
+// The new contents are written to a temporary file first, and then
+// renamed into place.
+func (lds *LocalDirStore) Write(ctx context.Context, p string,
+	r io.Reader, mtime time.Time) (ExternalEntry, error) {
+	localPath := lds.localPath(p)
+	dir := filepath.Dir(localPath)
+	err := ioutil.MkdirAll(dir, 0755)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	tmpPath, err := makeTmpFileName(dir)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	f, err := ioutil.OpenFile(
+		tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	_, err = io.Copy(f, r)
+	closeErr := f.Close()
+	if err != nil {
+		return ExternalEntry{}, errors.WithStack(err)
+	}
+	if closeErr != nil {
+		return ExternalEntry{}, errors.WithStack(closeErr)
+	}
+	err = os.Chtimes(tmpPath, mtime, mtime)
+	if err != nil {
+		return ExternalEntry{}, errors.WithStack(err)
+	}
+	err = ioutil.Rename(tmpPath, localPath)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	renamed = true
+
+	fi, err := ioutil.Lstat(localPath)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	return ExternalEntry{
+		Size:    fi.Size(),
+		Mtime:   fi.ModTime(),
+		Version: localVersion(fi),
+	}, nil
+}
+
+// Remove implements the ExternalStore interface for LocalDirStore.
+// Any directories left empty by the removal are removed too.
+func (lds *LocalDirStore) Remove(ctx context.Context, p string) error {
+	localPath := lds.localPath(p)
+	err := os.Remove(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	for dir := filepath.Dir(localPath); dir != lds.root &&
+		strings.HasPrefix(dir, lds.root); dir = filepath.Dir(dir) {
+		// This fails once it gets to a directory that isn't empty.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
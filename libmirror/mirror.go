@@ -0,0 +1,645 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package libmirror keeps local directories synchronized with
+// directories in KBFS, so that their contents can be served by
+// software that doesn't know about KBFS.
+package libmirror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfssync"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultParallelism is the default number of entries a Mirror
+	// copies at the same time.
+	DefaultParallelism = 10
+
+	// tmpFilePrefix is the prefix of the temporary files new file
+	// contents are written to, before being renamed into place.
+	tmpFilePrefix = ".kbfs_mirror_tmp-"
+
+	// copyBufSize is how much of a file is read from KBFS at once.
+	copyBufSize = 1 << 20
+
+	// Debug tag ID for an individual mirror sync pass.
+	ctxOpID = "MIRR"
+)
+
+type ctxTagKey int
+
+const (
+	ctxIDKey ctxTagKey = iota
+)
+
+// mirroredNode is a KBFS entry that has been copied to the local
+// directory.  Holding on to its Node keeps KBFS sending change
+// notifications for it.
+type mirroredNode struct {
+	node libkbfs.Node
+	// path is the slash-separated path of the entry, relative to
+	// the root of the mirror.
+	path  string
+	isDir bool
+}
+
+// Mirror keeps a local directory synchronized, one way, with a
+// directory in a TLF.  It starts by walking the whole KBFS directory
+// in parallel, and from then on only copies what the TLF's change
+// notifications say has changed.  Anything in the local directory
+// that isn't in KBFS is removed, so the local directory shouldn't be
+// written to by anything else.  New file contents are written to a
+// temporary file first and then renamed into place, so readers of the
+// local directory never see partially-copied files.
+//
+// Symlinks that are absolute, or that point outside of the mirrored
+// directory, are not mirrored.
+//
+// The Config a Mirror uses should not itself be used to write to the
+// TLF, since KBFS doesn't send change notifications for synced local
+// file writes.
+type Mirror struct {
+	config      libkbfs.Config
+	root        libkbfs.Node
+	localRoot   string
+	log         logger.Logger
+	parallelism int
+	sem         chan struct{}
+
+	updatesCh chan struct{}
+	pending   kbfssync.RepeatedWaitGroup
+	cancel    context.CancelFunc
+	doneCh    chan struct{}
+
+	lock       sync.Mutex
+	nodes      map[libkbfs.NodeID]mirroredNode
+	dirtyDirs  map[libkbfs.NodeID]bool
+	dirtyFiles map[libkbfs.NodeID]bool
+	fullSync   bool
+	numPending int
+	lastErr    error
+	// While a sync pass is running, changes to nodes it hasn't
+	// tracked yet are remembered in `untracked`, since the pass
+	// might have looked the nodes up just before they changed.
+	syncing   bool
+	untracked map[libkbfs.NodeID]bool
+}
+
+var _ libkbfs.Observer = (*Mirror)(nil)
+
+// lookupSubdir returns the node for the directory `subdir` of the
+// given TLF, or for its root directory if `subdir` is empty.
+func lookupSubdir(ctx context.Context, config libkbfs.Config,
+	tlfHandle *libkbfs.TlfHandle, subdir string) (libkbfs.Node, error) {
+	root, _, err := config.KBFSOps().GetOrCreateRootNode(
+		ctx, tlfHandle, libkbfs.MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	if subdir == "" {
+		return root, nil
+	}
+	for _, p := range strings.Split(path.Clean(subdir), "/") {
+		var ei libkbfs.EntryInfo
+		root, ei, err = config.KBFSOps().Lookup(ctx, root, p)
+		if err != nil {
+			return nil, err
+		}
+		if ei.Type != libkbfs.Dir {
+			return nil, errors.Errorf("%s is not a directory", subdir)
+		}
+	}
+	return root, nil
+}
+
+// NewMirror starts mirroring `subdir` (which may be empty, to mirror
+// the whole TLF) of the given TLF into `localRoot`, which is created
+// if needed.  At most `parallelism` entries are copied at once; if
+// it's not positive, DefaultParallelism is used.  The caller must
+// call Shutdown once the Mirror is no longer needed.
+func NewMirror(ctx context.Context, config libkbfs.Config,
+	tlfHandle *libkbfs.TlfHandle, subdir, localRoot string,
+	parallelism int) (*Mirror, error) {
+	root, err := lookupSubdir(ctx, config, tlfHandle, subdir)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.MkdirAll(localRoot, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if parallelism <= 0 {
+		parallelism = DefaultParallelism
+	}
+	loopCtx, cancel := context.WithCancel(
+		libkbfs.BackgroundContextWithCancellationDelayer())
+	m := &Mirror{
+		config:      config,
+		root:        root,
+		localRoot:   localRoot,
+		log:         config.MakeLogger("MIR"),
+		parallelism: parallelism,
+		sem:         make(chan struct{}, parallelism),
+		updatesCh:   make(chan struct{}, 1),
+		cancel:      cancel,
+		doneCh:      make(chan struct{}),
+		nodes:       make(map[libkbfs.NodeID]mirroredNode),
+		dirtyDirs:   make(map[libkbfs.NodeID]bool),
+		dirtyFiles:  make(map[libkbfs.NodeID]bool),
+	}
+	m.nodes[root.GetID()] = mirroredNode{node: root, isDir: true}
+
+	err = config.Notifier().RegisterForChanges(
+		[]libkbfs.FolderBranch{root.GetFolderBranch()}, m)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	m.log.CDebugf(ctx, "Mirroring %s/%s to %s",
+		tlfHandle.GetCanonicalPath(), subdir, localRoot)
+	m.markDirty(func() { m.fullSync = true })
+	go m.run(loopCtx)
+	return m, nil
+}
+
+// Shutdown stops the mirroring, leaving the local directory as it
+// is.
+func (m *Mirror) Shutdown() {
+	m.cancel()
+	<-m.doneCh
+	err := m.config.Notifier().UnregisterFromChanges(
+		[]libkbfs.FolderBranch{m.root.GetFolderBranch()}, m)
+	if err != nil {
+		m.log.CDebugf(nil, "Couldn't unregister from changes: %+v", err)
+	}
+}
+
+// Wait blocks until all the changes the Mirror has been notified of
+// so far have been copied to the local directory, and returns the
+// error, if any, from the last time it tried to copy them.
+func (m *Mirror) Wait(ctx context.Context) error {
+	err := m.pending.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastErr
+}
+
+// markDirty records some pending work with `f`, and pokes the
+// syncing goroutine.
+func (m *Mirror) markDirty(f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f()
+	m.addPendingLocked()
+}
+
+func (m *Mirror) addPendingLocked() {
+	m.numPending++
+	m.pending.Add(1)
+	select {
+	case m.updatesCh <- struct{}{}:
+	default:
+	}
+}
+
+// LocalChange implements the libkbfs.Observer interface for Mirror.
+func (m *Mirror) LocalChange(
+	ctx context.Context, node libkbfs.Node, write libkbfs.WriteRange) {
+	// Unsynced local writes don't get mirrored.
+}
+
+// BatchChanges implements the libkbfs.Observer interface for Mirror.
+func (m *Mirror) BatchChanges(
+	ctx context.Context, changes []libkbfs.NodeChange) {
+	// Observers are called with KBFS locks held, so just record
+	// what's changed for the syncing goroutine.
+	m.markDirty(func() {
+		for _, change := range changes {
+			id := change.Node.GetID()
+			mn, ok := m.nodes[id]
+			switch {
+			case !ok:
+				if m.syncing {
+					m.untracked[id] = true
+				}
+			case mn.isDir && len(change.DirUpdated) > 0:
+				m.dirtyDirs[id] = true
+			case !mn.isDir:
+				// Attribute changes, like setting the exec bit, come
+				// without any updated ranges.
+				m.dirtyFiles[id] = true
+			}
+		}
+	})
+}
+
+// TlfHandleChange implements the libkbfs.Observer interface for
+// Mirror.
+func (m *Mirror) TlfHandleChange(
+	ctx context.Context, newHandle *libkbfs.TlfHandle) {
+}
+
+func (m *Mirror) run(ctx context.Context) {
+	defer close(m.doneCh)
+	for {
+		select {
+		case <-m.updatesCh:
+			m.syncPending(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncPending copies everything that has changed since the last
+// pass to the local directory.
+func (m *Mirror) syncPending(ctx context.Context) {
+	ctx = libkbfs.CtxWithRandomIDReplayable(ctx, ctxIDKey, ctxOpID, m.log)
+	m.lock.Lock()
+	fullSync := m.fullSync
+	var dirs, files []mirroredNode
+	for id := range m.dirtyDirs {
+		dirs = append(dirs, m.nodes[id])
+	}
+	for id := range m.dirtyFiles {
+		files = append(files, m.nodes[id])
+	}
+	numPending := m.numPending
+	m.fullSync = false
+	m.dirtyDirs = make(map[libkbfs.NodeID]bool)
+	m.dirtyFiles = make(map[libkbfs.NodeID]bool)
+	m.numPending = 0
+	m.syncing = true
+	m.untracked = make(map[libkbfs.NodeID]bool)
+	m.lock.Unlock()
+	defer func() {
+		for i := 0; i < numPending; i++ {
+			m.pending.Done()
+		}
+	}()
+
+	var err error
+	if fullSync {
+		m.log.CDebugf(ctx, "Syncing the whole mirror")
+		err = m.syncDirs(ctx, []mirroredNode{{node: m.root, isDir: true}}, true)
+	} else {
+		m.log.CDebugf(ctx, "Syncing %d directories and %d files",
+			len(dirs), len(files))
+		err = m.syncDirs(ctx, dirs, false)
+		if err == nil {
+			err = m.syncFiles(ctx, files)
+		}
+	}
+	if err != nil {
+		m.log.CDebugf(ctx, "Mirror sync failed: %+v", err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.syncing = false
+	m.lastErr = err
+	if err != nil {
+		// Start over the next time anything changes.
+		m.fullSync = true
+		return
+	}
+	var missed []libkbfs.NodeID
+	for id := range m.untracked {
+		if _, ok := m.nodes[id]; ok {
+			missed = append(missed, id)
+		}
+	}
+	m.untracked = nil
+	if len(missed) == 0 {
+		return
+	}
+	m.log.CDebugf(ctx, "Resyncing %d entries that changed while "+
+		"being mirrored", len(missed))
+	for _, id := range missed {
+		if m.nodes[id].isDir {
+			m.dirtyDirs[id] = true
+		} else {
+			m.dirtyFiles[id] = true
+		}
+	}
+	// This runs before this pass's work is marked done, so that
+	// `Wait` covers the resync.
+	m.addPendingLocked()
+}
+
+func (m *Mirror) localPath(p string) string {
+	return filepath.Join(m.localRoot, filepath.FromSlash(p))
+}
+
+// track remembers `node` as mirrored at `p`.
+func (m *Mirror) track(node libkbfs.Node, p string, isDir bool) {
+	if node == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.nodes[node.GetID()] = mirroredNode{node: node, path: p, isDir: isDir}
+}
+
+// forget stops tracking the nodes at or under `p`.
+func (m *Mirror) forget(p string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, mn := range m.nodes {
+		if mn.path == p || strings.HasPrefix(mn.path, p+"/") {
+			delete(m.nodes, id)
+		}
+	}
+}
+
+// isTracked returns whether the node for `mn` is still mirrored
+// where it was, since it might have been removed since it was
+// marked dirty.
+func (m *Mirror) isTracked(mn mirroredNode) bool {
+	if mn.node == nil {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	curr, ok := m.nodes[mn.node.GetID()]
+	return ok && curr.path == mn.path
+}
+
+// runTasks runs `tasks`, in parallel as long as there are free
+// slots, and returns the first error.
+func (m *Mirror) runTasks(
+	ctx context.Context, tasks []func(context.Context) error) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, task := range tasks {
+		task := task
+		select {
+		case m.sem <- struct{}{}:
+			eg.Go(func() error {
+				defer func() { <-m.sem }()
+				return task(ctx)
+			})
+		default:
+			// Run it right here, so that nested directories can't
+			// deadlock waiting for slots held by their parents.
+			if err := task(ctx); err != nil {
+				eg.Go(func() error { return err })
+				return eg.Wait()
+			}
+		}
+	}
+	return eg.Wait()
+}
+
+func (m *Mirror) syncDirs(
+	ctx context.Context, dirs []mirroredNode, recursive bool) error {
+	tasks := make([]func(context.Context) error, 0, len(dirs))
+	for _, mn := range dirs {
+		mn := mn
+		if !m.isTracked(mn) {
+			continue
+		}
+		tasks = append(tasks, func(ctx context.Context) error {
+			return m.syncDir(ctx, mn.node, mn.path, recursive)
+		})
+	}
+	return m.runTasks(ctx, tasks)
+}
+
+func (m *Mirror) syncFiles(ctx context.Context, files []mirroredNode) error {
+	tasks := make([]func(context.Context) error, 0, len(files))
+	for _, mn := range files {
+		mn := mn
+		if !m.isTracked(mn) {
+			continue
+		}
+		tasks = append(tasks, func(ctx context.Context) error {
+			ei, err := m.config.KBFSOps().Stat(ctx, mn.node)
+			if err != nil {
+				return err
+			}
+			return m.syncFile(ctx, mn.node, ei, mn.path)
+		})
+	}
+	return m.runTasks(ctx, tasks)
+}
+
+// syncDir makes the local copy of the directory `dir`, at `p`, match
+// its KBFS children.  Subdirectories that already exist locally are
+// only synced if `recursive` is true, since otherwise they'll get
+// their own change notifications.
+func (m *Mirror) syncDir(ctx context.Context, dir libkbfs.Node, p string,
+	recursive bool) error {
+	children, err := m.config.KBFSOps().GetDirChildrenWithNodes(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	localDir := m.localPath(p)
+	fi, err := os.Lstat(localDir)
+	switch {
+	case err == nil && fi.IsDir():
+	case err == nil || os.IsNotExist(err):
+		err = m.replaceWithDir(localDir)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.WithStack(err)
+	}
+
+	// Remove anything that isn't in KBFS anymore, including any
+	// temporary files left behind by an earlier crash.
+	localChildren, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	for _, lfi := range localChildren {
+		name := lfi.Name()
+		if _, ok := children[name]; ok {
+			continue
+		}
+		childPath := path.Join(p, name)
+		m.forget(childPath)
+		err := ioutil.RemoveAll(m.localPath(childPath))
+		if err != nil {
+			return err
+		}
+	}
+
+	tasks := make([]func(context.Context) error, 0, len(children))
+	for name, child := range children {
+		child := child
+		childPath := path.Join(p, name)
+		m.track(child.Node, childPath, child.Type == libkbfs.Dir)
+		switch child.Type {
+		case libkbfs.Dir:
+			fi, err := os.Lstat(m.localPath(childPath))
+			if !recursive && err == nil && fi.IsDir() {
+				continue
+			}
+			tasks = append(tasks, func(ctx context.Context) error {
+				return m.syncDir(ctx, child.Node, childPath, true)
+			})
+		case libkbfs.File, libkbfs.Exec:
+			tasks = append(tasks, func(ctx context.Context) error {
+				return m.syncFile(ctx, child.Node, child.EntryInfo, childPath)
+			})
+		case libkbfs.Sym:
+			err := m.syncSymlink(ctx, child.SymPath, childPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return m.runTasks(ctx, tasks)
+}
+
+// replaceWithDir makes sure there is a directory at `localPath`,
+// removing anything else that's there.
+func (m *Mirror) replaceWithDir(localPath string) error {
+	err := ioutil.RemoveAll(localPath)
+	if err != nil {
+		return err
+	}
+	return ioutil.Mkdir(localPath, 0755)
+}
+
+func makeTmpFileName(dir string) (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return filepath.Join(
+		dir, tmpFilePrefix+base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// syncFile copies the KBFS file `file`, with entry info `ei`, to
+// `p`, unless the local copy already has the same size, mtime and
+// mode.
+func (m *Mirror) syncFile(ctx context.Context, file libkbfs.Node,
+	ei libkbfs.EntryInfo, p string) error {
+	localPath := m.localPath(p)
+	mode := os.FileMode(0644)
+	if ei.Type == libkbfs.Exec {
+		mode = 0755
+	}
+	mtime := time.Unix(0, ei.Mtime)
+	fi, err := os.Lstat(localPath)
+	if err == nil && fi.Mode().IsRegular() && fi.Mode().Perm() == mode &&
+		fi.Size() == int64(ei.Size) && fi.ModTime().Equal(mtime) {
+		return nil
+	}
+
+	tmpPath, err := makeTmpFileName(filepath.Dir(localPath))
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.OpenFile(
+		tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	err = copyFromKBFS(ctx, m.config, file, f)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return errors.WithStack(closeErr)
+	}
+	// Make sure the mode isn't affected by the umask.
+	err = os.Chmod(tmpPath, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Chtimes(tmpPath, mtime, mtime)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if fi != nil && fi.IsDir() {
+		err = ioutil.RemoveAll(localPath)
+		if err != nil {
+			return err
+		}
+	}
+	err = ioutil.Rename(tmpPath, localPath)
+	if err != nil {
+		return err
+	}
+	renamed = true
+	return nil
+}
+
+// copyFromKBFS writes the contents of the KBFS file `file` to `w`.
+func copyFromKBFS(ctx context.Context, config libkbfs.Config,
+	file libkbfs.Node, w io.Writer) error {
+	buf := make([]byte, copyBufSize)
+	var off int64
+	for {
+		n, err := config.KBFSOps().Read(ctx, file, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		off += n
+	}
+}
+
+// syncSymlink makes the local entry at `p` a symlink to `target`,
+// unless that would point outside of the mirror, in which case it
+// removes the local entry.
+func (m *Mirror) syncSymlink(ctx context.Context, target, p string) error {
+	localPath := m.localPath(p)
+	dest := path.Clean(path.Join(path.Dir(p), target))
+	if path.IsAbs(target) || dest == ".." || strings.HasPrefix(dest, "../") {
+		m.log.CDebugf(ctx, "Not mirroring symlink %s to %s, since it "+
+			"points outside the mirror", p, target)
+		return ioutil.RemoveAll(localPath)
+	}
+
+	localTarget := filepath.FromSlash(target)
+	if curr, err := os.Readlink(localPath); err == nil &&
+		curr == localTarget {
+		return nil
+	}
+	err := ioutil.RemoveAll(localPath)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.Symlink(localTarget, localPath))
+}
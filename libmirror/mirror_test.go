@@ -0,0 +1,163 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libmirror
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+func writeFile(t *testing.T, fs billy.Filesystem, name, data string) {
+	f, err := fs.Create(name)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte(data))
+	require.NoError(t, err)
+}
+
+// readLocalTree returns the contents of every file, and the target
+// of every symlink, under `root`, keyed by slash-separated path.
+func readLocalTree(t *testing.T, root string) map[string]string {
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(root, p)
+		require.NoError(t, err)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case fi.IsDir():
+			if rel != "." {
+				tree[rel+"/"] = ""
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			require.NoError(t, err)
+			tree[rel] = "-> " + filepath.ToSlash(target)
+		default:
+			data, err := ioutil.ReadFile(p)
+			require.NoError(t, err)
+			tree[rel] = string(data)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return tree
+}
+
+func TestMirror(t *testing.T) {
+	ctx, cancel := context.WithTimeout(
+		libkbfs.BackgroundContextWithCancellationDelayer(), 30*time.Second)
+	defer cancel()
+	config := libkbfs.MakeTestConfigOrBust(t, "user1", "user2")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	// The mirror reads the public TLF as another user.
+	config2 := libkbfs.ConfigAsUser(config, "user2")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config2)
+	// Config shutdown doesn't wait for the prefetchers, which could
+	// then log after the test is done.
+	<-config.BlockOps().TogglePrefetcher(false)
+	<-config2.BlockOps().TogglePrefetcher(false)
+
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, config.KBPKI(), config.MDOps(), "user1", tlf.Public)
+	require.NoError(t, err)
+	fs, err := libfs.NewFS(
+		ctx, config, h, "", "", keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	t.Log("Mirror some existing files, skipping the escaping symlinks")
+	err = fs.MkdirAll("site/dir", 0755)
+	require.NoError(t, err)
+	writeFile(t, fs, "site/index.html", "hello")
+	writeFile(t, fs, "site/dir/a", "a")
+	writeFile(t, fs, "outside", "secret")
+	err = fs.Symlink("dir/a", "site/link")
+	require.NoError(t, err)
+	err = fs.Symlink("../outside", "site/escape")
+	require.NoError(t, err)
+	err = fs.Symlink("/etc/passwd", "site/abs")
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	localRoot := filepath.Join(tempdir, "www")
+	// Leftovers in the local directory get cleaned up.
+	err = os.MkdirAll(filepath.Join(localRoot, "old"), 0755)
+	require.NoError(t, err)
+
+	h2, err := libkbfs.ParseTlfHandle(
+		ctx, config2.KBPKI(), config2.MDOps(), "user1", tlf.Public)
+	require.NoError(t, err)
+	m, err := NewMirror(ctx, config2, h2, "site", localRoot, 2)
+	require.NoError(t, err)
+	defer m.Shutdown()
+	err = m.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"index.html": "hello",
+		"dir/":       "",
+		"dir/a":      "a",
+		"link":       "-> dir/a",
+	}, readLocalTree(t, localRoot))
+
+	t.Log("Changes are mirrored incrementally")
+	writeFile(t, fs, "site/index.html", "goodbye")
+	err = fs.MkdirAll("site/dir/sub", 0755)
+	require.NoError(t, err)
+	writeFile(t, fs, "site/dir/sub/b", "b")
+	err = fs.Rename("site/dir/a", "site/c")
+	require.NoError(t, err)
+	err = fs.Remove("site/link")
+	require.NoError(t, err)
+	err = fs.Chmod("site/c", 0755)
+	require.NoError(t, err)
+	writeFile(t, fs, "outside", "still secret")
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(
+		ctx, m.root.GetFolderBranch(), nil)
+	require.NoError(t, err)
+	err = m.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"index.html": "goodbye",
+		"c":          "a",
+		"dir/":       "",
+		"dir/sub/":   "",
+		"dir/sub/b":  "b",
+	}, readLocalTree(t, localRoot))
+
+	fi, err := os.Stat(filepath.Join(localRoot, "c"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	kfi, err := fs.Stat("site/c")
+	require.NoError(t, err)
+	require.True(t, kfi.ModTime().Equal(fi.ModTime()))
+
+	// No temporary files are left behind.
+	infos, err := ioutil.ReadDir(localRoot)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"c", "dir", "index.html"}, names)
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libmirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/pkg/errors"
+)
+
+// S3Store is an ExternalStore backed by the objects under a key
+// prefix in an S3 bucket.  S3 doesn't let clients set the
+// modification time of an object, so the modification times it
+// reports are always those of the last upload.
+type S3Store struct {
+	client   *http.Client
+	signer   *aws.V4Signer
+	endpoint string
+	bucket   string
+	prefix   string
+}
+
+var _ ExternalStore = (*S3Store)(nil)
+
+// NewS3Store returns an ExternalStore for the objects under `prefix`
+// (which may be empty, for the whole bucket) in the given S3 bucket.
+func NewS3Store(auth *aws.Auth, region aws.Region, bucket,
+	prefix string) *S3Store {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Store{
+		client:   http.DefaultClient,
+		signer:   aws.NewV4Signer(auth, "s3", region),
+		endpoint: strings.TrimSuffix(region.S3Endpoint, "/"),
+		bucket:   bucket,
+		prefix:   prefix,
+	}
+}
+
+// objectURL returns the path-style URL of the object for `p`.
+func (s *S3Store) objectURL(p string) string {
+	parts := strings.Split(s.prefix+p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return s.endpoint + "/" + url.PathEscape(s.bucket) + "/" +
+		strings.Join(parts, "/")
+}
+
+// do sends a signed request, and returns the response if it was
+// successful.  The caller must close the response body.
+func (s *S3Store) do(ctx context.Context, method, u string,
+	body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	hash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+	s.signer.Sign(req)
+	if len(body) == 0 {
+		// The signer always replaces the body, which would make
+		// requests without one be sent chunked.
+		req.Body = http.NoBody
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.Errorf("S3 %s %s failed: %s: %s",
+			method, u, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List implements the ExternalStore interface for S3Store.  Objects
+// whose keys end in a slash, which some tools use to mark
+// directories, are ignored.
+func (s *S3Store) List(ctx context.Context) (
+	map[string]ExternalEntry, error) {
+	entries := make(map[string]ExternalEntry)
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, "GET", s.endpoint+"/"+
+			url.PathEscape(s.bucket)+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, c := range res.Contents {
+			p := strings.TrimPrefix(c.Key, s.prefix)
+			if p == "" || strings.HasSuffix(p, "/") {
+				continue
+			}
+			entries[p] = ExternalEntry{
+				Size:    c.Size,
+				Mtime:   c.LastModified,
+				Version: strings.Trim(c.ETag, `"`),
+			}
+		}
+		if !res.IsTruncated {
+			return entries, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Read implements the ExternalStore interface for S3Store.
+func (s *S3Store) Read(ctx context.Context, p string) (
+	io.ReadCloser, error) {
+	resp, err := s.do(ctx, "GET", s.objectURL(p), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Write implements the ExternalStore interface for S3Store.  The
+// contents are buffered in memory, since requests must be signed
+// with their hash, and `mtime` is ignored.
+func (s *S3Store) Write(ctx context.Context, p string,
+	r io.Reader, mtime time.Time) (ExternalEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	resp, err := s.do(ctx, "PUT", s.objectURL(p), data)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	resp.Body.Close()
+
+	// The upload response doesn't say what modification time S3
+	// gave the object, so ask for it.
+	resp, err = s.do(ctx, "HEAD", s.objectURL(p), nil)
+	if err != nil {
+		return ExternalEntry{}, err
+	}
+	resp.Body.Close()
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return ExternalEntry{}, errors.WithStack(err)
+	}
+	return ExternalEntry{
+		Size:    int64(len(data)),
+		Mtime:   lastModified,
+		Version: strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
+}
+
+// Remove implements the ExternalStore interface for S3Store.
+func (s *S3Store) Remove(ctx context.Context, p string) error {
+	resp, err := s.do(ctx, "DELETE", s.objectURL(p), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/keybase/kbfs/libpages/config"
+)
+
+// Default caching headers, for paths the site config has no policy
+// for.  Sites can change at any time, so they're kept short: HTML is
+// revalidated often so new revisions show up quickly, while assets,
+// which are usually referenced from HTML, can be kept a bit longer.
+const (
+	cacheControlHTML    = "public, max-age=60"
+	cacheControlAsset   = "public, max-age=3600"
+	cacheControlDefault = "public, max-age=300"
+	// cacheControlPrivate is used for responses that needed
+	// authentication, so CDNs and other shared caches never keep them.
+	cacheControlPrivate = "private, max-age=0, must-revalidate"
+)
+
+// assetExtensions are the file extensions that get cacheControlAsset
+// by default.
+var assetExtensions = map[string]bool{
+	".css": true, ".js": true, ".mjs": true, ".map": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".svg": true, ".ico": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp3": true, ".mp4": true, ".webm": true, ".ogg": true,
+}
+
+// defaultCacheControl returns the caching headers for `requestPath`
+// when the site config has none, based on its file type.
+func defaultCacheControl(requestPath string) config.CacheControl {
+	if strings.HasSuffix(requestPath, "/") {
+		// A directory, served as its index.html or a listing.
+		return config.CacheControl{CacheControl: cacheControlHTML}
+	}
+	ext := strings.ToLower(path.Ext(requestPath))
+	switch {
+	case ext == "" || ext == ".html" || ext == ".htm":
+		return config.CacheControl{CacheControl: cacheControlHTML}
+	case assetExtensions[ext]:
+		return config.CacheControl{CacheControl: cacheControlAsset}
+	default:
+		return config.CacheControl{CacheControl: cacheControlDefault}
+	}
+}
+
+// getCacheControl returns the caching headers for a response to a
+// request for `requestPath`, according to `cfg`.  Responses that
+// needed authentication are always private, whatever the config
+// says, so that a CDN in front of the site can't serve them to anyone
+// else.
+func getCacheControl(cfg config.Config, requestPath string,
+	authenticated bool) config.CacheControl {
+	if authenticated {
+		return config.CacheControl{CacheControl: cacheControlPrivate}
+	}
+	cleanPath := path.Clean("/" + requestPath)
+	if cc, ok := cfg.GetCacheControl(cleanPath); ok {
+		return cc
+	}
+	return defaultCacheControl(requestPath)
+}
+
+// cacheControlResponseWriter is an http.ResponseWriter that adds
+// caching headers to successful responses and redirects.  Error
+// responses are left alone, so a CDN doesn't keep serving a transient
+// error.
+type cacheControlResponseWriter struct {
+	http.ResponseWriter
+	cc          config.CacheControl
+	wroteHeader bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface for
+// cacheControlResponseWriter.
+func (w *cacheControlResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status < http.StatusBadRequest {
+		h := w.ResponseWriter.Header()
+		if w.cc.CacheControl != "" {
+			h.Set("Cache-Control", w.cc.CacheControl)
+		}
+		if w.cc.SurrogateControl != "" {
+			h.Set("Surrogate-Control", w.cc.SurrogateControl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface for
+// cacheControlResponseWriter.
+func (w *cacheControlResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements the http.Flusher interface for
+// cacheControlResponseWriter, if the wrapped writer supports it.
+func (w *cacheControlResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
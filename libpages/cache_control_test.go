@@ -0,0 +1,75 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keybase/kbfs/libpages/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCacheControl(t *testing.T) {
+	cfg := config.DefaultV1()
+	for p, expected := range map[string]string{
+		"/":                cacheControlHTML,
+		"/blog/":           cacheControlHTML,
+		"/index.html":      cacheControlHTML,
+		"/about":           cacheControlHTML,
+		"/css/site.CSS":    cacheControlAsset,
+		"/img/logo.png":    cacheControlAsset,
+		"/files/notes.pdf": cacheControlDefault,
+	} {
+		require.Equal(t, config.CacheControl{CacheControl: expected},
+			getCacheControl(cfg, p, false), p)
+	}
+
+	cfg = &config.V1{
+		Common: config.Common{Version: config.Version1Str},
+		CacheControl: map[string]config.CacheControlV1{
+			"/static/*": {
+				CacheControl:     "public, max-age=60",
+				SurrogateControl: "max-age=31536000",
+			},
+		},
+	}
+	require.NoError(t, cfg.EnsureInit())
+	require.Equal(t, config.CacheControl{
+		CacheControl:     "public, max-age=60",
+		SurrogateControl: "max-age=31536000",
+	}, getCacheControl(cfg, "/static/../static/a.js", false))
+	require.Equal(t, config.CacheControl{CacheControl: cacheControlAsset},
+		getCacheControl(cfg, "/a.js", false))
+
+	t.Log("Authenticated responses are always private")
+	require.Equal(t, config.CacheControl{CacheControl: cacheControlPrivate},
+		getCacheControl(cfg, "/static/a.js", true))
+}
+
+func TestCacheControlResponseWriter(t *testing.T) {
+	cc := config.CacheControl{
+		CacheControl:     "public, max-age=60",
+		SurrogateControl: "max-age=600",
+	}
+
+	t.Log("An implicit 200 gets the headers")
+	w := httptest.NewRecorder()
+	ccw := &cacheControlResponseWriter{ResponseWriter: w, cc: cc}
+	_, err := ccw.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, cc.CacheControl, w.Header().Get("Cache-Control"))
+	require.Equal(t, cc.SurrogateControl, w.Header().Get("Surrogate-Control"))
+
+	t.Log("Errors don't")
+	w = httptest.NewRecorder()
+	ccw = &cacheControlResponseWriter{ResponseWriter: w, cc: cc}
+	ccw.WriteHeader(http.StatusNotFound)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Empty(t, w.Header().Get("Cache-Control"))
+	require.Empty(t, w.Header().Get("Surrogate-Control"))
+}
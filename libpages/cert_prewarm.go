@@ -0,0 +1,158 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// certPrewarmInterval is how often all the pre-warmed domains are
+	// checked again.  The ACME manager renews the certificates it has
+	// loaded on its own, so this is mostly for catching domains whose
+	// renewals have failed for good, or that have only just got their
+	// DNS records.
+	certPrewarmInterval = 6 * time.Hour
+	// Rounds with failures are retried sooner, starting at
+	// certPrewarmMinRetry and doubling up to certPrewarmInterval.
+	certPrewarmMinRetry = time.Minute
+	// certPrewarmConcurrency bounds the number of certificates being
+	// loaded or issued at once, to go easy on the ACME server's rate
+	// limits.
+	certPrewarmConcurrency = 4
+	// certExpiryWarning is how close to expiry a pre-warmed certificate
+	// can be before it's logged as a warning, since that means the ACME
+	// manager has failed to renew it.
+	certExpiryWarning = 7 * 24 * time.Hour
+)
+
+// certGetter gets the certificate for a TLS handshake, issuing it if
+// needed.  It's implemented by *autocert.Manager.
+type certGetter interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// certPrewarmer loads or issues certificates for a fixed list of
+// domains ahead of the first requests for them, so that visitors don't
+// have to wait for ACME issuance after a deploy.  Certificates go
+// through the same host policy as handshakes do.
+type certPrewarmer struct {
+	log     *zap.Logger
+	getter  certGetter
+	domains []string
+	now     func() time.Time
+}
+
+func makeCertPrewarmer(log *zap.Logger, getter certGetter,
+	domains []string) *certPrewarmer {
+	return &certPrewarmer{
+		log:     log,
+		getter:  getter,
+		domains: domains,
+		now:     time.Now,
+	}
+}
+
+// prewarmDomain gets the certificate for `domain`, and returns whether
+// that worked.
+func (p *certPrewarmer) prewarmDomain(domain string) bool {
+	start := p.now()
+	cert, err := p.getter.GetCertificate(&tls.ClientHelloInfo{
+		ServerName: domain,
+	})
+	latency := p.now().Sub(start)
+	if err != nil {
+		p.log.Warn("certPrewarmer: getting certificate failed",
+			zap.String("domain", domain), zap.Duration("latency", latency),
+			zap.Error(err))
+		return false
+	}
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			p.log.Warn("certPrewarmer: parsing certificate failed",
+				zap.String("domain", domain), zap.Error(err))
+			return false
+		}
+	}
+	if leaf == nil {
+		p.log.Warn("certPrewarmer: empty certificate",
+			zap.String("domain", domain))
+		return false
+	}
+	if leaf.NotAfter.Sub(p.now()) < certExpiryWarning {
+		p.log.Warn("certPrewarmer: certificate expires soon",
+			zap.String("domain", domain), zap.Time("notAfter", leaf.NotAfter))
+	} else {
+		p.log.Debug("certPrewarmer: certificate ready",
+			zap.String("domain", domain), zap.Time("notAfter", leaf.NotAfter),
+			zap.Duration("latency", latency))
+	}
+	return true
+}
+
+// prewarmOnce gets the certificates for all the domains, and returns
+// the number that failed.
+func (p *certPrewarmer) prewarmOnce(ctx context.Context) (failed int) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	sem := make(chan struct{}, certPrewarmConcurrency)
+loop:
+	for _, domain := range p.domains {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if !p.prewarmDomain(domain) {
+				lock.Lock()
+				defer lock.Unlock()
+				failed++
+			}
+		}(domain)
+	}
+	wg.Wait()
+	return failed
+}
+
+// run pre-warms the certificates right away, and then periodically
+// until ctx is done.
+func (p *certPrewarmer) run(ctx context.Context) {
+	retry := certPrewarmMinRetry
+	for {
+		failed := p.prewarmOnce(ctx)
+		p.log.Info("certPrewarmer: round done",
+			zap.Int("domains", len(p.domains)), zap.Int("failed", failed))
+		next := certPrewarmInterval
+		if failed > 0 {
+			next = retry
+			retry *= 2
+			if retry > certPrewarmInterval {
+				retry = certPrewarmInterval
+			}
+		} else {
+			retry = certPrewarmMinRetry
+		}
+		select {
+		case <-time.After(next):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type testCertGetter struct {
+	lock      sync.Mutex
+	requested map[string]int
+	notAfter  map[string]time.Time
+}
+
+func (g *testCertGetter) GetCertificate(hello *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.requested[hello.ServerName]++
+	notAfter, ok := g.notAfter[hello.ServerName]
+	if !ok {
+		return nil, errors.New("no kbp TXT record")
+	}
+	return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: notAfter}}, nil
+}
+
+func TestCertPrewarmer(t *testing.T) {
+	now := time.Now()
+	getter := &testCertGetter{
+		requested: make(map[string]int),
+		notAfter: map[string]time.Time{
+			"a.example.com": now.Add(60 * 24 * time.Hour),
+			"b.example.com": now.Add(time.Hour),
+		},
+	}
+	domains := []string{
+		"a.example.com", "b.example.com", "c.example.com",
+		"d.example.com", "e.example.com",
+	}
+	p := makeCertPrewarmer(zap.NewNop(), getter, domains)
+
+	t.Log("Every domain is requested once a round, and failures are counted")
+	require.Equal(t, 3, p.prewarmOnce(context.Background()))
+	for _, d := range domains {
+		require.Equal(t, 1, getter.requested[d], d)
+	}
+
+	t.Log("Nothing is requested once the context is done")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx)
+	for _, d := range domains {
+		require.Equal(t, 1, getter.requested[d], d)
+	}
+}
@@ -59,6 +59,48 @@ func parseVersion(s string) (Version, error) {
 	}
 }
 
+// Webhook is an HTTP callback that kbpagesd fires whenever the TLF hosting a
+// site gets a new revision.
+type Webhook struct {
+	// URL is where the callback is POSTed to.
+	URL string
+	// Secret, if not empty, is used to sign the body of the callback with
+	// HMAC-SHA256.
+	Secret string
+}
+
+const (
+	// ErrorPageNotFound is the error page key for 404 responses.
+	ErrorPageNotFound = "404"
+	// ErrorPageServerError is the error page key for all 5xx
+	// responses, including those served in maintenance mode.
+	ErrorPageServerError = "50x"
+)
+
+// ErrorPageKey returns the error page key that applies to responses with
+// the given HTTP status code, if any.
+func ErrorPageKey(status int) (key string, ok bool) {
+	switch {
+	case status == 404:
+		return ErrorPageNotFound, true
+	case status >= 500 && status < 600:
+		return ErrorPageServerError, true
+	default:
+		return "", false
+	}
+}
+
+// CacheControl holds the caching headers for responses.
+type CacheControl struct {
+	// CacheControl is the value of the Cache-Control header, which applies
+	// to browsers and, unless SurrogateControl is set, CDNs too.
+	CacheControl string
+	// SurrogateControl, if not empty, is the value of the
+	// Surrogate-Control header, which CDNs such as Fastly obey instead of
+	// Cache-Control, and strip before responding.
+	SurrogateControl string
+}
+
 // Config is a collection of methods for getting different configuration
 // parameters.
 type Config interface {
@@ -67,6 +109,16 @@ type Config interface {
 	GetPermissionsForAnonymous(path string) (read, list bool, realm string, err error)
 	GetPermissionsForUsername(
 		path, username string) (read, list bool, realm string, err error)
+	GetWebhooks() []Webhook
+	// GetErrorPages returns an error page key -> path map, of the pages
+	// under the site root to serve in place of generic error responses.
+	GetErrorPages() map[string]string
+	// InMaintenance returns whether the site is down for maintenance, in
+	// which case every request gets a 503.
+	InMaintenance() bool
+	// GetCacheControl returns the caching headers configured for responses
+	// for path, if any are.
+	GetCacheControl(path string) (cc CacheControl, ok bool)
 
 	Encode(w io.Writer, prettify bool) error
 }
@@ -29,6 +29,13 @@ func TestParseConfig(t *testing.T) {
 				},
 			},
 		},
+		Webhooks: []WebhookV1{
+			{URL: "https://example.com/build", Secret: "shh"},
+		},
+		ErrorPages: map[string]string{
+			ErrorPageNotFound: "/404.html",
+		},
+		Maintenance: true,
 	}
 	buf := &bytes.Buffer{}
 	err := json.NewEncoder(buf).Encode(config)
@@ -40,4 +47,7 @@ func TestParseConfig(t *testing.T) {
 	require.Equal(t, config.ACLs, parsedV1.ACLs)
 	require.Equal(t, config.Common, parsedV1.Common)
 	require.Equal(t, config.Users, parsedV1.Users)
+	require.Equal(t, config.Webhooks, parsedV1.Webhooks)
+	require.Equal(t, config.ErrorPages, parsedV1.ErrorPages)
+	require.True(t, parsedV1.InMaintenance())
 }
@@ -7,6 +7,8 @@ package config
 import (
 	"encoding/json"
 	"io"
+	"net/url"
+	"path"
 	"strings"
 	"sync"
 
@@ -33,6 +35,28 @@ type AccessControlV1 struct {
 	AnonymousPermissions string `json:"anonymous_permissions"`
 }
 
+// WebhookV1 defines an HTTP callback for the V1 config, which is POSTed to
+// whenever the TLF hosting the site gets a new revision.
+type WebhookV1 struct {
+	// URL is the absolute http or https URL the callback is sent to.
+	URL string `json:"url"`
+	// Secret, if set, is used to sign the body of each callback with
+	// HMAC-SHA256. Keep in mind that the config file of a site in a public
+	// TLF can be read by anyone.
+	Secret string `json:"secret,omitempty"`
+}
+
+// CacheControlV1 defines the caching headers for the V1 config, for
+// responses under a path pattern.
+type CacheControlV1 struct {
+	// CacheControl is the Cache-Control header value, e.g.
+	// "public, max-age=3600".
+	CacheControl string `json:"cache_control,omitempty"`
+	// SurrogateControl, if set, is the Surrogate-Control header value, e.g.
+	// "max-age=86400".
+	SurrogateControl string `json:"surrogate_control,omitempty"`
+}
+
 // V1 defines a V1 config. Public fields are accessible by `json`
 // encoders and decoder.
 //
@@ -51,9 +75,31 @@ type V1 struct {
 	// paths.
 	ACLs map[string]AccessControlV1 `json:"acls"`
 
-	initOnce          sync.Once
-	aclChecker        *aclCheckerV1
-	aclCheckerInitErr error
+	// Webhooks is a list of HTTP callbacks fired when the site's TLF gets
+	// a new revision.
+	Webhooks []WebhookV1 `json:"webhooks,omitempty"`
+
+	// ErrorPages is an error page key -> path map that defines custom pages
+	// to serve with error responses. Keys are ErrorPageNotFound ("404") and
+	// ErrorPageServerError ("50x"), and paths are absolute paths under the
+	// site root, e.g. "/404.html". The pages are served regardless of ACLs.
+	ErrorPages map[string]string `json:"error_pages,omitempty"`
+
+	// Maintenance, if true, makes kbpagesd respond to every request with a
+	// 503, and the "50x" error page if there is one.
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// CacheControl is a path pattern -> CacheControlV1 map that defines the
+	// caching headers of responses. Patterns containing a "/" are matched,
+	// using path.Match, against the whole path, e.g. "/assets/*"; others
+	// are matched against the last element, e.g. "*.css". If more than one
+	// pattern matches, the longest one wins. Paths that no pattern matches
+	// get defaults based on their file type.
+	CacheControl map[string]CacheControlV1 `json:"cache_control,omitempty"`
+
+	initOnce   sync.Once
+	aclChecker *aclCheckerV1
+	initErr    error
 }
 
 var _ Config = (*V1)(nil)
@@ -75,16 +121,63 @@ func DefaultV1() *V1 {
 	return v1
 }
 
-func (c *V1) initACLChecker() {
-	c.aclChecker, c.aclCheckerInitErr = makeACLCheckerV1(c.ACLs, c.Users)
+func checkWebhooksV1(webhooks []WebhookV1) error {
+	for _, webhook := range webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || !u.IsAbs() ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalidWebhookURL{webhook.URL}
+		}
+	}
+	return nil
+}
+
+func checkErrorPagesV1(errorPages map[string]string) error {
+	for key, p := range errorPages {
+		if key != ErrorPageNotFound && key != ErrorPageServerError {
+			return ErrInvalidErrorPage{key: key, path: p}
+		}
+		if !strings.HasPrefix(p, "/") || path.Clean(p) != p || p == "/" {
+			return ErrInvalidErrorPage{key: key, path: p}
+		}
+	}
+	return nil
+}
+
+func checkCacheControlV1(cacheControl map[string]CacheControlV1) error {
+	for pattern := range cacheControl {
+		if pattern == "" {
+			return ErrInvalidCacheControlPattern{pattern}
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return ErrInvalidCacheControlPattern{pattern}
+		}
+	}
+	return nil
+}
+
+func (c *V1) init() {
+	c.aclChecker, c.initErr = makeACLCheckerV1(c.ACLs, c.Users)
+	if c.initErr != nil {
+		return
+	}
+	c.initErr = checkWebhooksV1(c.Webhooks)
+	if c.initErr != nil {
+		return
+	}
+	c.initErr = checkErrorPagesV1(c.ErrorPages)
+	if c.initErr != nil {
+		return
+	}
+	c.initErr = checkCacheControlV1(c.CacheControl)
 }
 
 // EnsureInit initializes c, and returns any error encountered during the
 // initialization. It is not necessary to call EnsureInit. Methods that need it
 // does it automatically.
 func (c *V1) EnsureInit() error {
-	c.initOnce.Do(c.initACLChecker)
-	return c.aclCheckerInitErr
+	c.initOnce.Do(c.init)
+	return c.initErr
 }
 
 // Version implements the Config interface.
@@ -123,6 +216,71 @@ func (c *V1) GetPermissionsForUsername(path, username string) (
 	return perms.read, perms.list, realm, nil
 }
 
+// GetWebhooks implements the Config interface.
+func (c *V1) GetWebhooks() []Webhook {
+	if len(c.Webhooks) == 0 {
+		return nil
+	}
+	webhooks := make([]Webhook, 0, len(c.Webhooks))
+	for _, webhook := range c.Webhooks {
+		webhooks = append(webhooks, Webhook{
+			URL:    webhook.URL,
+			Secret: webhook.Secret,
+		})
+	}
+	return webhooks
+}
+
+// GetErrorPages implements the Config interface.
+func (c *V1) GetErrorPages() map[string]string {
+	if len(c.ErrorPages) == 0 {
+		return nil
+	}
+	errorPages := make(map[string]string, len(c.ErrorPages))
+	for key, p := range c.ErrorPages {
+		errorPages[key] = p
+	}
+	return errorPages
+}
+
+// InMaintenance implements the Config interface.
+func (c *V1) InMaintenance() bool {
+	return c.Maintenance
+}
+
+// matchCacheControlPattern returns whether pattern, from a V1 config's
+// CacheControl map, matches p.
+func matchCacheControlPattern(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	matched, err := path.Match(pattern, p)
+	return err == nil && matched
+}
+
+// GetCacheControl implements the Config interface.
+func (c *V1) GetCacheControl(p string) (cc CacheControl, ok bool) {
+	var best string
+	for pattern, cacheControl := range c.CacheControl {
+		if !matchCacheControlPattern(pattern, p) {
+			continue
+		}
+		// Prefer the longest pattern, and break ties the same way
+		// every time.
+		if ok && (len(pattern) < len(best) ||
+			(len(pattern) == len(best) && pattern > best)) {
+			continue
+		}
+		best = pattern
+		cc = CacheControl{
+			CacheControl:     cacheControl.CacheControl,
+			SurrogateControl: cacheControl.SurrogateControl,
+		}
+		ok = true
+	}
+	return cc, ok
+}
+
 // Encode implements the Config interface.
 func (c *V1) Encode(w io.Writer, prettify bool) error {
 	encoder := json.NewEncoder(w)
@@ -144,5 +302,14 @@ func (c *V1) Encode(w io.Writer, prettify bool) error {
 // safe against changes to the public fields.
 func (c *V1) Validate() error {
 	_, err := makeACLCheckerV1(c.ACLs, c.Users)
-	return err
+	if err != nil {
+		return err
+	}
+	if err = checkWebhooksV1(c.Webhooks); err != nil {
+		return err
+	}
+	if err = checkErrorPagesV1(c.ErrorPages); err != nil {
+		return err
+	}
+	return checkCacheControlV1(c.CacheControl)
 }
@@ -258,3 +258,145 @@ func TestConfigV1Full(t *testing.T) {
 	require.False(t, list)
 	require.Equal(t, "/bob/dir/deep-dir/deep-deep-dir", realm)
 }
+
+func TestConfigV1Webhooks(t *testing.T) {
+	config := DefaultV1()
+	require.Nil(t, config.GetWebhooks())
+
+	config = &V1{
+		Common: Common{
+			Version: Version1Str,
+		},
+		Webhooks: []WebhookV1{
+			{URL: "https://example.com/build", Secret: "shh"},
+			{URL: "http://127.0.0.1:8080/hook"},
+		},
+	}
+	require.NoError(t, config.EnsureInit())
+	require.Equal(t, []Webhook{
+		{URL: "https://example.com/build", Secret: "shh"},
+		{URL: "http://127.0.0.1:8080/hook"},
+	}, config.GetWebhooks())
+
+	for _, invalidURL := range []string{
+		"", "/relative", "ftp://example.com/hook", "https://", "http://%zz",
+	} {
+		err := (&V1{
+			Common: Common{
+				Version: Version1Str,
+			},
+			Webhooks: []WebhookV1{{URL: invalidURL}},
+		}).EnsureInit()
+		require.Error(t, err, invalidURL)
+		require.IsType(t, ErrInvalidWebhookURL{}, err)
+
+		err = (&V1{
+			Common: Common{
+				Version: Version1Str,
+			},
+			Webhooks: []WebhookV1{{URL: invalidURL}},
+		}).Validate()
+		require.IsType(t, ErrInvalidWebhookURL{}, err)
+	}
+}
+
+func TestConfigV1ErrorPages(t *testing.T) {
+	config := DefaultV1()
+	require.Nil(t, config.GetErrorPages())
+	require.False(t, config.InMaintenance())
+
+	config = &V1{
+		Common: Common{
+			Version: Version1Str,
+		},
+		ErrorPages: map[string]string{
+			ErrorPageNotFound:    "/404.html",
+			ErrorPageServerError: "/errors/50x.html",
+		},
+	}
+	require.NoError(t, config.EnsureInit())
+	require.Equal(t, map[string]string{
+		"404": "/404.html",
+		"50x": "/errors/50x.html",
+	}, config.GetErrorPages())
+
+	for _, invalid := range [][2]string{
+		{"403", "/403.html"},
+		{ErrorPageNotFound, "404.html"},
+		{ErrorPageServerError, "/errors/../50x.html"},
+		{ErrorPageNotFound, "/"},
+	} {
+		err := (&V1{
+			Common: Common{
+				Version: Version1Str,
+			},
+			ErrorPages: map[string]string{invalid[0]: invalid[1]},
+		}).EnsureInit()
+		require.IsType(t, ErrInvalidErrorPage{}, err, invalid[1])
+	}
+}
+
+func TestErrorPageKey(t *testing.T) {
+	key, ok := ErrorPageKey(404)
+	require.True(t, ok)
+	require.Equal(t, ErrorPageNotFound, key)
+	for _, status := range []int{500, 502, 503} {
+		key, ok = ErrorPageKey(status)
+		require.True(t, ok)
+		require.Equal(t, ErrorPageServerError, key)
+	}
+	for _, status := range []int{200, 401, 403} {
+		_, ok = ErrorPageKey(status)
+		require.False(t, ok)
+	}
+}
+
+func TestConfigV1CacheControl(t *testing.T) {
+	config := DefaultV1()
+	_, ok := config.GetCacheControl("/index.html")
+	require.False(t, ok)
+
+	config = &V1{
+		Common: Common{
+			Version: Version1Str,
+		},
+		CacheControl: map[string]CacheControlV1{
+			"*.css": {CacheControl: "public, max-age=3600"},
+			"/assets/*": {
+				CacheControl:     "public, max-age=600",
+				SurrogateControl: "max-age=86400",
+			},
+			"/assets/app.*.js": {CacheControl: "public, max-age=31536000"},
+		},
+	}
+	require.NoError(t, config.EnsureInit())
+
+	cc, ok := config.GetCacheControl("/styles/main.css")
+	require.True(t, ok)
+	require.Equal(t, CacheControl{CacheControl: "public, max-age=3600"}, cc)
+
+	// Both "*.css" and "/assets/*" match; the longer pattern wins.
+	cc, ok = config.GetCacheControl("/assets/main.css")
+	require.True(t, ok)
+	require.Equal(t, CacheControl{
+		CacheControl:     "public, max-age=600",
+		SurrogateControl: "max-age=86400",
+	}, cc)
+
+	cc, ok = config.GetCacheControl("/assets/app.1234.js")
+	require.True(t, ok)
+	require.Equal(t, CacheControl{CacheControl: "public, max-age=31536000"}, cc)
+
+	_, ok = config.GetCacheControl("/index.html")
+	require.False(t, ok)
+
+	for _, invalid := range []string{"", "[", "/assets/[a-"} {
+		err := (&V1{
+			Common: Common{
+				Version: Version1Str,
+			},
+			CacheControl: map[string]CacheControlV1{invalid: {}},
+		}).EnsureInit()
+		require.IsType(t, ErrInvalidCacheControlPattern{}, err, invalid)
+	}
+}
@@ -34,6 +34,40 @@ func (e ErrInvalidVersion) Error() string {
 	return fmt.Sprintf("invalid version %s", e.versionStr)
 }
 
+// ErrInvalidWebhookURL is returned when a webhook in the config doesn't have
+// an absolute http or https URL.
+type ErrInvalidWebhookURL struct {
+	url string
+}
+
+// Error implements the error interface.
+func (e ErrInvalidWebhookURL) Error() string {
+	return fmt.Sprintf("invalid webhook URL %q", e.url)
+}
+
+// ErrInvalidErrorPage is returned when an error page in the config has an
+// unknown key, or a path that isn't a clean absolute path.
+type ErrInvalidErrorPage struct {
+	key  string
+	path string
+}
+
+// Error implements the error interface.
+func (e ErrInvalidErrorPage) Error() string {
+	return fmt.Sprintf("invalid error page %q: %q", e.key, e.path)
+}
+
+// ErrInvalidCacheControlPattern is returned when a path pattern in the
+// config's cache control section is malformed.
+type ErrInvalidCacheControlPattern struct {
+	pattern string
+}
+
+// Error implements the error interface.
+func (e ErrInvalidCacheControlPattern) Error() string {
+	return fmt.Sprintf("invalid cache control pattern %q", e.pattern)
+}
+
 // ErrUndefinedUsername is returned when a username appears in a ACL but it's
 // not defined in the config's Users section.
 type ErrUndefinedUsername struct {
@@ -13,7 +13,8 @@ import (
 )
 
 const (
-	keybasePagesPrefix = "kbp="
+	keybasePagesPrefix       = "kbp="
+	keybasePagesOriginPrefix = "kbp_origin="
 )
 
 // ErrKeybasePagesRecordNotFound is returned when a domain requested doesn't
@@ -52,6 +53,11 @@ const kbpRecordPrefix = "_keybase_pages."
 // other records (TXT or not) can co-exist with the "kbp=" record (as long as
 // no CNAME record exists on the "_keybase_pages." prefixed domain of course).
 //
+// An optional "kbp_origin=" TXT record names the KBFS deployment the root
+// lives in, out of the ones the server is configured with (see
+// ServerConfig.KBFSConfigForOrigin). Without one, the root is in
+// DefaultOrigin.
+//
 // If the given domain is invalid, it would cause the domain name constructed
 // in step will be invalid too, which causes Go's DNS resolver to return a
 // net.DNSError typed "no such host" error.
@@ -64,19 +70,13 @@ const kbpRecordPrefix = "_keybase_pages."
 // _keybase_pages.song.gao.io       TXT "kbp=/keybase/private/songgao,kb_bot/blah"
 // _keybase_pages.blah.strib.io     TXT "kbp=/keybase/private/strib#kb_bot/blahblahb" "lah/blah/"
 // _keybase_pages.kbp.jzila.com     TXT "kbp=git-keybase://private/jzila,kb_bot/kbp.git"
+//
+// And for a site served from a deployment named "staging":
+//
+// _keybase_pages.staging.gao.io    TXT "kbp=/keybase/public/songgao/staging/" "kbp_origin=staging"
 func LoadRootFromDNS(log *zap.Logger, domain string) (root Root, err error) {
-	var rootPath string
-
 	defer func() {
-		zapFields := []zapcore.Field{
-			zap.String("domain", domain),
-			zap.String("root_path", rootPath),
-		}
-		if err == nil {
-			log.Info("LoadRootFromDNS", zapFields...)
-		} else {
-			log.Warn("LoadRootFromDNS", append(zapFields, zap.Error(err))...)
-		}
+		logRootLoad(log, "LoadRootFromDNS", domain, root, err)
 	}()
 
 	txtRecords, err := net.LookupTXT(kbpRecordPrefix + domain)
@@ -84,6 +84,29 @@ func LoadRootFromDNS(log *zap.Logger, domain string) (root Root, err error) {
 		return Root{}, err
 	}
 
+	return rootFromTXTRecords(txtRecords)
+}
+
+func logRootLoad(log *zap.Logger, msg, domain string, root Root, err error,
+	extraFields ...zapcore.Field) {
+	zapFields := append([]zapcore.Field{
+		zap.String("domain", domain),
+		zap.String("tlf_type", root.TlfType.String()),
+		zap.String("tlf", root.TlfNameUnparsed),
+		zap.String("path", root.PathUnparsed),
+		zap.String("origin", root.Origin),
+	}, extraFields...)
+	if err == nil {
+		log.Info(msg, zapFields...)
+	} else {
+		log.Warn(msg, append(zapFields, zap.Error(err))...)
+	}
+}
+
+// rootFromTXTRecords parses the root out of the TXT records of a
+// "_keybase_pages." prefixed domain, as described for LoadRootFromDNS.
+func rootFromTXTRecords(txtRecords []string) (root Root, err error) {
+	var rootPath, origin string
 	for _, r := range txtRecords {
 		r = strings.TrimSpace(r)
 
@@ -93,11 +116,26 @@ func LoadRootFromDNS(log *zap.Logger, domain string) (root Root, err error) {
 			}
 			rootPath = r[len(keybasePagesPrefix):]
 		}
+
+		if strings.HasPrefix(r, keybasePagesOriginPrefix) {
+			if len(origin) != 0 {
+				return Root{}, ErrKeybasePagesRecordTooMany{}
+			}
+			origin = r[len(keybasePagesOriginPrefix):]
+			if !isValidOriginName(origin) {
+				return Root{}, ErrInvalidKeybasePagesRecord{}
+			}
+		}
 	}
 
 	if len(rootPath) == 0 {
 		return Root{}, ErrKeybasePagesRecordNotFound{}
 	}
 
-	return ParseRoot(rootPath)
+	root, err = ParseRoot(rootPath)
+	if err != nil {
+		return Root{}, err
+	}
+	root.Origin = origin
+	return root, nil
 }
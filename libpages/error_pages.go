@@ -0,0 +1,123 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/keybase/kbfs/libpages/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxErrorPageSize is the largest error page that's served; larger
+	// ones are ignored, since they're all kept in memory.
+	maxErrorPageSize = 1 << 20
+	// maintenanceRetryAfter is the Retry-After sent with responses for
+	// sites in maintenance mode.
+	maintenanceRetryAfter = 5 * 60
+)
+
+// loadErrorPages reads the error pages named in `cfg`.  Pages that
+// don't exist or are too large are skipped.
+func (s *site) loadErrorPages(cfg config.Config) (
+	errorPages map[string][]byte, err error) {
+	for key, p := range cfg.GetErrorPages() {
+		f, err := s.fs.Open(p)
+		switch {
+		case os.IsNotExist(err):
+			s.logger.Info("error page not found",
+				zap.String("key", key), zap.String("path", p))
+			continue
+		case err != nil:
+			return nil, err
+		}
+		page, err := ioutil.ReadAll(
+			io.LimitReader(f, maxErrorPageSize+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(page) > maxErrorPageSize {
+			s.logger.Info("error page too large",
+				zap.String("key", key), zap.String("path", p))
+			continue
+		}
+		if errorPages == nil {
+			errorPages = make(map[string][]byte)
+		}
+		errorPages[key] = page
+	}
+	return errorPages, nil
+}
+
+// getErrorPage returns the site's error page for responses with the
+// given status code, or nil if there isn't one.
+func (s *site) getErrorPage(status int) []byte {
+	key, ok := config.ErrorPageKey(status)
+	if !ok {
+		return nil
+	}
+	s.cachedConfigLock.RLock()
+	defer s.cachedConfigLock.RUnlock()
+	return s.cachedErrorPages[key]
+}
+
+// errorPageResponseWriter is an http.ResponseWriter that replaces the
+// body of error responses with the site's error page for the status
+// code, if it has one.  This catches both the errors libpages writes
+// itself, and the ones from http.FileServer.
+type errorPageResponseWriter struct {
+	http.ResponseWriter
+	st *site
+	// replaced is set once an error page has been written, after
+	// which the original body is dropped.
+	replaced bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface for
+// errorPageResponseWriter.
+func (w *errorPageResponseWriter) WriteHeader(status int) {
+	page := w.st.getErrorPage(status)
+	if page == nil {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h := w.ResponseWriter.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(page)))
+	h.Del("Content-Encoding")
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write(page)
+	w.replaced = true
+}
+
+// Write implements the http.ResponseWriter interface for
+// errorPageResponseWriter.
+func (w *errorPageResponseWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements the http.Flusher interface for
+// errorPageResponseWriter, if the wrapped writer supports it.
+func (w *errorPageResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveMaintenance responds to a request for a site in maintenance
+// mode.
+func serveMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
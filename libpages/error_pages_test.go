@@ -0,0 +1,81 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libpages/config"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestErrorPages(t *testing.T) {
+	ctx, kbfsConfig, fs, data := makeTestStreamFS(t, 10)
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, kbfsConfig)
+	notFound := []byte("<p>No such page</p>")
+	f, err := fs.Create("404.html")
+	require.NoError(t, err)
+	_, err = f.Write(notFound)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.SyncAll())
+
+	st := &site{fs: fs, logger: zap.NewNop()}
+	cfg := &config.V1{
+		Common: config.Common{Version: config.Version1Str},
+		ErrorPages: map[string]string{
+			config.ErrorPageNotFound:    "/404.html",
+			config.ErrorPageServerError: "/missing.html",
+		},
+	}
+	require.NoError(t, cfg.EnsureInit())
+	st.cachedErrorPages, err = st.loadErrorPages(cfg)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{
+		config.ErrorPageNotFound: notFound,
+	}, st.cachedErrorPages)
+
+	handler := http.FileServer(fs.ToHTTPFileSystem(ctx))
+	serve := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(&errorPageResponseWriter{
+			ResponseWriter: w, st: st}, r)
+		return w
+	}
+
+	t.Log("Found files are served as usual")
+	w := serve("/big.bin")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, data, w.Body.Bytes())
+
+	t.Log("Missing files get the custom 404 page")
+	w = serve("/nope")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, notFound, w.Body.Bytes())
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, strconv.Itoa(len(notFound)),
+		w.Header().Get("Content-Length"))
+
+	t.Log("Without a 50x page, maintenance responses are bare")
+	w = httptest.NewRecorder()
+	serveMaintenance(&errorPageResponseWriter{ResponseWriter: w, st: st})
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Empty(t, w.Body.Bytes())
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	t.Log("With one, they get the page")
+	serverError := []byte("<p>Back soon</p>")
+	st.cachedErrorPages[config.ErrorPageServerError] = serverError
+	w = httptest.NewRecorder()
+	serveMaintenance(&errorPageResponseWriter{ResponseWriter: w, st: st})
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, serverError, w.Body.Bytes())
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libpages/config"
+	"github.com/keybase/kbfs/tlf"
+	"go.uber.org/zap"
+)
+
+// Manifests let third parties check that what a site on a public TLF
+// serves matches what the folder's writers published.  A manifest
+// lists every file the site serves to anonymous visitors, with its
+// size and SHA-256 hash, along with the TLF ID, MD revision and head
+// writer the list was made from.  kbpagesd signs it with the device
+// key it's logged in with, so that a verifier can check the signature
+// against kbpagesd's sigchain, and then compare the listed revision
+// and hashes with the public folder as seen by any Keybase client.
+
+const (
+	// ManifestPath is the well-known URL path under which kbpagesd
+	// serves the signed manifest of a site on a public TLF.
+	ManifestPath = "/.well-known/keybase-pages-manifest.json"
+
+	manifestVersion = 1
+	// manifestMaxTries is how many times making a manifest is tried
+	// before giving up, if the TLF keeps changing underneath it.
+	manifestMaxTries = 3
+)
+
+// ManifestFile describes a single file in a Manifest.
+type ManifestFile struct {
+	// Path is the URL path the file is served under.
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// Manifest lists the files a site serves, as of a given revision of
+// its TLF.
+type Manifest struct {
+	Version  int
+	Tlf      string
+	TlfID    string
+	Root     string
+	Revision kbfsmd.Revision
+	// HeadWriter is the user who wrote Revision.
+	HeadWriter string
+	Files      []ManifestFile
+}
+
+// SignedManifest is what kbpagesd serves at ManifestPath.  Manifest
+// is kept as the exact bytes that were signed.
+type SignedManifest struct {
+	Manifest  json.RawMessage
+	Signature kbfscrypto.SignatureInfo
+}
+
+// ErrManifestChanged is returned when the TLF kept changing while a
+// manifest was being made.
+type ErrManifestChanged struct{}
+
+// Error implements the error interface.
+func (ErrManifestChanged) Error() string {
+	return "TLF changed while making manifest"
+}
+
+// VerifyManifest checks the signature on `signed`, and returns the
+// manifest it contains.  It's up to the caller to check that the
+// verifying key belongs to the kbpagesd it expects.
+func VerifyManifest(signed SignedManifest) (Manifest, error) {
+	err := kbfscrypto.Verify(signed.Manifest, signed.Signature)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(signed.Manifest, &m); err != nil {
+		return Manifest{}, err
+	}
+	if m.Version != manifestVersion {
+		return Manifest{}, errors.New("unknown manifest version")
+	}
+	return m, nil
+}
+
+// isManifestPath returns whether `requestPath` is the manifest's.
+func isManifestPath(requestPath string) bool {
+	return path.Clean("/"+requestPath) == ManifestPath
+}
+
+// listManifestFiles walks `fs` from `dir`, and returns the regular
+// files that anonymous visitors can read according to `cfg`, sorted
+// by path.  The config file and shares are never served as content,
+// so they're left out.
+func listManifestFiles(fs *libfs.FS, cfg config.Config, dir string) (
+	files []ManifestFile, err error) {
+	fis, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		p := path.Join(dir, fi.Name())
+		switch {
+		case strings.EqualFold(p, config.DefaultConfigFilepath):
+			continue
+		case isSharePath(p):
+			continue
+		case fi.IsDir():
+			children, err := listManifestFiles(fs, cfg, p)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, children...)
+			continue
+		case !fi.Mode().IsRegular():
+			continue
+		}
+
+		canRead, _, _, err := cfg.GetPermissionsForAnonymous(p)
+		if err != nil {
+			return nil, err
+		}
+		if !canRead {
+			continue
+		}
+		f, err := fs.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ManifestFile{
+			Path:   p,
+			Size:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// makeManifest lists the files of site `st` as of its current
+// revision.  If the revision changes while the files are being read,
+// it starts over.
+func makeManifest(ctx context.Context, st *site) (Manifest, error) {
+	kbfsOps := st.fs.Config().KBFSOps()
+	fs := st.fs.WithContext(ctx)
+	for i := 0; i < manifestMaxTries; i++ {
+		status, _, err := kbfsOps.FolderStatus(ctx, st.fs.FolderBranch())
+		if err != nil {
+			return Manifest{}, err
+		}
+		cfg, err := st.getConfig(true)
+		if err != nil {
+			return Manifest{}, err
+		}
+		files, err := listManifestFiles(fs, cfg, "/")
+		if err != nil {
+			return Manifest{}, err
+		}
+		after, _, err := kbfsOps.FolderStatus(ctx, st.fs.FolderBranch())
+		if err != nil {
+			return Manifest{}, err
+		}
+		if after.Revision != status.Revision {
+			continue
+		}
+		return Manifest{
+			Version:    manifestVersion,
+			Tlf:        st.root.TlfNameUnparsed,
+			TlfID:      status.FolderID,
+			Root:       st.root.PathUnparsed,
+			Revision:   status.Revision,
+			HeadWriter: status.HeadWriter.String(),
+			Files:      files,
+		}, nil
+	}
+	return Manifest{}, ErrManifestChanged{}
+}
+
+// signManifest signs `m` with the current device's key.
+func signManifest(ctx context.Context, crypto libkbfs.Crypto, m Manifest) (
+	SignedManifest, error) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return SignedManifest{}, err
+	}
+	sig, err := crypto.Sign(ctx, buf)
+	if err != nil {
+		return SignedManifest{}, err
+	}
+	return SignedManifest{Manifest: buf, Signature: sig}, nil
+}
+
+// manifestCache keeps the last signed manifest of a site, serialized,
+// until the site's TLF moves past the revision it was made from.
+type manifestCache struct {
+	lock     sync.Mutex
+	revision kbfsmd.Revision
+	buf      []byte
+}
+
+// get returns the serialized signed manifest of `st`, making a new
+// one if the TLF has changed since the last one was made.
+func (c *manifestCache) get(ctx context.Context, st *site) ([]byte, error) {
+	// Hold the lock while making a new manifest, so that concurrent
+	// requests don't all read the whole site.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	status, _, err := st.fs.Config().KBFSOps().FolderStatus(
+		ctx, st.fs.FolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	if c.buf != nil && c.revision == status.Revision {
+		return c.buf, nil
+	}
+
+	m, err := makeManifest(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := signManifest(ctx, st.fs.Config().Crypto(), m)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(signed)
+	if err != nil {
+		return nil, err
+	}
+	c.revision = m.Revision
+	c.buf = buf
+	return buf, nil
+}
+
+// serveManifest serves the signed manifest of site `st`.  Only sites
+// on public TLFs have one, since the point is to let anyone check
+// them.
+func (s *Server) serveManifest(ctx context.Context,
+	w http.ResponseWriter, st *site) {
+	if st.root.TlfType != tlf.Public {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	buf, err := st.manifest.get(ctx, st)
+	switch err.(type) {
+	case nil:
+	case ErrManifestChanged:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+		s.config.Logger.Warn("manifest", zap.Error(err))
+		s.handleError(w, err)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-cache")
+	w.Write(buf)
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libpages/config"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestListAndSign(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	kbfsConfig := libkbfs.MakeTestConfigOrBust(t, "user1")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, kbfsConfig)
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, kbfsConfig.KBPKI(), kbfsConfig.MDOps(), "user1", tlf.Public)
+	require.NoError(t, err)
+	fs, err := libfs.NewFS(
+		ctx, kbfsConfig, h, "", "", keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	contents := map[string]string{
+		"index.html":         "hello",
+		"a/b.css":            "body {}",
+		".kbp_config":        "{}",
+		ShareDir + "/abcdef": "sealed",
+	}
+	for p, data := range contents {
+		err = fs.MkdirAll(path.Dir(p), 0700)
+		require.NoError(t, err)
+		f, err := fs.Create(p)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	require.NoError(t, fs.SyncAll())
+
+	files, err := listManifestFiles(fs, config.DefaultV1(), "/")
+	require.NoError(t, err)
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	require.Equal(t, []ManifestFile{
+		{Path: "/a/b.css", Size: 7, SHA256: hash("body {}")},
+		{Path: "/index.html", Size: 5, SHA256: hash("hello")},
+	}, files)
+
+	m := Manifest{
+		Version:  manifestVersion,
+		Tlf:      "user1",
+		Revision: 2,
+		Files:    files,
+	}
+	signed, err := signManifest(ctx, kbfsConfig.Crypto(), m)
+	require.NoError(t, err)
+	got, err := VerifyManifest(signed)
+	require.NoError(t, err)
+	require.Equal(t, m, got)
+
+	t.Log("A tampered manifest doesn't verify")
+	signed.Manifest[len(signed.Manifest)-2]++
+	_, err = VerifyManifest(signed)
+	require.Error(t, err)
+}
+
+func TestIsManifestPath(t *testing.T) {
+	require.True(t, isManifestPath(ManifestPath))
+	require.True(t, isManifestPath("/.well-known/../"+ManifestPath))
+	require.False(t, isManifestPath("/.well-known/"))
+	require.False(t, isManifestPath("/index.html"))
+}
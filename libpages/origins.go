@@ -0,0 +1,95 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// DefaultOrigin is the origin of roots whose DNS records don't name
+// one.  It's served by the libkbfs.Config passed to ListenAndServe.
+const DefaultOrigin = ""
+
+// KBFSConfigMaker makes a libkbfs.Config connected to the KBFS
+// deployment (e.g., staging, or a self-hosted one) that the operator
+// has named `origin`.  It returns an ErrUnknownOrigin for names it
+// doesn't know.  It's called with the server's context rather than a
+// request's, since the config outlives the request.
+type KBFSConfigMaker func(
+	ctx context.Context, origin string) (libkbfs.Config, error)
+
+// ErrUnknownOrigin is returned when a root names an origin that the
+// server isn't configured to serve.
+type ErrUnknownOrigin struct {
+	Origin string
+}
+
+// Error implements the error interface.
+func (e ErrUnknownOrigin) Error() string {
+	return fmt.Sprintf("unknown KBFS origin %q", e.Origin)
+}
+
+// isValidOriginName returns whether `origin` can be named in a DNS
+// record.  Names are kept simple since they're chosen by whoever
+// controls the domain, and end up in log prefixes.
+func isValidOriginName(origin string) bool {
+	if len(origin) == 0 || len(origin) > 32 {
+		return false
+	}
+	for _, c := range origin {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9':
+		case c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// kbfsConfigPool hands out one libkbfs.Config per origin, making
+// each one the first time it's needed, and keeping it for the life of
+// the server.
+type kbfsConfigPool struct {
+	ctx   context.Context
+	maker KBFSConfigMaker
+
+	lock    sync.Mutex
+	configs map[string]libkbfs.Config
+}
+
+func makeKBFSConfigPool(ctx context.Context,
+	defaultConfig libkbfs.Config, maker KBFSConfigMaker) *kbfsConfigPool {
+	return &kbfsConfigPool{
+		ctx:     ctx,
+		maker:   maker,
+		configs: map[string]libkbfs.Config{DefaultOrigin: defaultConfig},
+	}
+}
+
+// get returns the libkbfs.Config for `origin`.
+func (p *kbfsConfigPool) get(origin string) (libkbfs.Config, error) {
+	// Hold the lock while making a config, so that concurrent
+	// requests for a new origin don't each make one.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if config, ok := p.configs[origin]; ok {
+		return config, nil
+	}
+	if p.maker == nil {
+		return nil, ErrUnknownOrigin{Origin: origin}
+	}
+	config, err := p.maker(p.ctx, origin)
+	if err != nil {
+		return nil, err
+	}
+	p.configs[origin] = config
+	return config, nil
+}
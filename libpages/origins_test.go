@@ -0,0 +1,55 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"context"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsValidOriginName(t *testing.T) {
+	require.True(t, isValidOriginName("staging"))
+	require.True(t, isValidOriginName("self-hosted_1"))
+	require.False(t, isValidOriginName(""))
+	require.False(t, isValidOriginName("Staging"))
+	require.False(t, isValidOriginName("a.b"))
+	require.False(t, isValidOriginName("a/b"))
+}
+
+func TestKBFSConfigPool(t *testing.T) {
+	ctx := context.Background()
+	defaultConfig := &libkbfs.ConfigLocal{}
+
+	t.Log("Without a maker, only the default origin is served")
+	pool := makeKBFSConfigPool(ctx, defaultConfig, nil)
+	config, err := pool.get(DefaultOrigin)
+	require.NoError(t, err)
+	require.True(t, config == libkbfs.Config(defaultConfig))
+	_, err = pool.get("staging")
+	require.Equal(t, ErrUnknownOrigin{Origin: "staging"}, err)
+
+	t.Log("Configs are made once per origin")
+	stagingConfig := &libkbfs.ConfigLocal{}
+	made := 0
+	pool = makeKBFSConfigPool(ctx, defaultConfig,
+		func(_ context.Context, origin string) (libkbfs.Config, error) {
+			if origin != "staging" {
+				return nil, ErrUnknownOrigin{Origin: origin}
+			}
+			made++
+			return stagingConfig, nil
+		})
+	for i := 0; i < 2; i++ {
+		config, err = pool.get("staging")
+		require.NoError(t, err)
+		require.True(t, config == libkbfs.Config(stagingConfig))
+	}
+	require.Equal(t, 1, made)
+	_, err = pool.get("prod")
+	require.Equal(t, ErrUnknownOrigin{Origin: "prod"}, err)
+}
@@ -56,6 +56,9 @@ type Root struct {
 	TlfType         tlf.Type
 	TlfNameUnparsed string
 	PathUnparsed    string
+	// Origin names the KBFS deployment the TLF lives in, or is
+	// DefaultOrigin.
+	Origin string
 }
 
 // MakeFS makes a *libfs.FS from *r, which can be adapted to a http.FileSystem
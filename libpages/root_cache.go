@@ -0,0 +1,325 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+	metrics "github.com/rcrowley/go-metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	rootCacheSize = 1 << 14
+	// Cached roots are kept for the TTL of the TXT records they came
+	// from, within these bounds, so that site owners can change their
+	// records without waiting too long, and so that very short TTLs
+	// don't cost a lookup for every request.
+	minRootTTL = 30 * time.Second
+	maxRootTTL = time.Hour
+	// Negative answers are kept for the TTL in the SOA record that came
+	// with them, within [minRootTTL, maxNegativeRootTTL], or for
+	// defaultNegativeRootTTL if there was none.
+	maxNegativeRootTTL     = 5 * time.Minute
+	defaultNegativeRootTTL = time.Minute
+	// defaultRootTTL is used when the resolver can't tell TTLs.
+	defaultRootTTL = 5 * time.Minute
+
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+// txtResolver looks up the TXT records of a domain name, and returns
+// how long the answer can be cached for, including when it's a
+// negative one.
+type txtResolver interface {
+	LookupTXT(name string) (records []string, ttl time.Duration, err error)
+}
+
+// dnsTXTResolver queries the nameservers in resolv.conf directly,
+// since Go's own resolver doesn't report TTLs.
+type dnsTXTResolver struct {
+	client  *dns.Client
+	servers []string
+}
+
+var _ txtResolver = dnsTXTResolver{}
+
+func makeDNSTXTResolver() (dnsTXTResolver, error) {
+	conf, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		return dnsTXTResolver{}, err
+	}
+	servers := make([]string, 0, len(conf.Servers))
+	for _, server := range conf.Servers {
+		servers = append(servers, net.JoinHostPort(server, conf.Port))
+	}
+	return dnsTXTResolver{
+		client: &dns.Client{
+			Timeout: time.Duration(conf.Timeout) * time.Second,
+		},
+		servers: servers,
+	}, nil
+}
+
+// negativeTTL returns how long the negative answer `m` can be cached
+// for, according to RFC 2308.
+func negativeTTL(m *dns.Msg) time.Duration {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return defaultNegativeRootTTL
+}
+
+// LookupTXT implements the txtResolver interface for dnsTXTResolver.
+// Like net.LookupTXT, it joins the strings of each record, and returns
+// a *net.DNSError with IsNotFound set for NXDOMAIN.
+func (r dnsTXTResolver) LookupTXT(name string) (
+	records []string, ttl time.Duration, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	err = &net.DNSError{Err: "no nameservers", Name: name}
+	for _, server := range r.servers {
+		in, _, exchangeErr := r.client.Exchange(m, server)
+		if exchangeErr != nil {
+			err = exchangeErr
+			continue
+		}
+		switch in.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, negativeTTL(in), &net.DNSError{
+				Err:        "no such host",
+				Name:       name,
+				Server:     server,
+				IsNotFound: true,
+			}
+		default:
+			err = &net.DNSError{
+				Err:    dns.RcodeToString[in.Rcode],
+				Name:   name,
+				Server: server,
+			}
+			continue
+		}
+
+		// The answer may include a CNAME chain, whose TTLs count too.
+		ttl = maxRootTTL
+		for _, rr := range in.Answer {
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+			if txt, ok := rr.(*dns.TXT); ok {
+				records = append(records, strings.Join(txt.Txt, ""))
+			}
+		}
+		if len(records) == 0 {
+			return nil, negativeTTL(in), nil
+		}
+		return records, ttl, nil
+	}
+	return nil, 0, err
+}
+
+// netTXTResolver uses Go's resolver, and a fixed TTL.  It's used when
+// there's no resolv.conf to find nameservers in.
+type netTXTResolver struct{}
+
+var _ txtResolver = netTXTResolver{}
+
+// LookupTXT implements the txtResolver interface for netTXTResolver.
+func (netTXTResolver) LookupTXT(name string) (
+	records []string, ttl time.Duration, err error) {
+	records, err = net.LookupTXT(name)
+	return records, defaultRootTTL, err
+}
+
+type rootCacheEntry struct {
+	root    Root
+	err     error
+	expires time.Time
+}
+
+// RootCache loads roots from DNS like LoadRootFromDNS, but caches
+// them, and negative answers, for the TTL of the records they came
+// from.  Transient lookup failures aren't cached.  It's safe for
+// concurrent use.
+type RootCache struct {
+	log      *zap.Logger
+	resolver txtResolver
+	entries  *lru.Cache
+	now      func() time.Time
+
+	lookupTimer metrics.Timer
+	hitMeter    metrics.Meter
+	missMeter   metrics.Meter
+}
+
+// NewRootCache returns a new RootCache, which records its metrics in
+// `registry`, or in metrics.DefaultRegistry if that's nil.
+func NewRootCache(
+	log *zap.Logger, registry metrics.Registry) (*RootCache, error) {
+	entries, err := lru.New(rootCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	var resolver txtResolver = netTXTResolver{}
+	if dnsResolver, err := makeDNSTXTResolver(); err == nil {
+		resolver = dnsResolver
+	} else {
+		log.Warn("NewRootCache: can't use resolv.conf; "+
+			"falling back to fixed TTLs", zap.Error(err))
+	}
+	return &RootCache{
+		log:         log,
+		resolver:    resolver,
+		entries:     entries,
+		now:         time.Now,
+		lookupTimer: metrics.GetOrRegisterTimer("RootCache.Lookup", registry),
+		hitMeter:    metrics.GetOrRegisterMeter("RootCache.Hit", registry),
+		missMeter:   metrics.GetOrRegisterMeter("RootCache.Miss", registry),
+	}, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func isCacheableLookupErr(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func clampTTL(ttl, min, max time.Duration) time.Duration {
+	switch {
+	case ttl < min:
+		return min
+	case ttl > max:
+		return max
+	default:
+		return ttl
+	}
+}
+
+// Load returns the root configured for `domain`, as described for
+// LoadRootFromDNS.
+func (c *RootCache) Load(domain string) (root Root, err error) {
+	domain = normalizeDomain(domain)
+	if cached, ok := c.entries.Get(domain); ok {
+		if entry := cached.(rootCacheEntry); c.now().Before(entry.expires) {
+			c.hitMeter.Mark(1)
+			return entry.root, entry.err
+		}
+		c.entries.Remove(domain)
+	}
+	c.missMeter.Mark(1)
+
+	start := time.Now()
+	records, ttl, err := c.resolver.LookupTXT(kbpRecordPrefix + domain)
+	latency := time.Since(start)
+	c.lookupTimer.Update(latency)
+	defer func() {
+		logRootLoad(c.log, "RootCache.Load", domain, root, err,
+			zap.Duration("latency", latency), zap.Duration("ttl", ttl))
+	}()
+
+	negative := false
+	switch {
+	case err == nil:
+		root, err = rootFromTXTRecords(records)
+		_, negative = err.(ErrKeybasePagesRecordNotFound)
+	case isCacheableLookupErr(err):
+		negative = true
+	default:
+		// Don't cache transient failures.
+		return Root{}, err
+	}
+
+	if negative {
+		ttl = clampTTL(ttl, minRootTTL, maxNegativeRootTTL)
+	} else {
+		ttl = clampTTL(ttl, minRootTTL, maxRootTTL)
+	}
+	c.entries.Add(domain, rootCacheEntry{
+		root:    root,
+		err:     err,
+		expires: c.now().Add(ttl),
+	})
+	return root, err
+}
+
+// Purge drops the cached root for `domain`, or all cached roots if
+// `domain` is empty.
+func (c *RootCache) Purge(domain string) {
+	if domain == "" {
+		c.entries.Purge()
+		return
+	}
+	c.entries.Remove(normalizeDomain(domain))
+}
+
+// RootCacheStatus describes the state of a RootCache.
+type RootCacheStatus struct {
+	Entries int
+	Hits    int64
+	Misses  int64
+	// Lookups are the DNS lookups made for misses, with their
+	// latencies in milliseconds.
+	Lookups            int64
+	LookupMeanMs       float64
+	LookupP99Ms        float64
+	LookupMaxMs        float64
+	LookupRate1MinPerS float64
+}
+
+// Status returns the current state of c.
+func (c *RootCache) Status() RootCacheStatus {
+	lookups := c.lookupTimer.Snapshot()
+	ms := float64(time.Millisecond)
+	return RootCacheStatus{
+		Entries:            c.entries.Len(),
+		Hits:               c.hitMeter.Count(),
+		Misses:             c.missMeter.Count(),
+		Lookups:            lookups.Count(),
+		LookupMeanMs:       lookups.Mean() / ms,
+		LookupP99Ms:        lookups.Percentile(0.99) / ms,
+		LookupMaxMs:        float64(lookups.Max()) / ms,
+		LookupRate1MinPerS: lookups.Rate1(),
+	}
+}
+
+// Handler returns an HTTP handler for managing c.  A GET returns its
+// RootCacheStatus as JSON; a POST purges the domain in the "domain"
+// form value, or everything if there isn't one, and then does the
+// same.  It does no authentication, so daemons should only serve it
+// on a local address.
+func (c *RootCache) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			c.Purge(r.FormValue("domain"))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(c.Status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type testTXTAnswer struct {
+	records []string
+	ttl     time.Duration
+	err     error
+}
+
+type testTXTResolver struct {
+	answers map[string]testTXTAnswer
+	lookups int
+}
+
+func (r *testTXTResolver) LookupTXT(name string) (
+	records []string, ttl time.Duration, err error) {
+	r.lookups++
+	a, ok := r.answers[name]
+	if !ok {
+		return nil, time.Minute, &net.DNSError{
+			Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return a.records, a.ttl, a.err
+}
+
+func makeTestRootCache(t *testing.T, resolver txtResolver) (
+	*RootCache, *time.Time) {
+	entries, err := lru.New(rootCacheSize)
+	require.NoError(t, err)
+	now := time.Now()
+	registry := metrics.NewRegistry()
+	return &RootCache{
+		log:         zap.NewNop(),
+		resolver:    resolver,
+		entries:     entries,
+		now:         func() time.Time { return now },
+		lookupTimer: metrics.GetOrRegisterTimer("RootCache.Lookup", registry),
+		hitMeter:    metrics.GetOrRegisterMeter("RootCache.Hit", registry),
+		missMeter:   metrics.GetOrRegisterMeter("RootCache.Miss", registry),
+	}, &now
+}
+
+func TestRootCache(t *testing.T) {
+	resolver := &testTXTResolver{answers: map[string]testTXTAnswer{
+		kbpRecordPrefix + "a.example.com": {
+			records: []string{"kbp=/keybase/public/alice/site"},
+			ttl:     10 * time.Minute,
+		},
+		kbpRecordPrefix + "b.example.com": {
+			records: []string{"v=spf1 -all"},
+			ttl:     time.Hour,
+		},
+		kbpRecordPrefix + "c.example.com": {
+			err: errors.New("i/o timeout"),
+		},
+	}}
+	c, now := makeTestRootCache(t, resolver)
+
+	t.Log("Roots are cached for their TTL, whatever the case of the domain")
+	root, err := c.Load("a.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "alice", root.TlfNameUnparsed)
+	root, err = c.Load("A.Example.com.")
+	require.NoError(t, err)
+	require.Equal(t, "alice", root.TlfNameUnparsed)
+	require.Equal(t, 1, resolver.lookups)
+	*now = now.Add(11 * time.Minute)
+	_, err = c.Load("a.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 2, resolver.lookups)
+
+	t.Log("NXDOMAIN and missing kbp= records are cached, but not for long")
+	resolver.lookups = 0
+	_, err = c.Load("nope.example.com")
+	require.True(t, isCacheableLookupErr(err))
+	_, err = c.Load("b.example.com")
+	require.IsType(t, ErrKeybasePagesRecordNotFound{}, err)
+	_, err = c.Load("nope.example.com")
+	require.True(t, isCacheableLookupErr(err))
+	_, err = c.Load("b.example.com")
+	require.IsType(t, ErrKeybasePagesRecordNotFound{}, err)
+	require.Equal(t, 2, resolver.lookups)
+	*now = now.Add(maxNegativeRootTTL)
+	_, err = c.Load("b.example.com")
+	require.IsType(t, ErrKeybasePagesRecordNotFound{}, err)
+	require.Equal(t, 3, resolver.lookups)
+
+	t.Log("Transient failures aren't cached")
+	resolver.lookups = 0
+	_, err = c.Load("c.example.com")
+	require.Error(t, err)
+	_, err = c.Load("c.example.com")
+	require.Error(t, err)
+	require.Equal(t, 2, resolver.lookups)
+
+	t.Log("Purging forces a new lookup")
+	resolver.lookups = 0
+	c.Purge("A.example.com")
+	_, err = c.Load("a.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, resolver.lookups)
+	c.Purge("")
+	require.Equal(t, 0, c.Status().Entries)
+
+	status := c.Status()
+	require.NotZero(t, status.Hits)
+	require.NotZero(t, status.Misses)
+	require.Equal(t, status.Misses, status.Lookups)
+}
+
+func TestClampTTL(t *testing.T) {
+	require.Equal(t, minRootTTL, clampTTL(0, minRootTTL, maxRootTTL))
+	require.Equal(t, maxRootTTL, clampTTL(24*time.Hour, minRootTTL, maxRootTTL))
+	require.Equal(t, 10*time.Minute,
+		clampTTL(10*time.Minute, minRootTTL, maxRootTTL))
+}
@@ -8,8 +8,12 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -33,6 +37,17 @@ type ServerConfig struct {
 	UseStaging       bool
 	Logger           *zap.Logger
 	UseDiskCertCache bool
+	// RootCache, if non-nil, is used to load roots from DNS. If nil, a new
+	// one is made.
+	RootCache *RootCache
+	// KBFSConfigForOrigin, if non-nil, makes the libkbfs.Config for
+	// sites whose DNS records name an origin other than
+	// DefaultOrigin.  If nil, only DefaultOrigin is served.
+	KBFSConfigForOrigin KBFSConfigMaker
+	// PrewarmDomains are domains whose certificates are loaded, or
+	// issued, at startup rather than on their first handshake, and
+	// periodically checked after that.
+	PrewarmDomains []string
 }
 
 const fsCacheSize = 2 << 15
@@ -40,10 +55,14 @@ const fsCacheSize = 2 << 15
 // Server handles incoming HTTP requests by creating a Root for each host and
 // serving content from it.
 type Server struct {
-	config     ServerConfig
-	kbfsConfig libkbfs.Config
+	config      ServerConfig
+	kbfsConfigs *kbfsConfigPool
 
 	siteCache *lru.Cache
+	webhooks  *webhookDispatcher
+	// ipHashKey keys the client IP hashes in request log tags, so
+	// that they can't be reversed by hashing every IP address.
+	ipHashKey []byte
 
 	whiteList     map[string]bool
 	whiteListOnce sync.Once
@@ -57,13 +76,26 @@ func (s *Server) getSite(ctx context.Context, root Root) (st *site, err error) {
 		}
 		s.config.Logger.Error("nasty entry in s.siteCache",
 			zap.String("type", reflect.TypeOf(siteCached).String()))
+		s.siteCache.Remove(root)
 	}
-	fs, err := root.MakeFS(ctx, s.config.Logger, s.kbfsConfig)
+	kbfsConfig, err := s.kbfsConfigs.get(root.Origin)
 	if err != nil {
 		return nil, err
 	}
-	st = makeSite(fs)
-	s.siteCache.Add(root, st)
+	fs, err := root.MakeFS(ctx, s.config.Logger, kbfsConfig)
+	if err != nil {
+		return nil, err
+	}
+	st, err = makeSite(fs, root, s.config.Logger, s.webhooks)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := s.siteCache.ContainsOrAdd(root, st); ok {
+		// Another request made a site for the same root first, so use that
+		// one instead.
+		st.shutdown()
+		return s.getSite(ctx, root)
+	}
 	return st, nil
 }
 
@@ -79,6 +111,9 @@ func (s *Server) handleError(w http.ResponseWriter, err error) {
 		return
 	case ErrInvalidKeybasePagesRecord:
 		w.WriteHeader(http.StatusPreconditionFailed)
+	case ErrUnknownOrigin:
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -93,11 +128,25 @@ const (
 	// CtxKBPKey is the tag key for unique operation IDs within kbp and
 	// libpages.
 	CtxKBPKey CtxKBPTagKey = iota
+	// CtxKBPDomainKey is the tag key for the domain an HTTP request
+	// was sent to.
+	CtxKBPDomainKey
+	// CtxKBPClientIPHashKey is the tag key for a keyed hash of the
+	// IP address an HTTP request came from.
+	CtxKBPClientIPHashKey
 )
 
 // CtxKBPOpID is the display name for unique operations in kbp and libpages.
 const CtxKBPOpID = "KBP"
 
+const (
+	// CtxKBPDomainTag is the display name for the domain tag.
+	CtxKBPDomainTag = "KBPD"
+	// CtxKBPClientIPHashTag is the display name for the client IP
+	// hash tag.
+	CtxKBPClientIPHashTag = "KBPIP"
+)
+
 type adaptedLogger struct {
 	msg    string
 	logger *zap.Logger
@@ -107,15 +156,45 @@ func (a adaptedLogger) Warning(format string, args ...interface{}) {
 	a.logger.Warn(a.msg, zap.String("desc", fmt.Sprintf(format, args...)))
 }
 
+// clientIPHash returns a short keyed hash of the IP address in
+// `remoteAddr`, so that requests from the same client can be
+// correlated in the logs without logging its address.
+func (s *Server) clientIPHash(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	mac := hmac.New(sha256.New, s.ipHashKey)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// ctxWithRequestTags returns a context for serving `r`, tagged with a
+// random request ID, the requested domain, and a hash of the client
+// IP address.  The tags show up in the libkbfs logs for everything
+// done on behalf of the request, including block fetches.
+func (s *Server) ctxWithRequestTags(r *http.Request) context.Context {
+	ctx := libkbfs.CtxWithRandomIDReplayable(r.Context(),
+		CtxKBPKey, CtxKBPOpID, adaptedLogger{
+			msg:    "CtxWithRandomIDReplayable",
+			logger: s.config.Logger,
+		})
+	ctx = libkbfs.CtxWithTagReplayable(
+		ctx, CtxKBPDomainKey, CtxKBPDomainTag, r.Host)
+	return libkbfs.CtxWithTagReplayable(ctx, CtxKBPClientIPHashKey,
+		CtxKBPClientIPHashTag, s.clientIPHash(r.RemoteAddr))
+}
+
 func (s *Server) handleNeedAuthentication(
 	w http.ResponseWriter, r *http.Request, realm string) {
 	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%s", realm))
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
-func (s *Server) isDirWithNoIndexHTML(
+func (s *Server) isDirWithNoIndexHTML(ctx context.Context,
 	st *site, requestPath string) (bool, error) {
-	fi, err := st.fs.Stat(strings.Trim(path.Clean(requestPath), "/"))
+	fs := st.fs.WithContext(ctx)
+	fi, err := fs.Stat(strings.Trim(path.Clean(requestPath), "/"))
 	switch {
 	case os.IsNotExist(err):
 		// It doesn't exist! So just let the http package handle it.
@@ -131,7 +210,7 @@ func (s *Server) isDirWithNoIndexHTML(
 		return false, nil
 	}
 
-	fi, err = st.fs.Stat(path.Join(requestPath, "index.html"))
+	fi, err = fs.Stat(path.Join(requestPath, "index.html"))
 	switch {
 	case err == nil:
 		return false, nil
@@ -145,7 +224,10 @@ func (s *Server) isDirWithNoIndexHTML(
 
 // ServeHTTP implements the http.Handler interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := s.ctxWithRequestTags(r)
+	requestID, _ := ctx.Value(CtxKBPKey).(string)
 	s.config.Logger.Info("ServeHTTP",
+		zap.String("request_id", requestID),
 		zap.String("host", r.Host),
 		zap.String("path", r.URL.Path),
 		zap.String("proto", r.Proto),
@@ -158,23 +240,37 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	root, err := LoadRootFromDNS(s.config.Logger, r.Host)
+	root, err := s.config.RootCache.Load(r.Host)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
-	ctx := libkbfs.CtxWithRandomIDReplayable(r.Context(),
-		CtxKBPKey, CtxKBPOpID, adaptedLogger{
-			msg:    "CtxWithRandomIDReplayable",
-			logger: s.config.Logger,
-		})
 	st, err := s.getSite(ctx, root)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
+	if isManifestPath(r.URL.Path) {
+		s.serveManifest(ctx, w, st)
+		return
+	}
+
+	// From here on, error responses get the site's own error pages, if
+	// it has any.
+	w = &errorPageResponseWriter{ResponseWriter: w, st: st}
+
 	cfg, err := st.getConfig(false)
+	if err == nil && cfg.InMaintenance() {
+		serveMaintenance(w)
+		return
+	}
+
+	if isSharePath(r.URL.Path) {
+		s.serveShare(ctx, w, r, st)
+		return
+	}
+
 	if err != nil {
 		// User has a .kbp_config file but it's invalid.
 		// TODO: error page to show the error message?
@@ -186,7 +282,8 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var canRead, canList bool
 	var realm string
 	user, pass, ok := r.BasicAuth()
-	if ok && cfg.Authenticate(user, pass) {
+	authenticated := ok && cfg.Authenticate(user, pass)
+	if authenticated {
 		canRead, canList, realm, err = cfg.GetPermissionsForUsername(
 			r.URL.Path, user)
 	} else {
@@ -202,7 +299,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// http.FileServer handle it.  This permission check should ideally
 	// happen inside the http package, but unfortunately there isn't a
 	// way today.
-	isListing, err := s.isDirWithNoIndexHTML(st, r.URL.Path)
+	isListing, err := s.isDirWithNoIndexHTML(ctx, st, r.URL.Path)
 	if err != nil {
 		s.handleError(w, err)
 		return
@@ -218,7 +315,12 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.FileServer(st.getHTTPFileSystem(ctx)).ServeHTTP(w, r)
+	w = &cacheControlResponseWriter{
+		ResponseWriter: w,
+		cc:             getCacheControl(cfg, r.URL.Path, authenticated),
+	}
+	http.FileServer(st.getHTTPFileSystem(ctx)).ServeHTTP(
+		streamingResponseWriter{w}, r)
 }
 
 // ErrDomainNotAllowedInWhitelist is returned when the server is configured
@@ -257,11 +359,9 @@ func (s *Server) allowConnectionTo(ctx context.Context, host string) error {
 	// DoS protection: look up kbp TXT record before attempting ACME cert
 	// issuance, and only allow those that have DNS records configured. This is
 	// in case someone keeps sending us TLS handshakes with random SNIs,
-	// causing us to be rate-limited by the ACME server.
-	//
-	// TODO: cache the parsed root somewhere so we don't end up doing it twice
-	// for each connection.
-	_, err := LoadRootFromDNS(s.config.Logger, host)
+	// causing us to be rate-limited by the ACME server.  The root is cached,
+	// so the request that follows the handshake doesn't look it up again.
+	_, err := s.config.RootCache.Load(host)
 	if err != nil {
 		return err
 	}
@@ -275,6 +375,14 @@ const (
 	httpIdleTimeout         = 1 * time.Minute
 	stagingDiskCacheName    = "./kbp-cert-cache-staging"
 	prodDiskCacheName       = "./kbp-cert-cache"
+
+	// Sites are read-only, so clients have little reason to send
+	// much, and there's no point in letting them fill large receive
+	// windows.  Sending is limited by the clients' windows instead.
+	http2MaxConcurrentStreams      = 250
+	http2MaxReceiveBufferPerStream = 64 << 10
+	http2MaxReceiveBufferPerConn   = 1 << 20
+	http2PingTimeout               = 15 * time.Second
 )
 
 func (s *Server) redirectHandlerFunc(w http.ResponseWriter, req *http.Request) {
@@ -330,20 +438,40 @@ func makeACMEManager(
 
 // ListenAndServe listens on 443 and 80 ports of all addresses, and serve
 // Keybase Pages based on config and kbfsConfig. HTTPs setup is handled with
-// ACME.
+// ACME. kbfsConfig serves DefaultOrigin; other origins are served by configs
+// from config.KBFSConfigForOrigin.
 func ListenAndServe(ctx context.Context,
 	config ServerConfig, kbfsConfig libkbfs.Config) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	siteCache, err := lru.New(fsCacheSize)
+	siteCache, err := lru.NewWithEvict(fsCacheSize,
+		func(_ interface{}, value interface{}) {
+			if st, ok := value.(*site); ok {
+				st.shutdown()
+			}
+		})
+	if err != nil {
+		return err
+	}
+	if config.RootCache == nil {
+		config.RootCache, err = NewRootCache(config.Logger, nil)
+		if err != nil {
+			return err
+		}
+	}
+	ipHashKey := make([]byte, 32)
+	_, err = rand.Read(ipHashKey)
 	if err != nil {
 		return err
 	}
 	server := &Server{
-		config:     config,
-		kbfsConfig: kbfsConfig,
-		siteCache:  siteCache,
+		config: config,
+		kbfsConfigs: makeKBFSConfigPool(
+			ctx, kbfsConfig, config.KBFSConfigForOrigin),
+		siteCache: siteCache,
+		webhooks:  makeWebhookDispatcher(config.Logger),
+		ipHashKey: ipHashKey,
 	}
 
 	manager, err := makeACMEManager(
@@ -352,10 +480,24 @@ func ListenAndServe(ctx context.Context,
 		return err
 	}
 
+	// ACME challenges are answered through the listener below, so
+	// pre-warming mustn't hold up serving.
+	if len(config.PrewarmDomains) > 0 {
+		go makeCertPrewarmer(
+			config.Logger, manager, config.PrewarmDomains).run(ctx)
+	}
+
+	// HTTP/2 is negotiated through the ACME manager's listener.
 	httpsServer := http.Server{
 		Handler:           server,
 		ReadHeaderTimeout: httpReadHeaderTimeout,
 		IdleTimeout:       httpIdleTimeout,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams:          http2MaxConcurrentStreams,
+			MaxReceiveBufferPerStream:     http2MaxReceiveBufferPerStream,
+			MaxReceiveBufferPerConnection: http2MaxReceiveBufferPerConn,
+			PingTimeout:                   http2PingTimeout,
+		},
 	}
 
 	httpRedirectServer := http.Server{
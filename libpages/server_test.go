@@ -0,0 +1,44 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServerCtxWithRequestTags(t *testing.T) {
+	s := &Server{
+		config:    ServerConfig{Logger: zap.NewNop()},
+		ipHashKey: []byte("key"),
+	}
+
+	r := httptest.NewRequest("GET", "https://example.com/a", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	ctx := s.ctxWithRequestTags(r)
+	tags, ok := logger.LogTagsFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, CtxKBPOpID, tags[CtxKBPKey])
+	require.Equal(t, CtxKBPDomainTag, tags[CtxKBPDomainKey])
+	require.Equal(t, CtxKBPClientIPHashTag, tags[CtxKBPClientIPHashKey])
+	require.NotEmpty(t, ctx.Value(CtxKBPKey))
+	require.Equal(t, "example.com", ctx.Value(CtxKBPDomainKey))
+
+	t.Log("The client IP is hashed, ignoring the port")
+	ipHash := ctx.Value(CtxKBPClientIPHashKey).(string)
+	require.False(t, strings.Contains(ipHash, "192.0.2.1"))
+	r.RemoteAddr = "192.0.2.1:5678"
+	ctx2 := s.ctxWithRequestTags(r)
+	require.Equal(t, ipHash, ctx2.Value(CtxKBPClientIPHashKey))
+	require.NotEqual(t, ctx.Value(CtxKBPKey), ctx2.Value(CtxKBPKey))
+	r.RemoteAddr = "192.0.2.2:1234"
+	require.NotEqual(t, ipHash,
+		s.ctxWithRequestTags(r).Value(CtxKBPClientIPHashKey))
+}
@@ -0,0 +1,337 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Share links let a site owner hand out a single file or subtree to
+// people without Keybase accounts, without giving away the TLF's
+// keys.  The content is packed into an archive, encrypted under a
+// fresh random key, and written to the site as a new file under
+// ShareDir, so it's stored in new blocks of its own.  The key only
+// ever appears in the fragment of the share URL, which browsers don't
+// send to the server, so kbpagesd serves nothing but ciphertext.
+//
+// A sealed share is laid out as:
+//
+//   magic (4 bytes) | version (1 byte) | expiry (8 bytes) |
+//   nonce (12 bytes) | AES-256-GCM ciphertext
+//
+// where the expiry is a big-endian Unix time in seconds, and the
+// first 13 bytes are authenticated as additional data.  AES-GCM is
+// used, rather than NaCl's secretbox, so that recipients' browsers
+// can decrypt shares with WebCrypto.
+
+const (
+	// ShareDir is the directory, relative to a site's root, that
+	// share files are written to.  Paths under it are only ever
+	// served by the share handler.
+	ShareDir = ".kbp_shares"
+
+	// MaxShareSize is the largest plaintext that can be shared,
+	// since shares are encrypted and decrypted in one piece.
+	MaxShareSize = 64 << 20
+
+	shareMagic              = "kbps"
+	shareVersion            = 1
+	shareHeaderSize         = len(shareMagic) + 1 + 8
+	shareNonceSize          = 12
+	shareKeySize            = 32
+	shareIDSize             = 16
+	shareHeaderAndNonceSize = shareHeaderSize + shareNonceSize
+)
+
+// ErrShareExpired is returned when opening a share whose expiry has
+// passed.
+type ErrShareExpired struct {
+	Expires time.Time
+}
+
+// Error implements the error interface.
+func (e ErrShareExpired) Error() string {
+	return fmt.Sprintf("share expired at %s", e.Expires)
+}
+
+// ErrInvalidShare is returned when a share file is malformed, or
+// can't be decrypted with the given key.
+type ErrInvalidShare struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e ErrInvalidShare) Error() string {
+	return "invalid share: " + e.Reason
+}
+
+// ShareKey is the key a single share is encrypted with.
+type ShareKey [shareKeySize]byte
+
+// NewShareKey returns a new random ShareKey.
+func NewShareKey() (key ShareKey, err error) {
+	if _, err = rand.Read(key[:]); err != nil {
+		return ShareKey{}, err
+	}
+	return key, nil
+}
+
+// String returns the URL-safe encoding of the key used in share URL
+// fragments.
+func (k ShareKey) String() string {
+	return base64.RawURLEncoding.EncodeToString(k[:])
+}
+
+// ParseShareKey parses a key encoded by ShareKey.String.
+func ParseShareKey(s string) (key ShareKey, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ShareKey{}, err
+	}
+	if len(buf) != len(key) {
+		return ShareKey{}, ErrInvalidShare{Reason: "bad key length"}
+	}
+	copy(key[:], buf)
+	return key, nil
+}
+
+// NewShareID returns a new random name for a share file.
+func NewShareID() (string, error) {
+	buf := make([]byte, shareIDSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func isValidShareID(id string) bool {
+	buf, err := hex.DecodeString(id)
+	return err == nil && len(buf) == shareIDSize
+}
+
+// ShareURL returns the URL under which kbpagesd serves the share with
+// the given ID on `domain`, with the key in the fragment.
+func ShareURL(domain, id string, key ShareKey) string {
+	return "https://" + domain + "/" + ShareDir + "/" + id + "#" + key.String()
+}
+
+func makeShareHeader(expires time.Time) []byte {
+	header := make([]byte, shareHeaderSize)
+	copy(header, shareMagic)
+	header[len(shareMagic)] = shareVersion
+	binary.BigEndian.PutUint64(
+		header[len(shareMagic)+1:], uint64(expires.Unix()))
+	return header
+}
+
+func parseShareHeader(header []byte) (expires time.Time, err error) {
+	if len(header) < shareHeaderSize ||
+		!bytes.Equal(header[:len(shareMagic)], []byte(shareMagic)) {
+		return time.Time{}, ErrInvalidShare{Reason: "bad header"}
+	}
+	if v := header[len(shareMagic)]; v != shareVersion {
+		return time.Time{}, ErrInvalidShare{
+			Reason: fmt.Sprintf("unknown version %d", v)}
+	}
+	secs := binary.BigEndian.Uint64(header[len(shareMagic)+1:])
+	return time.Unix(int64(secs), 0), nil
+}
+
+// ReadShareExpiry reads just enough of a sealed share from `r` to
+// return when it expires.
+func ReadShareExpiry(r io.Reader) (time.Time, error) {
+	header := make([]byte, shareHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return time.Time{}, ErrInvalidShare{Reason: err.Error()}
+	}
+	return parseShareHeader(header)
+}
+
+func newShareAEAD(key ShareKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealShare encrypts `plaintext` under `key`, to be served until
+// `expires`.
+func SealShare(key ShareKey, expires time.Time, plaintext []byte) (
+	[]byte, error) {
+	if len(plaintext) > MaxShareSize {
+		return nil, errors.New("share is too large")
+	}
+	aead, err := newShareAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, shareHeaderAndNonceSize,
+		shareHeaderAndNonceSize+len(plaintext)+aead.Overhead())
+	copy(sealed, makeShareHeader(expires))
+	if _, err = rand.Read(sealed[shareHeaderSize:]); err != nil {
+		return nil, err
+	}
+	nonce := sealed[shareHeaderSize:shareHeaderAndNonceSize]
+	return aead.Seal(sealed, nonce, plaintext, sealed[:shareHeaderSize]), nil
+}
+
+// OpenShare decrypts a share sealed by SealShare, returning an
+// ErrShareExpired if it expired before `now`.
+func OpenShare(key ShareKey, sealed []byte, now time.Time) (
+	plaintext []byte, err error) {
+	if len(sealed) < shareHeaderAndNonceSize {
+		return nil, ErrInvalidShare{Reason: "too short"}
+	}
+	expires, err := parseShareHeader(sealed[:shareHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(expires) {
+		return nil, ErrShareExpired{Expires: expires}
+	}
+	aead, err := newShareAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[shareHeaderSize:shareHeaderAndNonceSize]
+	plaintext, err = aead.Open(nil, nonce,
+		sealed[shareHeaderAndNonceSize:], sealed[:shareHeaderSize])
+	if err != nil {
+		return nil, ErrInvalidShare{Reason: "decryption failed"}
+	}
+	return plaintext, nil
+}
+
+// shareHTML is served for share URLs.  It fetches the sealed share,
+// decrypts it with the key from the URL fragment, and offers the
+// archive for download, so the key never leaves the browser.
+const shareHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Keybase Pages share</title></head>
+<body>
+<p id="status">Decrypting&hellip;</p>
+<script>
+(function() {
+  var status = document.getElementById("status");
+  function fail(msg) { status.textContent = msg; }
+  var k = location.hash.slice(1).replace(/-/g, "+").replace(/_/g, "/");
+  while (k.length % 4) { k += "="; }
+  var key;
+  try {
+    key = Uint8Array.from(atob(k), function(c) { return c.charCodeAt(0); });
+  } catch (e) {
+    return fail("This link is missing its key.");
+  }
+  fetch(location.pathname + "?raw=1", {credentials: "omit"})
+    .then(function(resp) {
+      if (!resp.ok) { throw new Error("This share is gone or has expired."); }
+      return resp.arrayBuffer();
+    })
+    .then(function(buf) {
+      var sealed = new Uint8Array(buf);
+      return crypto.subtle.importKey("raw", key, "AES-GCM", false, ["decrypt"])
+        .then(function(ck) {
+          return crypto.subtle.decrypt({
+            name: "AES-GCM",
+            iv: sealed.subarray(13, 25),
+            additionalData: sealed.subarray(0, 13)
+          }, ck, sealed.subarray(25));
+        });
+    })
+    .then(function(plain) {
+      var a = document.createElement("a");
+      a.href = URL.createObjectURL(new Blob([plain], {type: "application/x-tar"}));
+      a.download = "share.tar";
+      a.textContent = "Download share.tar";
+      status.textContent = "";
+      status.appendChild(a);
+    }, function(e) {
+      fail(e.message || "Couldn't decrypt this share.");
+    });
+})();
+</script>
+</body>
+</html>
+`
+
+func isSharePath(requestPath string) bool {
+	p := path.Clean("/" + requestPath)
+	return p == "/"+ShareDir || strings.HasPrefix(p, "/"+ShareDir+"/")
+}
+
+// serveShare serves the share named by the request path.  Shares are
+// capabilities, meant for people who can't authenticate to the site,
+// so the site's ACLs don't apply to them; only the expiry does.
+// Without a "raw" query parameter, it serves the page that decrypts
+// the share; with one, it serves the sealed share itself.
+func (s *Server) serveShare(ctx context.Context,
+	w http.ResponseWriter, r *http.Request, st *site) {
+	id := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"+ShareDir+"/")
+	if !isValidShareID(id) {
+		// This also keeps the share directory from being listed.
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f, err := st.fs.WithContext(ctx).Open(path.Join(ShareDir, id))
+	switch {
+	case os.IsNotExist(err):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		s.handleError(w, err)
+		return
+	}
+	defer f.Close()
+
+	expires, err := ReadShareExpiry(f)
+	if err != nil {
+		s.config.Logger.Info("ReadShareExpiry",
+			zap.String("share", id), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !time.Now().Before(expires) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Referrer-Policy", "no-referrer")
+	if _, raw := r.URL.Query()["raw"]; !raw {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Security-Policy",
+			"default-src 'none'; script-src 'unsafe-inline'; "+
+				"connect-src 'self'")
+		io.WriteString(w, shareHTML)
+		return
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		s.handleError(w, err)
+		return
+	}
+	h.Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareSealOpen(t *testing.T) {
+	key, err := NewShareKey()
+	require.NoError(t, err)
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	plaintext := []byte("hello, world")
+
+	sealed, err := SealShare(key, expires, plaintext)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, plaintext))
+
+	got, err := OpenShare(key, sealed, now)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, got)
+
+	gotExpires, err := ReadShareExpiry(bytes.NewReader(sealed))
+	require.NoError(t, err)
+	require.Equal(t, expires.Unix(), gotExpires.Unix())
+
+	t.Log("Expired shares can't be opened")
+	_, err = OpenShare(key, sealed, expires)
+	require.IsType(t, ErrShareExpired{}, err)
+
+	t.Log("Neither can shares with a different key")
+	otherKey, err := NewShareKey()
+	require.NoError(t, err)
+	_, err = OpenShare(otherKey, sealed, now)
+	require.IsType(t, ErrInvalidShare{}, err)
+
+	t.Log("Or shares whose expiry was changed")
+	tampered := append([]byte(nil), sealed...)
+	copy(tampered, makeShareHeader(expires.Add(time.Hour)))
+	_, err = OpenShare(key, tampered, now)
+	require.IsType(t, ErrInvalidShare{}, err)
+}
+
+func TestShareKeyAndURL(t *testing.T) {
+	key, err := NewShareKey()
+	require.NoError(t, err)
+	parsed, err := ParseShareKey(key.String())
+	require.NoError(t, err)
+	require.Equal(t, key, parsed)
+
+	id, err := NewShareID()
+	require.NoError(t, err)
+	require.True(t, isValidShareID(id))
+	require.False(t, isValidShareID("../"+id))
+
+	u := ShareURL("example.com", id, key)
+	require.True(t, strings.HasSuffix(u, "#"+key.String()))
+	require.True(t, isSharePath("/"+ShareDir+"/"+id))
+	require.True(t, isSharePath("/"+ShareDir))
+	require.False(t, isSharePath("/index.html"))
+}
@@ -11,24 +11,143 @@ import (
 	"sync"
 	"time"
 
+	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/libpages/config"
+	"go.uber.org/zap"
 )
 
 const configCacheTime = 16 * time.Second
 
 type site struct {
-	// fs should never be changed once it's constructed.
-	fs *libfs.FS
+	// fs and root should never be changed once they're constructed.
+	fs   *libfs.FS
+	root Root
 
 	// TODO: replace this with a notification mechanism from the FBO.
 	cachedConfigLock      sync.RWMutex
 	cachedConfig          config.Config
 	cachedConfigExpiresAt time.Time
+	// cachedErrorPages are the contents of the error pages in the last
+	// config that could be loaded, keyed by error page key.  They're
+	// kept even if a later config can't be loaded, so they can still be
+	// served when KBFS can't be reached.
+	cachedErrorPages map[string][]byte
+
+	manifest manifestCache
+
+	logger    *zap.Logger
+	webhooks  *webhookDispatcher
+	updatesCh chan struct{}
+	cancel    context.CancelFunc
+	// lastRevision is only accessed by the watchForNewRevisions goroutine.
+	lastRevision kbfsmd.Revision
+}
+
+var _ libkbfs.Observer = (*site)(nil)
+
+// makeSite makes a site for fs, and starts watching its TLF for new
+// revisions so the webhooks in the site's config can be fired. The caller
+// must call shutdown once the site is no longer used.
+func makeSite(fs *libfs.FS, root Root, logger *zap.Logger,
+	webhooks *webhookDispatcher) (*site, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &site{
+		fs:        fs,
+		root:      root,
+		logger:    logger,
+		webhooks:  webhooks,
+		updatesCh: make(chan struct{}, 1),
+		cancel:    cancel,
+	}
+
+	fb := fs.FolderBranch()
+	status, _, err := fs.Config().KBFSOps().FolderStatus(ctx, fb)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.lastRevision = status.Revision
+	err = fs.Config().Notifier().RegisterForChanges(
+		[]libkbfs.FolderBranch{fb}, s)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go s.watchForNewRevisions(ctx)
+	return s, nil
+}
+
+func (s *site) shutdown() {
+	s.cancel()
+	err := s.fs.Config().Notifier().UnregisterFromChanges(
+		[]libkbfs.FolderBranch{s.fs.FolderBranch()}, s)
+	if err != nil {
+		s.logger.Warn("site.shutdown: UnregisterFromChanges", zap.Error(err))
+	}
+}
+
+// LocalChange implements the libkbfs.Observer interface for site.
+func (s *site) LocalChange(
+	ctx context.Context, node libkbfs.Node, write libkbfs.WriteRange) {
+}
+
+// BatchChanges implements the libkbfs.Observer interface for site.
+func (s *site) BatchChanges(
+	ctx context.Context, changes []libkbfs.NodeChange) {
+	// Observers are called with KBFS locks held, so just poke the watcher
+	// goroutine.  Changes that arrive while it's busy get coalesced.
+	select {
+	case s.updatesCh <- struct{}{}:
+	default:
+	}
 }
 
-func makeSite(fs *libfs.FS) *site {
-	return &site{fs: fs}
+// TlfHandleChange implements the libkbfs.Observer interface for site.
+func (s *site) TlfHandleChange(
+	ctx context.Context, newHandle *libkbfs.TlfHandle) {
+}
+
+func (s *site) watchForNewRevisions(ctx context.Context) {
+	for {
+		select {
+		case <-s.updatesCh:
+			s.fireWebhooksIfNewRevision(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *site) fireWebhooksIfNewRevision(ctx context.Context) {
+	status, _, err := s.fs.Config().KBFSOps().FolderStatus(
+		ctx, s.fs.FolderBranch())
+	if err != nil {
+		s.logger.Warn("site.FolderStatus", zap.Error(err))
+		return
+	}
+	if status.Revision <= s.lastRevision {
+		return
+	}
+	s.lastRevision = status.Revision
+
+	// The new revision may have changed the config too.
+	cfg, err := s.getConfig(true)
+	if err != nil {
+		s.logger.Info("site.getConfig", zap.Error(err))
+		return
+	}
+	webhooks := cfg.GetWebhooks()
+	if len(webhooks) == 0 {
+		return
+	}
+	s.webhooks.dispatchNewRevision(ctx, webhooks, WebhookPayload{
+		TlfType:  s.root.TlfType.String(),
+		Tlf:      s.root.TlfNameUnparsed,
+		Path:     s.root.PathUnparsed,
+		Revision: int64(status.Revision),
+	})
 }
 
 func (s *site) getCachedConfig() (cfg config.Config, expiresAt time.Time) {
@@ -62,7 +181,13 @@ func (s *site) fetchConfigAndRefreshCache() (cfg config.Config, err error) {
 		return nil, err
 	}
 
+	errorPages, err := s.loadErrorPages(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	s.cachedConfig = cfg
+	s.cachedErrorPages = errorPages
 	s.cachedConfigExpiresAt = time.Now().Add(configCacheTime)
 
 	return cfg, nil
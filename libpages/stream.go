@@ -0,0 +1,61 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// streamBufSize is the size of the buffers file contents are copied
+// through on their way into responses.  It matches the largest KBFS
+// block, so that copying a large file takes one KBFS read per block,
+// rather than one per 32 KiB as io.Copy would do.
+const streamBufSize = libkbfs.MaxBlockSizeBytesDefault
+
+var streamBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, streamBufSize)
+		return &buf
+	},
+}
+
+// writerOnly hides any io.ReaderFrom implementation of the wrapped
+// writer, so io.CopyBuffer uses the buffer it's given.
+type writerOnly struct {
+	io.Writer
+}
+
+// streamingResponseWriter is an http.ResponseWriter that copies
+// whatever http.FileServer hands to its ReadFrom through a pooled,
+// block-sized buffer, and straight into the wrapped writer.  The
+// decrypted data read out of the block cache is thus only copied once
+// before it's written to the connection, and nothing is allocated
+// per response.  This works the same for HTTP/1.1 and HTTP/2
+// responses; the latter don't implement io.ReaderFrom at all.
+type streamingResponseWriter struct {
+	http.ResponseWriter
+}
+
+var _ io.ReaderFrom = streamingResponseWriter{}
+
+// ReadFrom implements the io.ReaderFrom interface for
+// streamingResponseWriter.
+func (w streamingResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	bufp := streamBufPool.Get().(*[]byte)
+	defer streamBufPool.Put(bufp)
+	return io.CopyBuffer(writerOnly{w.ResponseWriter}, r, *bufp)
+}
+
+// Flush implements the http.Flusher interface for
+// streamingResponseWriter, if the wrapped writer supports it.
+func (w streamingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
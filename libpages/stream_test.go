@@ -0,0 +1,105 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestStreamFS(t testing.TB, size int) (
+	context.Context, libkbfs.Config, *libfs.FS, []byte) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	kbfsConfig := libkbfs.MakeTestConfigOrBust(t, "user1")
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, kbfsConfig.KBPKI(), kbfsConfig.MDOps(), "user1", tlf.Public)
+	require.NoError(t, err)
+	fs, err := libfs.NewFS(
+		ctx, kbfsConfig, h, "", "", keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	f, err := fs.Create("big.bin")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.SyncAll())
+	return ctx, kbfsConfig, fs, data
+}
+
+func TestStreamingResponseWriter(t *testing.T) {
+	ctx, kbfsConfig, fs, data := makeTestStreamFS(t, 3*streamBufSize+17)
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, kbfsConfig)
+	handler := http.FileServer(fs.ToHTTPFileSystem(ctx))
+
+	r := httptest.NewRequest("GET", "/big.bin", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(streamingResponseWriter{w}, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, bytes.Equal(data, w.Body.Bytes()))
+
+	t.Log("Ranges are streamed too")
+	r = httptest.NewRequest("GET", "/big.bin", nil)
+	r.Header.Set("Range", "bytes=100-600099")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(streamingResponseWriter{w}, r)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	require.True(t, bytes.Equal(data[100:600100], w.Body.Bytes()))
+}
+
+// discardResponseWriter is an http.ResponseWriter that throws away
+// the body, like an HTTP/2 response, which has no io.ReaderFrom.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w discardResponseWriter) WriteHeader(int) {}
+
+func benchmarkServeLargeFile(b *testing.B, streaming bool) {
+	const size = 16 << 20
+	ctx, kbfsConfig, fs, _ := makeTestStreamFS(b, size)
+	defer libkbfs.CheckConfigAndShutdown(ctx, b, kbfsConfig)
+	handler := http.FileServer(fs.ToHTTPFileSystem(ctx))
+	r := httptest.NewRequest("GET", "/big.bin", nil)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var w http.ResponseWriter = discardResponseWriter{make(http.Header)}
+		if streaming {
+			w = streamingResponseWriter{w}
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+func BenchmarkServeLargeFileCopy(b *testing.B) {
+	benchmarkServeLargeFile(b, false)
+}
+
+func BenchmarkServeLargeFileStreaming(b *testing.B) {
+	benchmarkServeLargeFile(b, true)
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/libpages/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	webhookTimeout      = 16 * time.Second
+	webhookMaxAttempts  = 3
+	webhookRetryBackoff = 4 * time.Second
+
+	// WebhookEventHeader is the HTTP header carrying the type of event a
+	// webhook callback is for.
+	WebhookEventHeader = "X-Kbp-Event"
+	// WebhookSignatureHeader is the HTTP header carrying the signature of a
+	// webhook callback's body, as "sha256=" followed by the hex-encoded
+	// HMAC-SHA256 of the body, keyed with the webhook's secret. It's only
+	// set for webhooks that have a secret.
+	WebhookSignatureHeader = "X-Kbp-Signature"
+
+	webhookEventNewRevision = "new_revision"
+)
+
+// WebhookPayload is the JSON body of a webhook callback.
+type WebhookPayload struct {
+	// TlfType and Tlf identify the TLF hosting the site, and Path is the
+	// site's root directory within the TLF.
+	TlfType string `json:"tlf_type"`
+	Tlf     string `json:"tlf"`
+	Path    string `json:"path"`
+	// Revision is the new revision of the TLF.
+	Revision int64 `json:"revision"`
+}
+
+// ErrWebhookStatus is returned when a webhook endpoint responds with a
+// non-2xx status code.
+type ErrWebhookStatus struct {
+	StatusCode int
+}
+
+// Error implements the error interface.
+func (e ErrWebhookStatus) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.StatusCode)
+}
+
+func (e ErrWebhookStatus) isRetriable() bool {
+	return e.StatusCode >= http.StatusInternalServerError ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher POSTs webhook callbacks, retrying the ones that fail
+// because of network errors or server-side errors.
+type webhookDispatcher struct {
+	client       *http.Client
+	logger       *zap.Logger
+	retryBackoff time.Duration
+}
+
+func makeWebhookDispatcher(logger *zap.Logger) *webhookDispatcher {
+	return &webhookDispatcher{
+		client:       &http.Client{Timeout: webhookTimeout},
+		logger:       logger,
+		retryBackoff: webhookRetryBackoff,
+	}
+}
+
+func (d *webhookDispatcher) post(ctx context.Context,
+	webhook config.Webhook, event string, body []byte) error {
+	req, err := http.NewRequest(
+		http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event)
+	if webhook.Secret != "" {
+		req.Header.Set(
+			WebhookSignatureHeader, signWebhookBody(webhook.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ErrWebhookStatus{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) fire(ctx context.Context,
+	webhook config.Webhook, event string, body []byte) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = d.post(ctx, webhook, event, body)
+		if err == nil {
+			return nil
+		}
+		if statusErr, ok := err.(ErrWebhookStatus); ok &&
+			!statusErr.isRetriable() {
+			return err
+		}
+		if attempt >= webhookMaxAttempts {
+			return err
+		}
+		d.logger.Info("webhook.fire: retrying",
+			zap.String("url", webhook.URL),
+			zap.Int("attempt", attempt), zap.Error(err))
+		select {
+		case <-time.After(d.retryBackoff * time.Duration(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// dispatchNewRevision fires all the given webhooks, in parallel, for a new
+// revision of a site's TLF. It returns once they have all either succeeded
+// or given up.
+func (d *webhookDispatcher) dispatchNewRevision(ctx context.Context,
+	webhooks []config.Webhook, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.logger.Error("webhook.dispatch: json.Marshal", zap.Error(err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, webhook := range webhooks {
+		wg.Add(1)
+		go func(webhook config.Webhook) {
+			defer wg.Done()
+			err := d.fire(ctx, webhook, webhookEventNewRevision, body)
+			fields := []zapcore.Field{
+				zap.String("tlf", payload.Tlf),
+				zap.Int64("revision", payload.Revision),
+				zap.String("url", webhook.URL),
+			}
+			if err != nil {
+				d.logger.Warn("webhook.dispatch",
+					append(fields, zap.Error(err))...)
+				return
+			}
+			d.logger.Info("webhook.dispatch", fields...)
+		}(webhook)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libpages
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libpages/config"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type testWebhookEndpoint struct {
+	t *testing.T
+
+	lock      sync.Mutex
+	statuses  []int
+	requests  int
+	bodies    [][]byte
+	signature string
+}
+
+func (e *testWebhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(e.t, err)
+	require.Equal(e.t, webhookEventNewRevision, r.Header.Get(WebhookEventHeader))
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.bodies = append(e.bodies, body)
+	e.signature = r.Header.Get(WebhookSignatureHeader)
+	status := http.StatusOK
+	if e.requests < len(e.statuses) {
+		status = e.statuses[e.requests]
+	}
+	e.requests++
+	w.WriteHeader(status)
+}
+
+func makeTestWebhookDispatcher(t *testing.T) *webhookDispatcher {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	d := makeWebhookDispatcher(logger)
+	d.retryBackoff = time.Millisecond
+	return d
+}
+
+func TestWebhookDispatcherSignsPayload(t *testing.T) {
+	endpoint := &testWebhookEndpoint{t: t}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	payload := WebhookPayload{
+		TlfType:  "private",
+		Tlf:      "alice",
+		Path:     "www",
+		Revision: 42,
+	}
+	d := makeTestWebhookDispatcher(t)
+	d.dispatchNewRevision(context.Background(), []config.Webhook{
+		{URL: server.URL, Secret: "shh"},
+	}, payload)
+
+	require.Equal(t, 1, endpoint.requests)
+	var received WebhookPayload
+	err := json.Unmarshal(endpoint.bodies[0], &received)
+	require.NoError(t, err)
+	require.Equal(t, payload, received)
+	require.Equal(t,
+		signWebhookBody("shh", endpoint.bodies[0]), endpoint.signature)
+	require.NotEqual(t,
+		signWebhookBody("not shh", endpoint.bodies[0]), endpoint.signature)
+
+	// No signature without a secret.
+	d.dispatchNewRevision(context.Background(), []config.Webhook{
+		{URL: server.URL},
+	}, payload)
+	require.Equal(t, 2, endpoint.requests)
+	require.Equal(t, "", endpoint.signature)
+}
+
+func TestWebhookDispatcherRetries(t *testing.T) {
+	endpoint := &testWebhookEndpoint{t: t, statuses: []int{
+		http.StatusServiceUnavailable, http.StatusTooManyRequests,
+	}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	d := makeTestWebhookDispatcher(t)
+	webhook := config.Webhook{URL: server.URL}
+	err := d.fire(context.Background(), webhook, webhookEventNewRevision, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, endpoint.requests)
+
+	t.Log("Give up after webhookMaxAttempts server errors")
+	endpoint.requests = 0
+	endpoint.statuses = []int{500, 500, 500, 500}
+	err = d.fire(context.Background(), webhook, webhookEventNewRevision, nil)
+	require.Equal(t, ErrWebhookStatus{StatusCode: 500}, err)
+	require.Equal(t, webhookMaxAttempts, endpoint.requests)
+
+	t.Log("Client errors aren't retried")
+	endpoint.requests = 0
+	endpoint.statuses = []int{http.StatusNotFound}
+	err = d.fire(context.Background(), webhook, webhookEventNewRevision, nil)
+	require.Equal(t, ErrWebhookStatus{StatusCode: http.StatusNotFound}, err)
+	require.Equal(t, 1, endpoint.requests)
+}
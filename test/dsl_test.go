@@ -494,6 +494,31 @@ func as(user username, fops ...fileOp) optionOp {
 	}
 }
 
+// device returns the name of the `i`th extra device of `user`, as
+// added by addDevice().  It can be passed to as() like a user.
+func device(user username, i int) username {
+	return username(fmt.Sprintf("%s#%d", user, i))
+}
+
+// addDevice logs `user` in on a new device named device(user, i).
+// The new device can't read existing private TLFs until one of the
+// user's other devices rekeys them.
+func addDevice(user username, i int) optionOp {
+	return func(o *opt) {
+		o.tb.Log("addDevice:", user, i)
+		o.runInitOnce()
+		u := libkb.NewNormalizedUsername(string(user))
+		d := libkb.NewNormalizedUsername(string(device(user, i)))
+		if _, ok := o.users[d]; ok {
+			o.tb.Fatalf("Device %s already exists", d)
+		}
+		newDevice, err := o.engine.AddDevice(o.users[u])
+		o.expectSuccess("AddDevice", err)
+		o.users[d] = newDevice
+		o.stallers[d] = o.engine.MakeNaïveStaller(newDevice)
+	}
+}
+
 // initRoot initializes the root for an invocation of as(). Usually
 // not called directly.
 func initRoot() fileOp {
@@ -903,6 +928,15 @@ func rekey() fileOp {
 	}, IsInit, "rekey()"}
 }
 
+// checkState verifies that the server-side state of the TLF is
+// consistent.  It should only be used once all devices have synced
+// and resolved any conflicts.
+func checkState() fileOp {
+	return fileOp{func(c *ctx) error {
+		return c.engine.CheckState(c.user, c.tlfName, c.tlfType)
+	}, IsInit, "checkState()"}
+}
+
 func enableJournal() fileOp {
 	return fileOp{func(c *ctx) error {
 		return c.engine.EnableJournal(c.user, c.tlfName, c.tlfType)
@@ -131,6 +131,15 @@ type Engine interface {
 	ChangeTeamName(u User, oldName, newName string) (err error)
 	// Rekey rekeys the given TLF under the given user.
 	Rekey(u User, tlfName string, t tlf.Type) (err error)
+	// AddDevice is called by the test harness to log the given
+	// user in on a new device, returning a new user instance for
+	// that device.  The new device can't read existing private
+	// TLFs until they are rekeyed by another device.
+	AddDevice(u User) (device User, err error)
+	// CheckState is called by the test harness as the given user
+	// to verify that the server-side state of the given TLF is
+	// consistent, once every device has synced.
+	CheckState(u User, tlfName string, t tlf.Type) (err error)
 	// EnableJournal is called by the test harness as the given
 	// user to enable journaling.
 	EnableJournal(u User, tlfName string, t tlf.Type) (err error)
@@ -11,6 +11,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
 )
 
 func setBlockSizes(t testing.TB, config libkbfs.Config, blockSize, blockChangeSize int64) {
@@ -102,3 +103,20 @@ func makeImplicitTeams(t testing.TB, config libkbfs.Config, e Engine,
 		}
 	}
 }
+
+// checkMergedState verifies the server-side state of the given TLF, after
+// syncing `config` with the server.
+func checkMergedState(ctx context.Context, config libkbfs.Config, tlfName string,
+	t tlf.Type) error {
+	dir, err := getRootNode(ctx, config, tlfName, t)
+	if err != nil {
+		return err
+	}
+	err = config.KBFSOps().SyncFromServerForTesting(
+		ctx, dir.GetFolderBranch(), nil)
+	if err != nil {
+		return err
+	}
+	return libkbfs.NewStateChecker(config).CheckMergedState(
+		ctx, dir.GetFolderBranch().Tlf)
+}
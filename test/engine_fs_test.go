@@ -36,6 +36,10 @@ type fsEngine struct {
 	name       string
 	tb         testing.TB
 	createUser createUserFn
+	// number of user instances created so far, including devices
+	numUsers int
+	// timeout for all KBFS calls
+	opTimeout time.Duration
 	// journal directory
 	journalDir string
 }
@@ -342,6 +346,23 @@ func (*fsEngine) Rekey(user User, tlfName string, t tlf.Type) error {
 		[]byte("x"), 0644)
 }
 
+// AddDevice implements the Engine interface.
+func (e *fsEngine) AddDevice(user User) (User, error) {
+	u := user.(*fsUser)
+	c := libkbfs.ConfigAsUserOnNewDeviceOrBust(e.tb, u.config, u.username)
+	c.SetBlockSplitter(u.config.BlockSplitter())
+	c.SetBGFlushDirOpBatchSize(u.config.BGFlushDirOpBatchSize())
+	device := e.createUser(e.tb, e.numUsers, c, e.opTimeout)
+	e.numUsers++
+	return device, nil
+}
+
+// CheckState implements the Engine interface.
+func (*fsEngine) CheckState(user User, tlfName string, t tlf.Type) error {
+	u := user.(*fsUser)
+	return checkMergedState(context.Background(), u.config, tlfName, t)
+}
+
 // EnableJournal is called by the test harness as the given user to
 // enable journaling.
 func (*fsEngine) EnableJournal(user User, tlfName string,
@@ -619,6 +640,8 @@ func (e *fsEngine) InitTest(ver kbfsmd.MetadataVer,
 	for i, name := range users {
 		res[name] = e.createUser(e.tb, i, cfgs[i], opTimeout)
 	}
+	e.numUsers = len(users)
+	e.opTimeout = opTimeout
 
 	if journal {
 		jdir, err := ioutil.TempDir(os.TempDir(), "kbfs_journal")
@@ -633,6 +633,34 @@ func (k *LibKBFS) Rekey(u User, tlfName string, t tlf.Type) error {
 	return err
 }
 
+// AddDevice implements the Engine interface.
+func (k *LibKBFS) AddDevice(u User) (User, error) {
+	config := u.(*libkbfs.ConfigLocal)
+
+	ctx, cancel := k.newContext(u)
+	defer cancel()
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := libkbfs.ConfigAsUserOnNewDeviceOrBust(k.tb, config, session.Name)
+	c.SetBlockSplitter(config.BlockSplitter())
+	c.SetBGFlushDirOpBatchSize(config.BGFlushDirOpBatchSize())
+	k.refs[c] = make(map[libkbfs.Node]bool)
+	k.updateChannels[c] = make(map[libkbfs.FolderBranch]chan<- struct{})
+	return c, nil
+}
+
+// CheckState implements the Engine interface.
+func (k *LibKBFS) CheckState(u User, tlfName string, t tlf.Type) error {
+	config := u.(*libkbfs.ConfigLocal)
+
+	ctx, cancel := k.newContext(u)
+	defer cancel()
+	return checkMergedState(ctx, config, tlfName, t)
+}
+
 // EnableJournal implements the Engine interface.
 func (k *LibKBFS) EnableJournal(u User, tlfName string, t tlf.Type) error {
 	config := u.(*libkbfs.ConfigLocal)
@@ -0,0 +1,73 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// These tests script operations across several devices of the same
+// user, some of them partitioned from the server's updates.
+
+package test
+
+import (
+	"testing"
+)
+
+// alice's new device can read the TLF once her first device rekeys it.
+func TestMultiDeviceRekeyNewDevice(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a", "hello"),
+		),
+		addDevice(alice, 1),
+		as(alice,
+			rekey(),
+		),
+		as(device(alice, 1),
+			read("a", "hello"),
+			write("b", "world"),
+		),
+		as(bob,
+			read("a", "hello"),
+			read("b", "world"),
+			checkState(),
+		),
+	)
+}
+
+// alice's second device goes offline and writes, while her first
+// device writes and rekeys the TLF for a third device.  All devices
+// converge once the second device comes back.
+func TestMultiDeviceRekeyWhileOffline(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		addDevice(alice, 1),
+		as(alice,
+			mkfile("a", "hello"),
+			rekey(),
+		),
+		as(device(alice, 1),
+			read("a", "hello"),
+			disableUpdates(),
+		),
+		addDevice(alice, 2),
+		as(alice,
+			write("b", "world"),
+			rekey(),
+		),
+		as(device(alice, 1), noSync(),
+			write("c", "offline"),
+			reenableUpdates(),
+			lsdir("", m{"a": "FILE", "b": "FILE", "c": "FILE"}),
+		),
+		as(device(alice, 2),
+			lsdir("", m{"a": "FILE", "b": "FILE", "c": "FILE"}),
+			read("a", "hello"),
+			read("b", "world"),
+			read("c", "offline"),
+		),
+		as(bob,
+			lsdir("", m{"a": "FILE", "b": "FILE", "c": "FILE"}),
+			checkState(),
+		),
+	)
+}